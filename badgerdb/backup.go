@@ -0,0 +1,83 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"os"
+)
+
+// backupProgressSize is the number of bytes of keys and values copied between
+// calls to the progress function while backing up a database.
+const backupProgressSize = 4 * 1024 * 1024 // 4 MB
+
+// Backup writes a copy of the database as of the time it is called to a new
+// database in the directory at the passed path, which must not exist yet.
+// This is part of the btcdb.Db interface implementation.
+//
+// Every key is copied from a single read transaction, which sees the database
+// as of the time it was started while changes continue to be committed.
+func (db *BadgerDb) Backup(destPath string, progress func(copied int64)) (rerr error) {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination %v already exists",
+			destPath)
+	}
+
+	opts := badger.DefaultOptions(destPath).
+		WithValueThreshold(DefaultValueThreshold).
+		WithLogger(badgerLogger{})
+	dest, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dest.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+		if rerr != nil {
+			os.RemoveAll(destPath)
+		}
+	}()
+
+	wb := dest.NewWriteBatch()
+	defer wb.Cancel()
+
+	var copied, reported int64
+	err = db.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			key := item.KeyCopy(nil)
+			if err := wb.Set(key, value); err != nil {
+				return err
+			}
+			copied += int64(len(key) + len(value))
+			if progress != nil && copied-reported >= backupProgressSize {
+				progress(copied)
+				reported = copied
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(copied)
+	}
+	return nil
+}
@@ -0,0 +1,1682 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/dgraph-io/badger"
+	"math"
+	"sync"
+)
+
+// Badger has a single key space, so every key is prefixed by the kind of
+// record it refers to:
+//
+//	b | block height (8 bytes big endian) -> block hash | raw block
+//	h | block hash                        -> block height (8 bytes little endian)
+//	t | transaction hash                  -> transaction records
+//	s | tx hash | output index (4 bytes)  -> spending tx hash | height | input
+//	                                         index, when the spend index is on
+//	f | block height (8 bytes big endian) -> filter header | basic filter,
+//	                                         when filters are on
+//	w | block height (8 bytes big endian) -> cumulative chain work (big
+//	                                         endian)
+//	m | name                              -> miscellaneous state such as the
+//	                                         unspent output set size
+//	u | metadata namespace key            -> value
+//
+// Block heights are stored big endian so the blocks iterate in height order.
+var (
+	blockPrefix       = []byte("b")
+	blockHeightPrefix = []byte("h")
+	txPrefix          = []byte("t")
+	spendPrefix       = []byte("s")
+	filterPrefix      = []byte("f")
+	workPrefix        = []byte("w")
+	metaPrefix        = []byte("m")
+	userMetaPrefix    = []byte("u")
+
+	utxoSetSizeKey = prefixedKey(metaPrefix, []byte("utxosetsize"))
+	spendIndexKey  = prefixedKey(metaPrefix, []byte("spendindex"))
+	filterIndexKey = prefixedKey(metaPrefix, []byte("filterindex"))
+	chainWorkKey   = prefixedKey(metaPrefix, []byte("chainwork"))
+)
+
+const (
+	// DefaultValueThreshold is the size in bytes above which Badger moves
+	// values out of the tree and into the value log when no other size is
+	// specified.  It is chosen so every raw block lives in the value log
+	// while the index records stay in the tree.
+	DefaultValueThreshold = 64
+
+	// ValueThresholdOption is the key of the btcdb.Options Backend setting
+	// which overrides DefaultValueThreshold.
+	ValueThresholdOption = "valuethreshold"
+)
+
+var zeroHash = btcwire.ShaHash{}
+
+// txRecordHeaderLen is the length of the fixed portion of a serialized
+// transaction record:
+//
+//	block height (8) | tx offset (4) | tx length (4) | index in block (4) |
+//	number of outputs (4)
+//
+// It is followed by the spent bits of the outputs.  All integers are little
+// endian.
+const txRecordHeaderLen = 8 + 4 + 4 + 4 + 4
+
+// txRecord holds information about the location and spent status of a single
+// instance of a transaction.  A transaction hash may have several instances
+// so long as all but the most recent one are fully spent.
+type txRecord struct {
+	blockHeight int64
+	txOff       int
+	txLen       int
+	txIdx       int
+	spent       []bool
+}
+
+// isCoinbaseInput returns whether or not the passed transaction input is a
+// coinbase input.
+func isCoinbaseInput(txIn *btcwire.TxIn) bool {
+	prevOut := &txIn.PreviousOutpoint
+	if prevOut.Index == math.MaxUint32 && prevOut.Hash.IsEqual(&zeroHash) {
+		return true
+	}
+
+	return false
+}
+
+// unspentCount returns the number of unspent outputs of the passed transaction
+// record.
+func unspentCount(rec *txRecord) int64 {
+	var count int64
+	for _, spent := range rec.spent {
+		if !spent {
+			count++
+		}
+	}
+	return count
+}
+
+// isFullySpent returns whether or not all outputs of the passed transaction
+// record are spent.
+func isFullySpent(rec *txRecord) bool {
+	return unspentCount(rec) == 0
+}
+
+// prefixedKey returns the passed key prefixed by the given record kind.
+func prefixedKey(prefix, key []byte) []byte {
+	buf := make([]byte, len(prefix)+len(key))
+	copy(buf, prefix)
+	copy(buf[len(prefix):], key)
+	return buf
+}
+
+// heightToKey returns the key for the block at the given height.
+func heightToKey(height int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(height))
+	return prefixedKey(blockPrefix, buf[:])
+}
+
+// keyToHeight returns the height of the block with the passed key.
+func keyToHeight(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(blockPrefix):]))
+}
+
+// serializeTxRecords returns the value stored for the passed records of a
+// transaction hash.
+func serializeTxRecords(recs []*txRecord) []byte {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		var hdr [txRecordHeaderLen]byte
+		binary.LittleEndian.PutUint64(hdr[0:], uint64(rec.blockHeight))
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(rec.txOff))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(rec.txLen))
+		binary.LittleEndian.PutUint32(hdr[16:], uint32(rec.txIdx))
+		binary.LittleEndian.PutUint32(hdr[20:], uint32(len(rec.spent)))
+		buf.Write(hdr[:])
+
+		spentBits := make([]byte, (len(rec.spent)+7)/8)
+		for i, spent := range rec.spent {
+			if spent {
+				spentBits[i/8] |= byte(1) << uint(i%8)
+			}
+		}
+		buf.Write(spentBits)
+	}
+	return buf.Bytes()
+}
+
+// deserializeTxRecords decodes the value stored for a transaction hash.
+func deserializeTxRecords(buf []byte) ([]*txRecord, error) {
+	var recs []*txRecord
+	for len(buf) != 0 {
+		if len(buf) < txRecordHeaderLen {
+			return nil, btcdb.ErrCorruption
+		}
+		numOut := int(binary.LittleEndian.Uint32(buf[20:]))
+		spentLen := (numOut + 7) / 8
+		if len(buf) < txRecordHeaderLen+spentLen {
+			return nil, btcdb.ErrCorruption
+		}
+
+		rec := txRecord{
+			blockHeight: int64(binary.LittleEndian.Uint64(buf[0:])),
+			txOff:       int(binary.LittleEndian.Uint32(buf[8:])),
+			txLen:       int(binary.LittleEndian.Uint32(buf[12:])),
+			txIdx:       int(binary.LittleEndian.Uint32(buf[16:])),
+			spent:       make([]bool, numOut),
+		}
+		spentBits := buf[txRecordHeaderLen : txRecordHeaderLen+spentLen]
+		for i := range rec.spent {
+			rec.spent[i] = spentBits[i/8]&(byte(1)<<uint(i%8)) != 0
+		}
+		recs = append(recs, &rec)
+		buf = buf[txRecordHeaderLen+spentLen:]
+	}
+	return recs, nil
+}
+
+// badgerLogger forwards the log messages of Badger to the btcdb logger.
+type badgerLogger struct{}
+
+func (badgerLogger) Errorf(format string, v ...interface{}) {
+	log.Errorf(format, v...)
+}
+
+func (badgerLogger) Warningf(format string, v ...interface{}) {
+	log.Warnf(format, v...)
+}
+
+func (badgerLogger) Infof(format string, v ...interface{}) {
+	log.Debugf(format, v...)
+}
+
+func (badgerLogger) Debugf(format string, v ...interface{}) {
+	log.Tracef(format, v...)
+}
+
+// BadgerDb is a concrete implementation of the btcdb.Db interface which stores
+// the block chain in a Badger database directory.
+type BadgerDb struct {
+	db *badger.DB
+
+	// metrics receives the measurements of the operations of the database.
+	metrics btcdb.Metrics
+
+	// validation selects the checks performed on each inserted block.
+	validation btcdb.ValidationMode
+
+	// blockCache holds the blocks most recently fetched and inserted.  It
+	// is nil when blocks are not cached and for snapshots, which may not
+	// see every block it holds.
+	blockCache *btcdb.BlockCache
+
+	// prefetch is the number of blocks read ahead by block iterators and
+	// readAhead reads the blocks following those fetched in height order
+	// into the block cache.  readAhead is nil without a block cache and
+	// for snapshots.
+	prefetch  int
+	readAhead *btcdb.ReadAhead
+
+	// writeLock serializes the transactions which modify the database so
+	// their events reach subscribers in commit order.  pending holds the
+	// events of the transaction being run until it commits, committed the
+	// functions run once it commits and indexers the secondary indexes
+	// updated within the same transactions.
+	writeLock sync.Mutex
+	pending   []btcdb.ChainEvent
+	committed []func()
+	notifier  btcdb.Notifier
+	indexers  btcdb.IndexerSet
+
+	// closed is set once the database has been closed and readOnly when it
+	// was opened without allowing changes.  closeLock is held for reading
+	// by every transaction and for writing by Close, so closing waits for
+	// the transactions in progress and those begun later see closed set.
+	closeLock sync.RWMutex
+	closed    bool
+	readOnly  bool
+
+	// syncer performs the periodic syncs of the SyncPeriodic policy.
+	syncer btcdb.PeriodicSyncer
+
+	// lock keeps other processes from opening the database while it is
+	// open.
+	lock *btcdb.DbLock
+
+	// snap is the read transaction all reads go through when the instance
+	// is a snapshot of the database rather than the database itself.
+	snap *snapshotTxn
+}
+
+// openDB opens or creates the Badger database in the directory of the passed
+// options.  Badger does not compress its data or keep a cache of its own, so
+// those settings of the options do not apply.
+func openDB(dbOpts *btcdb.Options) (btcdb.Db, error) {
+	valueThreshold := DefaultValueThreshold
+	if arg, ok := dbOpts.Backend[ValueThresholdOption]; ok {
+		threshold, ok := arg.(int)
+		if !ok || threshold <= 0 {
+			return nil, fmt.Errorf("%s setting is invalid -- "+
+				"expected positive integer", ValueThresholdOption)
+		}
+		valueThreshold = threshold
+	}
+
+	opts := badger.DefaultOptions(dbOpts.Path).
+		WithValueThreshold(valueThreshold).
+		WithSyncWrites(dbOpts.Sync == btcdb.SyncAlways).
+		WithReadOnly(dbOpts.ReadOnly).
+		WithLogger(badgerLogger{})
+	if dbOpts.WriteBufferSize > 0 {
+		opts = opts.WithMaxTableSize(int64(dbOpts.WriteBufferSize))
+	}
+
+	// Other processes are kept from opening the database at the same
+	// time.
+	lock, err := btcdb.LockDb(dbOpts.Path, dbOpts.ForceOpen)
+	if err != nil {
+		return nil, err
+	}
+	bdb, err := badger.Open(opts)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	db := &BadgerDb{db: bdb, lock: lock, readOnly: dbOpts.ReadOnly,
+		metrics:    btcdb.DriverMetrics(dbOpts),
+		validation: dbOpts.Validation,
+		blockCache: btcdb.NewBlockCache(dbOpts.BlockCacheSize),
+		prefetch:   dbOpts.PrefetchDepth}
+	if db.blockCache != nil {
+		db.readAhead = btcdb.NewReadAhead(dbOpts.PrefetchDepth,
+			db.readAheadBlock)
+	}
+
+	// Databases created before the cumulative chain work was stored get
+	// it added now.
+	if !db.readOnly {
+		if err := db.update(buildChainWork); err != nil {
+			bdb.Close()
+			lock.Unlock()
+			return nil, err
+		}
+		if dbOpts.Sync == btcdb.SyncPeriodic {
+			db.syncer.Start(dbOpts.SyncInterval, db.Sync)
+		}
+	}
+	return db, nil
+}
+
+// view runs the passed function in a read-only Badger transaction.
+func (db *BadgerDb) view(fn func(txn *badger.Txn) error) error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.snap != nil {
+		return db.snap.view(fn)
+	}
+	return db.db.View(fn)
+}
+
+// update runs the passed function in a read-write Badger transaction which is
+// committed when the function succeeds.
+func (db *BadgerDb) update(fn func(txn *badger.Txn) error) error {
+	return db.updateOp(btcdb.StartOp(btcdb.DiscardMetrics, "", nil), fn)
+}
+
+// updateOp behaves the same as update while recording the time the passed
+// operation waited for the write lock.  The statistics of Badger are reported
+// once the transaction is committed.
+func (db *BadgerDb) updateOp(op *btcdb.OpTimer, fn func(txn *badger.Txn) error) error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	db.writeLock.Lock()
+	op.Locked()
+	defer db.writeLock.Unlock()
+
+	db.pending, db.committed = nil, nil
+	if err := db.db.Update(fn); err != nil {
+		db.pending, db.committed = nil, nil
+		return err
+	}
+	for _, fn := range db.committed {
+		fn()
+	}
+	db.notifier.Notify(db.pending...)
+	db.pending, db.committed = nil, nil
+	db.reportStats()
+	return nil
+}
+
+// onCommit runs the passed function once the transaction being run by update
+// commits, while the write lock is still held.  It is not run when the
+// transaction fails.  Must be called from within a function run by update.
+func (db *BadgerDb) onCommit(fn func()) {
+	db.committed = append(db.committed, fn)
+}
+
+// reportStats passes the sizes of the tree and value log of Badger to the
+// metrics of the database as gauges.
+func (db *BadgerDb) reportStats() {
+	if db.metrics == btcdb.DiscardMetrics {
+		return
+	}
+	lsm, vlog := db.db.Size()
+	db.metrics.SetGauge("badger.lsm_bytes", lsm)
+	db.metrics.SetGauge("badger.vlog_bytes", vlog)
+}
+
+// getValue returns a copy of the value stored under the passed key or nil when
+// the key does not exist.
+func getValue(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// newestBlock returns the height and hash of the most recent block in the
+// database.  A height of -1 is returned if there are no blocks.
+func newestBlock(txn *badger.Txn) (int64, *btcwire.ShaHash, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.Prefix = blockPrefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	// Seeking in reverse finds the last key that is not greater than the
+	// passed key, so seek past the largest possible height.
+	it.Seek(prefixedKey(blockPrefix, bytes.Repeat([]byte{0xff}, 8)))
+	if !it.Valid() {
+		return -1, new(btcwire.ShaHash), nil
+	}
+
+	item := it.Item()
+	var sha btcwire.ShaHash
+	err := item.Value(func(val []byte) error {
+		if len(val) < btcwire.HashSize {
+			return btcdb.ErrCorruption
+		}
+		sha.SetBytes(val[0:btcwire.HashSize])
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return keyToHeight(item.Key()), &sha, nil
+}
+
+// newestHeight returns the height of the most recent block in the database or
+// -1 if there are no blocks.
+func newestHeight(txn *badger.Txn) (int64, error) {
+	height, _, err := newestBlock(txn)
+	return height, err
+}
+
+// fetchHeight returns the height of the block with the given hash.
+func fetchHeight(txn *badger.Txn, sha *btcwire.ShaHash) (int64, error) {
+	buf, err := getValue(txn, prefixedKey(blockHeightPrefix, sha.Bytes()))
+	if err != nil {
+		return 0, err
+	}
+	if buf == nil {
+		return 0, btcdb.ErrBlockNotFound
+	}
+	if len(buf) != 8 {
+		return 0, btcdb.ErrCorruption
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// fetchBlockByHeight returns the hash and raw bytes of the block at the given
+// height.
+func fetchBlockByHeight(txn *badger.Txn, height int64) (*btcwire.ShaHash, []byte, error) {
+	val, err := getValue(txn, heightToKey(height))
+	if err != nil {
+		return nil, nil, err
+	}
+	if val == nil {
+		return nil, nil, btcdb.ErrBlockNotFound
+	}
+	if len(val) < btcwire.HashSize {
+		return nil, nil, btcdb.ErrCorruption
+	}
+
+	var sha btcwire.ShaHash
+	sha.SetBytes(val[0:btcwire.HashSize])
+	return &sha, val[btcwire.HashSize:], nil
+}
+
+// deserializeHeader decodes the header of the block stored in the passed item
+// directly from its value without copying the block body.
+func deserializeHeader(bh *btcwire.BlockHeader, item *badger.Item) error {
+	return item.Value(func(val []byte) error {
+		if len(val) < btcwire.HashSize {
+			return btcdb.ErrCorruption
+		}
+		return bh.Deserialize(bytes.NewReader(val[btcwire.HashSize:]))
+	})
+}
+
+// fetchTxRecords returns all records for the given transaction hash ordered
+// from oldest to newest.  A nil slice is returned when there are none.
+func fetchTxRecords(txn *badger.Txn, sha *btcwire.ShaHash) ([]*txRecord, error) {
+	buf, err := getValue(txn, prefixedKey(txPrefix, sha.Bytes()))
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return deserializeTxRecords(buf)
+}
+
+// putTxRecords stores the records for the given transaction hash, removing the
+// hash entirely when there are no records left.
+func putTxRecords(txn *badger.Txn, sha *btcwire.ShaHash, recs []*txRecord) error {
+	key := prefixedKey(txPrefix, sha.Bytes())
+	if len(recs) == 0 {
+		return txn.Delete(key)
+	}
+	return txn.Set(key, serializeTxRecords(recs))
+}
+
+// fetchTx loads the transaction described by the passed record along with the
+// hash of the block which contains it.
+func fetchTx(txn *badger.Txn, rec *txRecord) (*btcwire.MsgTx, *btcwire.ShaHash, error) {
+	blkSha, buf, err := fetchBlockByHeight(txn, rec.blockHeight)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec.txOff+rec.txLen > len(buf) {
+		return nil, nil, btcdb.ErrCorruption
+	}
+
+	var msgTx btcwire.MsgTx
+	err = msgTx.Deserialize(bytes.NewBuffer(buf[rec.txOff : rec.txOff+rec.txLen]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &msgTx, blkSha, nil
+}
+
+// fetchUtxoSetSize returns the stored size of the unspent transaction output
+// set.
+func fetchUtxoSetSize(txn *badger.Txn) (int64, error) {
+	buf, err := getValue(txn, utxoSetSizeKey)
+	if err != nil || buf == nil {
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, btcdb.ErrCorruption
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// adjustUtxoSetSize adds the passed delta to the stored size of the unspent
+// transaction output set.
+func adjustUtxoSetSize(txn *badger.Txn, delta int64) error {
+	size, err := fetchUtxoSetSize(txn)
+	if err != nil {
+		return err
+	}
+
+	var sizeBuf [8]byte
+	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(size+delta))
+	return txn.Set(utxoSetSizeKey, sizeBuf[:])
+}
+
+// Close cleanly shuts down the database.  This is part of the btcdb.Db
+// interface implementation.
+func (db *BadgerDb) Close() {
+	// The periodic syncs and reading ahead begin transactions, so they
+	// are stopped first.
+	db.syncer.Stop()
+	db.readAhead.Stop()
+
+	db.closeLock.Lock()
+	defer db.closeLock.Unlock()
+
+	if db.closed {
+		return
+	}
+	db.closed = true
+
+	// A snapshot only owns the read transaction it reads from.
+	if db.snap != nil {
+		db.snap.release()
+		return
+	}
+	db.notifier.Close()
+	if err := db.db.Close(); err != nil {
+		log.Warnf("Close: %v", err)
+	}
+	db.lock.Unlock()
+}
+
+// Closed returns whether the database has been closed.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) Closed() bool {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	return db.closed
+}
+
+// removeTx removes the most recent instance of the passed transaction and
+// unspends the outputs it spends.  It returns the resulting change in the size
+// of the unspent transaction output set.
+func removeTx(txn *badger.Txn, msgTx *btcwire.MsgTx, txHash *btcwire.ShaHash) (int64, error) {
+	var delta int64
+
+	// Undo all of the spends for the transaction.
+	for _, txIn := range msgTx.TxIn {
+		if isCoinbaseInput(txIn) {
+			continue
+		}
+
+		prevOut := &txIn.PreviousOutpoint
+		originRecs, err := fetchTxRecords(txn, &prevOut.Hash)
+		if err != nil {
+			return 0, err
+		}
+		if len(originRecs) == 0 {
+			log.Warnf("Unable to find input transaction %s to "+
+				"unspend %s index %d", prevOut.Hash, txHash,
+				prevOut.Index)
+			continue
+		}
+
+		originRec := originRecs[len(originRecs)-1]
+		if int(prevOut.Index) < len(originRec.spent) &&
+			originRec.spent[prevOut.Index] {
+
+			originRec.spent[prevOut.Index] = false
+			delta++
+		}
+		err = putTxRecords(txn, &prevOut.Hash, originRecs)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Remove the most recent instance of the transaction.  Any older
+	// instance becomes the current one again.
+	recs, err := fetchTxRecords(txn, txHash)
+	if err != nil {
+		return 0, err
+	}
+	if len(recs) == 0 {
+		return delta, nil
+	}
+	delta -= unspentCount(recs[len(recs)-1])
+	recs = recs[:len(recs)-1]
+	if len(recs) != 0 {
+		delta += unspentCount(recs[len(recs)-1])
+	}
+	return delta, putTxRecords(txn, txHash, recs)
+}
+
+// DropAfterBlockBySha removes any blocks from the database after the given
+// block.  This is different than a simple truncate since the spend information
+// for each block must also be unwound.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	return db.DropAfterBlockByShaWithMeta(sha, nil)
+}
+
+// dropAfterBlockBySha removes any blocks after the given block, unwinds their
+// spend information and removes them from the indexers.  It returns the removed
+// blocks from the tip down.
+func (db *BadgerDb) dropAfterBlockBySha(txn *badger.Txn, sha *btcwire.ShaHash) ([]btcdb.ChainEvent, error) {
+	height, err := fetchHeight(txn, sha)
+	if err != nil {
+		return nil, err
+	}
+	db.onCommit(func() {
+		db.blockCache.RemoveFrom(height + 1)
+	})
+	lastHeight, err := newestHeight(txn)
+	if err != nil {
+		return nil, err
+	}
+	spendIndex, err := spendIndexEnabled(txn)
+	if err != nil {
+		return nil, err
+	}
+	filterIndex, err := filterIndexEnabled(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	// The spend information has to be undone in reverse order, so
+	// loop backwards from the last block through the block just
+	// after the passed block.
+	var delta int64
+	var disconnected []btcdb.ChainEvent
+	var dropped []*btcutil.Block
+	var droppedHeights []int64
+	var droppedSpent [][]*btcdb.UtxoEntry
+	for i := lastHeight; i > height; i-- {
+		blkSha, buf, err := fetchBlockByHeight(txn, i)
+		if err != nil {
+			return nil, err
+		}
+		blk, err := btcutil.NewBlockFromBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// The spent outputs are looked up before the transactions of
+		// the block are removed.
+		if db.indexers.Len() != 0 {
+			spent, err := db.fetchSpentTxOuts(txn,
+				[]*btcutil.Block{blk}, []int64{i})
+			if err != nil {
+				return nil, err
+			}
+			dropped = append(dropped, blk)
+			droppedHeights = append(droppedHeights, i)
+			droppedSpent = append(droppedSpent, spent...)
+		}
+
+		// Unspend and remove each transaction in reverse order
+		// because later transactions in a block can reference
+		// earlier ones.
+		transactions := blk.Transactions()
+		for j := len(transactions) - 1; j >= 0; j-- {
+			t := transactions[j]
+			d, err := removeTx(txn, t.MsgTx(), t.Sha())
+			if err != nil {
+				return nil, err
+			}
+			delta += d
+		}
+		if spendIndex {
+			if err := unindexBlockSpends(txn, blk); err != nil {
+				return nil, err
+			}
+		}
+
+		err = txn.Delete(prefixedKey(blockHeightPrefix, blkSha.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		if err := txn.Delete(heightToKey(i)); err != nil {
+			return nil, err
+		}
+		if filterIndex {
+			err := txn.Delete(heightFilterToKey(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := txn.Delete(heightWorkToKey(i)); err != nil {
+			return nil, err
+		}
+		disconnected = append(disconnected,
+			btcdb.BlockDisconnected{Sha: *blkSha, Height: i})
+	}
+
+	if err := adjustUtxoSetSize(txn, delta); err != nil {
+		return nil, err
+	}
+	idxMeta, err := db.indexers.DisconnectBlocks(dropped, droppedHeights,
+		droppedSpent, metaView(txn))
+	if err != nil {
+		return nil, err
+	}
+	if err := putMeta(txn, idxMeta); err != nil {
+		return nil, err
+	}
+	return disconnected, nil
+}
+
+// ExistsSha returns whether or not the given block hash is present in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) ExistsSha(sha *btcwire.ShaHash) bool {
+	var exists bool
+	err := db.view(func(txn *badger.Txn) error {
+		_, err := txn.Get(prefixedKey(blockHeightPrefix, sha.Bytes()))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	if err != nil {
+		log.Warnf("ExistsSha: %v", err)
+		return false
+	}
+	return exists
+}
+
+// ExistsShas returns whether or not each of the given block hashes is present
+// in the database.  All of the hashes are looked up in a single transaction.
+// This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) ExistsShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	err := db.view(func(txn *badger.Txn) error {
+		for i := range shas {
+			key := prefixedKey(blockHeightPrefix, shas[i].Bytes())
+			_, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			exists[i] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("ExistsShas: %v", err)
+		return make([]bool, len(shas))
+	}
+	return exists
+}
+
+// FetchBlockBySha returns a btcutil.Block.  This is part of the btcdb.Db
+// interface implementation.
+func (db *BadgerDb) FetchBlockBySha(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	return db.FetchBlockByShaCtx(context.Background(), sha)
+}
+
+// FetchBlockByShaCtx returns a btcutil.Block unless the passed context is done
+// first.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha).Done()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if blk := db.blockCache.Lookup(sha); blk != nil {
+		db.readAhead.Fetched(blk.Height())
+		return blk, nil
+	}
+	epoch := db.blockCache.Epoch()
+
+	var blk *btcutil.Block
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := fetchHeight(txn, sha)
+		if err != nil {
+			return err
+		}
+		_, buf, err := fetchBlockByHeight(txn, height)
+		if err != nil {
+			return err
+		}
+		blk, err = btcutil.NewBlockFromBytes(buf)
+		if err != nil {
+			return err
+		}
+		blk.SetHeight(height)
+		db.blockCache.AddRead(epoch, sha, height, buf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.readAhead.Fetched(blk.Height())
+	return blk, nil
+}
+
+// readAheadBlock reads the block at the given height into the block cache
+// ahead of the caller.  It returns false once there is no such block.
+func (db *BadgerDb) readAheadBlock(height int64) bool {
+	epoch := db.blockCache.Epoch()
+	err := db.view(func(txn *badger.Txn) error {
+		sha, buf, err := fetchBlockByHeight(txn, height)
+		if err != nil {
+			return err
+		}
+		db.blockCache.AddRead(epoch, sha, height, buf)
+		return nil
+	})
+	return err == nil
+}
+
+// BlockCacheStats returns the use of the cache of recent blocks.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BadgerDb) BlockCacheStats() btcdb.BlockCacheStats {
+	return db.blockCache.Stats()
+}
+
+// FetchBlockHeightBySha returns the block height for the given hash.  This is
+// part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
+	var height int64
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		height, err = fetchHeight(txn, sha)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// FetchBlockRegion returns length bytes of the serialized block with the given
+// hash starting at offset.  Only the region is copied out of the value.  This
+// is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error) {
+	var region []byte
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := fetchHeight(txn, sha)
+		if err != nil {
+			return err
+		}
+		item, err := txn.Get(heightToKey(height))
+		if err == badger.ErrKeyNotFound {
+			return btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) < btcwire.HashSize {
+				return btcdb.ErrCorruption
+			}
+			buf := val[btcwire.HashSize:]
+			if offset < 0 || length < 0 || offset+length > len(buf) {
+				return btcdb.ErrInvalidRegion
+			}
+			region = make([]byte, length)
+			copy(region, buf[offset:])
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return region, nil
+}
+
+// FetchBlockBytesBySha appends the serialized block with the given hash to
+// buf[:0] and returns the result.  The block is copied straight out of the
+// value read by badger into the buffer.  This is part of the btcdb.Db
+// interface implementation.
+func (db *BadgerDb) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha).Done()
+
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := fetchHeight(txn, sha)
+		if err != nil {
+			return err
+		}
+		item, err := txn.Get(heightToKey(height))
+		if err == badger.ErrKeyNotFound {
+			return btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) < btcwire.HashSize {
+				return btcdb.ErrCorruption
+			}
+			buf = append(buf[:0], val[btcwire.HashSize:]...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// FetchBlockHeaderBySha returns a btcwire.BlockHeader for the given sha.  This
+// is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (*btcwire.BlockHeader, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, sha).Done()
+
+	var bh btcwire.BlockHeader
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := fetchHeight(txn, sha)
+		if err != nil {
+			return err
+		}
+		_, buf, err := fetchBlockByHeight(txn, height)
+		if err != nil {
+			return err
+		}
+		return bh.Deserialize(bytes.NewBuffer(buf))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bh, nil
+}
+
+// FetchBlockShaByHeight returns a block hash based on its height in the block
+// chain.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchBlockShaByHeight(height int64) (*btcwire.ShaHash, error) {
+	var sha *btcwire.ShaHash
+	err := db.view(func(txn *badger.Txn) error {
+		lastHeight, err := newestHeight(txn)
+		if err != nil {
+			return err
+		}
+		if height < 0 || height > lastHeight {
+			return btcdb.ErrBlockNotFound
+		}
+
+		sha, _, err = fetchBlockByHeight(txn, height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sha, nil
+}
+
+// FetchHeightRange looks up a range of blocks by the start and ending heights.
+// Fetch is inclusive of the start height and exclusive of the ending height.
+// To fetch all hashes from the start height until no more are present, use the
+// special id `AllShas'.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	return db.FetchHeightRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeightRangeCtx looks up a range of blocks by the start and ending
+// heights unless the passed context is done first.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	var hashList []btcwire.ShaHash
+	err := db.view(func(txn *badger.Txn) error {
+		// Fetch as many as are available within the specified range.
+		lastHeight, err := newestHeight(txn)
+		if err != nil {
+			return err
+		}
+		if endHeight > lastHeight+1 {
+			endHeight = lastHeight + 1
+		}
+		if endHeight < startHeight {
+			endHeight = startHeight
+		}
+		hashList = make([]btcwire.ShaHash, 0, endHeight-startHeight)
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = blockPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		endKey := heightToKey(endHeight)
+		for it.Seek(heightToKey(startHeight)); it.Valid() &&
+			bytes.Compare(it.Item().Key(), endKey) < 0; it.Next() {
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var sha btcwire.ShaHash
+			err := it.Item().Value(func(val []byte) error {
+				if len(val) < btcwire.HashSize {
+					return btcdb.ErrCorruption
+				}
+				sha.SetBytes(val[0:btcwire.HashSize])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			hashList = append(hashList, sha)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.readAhead.Listed(startHeight, startHeight+int64(len(hashList)))
+	return hashList, nil
+}
+
+// FetchBlockHeaderByHeight returns the block header at the given height in the
+// main chain.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchBlockHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, height).Done()
+
+	var bh btcwire.BlockHeader
+	err := db.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightToKey(height))
+		if err == badger.ErrKeyNotFound {
+			return btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return deserializeHeader(&bh, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bh, nil
+}
+
+// FetchHeaderRange returns the block headers from the start height up to but
+// not including the end height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return db.FetchHeaderRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeaderRangeCtx returns the block headers from the start height up to but
+// not including the end height unless the passed context is done first.  This
+// is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	var headers []btcwire.BlockHeader
+	err := db.view(func(txn *badger.Txn) error {
+		// Fetch as many as are available within the specified range.
+		lastHeight, err := newestHeight(txn)
+		if err != nil {
+			return err
+		}
+		if endHeight > lastHeight+1 {
+			endHeight = lastHeight + 1
+		}
+		if endHeight < startHeight {
+			endHeight = startHeight
+		}
+		headers = make([]btcwire.BlockHeader, 0, endHeight-startHeight)
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = blockPrefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		endKey := heightToKey(endHeight)
+		for it.Seek(heightToKey(startHeight)); it.Valid() &&
+			bytes.Compare(it.Item().Key(), endKey) < 0; it.Next() {
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var bh btcwire.BlockHeader
+			if err := deserializeHeader(&bh, it.Item()); err != nil {
+				return err
+			}
+			headers = append(headers, bh)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// ExistsTxSha returns whether or not the given transaction hash is present in
+// the database and is not fully spent.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) ExistsTxSha(sha *btcwire.ShaHash) bool {
+	var exists bool
+	err := db.view(func(txn *badger.Txn) error {
+		recs, err := fetchTxRecords(txn, sha)
+		if err != nil {
+			return err
+		}
+		exists = len(recs) != 0 && !isFullySpent(recs[len(recs)-1])
+		return nil
+	})
+	if err != nil {
+		log.Warnf("ExistsTxSha: %v", err)
+		return false
+	}
+	return exists
+}
+
+// ExistsTxShas returns whether or not each of the given transaction hashes is
+// present in the database and is not fully spent.  All of the hashes are
+// looked up in a single transaction.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) ExistsTxShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	err := db.view(func(txn *badger.Txn) error {
+		for i := range shas {
+			recs, err := fetchTxRecords(txn, &shas[i])
+			if err != nil {
+				return err
+			}
+			exists[i] = len(recs) != 0 &&
+				!isFullySpent(recs[len(recs)-1])
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("ExistsTxShas: %v", err)
+		return make([]bool, len(shas))
+	}
+	return exists
+}
+
+// FetchTxBySha returns some data for the given transaction hash.  Every
+// instance of the transaction is returned ordered from oldest to newest.  This
+// is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchTxBySha(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchTx, txHash).Done()
+
+	var replyList []*btcdb.TxListReply
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		replyList, err = fetchTxInstances(txn, txHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replyList, nil
+}
+
+// fetchTxInstances returns every instance of the transaction with the passed
+// hash stored in the database using the passed badger transaction.
+func fetchTxInstances(txn *badger.Txn, txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	recs, err := fetchTxRecords(txn, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		log.Warnf("FetchTxBySha: requested hash of %s does not exist",
+			txHash)
+		return nil, btcdb.TxShaMissing
+	}
+
+	txHashCopy := *txHash
+	replyList := make([]*btcdb.TxListReply, len(recs))
+	for i, rec := range recs {
+		msgTx, blkSha, err := fetchTx(txn, rec)
+		if err != nil {
+			return nil, err
+		}
+		replyList[i] = &btcdb.TxListReply{
+			Sha:      &txHashCopy,
+			Tx:       msgTx,
+			BlkSha:   blkSha,
+			Height:   rec.blockHeight,
+			BlkIndex: rec.txIdx,
+			TxSpent:  rec.spent,
+		}
+	}
+	return replyList, nil
+}
+
+// fetchSpentTxOuts returns the outputs spent by each of the passed blocks
+// stored at the given heights using the passed badger transaction, or nil
+// when there are no indexers to pass them to.
+func (db *BadgerDb) fetchSpentTxOuts(txn *badger.Txn, blocks []*btcutil.Block, heights []int64) ([][]*btcdb.UtxoEntry, error) {
+	if db.indexers.Len() == 0 {
+		return nil, nil
+	}
+	fetch := func(sha *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+		return fetchTxInstances(txn, sha)
+	}
+	spent := make([][]*btcdb.UtxoEntry, 0, len(blocks))
+	for i, block := range blocks {
+		s, err := btcdb.FetchSpentTxOuts(block, heights[i], fetch)
+		if err != nil {
+			return nil, err
+		}
+		spent = append(spent, s)
+	}
+	return spent, nil
+}
+
+// fetchTxByShaList fetches transactions and information about them given an
+// array of transaction hashes.  The includeSpent flag indicates whether or not
+// information about transactions which are fully spent should be returned.
+// When the flag is not set, the corresponding entry in the TxListReply slice
+// for fully spent transactions will indicate the transaction does not exist
+// and is fully spent.
+func (db *BadgerDb) fetchTxByShaList(txShaList []*btcwire.ShaHash, includeSpent bool) []*btcdb.TxListReply {
+	replyList := make([]*btcdb.TxListReply, 0, len(txShaList))
+	for _, hash := range txShaList {
+		reply := btcdb.TxListReply{Sha: hash, Err: btcdb.TxShaMissing}
+		replyList = append(replyList, &reply)
+	}
+
+	err := db.view(func(txn *badger.Txn) error {
+		for _, reply := range replyList {
+			recs, err := fetchTxRecords(txn, reply.Sha)
+			if err != nil {
+				reply.Err = err
+				continue
+			}
+
+			// Only the most recent instance of the transaction is
+			// of interest.  FetchTxBySha can be used to get all of
+			// them.
+			if len(recs) == 0 {
+				continue
+			}
+			rec := recs[len(recs)-1]
+			if !includeSpent && isFullySpent(rec) {
+				reply.Height = rec.blockHeight
+				reply.FullySpent = true
+				continue
+			}
+
+			msgTx, blkSha, err := fetchTx(txn, rec)
+			if err != nil {
+				reply.Err = err
+				continue
+			}
+			reply.Tx = msgTx
+			reply.BlkSha = blkSha
+			reply.Height = rec.blockHeight
+			reply.BlkIndex = rec.txIdx
+			reply.TxSpent = rec.spent
+			reply.Err = nil
+		}
+		return nil
+	})
+	if err != nil {
+		for _, reply := range replyList {
+			reply.Err = err
+		}
+	}
+	return replyList
+}
+
+// FetchTxByShaList returns a TxListReply given an array of transaction hashes.
+// This function differs from FetchUnSpentTxByShaList in that it returns the
+// most recent version of fully spent transactions.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return db.fetchTxByShaList(txShaList, true)
+}
+
+// FetchUnSpentTxByShaList returns a TxListReply given an array of transaction
+// hashes.  Any transactions which are fully spent will indicate they do not
+// exist by setting the Err field to TxShaMissing, along with the FullySpent
+// field and the height of their most recent instance.  This is part of the btcdb.Db
+// interface implementation.
+func (db *BadgerDb) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return db.fetchTxByShaList(txShaList, false)
+}
+
+// FetchUtxoEntry returns the unspent transaction output referenced by the
+// given outpoint.  A nil entry and no error is returned when the output does
+// not exist or has already been spent.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) FetchUtxoEntry(op *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	var entry *btcdb.UtxoEntry
+	err := db.view(func(txn *badger.Txn) error {
+		// Only the most recent instance of a transaction can have
+		// unspent outputs.
+		recs, err := fetchTxRecords(txn, &op.Hash)
+		if err != nil || len(recs) == 0 {
+			return err
+		}
+		rec := recs[len(recs)-1]
+		if int(op.Index) >= len(rec.spent) || rec.spent[op.Index] {
+			return nil
+		}
+
+		msgTx, _, err := fetchTx(txn, rec)
+		if err != nil {
+			return err
+		}
+		txOut := msgTx.TxOut[op.Index]
+		entry = &btcdb.UtxoEntry{
+			Height:   rec.blockHeight,
+			Coinbase: rec.txIdx == 0,
+			Value:    txOut.Value,
+			PkScript: txOut.PkScript,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// IsOutpointSpent returns whether the output referenced by the given outpoint
+// was spent by a transaction of the main chain.  This is part of the btcdb.Db
+// interface implementation.
+func (db *BadgerDb) IsOutpointSpent(op *btcwire.OutPoint) (bool, error) {
+	spent := false
+	err := db.view(func(txn *badger.Txn) error {
+		recs, err := fetchTxRecords(txn, &op.Hash)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return btcdb.ErrTxNotFound
+		}
+		rec := recs[len(recs)-1]
+		spent = int(op.Index) >= len(rec.spent) || rec.spent[op.Index]
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return spent, nil
+}
+
+// UtxoSetSize returns the total number of unspent transaction outputs in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) UtxoSetSize() (int64, error) {
+	var size int64
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		size, err = fetchUtxoSetSize(txn)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// InsertBlock inserts raw block and transaction data from a block into the
+// database.  The first block inserted into the database will be treated as the
+// genesis block.  Every subsequent block insert requires the referenced parent
+// block to already exist.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) InsertBlock(block *btcutil.Block) (int64, error) {
+	heights, err := db.InsertBlocksWithMeta([]*btcutil.Block{block}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return heights[0], nil
+}
+
+// InsertBlocks inserts a run of blocks in order within a single transaction
+// and returns the height of each.  Every block must connect to the one before
+// it and the first to a block already in the database.  When any of the blocks
+// fails to insert, none of them are.  Runs which are too large for a single
+// badger transaction fail with badger.ErrTxnTooBig and must be split up.
+// This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) InsertBlocks(blocks []*btcutil.Block) ([]int64, error) {
+	return db.InsertBlocksWithMeta(blocks, nil)
+}
+
+// insertBlock stores the raw block and transaction data of the passed block
+// once it passes the checks of the given validation mode and returns the height
+// it was inserted at.
+func insertBlock(txn *badger.Txn, block *btcutil.Block, mode btcdb.ValidationMode) (int64, error) {
+	blockHash, err := block.Sha()
+	if err != nil {
+		return 0, err
+	}
+	rawMsg, err := block.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	txLocs, err := block.TxLoc()
+	if err != nil {
+		return 0, err
+	}
+
+	// Reject the insert if the previously reference block does not exist
+	// except in the case there are no blocks inserted yet where the first
+	// inserted block is assumed to be a genesis block.
+	msgBlock := block.MsgBlock()
+	heightKey := prefixedKey(blockHeightPrefix, blockHash.Bytes())
+	if buf, err := getValue(txn, heightKey); err != nil {
+		return 0, err
+	} else if buf != nil {
+		return 0, btcdb.DuplicateSha
+	}
+	lastHeight, tipSha, err := newestBlock(txn)
+	if err != nil {
+		return 0, err
+	}
+	if lastHeight == -1 {
+		tipSha = nil
+	}
+	if err := btcdb.CheckBlock(block, mode, tipSha); err != nil {
+		return 0, err
+	}
+	prevKey := prefixedKey(blockHeightPrefix,
+		msgBlock.Header.PrevBlock.Bytes())
+	if buf, err := getValue(txn, prevKey); err != nil {
+		return 0, err
+	} else if buf == nil && lastHeight != -1 {
+		return 0, btcdb.PrevShaMissing
+	}
+	newHeight := lastHeight + 1
+
+	blkVal := make([]byte, btcwire.HashSize+len(rawMsg))
+	copy(blkVal, blockHash.Bytes())
+	copy(blkVal[btcwire.HashSize:], rawMsg)
+	if err := txn.Set(heightToKey(newHeight), blkVal); err != nil {
+		return 0, err
+	}
+	var heightBuf [8]byte
+	binary.LittleEndian.PutUint64(heightBuf[:], uint64(newHeight))
+	if err := txn.Set(heightKey, heightBuf[:]); err != nil {
+		return 0, err
+	}
+
+	// Build a map of in-flight transactions because some of the inputs in
+	// this block could be referencing other transactions earlier in this
+	// block.
+	txInFlight := map[btcwire.ShaHash]int{}
+	transactions := block.Transactions()
+	for i, t := range transactions {
+		txInFlight[*t.Sha()] = i
+	}
+
+	var delta int64
+	for i, t := range transactions {
+		d, err := insertTx(txn, t, i, newHeight, &txLocs[i], txInFlight)
+		if err != nil {
+			return 0, err
+		}
+		delta += d
+	}
+
+	spendIndex, err := spendIndexEnabled(txn)
+	if err != nil {
+		return 0, err
+	}
+	if spendIndex {
+		if err := indexBlockSpends(txn, newHeight, block); err != nil {
+			return 0, err
+		}
+	}
+	filterIndex, err := filterIndexEnabled(txn)
+	if err != nil {
+		return 0, err
+	}
+	if filterIndex {
+		if err := putFilter(txn, newHeight, block); err != nil {
+			return 0, err
+		}
+	}
+	err = putChainWork(txn, newHeight, block.MsgBlock().Header.Bits)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := adjustUtxoSetSize(txn, delta); err != nil {
+		return 0, err
+	}
+	return newHeight, nil
+}
+
+// insertTx stores a record for the passed transaction, which is at index txIdx
+// of the block at the given height, and spends all of the outputs referenced
+// by its inputs.  It returns the resulting change in the size of the unspent
+// transaction output set.
+func insertTx(txn *badger.Txn, t *btcutil.Tx, txIdx int, height int64,
+	loc *btcwire.TxLoc, txInFlight map[btcwire.ShaHash]int) (int64, error) {
+
+	// The two duplicate coinbase transactions which were accepted before
+	// BIP0030 overwrite the earlier instances of their hash.  See
+	// btcdb.IsBIP30Exception for details.
+	allowDup := btcdb.IsBIP30Exception(height, t.Sha())
+
+	// Prevent duplicate transactions in the same block.
+	if inFlightIndex := txInFlight[*t.Sha()]; inFlightIndex != txIdx {
+		log.Warnf("Block contains duplicate transaction %s", t.Sha())
+		return 0, btcdb.DuplicateSha
+	}
+
+	// Prevent duplicate transactions unless the old one is fully spent.
+	recs, err := fetchTxRecords(txn, t.Sha())
+	if err != nil {
+		return 0, err
+	}
+	var delta int64
+	if len(recs) != 0 {
+		prevRec := recs[len(recs)-1]
+		if !allowDup && !isFullySpent(prevRec) {
+			log.Warnf("Attempt to insert duplicate transaction %s",
+				t.Sha())
+			return 0, btcdb.DuplicateSha
+		}
+		delta -= unspentCount(prevRec)
+	}
+
+	// Spend all of the inputs.
+	for _, txIn := range t.MsgTx().TxIn {
+		if isCoinbaseInput(txIn) {
+			continue
+		}
+
+		// It is acceptable for a transaction input to reference the
+		// output of another transaction in this block only if the
+		// referenced transaction comes before the current one.
+		prevOut := &txIn.PreviousOutpoint
+		if inFlightIndex, ok := txInFlight[prevOut.Hash]; ok &&
+			txIdx <= inFlightIndex {
+
+			log.Warnf("InsertBlock: requested hash of %s does not "+
+				"exist in-flight", t.Sha())
+			return 0, btcdb.TxShaMissing
+		}
+
+		originRecs, err := fetchTxRecords(txn, &prevOut.Hash)
+		if err != nil {
+			return 0, err
+		}
+		if len(originRecs) == 0 {
+			log.Warnf("InsertBlock: requested hash of %s by %s "+
+				"does not exist", prevOut.Hash, t.Sha())
+			return 0, btcdb.TxShaMissing
+		}
+		originRec := originRecs[len(originRecs)-1]
+		if int(prevOut.Index) >= len(originRec.spent) {
+			log.Warnf("InsertBlock: requested hash of %s with "+
+				"index %d does not exist", t.Sha(),
+				prevOut.Index)
+			return 0, btcdb.TxShaMissing
+		}
+		if !originRec.spent[prevOut.Index] {
+			originRec.spent[prevOut.Index] = true
+			delta--
+		}
+		if err := putTxRecords(txn, &prevOut.Hash, originRecs); err != nil {
+			return 0, err
+		}
+	}
+
+	rec := txRecord{
+		blockHeight: height,
+		txOff:       loc.TxStart,
+		txLen:       loc.TxLen,
+		txIdx:       txIdx,
+		spent:       make([]bool, len(t.MsgTx().TxOut)),
+	}
+	recs = append(recs, &rec)
+	delta += int64(len(rec.spent))
+	return delta, putTxRecords(txn, t.Sha(), recs)
+}
+
+// NewestSha returns the hash and block height of the most recent (end) block of
+// the block chain.  It will return the zero hash, -1 for the block height, and
+// no error (nil) if there are not any blocks in the database yet.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BadgerDb) NewestSha() (*btcwire.ShaHash, int64, error) {
+	var sha *btcwire.ShaHash
+	var height int64
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		height, sha, err = newestBlock(txn)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return sha, height, nil
+}
+
+// RollbackClose discards the recent database changes to the previously saved
+// data at last Sync and closes the database.  This is part of the btcdb.Db
+// interface implementation.
+//
+// Every change is committed before the function making it returns with this
+// implementation, so there is nothing to discard and this function behaves no
+// differently than Close.
+func (db *BadgerDb) RollbackClose() {
+	db.Close()
+}
+
+// Sync syncs all data committed so far to disk.  This is part of the btcdb.Db
+// interface implementation.
+func (db *BadgerDb) Sync() {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed || db.readOnly {
+		return
+	}
+	if err := db.db.Sync(); err != nil {
+		log.Warnf("Sync: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/badgerdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+)
+
+// TestReopen ensures a badger database can only be created once and that its
+// contents are available after it is reopened.
+func TestReopen(t *testing.T) {
+	dbname := "tstdbreopen"
+	_ = os.RemoveAll(dbname)
+	if _, err := btcdb.OpenDB("badger", dbname); err != btcdb.DbDoesNotExist {
+		t.Errorf("OpenDB: unexpected error for missing database %v", err)
+	}
+
+	db, err := btcdb.CreateDB("badger", dbname)
+	if err != nil {
+		t.Errorf("Failed to create test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+
+	_, err = db.InsertBlock(btcutil.NewBlock(&btcwire.GenesisBlock))
+	if err != nil {
+		t.Errorf("InsertBlock: %v", err)
+	}
+	db.Close()
+
+	if _, err := btcdb.CreateDB("badger", dbname); err == nil {
+		t.Errorf("CreateDB: created database over an existing one")
+	}
+
+	db, err = btcdb.OpenDB("badger", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		t.Errorf("NewestSha: %v", err)
+		return
+	}
+	if height != 0 || !sha.IsEqual(&btcwire.GenesisHash) {
+		t.Errorf("NewestSha: got %v at height %d, want %v at height 0",
+			sha, height, &btcwire.GenesisHash)
+	}
+
+	size, err := db.UtxoSetSize()
+	if err != nil || size != 1 {
+		t.Errorf("UtxoSetSize: got %d, want 1 (err %v)", size, err)
+	}
+}
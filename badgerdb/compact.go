@@ -0,0 +1,40 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/dgraph-io/badger"
+)
+
+// compactDiscardRatio is the fraction of a value log file which must be
+// garbage for Compact to rewrite it.
+const compactDiscardRatio = 0.5
+
+// Compact merges the levels of the tree into one and rewrites the value log
+// files which mostly hold values that were overwritten or deleted.
+func (db *BadgerDb) Compact() error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	if err := db.db.Flatten(1); err != nil {
+		return err
+	}
+	for {
+		err := db.db.RunValueLogGC(compactDiscardRatio)
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package badgerdb implements an instance of btcdb backed by Badger.
+
+Badger is a log-structured merge tree which keeps values larger than a small
+threshold in a separate value log and only stores pointers to them in the tree
+itself.  Since raw blocks make up nearly all of the data, they are written
+once to the value log and are not rewritten as the tree is compacted, which
+greatly reduces the write amplification of large imports compared to LevelDB.
+The small index entries, such as block heights and transaction records, are
+kept directly in the tree.
+
+Every operation that modifies the database, such as InsertBlock and
+DropAfterBlockBySha, is performed in a single Badger transaction.  Writes are
+not synced to disk as they are committed unless the database is opened with the
+btcdb.SyncAlways policy, so Sync must otherwise be called to ensure they are
+durable.  With the btcdb.SyncPeriodic policy it is called at the requested
+interval.  Changes are never rolled back, so RollbackClose behaves the same as
+Close.
+
+The database is created and opened with the path of the database directory:
+
+	db, err := btcdb.CreateDB("badger", "blocks_badger")
+
+The size above which values are moved to the value log may be changed from
+DefaultValueThreshold with the ValueThresholdOption setting of btcdb.Options.
+*/
+package badgerdb
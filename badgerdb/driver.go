@@ -0,0 +1,62 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"os"
+)
+
+var log = btcdb.DriverLogger("badgerdb")
+
+func init() {
+	driver := btcdb.DriverDB{DbType: "badger", CreateDB: CreateDB, OpenDB: OpenDB}
+	btcdb.AddDBDriver(driver)
+}
+
+// parseArgs parses the arguments from the btcdb Open/Create methods.  The
+// database is described by either its path or a btcdb.Options.
+func parseArgs(funcName string, args ...interface{}) (*btcdb.Options, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Invalid arguments to badgerdb.%s -- "+
+			"expected database path string or options", funcName)
+	}
+	switch arg := args[0].(type) {
+	case string:
+		return &btcdb.Options{Path: arg}, nil
+	case btcdb.Options:
+		return &arg, nil
+	}
+	return nil, fmt.Errorf("First argument to badgerdb.%s is invalid -- "+
+		"expected database path string or options", funcName)
+}
+
+// OpenDB opens an existing database for use.
+func OpenDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, err := parseArgs("OpenDB", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(dbOpts.Path); err != nil {
+		return nil, btcdb.DbDoesNotExist
+	}
+	return openDB(dbOpts)
+}
+
+// CreateDB creates, initializes, and opens a database for use.
+func CreateDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, err := parseArgs("CreateDB", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(dbOpts.Path); err == nil {
+		return nil, fmt.Errorf("database %v already exists",
+			dbOpts.Path)
+	}
+	return openDB(dbOpts)
+}
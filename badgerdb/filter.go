@@ -0,0 +1,291 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/gcs"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/dgraph-io/badger"
+)
+
+// heightFilterToKey returns the key for the basic filter of the block at the
+// given height.
+func heightFilterToKey(height int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(height))
+	return prefixedKey(filterPrefix, buf[:])
+}
+
+// filterIndexEnabled returns whether or not basic filters are maintained for
+// the database.
+func filterIndexEnabled(txn *badger.Txn) (bool, error) {
+	_, err := txn.Get(filterIndexKey)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// fetchMsgTx returns the most recent instance of the transaction with the
+// given hash.
+func fetchMsgTx(txn *badger.Txn, sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+	recs, err := fetchTxRecords(txn, sha)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, btcdb.TxShaMissing
+	}
+	msgTx, _, err := fetchTx(txn, recs[len(recs)-1])
+	return msgTx, err
+}
+
+// putFilter builds the basic filter of the passed block, which is at the given
+// height, and stores it along with its filter header.  The filter of the
+// previous block must already be stored.
+func putFilter(txn *badger.Txn, height int64, block *btcutil.Block) error {
+	filter, err := gcs.BuildBasicFilter(block,
+		func(sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+			return fetchMsgTx(txn, sha)
+		})
+	if err != nil {
+		return err
+	}
+
+	var prevHeader btcwire.ShaHash
+	if height > 0 {
+		val, err := getValue(txn, heightFilterToKey(height-1))
+		if err != nil {
+			return err
+		}
+		if len(val) < btcwire.HashSize {
+			return btcdb.ErrCorruption
+		}
+		prevHeader.SetBytes(val[0:btcwire.HashSize])
+	}
+	header := gcs.FilterHeader(filter, &prevHeader)
+
+	val := make([]byte, btcwire.HashSize+len(filter))
+	copy(val, header.Bytes())
+	copy(val[btcwire.HashSize:], filter)
+	return txn.Set(heightFilterToKey(height), val)
+}
+
+// fetchFilterEntry returns the stored filter header and filter of the block
+// with the given hash.
+func fetchFilterEntry(txn *badger.Txn, sha *btcwire.ShaHash) ([]byte, error) {
+	enabled, err := filterIndexEnabled(txn)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, btcdb.ErrNoFilterIndex
+	}
+	height, err := fetchHeight(txn, sha)
+	if err != nil {
+		return nil, err
+	}
+	val, err := getValue(txn, heightFilterToKey(height))
+	if err != nil {
+		return nil, err
+	}
+	if len(val) < btcwire.HashSize {
+		return nil, btcdb.ErrCorruption
+	}
+	return val, nil
+}
+
+// FetchFilterBySha returns the basic filter of the block with the given hash.
+// This is part of the btcdb.Db interface implementation.
+//
+// Filters are optional for this backend and btcdb.ErrNoFilterIndex is returned
+// unless they have been enabled with EnableFilterIndex.
+func (db *BadgerDb) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	var filter []byte
+	err := db.view(func(txn *badger.Txn) error {
+		val, err := fetchFilterEntry(txn, sha)
+		if err != nil {
+			return err
+		}
+		filter = val[btcwire.HashSize:]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// FetchFilterHeaderBySha returns the basic filter header of the block with the
+// given hash.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	var header btcwire.ShaHash
+	err := db.view(func(txn *badger.Txn) error {
+		val, err := fetchFilterEntry(txn, sha)
+		if err != nil {
+			return err
+		}
+		header.SetBytes(val[0:btcwire.HashSize])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// fetchFilterRange calls the passed function with the stored filter header and
+// filter of each block from the start height up to but not including the end
+// height in height order.  The values are only valid for the duration of the
+// call.
+func (db *BadgerDb) fetchFilterRange(startHeight, endHeight int64, fn func([]byte)) error {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	return db.view(func(txn *badger.Txn) error {
+		enabled, err := filterIndexEnabled(txn)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return btcdb.ErrNoFilterIndex
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = filterPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		endKey := heightFilterToKey(endHeight)
+		for it.Seek(heightFilterToKey(startHeight)); it.Valid() &&
+			bytes.Compare(it.Item().Key(), endKey) < 0; it.Next() {
+
+			err := it.Item().Value(func(val []byte) error {
+				if len(val) < btcwire.HashSize {
+					return btcdb.ErrCorruption
+				}
+				fn(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FetchFilterRange returns the basic filters of the blocks from the start
+// height up to but not including the end height.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	var filters [][]byte
+	err := db.fetchFilterRange(startHeight, endHeight, func(val []byte) {
+		filter := make([]byte, len(val)-btcwire.HashSize)
+		copy(filter, val[btcwire.HashSize:])
+		filters = append(filters, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// FetchFilterHeaderRange returns the basic filter headers of the blocks from
+// the start height up to but not including the end height.  This is part of
+// the btcdb.Db interface implementation.
+func (db *BadgerDb) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	var headers []btcwire.ShaHash
+	err := db.fetchFilterRange(startHeight, endHeight, func(val []byte) {
+		var header btcwire.ShaHash
+		header.SetBytes(val[0:btcwire.HashSize])
+		headers = append(headers, header)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// FilterIndexEnabled returns whether or not basic filters are maintained for
+// the database.
+func (db *BadgerDb) FilterIndexEnabled() bool {
+	var enabled bool
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		enabled, err = filterIndexEnabled(txn)
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// EnableFilterIndex turns maintenance of basic filters on or off.  The setting
+// is persisted in the database.  When filters are turned on for a database
+// which already contains blocks, they are built from the stored blocks.  When
+// they are turned off, all stored filters are removed.  Either happens within
+// a single transaction, so databases which are too large for one fail with
+// badger.ErrTxnTooBig.
+func (db *BadgerDb) EnableFilterIndex(enable bool) error {
+	return db.update(func(txn *badger.Txn) error {
+		enabled, err := filterIndexEnabled(txn)
+		if err != nil {
+			return err
+		}
+		if enable == enabled {
+			return nil
+		}
+
+		if !enable {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = filterPrefix
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				err := txn.Delete(it.Item().KeyCopy(nil))
+				if err != nil {
+					return err
+				}
+			}
+			return txn.Delete(filterIndexKey)
+		}
+
+		lastHeight, err := newestHeight(txn)
+		if err != nil {
+			return err
+		}
+		for height := int64(0); height <= lastHeight; height++ {
+			_, buf, err := fetchBlockByHeight(txn, height)
+			if err != nil {
+				return err
+			}
+			blk, err := btcutil.NewBlockFromBytes(buf)
+			if err != nil {
+				return err
+			}
+			if err := putFilter(txn, height, blk); err != nil {
+				return err
+			}
+		}
+		return txn.Set(filterIndexKey, []byte{1})
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/dgraph-io/badger"
+)
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	var locator btcdb.BlockLocator
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := fetchHeight(txn, sha)
+		if err != nil {
+			return err
+		}
+		locator, err = blockLocator(txn, height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	var locator btcdb.BlockLocator
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := newestHeight(txn)
+		if err != nil {
+			return err
+		}
+		locator, err = blockLocator(txn, height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// blockLocator returns a block locator for the block at the given height.
+// Only the hashes are read from the stored blocks.
+func blockLocator(txn *badger.Txn, height int64) (btcdb.BlockLocator, error) {
+	heights := btcdb.LocatorHeights(height)
+	locator := make(btcdb.BlockLocator, 0, len(heights))
+	for _, h := range heights {
+		item, err := txn.Get(heightToKey(h))
+		if err == badger.ErrKeyNotFound {
+			return nil, btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sha btcwire.ShaHash
+		err = item.Value(func(val []byte) error {
+			if len(val) < btcwire.HashSize {
+				return btcdb.ErrCorruption
+			}
+			sha.SetBytes(val[0:btcwire.HashSize])
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, &sha)
+	}
+	return locator, nil
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/dgraph-io/badger"
+)
+
+// putMeta applies the passed changes to the metadata namespace.
+func putMeta(txn *badger.Txn, meta *btcdb.MetaBatch) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	for _, op := range meta.Ops() {
+		key := prefixedKey(userMetaPrefix, op.Key)
+		var err error
+		if op.Delete {
+			err = txn.Delete(key)
+		} else {
+			err = txn.Set(key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertBlocksWithMeta inserts a run of blocks in order along with the passed
+// changes to the metadata namespace within a single transaction.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BadgerDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+
+	heights := make([]int64, 0, len(blocks))
+	err := db.updateOp(op, func(txn *badger.Txn) error {
+		for _, block := range blocks {
+			height, err := insertBlock(txn, block, db.validation)
+			if err != nil {
+				return err
+			}
+			heights = append(heights, height)
+			sha, _ := block.Sha()
+			db.notifyOnCommit(btcdb.BlockConnected{Sha: *sha,
+				Height: height})
+		}
+		spent, err := db.fetchSpentTxOuts(txn, blocks, heights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := db.indexers.ConnectBlocks(blocks, heights, spent,
+			metaView(txn))
+		if err != nil {
+			return err
+		}
+		if err := putMeta(txn, meta); err != nil {
+			return err
+		}
+		db.onCommit(func() {
+			db.blockCache.AddBlocks(blocks, heights)
+		})
+		return putMeta(txn, idxMeta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// DropAfterBlockByShaWithMeta removes any blocks from the database after the
+// given block along with applying the passed changes to the metadata namespace
+// within a single transaction.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
+
+	return db.updateOp(op, func(txn *badger.Txn) error {
+		disconnected, err := db.dropAfterBlockBySha(txn, sha)
+		if err != nil {
+			return err
+		}
+		db.notifyOnCommit(disconnected...)
+		return putMeta(txn, meta)
+	})
+}
+
+// ReorganizeWithMeta removes any blocks from the database after the given
+// block, inserts the passed run of blocks after it and applies the passed
+// changes to the metadata namespace within a single transaction.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BadgerDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricReorganize, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricReorganize, len(blocks))
+
+	heights := make([]int64, 0, len(blocks))
+	err := db.updateOp(op, func(txn *badger.Txn) error {
+		disconnected, err := db.dropAfterBlockBySha(txn, sha)
+		if err != nil {
+			return err
+		}
+		db.notifyOnCommit(disconnected...)
+		for _, block := range blocks {
+			height, err := insertBlock(txn, block, db.validation)
+			if err != nil {
+				return err
+			}
+			heights = append(heights, height)
+			blkSha, _ := block.Sha()
+			db.notifyOnCommit(btcdb.BlockConnected{Sha: *blkSha,
+				Height: height})
+		}
+		spent, err := db.fetchSpentTxOuts(txn, blocks, heights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := db.indexers.ConnectBlocks(blocks, heights, spent,
+			metaView(txn))
+		if err != nil {
+			return err
+		}
+		if err := putMeta(txn, meta); err != nil {
+			return err
+		}
+		db.onCommit(func() {
+			db.blockCache.AddBlocks(blocks, heights)
+		})
+		return putMeta(txn, idxMeta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// GetMeta returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) GetMeta(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		value, err = getValue(txn, prefixedKey(userMetaPrefix, key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// metaView returns a view of the metadata namespace as of the changes made by
+// the passed badger transaction.
+func metaView(txn *badger.Txn) btcdb.MetaView {
+	return func(key []byte) ([]byte, error) {
+		return getValue(txn, prefixedKey(userMetaPrefix, key))
+	}
+}
+
+// PutMeta stores the value under the given key in the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) PutMeta(key, value []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Put(key, value)
+	return db.WriteMeta(&meta)
+}
+
+// DeleteMeta removes the given key from the metadata namespace.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BadgerDb) DeleteMeta(key []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Delete(key)
+	return db.WriteMeta(&meta)
+}
+
+// WriteMeta applies the passed changes to the metadata namespace within a
+// single transaction.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) WriteMeta(meta *btcdb.MetaBatch) error {
+	return db.update(func(txn *badger.Txn) error {
+		return putMeta(txn, meta)
+	})
+}
+
+// MetaIterator returns an iterator over the keys of the metadata namespace
+// which begin with the given prefix.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewMetaIterator(keys, values), nil
+}
+
+// ReverseMetaIterator returns an iterator over the keys of the metadata
+// namespace which begin with the given prefix in descending order.  This is
+// part of the btcdb.Db interface implementation.
+func (db *BadgerDb) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewReverseMetaIterator(keys, values), nil
+}
+
+// metaEntries returns copies of the keys of the metadata namespace which begin
+// with the given prefix and their values, read in a single transaction.
+func (db *BadgerDb) metaEntries(prefix []byte) ([][]byte, [][]byte, error) {
+	var keys, values [][]byte
+	err := db.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefixedKey(userMetaPrefix, prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			key := item.KeyCopy(nil)[len(userMetaPrefix):]
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
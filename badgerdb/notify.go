@@ -0,0 +1,38 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"github.com/conformal/btcdb"
+)
+
+// notifyOnCommit delivers the passed events to subscribers once the
+// transaction being run by update commits.  They are discarded when it fails.
+// Must be called from within a function run by update.
+func (db *BadgerDb) notifyOnCommit(events ...btcdb.ChainEvent) {
+	db.pending = append(db.pending, events...)
+}
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain.  This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) Subscribe() (*btcdb.Subscription, error) {
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	return db.notifier.Subscribe()
+}
+
+// AddIndexer initializes the passed indexer, catches it up with the chain and
+// from then on updates it within the transactions which change the blocks.
+// This is part of the btcdb.Db interface implementation.
+func (db *BadgerDb) AddIndexer(idx btcdb.Indexer) error {
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	return db.indexers.Add(db, idx)
+}
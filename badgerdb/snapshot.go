@@ -0,0 +1,102 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/dgraph-io/badger"
+	"io"
+	"sync"
+)
+
+// snapshotTxn is a read transaction held open for the lifetime of a snapshot.
+// Badger transactions are not safe for concurrent use, so the mutex serializes
+// access to it.
+type snapshotTxn struct {
+	sync.Mutex
+	txn *badger.Txn
+}
+
+// view runs the passed function in the held read transaction.
+func (s *snapshotTxn) view(fn func(txn *badger.Txn) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.txn == nil {
+		return btcdb.ErrDbClosed
+	}
+	return fn(s.txn)
+}
+
+// release discards the held read transaction.
+func (s *snapshotTxn) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.txn != nil {
+		s.txn.Discard()
+		s.txn = nil
+	}
+}
+
+// snapshot is a read-only view of a Badger database pinned to the read
+// timestamp of a transaction.
+type snapshot struct {
+	*BadgerDb
+}
+
+// Release discards the read transaction of the snapshot.  This is part of the
+// btcdb.Snapshot interface implementation.
+func (s *snapshot) Release() {
+	s.Close()
+}
+
+// Snapshot returns a read-only view of the database pinned to the current
+// point in time.  Badger keeps the versions of keys the snapshot may read
+// until it is released.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BadgerDb) Snapshot() (btcdb.Snapshot, error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	txn := db.db.NewTransaction(false)
+	view := &BadgerDb{
+		db:       db.db,
+		metrics:  db.metrics,
+		readOnly: true,
+		snap:     &snapshotTxn{txn: txn},
+	}
+	return &snapshot{view}, nil
+}
+
+// VerifyIntegrity performs the integrity checks of the given level on every
+// block of the chain using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) VerifyIntegrity(level int, progress func(height int64)) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.VerifyChain(snap, level, progress)
+}
+
+// ExportBootstrap writes the blocks of a range of heights in the format of
+// bootstrap.dat using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BadgerDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.WriteBootstrap(snap, w, startHeight, endHeight)
+}
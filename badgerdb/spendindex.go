@@ -0,0 +1,189 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/dgraph-io/badger"
+)
+
+// spendEntryLen is the length of a spend index entry:
+//
+//	spending tx hash (32) | block height (8) | input index (4)
+const spendEntryLen = btcwire.HashSize + 8 + 4
+
+// outPointKey returns the key for the spend index entry of the given
+// outpoint.
+func outPointKey(op *btcwire.OutPoint) []byte {
+	var buf [btcwire.HashSize + 4]byte
+	copy(buf[:], op.Hash.Bytes())
+	binary.BigEndian.PutUint32(buf[btcwire.HashSize:], op.Index)
+	return prefixedKey(spendPrefix, buf[:])
+}
+
+// spendIndexEnabled returns whether or not the spend index is maintained for
+// the database.
+func spendIndexEnabled(txn *badger.Txn) (bool, error) {
+	_, err := txn.Get(spendIndexKey)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// indexBlockSpends adds spend index entries for every output spent by the
+// passed block, which is at the given height.
+func indexBlockSpends(txn *badger.Txn, height int64, block *btcutil.Block) error {
+	for _, t := range block.Transactions() {
+		for inIdx, txIn := range t.MsgTx().TxIn {
+			if isCoinbaseInput(txIn) {
+				continue
+			}
+			val := make([]byte, spendEntryLen)
+			copy(val, t.Sha().Bytes())
+			binary.LittleEndian.PutUint64(val[btcwire.HashSize:],
+				uint64(height))
+			binary.LittleEndian.PutUint32(val[btcwire.HashSize+8:],
+				uint32(inIdx))
+			err := txn.Set(outPointKey(&txIn.PreviousOutpoint), val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexBlockSpends removes the spend index entries for every output spent by
+// the passed block.
+func unindexBlockSpends(txn *badger.Txn, block *btcutil.Block) error {
+	for _, t := range block.Transactions() {
+		for _, txIn := range t.MsgTx().TxIn {
+			if isCoinbaseInput(txIn) {
+				continue
+			}
+			err := txn.Delete(outPointKey(&txIn.PreviousOutpoint))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FetchSpendingTx returns the transaction which spent the output referenced by
+// the given outpoint.  This is part of the btcdb.Db interface implementation.
+//
+// The spend index is optional for this backend and btcdb.ErrNoSpendIndex is
+// returned unless it has been enabled with EnableSpendIndex.
+func (db *BadgerDb) FetchSpendingTx(op *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	var spender *btcdb.SpendingTx
+	err := db.view(func(txn *badger.Txn) error {
+		enabled, err := spendIndexEnabled(txn)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return btcdb.ErrNoSpendIndex
+		}
+
+		val, err := getValue(txn, outPointKey(op))
+		if err != nil || val == nil {
+			return err
+		}
+		if len(val) != spendEntryLen {
+			return btcdb.ErrCorruption
+		}
+
+		var sha btcwire.ShaHash
+		sha.SetBytes(val[0:btcwire.HashSize])
+		spender = &btcdb.SpendingTx{
+			Sha:        &sha,
+			Height:     int64(binary.LittleEndian.Uint64(val[btcwire.HashSize:])),
+			InputIndex: binary.LittleEndian.Uint32(val[btcwire.HashSize+8:]),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spender, nil
+}
+
+// SpendIndexEnabled returns whether or not the spend index is maintained for
+// the database.
+func (db *BadgerDb) SpendIndexEnabled() bool {
+	var enabled bool
+	err := db.view(func(txn *badger.Txn) error {
+		var err error
+		enabled, err = spendIndexEnabled(txn)
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// EnableSpendIndex turns maintenance of the spend index on or off.  The setting
+// is persisted in the database.  When the index is turned on for a database
+// which already contains blocks, it is built from the stored blocks.  When it
+// is turned off, all existing index entries are removed.  Either happens
+// within a single transaction, so databases which are too large for one fail
+// with badger.ErrTxnTooBig.
+func (db *BadgerDb) EnableSpendIndex(enable bool) error {
+	return db.update(func(txn *badger.Txn) error {
+		enabled, err := spendIndexEnabled(txn)
+		if err != nil {
+			return err
+		}
+		if enable == enabled {
+			return nil
+		}
+
+		opts := badger.DefaultIteratorOptions
+		if !enable {
+			opts.Prefix = spendPrefix
+			opts.PrefetchValues = false
+		} else {
+			opts.Prefix = blockPrefix
+		}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		if !enable {
+			for it.Rewind(); it.Valid(); it.Next() {
+				err := txn.Delete(it.Item().KeyCopy(nil))
+				if err != nil {
+					return err
+				}
+			}
+			return txn.Delete(spendIndexKey)
+		}
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			height := keyToHeight(item.Key())
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if len(val) < btcwire.HashSize {
+				return btcdb.ErrCorruption
+			}
+			blk, err := btcutil.NewBlockFromBytes(val[btcwire.HashSize:])
+			if err != nil {
+				return err
+			}
+			if err := indexBlockSpends(txn, height, blk); err != nil {
+				return err
+			}
+		}
+		return txn.Set(spendIndexKey, []byte{1})
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/dgraph-io/badger"
+	"math/big"
+)
+
+// heightWorkToKey returns the key for the cumulative chain work through the
+// block at the given height.
+func heightWorkToKey(height int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(height))
+	return prefixedKey(workPrefix, buf[:])
+}
+
+// chainWorkStored returns whether or not the cumulative chain work is stored
+// for every block of the database.
+func chainWorkStored(txn *badger.Txn) (bool, error) {
+	_, err := txn.Get(chainWorkKey)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// putChainWork stores the cumulative chain work through the block at the given
+// height, which has the passed compact target difficulty.  The work through
+// the block before it must already be stored.
+func putChainWork(txn *badger.Txn, height int64, bits uint32) error {
+	work := btcdb.CalcWork(bits)
+	if height > 0 {
+		prev, err := getValue(txn, heightWorkToKey(height-1))
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			return btcdb.ErrCorruption
+		}
+		work.Add(work, new(big.Int).SetBytes(prev))
+	}
+	return txn.Set(heightWorkToKey(height), work.Bytes())
+}
+
+// sumChainWork computes the cumulative chain work through the block at the
+// given height from the headers of it and every block before it.
+func sumChainWork(txn *badger.Txn, height int64) (*big.Int, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = blockPrefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	work := new(big.Int)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if keyToHeight(item.Key()) > height {
+			break
+		}
+		var bh btcwire.BlockHeader
+		if err := deserializeHeader(&bh, item); err != nil {
+			return nil, err
+		}
+		work.Add(work, btcdb.CalcWork(bh.Bits))
+	}
+	return work, nil
+}
+
+// buildChainWork stores the cumulative chain work of every block of a database
+// created before it was stored and records that it is now.  This happens
+// within a single transaction, so databases which are too large for one fail
+// with badger.ErrTxnTooBig.
+func buildChainWork(txn *badger.Txn) error {
+	stored, err := chainWorkStored(txn)
+	if err != nil || stored {
+		return err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = blockPrefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		var bh btcwire.BlockHeader
+		if err := deserializeHeader(&bh, item); err != nil {
+			return err
+		}
+		err := putChainWork(txn, keyToHeight(item.Key()), bh.Bits)
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Set(chainWorkKey, []byte{1})
+}
+
+// FetchChainWorkBySha returns the cumulative work of the main chain through the
+// block with the given hash.  This is part of the btcdb.Db interface
+// implementation.
+//
+// Databases created before the work was stored get it added the first time
+// they are opened for writing, while read-only opens compute it from the
+// headers of every block up to the requested one.
+func (db *BadgerDb) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	var work *big.Int
+	err := db.view(func(txn *badger.Txn) error {
+		height, err := fetchHeight(txn, sha)
+		if err != nil {
+			return err
+		}
+
+		stored, err := chainWorkStored(txn)
+		if err != nil {
+			return err
+		}
+		if !stored {
+			work, err = sumChainWork(txn, height)
+			return err
+		}
+		buf, err := getValue(txn, heightWorkToKey(height))
+		if err != nil {
+			return err
+		}
+		if buf == nil {
+			return btcdb.ErrCorruption
+		}
+		work = new(big.Int).SetBytes(buf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return work, nil
+}
@@ -0,0 +1,347 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// AddrBalancePrefix is the prefix of the keys of the metadata namespace under
+// which an AddrBalanceIndex keeps the balance of every output script.
+var AddrBalancePrefix = []byte("btcdb/balance/")
+
+var (
+	// addrBalanceTipKey is the key of the hash and height of the newest
+	// block counted by the balance index.
+	addrBalanceTipKey = []byte("btcdb/balance/tip")
+
+	// addrBalanceScriptPrefix is the prefix of the keys of the balance of
+	// each script, which are followed by the WatchScriptHash of the
+	// script.  The value is the balance as an 8-byte little-endian number
+	// followed by the script.
+	addrBalanceScriptPrefix = []byte("btcdb/balance/script/")
+
+	// addrBalanceRankPrefix is the prefix of the keys which order the
+	// scripts by balance, which are followed by the complement of the
+	// balance as a big endian number and the WatchScriptHash of the script,
+	// so the richest script comes first.  The value is empty.
+	addrBalanceRankPrefix = []byte("btcdb/balance/rank/")
+
+	// addrBalanceVersionKey is the key of the version of the records of the
+	// balance index.  It is kept outside of AddrBalancePrefix so it
+	// survives the index being rebuilt.
+	addrBalanceVersionKey = []byte("btcdb/version/balance")
+)
+
+// addrBalanceVersion is the version of the records of the balance index.
+const addrBalanceVersion = 1
+
+// addrBalanceScriptKey returns the key of the balance of the script with the
+// passed hash.
+func addrBalanceScriptKey(scriptHash *btcwire.ShaHash) []byte {
+	key := make([]byte, len(addrBalanceScriptPrefix)+btcwire.HashSize)
+	copy(key, addrBalanceScriptPrefix)
+	copy(key[len(addrBalanceScriptPrefix):], scriptHash[:])
+	return key
+}
+
+// addrBalanceRankKey returns the key which ranks the script with the passed
+// hash by the passed balance.
+func addrBalanceRankKey(scriptHash *btcwire.ShaHash, balance int64) []byte {
+	off := len(addrBalanceRankPrefix)
+	key := make([]byte, off+8+btcwire.HashSize)
+	copy(key, addrBalanceRankPrefix)
+	binary.BigEndian.PutUint64(key[off:], ^uint64(balance))
+	copy(key[off+8:], scriptHash[:])
+	return key
+}
+
+// AddrBalance is the balance of an output script, which is the total value of
+// the unspent outputs paying to it.
+type AddrBalance struct {
+	PkScript []byte
+	Balance  int64
+}
+
+// deserializeAddrBalance returns the balance stored in the passed value.
+func deserializeAddrBalance(val []byte) (*AddrBalance, error) {
+	if len(val) < 8 {
+		return nil, fmt.Errorf("malformed balance record %x", val)
+	}
+	return &AddrBalance{
+		PkScript: append([]byte{}, val[8:]...),
+		Balance:  int64(binary.LittleEndian.Uint64(val)),
+	}, nil
+}
+
+// addrBalanceDeltas collects the changes a block makes to the balances of the
+// scripts it pays and spends from, in the order the scripts first appear.
+type addrBalanceDeltas struct {
+	scripts [][]byte
+	deltas  map[string]int64
+}
+
+// add adds the passed value to the change to the balance of the passed script.
+func (d *addrBalanceDeltas) add(pkScript []byte, value int64) {
+	if _, ok := d.deltas[string(pkScript)]; !ok {
+		d.scripts = append(d.scripts, pkScript)
+	}
+	d.deltas[string(pkScript)] += value
+}
+
+// blockAddrBalanceDeltas returns the changes the passed block at the passed
+// height, which spent the passed outputs, makes to the balances of scripts.
+// Outputs of the genesis block and outputs which may never be spent do not
+// count towards any balance.
+func blockAddrBalanceDeltas(block *btcutil.Block, height int64, spent []*UtxoEntry) (*addrBalanceDeltas, error) {
+	d := &addrBalanceDeltas{deltas: make(map[string]int64)}
+	if height == 0 {
+		return d, nil
+	}
+
+	for _, entry := range spent {
+		if !isUnspendableOutput(entry.PkScript) {
+			d.add(entry.PkScript, -entry.Value)
+		}
+	}
+	for _, tx := range block.MsgBlock().Transactions {
+		txSha, err := tx.TxSha()
+		if err != nil {
+			return nil, err
+		}
+
+		// The outputs of the transaction overwritten by a duplicate
+		// are no longer available.  Being a duplicate, the
+		// overwritten transaction has the same outputs.
+		overwrites := IsBIP30Exception(height, &txSha)
+		for _, txOut := range tx.TxOut {
+			if isUnspendableOutput(txOut.PkScript) {
+				continue
+			}
+			if overwrites {
+				d.add(txOut.PkScript, -txOut.Value)
+			}
+			d.add(txOut.PkScript, txOut.Value)
+		}
+	}
+	return d, nil
+}
+
+// AddrBalanceIndex is an optional indexer which keeps the balance of every
+// output script, so FetchAddrBalance returns the balance of an address without
+// reading its outputs and FetchRichList returns the scripts holding the most
+// coins.  Only the balances as of the newest block are kept; they are updated
+// with the outputs each block creates and spends as it is connected and
+// disconnected.  The spent outputs are those the database passes along with
+// each block, so the index can not be kept for a database which does not know
+// them, such as one which only stores headers.
+//
+// Outputs of the genesis block and outputs which may never be spent do not
+// count towards any balance, the same as for UtxoHashIndex.
+type AddrBalanceIndex struct {
+	mtx sync.Mutex
+	db  Db
+}
+
+// Ensure AddrBalanceIndex implements the Indexer interface.
+var _ Indexer = (*AddrBalanceIndex)(nil)
+
+// NewAddrBalanceIndex returns a balance index which starts counting once it is
+// added to a database with AddIndexer.
+func NewAddrBalanceIndex() *AddrBalanceIndex {
+	return new(AddrBalanceIndex)
+}
+
+// Init prepares the index to count the blocks of the passed database.  The
+// index is rebuilt from the genesis block when its tip is no longer in the
+// chain or its records were written by another version of the index.  This is
+// part of the Indexer interface implementation.
+func (idx *AddrBalanceIndex) Init(db Db) error {
+	_, err := initVersionedIndexerState(db, "Balance index",
+		AddrBalancePrefix, addrBalanceTipKey, addrBalanceVersionKey,
+		addrBalanceVersion)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block counted as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *AddrBalanceIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, addrBalanceTipKey)
+}
+
+// applyAddrBalanceBlock adds the changes the passed block makes to the balances
+// of scripts to the passed batch, negated when sign is negative.
+func applyAddrBalanceBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, sign int64, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	if !spentKnown(block, spent) {
+		return fmt.Errorf("outputs spent by block %v at height %d are "+
+			"not known", sha, height)
+	}
+
+	d, err := blockAddrBalanceDeltas(block, height, spent)
+	if err != nil {
+		return err
+	}
+	for _, pkScript := range d.scripts {
+		delta := sign * d.deltas[string(pkScript)]
+		if delta == 0 {
+			continue
+		}
+
+		scriptHash := WatchScriptHash(pkScript)
+		key := addrBalanceScriptKey(&scriptHash)
+		val, err := meta.Get(key)
+		if err != nil {
+			return err
+		}
+		var balance int64
+		if val != nil {
+			old, err := deserializeAddrBalance(val)
+			if err != nil {
+				return err
+			}
+			balance = old.Balance
+			meta.Delete(addrBalanceRankKey(&scriptHash, balance))
+		}
+
+		balance += delta
+		switch {
+		case balance < 0:
+			return fmt.Errorf("balance of script %x would be "+
+				"negative at block %v at height %d", pkScript,
+				sha, height)
+		case balance == 0:
+			meta.Delete(key)
+		default:
+			rec := make([]byte, 8+len(pkScript))
+			binary.LittleEndian.PutUint64(rec, uint64(balance))
+			copy(rec[8:], pkScript)
+			meta.Put(key, rec)
+			meta.Put(addrBalanceRankKey(&scriptHash, balance), nil)
+		}
+	}
+	return nil
+}
+
+// ConnectBlock adds the outputs the passed block creates to the balances of the
+// scripts they pay and subtracts the outputs it spends.  This is part of the
+// Indexer interface implementation.
+func (idx *AddrBalanceIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	err := applyAddrBalanceBlock(block, height, spent, 1, meta)
+	if err != nil {
+		return err
+	}
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	putTipRecord(meta, addrBalanceTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock undoes the changes the passed block made to the balances of
+// scripts.  This is part of the Indexer interface implementation.
+func (idx *AddrBalanceIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	err := applyAddrBalanceBlock(block, height, spent, -1, meta)
+	if err != nil {
+		return err
+	}
+	putTipRecord(meta, addrBalanceTipKey, &block.MsgBlock().Header.PrevBlock,
+		height-1)
+	return nil
+}
+
+// FetchAddrBalance returns the total value of the unspent outputs paying to
+// the passed script as of the newest block counted by the AddrBalanceIndex of
+// the passed database, which is zero for a script which was never paid.
+// ErrNoAddrBalanceIndex is returned when the database has no balance index.
+func FetchAddrBalance(db Db, pkScript []byte) (int64, error) {
+	tipSha, _, err := fetchTipRecord(db, addrBalanceTipKey)
+	if err != nil {
+		return 0, err
+	}
+	if tipSha == nil {
+		return 0, ErrNoAddrBalanceIndex
+	}
+
+	scriptHash := WatchScriptHash(pkScript)
+	val, err := db.GetMeta(addrBalanceScriptKey(&scriptHash))
+	if err != nil || val == nil {
+		return 0, err
+	}
+	b, err := deserializeAddrBalance(val)
+	if err != nil {
+		return 0, err
+	}
+	return b.Balance, nil
+}
+
+// FetchRichList returns up to the passed number of the scripts with the
+// largest balances as of the newest block counted by the AddrBalanceIndex of
+// the passed database, richest first.  Scripts with the same balance are
+// ordered by their WatchScriptHash.  ErrNoAddrBalanceIndex is returned when
+// the database has no balance index.
+func FetchRichList(db Db, n int) ([]*AddrBalance, error) {
+	tipSha, _, err := fetchTipRecord(db, addrBalanceTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoAddrBalanceIndex
+	}
+
+	iter, err := db.MetaIterator(addrBalanceRankPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var list []*AddrBalance
+	off := len(addrBalanceRankPrefix) + 8
+	for len(list) < n && iter.Next() {
+		key := iter.Key()
+		if len(key) != off+btcwire.HashSize {
+			return nil, fmt.Errorf("malformed balance rank key %x",
+				key)
+		}
+		var scriptHash btcwire.ShaHash
+		copy(scriptHash[:], key[off:])
+		val, err := db.GetMeta(addrBalanceScriptKey(&scriptHash))
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, fmt.Errorf("balance of script %v is missing",
+				&scriptHash)
+		}
+		b, err := deserializeAddrBalance(val)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestAddrBalance ensures the balances kept by the balance index are the total
+// value of the outputs left unspent by the chain paying to each script, and
+// that the rich list orders the scripts by them, for every supported database
+// type, both as the index is caught up with the chain and as blocks are
+// inserted and replaced, including when the connection of blocks fails.
+func TestAddrBalance(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// balances returns the expected balance of each script paid by the
+	// passed chain, which starts with the genesis block, and the expected
+	// rich list.
+	balances := func(chain []*btcutil.Block) (map[string]int64, []*btcdb.AddrBalance) {
+		set := make(map[btcwire.OutPoint]*btcwire.TxOut)
+		for _, blk := range chain[1:] {
+			for i, tx := range blk.MsgBlock().Transactions {
+				if i > 0 {
+					for _, txIn := range tx.TxIn {
+						delete(set, txIn.PreviousOutpoint)
+					}
+				}
+				txSha, _ := tx.TxSha()
+				for idx, txOut := range tx.TxOut {
+					op := btcwire.NewOutPoint(&txSha, uint32(idx))
+					set[*op] = txOut
+				}
+			}
+		}
+		bals := make(map[string]int64)
+		for _, txOut := range set {
+			bals[string(txOut.PkScript)] += txOut.Value
+		}
+		var rich []*btcdb.AddrBalance
+		for script, bal := range bals {
+			rich = append(rich, &btcdb.AddrBalance{
+				PkScript: []byte(script),
+				Balance:  bal,
+			})
+		}
+		sort.Slice(rich, func(i, j int) bool {
+			if rich[i].Balance != rich[j].Balance {
+				return rich[i].Balance > rich[j].Balance
+			}
+			hi := btcdb.WatchScriptHash(rich[i].PkScript)
+			hj := btcdb.WatchScriptHash(rich[j].PkScript)
+			return bytes.Compare(hi[:], hj[:]) < 0
+		})
+		return bals, rich
+	}
+
+	// checkBalances ensures the balance of every script paid by the passed
+	// chain, and the rich list, are the expected ones.
+	checkBalances := func(dbType, desc string, db btcdb.Db, chain []*btcutil.Block) {
+		bals, rich := balances(chain)
+		for _, blk := range chain {
+			for _, tx := range blk.MsgBlock().Transactions {
+				for _, txOut := range tx.TxOut {
+					want := bals[string(txOut.PkScript)]
+					got, err := btcdb.FetchAddrBalance(db,
+						txOut.PkScript)
+					if err != nil || got != want {
+						t.Errorf("FetchAddrBalance (%s) %s: "+
+							"script %x got %d (err %v), "+
+							"want %d", dbType, desc,
+							txOut.PkScript, got, err, want)
+						return
+					}
+				}
+			}
+		}
+
+		got, err := btcdb.FetchRichList(db, len(rich)+1)
+		if err != nil {
+			t.Errorf("FetchRichList (%s) %s: %v", dbType, desc, err)
+			return
+		}
+		if len(got) != len(rich) {
+			t.Errorf("FetchRichList (%s) %s: got %d scripts, want %d",
+				dbType, desc, len(got), len(rich))
+			return
+		}
+		for i := range got {
+			if !reflect.DeepEqual(got[i], rich[i]) {
+				t.Errorf("FetchRichList (%s) %s: entry %d got "+
+					"%+v, want %+v", dbType, desc, i, got[i],
+					rich[i])
+				return
+			}
+		}
+		top, err := btcdb.FetchRichList(db, 3)
+		if err != nil || !reflect.DeepEqual(top, rich[:3]) {
+			t.Errorf("FetchRichList (%s) %s: got %v (err %v), want %v",
+				dbType, desc, top, err, rich[:3])
+		}
+	}
+
+	half := len(blocks) / 2
+	alt := altChain(blocks[half-11], 20)
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "addrbalance", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		script := blocks[1].MsgBlock().Transactions[0].TxOut[0].PkScript
+		if _, err := btcdb.FetchAddrBalance(db, script); err != btcdb.ErrNoAddrBalanceIndex {
+			t.Errorf("FetchAddrBalance (%s): got %v without an "+
+				"index, want %v", dbType, err,
+				btcdb.ErrNoAddrBalanceIndex)
+		}
+		if _, err := btcdb.FetchRichList(db, 1); err != btcdb.ErrNoAddrBalanceIndex {
+			t.Errorf("FetchRichList (%s): got %v without an index, "+
+				"want %v", dbType, err, btcdb.ErrNoAddrBalanceIndex)
+		}
+
+		// The index is caught up with the blocks already stored.  The
+		// indexer added after it makes the insertion of blocks fail
+		// once the balances were updated.
+		if err := db.AddIndexer(btcdb.NewAddrBalanceIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		failIdx := new(testIndexer)
+		if err := db.AddIndexer(failIdx); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkBalances(dbType, "of the first blocks", db, blocks[:half])
+		got, err := btcdb.FetchAddrBalance(db, []byte{0x6a})
+		if err != nil || got != 0 {
+			t.Errorf("FetchAddrBalance (%s): got %d (err %v) for an "+
+				"unpaid script, want 0", dbType, got, err)
+		}
+
+		failIdx.fail = true
+		if _, err := db.InsertBlocks(blocks[half:]); err == nil {
+			t.Errorf("InsertBlocks (%s): unexpected success with "+
+				"failing indexer", dbType)
+		}
+		failIdx.fail = false
+		checkBalances(dbType, "after failing to insert blocks", db,
+			blocks[:half])
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkBalances(dbType, "of every block", db, blocks)
+
+		// Balances are restored as blocks are replaced, and the
+		// outputs of the replacing blocks paying the same script add
+		// up.
+		keepSha, _ := blocks[half-11].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkBalances(dbType, "after dropping blocks", db,
+			blocks[:half-10])
+		if _, err := db.InsertBlocks(alt); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		chain := append(append([]*btcutil.Block(nil),
+			blocks[:half-10]...), alt...)
+		checkBalances(dbType, "after replacing blocks", db, chain)
+		teardown()
+	}
+}
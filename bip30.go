@@ -0,0 +1,56 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// newShaHashFromStr converts the passed big-endian hex string into a
+// btcwire.ShaHash.  It only differs from the one available in btcwire in that
+// it ignores the error since it will only (and must only) be called with
+// hard-coded, and therefore known good, hashes.
+func newShaHashFromStr(hexStr string) *btcwire.ShaHash {
+	sha, _ := btcwire.NewShaHashFromStr(hexStr)
+	return sha
+}
+
+// bip30Exceptions maps the heights of the blocks which contain a duplicate of a
+// transaction which is not fully spent to the hash of that transaction.
+//
+// Two old blocks contain duplicate coinbase transactions due to being mined by
+// faulty miners and accepted by the origin Satoshi client.  BIP0030 has since
+// been added to ensure this problem can no longer happen, but the two
+// duplicate transactions which were originally accepted are forever in the
+// block chain history and must be dealt with specially.  The duplicates at
+// heights 91842 and 91880 overwrite the transactions of the same hash at
+// heights 91812 and 91722, whose outputs can no longer be spent.
+// http://blockexplorer.com/b/91842
+// http://blockexplorer.com/b/91880
+var bip30Exceptions = map[int64]*btcwire.ShaHash{
+	91842: newShaHashFromStr("d5d27987d2a3dfc724e359870c6644b40e497bdc0589a033220fe15429d88599"),
+	91880: newShaHashFromStr("e3bf3d07d4b0375638d5f1db5255fe07ba2c4cb067cd81b84ee974b6585fb468"),
+}
+
+// bip30Overwritten maps the heights of the blocks in bip30Exceptions to the
+// heights of the blocks holding the transactions their duplicates overwrite.
+var bip30Overwritten = map[int64]int64{
+	91842: 91812,
+	91880: 91722,
+}
+
+// IsBIP30Exception returns whether or not the transaction with the passed hash
+// in the block at the given height may overwrite an earlier transaction of the
+// same hash which is not fully spent.  Every other duplicate of such a
+// transaction must be rejected with DuplicateSha.
+//
+// When the earlier transaction is overwritten, it is kept as an instance of
+// the transaction which is fully spent, so its outputs are no longer available
+// for spending, and it is made available again when the block containing the
+// duplicate is removed.
+func IsBIP30Exception(height int64, sha *btcwire.ShaHash) bool {
+	dup, ok := bip30Exceptions[height]
+	return ok && dup.IsEqual(sha)
+}
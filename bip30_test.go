@@ -0,0 +1,360 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bip30CoinbaseFile holds the coinbase transactions of the mainnet blocks 91722,
+// 91812, 91842 and 91880, one per line as the height of the block followed by
+// the serialized transaction in hex.
+var bip30CoinbaseFile = filepath.Join("testdata", "bip30coinbases.txt")
+
+// bip30Coinbases maps the heights of the mainnet blocks holding the historical
+// duplicate coinbases to the hash of their coinbase.
+var bip30Coinbases = map[int64]string{
+	91722: "e3bf3d07d4b0375638d5f1db5255fe07ba2c4cb067cd81b84ee974b6585fb468",
+	91812: "d5d27987d2a3dfc724e359870c6644b40e497bdc0589a033220fe15429d88599",
+	91842: "d5d27987d2a3dfc724e359870c6644b40e497bdc0589a033220fe15429d88599",
+	91880: "e3bf3d07d4b0375638d5f1db5255fe07ba2c4cb067cd81b84ee974b6585fb468",
+}
+
+// loadBIP30Coinbases returns the mainnet coinbases of bip30CoinbaseFile keyed by
+// the height of their block, after checking each hashes to the one listed by
+// bip30Coinbases.
+func loadBIP30Coinbases() (map[int64]*btcwire.MsgTx, error) {
+	f, err := os.Open(bip30CoinbaseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	txs := make(map[int64]*btcwire.MsgTx)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line %q", scanner.Text())
+		}
+		height, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		var tx btcwire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+			return nil, err
+		}
+		sha, _ := tx.TxSha()
+		if want, ok := bip30Coinbases[height]; !ok || sha.String() != want {
+			return nil, fmt.Errorf("coinbase %v at height %d is not "+
+				"a mainnet duplicate", &sha, height)
+		}
+		txs[height] = &tx
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(txs) != len(bip30Coinbases) {
+		return nil, fmt.Errorf("got %d coinbases, want %d", len(txs),
+			len(bip30Coinbases))
+	}
+	return txs, nil
+}
+
+// TestBIP30 ensures a transaction may only have the hash of an earlier one which
+// is fully spent, except for the duplicates allowed by btcdb.IsBIP30Exception,
+// which overwrite the earlier one until the block containing the duplicate is
+// removed.  The exception is made for a duplicate in a block built on top of
+// the test chain, while TestBIP30Mainnet replays the historical duplicates.
+func TestBIP30(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	tip := blocks[len(blocks)-1]
+	tipHeight := int64(len(blocks) - 1)
+
+	// coinbase returns a coinbase transaction whose hash only depends on
+	// the passed tag.
+	coinbase := func(tag byte) *btcwire.MsgTx {
+		tx := btcwire.NewMsgTx()
+		prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{tag}))
+		tx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+		return tx
+	}
+
+	// makeBlock returns a block on top of the passed one which holds the
+	// passed transactions.
+	makeBlock := func(prev *btcutil.Block, nonce uint32,
+		txs ...*btcwire.MsgTx) *btcutil.Block {
+
+		prevSha, _ := prev.Sha()
+		prevHdr := &prev.MsgBlock().Header
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash, prevHdr.Bits,
+			nonce)
+		hdr.Timestamp = prevHdr.Timestamp.Add(10 * time.Minute)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		for _, tx := range txs {
+			msgBlock.AddTransaction(tx)
+		}
+		return btcutil.NewBlock(msgBlock)
+	}
+
+	dupTx := coinbase(1)
+	dupSha, _ := dupTx.TxSha()
+	first := makeBlock(tip, 1, dupTx)
+	dup := makeBlock(first, 2, coinbase(1))
+	inBlockDup := makeBlock(first, 3, coinbase(2), coinbase(2))
+
+	// The duplicate is allowed once the output of the first instance is
+	// spent.
+	spendTx := btcwire.NewMsgTx()
+	spendTx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&dupSha, 0),
+		[]byte{0x51}))
+	spendTx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+	spend := makeBlock(first, 4, coinbase(3), spendTx)
+	spentDup := makeBlock(spend, 5, coinbase(1))
+
+	type txIndexer interface {
+		EnableTxIndex(bool) error
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "bip30", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		// The standalone transaction index must follow the instance
+		// which is unspent as well.
+		if indexer, ok := db.(txIndexer); ok {
+			if err := indexer.EnableTxIndex(true); err != nil {
+				t.Errorf("EnableTxIndex (%s): %v", dbType, err)
+				teardown()
+				continue
+			}
+		}
+		blocks := append(blocks[:len(blocks):len(blocks)], first)
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		// checkDup ensures the unspent instance of the duplicated
+		// transaction is the one at the passed height.
+		checkDup := func(when string, height int64) {
+			reply := db.FetchUnSpentTxByShaList(
+				[]*btcwire.ShaHash{&dupSha})[0]
+			if reply.Err != nil || reply.Height != height ||
+				len(reply.TxSpent) != 1 || reply.TxSpent[0] {
+
+				t.Errorf("FetchUnSpentTxByShaList (%s): %s got "+
+					"height %d spent %v (err %v), want "+
+					"unspent at height %d", dbType, when,
+					reply.Height, reply.TxSpent, reply.Err,
+					height)
+			}
+			op := btcwire.NewOutPoint(&dupSha, 0)
+			entry, err := db.FetchUtxoEntry(op)
+			if err == nil && (entry == nil || entry.Height != height) {
+				t.Errorf("FetchUtxoEntry (%s): %s got %+v, want "+
+					"height %d", dbType, when, entry, height)
+			}
+		}
+
+		// Unspent duplicates and duplicates in the same block are
+		// rejected.
+		for _, block := range []*btcutil.Block{dup, inBlockDup} {
+			if _, err := db.InsertBlock(block); err != btcdb.DuplicateSha {
+				t.Errorf("InsertBlock (%s): unexpected error "+
+					"for duplicate - got %v, want %v",
+					dbType, err, btcdb.DuplicateSha)
+			}
+		}
+		_, height, err := db.NewestSha()
+		if err != nil || height != tipHeight+1 {
+			t.Errorf("NewestSha (%s): got height %d (err %v) after "+
+				"duplicates, want %d", dbType, height, err,
+				tipHeight+1)
+		}
+		checkDup("before the exception", tipHeight+1)
+
+		// The exception overwrites the earlier instance until it is
+		// removed.
+		restore := btcdb.SetBIP30Exception(tipHeight+2, &dupSha)
+		height, err = db.InsertBlock(dup)
+		if err != nil || height != tipHeight+2 {
+			t.Errorf("InsertBlock (%s): got height %d (err %v) for "+
+				"exception, want %d", dbType, height, err,
+				tipHeight+2)
+		}
+		checkDup("after the exception", tipHeight+2)
+		firstSha, _ := first.Sha()
+		if err := db.DropAfterBlockBySha(firstSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		restore()
+		checkDup("after dropping the exception", tipHeight+1)
+		if _, err := db.InsertBlock(dup); err != btcdb.DuplicateSha {
+			t.Errorf("InsertBlock (%s): unexpected error for "+
+				"duplicate once restored - got %v, want %v",
+				dbType, err, btcdb.DuplicateSha)
+		}
+
+		// A duplicate of a fully spent transaction is allowed.
+		for _, block := range []*btcutil.Block{spend, spentDup} {
+			if _, err := db.InsertBlock(block); err != nil {
+				t.Errorf("InsertBlock (%s): %v", dbType, err)
+			}
+		}
+		checkDup("after spending", tipHeight+3)
+		teardown()
+	}
+}
+
+// TestBIP30Mainnet replays the historical duplicate coinbases of the mainnet
+// blocks 91842 and 91880 at their heights, on top of a chain of blocks with a
+// coinbase of their own, and ensures they are allowed by the exceptions of
+// btcdb.IsBIP30Exception as they are, overwriting the coinbases of the blocks
+// 91812 and 91722 until they are removed.  The chain is long, so it is only
+// replayed with the memory and leveldb drivers.
+func TestBIP30Mainnet(t *testing.T) {
+	coinbases, err := loadBIP30Coinbases()
+	if os.IsNotExist(err) {
+		t.Skipf("%s is missing, so the mainnet duplicates are not "+
+			"replayed", bip30CoinbaseFile)
+	}
+	if err != nil {
+		t.Fatalf("loadBIP30Coinbases: %v", err)
+	}
+
+	// Every other block has a coinbase whose hash only depends on its
+	// height.
+	const tipHeight = 91880
+	blocks := make([]*btcutil.Block, 0, tipHeight+1)
+	prev := btcutil.NewBlock(&btcwire.GenesisBlock)
+	blocks = append(blocks, prev)
+	for height := int64(1); height <= tipHeight; height++ {
+		tx, ok := coinbases[height]
+		if !ok {
+			var script [5]byte
+			binary.LittleEndian.PutUint32(script[:4], uint32(height))
+			script[4] = 0x51
+			tx = btcwire.NewMsgTx()
+			prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+			tx.AddTxIn(btcwire.NewTxIn(prevOut, script[:]))
+			tx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+		}
+		prevSha, _ := prev.Sha()
+		prevHdr := &prev.MsgBlock().Header
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash, prevHdr.Bits, 0)
+		hdr.Timestamp = prevHdr.Timestamp.Add(10 * time.Minute)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		msgBlock.AddTransaction(tx)
+		prev = btcutil.NewBlock(msgBlock)
+		blocks = append(blocks, prev)
+	}
+
+	type txIndexer interface {
+		EnableTxIndex(bool) error
+	}
+
+	for _, dbType := range []string{"memory", "leveldb"} {
+		db, teardown, err := createDB(dbType, "bip30mainnet", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if indexer, ok := db.(txIndexer); ok {
+			if err := indexer.EnableTxIndex(true); err != nil {
+				t.Errorf("EnableTxIndex (%s): %v", dbType, err)
+				teardown()
+				continue
+			}
+		}
+		inserted := true
+		for start := 0; start < len(blocks); start += 1000 {
+			end := start + 1000
+			if end > len(blocks) {
+				end = len(blocks)
+			}
+			if _, err := db.InsertBlocks(blocks[start:end]); err != nil {
+				t.Errorf("InsertBlocks (%s) %d-%d: %v", dbType,
+					start, end-1, err)
+				inserted = false
+				break
+			}
+		}
+		if !inserted {
+			teardown()
+			continue
+		}
+
+		// checkDups ensures the unspent instance of each duplicated
+		// coinbase is the one in the block at the passed height.
+		checkDups := func(when string, heights ...int64) {
+			for _, height := range heights {
+				sha, _ := coinbases[height].TxSha()
+				reply := db.FetchUnSpentTxByShaList(
+					[]*btcwire.ShaHash{&sha})[0]
+				if reply.Err != nil || reply.Height != height {
+					t.Errorf("FetchUnSpentTxByShaList (%s): "+
+						"%s got %v at height %d (err %v), "+
+						"want height %d", dbType, when,
+						&sha, reply.Height, reply.Err,
+						height)
+				}
+				replies, err := db.FetchTxBySha(&sha)
+				if err != nil || len(replies) == 0 ||
+					replies[len(replies)-1].Height != height {
+					t.Errorf("FetchTxBySha (%s): %s got %d "+
+						"instances of %v (err %v), want "+
+						"the newest at height %d", dbType,
+						when, len(replies), &sha, err,
+						height)
+				}
+			}
+		}
+		checkDups("after the duplicates", 91842, 91880)
+
+		dropSha, _ := blocks[91841].Sha()
+		if err := db.DropAfterBlockBySha(dropSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkDups("after dropping the duplicates", 91812, 91722)
+		teardown()
+	}
+}
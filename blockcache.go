@@ -0,0 +1,236 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"container/list"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// BlockCacheStats describes the use of the cache of recent blocks of a
+// database.
+type BlockCacheStats struct {
+	// Size is the number of bytes of serialized blocks held by the cache
+	// and MaxSize the number it holds at most.
+	Size    int64
+	MaxSize int64
+
+	// Blocks is the number of blocks held by the cache.
+	Blocks int
+
+	// Hits and Misses are the number of blocks fetched which were and were
+	// not found in the cache.
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate returns the fraction of the blocks fetched which were found in the
+// cache, or zero when no blocks were fetched.
+func (s BlockCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// BlockCache holds the serialized form of the blocks most recently fetched
+// from and inserted into a database, up to a number of bytes, so blocks which
+// are requested repeatedly, such as new blocks relayed to many peers, are not
+// read from the storage engine every time.  The blocks used least recently are
+// evicted first.  It is intended for drivers, which add blocks as they are
+// read or committed and remove them as they are dropped or pruned.
+//
+// Drivers whose reads may run while blocks are dropped must not add a block
+// they read after it was removed from the cache.  They take the Epoch of the
+// cache before starting the read and add the block with AddRead, which does
+// nothing when blocks were removed meanwhile.
+//
+// All functions are safe for concurrent use and do nothing on a nil cache,
+// which is what NewBlockCache returns when caching is disabled.
+type BlockCache struct {
+	mtx     sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[btcwire.ShaHash]*list.Element
+	epoch   uint64
+	hits    uint64
+	misses  uint64
+}
+
+// blockCacheEntry is a block held by a BlockCache.
+type blockCacheEntry struct {
+	sha    btcwire.ShaHash
+	height int64
+	raw    []byte
+}
+
+// NewBlockCache returns a cache holding up to the given number of bytes of
+// serialized blocks, or nil when the size is not positive.
+func NewBlockCache(maxSize int) *BlockCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &BlockCache{
+		maxSize: int64(maxSize),
+		lru:     list.New(),
+		entries: make(map[btcwire.ShaHash]*list.Element),
+	}
+}
+
+// Lookup returns the block with the given hash with its height set, or nil
+// when the cache does not hold it.  A new block is returned every time, so
+// callers may use it as they please.
+func (c *BlockCache) Lookup(sha *btcwire.ShaHash) *btcutil.Block {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	elem, ok := c.entries[*sha]
+	if !ok {
+		c.misses++
+		c.mtx.Unlock()
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*blockCacheEntry)
+	c.mtx.Unlock()
+
+	blk, err := btcutil.NewBlockFromBytes(entry.raw)
+	if err != nil {
+		return nil
+	}
+	blk.SetHeight(entry.height)
+	return blk
+}
+
+// Epoch returns a value which changes whenever blocks are removed from the
+// cache, to be passed to AddRead.
+func (c *BlockCache) Epoch() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.epoch
+}
+
+// Add adds the serialized block with the given hash and height to the cache,
+// evicting the blocks used least recently as needed.  Blocks larger than the
+// cache are not added.  The cache keeps the passed slice, which must not be
+// modified afterwards.  The block must still be in the database, which drivers
+// ensure by adding blocks while holding a lock which excludes drops.
+func (c *BlockCache) Add(sha *btcwire.ShaHash, height int64, raw []byte) {
+	c.AddRead(c.Epoch(), sha, height, raw)
+}
+
+// AddRead adds the serialized block with the given hash and height which was
+// read from the database after the cache was at the given epoch.  The block
+// is not added when blocks were removed since, as it may be one of them.
+func (c *BlockCache) AddRead(epoch uint64, sha *btcwire.ShaHash, height int64, raw []byte) {
+	if c == nil || int64(len(raw)) > c.maxSize {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+	if elem, ok := c.entries[*sha]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	entry := &blockCacheEntry{sha: *sha, height: height, raw: raw}
+	c.entries[*sha] = c.lru.PushFront(entry)
+	c.size += int64(len(raw))
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// AddBlocks adds the passed blocks, which were inserted at the given heights,
+// to the cache.
+func (c *BlockCache) AddBlocks(blocks []*btcutil.Block, heights []int64) {
+	if c == nil {
+		return
+	}
+	for i, blk := range blocks {
+		sha, err := blk.Sha()
+		if err != nil {
+			continue
+		}
+		raw, err := blk.Bytes()
+		if err != nil {
+			continue
+		}
+		c.Add(sha, heights[i], raw)
+	}
+}
+
+// RemoveFrom removes the blocks at or above the given height from the cache,
+// which is done once they are dropped from the database.
+func (c *BlockCache) RemoveFrom(height int64) {
+	c.removeIf(func(h int64) bool { return h >= height })
+}
+
+// RemoveBelow removes the blocks below the given height from the cache, which
+// is done once their bodies are pruned from the database.
+func (c *BlockCache) RemoveBelow(height int64) {
+	c.removeIf(func(h int64) bool { return h < height })
+}
+
+// removeIf removes every block whose height matches the passed function.
+func (c *BlockCache) removeIf(match func(height int64) bool) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.epoch++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*blockCacheEntry).height) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// remove removes the passed element from the cache.
+//
+// This function must be called with the cache lock held.
+func (c *BlockCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*blockCacheEntry)
+	delete(c.entries, entry.sha)
+	c.size -= int64(len(entry.raw))
+}
+
+// Stats returns the current use of the cache.  A nil cache has zero stats.
+func (c *BlockCache) Stats() BlockCacheStats {
+	if c == nil {
+		return BlockCacheStats{}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return BlockCacheStats{
+		Size:    c.size,
+		MaxSize: c.maxSize,
+		Blocks:  c.lru.Len(),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBlockCache ensures every driver serves the blocks it inserted and
+// fetched from its block cache and never serves the blocks it dropped.
+func TestBlockCache(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+	keepSha, _ := blocks[3].Sha()
+	droppedSha, _ := blocks[5].Sha()
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path:           filepath.Join(testDbRoot, "cachedb-"+dbType),
+			BlockCacheSize: 1024 * 1024,
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		for i := 0; i < 2; i++ {
+			blk, err := db.FetchBlockBySha(droppedSha)
+			if err != nil {
+				t.Errorf("FetchBlockBySha (%s): %v", dbType, err)
+				continue
+			}
+			sha, _ := blk.Sha()
+			if !sha.IsEqual(droppedSha) || blk.Height() != 5 {
+				t.Errorf("FetchBlockBySha (%s): got block %v at "+
+					"height %d, want %v at height 5", dbType,
+					sha, blk.Height(), droppedSha)
+			}
+		}
+		stats := db.BlockCacheStats()
+
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		if _, err := db.FetchBlockBySha(droppedSha); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockBySha (%s): got %v for a dropped "+
+				"block, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		dropStats := db.BlockCacheStats()
+		db.Close()
+
+		// A memory database has nothing to cache.
+		if dbType == "memory" {
+			continue
+		}
+		if stats.Blocks != len(blocks) || stats.Hits != 2 ||
+			stats.Misses != 0 || stats.Size == 0 ||
+			stats.MaxSize != int64(opts.BlockCacheSize) {
+			t.Errorf("BlockCacheStats (%s): got %+v after fetching "+
+				"inserted blocks", dbType, stats)
+		}
+		if dropStats.Blocks != 4 || dropStats.Misses != 1 {
+			t.Errorf("BlockCacheStats (%s): got %+v after drop",
+				dbType, dropStats)
+		}
+	}
+}
+
+// TestBlockCacheEviction ensures the block cache evicts the blocks used least
+// recently and does not add blocks read before blocks were removed.
+func TestBlockCacheEviction(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:4]
+	var shas []*btcwire.ShaHash
+	var raws [][]byte
+	for _, blk := range blocks {
+		sha, _ := blk.Sha()
+		raw, _ := blk.Bytes()
+		shas = append(shas, sha)
+		raws = append(raws, raw)
+	}
+
+	// The cache has room for the first three blocks, which are all the
+	// same size.
+	c := btcdb.NewBlockCache(3 * len(raws[1]))
+	for i := 1; i < 4; i++ {
+		c.Add(shas[i], int64(i), raws[i])
+	}
+	if c.Lookup(shas[1]) == nil {
+		t.Errorf("Lookup: block 1 is not cached")
+	}
+	epoch := c.Epoch()
+	c.Add(shas[0], 0, raws[0])
+	if c.Lookup(shas[2]) != nil {
+		t.Errorf("Lookup: block 2 used least recently was not evicted")
+	}
+
+	c.RemoveFrom(3)
+	c.AddRead(epoch, shas[3], 3, raws[3])
+	if c.Lookup(shas[3]) != nil {
+		t.Errorf("AddRead: block read before a removal was added")
+	}
+	c.AddRead(c.Epoch(), shas[2], 2, raws[2])
+	if blk := c.Lookup(shas[2]); blk == nil || blk.Height() != 2 {
+		t.Errorf("AddRead: block 2 was not added")
+	}
+
+	var nilCache *btcdb.BlockCache
+	nilCache.Add(shas[0], 0, raws[0])
+	if nilCache.Lookup(shas[0]) != nil || nilCache.Stats().Blocks != 0 {
+		t.Errorf("Lookup: a nil cache holds blocks")
+	}
+	if btcdb.NewBlockCache(0) != nil {
+		t.Errorf("NewBlockCache: got a cache of size 0")
+	}
+}
+
+// waitForCachedBlocks waits for the block cache of the passed database to hold
+// the given number of blocks and returns whether it did before timing out.
+func waitForCachedBlocks(db btcdb.Db, n int) bool {
+	for i := 0; i < 500; i++ {
+		if db.BlockCacheStats().Blocks >= n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
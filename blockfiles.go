@@ -0,0 +1,117 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// BlockFilesCheckpointKey is the key of the metadata namespace under which
+// ImportBlockFiles records the number of the first block file it reads when it
+// is run again.
+var BlockFilesCheckpointKey = []byte("btcdb/blockfiles")
+
+// ImportBlockFiles inserts the blocks of the main chain stored in the
+// blkNNNNN.dat files of the blocks directory of the reference client at the
+// passed path into the passed database, reading the files in the order of
+// their numbers with the framing of the passed network.  It returns the number
+// of blocks inserted.
+//
+// Blocks are connected as by ImportBootstrap, which leaves out the stale blocks
+// the files hold along with the main chain.  Once each file has been read, the
+// number of the first file holding a block which is still waiting for its
+// parent, or of the next file, is stored under BlockFilesCheckpointKey in the
+// same change as the last of the blocks inserted, so an interrupted import
+// picks up from there when it is run again.
+func ImportBlockFiles(db Db, path string, net btcwire.BitcoinNet) (int64, error) {
+	files, err := blockFiles(path)
+	if err != nil {
+		return 0, err
+	}
+
+	start := 0
+	val, err := db.GetMeta(BlockFilesCheckpointKey)
+	if err != nil {
+		return 0, err
+	}
+	if val != nil {
+		if len(val) != 4 {
+			return 0, fmt.Errorf("malformed block file checkpoint %x",
+				val)
+		}
+		start = int(binary.LittleEndian.Uint32(val))
+	}
+
+	imp, err := newBootstrapImporter(db)
+	if err != nil {
+		return 0, err
+	}
+	for _, num := range files {
+		if num < start {
+			continue
+		}
+		err := importBlockFile(imp, path, num, net)
+		if err != nil {
+			return imp.inserted, err
+		}
+		log.Debugf("Imported block file %d, %d blocks inserted", num,
+			imp.inserted)
+	}
+	if imp.numOrphans != 0 {
+		log.Warnf("%d blocks of the block files were not connected "+
+			"to the chain", imp.numOrphans)
+	}
+	return imp.inserted, nil
+}
+
+// importBlockFile adds the blocks of the block file with the given number to
+// the passed importer and inserts them along with the checkpoint after it.
+func importBlockFile(imp *bootstrapImporter, path string, num int, net btcwire.BitcoinNet) error {
+	f, err := os.Open(filepath.Join(path, fmt.Sprintf("blk%05d.dat", num)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := imp.importStream(f, net, num); err != nil {
+		return fmt.Errorf("block file %d: %v", num, err)
+	}
+
+	var checkpoint [4]byte
+	next := imp.firstOrphanSource(num + 1)
+	binary.LittleEndian.PutUint32(checkpoint[:], uint32(next))
+	var meta MetaBatch
+	meta.Put(BlockFilesCheckpointKey, checkpoint[:])
+	return imp.flush(&meta)
+}
+
+// blockFiles returns the numbers of the blkNNNNN.dat files in the directory at
+// the passed path in ascending order.
+func blockFiles(path string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(path, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	var files []int
+	for _, name := range names {
+		var num int
+		base := filepath.Base(name)
+		_, err := fmt.Sscanf(base, "blk%05d.dat", &num)
+		if err != nil || fmt.Sprintf("blk%05d.dat", num) != base {
+			continue
+		}
+		files = append(files, num)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no block files in %v", path)
+	}
+	sort.Ints(files)
+	return files, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestImportBlockFiles ensures the blocks in a directory of block files are
+// inserted into every supported database type and that an import which only
+// saw some of the files is resumed from its checkpoint.
+func TestImportBlockFiles(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The first file holds blocks whose parents are in the second file,
+	// which also ends in padding.
+	dir := "tstblockfiles"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Errorf("Unable to create block file directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fileBlocks := [][]*btcutil.Block{
+		append(append([]*btcutil.Block{}, blocks[:30]...), blocks[40:60]...),
+		append(append([]*btcutil.Block{}, blocks[30:40]...), blocks[60:100]...),
+		blocks[100:],
+	}
+	var files [][]byte
+	for _, blks := range fileBlocks {
+		var buf bytes.Buffer
+		for _, block := range blks {
+			raw, _ := block.Bytes()
+			binary.Write(&buf, binary.LittleEndian, uint32(network))
+			binary.Write(&buf, binary.LittleEndian, uint32(len(raw)))
+			buf.Write(raw)
+		}
+		buf.Write(make([]byte, 64))
+		files = append(files, buf.Bytes())
+	}
+	writeFiles := func(n int) {
+		for i, data := range files[:n] {
+			name := filepath.Join(dir, fmt.Sprintf("blk%05d.dat", i))
+			if err := ioutil.WriteFile(name, data, 0600); err != nil {
+				t.Errorf("Unable to write block file: %v", err)
+			}
+		}
+	}
+	checkpoint := func(db btcdb.Db) int {
+		val, err := db.GetMeta(btcdb.BlockFilesCheckpointKey)
+		if err != nil || len(val) != 4 {
+			return -1
+		}
+		return int(binary.LittleEndian.Uint32(val))
+	}
+
+	wantSha, _ := blocks[len(blocks)-1].Sha()
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "blockfiles", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		// Blocks waiting for their parents keep the checkpoint at the
+		// file they were read from.
+		writeFiles(1)
+		n, err := btcdb.ImportBlockFiles(db, dir, network)
+		if err != nil || n != 30 {
+			t.Errorf("ImportBlockFiles (%s): inserted %d blocks (err "+
+				"%v), want 30", dbType, n, err)
+		}
+		if got := checkpoint(db); got != 0 {
+			t.Errorf("ImportBlockFiles (%s): got checkpoint %d, "+
+				"want 0", dbType, got)
+		}
+
+		writeFiles(len(files))
+		n, err = btcdb.ImportBlockFiles(db, dir, network)
+		if err != nil || n != int64(len(blocks)-30) {
+			t.Errorf("ImportBlockFiles (%s): inserted %d blocks (err "+
+				"%v), want %d", dbType, n, err, len(blocks)-30)
+		}
+		if got := checkpoint(db); got != len(files) {
+			t.Errorf("ImportBlockFiles (%s): got checkpoint %d, "+
+				"want %d", dbType, got, len(files))
+		}
+		sha, height, err := db.NewestSha()
+		if err != nil || !sha.IsEqual(wantSha) {
+			t.Errorf("NewestSha (%s): got %v at height %d (err %v), "+
+				"want %v", dbType, sha, height, err, wantSha)
+		}
+
+		// Nothing is left to read once every file is done.
+		n, err = btcdb.ImportBlockFiles(db, dir, network)
+		if err != nil || n != 0 {
+			t.Errorf("ImportBlockFiles (%s): inserted %d blocks (err "+
+				"%v), want 0", dbType, n, err)
+		}
+		teardown()
+		for i := range files {
+			os.Remove(filepath.Join(dir, fmt.Sprintf("blk%05d.dat", i)))
+		}
+	}
+}
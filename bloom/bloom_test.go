@@ -0,0 +1,222 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bloom_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/conformal/btcdb/bloom"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestMurmurHash3 ensures MurmurHash3 produces the test vectors used by the
+// reference implementation of BIP0037.
+func TestMurmurHash3(t *testing.T) {
+	tests := []struct {
+		seed uint32
+		data string
+		want uint32
+	}{
+		{0x00000000, "", 0x00000000},
+		{0xfba4c795, "", 0x6a396f08},
+		{0xffffffff, "", 0x81f16f39},
+		{0x00000000, "00", 0x514e28b7},
+		{0xfba4c795, "00", 0xea3f0b17},
+		{0x00000000, "ff", 0xfd6cf10d},
+		{0x00000000, "0011", 0x16c6b7ab},
+		{0x00000000, "001122", 0x8eb51c3d},
+		{0x00000000, "00112233", 0xb4471bf8},
+		{0x00000000, "21436587", 0xf55b516b},
+		{0x5082edee, "21436587", 0x2362f9de},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		got := bloom.MurmurHash3(test.seed, data)
+		if got != test.want {
+			t.Errorf("MurmurHash3(%x, %s): got %08x, want %08x",
+				test.seed, test.data, got, test.want)
+		}
+	}
+}
+
+// TestFilter ensures filters are sized and filled as by the reference
+// implementation of BIP0037 and that the data added to them matches.
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		tweak uint32
+		want  string
+	}{
+		{0, "614e9b"},
+		{2147483649, "ce4299"},
+	}
+	items := []string{
+		"99108ad8ed9bb6274d3980bab5a85c048f0950c8",
+		"b5a2c786d9ef4658287ced5914b37a1b4aa32eee",
+		"b9300670b4c5366e95b2699e8b18bc75e5f729c5",
+	}
+	other, _ := hex.DecodeString("19108ad8ed9bb6274d3980bab5a85c048f0950c8")
+
+	for _, test := range tests {
+		f := bloom.NewFilter(3, test.tweak, 0.01, bloom.UpdateAll)
+		for _, item := range items {
+			data, _ := hex.DecodeString(item)
+			f.Add(data)
+			if !f.Matches(data) {
+				t.Errorf("Matches (tweak %d): %s does not match "+
+					"after it was added", test.tweak, item)
+			}
+		}
+		if f.Matches(other) {
+			t.Errorf("Matches (tweak %d): %x matches without being "+
+				"added", test.tweak, other)
+		}
+		data, hashFuncs := f.Data()
+		if hex.EncodeToString(data) != test.want || hashFuncs != 5 {
+			t.Errorf("NewFilter (tweak %d): got %x with %d hash "+
+				"functions, want %s with 5", test.tweak, data,
+				hashFuncs, test.want)
+		}
+
+		f = bloom.LoadFilter(data, hashFuncs, test.tweak, bloom.UpdateAll)
+		for _, item := range items {
+			data, _ := hex.DecodeString(item)
+			if !f.Matches(data) {
+				t.Errorf("Matches (tweak %d): %s does not match "+
+					"the loaded filter", test.tweak, item)
+			}
+		}
+	}
+}
+
+// testTx returns a transaction spending the passed outpoint to an output
+// with the passed script.
+func testTx(prevOut *btcwire.OutPoint, pkScript []byte) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx()
+	tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{0x51}))
+	tx.AddTxOut(btcwire.NewTxOut(50*1e8, pkScript))
+	return tx
+}
+
+// testBlock returns a block holding the passed transactions with the merkle
+// root of their hashes.
+func testBlock(txs []*btcwire.MsgTx) *btcutil.Block {
+	level := make([]btcwire.ShaHash, len(txs))
+	for i, tx := range txs {
+		level[i], _ = tx.TxSha()
+	}
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]btcwire.ShaHash, len(level)/2)
+		for i := range next {
+			buf := append(level[2*i].Bytes(), level[2*i+1].Bytes()...)
+			next[i].SetBytes(btcwire.DoubleSha256(buf))
+		}
+		level = next
+	}
+
+	msgBlock := btcwire.NewMsgBlock(btcwire.NewBlockHeader(
+		&btcwire.ShaHash{}, &level[0], 0x1d00ffff, 0))
+	for _, tx := range txs {
+		msgBlock.AddTransaction(tx)
+	}
+	return btcutil.NewBlock(msgBlock)
+}
+
+// TestMerkleBlock ensures merkle blocks prove exactly the transactions matched
+// by a filter for blocks of every shape, that filters are updated with the
+// outputs matched, and that tampered merkle blocks are rejected.
+func TestMerkleBlock(t *testing.T) {
+	coinbase := btcwire.NewOutPoint(&btcwire.ShaHash{}, math.MaxUint32)
+	for numTx := 1; numTx <= 9; numTx++ {
+		txs := make([]*btcwire.MsgTx, numTx)
+		for i := range txs {
+			txs[i] = testTx(coinbase, []byte{0x01, byte(i), 0xac})
+		}
+		block := testBlock(txs)
+
+		// Every subset of up to the first three transactions and the
+		// last one is matched by adding their script data to a filter.
+		for set := 0; set < 16; set++ {
+			f := bloom.NewFilter(10, 0, 0.0001, bloom.UpdateNone)
+			var want []*btcwire.ShaHash
+			for i, tx := range block.Transactions() {
+				bit := i
+				if i == numTx-1 {
+					bit = 3
+				} else if i >= 3 {
+					continue
+				}
+				if set&(1<<uint(bit)) != 0 {
+					f.Add([]byte{byte(i)})
+					want = append(want, tx.Sha())
+				}
+			}
+
+			mb, matches := bloom.NewMerkleBlock(block, f)
+			var got []*btcwire.ShaHash
+			for _, tx := range matches {
+				got = append(got, tx.Sha())
+			}
+			extracted, err := mb.ExtractMatches()
+			if err != nil || !reflect.DeepEqual(got, want) ||
+				!reflect.DeepEqual(extracted, want) {
+				t.Errorf("NewMerkleBlock (%d txs, set %x): matched "+
+					"%v and extracted %v (err %v), want %v",
+					numTx, set, got, extracted, err, want)
+				continue
+			}
+
+			// A merkle block whose hashes were tampered with no
+			// longer leads to the merkle root.
+			mb.Hashes[0] = &btcwire.ShaHash{0x01}
+			if _, err := mb.ExtractMatches(); err == nil {
+				t.Errorf("ExtractMatches (%d txs, set %x): "+
+					"tampered merkle block was accepted",
+					numTx, set)
+			}
+		}
+	}
+
+	// Transactions spending the outputs matched are only matched when
+	// the filter is updated with them.
+	first := testTx(coinbase, []byte{0x01, 0x07, 0xac})
+	firstSha, _ := first.TxSha()
+	second := testTx(btcwire.NewOutPoint(&firstSha, 0), []byte{0x51})
+	block := testBlock([]*btcwire.MsgTx{first, second})
+	for _, flags := range []bloom.UpdateType{bloom.UpdateNone,
+		bloom.UpdateAll, bloom.UpdateP2PubkeyOnly} {
+
+		f := bloom.NewFilter(10, 0, 0.0001, flags)
+		f.Add([]byte{0x07})
+		_, matches := bloom.NewMerkleBlock(block, f)
+		want := 2
+		if flags != bloom.UpdateAll {
+			want = 1
+		}
+		if len(matches) != want {
+			t.Errorf("NewMerkleBlock (flags %d): got %d matches, "+
+				"want %d", flags, len(matches), want)
+		}
+	}
+
+	// A merkle block is written in the format of a merkleblock message.
+	mb, _ := bloom.NewMerkleBlock(block, bloom.NewFilter(1, 0, 0.01,
+		bloom.UpdateNone))
+	var buf bytes.Buffer
+	if err := mb.Serialize(&buf); err != nil {
+		t.Errorf("Serialize: %v", err)
+	}
+	if buf.Len() != 80+4+1+32+1+1 {
+		t.Errorf("Serialize: got %d bytes, want %d", buf.Len(),
+			80+4+1+32+1+1)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package bloom implements the bloom filters and merkle blocks described by
+BIP0037 which are used to serve filtered blocks to light clients.
+
+A client loads a filter holding the data it is interested in, such as its
+public keys and the hashes of its addresses, with a filterload message.  For
+each block it asks for, it is sent a merkle block proving which transactions of
+the block match the filter, followed by those transactions.  FetchMerkleBlock
+builds both from a block stored in a database:
+
+	filter := bloom.LoadFilter(msg.Filter, msg.HashFuncs, msg.Tweak,
+		bloom.UpdateType(msg.Flags))
+	mb, txs, err := bloom.FetchMerkleBlock(db, blockSha, filter)
+	if err != nil {
+		return err
+	}
+*/
+package bloom
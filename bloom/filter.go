@@ -0,0 +1,206 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"math"
+	"sync"
+)
+
+const (
+	// MaxFilterSize is the largest size in bytes of a filter allowed by
+	// BIP0037.
+	MaxFilterSize = 36000
+
+	// MaxHashFuncs is the largest number of hash functions of a filter
+	// allowed by BIP0037.
+	MaxHashFuncs = 50
+
+	// hashSeedMul is multiplied by the number of each hash function to
+	// derive its seed.
+	hashSeedMul = 0xfba4c795
+)
+
+// ln2Squared is the square of the natural logarithm of 2.
+var ln2Squared = math.Ln2 * math.Ln2
+
+// UpdateType tells a filter which outputs of the transactions it matches to
+// add to itself, so the transactions spending them are matched too.
+type UpdateType uint8
+
+const (
+	// UpdateNone adds no outputs to the filter.
+	UpdateNone UpdateType = iota
+
+	// UpdateAll adds every output whose script pushes data matched by
+	// the filter.
+	UpdateAll
+
+	// UpdateP2PubkeyOnly only adds such outputs when their script pays
+	// to a public key or is a multisig script.
+	UpdateP2PubkeyOnly
+)
+
+// Filter is a BIP0037 bloom filter which a light client loads to learn of the
+// transactions it is interested in without telling which they are.  It is
+// safe for concurrent access.
+type Filter struct {
+	mtx       sync.Mutex
+	data      []byte
+	hashFuncs uint32
+	tweak     uint32
+	flags     UpdateType
+}
+
+// NewFilter returns an empty filter sized to hold the passed number of
+// elements with the passed false positive rate, which is between 0 and 1,
+// within the limits of BIP0037.  The tweak is added to the seed of each hash
+// function so the filters of different clients differ.
+func NewFilter(elements, tweak uint32, fprate float64, flags UpdateType) *Filter {
+	if elements == 0 {
+		elements = 1
+	}
+	fprate = math.Max(math.Min(fprate, 1), 1e-9)
+
+	bits := -1 / ln2Squared * float64(elements) * math.Log(fprate)
+	dataLen := uint32(math.Min(bits, MaxFilterSize*8)) / 8
+	hashFuncs := uint32(math.Min(float64(dataLen*8)/float64(elements)*
+		math.Ln2, MaxHashFuncs))
+	return &Filter{
+		data:      make([]byte, dataLen),
+		hashFuncs: hashFuncs,
+		tweak:     tweak,
+		flags:     flags,
+	}
+}
+
+// LoadFilter returns the filter a client loaded with a filterload message
+// holding the passed fields.  The filter keeps the slice, which must not be
+// modified afterwards.
+func LoadFilter(data []byte, hashFuncs, tweak uint32, flags UpdateType) *Filter {
+	return &Filter{
+		data:      data,
+		hashFuncs: hashFuncs,
+		tweak:     tweak,
+		flags:     flags,
+	}
+}
+
+// hash returns the index of the bit of the filter the passed hash function sets
+// for the passed data.  It must be called with the lock held and a filter
+// which is not empty.
+func (f *Filter) hash(hashNum uint32, data []byte) uint32 {
+	seed := hashNum*hashSeedMul + f.tweak
+	return murmurHash3(seed, data) % uint32(len(f.data)*8)
+}
+
+// matches returns whether the passed data matches the filter.  It must be
+// called with the lock held.
+func (f *Filter) matches(data []byte) bool {
+	if len(f.data) == 0 {
+		return false
+	}
+	for i := uint32(0); i < f.hashFuncs; i++ {
+		idx := f.hash(i, data)
+		if f.data[idx>>3]&(1<<(idx&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds the passed data to the filter.  It must be called with the lock
+// held.
+func (f *Filter) add(data []byte) {
+	if len(f.data) == 0 {
+		return
+	}
+	for i := uint32(0); i < f.hashFuncs; i++ {
+		idx := f.hash(i, data)
+		f.data[idx>>3] |= 1 << (idx & 7)
+	}
+}
+
+// outPointBytes returns the serialized form of the passed outpoint which
+// filters match: the hash of the transaction followed by the index of the
+// output as a little endian number.
+func outPointBytes(op *btcwire.OutPoint) []byte {
+	buf := make([]byte, btcwire.HashSize+4)
+	copy(buf, op.Hash.Bytes())
+	binary.LittleEndian.PutUint32(buf[btcwire.HashSize:], op.Index)
+	return buf
+}
+
+// Matches returns whether the passed data matches the filter.  Data which was
+// added always does, while other data does with about the false positive rate
+// of the filter.
+func (f *Filter) Matches(data []byte) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.matches(data)
+}
+
+// Add adds the passed data to the filter.
+func (f *Filter) Add(data []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.add(data)
+}
+
+// AddShaHash adds the passed hash to the filter.
+func (f *Filter) AddShaHash(sha *btcwire.ShaHash) {
+	f.Add(sha.Bytes())
+}
+
+// AddOutPoint adds the passed outpoint to the filter, so the transactions
+// spending it match.
+func (f *Filter) AddOutPoint(op *btcwire.OutPoint) {
+	f.Add(outPointBytes(op))
+}
+
+// MatchTxAndUpdate returns whether the passed transaction matches the filter as
+// set out by BIP0037: when the filter matches its hash, the data pushed by the
+// script of one of its outputs, one of the outpoints it spends or the data
+// pushed by the signature script of one of its inputs.  The outputs whose
+// script matches are added to the filter according to its update type.
+func (f *Filter) MatchTxAndUpdate(tx *btcwire.MsgTx, txSha *btcwire.ShaHash) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	matched := f.matches(txSha.Bytes())
+	for i, txOut := range tx.TxOut {
+		if !forEachData(txOut.PkScript, f.matches) {
+			continue
+		}
+		matched = true
+
+		switch f.flags {
+		case UpdateAll:
+			f.add(outPointBytes(btcwire.NewOutPoint(txSha, uint32(i))))
+		case UpdateP2PubkeyOnly:
+			class := btcdb.ClassifyScript(txOut.PkScript)
+			if class == btcdb.PubKeyTy || class == btcdb.MultiSigTy {
+				f.add(outPointBytes(btcwire.NewOutPoint(txSha,
+					uint32(i))))
+			}
+		}
+	}
+	if matched {
+		return true
+	}
+
+	for _, txIn := range tx.TxIn {
+		if f.matches(outPointBytes(&txIn.PreviousOutpoint)) ||
+			forEachData(txIn.SignatureScript, f.matches) {
+			return true
+		}
+	}
+	return false
+}
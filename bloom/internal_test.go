@@ -0,0 +1,20 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bloom
+
+// MurmurHash3 returns the MurmurHash3 of the passed data with the given seed.
+// This is a testing only interface.
+func MurmurHash3(seed uint32, data []byte) uint32 {
+	return murmurHash3(seed, data)
+}
+
+// Data returns the bits of the filter and the number of hash functions it
+// uses.  This is a testing only interface.
+func (f *Filter) Data() ([]byte, uint32) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return append([]byte(nil), f.data...), f.hashFuncs
+}
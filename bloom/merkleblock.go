@@ -0,0 +1,256 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// ErrMalformedMerkleBlock is returned by ExtractMatches when the partial merkle
+// tree of a merkle block does not describe a tree of its transactions.
+var ErrMalformedMerkleBlock = errors.New("malformed merkle block")
+
+// MerkleBlock is the header of a block along with a partial merkle tree of its
+// transactions which proves the block holds the transactions matched by a
+// filter, as sent to light clients in a merkleblock message.  Transactions is
+// the number of transactions of the block, and Hashes and Flags hold the tree
+// as set out by BIP0037.
+type MerkleBlock struct {
+	Header       btcwire.BlockHeader
+	Transactions uint32
+	Hashes       []*btcwire.ShaHash
+	Flags        []byte
+}
+
+// treeWidth returns the number of nodes of the merkle tree of the passed number
+// of transactions at the passed height, where the transactions are at height
+// 0.
+func treeWidth(numTx, height uint32) uint32 {
+	return (numTx + (1 << height) - 1) >> height
+}
+
+// treeHeight returns the height of the root of the merkle tree of the passed
+// number of transactions.
+func treeHeight(numTx uint32) uint32 {
+	var height uint32
+	for treeWidth(numTx, height) > 1 {
+		height++
+	}
+	return height
+}
+
+// hashMerkleBranches returns the hash of the node of a merkle tree whose
+// children have the passed hashes.
+func hashMerkleBranches(left, right *btcwire.ShaHash) *btcwire.ShaHash {
+	var buf [btcwire.HashSize * 2]byte
+	copy(buf[:btcwire.HashSize], left.Bytes())
+	copy(buf[btcwire.HashSize:], right.Bytes())
+	var sha btcwire.ShaHash
+	sha.SetBytes(btcwire.DoubleSha256(buf[:]))
+	return &sha
+}
+
+// merkleBuilder builds the partial merkle tree of a block.
+type merkleBuilder struct {
+	numTx   uint32
+	txShas  []*btcwire.ShaHash
+	matched []bool
+	hashes  []*btcwire.ShaHash
+	bits    []bool
+}
+
+// calcHash returns the hash of the node of the merkle tree at the passed height
+// and position.  Levels with an odd number of nodes pair the last node with
+// itself.
+func (b *merkleBuilder) calcHash(height, pos uint32) *btcwire.ShaHash {
+	if height == 0 {
+		return b.txShas[pos]
+	}
+	left := b.calcHash(height-1, pos*2)
+	right := left
+	if pos*2+1 < treeWidth(b.numTx, height-1) {
+		right = b.calcHash(height-1, pos*2+1)
+	}
+	return hashMerkleBranches(left, right)
+}
+
+// traverseAndBuild adds the node at the passed height and position to the
+// partial merkle tree.  Nodes above a matched transaction are descended into,
+// while the hashes of the others and of the matched transactions are added.
+func (b *merkleBuilder) traverseAndBuild(height, pos uint32) {
+	parentOfMatch := false
+	for i := pos << height; i < (pos+1)<<height && i < b.numTx; i++ {
+		if b.matched[i] {
+			parentOfMatch = true
+			break
+		}
+	}
+	b.bits = append(b.bits, parentOfMatch)
+
+	if height == 0 || !parentOfMatch {
+		b.hashes = append(b.hashes, b.calcHash(height, pos))
+		return
+	}
+	b.traverseAndBuild(height-1, pos*2)
+	if pos*2+1 < treeWidth(b.numTx, height-1) {
+		b.traverseAndBuild(height-1, pos*2+1)
+	}
+}
+
+// NewMerkleBlock returns the merkle block of the passed block proving which of
+// its transactions match the passed filter, along with those transactions in
+// the order of the block.  The filter is updated with the outputs of the
+// transactions matched according to its update type, so later transactions of
+// the block spending them are matched too.
+func NewMerkleBlock(block *btcutil.Block, filter *Filter) (*MerkleBlock, []*btcutil.Tx) {
+	txs := block.Transactions()
+	b := &merkleBuilder{
+		numTx:   uint32(len(txs)),
+		txShas:  make([]*btcwire.ShaHash, len(txs)),
+		matched: make([]bool, len(txs)),
+	}
+	var matches []*btcutil.Tx
+	for i, tx := range txs {
+		b.txShas[i] = tx.Sha()
+		if filter.MatchTxAndUpdate(tx.MsgTx(), tx.Sha()) {
+			b.matched[i] = true
+			matches = append(matches, tx)
+		}
+	}
+
+	mb := &MerkleBlock{
+		Header:       block.MsgBlock().Header,
+		Transactions: b.numTx,
+	}
+	if b.numTx != 0 {
+		b.traverseAndBuild(treeHeight(b.numTx), 0)
+	}
+	mb.Hashes = b.hashes
+	mb.Flags = make([]byte, (len(b.bits)+7)/8)
+	for i, bit := range b.bits {
+		if bit {
+			mb.Flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return mb, matches
+}
+
+// merkleParser walks the partial merkle tree of a merkle block.
+type merkleParser struct {
+	mb         *MerkleBlock
+	bitsUsed   int
+	hashesUsed int
+	matches    []*btcwire.ShaHash
+}
+
+// traverseAndExtract returns the hash of the node of the partial merkle tree at
+// the passed height and position, adding the matched transactions below it, or
+// nil when the tree ends early or holds the same subtree twice.
+func (p *merkleParser) traverseAndExtract(height, pos uint32) *btcwire.ShaHash {
+	if p.bitsUsed >= len(p.mb.Flags)*8 {
+		return nil
+	}
+	parentOfMatch := p.mb.Flags[p.bitsUsed/8]&(1<<uint(p.bitsUsed%8)) != 0
+	p.bitsUsed++
+
+	if height == 0 || !parentOfMatch {
+		if p.hashesUsed >= len(p.mb.Hashes) {
+			return nil
+		}
+		sha := p.mb.Hashes[p.hashesUsed]
+		p.hashesUsed++
+		if height == 0 && parentOfMatch {
+			p.matches = append(p.matches, sha)
+		}
+		return sha
+	}
+
+	left := p.traverseAndExtract(height-1, pos*2)
+	if left == nil {
+		return nil
+	}
+	right := left
+	if pos*2+1 < treeWidth(p.mb.Transactions, height-1) {
+		right = p.traverseAndExtract(height-1, pos*2+1)
+		// Identical siblings would let a tree with a duplicated
+		// transaction prove the same root.
+		if right == nil || right.IsEqual(left) {
+			return nil
+		}
+	}
+	return hashMerkleBranches(left, right)
+}
+
+// ExtractMatches returns the hashes of the transactions the merkle block proves
+// its block holds, after checking its partial merkle tree leads to the merkle
+// root of its header.  ErrMalformedMerkleBlock is returned when the tree is not
+// a tree of the transactions of the block.
+func (mb *MerkleBlock) ExtractMatches() ([]*btcwire.ShaHash, error) {
+	if mb.Transactions == 0 || uint32(len(mb.Hashes)) > mb.Transactions ||
+		len(mb.Flags)*8 < len(mb.Hashes) {
+		return nil, ErrMalformedMerkleBlock
+	}
+
+	p := &merkleParser{mb: mb}
+	root := p.traverseAndExtract(treeHeight(mb.Transactions), 0)
+	if root == nil || (p.bitsUsed+7)/8 != len(mb.Flags) ||
+		p.hashesUsed != len(mb.Hashes) {
+		return nil, ErrMalformedMerkleBlock
+	}
+	if !root.IsEqual(&mb.Header.MerkleRoot) {
+		return nil, fmt.Errorf("merkle block leads to merkle root %v "+
+			"instead of %v", root, &mb.Header.MerkleRoot)
+	}
+	return p.matches, nil
+}
+
+// Serialize writes the merkle block to the passed writer in the format of the
+// payload of a merkleblock message.
+func (mb *MerkleBlock) Serialize(w io.Writer) error {
+	if err := mb.Header.Serialize(w); err != nil {
+		return err
+	}
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], mb.Transactions)
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	err := btcwire.WriteVarInt(w, 0, uint64(len(mb.Hashes)))
+	if err != nil {
+		return err
+	}
+	for _, sha := range mb.Hashes {
+		if _, err := w.Write(sha.Bytes()); err != nil {
+			return err
+		}
+	}
+	err = btcwire.WriteVarInt(w, 0, uint64(len(mb.Flags)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(mb.Flags)
+	return err
+}
+
+// FetchMerkleBlock returns the merkle block of the block with the passed hash
+// stored in the passed database proving which of its transactions match the
+// passed filter, along with those transactions, as served to a light client
+// which loaded the filter.  The filter is updated as by NewMerkleBlock.  The
+// errors of FetchBlockBySha, such as btcdb.ErrPruned for blocks which are no
+// longer stored, are returned as is.
+func FetchMerkleBlock(db btcdb.Db, sha *btcwire.ShaHash, filter *Filter) (*MerkleBlock, []*btcutil.Tx, error) {
+	block, err := db.FetchBlockBySha(sha)
+	if err != nil {
+		return nil, nil, err
+	}
+	mb, matches := NewMerkleBlock(block, filter)
+	return mb, matches, nil
+}
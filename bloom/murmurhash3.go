@@ -0,0 +1,63 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"encoding/binary"
+)
+
+// Constants of the 32-bit x86 variant of MurmurHash3.
+const (
+	murmurC1 = 0xcc9e2d51
+	murmurC2 = 0x1b873593
+	murmurR1 = 15
+	murmurR2 = 13
+	murmurM  = 5
+	murmurN  = 0xe6546b64
+)
+
+// murmurHash3 returns the 32-bit x86 variant of MurmurHash3 of the passed data
+// with the given seed, which is the hash BIP0037 filters are built with.
+func murmurHash3(seed uint32, data []byte) uint32 {
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= murmurC1
+		k = (k << murmurR1) | (k >> (32 - murmurR1))
+		k *= murmurC2
+
+		h ^= k
+		h = (h << murmurR2) | (h >> (32 - murmurR2))
+		h = h*murmurM + murmurN
+	}
+
+	// Mix in the bytes left over.
+	tail := data[n*4:]
+	var k uint32
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= murmurC1
+		k = (k << murmurR1) | (k >> (32 - murmurR1))
+		k *= murmurC2
+		h ^= k
+	}
+
+	// Finalize.
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
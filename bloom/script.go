@@ -0,0 +1,64 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"encoding/binary"
+)
+
+// Opcodes which push data onto the stack.
+const (
+	opPushData1 = 0x4c
+	opPushData2 = 0x4d
+	opPushData4 = 0x4e
+)
+
+// forEachData calls fn with the data pushed by each push operation of the
+// passed script which is not empty until fn returns true, and returns whether
+// it did.  Other operations are skipped and the script is no longer read once
+// a push runs past its end.
+func forEachData(script []byte, fn func(data []byte) bool) bool {
+	for len(script) != 0 {
+		op := script[0]
+		script = script[1:]
+
+		var n int
+		switch {
+		case op < opPushData1:
+			n = int(op)
+		case op == opPushData1:
+			if len(script) < 1 {
+				return false
+			}
+			n, script = int(script[0]), script[1:]
+		case op == opPushData2:
+			if len(script) < 2 {
+				return false
+			}
+			n = int(binary.LittleEndian.Uint16(script))
+			script = script[2:]
+		case op == opPushData4:
+			if len(script) < 4 {
+				return false
+			}
+			n64 := uint64(binary.LittleEndian.Uint32(script))
+			if n64 > uint64(len(script)-4) {
+				return false
+			}
+			n = int(n64)
+			script = script[4:]
+		default:
+			continue
+		}
+		if n > len(script) {
+			return false
+		}
+		if n != 0 && fn(script[:n]) {
+			return true
+		}
+		script = script[n:]
+	}
+	return false
+}
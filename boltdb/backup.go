@@ -0,0 +1,61 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"io"
+	"os"
+)
+
+// progressWriter passes writes on to a writer while reporting the number of
+// bytes written so far to a progress function.
+type progressWriter struct {
+	w        io.Writer
+	copied   int64
+	progress func(copied int64)
+}
+
+// Write writes the passed data to the underlying writer and reports the
+// progress.
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.copied += int64(n)
+	if pw.progress != nil {
+		pw.progress(pw.copied)
+	}
+	return n, err
+}
+
+// Backup writes a copy of the database as of the time it is called to a new
+// database file at the passed path, which must not exist yet.  This is part of
+// the btcdb.Db interface implementation.
+//
+// The copy is written from a single read transaction, which sees the database
+// as of the time it was started while changes continue to be committed.
+func (db *BoltDb) Backup(destPath string, progress func(copied int64)) (rerr error) {
+	f, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+		if rerr != nil {
+			os.Remove(destPath)
+		}
+	}()
+
+	err = db.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&progressWriter{w: f, progress: progress})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/boltdb"
+	"github.com/conformal/btcdb/dbtest"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+)
+
+// TestReopen ensures a bolt database can only be created once and that its
+// contents are available after it is reopened.
+func TestReopen(t *testing.T) {
+	dbname := "tstdbreopen.db"
+	_ = os.Remove(dbname)
+	if _, err := btcdb.OpenDB("boltdb", dbname); err != btcdb.DbDoesNotExist {
+		t.Errorf("OpenDB: unexpected error for missing database %v", err)
+	}
+
+	db, err := btcdb.CreateDB("boltdb", dbname)
+	if err != nil {
+		t.Errorf("Failed to create test database %v", err)
+		return
+	}
+	defer os.Remove(dbname)
+
+	_, err = db.InsertBlock(btcutil.NewBlock(&btcwire.GenesisBlock))
+	if err != nil {
+		t.Errorf("InsertBlock: %v", err)
+	}
+	db.Close()
+
+	if _, err := btcdb.CreateDB("boltdb", dbname); err == nil {
+		t.Errorf("CreateDB: created database over an existing one")
+	}
+
+	db, err = btcdb.OpenDB("boltdb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		t.Errorf("NewestSha: %v", err)
+		return
+	}
+	if height != 0 || !sha.IsEqual(&btcwire.GenesisHash) {
+		t.Errorf("NewestSha: got %v at height %d, want %v at height 0",
+			sha, height, &btcwire.GenesisHash)
+	}
+
+	size, err := db.UtxoSetSize()
+	if err != nil || size != 1 {
+		t.Errorf("UtxoSetSize: got %d, want 1 (err %v)", size, err)
+	}
+}
+
+// TestRepeatedReorg ensures the newest block is still found after a
+// reorganization drops enough blocks to leave empty pages behind, which bolt
+// only removes once the change is committed.
+func TestRepeatedReorg(t *testing.T) {
+	dbname := "tstdbreorg.db"
+	_ = os.Remove(dbname)
+	db, err := btcdb.CreateDB("boltdb", dbname)
+	if err != nil {
+		t.Errorf("Failed to create test database %v", err)
+		return
+	}
+	defer os.Remove(dbname)
+	defer db.Close()
+
+	g := dbtest.NewChainGenerator(10)
+	g.OutputsPerTx = 2
+	if _, err := dbtest.InsertChain(db, g, 21); err != nil {
+		t.Errorf("InsertChain: %v", err)
+		return
+	}
+	forkSha, err := g.Tip().Sha()
+	if err != nil {
+		t.Errorf("Sha: %v", err)
+		return
+	}
+	side := g.Fork(1).NextBlocks(10)
+	main, err := dbtest.InsertChain(db, g, 10)
+	if err != nil {
+		t.Errorf("InsertChain: %v", err)
+		return
+	}
+
+	for i := 0; i < 4; i++ {
+		branch := side
+		if i%2 != 0 {
+			branch = main
+		}
+		heights, err := db.ReorganizeWithMeta(forkSha, branch, nil)
+		if err != nil {
+			t.Errorf("ReorganizeWithMeta %d: %v", i, err)
+			return
+		}
+		if heights[0] != 21 {
+			t.Errorf("ReorganizeWithMeta %d: first block at height "+
+				"%d, want 21", i, heights[0])
+		}
+
+		wantSha, _ := branch[len(branch)-1].Sha()
+		sha, height, err := db.NewestSha()
+		if err != nil {
+			t.Errorf("NewestSha: %v", err)
+			return
+		}
+		if height != 30 || !sha.IsEqual(wantSha) {
+			t.Errorf("NewestSha: got %v at height %d, want %v at "+
+				"height 30", sha, height, wantSha)
+		}
+	}
+}
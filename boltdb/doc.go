@@ -0,0 +1,21 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package boltdb implements an instance of btcdb backed by bolt.
+
+The entire database is kept in a single file and every operation that
+modifies it, such as InsertBlock and DropAfterBlockBySha, is performed in a
+single bolt transaction which is committed before the function returns.  As a
+result the database is always consistent on disk and no separate sync or
+rollback handling is required.  Opening the database with the btcdb.SyncNever
+policy skips syncing each transaction to disk, in which case Sync must be
+called to ensure the changes are durable.  The btcdb.SyncPeriodic policy skips
+it as well but calls Sync at the requested interval.
+
+The database is created and opened with the path of the database file:
+
+	db, err := btcdb.CreateDB("boltdb", "blocks.db")
+*/
+package boltdb
@@ -0,0 +1,232 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/gcs"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// fetchMsgTx returns the most recent instance of the transaction with the
+// given hash.
+func fetchMsgTx(tx *bolt.Tx, sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+	recs, err := fetchTxRecords(tx, sha)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, btcdb.TxShaMissing
+	}
+	msgTx, _, err := fetchTx(tx, recs[len(recs)-1])
+	return msgTx, err
+}
+
+// putFilter builds the basic filter of the passed block, which is at the given
+// height, and stores it along with its filter header in the filters bucket.
+// The filter of the previous block must already be stored.
+func putFilter(tx *bolt.Tx, filters *bolt.Bucket, height int64, block *btcutil.Block) error {
+	filter, err := gcs.BuildBasicFilter(block,
+		func(sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+			return fetchMsgTx(tx, sha)
+		})
+	if err != nil {
+		return err
+	}
+
+	var prevHeader btcwire.ShaHash
+	if height > 0 {
+		val := filters.Get(heightToKey(height - 1))
+		if len(val) < btcwire.HashSize {
+			return btcdb.ErrCorruption
+		}
+		prevHeader.SetBytes(val[0:btcwire.HashSize])
+	}
+	header := gcs.FilterHeader(filter, &prevHeader)
+
+	val := make([]byte, btcwire.HashSize+len(filter))
+	copy(val, header.Bytes())
+	copy(val[btcwire.HashSize:], filter)
+	return filters.Put(heightToKey(height), val)
+}
+
+// fetchFilterEntry returns the filters bucket value of the block with the
+// given hash.  The value is only valid for the life of the transaction.
+func fetchFilterEntry(tx *bolt.Tx, sha *btcwire.ShaHash) ([]byte, error) {
+	filters := tx.Bucket(filtersBucket)
+	if filters == nil {
+		return nil, btcdb.ErrNoFilterIndex
+	}
+	height, err := fetchHeight(tx, sha)
+	if err != nil {
+		return nil, err
+	}
+	val := filters.Get(heightToKey(height))
+	if len(val) < btcwire.HashSize {
+		return nil, btcdb.ErrCorruption
+	}
+	return val, nil
+}
+
+// FetchFilterBySha returns the basic filter of the block with the given hash.
+// This is part of the btcdb.Db interface implementation.
+//
+// Filters are optional for this backend and btcdb.ErrNoFilterIndex is returned
+// unless they have been enabled with EnableFilterIndex.
+func (db *BoltDb) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	var filter []byte
+	err := db.view(func(tx *bolt.Tx) error {
+		val, err := fetchFilterEntry(tx, sha)
+		if err != nil {
+			return err
+		}
+		filter = make([]byte, len(val)-btcwire.HashSize)
+		copy(filter, val[btcwire.HashSize:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// FetchFilterHeaderBySha returns the basic filter header of the block with the
+// given hash.  This is part of the btcdb.Db interface implementation.
+func (db *BoltDb) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	var header btcwire.ShaHash
+	err := db.view(func(tx *bolt.Tx) error {
+		val, err := fetchFilterEntry(tx, sha)
+		if err != nil {
+			return err
+		}
+		header.SetBytes(val[0:btcwire.HashSize])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// fetchFilterRange calls the passed function with the filters bucket value of
+// each block from the start height up to but not including the end height in
+// height order.  The values are only valid for the life of the transaction.
+func (db *BoltDb) fetchFilterRange(startHeight, endHeight int64, fn func([]byte)) error {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	return db.view(func(tx *bolt.Tx) error {
+		filters := tx.Bucket(filtersBucket)
+		if filters == nil {
+			return btcdb.ErrNoFilterIndex
+		}
+
+		c := filters.Cursor()
+		endKey := heightToKey(endHeight)
+		for k, v := c.Seek(heightToKey(startHeight)); k != nil &&
+			bytes.Compare(k, endKey) < 0; k, v = c.Next() {
+
+			if len(v) < btcwire.HashSize {
+				return btcdb.ErrCorruption
+			}
+			fn(v)
+		}
+		return nil
+	})
+}
+
+// FetchFilterRange returns the basic filters of the blocks from the start
+// height up to but not including the end height.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BoltDb) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	var filters [][]byte
+	err := db.fetchFilterRange(startHeight, endHeight, func(val []byte) {
+		filter := make([]byte, len(val)-btcwire.HashSize)
+		copy(filter, val[btcwire.HashSize:])
+		filters = append(filters, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// FetchFilterHeaderRange returns the basic filter headers of the blocks from
+// the start height up to but not including the end height.  This is part of
+// the btcdb.Db interface implementation.
+func (db *BoltDb) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	var headers []btcwire.ShaHash
+	err := db.fetchFilterRange(startHeight, endHeight, func(val []byte) {
+		var header btcwire.ShaHash
+		header.SetBytes(val[0:btcwire.HashSize])
+		headers = append(headers, header)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// FilterIndexEnabled returns whether or not basic filters are maintained for
+// the database.
+func (db *BoltDb) FilterIndexEnabled() bool {
+	var enabled bool
+	err := db.view(func(tx *bolt.Tx) error {
+		enabled = tx.Bucket(filtersBucket) != nil
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// EnableFilterIndex turns maintenance of basic filters on or off.  The filters
+// are kept in the filters bucket, so its presence is the persisted setting.
+// When filters are turned on for a database which already contains blocks,
+// they are built from the stored blocks within the same transaction.  When
+// they are turned off, the bucket is removed.
+func (db *BoltDb) EnableFilterIndex(enable bool) error {
+	return db.update(func(tx *bolt.Tx) error {
+		enabled := tx.Bucket(filtersBucket) != nil
+		if enable == enabled {
+			return nil
+		}
+		if !enable {
+			return tx.DeleteBucket(filtersBucket)
+		}
+
+		filters, err := tx.CreateBucket(filtersBucket)
+		if err != nil {
+			return err
+		}
+		for height := int64(0); height <= newestHeight(tx); height++ {
+			_, buf, err := fetchBlockByHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			blk, err := btcutil.NewBlockFromBytes(buf)
+			if err != nil {
+				return err
+			}
+			if err := putFilter(tx, filters, height, blk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (db *BoltDb) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	var locator btcdb.BlockLocator
+	err := db.view(func(tx *bolt.Tx) error {
+		height, err := fetchHeight(tx, sha)
+		if err != nil {
+			return err
+		}
+		locator, err = blockLocator(tx, height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (db *BoltDb) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	var locator btcdb.BlockLocator
+	err := db.view(func(tx *bolt.Tx) error {
+		var err error
+		locator, err = blockLocator(tx, newestHeight(tx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// blockLocator returns a block locator for the block at the given height.
+func blockLocator(tx *bolt.Tx, height int64) (btcdb.BlockLocator, error) {
+	heights := btcdb.LocatorHeights(height)
+	locator := make(btcdb.BlockLocator, 0, len(heights))
+	blocks := tx.Bucket(blocksBucket)
+	for _, h := range heights {
+		val := blocks.Get(heightToKey(h))
+		if val == nil {
+			return nil, btcdb.ErrBlockNotFound
+		}
+		if len(val) < btcwire.HashSize {
+			return nil, btcdb.ErrCorruption
+		}
+		var sha btcwire.ShaHash
+		sha.SetBytes(val[0:btcwire.HashSize])
+		locator = append(locator, &sha)
+	}
+	return locator, nil
+}
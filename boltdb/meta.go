@@ -0,0 +1,262 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// putMeta applies the passed changes to the metadata namespace.
+func putMeta(tx *bolt.Tx, meta *btcdb.MetaBatch) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	userMeta := tx.Bucket(userMetaBucket)
+	for _, op := range meta.Ops() {
+		var err error
+		if op.Delete {
+			err = userMeta.Delete(op.Key)
+		} else {
+			err = userMeta.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertBlocksWithMeta inserts a run of blocks in order along with the passed
+// changes to the metadata namespace within a single transaction.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BoltDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+
+	heights := make([]int64, 0, len(blocks))
+	err := db.updateOp(op, func(tx *bolt.Tx) error {
+		connected := make([]btcdb.ChainEvent, 0, len(blocks))
+		for _, block := range blocks {
+			height, err := insertBlock(tx, block, db.validation)
+			if err != nil {
+				return err
+			}
+			heights = append(heights, height)
+			sha, _ := block.Sha()
+			connected = append(connected,
+				btcdb.BlockConnected{Sha: *sha, Height: height})
+		}
+		spent, err := db.fetchSpentTxOuts(tx, blocks, heights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := db.indexers.ConnectBlocks(blocks, heights, spent,
+			metaView(tx))
+		if err != nil {
+			return err
+		}
+		if err := putMeta(tx, meta); err != nil {
+			return err
+		}
+		if err := putMeta(tx, idxMeta); err != nil {
+			return err
+		}
+		tx.OnCommit(func() {
+			db.blockCache.AddBlocks(blocks, heights)
+		})
+		db.notifyOnCommit(tx, connected)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// DropAfterBlockByShaWithMeta removes any blocks from the database after the
+// given block along with applying the passed changes to the metadata namespace
+// within a single transaction.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BoltDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
+
+	return db.updateOp(op, func(tx *bolt.Tx) error {
+		disconnected, err := db.dropAfterBlockBySha(tx, sha)
+		if err != nil {
+			return err
+		}
+		if err := putMeta(tx, meta); err != nil {
+			return err
+		}
+		db.notifyOnCommit(tx, disconnected)
+		return nil
+	})
+}
+
+// ReorganizeWithMeta removes any blocks from the database after the given
+// block, inserts the passed run of blocks after it and applies the passed
+// changes to the metadata namespace within a single transaction.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BoltDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricReorganize, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricReorganize, len(blocks))
+
+	heights := make([]int64, 0, len(blocks))
+	err := db.updateOp(op, func(tx *bolt.Tx) error {
+		events, err := db.dropAfterBlockBySha(tx, sha)
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			height, err := insertBlock(tx, block, db.validation)
+			if err != nil {
+				return err
+			}
+			heights = append(heights, height)
+			blkSha, _ := block.Sha()
+			events = append(events,
+				btcdb.BlockConnected{Sha: *blkSha, Height: height})
+		}
+		spent, err := db.fetchSpentTxOuts(tx, blocks, heights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := db.indexers.ConnectBlocks(blocks, heights, spent,
+			metaView(tx))
+		if err != nil {
+			return err
+		}
+		if err := putMeta(tx, meta); err != nil {
+			return err
+		}
+		if err := putMeta(tx, idxMeta); err != nil {
+			return err
+		}
+		tx.OnCommit(func() {
+			db.blockCache.AddBlocks(blocks, heights)
+		})
+		db.notifyOnCommit(tx, events)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// GetMeta returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BoltDb) GetMeta(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.view(func(tx *bolt.Tx) error {
+		var err error
+		value, err = getMeta(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// getMeta returns the value stored under the given key in the metadata
+// namespace using the passed bolt transaction, or nil when the key does not
+// exist.
+func getMeta(tx *bolt.Tx, key []byte) ([]byte, error) {
+	// Databases created before the metadata namespace existed which are
+	// opened read-only do not have the bucket.
+	userMeta := tx.Bucket(userMetaBucket)
+	if userMeta == nil || len(key) == 0 {
+		return nil, nil
+	}
+	if v := userMeta.Get(key); v != nil {
+		return append([]byte{}, v...), nil
+	}
+	return nil, nil
+}
+
+// metaView returns a view of the metadata namespace as of the changes made by
+// the passed bolt transaction.
+func metaView(tx *bolt.Tx) btcdb.MetaView {
+	return func(key []byte) ([]byte, error) {
+		return getMeta(tx, key)
+	}
+}
+
+// PutMeta stores the value under the given key in the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *BoltDb) PutMeta(key, value []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Put(key, value)
+	return db.WriteMeta(&meta)
+}
+
+// DeleteMeta removes the given key from the metadata namespace.  This is part
+// of the btcdb.Db interface implementation.
+func (db *BoltDb) DeleteMeta(key []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Delete(key)
+	return db.WriteMeta(&meta)
+}
+
+// WriteMeta applies the passed changes to the metadata namespace within a
+// single transaction.  This is part of the btcdb.Db interface implementation.
+func (db *BoltDb) WriteMeta(meta *btcdb.MetaBatch) error {
+	return db.update(func(tx *bolt.Tx) error {
+		return putMeta(tx, meta)
+	})
+}
+
+// MetaIterator returns an iterator over the keys of the metadata namespace
+// which begin with the given prefix.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BoltDb) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewMetaIterator(keys, values), nil
+}
+
+// ReverseMetaIterator returns an iterator over the keys of the metadata
+// namespace which begin with the given prefix in descending order.  This is
+// part of the btcdb.Db interface implementation.
+func (db *BoltDb) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewReverseMetaIterator(keys, values), nil
+}
+
+// metaEntries returns copies of the keys of the metadata namespace which begin
+// with the given prefix and their values, read in a single transaction.
+func (db *BoltDb) metaEntries(prefix []byte) ([][]byte, [][]byte, error) {
+	var keys, values [][]byte
+	err := db.view(func(tx *bolt.Tx) error {
+		userMeta := tx.Bucket(userMetaBucket)
+		if userMeta == nil {
+			return nil
+		}
+		c := userMeta.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte{}, v...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+)
+
+// updateOp behaves the same as update while recording the time the passed
+// operation waited for the writer lock of bolt, which is held from the start of
+// the transaction.  The statistics of bolt are reported once it is committed.
+func (db *BoltDb) updateOp(op *btcdb.OpTimer, fn func(tx *bolt.Tx) error) error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.snap != nil || db.db.IsReadOnly() {
+		return btcdb.ErrReadOnly
+	}
+	tx, err := db.db.Begin(true)
+	if err == bolt.ErrDatabaseNotOpen {
+		return btcdb.ErrDbClosed
+	}
+	if err != nil {
+		return err
+	}
+	op.Locked()
+
+	// The transaction is rolled back should the function panic.
+	defer func() {
+		if tx.DB() != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.reportStats()
+	return nil
+}
+
+// reportStats passes the statistics bolt keeps about its pages and
+// transactions to the metrics of the database as gauges.
+func (db *BoltDb) reportStats() {
+	if db.metrics == btcdb.DiscardMetrics {
+		return
+	}
+
+	stats := db.db.Stats()
+	m := db.metrics
+	m.SetGauge("bolt.freepages", int64(stats.FreePageN))
+	m.SetGauge("bolt.pendingpages", int64(stats.PendingPageN))
+	m.SetGauge("bolt.freelist_bytes", int64(stats.FreelistInuse))
+	m.SetGauge("bolt.readtx.count", int64(stats.TxN))
+	m.SetGauge("bolt.readtx.open", int64(stats.OpenTxN))
+	m.SetGauge("bolt.write.count", int64(stats.TxStats.Write))
+	m.SetGauge("bolt.write.time_ns", int64(stats.TxStats.WriteTime))
+}
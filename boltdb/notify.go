@@ -0,0 +1,35 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+)
+
+// notifyOnCommit delivers the passed events to subscribers once the passed
+// transaction commits.  Bolt runs commit handlers while it still holds the
+// writer lock, so the events of consecutive transactions stay in order.
+func (db *BoltDb) notifyOnCommit(tx *bolt.Tx, events []btcdb.ChainEvent) {
+	tx.OnCommit(func() {
+		db.notifier.Notify(events...)
+	})
+}
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain.  This is part of the btcdb.Db interface implementation.
+func (db *BoltDb) Subscribe() (*btcdb.Subscription, error) {
+	return db.notifier.Subscribe()
+}
+
+// AddIndexer initializes the passed indexer, catches it up with the chain and
+// from then on updates it within the transactions which change the blocks.
+// This is part of the btcdb.Db interface implementation.
+func (db *BoltDb) AddIndexer(idx btcdb.Indexer) error {
+	if db.snap != nil || db.db.IsReadOnly() {
+		return btcdb.ErrReadOnly
+	}
+	return db.indexers.Add(db, idx)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+	"io"
+	"sync"
+)
+
+// snapshotTx is a read transaction held open for the lifetime of a snapshot.
+// Bolt transactions are not safe for concurrent use, so the mutex serializes
+// access to it.
+type snapshotTx struct {
+	sync.Mutex
+	tx *bolt.Tx
+}
+
+// view runs the passed function in the held read transaction.
+func (s *snapshotTx) view(fn func(tx *bolt.Tx) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx == nil {
+		return btcdb.ErrDbClosed
+	}
+	return fn(s.tx)
+}
+
+// release closes the held read transaction.
+func (s *snapshotTx) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+}
+
+// snapshot is a read-only view of a bolt database pinned to a read
+// transaction.
+type snapshot struct {
+	*BoltDb
+}
+
+// Release closes the read transaction of the snapshot.  This is part of the
+// btcdb.Snapshot interface implementation.
+func (s *snapshot) Release() {
+	s.Close()
+}
+
+// Snapshot returns a read-only view of the database pinned to the current
+// point in time.  Bolt must wait for all read transactions to finish before
+// it can grow its memory map, so the snapshot must not be held by a goroutine
+// which also inserts blocks.  This is part of the btcdb.Db interface
+// implementation.
+func (db *BoltDb) Snapshot() (btcdb.Snapshot, error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	tx, err := db.db.Begin(false)
+	if err == bolt.ErrDatabaseNotOpen {
+		return nil, btcdb.ErrDbClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{&BoltDb{db: db.db, metrics: db.metrics,
+		snap: &snapshotTx{tx: tx}}}, nil
+}
+
+// VerifyIntegrity performs the integrity checks of the given level on every
+// block of the chain using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BoltDb) VerifyIntegrity(level int, progress func(height int64)) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.VerifyChain(snap, level, progress)
+}
+
+// ExportBootstrap writes the blocks of a range of heights in the format of
+// bootstrap.dat using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *BoltDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.WriteBootstrap(snap, w, startHeight, endHeight)
+}
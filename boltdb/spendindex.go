@@ -0,0 +1,153 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// spendEntryLen is the length of a spend index entry:
+//
+//	spending tx hash (32) | block height (8) | input index (4)
+const spendEntryLen = btcwire.HashSize + 8 + 4
+
+// outPointKey returns the key for the spend index entry of the given
+// outpoint.
+func outPointKey(op *btcwire.OutPoint) []byte {
+	key := make([]byte, btcwire.HashSize+4)
+	copy(key, op.Hash.Bytes())
+	binary.BigEndian.PutUint32(key[btcwire.HashSize:], op.Index)
+	return key
+}
+
+// indexBlockSpends adds spend index entries for every output spent by the
+// passed block, which is at the given height, to the spends bucket.
+func indexBlockSpends(spends *bolt.Bucket, height int64, block *btcutil.Block) error {
+	for _, t := range block.Transactions() {
+		for inIdx, txIn := range t.MsgTx().TxIn {
+			if isCoinbaseInput(txIn) {
+				continue
+			}
+			val := make([]byte, spendEntryLen)
+			copy(val, t.Sha().Bytes())
+			binary.LittleEndian.PutUint64(val[btcwire.HashSize:],
+				uint64(height))
+			binary.LittleEndian.PutUint32(val[btcwire.HashSize+8:],
+				uint32(inIdx))
+			err := spends.Put(outPointKey(&txIn.PreviousOutpoint), val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexBlockSpends removes the spend index entries for every output spent by
+// the passed block from the spends bucket.
+func unindexBlockSpends(spends *bolt.Bucket, block *btcutil.Block) error {
+	for _, t := range block.Transactions() {
+		for _, txIn := range t.MsgTx().TxIn {
+			if isCoinbaseInput(txIn) {
+				continue
+			}
+			err := spends.Delete(outPointKey(&txIn.PreviousOutpoint))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FetchSpendingTx returns the transaction which spent the output referenced by
+// the given outpoint.  This is part of the btcdb.Db interface implementation.
+//
+// The spend index is optional for this backend and btcdb.ErrNoSpendIndex is
+// returned unless it has been enabled with EnableSpendIndex.
+func (db *BoltDb) FetchSpendingTx(op *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	var spender *btcdb.SpendingTx
+	err := db.view(func(tx *bolt.Tx) error {
+		spends := tx.Bucket(spendsBucket)
+		if spends == nil {
+			return btcdb.ErrNoSpendIndex
+		}
+		val := spends.Get(outPointKey(op))
+		if val == nil {
+			return nil
+		}
+		if len(val) != spendEntryLen {
+			return btcdb.ErrCorruption
+		}
+
+		var sha btcwire.ShaHash
+		sha.SetBytes(val[0:btcwire.HashSize])
+		spender = &btcdb.SpendingTx{
+			Sha:        &sha,
+			Height:     int64(binary.LittleEndian.Uint64(val[btcwire.HashSize:])),
+			InputIndex: binary.LittleEndian.Uint32(val[btcwire.HashSize+8:]),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spender, nil
+}
+
+// SpendIndexEnabled returns whether or not the spend index is maintained for
+// the database.
+func (db *BoltDb) SpendIndexEnabled() bool {
+	var enabled bool
+	err := db.view(func(tx *bolt.Tx) error {
+		enabled = tx.Bucket(spendsBucket) != nil
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// EnableSpendIndex turns maintenance of the spend index on or off.  The index
+// is kept in the spends bucket, so its presence is the persisted setting.
+// When the index is turned on for a database which already contains blocks, it
+// is built from the stored blocks within the same transaction.  When it is
+// turned off, the bucket is removed.
+func (db *BoltDb) EnableSpendIndex(enable bool) error {
+	return db.update(func(tx *bolt.Tx) error {
+		enabled := tx.Bucket(spendsBucket) != nil
+		if enable == enabled {
+			return nil
+		}
+		if !enable {
+			return tx.DeleteBucket(spendsBucket)
+		}
+
+		spends, err := tx.CreateBucket(spendsBucket)
+		if err != nil {
+			return err
+		}
+		c := tx.Bucket(blocksBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) < btcwire.HashSize {
+				return btcdb.ErrCorruption
+			}
+			blk, err := btcutil.NewBlockFromBytes(v[btcwire.HashSize:])
+			if err != nil {
+				return err
+			}
+			height := int64(binary.BigEndian.Uint64(k))
+			if err := indexBlockSpends(spends, height, blk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
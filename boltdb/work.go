@@ -0,0 +1,105 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// putChainWork stores the cumulative chain work through the block at the given
+// height, which has the passed compact target difficulty, in the chain work
+// bucket.  The work through the block before it must already be stored.
+func putChainWork(work *bolt.Bucket, height int64, bits uint32) error {
+	blkWork := btcdb.CalcWork(bits)
+	if height > 0 {
+		prev := work.Get(heightToKey(height - 1))
+		if prev == nil {
+			return btcdb.ErrCorruption
+		}
+		blkWork.Add(blkWork, new(big.Int).SetBytes(prev))
+	}
+	return work.Put(heightToKey(height), blkWork.Bytes())
+}
+
+// sumChainWork computes the cumulative chain work through the block at the
+// given height from the headers of it and every block before it.
+func sumChainWork(tx *bolt.Tx, height int64) (*big.Int, error) {
+	work := new(big.Int)
+	c := tx.Bucket(blocksBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if int64(binary.BigEndian.Uint64(k)) > height {
+			break
+		}
+		var bh btcwire.BlockHeader
+		if err := deserializeHeader(&bh, v); err != nil {
+			return nil, err
+		}
+		work.Add(work, btcdb.CalcWork(bh.Bits))
+	}
+	return work, nil
+}
+
+// buildChainWork creates the chain work bucket for a database created before
+// the cumulative work was stored and fills it from the stored blocks.
+func buildChainWork(tx *bolt.Tx) error {
+	if tx.Bucket(chainWorkBucket) != nil {
+		return nil
+	}
+	work, err := tx.CreateBucket(chainWorkBucket)
+	if err != nil {
+		return err
+	}
+
+	c := tx.Bucket(blocksBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var bh btcwire.BlockHeader
+		if err := deserializeHeader(&bh, v); err != nil {
+			return err
+		}
+		height := int64(binary.BigEndian.Uint64(k))
+		err := putChainWork(work, height, bh.Bits)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchChainWorkBySha returns the cumulative work of the main chain through the
+// block with the given hash.  This is part of the btcdb.Db interface
+// implementation.
+//
+// Databases created before the work was stored get it added the first time
+// they are opened for writing, while read-only opens compute it from the
+// headers of every block up to the requested one.
+func (db *BoltDb) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	var work *big.Int
+	err := db.view(func(tx *bolt.Tx) error {
+		height, err := fetchHeight(tx, sha)
+		if err != nil {
+			return err
+		}
+
+		bucket := tx.Bucket(chainWorkBucket)
+		if bucket == nil {
+			work, err = sumChainWork(tx, height)
+			return err
+		}
+		buf := bucket.Get(heightToKey(height))
+		if buf == nil {
+			return btcdb.ErrCorruption
+		}
+		work = new(big.Int).SetBytes(buf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return work, nil
+}
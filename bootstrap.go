@@ -0,0 +1,325 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// MaxBootstrapOrphans is the maximum number of blocks ImportBootstrap holds
+// while waiting for their parents to arrive.
+const MaxBootstrapOrphans = 10000
+
+// ImportBootstrap reads blocks in the format of bootstrap.dat and the blk*.dat
+// files of the reference client, where each block is preceded by the magic of
+// the passed network and its length, and inserts them into the passed database.
+// It returns the number of blocks inserted.
+//
+// Blocks may appear in any order.  Those whose parent has not been inserted yet
+// are held until it is, up to MaxBootstrapOrphans of them, and blocks which are
+// already part of the chain are skipped, so a stream may be imported on top of
+// a database which has some of its blocks.  Blocks which extend any block but
+// the tip of the chain are ignored along with blocks which are still waiting
+// for their parent when the stream ends.  Data between blocks which does not
+// start with the network magic, such as the zero padding at the end of the
+// blk*.dat files, is skipped.
+func ImportBootstrap(db Db, r io.Reader, net btcwire.BitcoinNet) (int64, error) {
+	imp, err := newBootstrapImporter(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := imp.importStream(r, net, 0); err != nil {
+		return imp.inserted, err
+	}
+	if err := imp.flush(nil); err != nil {
+		return imp.inserted, err
+	}
+	if imp.numOrphans != 0 {
+		log.Warnf("%d blocks of the bootstrap data were not connected "+
+			"to the chain", imp.numOrphans)
+	}
+	return imp.inserted, nil
+}
+
+// bootstrapImporter inserts blocks read in any order into a database in chain
+// order, holding the blocks whose parent has not been inserted yet.
+type bootstrapImporter struct {
+	db         Db
+	tip        *btcwire.ShaHash
+	batch      []*btcutil.Block
+	inserted   int64
+	orphans    map[btcwire.ShaHash][]bootstrapOrphan
+	numOrphans int
+}
+
+// bootstrapOrphan is a block held by a bootstrapImporter until its parent is
+// added along with the number of the source it was read from.
+type bootstrapOrphan struct {
+	blk    *btcutil.Block
+	source int
+}
+
+// newBootstrapImporter returns an importer of blocks into the passed database.
+func newBootstrapImporter(db Db) (*bootstrapImporter, error) {
+	tip, _, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	return &bootstrapImporter{
+		db:      db,
+		tip:     tip,
+		orphans: make(map[btcwire.ShaHash][]bootstrapOrphan),
+	}, nil
+}
+
+// importStream adds every block of the passed stream framed by the magic of
+// the passed network with the given source number.
+func (imp *bootstrapImporter) importStream(r io.Reader, net btcwire.BitcoinNet, source int) error {
+	br := bufio.NewReader(r)
+	for {
+		blk, err := readBootstrapBlock(br, net)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := imp.add(blk, source); err != nil {
+			return err
+		}
+	}
+}
+
+// add queues the passed block for insertion when it extends the tip, skips it
+// when it is already part of the chain or extends any other block of it and
+// holds it until its parent is added otherwise.
+func (imp *bootstrapImporter) add(blk *btcutil.Block, source int) error {
+	sha, err := blk.Sha()
+	if err != nil {
+		return err
+	}
+
+	prev := &blk.MsgBlock().Header.PrevBlock
+	switch {
+	case prev.IsEqual(imp.tip):
+		return imp.connect(blk, sha)
+
+	case imp.contains(sha):
+		// The block is already part of the chain.
+
+	case imp.contains(prev):
+		// The block extends a block which is no longer the tip.
+
+	default:
+		if imp.numOrphans >= MaxBootstrapOrphans {
+			return fmt.Errorf("more than %d blocks are waiting "+
+				"for their parents", MaxBootstrapOrphans)
+		}
+		imp.orphans[*prev] = append(imp.orphans[*prev],
+			bootstrapOrphan{blk: blk, source: source})
+		imp.numOrphans++
+	}
+	return nil
+}
+
+// connect queues the passed block, which extends the tip, for insertion
+// followed by every held block which then extends the tip in turn.
+func (imp *bootstrapImporter) connect(blk *btcutil.Block, sha *btcwire.ShaHash) error {
+	for {
+		imp.batch = append(imp.batch, blk)
+		imp.tip = sha
+		if len(imp.batch) >= importBatchSize {
+			if err := imp.flush(nil); err != nil {
+				return err
+			}
+		}
+
+		children := imp.orphans[*sha]
+		if len(children) == 0 {
+			return nil
+		}
+		delete(imp.orphans, *sha)
+		imp.numOrphans -= len(children)
+
+		// Only a single child can extend the chain, the others are
+		// left out like any other stale block.
+		blk = children[0].blk
+		var err error
+		sha, err = blk.Sha()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flush inserts the queued blocks along with the passed metadata changes, which
+// may be nil.
+func (imp *bootstrapImporter) flush(meta *MetaBatch) error {
+	if len(imp.batch) == 0 {
+		if meta.Len() == 0 {
+			return nil
+		}
+		return imp.db.WriteMeta(meta)
+	}
+	if _, err := imp.db.InsertBlocksWithMeta(imp.batch, meta); err != nil {
+		return err
+	}
+	imp.inserted += int64(len(imp.batch))
+	imp.batch = imp.batch[:0]
+	return nil
+}
+
+// firstOrphanSource returns the lowest source number of the held blocks, or the
+// passed number when no blocks are held.
+func (imp *bootstrapImporter) firstOrphanSource(next int) int {
+	for _, children := range imp.orphans {
+		for _, orphan := range children {
+			if orphan.source < next {
+				next = orphan.source
+			}
+		}
+	}
+	return next
+}
+
+// contains returns whether the block with the given hash is in the database or
+// queued for insertion into it.
+func (imp *bootstrapImporter) contains(sha *btcwire.ShaHash) bool {
+	for _, blk := range imp.batch {
+		if blkSha, err := blk.Sha(); err == nil && blkSha.IsEqual(sha) {
+			return true
+		}
+	}
+	return imp.db.ExistsSha(sha)
+}
+
+// readBootstrapBlock reads the next block framed by the passed network magic
+// and its length from the passed reader.  Data which does not start with the
+// magic is skipped a byte at a time.  It returns io.EOF when the reader ends
+// before another block starts.
+func readBootstrapBlock(r *bufio.Reader, net btcwire.BitcoinNet) (*btcutil.Block, error) {
+	var magic [4]byte
+	binary.LittleEndian.PutUint32(magic[:], uint32(net))
+	for {
+		buf, err := r.Peek(len(magic))
+		if err != nil {
+			// Fewer bytes than a magic are left, which only
+			// happens for padding at the end of the stream.
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if string(buf) == string(magic[:]) {
+			break
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := binary.LittleEndian.Uint32(hdr[4:])
+	if size > btcwire.MaxBlockPayload {
+		return nil, fmt.Errorf("bootstrap block of %d bytes is too "+
+			"large", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return btcutil.NewBlockFromBytes(buf)
+}
+
+// GenesisNetwork returns the network whose genesis block has the passed hash
+// and whether it is one of the known networks.
+func GenesisNetwork(sha *btcwire.ShaHash) (btcwire.BitcoinNet, bool) {
+	switch {
+	case sha.IsEqual(&btcwire.GenesisHash):
+		return btcwire.MainNet, true
+	case sha.IsEqual(&btcwire.TestNet3GenesisHash):
+		return btcwire.TestNet3, true
+	case sha.IsEqual(&btcwire.TestNetGenesisHash):
+		return btcwire.TestNet, true
+	}
+	return 0, false
+}
+
+// bootstrapNetwork returns the network whose genesis block is the first block
+// of the chain seen by the passed snapshot.
+func bootstrapNetwork(snap Snapshot) (btcwire.BitcoinNet, error) {
+	sha, err := snap.FetchBlockShaByHeight(0)
+	if err != nil {
+		return 0, err
+	}
+	net, ok := GenesisNetwork(sha)
+	if !ok {
+		return 0, fmt.Errorf("genesis block %v belongs to an unknown "+
+			"network", sha)
+	}
+	return net, nil
+}
+
+// WriteBootstrap writes the blocks of the chain seen by the passed snapshot
+// from the start height up to but not including the ending height, or through
+// the end of the chain for AllShas, to the passed writer in the format read by
+// ImportBootstrap.  The network magic is chosen by the genesis block of the
+// chain.  It is intended for drivers, which implement ExportBootstrap by
+// running it on a snapshot of the database.
+func WriteBootstrap(snap Snapshot, w io.Writer, startHeight, endHeight int64) error {
+	_, newest, err := snap.NewestSha()
+	if err != nil {
+		return err
+	}
+	if endHeight == AllShas || endHeight > newest+1 {
+		endHeight = newest + 1
+	}
+	if startHeight < 0 || startHeight > endHeight {
+		return fmt.Errorf("invalid bootstrap range %d to %d of chain "+
+			"ending at height %d", startHeight, endHeight, newest)
+	}
+	if startHeight == endHeight {
+		return nil
+	}
+	net, err := bootstrapNetwork(snap)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for height := startHeight; height < endHeight; height++ {
+		sha, err := snap.FetchBlockShaByHeight(height)
+		if err != nil {
+			return err
+		}
+		blk, err := snap.FetchBlockBySha(sha)
+		if err != nil {
+			return err
+		}
+		raw, err := blk.Bytes()
+		if err != nil {
+			return err
+		}
+
+		var hdr [8]byte
+		binary.LittleEndian.PutUint32(hdr[:], uint32(net))
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(raw)))
+		if _, err := bw.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(raw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"testing"
+)
+
+// TestImportBootstrap ensures blocks framed as in bootstrap.dat are inserted
+// into every supported database type in chain order when some of them are out
+// of order, already in the database, stale or separated by padding.
+func TestImportBootstrap(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The stream moves a run of blocks behind later ones and holds a
+	// stale block which extends a block deep in the chain.
+	stream := append([]*btcutil.Block{}, blocks[1:20]...)
+	stream = append(stream, blocks[30:60]...)
+	stream = append(stream, blocks[20:30]...)
+	stale := *blocks[50].MsgBlock()
+	stale.Header.Nonce++
+	stream = append(stream, btcutil.NewBlock(&stale))
+	stream = append(stream, blocks[60:]...)
+
+	var buf bytes.Buffer
+	for i, block := range stream {
+		raw, err := block.Bytes()
+		if err != nil {
+			t.Errorf("Bytes: %v", err)
+			return
+		}
+		binary.Write(&buf, binary.LittleEndian, uint32(network))
+		binary.Write(&buf, binary.LittleEndian, uint32(len(raw)))
+		buf.Write(raw)
+		if i%50 == 0 {
+			buf.Write(make([]byte, 7))
+		}
+	}
+	buf.Write(make([]byte, 3))
+
+	const have = 10
+	wantSha, _ := blocks[len(blocks)-1].Sha()
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "bootstrap", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:have]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		r := bytes.NewReader(buf.Bytes())
+		n, err := btcdb.ImportBootstrap(db, r, network)
+		if err != nil || n != int64(len(blocks)-have) {
+			t.Errorf("ImportBootstrap (%s): inserted %d blocks (err "+
+				"%v), want %d", dbType, n, err, len(blocks)-have)
+		}
+		sha, height, err := db.NewestSha()
+		if err != nil || height != int64(len(blocks)-1) ||
+			!sha.IsEqual(wantSha) {
+
+			t.Errorf("NewestSha (%s): got %v at height %d (err %v), "+
+				"want %v at height %d", dbType, sha, height, err,
+				wantSha, len(blocks)-1)
+		}
+
+		// A block cut short by the end of the stream is an error.
+		truncated := bytes.NewReader(buf.Bytes()[:100])
+		if _, err := btcdb.ImportBootstrap(db, truncated, network); err == nil {
+			t.Errorf("ImportBootstrap (%s): unexpected success for "+
+				"truncated block", dbType)
+		}
+		teardown()
+	}
+}
+
+// TestExportBootstrap ensures every supported database type writes ranges of
+// its blocks framed as in bootstrap.dat which load into another database.
+func TestExportBootstrap(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "exportbootstrap", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		// A range in the middle of the chain holds exactly its blocks.
+		var buf bytes.Buffer
+		if err := db.ExportBootstrap(&buf, 5, 10); err != nil {
+			t.Errorf("ExportBootstrap (%s): %v", dbType, err)
+		}
+		r := bytes.NewReader(buf.Bytes())
+		for height := 5; height < 10; height++ {
+			var hdr [2]uint32
+			binary.Read(r, binary.LittleEndian, &hdr)
+			raw, _ := blocks[height].Bytes()
+			got := make([]byte, hdr[1])
+			r.Read(got)
+			if hdr[0] != uint32(network) || !bytes.Equal(got, raw) {
+				t.Errorf("ExportBootstrap (%s): wrong block at "+
+					"height %d", dbType, height)
+				break
+			}
+		}
+		if r.Len() != 0 {
+			t.Errorf("ExportBootstrap (%s): %d bytes after the last "+
+				"block", dbType, r.Len())
+		}
+
+		err = db.ExportBootstrap(&buf, 10, 5)
+		if err == nil {
+			t.Errorf("ExportBootstrap (%s): unexpected success for "+
+				"invalid range", dbType)
+		}
+
+		// The whole chain loads into a new database.
+		buf.Reset()
+		if err := db.ExportBootstrap(&buf, 0, btcdb.AllShas); err != nil {
+			t.Errorf("ExportBootstrap (%s): %v", dbType, err)
+		}
+		teardown()
+
+		dest, err := btcdb.CreateDB("memory")
+		if err != nil {
+			t.Errorf("Failed to create memory database: %v", err)
+			continue
+		}
+		n, err := btcdb.ImportBootstrap(dest, &buf, network)
+		if err != nil || n != int64(len(blocks)) {
+			t.Errorf("ImportBootstrap (%s): inserted %d blocks (err "+
+				"%v), want %d", dbType, n, err, len(blocks))
+		}
+		dest.Close()
+	}
+}
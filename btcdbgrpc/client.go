@@ -0,0 +1,833 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbgrpc
+
+import (
+	"bytes"
+	"context"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"google.golang.org/grpc"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// Client is a read-only btcdb.Db whose blocks and transactions are read from a
+// server of the service.  Functions which modify the database return
+// btcdb.ErrReadOnly, and those reading data the service does not offer, such
+// as the spend and filter indexes, return ErrUnsupported.
+type Client struct {
+	cc   grpc.ClientConnInterface
+	conn *grpc.ClientConn
+
+	// ctx is cancelled once the client is closed, which ends the calls
+	// and streams in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mtx protects closed and notifier.  The notifier is set while a
+	// SubscribeBlocks stream feeds it.
+	mtx      sync.Mutex
+	closed   bool
+	notifier *btcdb.Notifier
+}
+
+// Ensure Client implements the btcdb.Db interface.
+var _ btcdb.Db = (*Client)(nil)
+
+// NewClient returns a client making its calls on the passed connection, which
+// remains owned by the caller.
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{cc: cc, ctx: ctx, cancel: cancel}
+}
+
+// Dial returns a client connected to the server at the passed target, which
+// is closed along with the client.
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(conn)
+	c.conn = conn
+	return c, nil
+}
+
+// invoke calls the passed method of the service.
+func (c *Client) invoke(ctx context.Context, method string, req, reply interface{}) error {
+	if c.ctx.Err() != nil {
+		return btcdb.ErrDbClosed
+	}
+	err := c.cc.Invoke(ctx, "/"+serviceName+"/"+method, req, reply,
+		grpc.CallContentSubtype(codecName))
+	if err != nil && c.ctx.Err() != nil {
+		return btcdb.ErrDbClosed
+	}
+	return fromStatus(err)
+}
+
+// stream starts a call of the passed streaming method of the service.
+func (c *Client) stream(ctx context.Context, method string, req interface{}) (grpc.ClientStream, error) {
+	if c.ctx.Err() != nil {
+		return nil, btcdb.ErrDbClosed
+	}
+	desc := &grpc.StreamDesc{StreamName: method, ServerStreams: true}
+	stream, err := c.cc.NewStream(ctx, desc, "/"+serviceName+"/"+method,
+		grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, fromStatus(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, fromStatus(err)
+	}
+	return stream, nil
+}
+
+// Close ends the calls in progress and the subscriptions, and closes the
+// connection when the client was made by Dial.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) Close() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.cancel()
+	if c.notifier != nil {
+		c.notifier.Close()
+		c.notifier = nil
+	}
+	if c.conn != nil {
+		if err := c.conn.Close(); err != nil {
+			log.Warnf("Close: %v", err)
+		}
+	}
+}
+
+// Closed returns whether the client has been closed.  This is part of the
+// btcdb.Db interface implementation.
+func (c *Client) Closed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.closed
+}
+
+// RollbackClose is the same as Close, since the client does not make changes.
+// This is part of the btcdb.Db interface implementation.
+func (c *Client) RollbackClose() {
+	c.Close()
+}
+
+// Sync does nothing, since the client does not make changes.  This is part of
+// the btcdb.Db interface implementation.
+func (c *Client) Sync() {
+}
+
+// BlockCacheStats returns zero stats, since the client does not cache blocks.
+// This is part of the btcdb.Db interface implementation.
+func (c *Client) BlockCacheStats() btcdb.BlockCacheStats {
+	return btcdb.BlockCacheStats{}
+}
+
+// fetchBlock returns the serialized block a request selects.
+func (c *Client) fetchBlock(ctx context.Context, req *blockRequest) (*blockReply, error) {
+	var reply blockReply
+	if err := c.invoke(ctx, "GetBlock", req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// fetchHeader returns the serialized header of the block a request selects.
+func (c *Client) fetchHeader(req *blockRequest) (*blockReply, error) {
+	var reply blockReply
+	if err := c.invoke(c.ctx, "GetBlockHeader", req, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// ExistsSha returns whether or not the given block hash is present in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (c *Client) ExistsSha(sha *btcwire.ShaHash) bool {
+	_, err := c.fetchHeader(&blockRequest{Sha: sha.Bytes()})
+	if err != nil && err != btcdb.ErrBlockNotFound {
+		log.Warnf("ExistsSha: %v", err)
+	}
+	return err == nil
+}
+
+// ExistsShas returns whether or not each of the given block hashes is present
+// in the database.  This is part of the btcdb.Db interface implementation.
+func (c *Client) ExistsShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	for i := range shas {
+		exists[i] = c.ExistsSha(&shas[i])
+	}
+	return exists
+}
+
+// FetchBlockBySha returns a btcutil.Block.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchBlockBySha(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	return c.FetchBlockByShaCtx(c.ctx, sha)
+}
+
+// FetchBlockByShaCtx returns a btcutil.Block unless the passed context is done
+// first.  This is part of the btcdb.Db interface implementation.
+func (c *Client) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	reply, err := c.fetchBlock(ctx, &blockRequest{Sha: sha.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	blk, err := btcutil.NewBlockFromBytes(reply.Raw)
+	if err != nil {
+		return nil, err
+	}
+	blk.SetHeight(reply.Height)
+	return blk, nil
+}
+
+// FetchBlockRegion returns length bytes of the serialized block with the given
+// hash starting at offset.  The whole block is transferred.  This is part of
+// the btcdb.Db interface implementation.
+func (c *Client) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error) {
+	reply, err := c.fetchBlock(c.ctx, &blockRequest{Sha: sha.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > len(reply.Raw) {
+		return nil, btcdb.ErrInvalidRegion
+	}
+	return reply.Raw[offset : offset+length], nil
+}
+
+// FetchBlockBytesBySha returns the serialized block with the given hash,
+// appended to buf[:0].  This is part of the btcdb.Db interface implementation.
+func (c *Client) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error) {
+	reply, err := c.fetchBlock(c.ctx, &blockRequest{Sha: sha.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	return append(buf[:0], reply.Raw...), nil
+}
+
+// FetchBlockHeightBySha returns the block height for the given hash.  This is
+// part of the btcdb.Db interface implementation.
+func (c *Client) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
+	reply, err := c.fetchHeader(&blockRequest{Sha: sha.Bytes()})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Height, nil
+}
+
+// FetchBlockHeaderBySha returns a btcwire.BlockHeader for the given sha.  This
+// is part of the btcdb.Db interface implementation.
+func (c *Client) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (*btcwire.BlockHeader, error) {
+	reply, err := c.fetchHeader(&blockRequest{Sha: sha.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	var bh btcwire.BlockHeader
+	if err := bh.Deserialize(bytes.NewReader(reply.Raw)); err != nil {
+		return nil, err
+	}
+	return &bh, nil
+}
+
+// FetchBlockShaByHeight returns a block hash based on its height in the block
+// chain.  This is part of the btcdb.Db interface implementation.
+func (c *Client) FetchBlockShaByHeight(height int64) (*btcwire.ShaHash, error) {
+	reply, err := c.fetchHeader(&blockRequest{Height: height})
+	if err != nil {
+		return nil, err
+	}
+	return toSha(reply.Sha)
+}
+
+// FetchBlockHeaderByHeight returns the block header at the given height in the
+// main chain.  This is part of the btcdb.Db interface implementation.
+func (c *Client) FetchBlockHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	reply, err := c.fetchHeader(&blockRequest{Height: height})
+	if err != nil {
+		return nil, err
+	}
+	var bh btcwire.BlockHeader
+	if err := bh.Deserialize(bytes.NewReader(reply.Raw)); err != nil {
+		return nil, err
+	}
+	return &bh, nil
+}
+
+// fetchRange calls the passed function with each block, or only its header, of
+// the range the request selects as it is streamed.
+func (c *Client) fetchRange(ctx context.Context, req *rangeRequest, fn func(reply *blockReply) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.stream(ctx, "GetBlockRange", req)
+	if err != nil {
+		return err
+	}
+	for {
+		var reply blockReply
+		err := stream.RecvMsg(&reply)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fromStatus(err)
+		}
+		if err := fn(&reply); err != nil {
+			return err
+		}
+	}
+}
+
+// FetchHeaderRange returns the block headers from the start height up to but
+// not including the end height.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return c.FetchHeaderRangeCtx(c.ctx, startHeight, endHeight)
+}
+
+// FetchHeaderRangeCtx returns the block headers from the start height up to but
+// not including the end height unless the passed context is done first.  This
+// is part of the btcdb.Db interface implementation.
+func (c *Client) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	var headers []btcwire.BlockHeader
+	req := rangeRequest{Start: startHeight, End: endHeight, HeadersOnly: true}
+	err := c.fetchRange(ctx, &req, func(reply *blockReply) error {
+		var bh btcwire.BlockHeader
+		if err := bh.Deserialize(bytes.NewReader(reply.Raw)); err != nil {
+			return err
+		}
+		headers = append(headers, bh)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// FetchHeightRange looks up a range of blocks by the start and ending heights.
+// Fetch is inclusive of the start height and exclusive of the ending height.
+// To fetch all hashes from the start height until no more are present, use the
+// special id `AllShas'.  This is part of the btcdb.Db interface implementation.
+func (c *Client) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	return c.FetchHeightRangeCtx(c.ctx, startHeight, endHeight)
+}
+
+// FetchHeightRangeCtx looks up a range of blocks by the start and ending
+// heights unless the passed context is done first.  This is part of the
+// btcdb.Db interface implementation.
+func (c *Client) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	var shas []btcwire.ShaHash
+	req := rangeRequest{Start: startHeight, End: endHeight, HeadersOnly: true}
+	err := c.fetchRange(ctx, &req, func(reply *blockReply) error {
+		sha, err := toSha(reply.Sha)
+		if err != nil {
+			return err
+		}
+		shas = append(shas, *sha)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shas, nil
+}
+
+// FetchChainWorkBySha returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	return nil, ErrUnsupported
+}
+
+// blockLocator returns a block locator for the block at the given height.
+func (c *Client) blockLocator(height int64) (btcdb.BlockLocator, error) {
+	heights := btcdb.LocatorHeights(height)
+	locator := make(btcdb.BlockLocator, 0, len(heights))
+	for _, h := range heights {
+		sha, err := c.FetchBlockShaByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, sha)
+	}
+	return locator, nil
+}
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (c *Client) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	height, err := c.FetchBlockHeightBySha(sha)
+	if err != nil {
+		return nil, err
+	}
+	return c.blockLocator(height)
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (c *Client) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	_, height, err := c.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	return c.blockLocator(height)
+}
+
+// fetchTxs returns the records of the transactions a request looks up.
+func (c *Client) fetchTxs(req *txRequest) ([]*btcdb.TxListReply, error) {
+	var reply txReply
+	if err := c.invoke(c.ctx, "GetTx", req, &reply); err != nil {
+		return nil, err
+	}
+
+	replies := make([]*btcdb.TxListReply, 0, len(reply.Records))
+	for _, rec := range reply.Records {
+		r := btcdb.TxListReply{
+			Height:     rec.Height,
+			BlkIndex:   rec.BlkIndex,
+			TxSpent:    rec.TxSpent,
+			FullySpent: rec.FullySpent,
+			Err:        messageError(rec.Err),
+		}
+		var err error
+		if rec.Sha != nil {
+			if r.Sha, err = toSha(rec.Sha); err != nil {
+				return nil, err
+			}
+		}
+		if rec.BlkSha != nil {
+			if r.BlkSha, err = toSha(rec.BlkSha); err != nil {
+				return nil, err
+			}
+		}
+		if rec.Raw != nil {
+			var tx btcwire.MsgTx
+			if err := tx.Deserialize(bytes.NewReader(rec.Raw)); err != nil {
+				return nil, err
+			}
+			r.Tx = &tx
+		}
+		replies = append(replies, &r)
+	}
+	return replies, nil
+}
+
+// fetchTxList looks up each of the passed transactions in the given way.
+// Should the call fail, every reply carries the error.
+func (c *Client) fetchTxList(txShaList []*btcwire.ShaHash, lookup int32) []*btcdb.TxListReply {
+	req := txRequest{Shas: make([][]byte, 0, len(txShaList)), Lookup: lookup}
+	for _, sha := range txShaList {
+		req.Shas = append(req.Shas, sha.Bytes())
+	}
+	replies, err := c.fetchTxs(&req)
+	if err != nil {
+		replies = make([]*btcdb.TxListReply, 0, len(txShaList))
+		for _, sha := range txShaList {
+			replies = append(replies, &btcdb.TxListReply{
+				Sha: sha,
+				Err: err,
+			})
+		}
+	}
+	return replies
+}
+
+// ExistsTxSha returns whether or not the given transaction hash is present in
+// the database and is not fully spent.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) ExistsTxSha(sha *btcwire.ShaHash) bool {
+	return c.ExistsTxShas([]btcwire.ShaHash{*sha})[0]
+}
+
+// ExistsTxShas returns whether or not each of the given transaction hashes is
+// present in the database and is not fully spent.  All of the hashes are
+// looked up in a single call.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) ExistsTxShas(shas []btcwire.ShaHash) []bool {
+	list := make([]*btcwire.ShaHash, 0, len(shas))
+	for i := range shas {
+		list = append(list, &shas[i])
+	}
+	exists := make([]bool, len(shas))
+	for i, reply := range c.fetchTxList(list, txLookupUnspent) {
+		if reply.Err != nil && reply.Err != btcdb.ErrTxNotFound {
+			log.Warnf("ExistsTxShas: %v", reply.Err)
+		}
+		exists[i] = reply.Err == nil
+	}
+	return exists
+}
+
+// FetchTxBySha returns some data for the given transaction hash.  This is part
+// of the btcdb.Db interface implementation.
+func (c *Client) FetchTxBySha(txsha *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	req := txRequest{Shas: [][]byte{txsha.Bytes()}, Lookup: txLookupAll}
+	return c.fetchTxs(&req)
+}
+
+// FetchTxByShaList returns the most recent data for each of the given
+// transaction hashes.  This is part of the btcdb.Db interface implementation.
+func (c *Client) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return c.fetchTxList(txShaList, txLookupList)
+}
+
+// FetchUnSpentTxByShaList returns the most recent data for each of the given
+// transaction hashes which are not fully spent.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return c.fetchTxList(txShaList, txLookupUnspent)
+}
+
+// FetchUtxoEntry returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchUtxoEntry(outpoint *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	return nil, ErrUnsupported
+}
+
+// FetchSpendingTx returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchSpendingTx(outpoint *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	return nil, ErrUnsupported
+}
+
+// IsOutpointSpent returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) IsOutpointSpent(outpoint *btcwire.OutPoint) (bool, error) {
+	return false, ErrUnsupported
+}
+
+// FetchFilterBySha returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// FetchFilterHeaderBySha returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	return nil, ErrUnsupported
+}
+
+// FetchFilterRange returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// FetchFilterHeaderRange returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	return nil, ErrUnsupported
+}
+
+// UtxoSetSize returns ErrUnsupported.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) UtxoSetSize() (int64, error) {
+	return 0, ErrUnsupported
+}
+
+// InsertBlock returns btcdb.ErrReadOnly.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) InsertBlock(block *btcutil.Block) (int64, error) {
+	return 0, btcdb.ErrReadOnly
+}
+
+// InsertBlocks returns btcdb.ErrReadOnly.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) InsertBlocks(blocks []*btcutil.Block) ([]int64, error) {
+	return nil, btcdb.ErrReadOnly
+}
+
+// InsertBlocksWithMeta returns btcdb.ErrReadOnly.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	return nil, btcdb.ErrReadOnly
+}
+
+// DropAfterBlockBySha returns btcdb.ErrReadOnly.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	return btcdb.ErrReadOnly
+}
+
+// DropAfterBlockByShaWithMeta returns btcdb.ErrReadOnly.  This is part of the
+// btcdb.Db interface implementation.
+func (c *Client) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	return btcdb.ErrReadOnly
+}
+
+// ReorganizeWithMeta returns btcdb.ErrReadOnly.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	return nil, btcdb.ErrReadOnly
+}
+
+// GetMeta returns ErrUnsupported.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) GetMeta(key []byte) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// PutMeta returns btcdb.ErrReadOnly.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) PutMeta(key, value []byte) error {
+	return btcdb.ErrReadOnly
+}
+
+// DeleteMeta returns btcdb.ErrReadOnly.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) DeleteMeta(key []byte) error {
+	return btcdb.ErrReadOnly
+}
+
+// WriteMeta returns btcdb.ErrReadOnly.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) WriteMeta(meta *btcdb.MetaBatch) error {
+	return btcdb.ErrReadOnly
+}
+
+// MetaIterator returns ErrUnsupported.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	return nil, ErrUnsupported
+}
+
+// ReverseMetaIterator returns ErrUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	return nil, ErrUnsupported
+}
+
+// NewestSha returns the hash and block height of the most recent (end) block of
+// the block chain.  This is part of the btcdb.Db interface implementation.
+func (c *Client) NewestSha() (*btcwire.ShaHash, int64, error) {
+	var reply blockReply
+	if err := c.invoke(c.ctx, "GetBestBlock", &empty{}, &reply); err != nil {
+		return nil, 0, err
+	}
+	sha, err := toSha(reply.Sha)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sha, reply.Height, nil
+}
+
+// BlockIterator returns an iterator over the blocks of the chain in height
+// order beginning at the given height.  The blocks are streamed from the
+// server, so unlike those of other databases the iterator does not read from a
+// snapshot.  This is part of the btcdb.Db interface implementation.
+func (c *Client) BlockIterator(startHeight int64) (btcdb.BlockIterator, error) {
+	return c.BlockIteratorCtx(c.ctx, startHeight)
+}
+
+// BlockIteratorCtx returns an iterator over the blocks of the chain beginning
+// at the given height which stops once the passed context is done.  This is
+// part of the btcdb.Db interface implementation.
+func (c *Client) BlockIteratorCtx(ctx context.Context, startHeight int64) (btcdb.BlockIterator, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req := rangeRequest{Start: startHeight, End: btcdb.AllShas}
+	stream, err := c.stream(ctx, "GetBlockRange", &req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &blockIterator{stream: stream, cancel: cancel}, nil
+}
+
+// TxIterator returns an iterator over every transaction of the chain beginning
+// with the block at the given height.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) TxIterator(startHeight int64) (btcdb.TxIterator, error) {
+	return c.TxIteratorCtx(c.ctx, startHeight)
+}
+
+// TxIteratorCtx returns an iterator over every transaction of the chain
+// beginning with the block at the given height which stops once the passed
+// context is done.  This is part of the btcdb.Db interface implementation.
+func (c *Client) TxIteratorCtx(ctx context.Context, startHeight int64) (btcdb.TxIterator, error) {
+	blocks, err := c.BlockIteratorCtx(ctx, startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewTxIterator(blocks), nil
+}
+
+// AddIndexer returns btcdb.ErrReadOnly, since indexers are updated along with
+// the changes to the database.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) AddIndexer(idx btcdb.Indexer) error {
+	return btcdb.ErrReadOnly
+}
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain of the server.  The subscriptions of a client share a single
+// stream, which is started by the first of them.  They end should the stream
+// fail, and the next call starts a new one.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) Subscribe() (*btcdb.Subscription, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	if c.notifier == nil {
+		stream, err := c.stream(c.ctx, "SubscribeBlocks", &empty{})
+		if err != nil {
+			return nil, err
+		}
+
+		// The server sends the headers of the stream once it has
+		// subscribed, so no later change is missed.
+		if _, err := stream.Header(); err != nil {
+			return nil, fromStatus(err)
+		}
+		c.notifier = new(btcdb.Notifier)
+		go c.receiveEvents(stream, c.notifier)
+	}
+	return c.notifier.Subscribe()
+}
+
+// receiveEvents passes the events of a SubscribeBlocks stream to the notifier
+// it feeds until the stream ends, which ends the subscriptions.  It must be
+// run as a goroutine.
+func (c *Client) receiveEvents(stream grpc.ClientStream, n *btcdb.Notifier) {
+	defer func() {
+		c.mtx.Lock()
+		if c.notifier == n {
+			c.notifier = nil
+		}
+		c.mtx.Unlock()
+		n.Close()
+	}()
+
+	for {
+		var event blockEvent
+		if err := stream.RecvMsg(&event); err != nil {
+			if c.ctx.Err() == nil {
+				log.Warnf("SubscribeBlocks: %v", fromStatus(err))
+			}
+			return
+		}
+		sha, err := toSha(event.Sha)
+		if err != nil {
+			log.Warnf("SubscribeBlocks: %v", err)
+			return
+		}
+		if event.Connected {
+			n.Notify(btcdb.BlockConnected{Sha: *sha, Height: event.Height})
+		} else {
+			n.Notify(btcdb.BlockDisconnected{Sha: *sha,
+				Height: event.Height})
+		}
+	}
+}
+
+// Snapshot returns ErrUnsupported, since the server does not hold views of the
+// database open for clients.  This is part of the btcdb.Db interface
+// implementation.
+func (c *Client) Snapshot() (btcdb.Snapshot, error) {
+	return nil, ErrUnsupported
+}
+
+// VerifyIntegrity returns ErrUnsupported, since the checks run on a snapshot.
+// This is part of the btcdb.Db interface implementation.
+func (c *Client) VerifyIntegrity(level int, progress func(height int64)) error {
+	return ErrUnsupported
+}
+
+// Backup returns btcdb.ErrBackupUnsupported.  This is part of the btcdb.Db
+// interface implementation.
+func (c *Client) Backup(destPath string, progress func(copied int64)) error {
+	return btcdb.ErrBackupUnsupported
+}
+
+// ExportBootstrap returns ErrUnsupported, since the blocks are written from a
+// snapshot.  This is part of the btcdb.Db interface implementation.
+func (c *Client) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	return ErrUnsupported
+}
+
+// blockIterator implements btcdb.BlockIterator on top of a GetBlockRange
+// stream.
+type blockIterator struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	cur    blockReply
+	sha    *btcwire.ShaHash
+	err    error
+	done   bool
+}
+
+// Next moves to the next block.  This is part of the btcdb.BlockIterator
+// interface implementation.
+func (it *blockIterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	it.cur = blockReply{}
+	it.sha = nil
+	err := it.stream.RecvMsg(&it.cur)
+	if err == nil {
+		it.sha, err = toSha(it.cur.Sha)
+	}
+	if err != nil {
+		if err != io.EOF {
+			it.err = fromStatus(err)
+		}
+		it.cur = blockReply{}
+		it.done = true
+		return false
+	}
+	return true
+}
+
+// Sha returns the hash of the current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Sha() *btcwire.ShaHash {
+	return it.sha
+}
+
+// Height returns the height of the current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Height() int64 {
+	return it.cur.Height
+}
+
+// RawBytes returns the serialized current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) RawBytes() []byte {
+	return it.cur.Raw
+}
+
+// Err returns the error which stopped the iteration, if any.  This is part of
+// the btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Err() error {
+	return it.err
+}
+
+// Release ends the stream.  This is part of the btcdb.BlockIterator interface
+// implementation.
+func (it *blockIterator) Release() {
+	it.cancel()
+	it.done = true
+}
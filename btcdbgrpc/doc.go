@@ -0,0 +1,40 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package btcdbgrpc exposes a btcdb database over the network as a gRPC service,
+and provides a client which itself implements btcdb.Db, so block explorers,
+indexers and other services can read the chain of a node without embedding the
+database.
+
+The service, btcdb.BlockStore, offers the methods GetBlock, GetBlockHeader,
+GetTx and GetBestBlock, along with the server streams GetBlockRange, which
+sends the blocks or headers of a range of heights, and SubscribeBlocks, which
+sends the blocks connected to and disconnected from the chain.  Its messages
+are encoded with encoding/gob under the content subtype "btcdb" rather than as
+protocol buffers, so the package has no generated code.
+
+A server is set up by registering the service backed by an open database:
+
+	s := grpc.NewServer()
+	btcdbgrpc.Register(s, db)
+	err := s.Serve(listener)
+
+Clients connect with Dial, and are used like any other database:
+
+	db, err := btcdbgrpc.Dial("node.example.com:8340",
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		// Log and handle the error
+	}
+	defer db.Close()
+	sha, height, err := db.NewestSha()
+
+Clients are read-only, so the functions which modify the database return
+btcdb.ErrReadOnly.  Functions reading data the service does not offer, such as
+the spend and filter indexes, metadata and snapshots, return ErrUnsupported.
+Errors of the database, such as btcdb.ErrBlockNotFound, are returned to clients
+as themselves.
+*/
+package btcdbgrpc
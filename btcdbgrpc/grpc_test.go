@@ -0,0 +1,278 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbgrpc_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/btcdbgrpc"
+	_ "github.com/conformal/btcdb/memdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadBlocks returns the genesis block followed by the blocks of the test
+// data.
+func loadBlocks(t *testing.T) []*btcutil.Block {
+	testdatafile := filepath.Join("..", "testdata", "blocks1-256.bz2")
+	fi, err := os.Open(testdatafile)
+	if err != nil {
+		t.Fatalf("failed to open file %v, err %v", testdatafile, err)
+	}
+	defer fi.Close()
+	dr := bzip2.NewReader(fi)
+
+	blocks := []*btcutil.Block{btcutil.NewBlock(&btcwire.GenesisBlock)}
+	for {
+		var hdr [2]uint32
+		err := binary.Read(dr, binary.LittleEndian, &hdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read block header, err %v", err)
+		}
+		rbytes := make([]byte, hdr[1])
+		if _, err := io.ReadFull(dr, rbytes); err != nil {
+			t.Fatalf("failed to read block, err %v", err)
+		}
+		block, err := btcutil.NewBlockFromBytes(rbytes)
+		if err != nil {
+			t.Fatalf("failed to parse block %v, err %v", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// setup returns a memory database holding the passed blocks, and a client
+// connected to a server for it.  The returned function stops both.
+func setup(t *testing.T, blocks []*btcutil.Block) (btcdb.Db, *btcdbgrpc.Client, func()) {
+	db, err := btcdb.CreateDB("memory")
+	if err != nil {
+		t.Fatalf("Failed to open test database %v", err)
+	}
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Fatalf("InsertBlock: %v", err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	btcdbgrpc.Register(s, db)
+	go s.Serve(l)
+
+	client, err := btcdbgrpc.Dial(l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return db, client, func() {
+		client.Close()
+		s.Stop()
+		db.Close()
+	}
+}
+
+func TestClient(t *testing.T) {
+	blocks := loadBlocks(t)
+	_, client, teardown := setup(t, blocks)
+	defer teardown()
+
+	tipSha, _ := blocks[len(blocks)-1].Sha()
+	sha, height, err := client.NewestSha()
+	if err != nil || !sha.IsEqual(tipSha) || height != int64(len(blocks)-1) {
+		t.Errorf("NewestSha: got %v %d (err %v), want %v %d", sha,
+			height, err, tipSha, len(blocks)-1)
+	}
+
+	for height, block := range blocks {
+		sha, _ := block.Sha()
+		want, _ := block.Bytes()
+		blk, err := client.FetchBlockBySha(sha)
+		if err != nil {
+			t.Errorf("FetchBlockBySha: %v", err)
+			continue
+		}
+		if got, _ := blk.Bytes(); !bytes.Equal(got, want) ||
+			blk.Height() != int64(height) {
+			t.Errorf("FetchBlockBySha: block %d does not match", height)
+		}
+
+		gotSha, err := client.FetchBlockShaByHeight(int64(height))
+		if err != nil || !gotSha.IsEqual(sha) {
+			t.Errorf("FetchBlockShaByHeight: got %v (err %v), want %v",
+				gotSha, err, sha)
+		}
+		gotHeight, err := client.FetchBlockHeightBySha(sha)
+		if err != nil || gotHeight != int64(height) {
+			t.Errorf("FetchBlockHeightBySha: got %d (err %v), want %d",
+				gotHeight, err, height)
+		}
+		bh, err := client.FetchBlockHeaderByHeight(int64(height))
+		if err != nil {
+			t.Errorf("FetchBlockHeaderByHeight: %v", err)
+		} else if bhSha, _ := bh.BlockSha(); !bhSha.IsEqual(sha) {
+			t.Errorf("FetchBlockHeaderByHeight: header of block %d "+
+				"does not match", height)
+		}
+
+		for idx, tx := range block.Transactions() {
+			replies, err := client.FetchTxBySha(tx.Sha())
+			if err != nil || len(replies) == 0 {
+				t.Errorf("FetchTxBySha: transaction %v is missing "+
+					"(err %v)", tx.Sha(), err)
+				continue
+			}
+			reply := replies[len(replies)-1]
+			txSha, _ := reply.Tx.TxSha()
+			if !txSha.IsEqual(tx.Sha()) || !reply.BlkSha.IsEqual(sha) ||
+				reply.BlkIndex != idx {
+				t.Errorf("FetchTxBySha: transaction %v does not "+
+					"match", tx.Sha())
+			}
+		}
+	}
+
+	shas, err := client.FetchHeightRange(10, btcdb.AllShas)
+	if err != nil || len(shas) != len(blocks)-10 {
+		t.Errorf("FetchHeightRange: got %d hashes (err %v), want %d",
+			len(shas), err, len(blocks)-10)
+	}
+	headers, err := client.FetchHeaderRange(0, 100)
+	if err != nil || len(headers) != 100 {
+		t.Errorf("FetchHeaderRange: got %d headers (err %v), want 100",
+			len(headers), err)
+	}
+
+	it, err := client.BlockIterator(100)
+	if err != nil {
+		t.Fatalf("BlockIterator: %v", err)
+	}
+	height = 100
+	for it.Next() {
+		want, _ := blocks[height].Bytes()
+		if it.Height() != height || !bytes.Equal(it.RawBytes(), want) {
+			t.Errorf("BlockIterator: block %d does not match", height)
+		}
+		height++
+	}
+	if err := it.Err(); err != nil || height != int64(len(blocks)) {
+		t.Errorf("BlockIterator: stopped at %d (err %v), want %d",
+			height, err, len(blocks))
+	}
+	it.Release()
+
+	// The errors of the database are returned as themselves.
+	var missing btcwire.ShaHash
+	if _, err := client.FetchBlockBySha(&missing); err != btcdb.ErrBlockNotFound {
+		t.Errorf("FetchBlockBySha: got %v, want %v", err,
+			btcdb.ErrBlockNotFound)
+	}
+	if client.ExistsSha(&missing) || client.ExistsTxSha(&missing) {
+		t.Errorf("ExistsSha: missing hash exists")
+	}
+	if _, err := client.FetchBlockRegion(tipSha, 0, 1<<20); err != btcdb.ErrInvalidRegion {
+		t.Errorf("FetchBlockRegion: got %v, want %v", err,
+			btcdb.ErrInvalidRegion)
+	}
+
+	// Fully spent transactions are told from ones which do not exist.  The
+	// coinbase of block 9 is spent by block 170.
+	spentSha := blocks[9].Transactions()[0].Sha()
+	replies := client.FetchUnSpentTxByShaList(
+		[]*btcwire.ShaHash{spentSha, &missing})
+	if len(replies) != 2 || replies[0].Err != btcdb.TxShaMissing ||
+		!replies[0].FullySpent || replies[0].Height != 9 ||
+		replies[1].Err != btcdb.TxShaMissing || replies[1].FullySpent {
+
+		t.Errorf("FetchUnSpentTxByShaList: got %+v, want the first "+
+			"fully spent at height 9 and the second missing", replies)
+	}
+	if _, err := client.InsertBlock(blocks[0]); err != btcdb.ErrReadOnly {
+		t.Errorf("InsertBlock: got %v, want %v", err, btcdb.ErrReadOnly)
+	}
+	if _, err := client.FetchSpendingTx(&btcwire.OutPoint{}); err != btcdbgrpc.ErrUnsupported {
+		t.Errorf("FetchSpendingTx: got %v, want %v", err,
+			btcdbgrpc.ErrUnsupported)
+	}
+
+	client.Close()
+	if _, _, err := client.NewestSha(); err != btcdb.ErrDbClosed {
+		t.Errorf("NewestSha: got %v after close, want %v", err,
+			btcdb.ErrDbClosed)
+	}
+}
+
+func TestSubscribeBlocks(t *testing.T) {
+	blocks := loadBlocks(t)[:20]
+	db, client, teardown := setup(t, blocks[:10])
+	defer teardown()
+
+	sub, err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	var want []btcdb.ChainEvent
+	for height, block := range blocks[10:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Fatalf("InsertBlock: %v", err)
+		}
+		sha, _ := block.Sha()
+		want = append(want, btcdb.BlockConnected{Sha: *sha,
+			Height: int64(height + 10)})
+	}
+	forkSha, _ := blocks[15].Sha()
+	if err := db.DropAfterBlockBySha(forkSha); err != nil {
+		t.Fatalf("DropAfterBlockBySha: %v", err)
+	}
+	for height := len(blocks) - 1; height > 15; height-- {
+		sha, _ := blocks[height].Sha()
+		want = append(want, btcdb.BlockDisconnected{Sha: *sha,
+			Height: int64(height)})
+	}
+
+	for i := range want {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				t.Fatalf("subscription ended after %d events", i)
+			}
+			if event != want[i] {
+				t.Errorf("event %d is %+v, want %+v", i, event,
+					want[i])
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+
+	// Closing the client ends its subscriptions.
+	client.Close()
+	select {
+	case _, ok := <-sub.Events():
+		if ok {
+			t.Errorf("unexpected event after close")
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("subscription did not end on close")
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbgrpc
+
+import (
+	"github.com/conformal/btcdb"
+)
+
+// log is the logger of the package, which is set up along with the loggers of
+// the drivers.
+var log = btcdb.DriverLogger("btcdbgrpc")
@@ -0,0 +1,279 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbgrpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// headerRangeBatch is the number of headers read from the database at a time
+// for header ranges.
+const headerRangeBatch = 2000
+
+// server implements the service on top of a database.
+type server struct {
+	db btcdb.Db
+}
+
+// Register registers the service backed by the passed database with the gRPC
+// server.  The database is only read from, and remains owned by the caller,
+// who must stop the server before closing it.
+func Register(s grpc.ServiceRegistrar, db btcdb.Db) {
+	s.RegisterService(&serviceDesc, &server{db: db})
+}
+
+// blockSha returns the hash of the block a request selects.
+func (s *server) blockSha(req *blockRequest) (*btcwire.ShaHash, error) {
+	if req.Sha != nil {
+		return toSha(req.Sha)
+	}
+	return s.db.FetchBlockShaByHeight(req.Height)
+}
+
+// getBlock returns the serialized block a request selects.
+func (s *server) getBlock(ctx context.Context, req *blockRequest) (*blockReply, error) {
+	sha, err := s.blockSha(req)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	blk, err := s.db.FetchBlockByShaCtx(ctx, sha)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	raw, err := blk.Bytes()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &blockReply{Sha: sha.Bytes(), Height: blk.Height(), Raw: raw}, nil
+}
+
+// getBlockHeader returns the serialized header of the block a request selects.
+func (s *server) getBlockHeader(ctx context.Context, req *blockRequest) (*blockReply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, toStatus(err)
+	}
+
+	var sha *btcwire.ShaHash
+	var bh *btcwire.BlockHeader
+	height := req.Height
+	var err error
+	if req.Sha != nil {
+		sha, err = toSha(req.Sha)
+		if err == nil {
+			height, err = s.db.FetchBlockHeightBySha(sha)
+		}
+		if err == nil {
+			bh, err = s.db.FetchBlockHeaderBySha(sha)
+		}
+	} else {
+		sha, err = s.db.FetchBlockShaByHeight(height)
+		if err == nil {
+			bh, err = s.db.FetchBlockHeaderByHeight(height)
+		}
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	var buf bytes.Buffer
+	if err := bh.Serialize(&buf); err != nil {
+		return nil, toStatus(err)
+	}
+	return &blockReply{Sha: sha.Bytes(), Height: height, Raw: buf.Bytes()},
+		nil
+}
+
+// getTx returns the records of the transactions a request looks up.
+func (s *server) getTx(ctx context.Context, req *txRequest) (*txReply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, toStatus(err)
+	}
+
+	shas := make([]*btcwire.ShaHash, 0, len(req.Shas))
+	for _, b := range req.Shas {
+		sha, err := toSha(b)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		shas = append(shas, sha)
+	}
+
+	var replies []*btcdb.TxListReply
+	switch req.Lookup {
+	case txLookupAll:
+		if len(shas) != 1 {
+			return nil, toStatus(fmt.Errorf("lookup of all records "+
+				"takes one hash, not %d", len(shas)))
+		}
+		var err error
+		replies, err = s.db.FetchTxBySha(shas[0])
+		if err != nil {
+			return nil, toStatus(err)
+		}
+	case txLookupList:
+		replies = s.db.FetchTxByShaList(shas)
+	case txLookupUnspent:
+		replies = s.db.FetchUnSpentTxByShaList(shas)
+	default:
+		return nil, toStatus(fmt.Errorf("unknown transaction lookup %d",
+			req.Lookup))
+	}
+
+	reply := &txReply{Records: make([]txRecord, 0, len(replies))}
+	for _, r := range replies {
+		rec := txRecord{
+			Height:     r.Height,
+			BlkIndex:   r.BlkIndex,
+			TxSpent:    r.TxSpent,
+			FullySpent: r.FullySpent,
+			Err:        errorMessage(r.Err),
+		}
+		if r.Sha != nil {
+			rec.Sha = r.Sha.Bytes()
+		}
+		if r.BlkSha != nil {
+			rec.BlkSha = r.BlkSha.Bytes()
+		}
+		if r.Tx != nil {
+			var buf bytes.Buffer
+			if err := r.Tx.Serialize(&buf); err != nil {
+				return nil, toStatus(err)
+			}
+			rec.Raw = buf.Bytes()
+		}
+		reply.Records = append(reply.Records, rec)
+	}
+	return reply, nil
+}
+
+// getBestBlock returns the hash and height of the most recent block.
+func (s *server) getBestBlock(ctx context.Context, req *empty) (*blockReply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, toStatus(err)
+	}
+
+	sha, height, err := s.db.NewestSha()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &blockReply{Sha: sha.Bytes(), Height: height}, nil
+}
+
+// getBlockRange streams the blocks, or only their headers, of the range a
+// request selects.  The stream ends early should the client go away.
+func (s *server) getBlockRange(req *rangeRequest, stream grpc.ServerStream) error {
+	if req.Start < 0 {
+		return toStatus(fmt.Errorf("start height of fetch range must "+
+			"not be less than zero - got %d", req.Start))
+	}
+	if req.End < req.Start {
+		return toStatus(fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			req.Start, req.End))
+	}
+
+	ctx := stream.Context()
+	if req.HeadersOnly {
+		return toStatus(s.sendHeaderRange(ctx, req, stream))
+	}
+
+	it, err := s.db.BlockIteratorCtx(ctx, req.Start)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer it.Release()
+	for it.Next() && it.Height() < req.End {
+		reply := blockReply{
+			Sha:    it.Sha().Bytes(),
+			Height: it.Height(),
+			Raw:    it.RawBytes(),
+		}
+		if err := stream.SendMsg(&reply); err != nil {
+			return err
+		}
+	}
+	return toStatus(it.Err())
+}
+
+// sendHeaderRange streams the headers of the range a request selects in
+// batches.
+func (s *server) sendHeaderRange(ctx context.Context, req *rangeRequest, stream grpc.ServerStream) error {
+	for start := req.Start; start < req.End; {
+		end := req.End
+		if end-start > headerRangeBatch {
+			end = start + headerRangeBatch
+		}
+		headers, err := s.db.FetchHeaderRangeCtx(ctx, start, end)
+		if err != nil {
+			return err
+		}
+		for i := range headers {
+			sha, err := headers[i].BlockSha()
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := headers[i].Serialize(&buf); err != nil {
+				return err
+			}
+			reply := blockReply{
+				Sha:    sha.Bytes(),
+				Height: start + int64(i),
+				Raw:    buf.Bytes(),
+			}
+			if err := stream.SendMsg(&reply); err != nil {
+				return err
+			}
+		}
+		if int64(len(headers)) < end-start {
+			break
+		}
+		start = end
+	}
+	return nil
+}
+
+// subscribeBlocks streams the blocks connected to and disconnected from the
+// chain until the client goes away or the database is closed.  The headers of
+// the stream are sent once the subscription is in place, so clients know no
+// later change is missed.
+func (s *server) subscribeBlocks(req *empty, stream grpc.ServerStream) error {
+	sub, err := s.db.Subscribe()
+	if err != nil {
+		return toStatus(err)
+	}
+	defer sub.Unsubscribe()
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return toStatus(btcdb.ErrDbClosed)
+			}
+			var reply blockEvent
+			switch e := event.(type) {
+			case btcdb.BlockConnected:
+				reply = blockEvent{true, e.Sha.Bytes(), e.Height}
+			case btcdb.BlockDisconnected:
+				reply = blockEvent{false, e.Sha.Bytes(), e.Height}
+			}
+			if err := stream.SendMsg(&reply); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return toStatus(ctx.Err())
+		}
+	}
+}
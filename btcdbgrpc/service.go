@@ -0,0 +1,349 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbgrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// serviceName is the name of the gRPC service.
+const serviceName = "btcdb.BlockStore"
+
+// ErrUnsupported is returned by the functions of a Client which the service
+// does not offer, such as those reading the spend and filter indexes.
+var ErrUnsupported = errors.New("Function is not supported by btcdbgrpc " +
+	"clients")
+
+// codecName is the content subtype the messages of the service are sent
+// with.  The messages are plain structures encoded with encoding/gob, so the
+// service does not need code generated from a protocol buffer definition.
+const codecName = "btcdb"
+
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+}
+
+// gobCodec encodes the messages of the service with encoding/gob.
+type gobCodec struct{}
+
+// Marshal returns the encoded message.  This is part of the encoding.Codec
+// interface implementation.
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	// Messages without fields are sent empty, since gob refuses them.
+	if _, ok := v.(*empty); ok {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the passed data into the message.  This is part of the
+// encoding.Codec interface implementation.
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	if _, ok := v.(*empty); ok {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Name returns the content subtype of the codec.  This is part of the
+// encoding.Codec interface implementation.
+func (gobCodec) Name() string {
+	return codecName
+}
+
+// empty is the message of requests which have no arguments.
+type empty struct{}
+
+// blockRequest selects a block by its hash, or by its height when the hash is
+// nil.
+type blockRequest struct {
+	Sha    []byte
+	Height int64
+}
+
+// blockReply is a serialized block, or only its header in replies to
+// GetBlockHeader and header ranges.
+type blockReply struct {
+	Sha    []byte
+	Height int64
+	Raw    []byte
+}
+
+// Kinds of transaction lookups made by GetTx, which answer for FetchTxBySha,
+// FetchTxByShaList and FetchUnSpentTxByShaList respectively.
+const (
+	txLookupAll int32 = iota
+	txLookupList
+	txLookupUnspent
+)
+
+// txRequest looks up the transactions with the passed hashes.
+type txRequest struct {
+	Shas   [][]byte
+	Lookup int32
+}
+
+// txRecord is a btcdb.TxListReply with the transaction serialized and the
+// error replaced by its message.
+type txRecord struct {
+	Sha        []byte
+	Raw        []byte
+	BlkSha     []byte
+	Height     int64
+	BlkIndex   int
+	TxSpent    []bool
+	FullySpent bool
+	Err        string
+}
+
+// txReply holds the records found by GetTx.
+type txReply struct {
+	Records []txRecord
+}
+
+// rangeRequest selects the blocks from the start height up to but not
+// including the end height, or only their headers.
+type rangeRequest struct {
+	Start       int64
+	End         int64
+	HeadersOnly bool
+}
+
+// blockEvent is a btcdb.BlockConnected or btcdb.BlockDisconnected.
+type blockEvent struct {
+	Connected bool
+	Sha       []byte
+	Height    int64
+}
+
+// blockStoreServer is implemented by the server of the service.
+type blockStoreServer interface {
+	getBlock(ctx context.Context, req *blockRequest) (*blockReply, error)
+	getBlockHeader(ctx context.Context, req *blockRequest) (*blockReply, error)
+	getTx(ctx context.Context, req *txRequest) (*txReply, error)
+	getBestBlock(ctx context.Context, req *empty) (*blockReply, error)
+	getBlockRange(req *rangeRequest, stream grpc.ServerStream) error
+	subscribeBlocks(req *empty, stream grpc.ServerStream) error
+}
+
+// unaryCall runs a unary method of the service with the passed request
+// through the interceptor of the server, if any.
+func unaryCall(srv interface{}, ctx context.Context, method string, req interface{},
+	interceptor grpc.UnaryServerInterceptor,
+	handler func(ctx context.Context, req interface{}) (interface{}, error)) (interface{}, error) {
+
+	if interceptor == nil {
+		return handler(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + serviceName + "/" + method,
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+// getBlockHandler decodes a GetBlock request and passes it to the server.
+func getBlockHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	req := new(blockRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return unaryCall(srv, ctx, "GetBlock", req, interceptor,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(blockStoreServer).getBlock(ctx,
+				req.(*blockRequest))
+		})
+}
+
+// getBlockHeaderHandler decodes a GetBlockHeader request and passes it to the
+// server.
+func getBlockHeaderHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	req := new(blockRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return unaryCall(srv, ctx, "GetBlockHeader", req, interceptor,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(blockStoreServer).getBlockHeader(ctx,
+				req.(*blockRequest))
+		})
+}
+
+// getTxHandler decodes a GetTx request and passes it to the server.
+func getTxHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	req := new(txRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return unaryCall(srv, ctx, "GetTx", req, interceptor,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(blockStoreServer).getTx(ctx,
+				req.(*txRequest))
+		})
+}
+
+// getBestBlockHandler decodes a GetBestBlock request and passes it to the
+// server.
+func getBestBlockHandler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	req := new(empty)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	return unaryCall(srv, ctx, "GetBestBlock", req, interceptor,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(blockStoreServer).getBestBlock(ctx,
+				req.(*empty))
+		})
+}
+
+// getBlockRangeHandler receives a GetBlockRange request and has the server
+// stream the blocks.
+func getBlockRangeHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(rangeRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(blockStoreServer).getBlockRange(req, stream)
+}
+
+// subscribeBlocksHandler receives a SubscribeBlocks request and has the server
+// stream the events.
+func subscribeBlocksHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(empty)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(blockStoreServer).subscribeBlocks(req, stream)
+}
+
+// serviceDesc describes the service to gRPC.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*blockStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetBlock", Handler: getBlockHandler},
+		{MethodName: "GetBlockHeader", Handler: getBlockHeaderHandler},
+		{MethodName: "GetTx", Handler: getTxHandler},
+		{MethodName: "GetBestBlock", Handler: getBestBlockHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetBlockRange",
+			Handler:       getBlockRangeHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeBlocks",
+			Handler:       subscribeBlocksHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// sentinelErrors are the errors of btcdb which are passed to clients as
+// themselves along with the status code they are sent with.
+var sentinelErrors = []struct {
+	err  error
+	code codes.Code
+}{
+	{btcdb.ErrBlockNotFound, codes.NotFound},
+	{btcdb.ErrTxNotFound, codes.NotFound},
+	{btcdb.ErrPruned, codes.NotFound},
+	{btcdb.ErrHeadersOnly, codes.FailedPrecondition},
+	{btcdb.ErrInvalidRegion, codes.OutOfRange},
+	{btcdb.ErrDbClosed, codes.Unavailable},
+	{btcdb.ErrCorruption, codes.DataLoss},
+}
+
+// toStatus returns the passed error of a database as the error of a gRPC
+// status.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, s := range sentinelErrors {
+		if err == s.err {
+			return status.Error(s.code, err.Error())
+		}
+	}
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// fromStatus returns the error of a database a gRPC status stands for.
+func fromStatus(err error) error {
+	s, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	for _, sentinel := range sentinelErrors {
+		if s.Code() == sentinel.code && s.Message() == sentinel.err.Error() {
+			return sentinel.err
+		}
+	}
+	switch s.Code() {
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+	return errors.New(s.Message())
+}
+
+// errorMessage returns the message of the passed error, or an empty string
+// when it is nil.
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// messageError returns the error the passed message of a txRecord stands for.
+func messageError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, s := range sentinelErrors {
+		if msg == s.err.Error() {
+			return s.err
+		}
+	}
+	return errors.New(msg)
+}
+
+// toSha returns the passed bytes of a message as a hash.
+func toSha(b []byte) (*btcwire.ShaHash, error) {
+	var sha btcwire.ShaHash
+	if err := sha.SetBytes(b); err != nil {
+		return nil, fmt.Errorf("invalid hash in message: %v", err)
+	}
+	return &sha, nil
+}
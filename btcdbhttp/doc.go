@@ -0,0 +1,28 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package btcdbhttp provides an HTTP handler serving the blocks and transactions
+of a btcdb database, so lightweight block explorers can sit directly on the
+database without the RPC server of a full node.
+
+The handler answers GET and HEAD requests for the following paths:
+
+	/block/{hash}       the block with the given hash
+	/block/height/{n}   the block at the given height of the main chain
+	/tx/{txid}          the most recent transaction with the given hash
+	/tip                the hash and height of the most recent block
+
+Replies are JSON documents unless the query parameter format=hex is passed, in
+which case blocks and transactions are sent as the hex encoding of their
+serialized form.  Failed requests are answered with a JSON document holding the
+error along with a 404 status for unknown blocks and transactions, a 400 status
+for malformed requests and a 503 status once the database is closed.
+
+The handler only reads from the database, which remains owned by the caller:
+
+	http.Handle("/", btcdbhttp.NewHandler(db))
+	err := http.ListenAndServe("localhost:8080", nil)
+*/
+package btcdbhttp
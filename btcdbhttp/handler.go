@@ -0,0 +1,366 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbhttp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errNotFound is returned for paths the handler does not serve.
+var errNotFound = errors.New("not found")
+
+// handler implements http.Handler on top of a database.
+type handler struct {
+	db btcdb.Db
+}
+
+// NewHandler returns an http.Handler serving the blocks and transactions of
+// the passed database.  See the package documentation for the paths it serves.
+func NewHandler(db btcdb.Db) http.Handler {
+	return &handler{db: db}
+}
+
+// badRequest is an error caused by a malformed request rather than the
+// database.
+type badRequest struct {
+	msg string
+}
+
+// Error returns the message of the error.  This is part of the error
+// interface implementation.
+func (e badRequest) Error() string {
+	return e.msg
+}
+
+// tipReply is the JSON document sent for the tip of the chain.
+type tipReply struct {
+	Hash   string `json:"hash"`
+	Height int64  `json:"height"`
+}
+
+// blockReply is the JSON document sent for blocks.
+type blockReply struct {
+	Hash          string   `json:"hash"`
+	Height        int64    `json:"height"`
+	Confirmations int64    `json:"confirmations"`
+	Size          int      `json:"size"`
+	Version       int32    `json:"version"`
+	PreviousHash  string   `json:"previousblockhash"`
+	MerkleRoot    string   `json:"merkleroot"`
+	Time          int64    `json:"time"`
+	Bits          string   `json:"bits"`
+	Nonce         uint32   `json:"nonce"`
+	Tx            []string `json:"tx"`
+}
+
+// txInReply is the JSON document sent for the inputs of transactions.
+type txInReply struct {
+	Coinbase  string `json:"coinbase,omitempty"`
+	Txid      string `json:"txid,omitempty"`
+	Vout      uint32 `json:"vout"`
+	ScriptSig string `json:"scriptSig,omitempty"`
+	Sequence  uint32 `json:"sequence"`
+}
+
+// txOutReply is the JSON document sent for the outputs of transactions.
+type txOutReply struct {
+	Value        int64  `json:"value"`
+	N            int    `json:"n"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	Spent        bool   `json:"spent"`
+}
+
+// txReply is the JSON document sent for transactions.
+type txReply struct {
+	Txid          string       `json:"txid"`
+	BlockHash     string       `json:"blockhash"`
+	Height        int64        `json:"height"`
+	BlockIndex    int          `json:"blockindex"`
+	Confirmations int64        `json:"confirmations"`
+	Version       uint32       `json:"version"`
+	LockTime      uint32       `json:"locktime"`
+	Vin           []txInReply  `json:"vin"`
+	Vout          []txOutReply `json:"vout"`
+}
+
+// errorReply is the JSON document sent for failed requests.
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP answers the passed request.  This is part of the http.Handler
+// interface implementation.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed,
+			&errorReply{Error: "method not allowed"})
+		return
+	}
+
+	var asHex bool
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+	case "hex":
+		asHex = true
+	default:
+		writeError(w, badRequest{fmt.Sprintf("unknown format %q", format)})
+		return
+	}
+
+	var err error
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "tip":
+		err = h.serveTip(w)
+	case len(parts) == 2 && parts[0] == "block":
+		var sha *btcwire.ShaHash
+		sha, err = parseSha(parts[1])
+		if err == nil {
+			err = h.serveBlock(w, sha, asHex)
+		}
+	case len(parts) == 3 && parts[0] == "block" && parts[1] == "height":
+		var sha *btcwire.ShaHash
+		sha, err = h.shaByHeight(parts[2])
+		if err == nil {
+			err = h.serveBlock(w, sha, asHex)
+		}
+	case len(parts) == 2 && parts[0] == "tx":
+		var sha *btcwire.ShaHash
+		sha, err = parseSha(parts[1])
+		if err == nil {
+			err = h.serveTx(w, sha, asHex)
+		}
+	default:
+		err = errNotFound
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// parseSha returns the hash in the passed path segment.
+func parseSha(s string) (*btcwire.ShaHash, error) {
+	if len(s) != btcwire.HashSize*2 {
+		return nil, badRequest{fmt.Sprintf("invalid hash %q", s)}
+	}
+	sha, err := btcwire.NewShaHashFromStr(s)
+	if err != nil {
+		return nil, badRequest{fmt.Sprintf("invalid hash %q", s)}
+	}
+	return sha, nil
+}
+
+// shaByHeight returns the hash of the block at the height in the passed path
+// segment.
+func (h *handler) shaByHeight(s string) (*btcwire.ShaHash, error) {
+	height, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || height < 0 {
+		return nil, badRequest{fmt.Sprintf("invalid height %q", s)}
+	}
+	return h.db.FetchBlockShaByHeight(height)
+}
+
+// confirmations returns the number of confirmations of the block at the passed
+// height.
+func (h *handler) confirmations(height int64) (int64, error) {
+	_, tip, err := h.db.NewestSha()
+	if err != nil {
+		return 0, err
+	}
+	return tip - height + 1, nil
+}
+
+// serveTip sends the hash and height of the most recent block.
+func (h *handler) serveTip(w http.ResponseWriter) error {
+	sha, height, err := h.db.NewestSha()
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, &tipReply{Hash: sha.String(), Height: height})
+	return nil
+}
+
+// serveBlock sends the block with the passed hash.
+func (h *handler) serveBlock(w http.ResponseWriter, sha *btcwire.ShaHash, asHex bool) error {
+	if asHex {
+		raw, err := h.db.FetchBlockBytesBySha(sha, nil)
+		if err != nil {
+			return err
+		}
+		writeHex(w, raw)
+		return nil
+	}
+
+	blk, err := h.db.FetchBlockBySha(sha)
+	if err != nil {
+		return err
+	}
+	confirmations, err := h.confirmations(blk.Height())
+	if err != nil {
+		return err
+	}
+	reply, err := newBlockReply(blk, confirmations)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, reply)
+	return nil
+}
+
+// newBlockReply returns the JSON document for the passed block.
+func newBlockReply(blk *btcutil.Block, confirmations int64) (*blockReply, error) {
+	sha, err := blk.Sha()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := blk.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	msgBlock := blk.MsgBlock()
+	bh := &msgBlock.Header
+	reply := &blockReply{
+		Hash:          sha.String(),
+		Height:        blk.Height(),
+		Confirmations: confirmations,
+		Size:          len(raw),
+		Version:       bh.Version,
+		PreviousHash:  bh.PrevBlock.String(),
+		MerkleRoot:    bh.MerkleRoot.String(),
+		Time:          bh.Timestamp.Unix(),
+		Bits:          strconv.FormatUint(uint64(bh.Bits), 16),
+		Nonce:         bh.Nonce,
+		Tx:            make([]string, 0, len(msgBlock.Transactions)),
+	}
+	for _, tx := range blk.Transactions() {
+		reply.Tx = append(reply.Tx, tx.Sha().String())
+	}
+	return reply, nil
+}
+
+// serveTx sends the most recent transaction with the passed hash.
+func (h *handler) serveTx(w http.ResponseWriter, sha *btcwire.ShaHash, asHex bool) error {
+	replies, err := h.db.FetchTxBySha(sha)
+	if err != nil {
+		return err
+	}
+	if len(replies) == 0 {
+		return btcdb.ErrTxNotFound
+	}
+	r := replies[len(replies)-1]
+	if r.Err != nil {
+		return r.Err
+	}
+
+	if asHex {
+		var buf bytes.Buffer
+		if err := r.Tx.Serialize(&buf); err != nil {
+			return err
+		}
+		writeHex(w, buf.Bytes())
+		return nil
+	}
+
+	confirmations, err := h.confirmations(r.Height)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newTxReply(r, confirmations))
+	return nil
+}
+
+// newTxReply returns the JSON document for the passed transaction record.
+func newTxReply(r *btcdb.TxListReply, confirmations int64) *txReply {
+	tx := r.Tx
+	reply := &txReply{
+		Txid:          r.Sha.String(),
+		BlockHash:     r.BlkSha.String(),
+		Height:        r.Height,
+		BlockIndex:    r.BlkIndex,
+		Confirmations: confirmations,
+		Version:       tx.Version,
+		LockTime:      tx.LockTime,
+		Vin:           make([]txInReply, 0, len(tx.TxIn)),
+		Vout:          make([]txOutReply, 0, len(tx.TxOut)),
+	}
+
+	// Coinbase transactions have a single input spending the zero hash
+	// with the maximum index.
+	isCoinbase := len(tx.TxIn) == 1 &&
+		tx.TxIn[0].PreviousOutpoint.Index == ^uint32(0) &&
+		tx.TxIn[0].PreviousOutpoint.Hash == btcwire.ShaHash{}
+	for _, txIn := range tx.TxIn {
+		in := txInReply{Sequence: txIn.Sequence}
+		if isCoinbase {
+			in.Coinbase = hex.EncodeToString(txIn.SignatureScript)
+		} else {
+			in.Txid = txIn.PreviousOutpoint.Hash.String()
+			in.Vout = txIn.PreviousOutpoint.Index
+			in.ScriptSig = hex.EncodeToString(txIn.SignatureScript)
+		}
+		reply.Vin = append(reply.Vin, in)
+	}
+	for i, txOut := range tx.TxOut {
+		out := txOutReply{
+			Value:        txOut.Value,
+			N:            i,
+			ScriptPubKey: hex.EncodeToString(txOut.PkScript),
+		}
+		if i < len(r.TxSpent) {
+			out.Spent = r.TxSpent[i]
+		}
+		reply.Vout = append(reply.Vout, out)
+	}
+	return reply
+}
+
+// writeJSON sends the passed document with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(&errorReply{Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	w.Write([]byte{'\n'})
+}
+
+// writeHex sends the hex encoding of the passed serialized block or
+// transaction.
+func writeHex(w http.ResponseWriter, raw []byte) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(hex.EncodeToString(raw)))
+	w.Write([]byte{'\n'})
+}
+
+// writeError sends the passed error with the status it stands for.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case errNotFound, btcdb.ErrBlockNotFound, btcdb.ErrTxNotFound,
+		btcdb.ErrPruned:
+		status = http.StatusNotFound
+	case btcdb.ErrDbClosed:
+		status = http.StatusServiceUnavailable
+	}
+	if _, ok := err.(badRequest); ok {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, &errorReply{Error: err.Error()})
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdbhttp_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/btcdbhttp"
+	_ "github.com/conformal/btcdb/memdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// loadBlocks returns the genesis block followed by the blocks of the test
+// data.
+func loadBlocks(t *testing.T) []*btcutil.Block {
+	testdatafile := filepath.Join("..", "testdata", "blocks1-256.bz2")
+	fi, err := os.Open(testdatafile)
+	if err != nil {
+		t.Fatalf("failed to open file %v, err %v", testdatafile, err)
+	}
+	defer fi.Close()
+	dr := bzip2.NewReader(fi)
+
+	blocks := []*btcutil.Block{btcutil.NewBlock(&btcwire.GenesisBlock)}
+	for {
+		var hdr [2]uint32
+		err := binary.Read(dr, binary.LittleEndian, &hdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read block header, err %v", err)
+		}
+		rbytes := make([]byte, hdr[1])
+		if _, err := io.ReadFull(dr, rbytes); err != nil {
+			t.Fatalf("failed to read block, err %v", err)
+		}
+		block, err := btcutil.NewBlockFromBytes(rbytes)
+		if err != nil {
+			t.Fatalf("failed to parse block %v, err %v", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// get requests the passed path from the handler and returns the status and
+// body of the reply.
+func get(t *testing.T, h http.Handler, path string) (int, []byte) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.Bytes()
+}
+
+func TestHandler(t *testing.T) {
+	blocks := loadBlocks(t)
+	db, err := btcdb.CreateDB("memory")
+	if err != nil {
+		t.Fatalf("Failed to open test database %v", err)
+	}
+	defer db.Close()
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Fatalf("InsertBlock: %v", err)
+		}
+	}
+	h := btcdbhttp.NewHandler(db)
+	tipHeight := int64(len(blocks) - 1)
+
+	var tip struct {
+		Hash   string
+		Height int64
+	}
+	code, body := get(t, h, "/tip")
+	if err := json.Unmarshal(body, &tip); code != http.StatusOK || err != nil {
+		t.Fatalf("/tip: got status %d (err %v)", code, err)
+	}
+	tipSha, _ := blocks[tipHeight].Sha()
+	if tip.Hash != tipSha.String() || tip.Height != tipHeight {
+		t.Errorf("/tip: got %+v, want %v %d", tip, tipSha, tipHeight)
+	}
+
+	for _, height := range []int64{0, 1, 170, tipHeight} {
+		block := blocks[height]
+		sha, _ := block.Sha()
+		raw, _ := block.Bytes()
+
+		var reply struct {
+			Hash          string
+			Height        int64
+			Confirmations int64
+			Size          int
+			Tx            []string
+		}
+		for _, path := range []string{"/block/" + sha.String(),
+			"/block/height/" + strconv.FormatInt(height, 10)} {
+
+			code, body := get(t, h, path)
+			if err := json.Unmarshal(body, &reply); code != http.StatusOK ||
+				err != nil {
+				t.Errorf("%s: got status %d (err %v)", path, code, err)
+				continue
+			}
+			if reply.Hash != sha.String() || reply.Height != height ||
+				reply.Confirmations != tipHeight-height+1 ||
+				reply.Size != len(raw) ||
+				len(reply.Tx) != len(block.Transactions()) {
+				t.Errorf("%s: unexpected reply %+v", path, reply)
+			}
+		}
+
+		code, body := get(t, h, "/block/"+sha.String()+"?format=hex")
+		got, err := hex.DecodeString(strings.TrimSpace(string(body)))
+		if code != http.StatusOK || err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("/block/%v?format=hex: got status %d (err %v)",
+				sha, code, err)
+		}
+	}
+
+	// The first transaction spending another is in block 170, and spends
+	// the coinbase of block 9.
+	spender := blocks[170].Transactions()[1]
+	type txDoc struct {
+		Txid       string
+		BlockHash  string
+		Height     int64
+		BlockIndex int
+		Vin        []struct {
+			Coinbase string
+			Txid     string
+			Vout     uint32
+		}
+		Vout []struct {
+			Value int64
+			Spent bool
+		}
+	}
+	var tx txDoc
+	code, body = get(t, h, "/tx/"+spender.Sha().String())
+	if err := json.Unmarshal(body, &tx); code != http.StatusOK || err != nil {
+		t.Fatalf("/tx: got status %d (err %v)", code, err)
+	}
+	coinbase := blocks[9].Transactions()[0]
+	if tx.Txid != spender.Sha().String() || tx.Height != 170 ||
+		tx.BlockIndex != 1 || len(tx.Vin) != 1 || tx.Vin[0].Txid != coinbase.Sha().String() ||
+		len(tx.Vout) != 2 {
+		t.Errorf("/tx: unexpected reply %+v", tx)
+	}
+
+	tx = txDoc{}
+	code, body = get(t, h, "/tx/"+coinbase.Sha().String())
+	if err := json.Unmarshal(body, &tx); code != http.StatusOK || err != nil {
+		t.Fatalf("/tx: got status %d (err %v)", code, err)
+	}
+	if tx.Vin[0].Coinbase == "" || tx.Vin[0].Txid != "" || !tx.Vout[0].Spent {
+		t.Errorf("/tx: unexpected reply for coinbase %+v", tx)
+	}
+
+	var buf bytes.Buffer
+	spender.MsgTx().Serialize(&buf)
+	code, body = get(t, h, "/tx/"+spender.Sha().String()+"?format=hex")
+	if code != http.StatusOK ||
+		strings.TrimSpace(string(body)) != hex.EncodeToString(buf.Bytes()) {
+		t.Errorf("/tx?format=hex: got status %d, body %q", code, body)
+	}
+
+	var missing btcwire.ShaHash
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/block/" + missing.String(), http.StatusNotFound},
+		{"/block/height/100000", http.StatusNotFound},
+		{"/tx/" + missing.String(), http.StatusNotFound},
+		{"/block/xyz", http.StatusBadRequest},
+		{"/block/height/-1", http.StatusBadRequest},
+		{"/tip?format=xml", http.StatusBadRequest},
+		{"/blocks", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		code, body := get(t, h, test.path)
+		var reply struct{ Error string }
+		if err := json.Unmarshal(body, &reply); code != test.code ||
+			err != nil || reply.Error == "" {
+			t.Errorf("%s: got status %d (err %v), want %d", test.path,
+				code, err, test.code)
+		}
+	}
+
+	db.Close()
+	if code, _ := get(t, h, "/tip"); code != http.StatusServiceUnavailable {
+		t.Errorf("/tip: got status %d after close, want %d", code,
+			http.StatusServiceUnavailable)
+	}
+}
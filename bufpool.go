@@ -0,0 +1,38 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// blockBufPool holds the buffers handed out by GetBlockBuffer.  New buffers
+// have room for a block of the largest size allowed.
+var blockBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, btcwire.MaxBlockPayload)
+	},
+}
+
+// GetBlockBuffer returns an empty buffer with room for any block from a pool
+// shared by every database, to be passed to FetchBlockBytesBySha.  Scans which
+// read many blocks reuse the same few buffers this way rather than allocating
+// one for every block.
+func GetBlockBuffer() []byte {
+	return blockBufPool.Get().([]byte)[:0]
+}
+
+// PutBlockBuffer returns a buffer to the pool used by GetBlockBuffer.  The
+// caller must no longer use the buffer, any slice of it or anything decoded
+// from it which refers to its memory, such as a btcutil.Block created from the
+// buffer with btcutil.NewBlockFromBytes.  Decoding the buffer into a
+// btcwire.MsgBlock copies everything out of it.
+func PutBlockBuffer(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	blockBufPool.Put(buf[:0])
+}
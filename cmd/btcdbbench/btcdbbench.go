@@ -0,0 +1,554 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+btcdbbench measures how a btcdb driver performs on the workloads of a node, so
+changes to the backends and their settings can be compared on the same work.
+
+It creates a database of the type given with -dbtype at the path given with
+-db, which defaults to a temporary directory removed afterwards, and runs the
+workloads selected with -workloads against it in the following order.
+
+	import   inserts the chain one block at a time as a syncing node does
+	fetch    fetches blocks of the chain picked at random by their hash
+	exists   answers inventory messages mixing known and unknown block and
+	         transaction hashes as peers announcing them do
+	reorg    switches between the newest blocks of the chain and a side
+	         chain of as many blocks in a single reorganization, repeatedly
+
+The chain is read from a stream written by btcdb.Export given with -in, or is
+generated on the regression test network with -blocks blocks of -txs
+transactions each.  The chain is inserted with a single call when import is not
+selected.  A generated chain may be written out with -record, so the same
+chain is replayed later on another driver or machine with -in.  The blocks,
+hashes and reorganizations picked by the other workloads depend only on the
+chain and -seed, so every run with the same flags performs the same
+operations.
+
+For every workload the number of operations, their total time and rate, the
+50th, 90th and 99th percentiles and the largest of their latencies, and the
+number and bytes of the allocations per operation are printed.
+
+Usage:
+
+	btcdbbench [flags] [-dbtype type] [-db path] [-in path]
+*/
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/badgerdb"
+	_ "github.com/conformal/btcdb/boltdb"
+	"github.com/conformal/btcdb/dbtest"
+	_ "github.com/conformal/btcdb/ldb"
+	_ "github.com/conformal/btcdb/memdb"
+	_ "github.com/conformal/btcdb/sqldb"
+	"github.com/conformal/btclog"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+var log btclog.Logger
+
+var (
+	dbType     = flag.String("dbtype", "leveldb", "database type")
+	dbPath     = flag.String("db", "", "database path or connection string (default a temporary directory)")
+	inPath     = flag.String("in", "", "export stream holding the chain (default a generated chain)")
+	recordPath = flag.String("record", "", "file the generated chain is exported to")
+	workloads  = flag.String("workloads", "import,fetch,exists,reorg", "comma separated workloads to run")
+	numBlocks  = flag.Int("blocks", 2000, "number of blocks of the generated chain after the genesis block")
+	numTxs     = flag.Int("txs", 10, "number of transactions of each generated block besides the coinbase")
+	numOps     = flag.Int("ops", 10000, "number of operations of the fetch and exists workloads")
+	invSize    = flag.Int("invsize", 500, "number of hashes of each inventory message")
+	reorgs     = flag.Int("reorgs", 100, "number of reorganizations of the reorg workload")
+	reorgDepth = flag.Int("depth", 6, "number of blocks replaced by each reorganization")
+	blockCache = flag.Int("blockcache", 0, "size in bytes of the block cache of the database")
+	seed       = flag.Int64("seed", 1, "seed of the operations picked at random")
+	logLevel   = flag.String("loglevel", "warn", "logging level")
+)
+
+// durations sorts latencies from the shortest to the longest.
+type durations []time.Duration
+
+func (s durations) Len() int {
+	return len(s)
+}
+
+func (s durations) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s durations) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+// percentile returns the latency below which the passed percentage of the
+// passed sorted latencies are.
+func percentile(sorted durations, pct int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*pct + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+// recorder measures the latency of each operation of a workload along with the
+// allocations made while it runs.  The total time of the workload is the sum
+// of the latencies, so preparing the operations is not counted.
+type recorder struct {
+	name      string
+	latencies durations
+	elapsed   time.Duration
+	mem       runtime.MemStats
+	mallocs   uint64
+	bytes     uint64
+}
+
+// newRecorder returns a recorder for the named workload which starts counting
+// allocations.
+func newRecorder(name string, ops int) *recorder {
+	r := &recorder{name: name, latencies: make(durations, 0, ops)}
+	runtime.GC()
+	runtime.ReadMemStats(&r.mem)
+	return r
+}
+
+// time runs the passed operation and records how long it took.
+func (r *recorder) time(op func() error) error {
+	start := time.Now()
+	err := op()
+	latency := time.Since(start)
+	r.latencies = append(r.latencies, latency)
+	r.elapsed += latency
+	return err
+}
+
+// done stops counting allocations.
+func (r *recorder) done() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	r.mallocs = mem.Mallocs - r.mem.Mallocs
+	r.bytes = mem.TotalAlloc - r.mem.TotalAlloc
+}
+
+// report prints the results of the workload.
+func (r *recorder) report() {
+	ops := len(r.latencies)
+	if ops == 0 {
+		fmt.Printf("%-8s no operations\n", r.name)
+		return
+	}
+	sort.Sort(r.latencies)
+	fmt.Printf("%-8s %8d %10v %10.1f %10v %10v %10v %10v %10d %10d\n",
+		r.name, ops, r.elapsed, float64(ops)/r.elapsed.Seconds(),
+		percentile(r.latencies, 50), percentile(r.latencies, 90),
+		percentile(r.latencies, 99), r.latencies[ops-1],
+		r.mallocs/uint64(ops), r.bytes/uint64(ops))
+}
+
+// printHeader prints the column headings of the reports.
+func printHeader() {
+	fmt.Printf("%-8s %8s %10s %10s %10s %10s %10s %10s %10s %10s\n",
+		"workload", "ops", "total", "ops/s", "p50", "p90", "p99", "max",
+		"allocs/op", "B/op")
+}
+
+// generateChain returns a chain generated as configured.
+func generateChain() []*btcutil.Block {
+	g := dbtest.NewChainGenerator(*numTxs)
+	g.OutputsPerTx = 2
+	return g.NextBlocks(*numBlocks + 1)
+}
+
+// readChain returns the chain held by the export stream at the configured
+// input path, which is read through a database in memory.
+func readChain() ([]*btcutil.Block, error) {
+	f, err := os.Open(*inPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db, err := btcdb.CreateDB("memory")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := btcdb.Import(db, f); err != nil {
+		return nil, err
+	}
+
+	iter, err := db.BlockIterator(0)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var blocks []*btcutil.Block
+	for iter.Next() {
+		blk, err := btcutil.NewBlockFromBytes(iter.RawBytes())
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, blk)
+	}
+	return blocks, iter.Err()
+}
+
+// recordChain exports the chain held by the passed database to the configured
+// record path.
+func recordChain(db btcdb.Db) error {
+	f, err := os.Create(*recordPath)
+	if err != nil {
+		return err
+	}
+	if err := btcdb.Export(db, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImport inserts the passed chain into the passed database one block at a
+// time.
+func runImport(db btcdb.Db, blocks []*btcutil.Block) (*recorder, error) {
+	r := newRecorder("import", len(blocks))
+	for _, blk := range blocks {
+		err := r.time(func() error {
+			_, err := db.InsertBlock(blk)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.done()
+	return r, nil
+}
+
+// runFetch fetches blocks of the passed chain picked at random from the passed
+// database by their hash.
+func runFetch(db btcdb.Db, blocks []*btcutil.Block, rnd *rand.Rand) (*recorder, error) {
+	shas := make([]*btcwire.ShaHash, len(blocks))
+	for i, blk := range blocks {
+		sha, err := blk.Sha()
+		if err != nil {
+			return nil, err
+		}
+		shas[i] = sha
+	}
+
+	r := newRecorder("fetch", *numOps)
+	for i := 0; i < *numOps; i++ {
+		sha := shas[rnd.Intn(len(shas))]
+		err := r.time(func() error {
+			_, err := db.FetchBlockBySha(sha)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.done()
+	return r, nil
+}
+
+// unknownShas returns the passed number of hashes picked at random, which no
+// block or transaction has.
+func unknownShas(rnd *rand.Rand, n int) []btcwire.ShaHash {
+	shas := make([]btcwire.ShaHash, n)
+	var buf [8]byte
+	for i := range shas {
+		for j := range buf {
+			buf[j] = byte(rnd.Intn(256))
+		}
+		shas[i].SetBytes(btcwire.DoubleSha256(buf[:]))
+	}
+	return shas
+}
+
+// runExists answers inventory messages of the configured size from the passed
+// database.  Each entry of a message is a block or transaction hash with the
+// same chance, which half of the time the chain has.
+func runExists(db btcdb.Db, blocks []*btcutil.Block, rnd *rand.Rand) (*recorder, error) {
+	var blockShas, txShas []btcwire.ShaHash
+	for _, blk := range blocks {
+		sha, err := blk.Sha()
+		if err != nil {
+			return nil, err
+		}
+		blockShas = append(blockShas, *sha)
+		for _, tx := range blk.Transactions() {
+			txShas = append(txShas, *tx.Sha())
+		}
+	}
+
+	// The unknown hashes are made up front and the messages reuse their
+	// slices, so picking the hashes allocates nothing.
+	unknown := unknownShas(rnd, 4096)
+	invBlocks := make([]btcwire.ShaHash, 0, *invSize)
+	invTxs := make([]btcwire.ShaHash, 0, *invSize)
+
+	r := newRecorder("exists", *numOps)
+	for i := 0; i < *numOps; i++ {
+		invBlocks, invTxs = invBlocks[:0], invTxs[:0]
+		for j := 0; j < *invSize; j++ {
+			known := rnd.Intn(2) == 0
+			sha := unknown[rnd.Intn(len(unknown))]
+			if rnd.Intn(2) == 0 {
+				if known {
+					sha = blockShas[rnd.Intn(len(blockShas))]
+				}
+				invBlocks = append(invBlocks, sha)
+				continue
+			}
+			if known {
+				sha = txShas[rnd.Intn(len(txShas))]
+			}
+			invTxs = append(invTxs, sha)
+		}
+		r.time(func() error {
+			db.ExistsShas(invBlocks)
+			db.ExistsTxShas(invTxs)
+			return nil
+		})
+	}
+	r.done()
+	return r, nil
+}
+
+// sideChain returns the passed number of blocks following the passed block at
+// the passed height, which hold nothing but a coinbase so they build on any
+// chain.  They are only inserted into databases which do not validate them, so
+// they are not solved.
+func sideChain(fork *btcutil.Block, height int64, n int) ([]*btcutil.Block, error) {
+	prev := fork
+	blocks := make([]*btcutil.Block, 0, n)
+	for i := 0; i < n; i++ {
+		height++
+		var script [6]byte
+		script[0] = 5
+		binary.LittleEndian.PutUint32(script[1:5], uint32(height))
+		script[5] = 0xff
+		coinbase := btcwire.NewMsgTx()
+		coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(
+			&btcwire.ShaHash{}, math.MaxUint32), script[:]))
+		coinbase.AddTxOut(btcwire.NewTxOut(btcdb.CalcBlockSubsidy(height,
+			210000), []byte{0x51}))
+
+		prevSha, err := prev.Sha()
+		if err != nil {
+			return nil, err
+		}
+		root, err := coinbase.TxSha()
+		if err != nil {
+			return nil, err
+		}
+		prevHeader := &prev.MsgBlock().Header
+		header := btcwire.NewBlockHeader(prevSha, &root, prevHeader.Bits, 0)
+		header.Timestamp = prevHeader.Timestamp.Add(10 * time.Minute)
+		msgBlock := btcwire.NewMsgBlock(header)
+		msgBlock.AddTransaction(coinbase)
+
+		prev = btcutil.NewBlock(msgBlock)
+		blocks = append(blocks, prev)
+	}
+	return blocks, nil
+}
+
+// runReorg switches the passed database between the configured number of the
+// newest blocks of the passed chain and a side chain of as many blocks with a
+// single reorganization each time, as many times as configured.
+func runReorg(db btcdb.Db, blocks []*btcutil.Block) (*recorder, error) {
+	depth := *reorgDepth
+	if depth >= len(blocks) {
+		depth = len(blocks) - 1
+	}
+	forkHeight := len(blocks) - depth - 1
+	fork := blocks[forkHeight]
+	forkSha, err := fork.Sha()
+	if err != nil {
+		return nil, err
+	}
+	main := blocks[forkHeight+1:]
+	side, err := sideChain(fork, int64(forkHeight), depth)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRecorder("reorg", *reorgs)
+	for i := 0; i < *reorgs; i++ {
+		branch := side
+		if i%2 != 0 {
+			branch = main
+		}
+		err := r.time(func() error {
+			_, err := db.ReorganizeWithMeta(forkSha, branch, nil)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.done()
+	return r, nil
+}
+
+// selectedWorkloads returns the set of workloads selected with -workloads.
+func selectedWorkloads() (map[string]bool, error) {
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(*workloads, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "import", "fetch", "exists", "reorg":
+			selected[name] = true
+		default:
+			return nil, fmt.Errorf("unknown workload %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// openDB creates the database the workloads run against and returns it along
+// with a function removing the temporary directory it was created in, if any.
+func openDB() (btcdb.Db, func(), error) {
+	cleanup := func() {}
+	path := *dbPath
+	if path == "" && *dbType != "memory" && *dbType != "memdb" {
+		dir, err := ioutil.TempDir("", "btcdbbench")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+		path = dir + "/db"
+	}
+
+	opts := btcdb.Options{Path: path, BlockCacheSize: *blockCache}
+	db, err := btcdb.CreateDBWithOptions(*dbType, opts)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	_, height, err := db.NewestSha()
+	if err == nil && height != -1 {
+		err = fmt.Errorf("database at %v is not empty", path)
+	}
+	if err != nil {
+		db.Close()
+		cleanup()
+		return nil, nil, err
+	}
+	return db, cleanup, nil
+}
+
+func realMain() error {
+	flag.Parse()
+	backendLog, err := btclog.NewLoggerFromWriter(os.Stdout, btclog.InfoLvl)
+	if err != nil {
+		return err
+	}
+	log = backendLog
+	if err := btcdb.SetLogWriter(os.Stdout, *logLevel); err != nil {
+		return err
+	}
+	selected, err := selectedWorkloads()
+	if err != nil {
+		return err
+	}
+	if *inPath != "" && *recordPath != "" {
+		return fmt.Errorf("only a generated chain may be recorded")
+	}
+
+	var blocks []*btcutil.Block
+	if *inPath != "" {
+		log.Infof("Reading chain from %v", *inPath)
+		blocks, err = readChain()
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Infof("Generating chain of %d blocks", *numBlocks)
+		blocks = generateChain()
+	}
+	if len(blocks) < 2 {
+		return fmt.Errorf("chain has %d blocks, at least 2 are needed",
+			len(blocks))
+	}
+
+	db, cleanup, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	defer db.Close()
+
+	rnd := rand.New(rand.NewSource(*seed))
+	var results []*recorder
+	if selected["import"] {
+		r, err := runImport(db, blocks)
+		if err != nil {
+			return err
+		}
+		results = append(results, r)
+	} else if _, err := db.InsertBlocks(blocks); err != nil {
+		return err
+	}
+	if *recordPath != "" {
+		log.Infof("Recording chain to %v", *recordPath)
+		if err := recordChain(db); err != nil {
+			return err
+		}
+	}
+	if selected["fetch"] {
+		r, err := runFetch(db, blocks, rnd)
+		if err != nil {
+			return err
+		}
+		results = append(results, r)
+	}
+	if selected["exists"] {
+		r, err := runExists(db, blocks, rnd)
+		if err != nil {
+			return err
+		}
+		results = append(results, r)
+	}
+	if selected["reorg"] {
+		r, err := runReorg(db, blocks)
+		if err != nil {
+			return err
+		}
+		results = append(results, r)
+	}
+
+	fmt.Printf("%s database, %d blocks\n", *dbType, len(blocks))
+	printHeader()
+	for _, r := range results {
+		r.report()
+	}
+	return nil
+}
+
+func main() {
+	if err := realMain(); err != nil {
+		fmt.Fprintf(os.Stderr, "btcdbbench: %v\n", err)
+		os.Exit(1)
+	}
+}
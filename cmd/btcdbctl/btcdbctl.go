@@ -0,0 +1,607 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+btcdbctl inspects and maintains a btcdb database.
+
+Usage:
+
+	btcdbctl [-dbtype type] -db path command [args]
+
+The commands are:
+
+	tip                   show the most recent block of the chain
+	dbstats               show statistics about the stored data
+	dumpblock [-raw] id   show a block, given by hash or height, and its
+	                      transactions
+	dumptx [-raw] txid    show every stored transaction with the hash
+	txstats               count the transaction bytes which are stored more
+	                      than once
+	verify [level]        check every block at a level of
+	                      btcdb.VerifyIntegrity, btcdb.VerifyBlocks by
+	                      default
+	compact               reclaim the space of dropped data
+	invalidateblock id    mark a block, given by hash or height, and the
+	                      blocks after it as invalid, which removes them
+	                      from the chain
+	reconsiderblock sha   remove the invalid mark from a block and connect
+	                      it to the chain again
+	chaintips             show the newest block of the chain and of every
+	                      side chain and invalid branch
+	setmainchain sha      make the branch ending at a block the chain
+	serve address         serve the database to clients of the remote
+	                      driver at an address such as tcp://:8341 until
+	                      interrupted
+
+Every command but compact, serve, invalidateblock, reconsiderblock and
+setmainchain opens the database read-only, so it may be used while another process has the database
+open where the driver allows it.
+Compaction is only available for drivers with a Compact function.
+
+Databases served by another process are inspected through the remote driver:
+
+	btcdbctl -dbtype remote -db tcp://host:8341 tip
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/badgerdb"
+	_ "github.com/conformal/btcdb/boltdb"
+	_ "github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcdb/remote"
+	_ "github.com/conformal/btcdb/sqldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	dbType = flag.String("dbtype", "leveldb", "database type")
+	dbPath = flag.String("db", "", "database path or connection string")
+	force  = flag.Bool("force", false, "open a database without its "+
+		"lock when it is held by another process")
+)
+
+// compacter is implemented by the drivers which can reclaim the space of
+// dropped data.
+type compacter interface {
+	Compact() error
+}
+
+// statser is implemented by the drivers which keep statistics of their own.
+type statser interface {
+	Stats() (string, error)
+}
+
+// command describes a subcommand along with the function which runs it.
+type command struct {
+	readOnly bool
+	run      func(db btcdb.Db, args []string) error
+}
+
+var commands = map[string]command{
+	"tip":       {true, tipCmd},
+	"dbstats":   {true, dbStatsCmd},
+	"dumpblock": {true, dumpBlockCmd},
+	"dumptx":    {true, dumpTxCmd},
+	"txstats":   {true, txStatsCmd},
+	"verify":    {true, verifyCmd},
+	"compact":   {false, compactCmd},
+	"serve":     {false, serveCmd},
+
+	"invalidateblock": {false, invalidateBlockCmd},
+	"reconsiderblock": {false, reconsiderBlockCmd},
+	"chaintips":       {true, chainTipsCmd},
+	"setmainchain":    {false, setMainChainCmd},
+}
+
+// tipCmd shows the most recent block of the chain.
+func tipCmd(db btcdb.Db, args []string) error {
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if height < 0 {
+		fmt.Println("The database has no blocks")
+		return nil
+	}
+	bh, err := db.FetchBlockHeaderBySha(sha)
+	if err != nil {
+		return err
+	}
+	work, err := db.FetchChainWorkBySha(sha)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Hash:       %v\n", sha)
+	fmt.Printf("Height:     %d\n", height)
+	fmt.Printf("Time:       %v\n", bh.Timestamp.UTC())
+	fmt.Printf("Chain work: %064x\n", work)
+	return nil
+}
+
+// dbStatsCmd shows statistics about the data stored in the database.
+func dbStatsCmd(db btcdb.Db, args []string) error {
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Type:        %v\n", *dbType)
+	fmt.Printf("Tip:         %v\n", sha)
+	fmt.Printf("Blocks:      %d\n", height+1)
+
+	if utxos, err := db.UtxoSetSize(); err == nil {
+		fmt.Printf("UTXO set:    %d outputs\n", utxos)
+	} else {
+		fmt.Printf("UTXO set:    %v\n", err)
+	}
+
+	iter, err := db.MetaIterator(nil)
+	if err != nil {
+		return err
+	}
+	var metaKeys int
+	for iter.Next() {
+		metaKeys++
+	}
+	err = iter.Err()
+	iter.Release()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Meta keys:   %d\n", metaKeys)
+
+	// The size is only known for databases stored locally.
+	var size int64
+	err = filepath.Walk(*dbPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	if err == nil {
+		fmt.Printf("Disk size:   %d bytes\n", size)
+	}
+
+	if s, ok := db.(statser); ok {
+		stats, err := s.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n%s\n", stats)
+	}
+	return nil
+}
+
+// lookupBlock returns the hash of the block given as a hash or a height.
+func lookupBlock(db btcdb.Db, arg string) (*btcwire.ShaHash, error) {
+	if len(arg) < btcwire.MaxHashStringSize {
+		height, err := strconv.ParseInt(arg, 10, 64)
+		if err == nil {
+			return db.FetchBlockShaByHeight(height)
+		}
+	}
+	return btcwire.NewShaHashFromStr(arg)
+}
+
+// dumpBlockCmd shows the header and transactions of a block.
+func dumpBlockCmd(db btcdb.Db, args []string) error {
+	fs := flag.NewFlagSet("dumpblock", flag.ExitOnError)
+	raw := fs.Bool("raw", false, "show the serialized block in hex")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: dumpblock [-raw] sha|height")
+	}
+
+	sha, err := lookupBlock(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	height, err := db.FetchBlockHeightBySha(sha)
+	if err != nil {
+		return err
+	}
+	bh, err := db.FetchBlockHeaderBySha(sha)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Hash:        %v\n", sha)
+	fmt.Printf("Height:      %d\n", height)
+	fmt.Printf("Version:     %d\n", bh.Version)
+	fmt.Printf("Previous:    %v\n", &bh.PrevBlock)
+	fmt.Printf("Merkle root: %v\n", &bh.MerkleRoot)
+	fmt.Printf("Time:        %v\n", bh.Timestamp.UTC())
+	fmt.Printf("Bits:        %08x\n", bh.Bits)
+	fmt.Printf("Nonce:       %d\n", bh.Nonce)
+
+	blk, err := db.FetchBlockBySha(sha)
+	if err == btcdb.ErrHeadersOnly || err == btcdb.ErrPruned {
+		fmt.Printf("Body:        %v\n", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	buf, err := blk.Bytes()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Size:        %d bytes\n", len(buf))
+	fmt.Printf("Txs:         %d\n", len(blk.Transactions()))
+	for i, tx := range blk.Transactions() {
+		fmt.Printf("  %4d %v\n", i, tx.Sha())
+	}
+	if *raw {
+		fmt.Printf("\n%s\n", hex.EncodeToString(buf))
+	}
+	return nil
+}
+
+// dumpTxCmd shows every stored transaction with the given hash along with the
+// block which holds it and whether each of its outputs is spent.
+func dumpTxCmd(db btcdb.Db, args []string) error {
+	fs := flag.NewFlagSet("dumptx", flag.ExitOnError)
+	raw := fs.Bool("raw", false, "show the serialized transaction in hex")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: dumptx [-raw] txid")
+	}
+
+	txSha, err := btcwire.NewShaHashFromStr(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	replies, err := db.FetchTxBySha(txSha)
+	if err != nil {
+		return err
+	}
+	for i, reply := range replies {
+		if i != 0 {
+			fmt.Println()
+		}
+		tx := reply.Tx
+		fmt.Printf("Hash:      %v\n", reply.Sha)
+		fmt.Printf("Block:     %v\n", reply.BlkSha)
+		fmt.Printf("Height:    %d\n", reply.Height)
+		fmt.Printf("Version:   %d\n", tx.Version)
+		fmt.Printf("Lock time: %d\n", tx.LockTime)
+		for j, txIn := range tx.TxIn {
+			fmt.Printf("  in  %4d %v:%d\n", j,
+				&txIn.PreviousOutpoint.Hash,
+				txIn.PreviousOutpoint.Index)
+		}
+		for j, txOut := range tx.TxOut {
+			spent := ""
+			if j < len(reply.TxSpent) && reply.TxSpent[j] {
+				spent = " (spent)"
+			}
+			fmt.Printf("  out %4d %d%s %x\n", j, txOut.Value,
+				spent, txOut.PkScript)
+		}
+		if *raw {
+			var buf bytes.Buffer
+			if err := tx.Serialize(&buf); err != nil {
+				return err
+			}
+			fmt.Printf("\n%s\n", hex.EncodeToString(buf.Bytes()))
+		}
+	}
+	return nil
+}
+
+// txStatsCmd counts the transactions whose bytes are stored more than once.
+// Transactions of the blocks of the chain which repeat a transaction of an
+// earlier block, such as the duplicate coinbases BIP30 allowed, are copies, as
+// are the transactions kept for side and invalid blocks under
+// btcdb.KeptTxPrefix which are also in the chain.  Those blocks only hold the
+// hashes of their transactions, which are stored once however many of them
+// share one, except for the blocks kept before transactions were stored apart
+// whose transactions are all counted as copies.  The transaction index only
+// records where transactions are stored and holds no copies.
+func txStatsCmd(db btcdb.Db, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: txstats")
+	}
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+
+	const batch = 500
+	var txs, txBytes, dups, dupBytes, pruned int64
+	last := time.Now()
+	for height := int64(0); height <= newest; height += batch {
+		shas, err := db.FetchHeightRange(height, height+batch)
+		if err != nil {
+			return err
+		}
+		for i := range shas {
+			blk, err := db.FetchBlockBySha(&shas[i])
+			if err == btcdb.ErrHeadersOnly || err == btcdb.ErrPruned {
+				pruned++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, tx := range blk.Transactions() {
+				size := int64(tx.MsgTx().SerializeSize())
+				txs++
+				txBytes += size
+
+				replies, err := db.FetchTxBySha(tx.Sha())
+				if err != nil {
+					return err
+				}
+				for _, reply := range replies {
+					if reply.Height < height+int64(i) {
+						dups++
+						dupBytes += size
+						break
+					}
+				}
+			}
+		}
+		if now := time.Now(); now.Sub(last) >= 10*time.Second {
+			fmt.Printf("Measured %d of %d blocks\n", height+batch,
+				newest+1)
+			last = now
+		}
+	}
+
+	// Kept transactions are copies when the chain holds them too.
+	var kept, keptBytes, keptDups, keptDupBytes int64
+	iter, err := db.MetaIterator(btcdb.KeptTxPrefix)
+	if err != nil {
+		return err
+	}
+	for iter.Next() {
+		var sha btcwire.ShaHash
+		sha.SetBytes(iter.Key()[len(btcdb.KeptTxPrefix):])
+		size := int64(len(iter.Value()) - 4)
+		kept++
+		keptBytes += size
+		if db.ExistsTxSha(&sha) {
+			keptDups++
+			keptDupBytes += size
+		}
+	}
+	iter.Release()
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	// Blocks kept before their transactions were stored apart have the
+	// top bit of their height clear and hold the serialized block.
+	var legacy, legacyTxs, legacyBytes int64
+	prefixes := [][]byte{btcdb.SideBlockPrefix, btcdb.InvalidBlockPrefix}
+	for _, prefix := range prefixes {
+		iter, err := db.MetaIterator(prefix)
+		if err != nil {
+			return err
+		}
+		for iter.Next() {
+			val := iter.Value()
+			if len(val) < 8 || binary.LittleEndian.Uint64(val)>>63 != 0 {
+				continue
+			}
+			blk, err := btcutil.NewBlockFromBytes(val[8:])
+			if err != nil {
+				iter.Release()
+				return err
+			}
+			legacy++
+			for _, tx := range blk.MsgBlock().Transactions {
+				legacyTxs++
+				legacyBytes += int64(tx.SerializeSize())
+			}
+		}
+		iter.Release()
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Blocks:              %d\n", newest+1)
+	if pruned != 0 {
+		fmt.Printf("Without bodies:      %d\n", pruned)
+	}
+	fmt.Printf("Txs:                 %d\n", txs)
+	fmt.Printf("Tx bytes:            %d\n", txBytes)
+	fmt.Printf("Repeated txs:        %d\n", dups)
+	fmt.Printf("Repeated bytes:      %d\n", dupBytes)
+	fmt.Printf("Kept txs:            %d\n", kept)
+	fmt.Printf("Kept bytes:          %d\n", keptBytes)
+	fmt.Printf("Kept txs in chain:   %d\n", keptDups)
+	fmt.Printf("Kept bytes in chain: %d\n", keptDupBytes)
+	if legacy != 0 {
+		fmt.Printf("Legacy kept blocks:  %d\n", legacy)
+		fmt.Printf("Legacy kept txs:     %d\n", legacyTxs)
+		fmt.Printf("Legacy kept bytes:   %d\n", legacyBytes)
+	}
+	fmt.Printf("Copies:              %d\n", dups+keptDups+legacyTxs)
+	fmt.Printf("Copy bytes:          %d\n",
+		dupBytes+keptDupBytes+legacyBytes)
+	return nil
+}
+
+// verifyCmd checks every block of the chain at the given level.
+func verifyCmd(db btcdb.Db, args []string) error {
+	level := btcdb.VerifyBlocks
+	if len(args) > 1 {
+		return fmt.Errorf("usage: verify [level]")
+	}
+	if len(args) == 1 {
+		var err error
+		level, err = strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	last := start
+	err = db.VerifyIntegrity(level, func(height int64) {
+		if now := time.Now(); now.Sub(last) >= 10*time.Second {
+			fmt.Printf("Verified %d of %d blocks\n", height+1,
+				newest+1)
+			last = now
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified %d blocks in %v\n", newest+1,
+		time.Since(start))
+	return nil
+}
+
+// compactCmd reclaims the space of the data dropped from the database.
+func compactCmd(db btcdb.Db, args []string) error {
+	c, ok := db.(compacter)
+	if !ok {
+		return fmt.Errorf("%v databases can not be compacted", *dbType)
+	}
+	start := time.Now()
+	if err := c.Compact(); err != nil {
+		return err
+	}
+	fmt.Printf("Compacted in %v\n", time.Since(start))
+	return nil
+}
+
+// invalidateBlockCmd marks a block and the blocks after it as invalid.
+func invalidateBlockCmd(db btcdb.Db, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: invalidateblock sha|height")
+	}
+	sha, err := lookupBlock(db, args[0])
+	if err != nil {
+		return err
+	}
+	if err := btcdb.InvalidateBlock(db, sha); err != nil {
+		return err
+	}
+	return tipCmd(db, nil)
+}
+
+// reconsiderBlockCmd removes the invalid mark from a block.
+func reconsiderBlockCmd(db btcdb.Db, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: reconsiderblock sha")
+	}
+	sha, err := btcwire.NewShaHashFromStr(args[0])
+	if err != nil {
+		return err
+	}
+	if err := btcdb.ReconsiderBlock(db, sha); err != nil {
+		return err
+	}
+	return tipCmd(db, nil)
+}
+
+// chainTipsCmd shows the newest block of the chain and of every branch off it.
+func chainTipsCmd(db btcdb.Db, args []string) error {
+	tips, err := btcdb.FetchChainTips(db)
+	if err != nil {
+		return err
+	}
+	for _, tip := range tips {
+		fmt.Printf("%v  height %-8d branch %-6d %v\n", &tip.Sha,
+			tip.Height, tip.BranchLen, tip.Status)
+	}
+	return nil
+}
+
+// setMainChainCmd makes the branch ending at a block the chain.
+func setMainChainCmd(db btcdb.Db, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: setmainchain sha")
+	}
+	sha, err := btcwire.NewShaHashFromStr(args[0])
+	if err != nil {
+		return err
+	}
+	if err := btcdb.SetMainChain(db, sha); err != nil {
+		return err
+	}
+	return tipCmd(db, nil)
+}
+
+// serveCmd serves the database to clients of the remote driver until the
+// process is interrupted.
+func serveCmd(db btcdb.Db, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: serve address")
+	}
+	parts := strings.SplitN(args[0], "://", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid address %q -- expected tcp://host:port "+
+			"or unix://path", args[0])
+	}
+	l, err := net.Listen(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+
+	s := remote.NewServer(db)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		s.Close()
+	}()
+
+	fmt.Printf("Serving on %v\n", l.Addr())
+	if err := s.Serve(l); err != remote.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func realMain() error {
+	flag.Parse()
+	if *dbPath == "" || flag.NArg() == 0 {
+		return fmt.Errorf("usage: btcdbctl [-dbtype type] [-force] " +
+			"-db path command [args]")
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+
+	opts := btcdb.Options{Path: *dbPath, ReadOnly: cmd.readOnly,
+		ForceOpen: *force}
+	db, err := btcdb.OpenDBWithOptions(*dbType, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return cmd.run(db, flag.Args()[1:])
+}
+
+func main() {
+	if err := realMain(); err != nil {
+		fmt.Fprintf(os.Stderr, "btcdbctl: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+btcdbload bulk loads blocks into a btcdb database from local files.
+
+It reads one of the following inputs, given with -in, and inserts its blocks
+into the database of the type given with -dbtype at the path given with -db.
+The database is created with the genesis block of the network when it does
+not exist.
+
+	export      a stream written by btcdb.Export
+	bootstrap   a bootstrap.dat file or concatenated blk*.dat files
+	blocksdir   the blocks directory of the reference client
+
+The input defaults to standard input for the stream formats.  The blocks the
+database already has are checked against the input and skipped, so an
+interrupted load is resumed by running the same command again.  The height,
+the blocks inserted per second and the bytes read per second are printed at the
+interval given with -progress.
+
+The blocks are stored as they are read unless -validate selects the checks of
+btcdb.Options performed on each of them, which are sanity, checking that each
+block links to the one before it, meets its target difficulty and matches the
+merkle root of its header, or strict, which also checks the rules of the block
+chain that do not depend on the outputs spent by a block.
+
+Usage:
+
+	btcdbload [flags] -db path -format export|bootstrap|blocksdir [-in path]
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/badgerdb"
+	_ "github.com/conformal/btcdb/boltdb"
+	_ "github.com/conformal/btcdb/ldb"
+	_ "github.com/conformal/btcdb/sqldb"
+	"github.com/conformal/btclog"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var log btclog.Logger
+
+var (
+	dbType   = flag.String("dbtype", "leveldb", "database type")
+	dbPath   = flag.String("db", "", "database path or connection string")
+	format   = flag.String("format", "bootstrap", "input format: export, bootstrap or blocksdir")
+	inPath   = flag.String("in", "", "input file or blocks directory (default standard input)")
+	testnet  = flag.Bool("testnet", false, "read blocks of the test network")
+	regtest  = flag.Bool("regtest", false, "read blocks of the regression test network")
+	progress = flag.Duration("progress", 10*time.Second, "interval between progress reports")
+	logLevel = flag.String("loglevel", "info", "logging level")
+	validate = flag.String("validate", "none", "checks performed on each block: none, sanity or strict")
+)
+
+// countingReader counts the bytes read through it so the throughput can be
+// reported while another goroutine reads.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader and adds the bytes read to the count.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes read so far.
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// openDB opens the database at the configured path, creating it with the
+// genesis block of the network when it can not be opened.  Databases of
+// another network are refused.
+func openDB() (btcdb.Db, error) {
+	net, genesis := network()
+	mode, err := validation()
+	if err != nil {
+		return nil, err
+	}
+	opts := btcdb.Options{Path: *dbPath, Sync: btcdb.SyncPeriodic, Net: net,
+		Validation: mode}
+	db, err := btcdb.OpenDBWithOptions(*dbType, opts)
+	if err == nil {
+		return db, nil
+	}
+	if _, ok := err.(*btcdb.IdentityError); ok {
+		return nil, err
+	}
+	log.Infof("Creating database at %v: %v", *dbPath, err)
+	db, err = btcdb.CreateDBWithOptions(*dbType, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.InsertBlock(btcutil.NewBlock(genesis)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// validation returns the validation mode selected with -validate.
+func validation() (btcdb.ValidationMode, error) {
+	switch *validate {
+	case "none":
+		return btcdb.ValidateNone, nil
+	case "sanity":
+		return btcdb.ValidateSanity, nil
+	case "strict":
+		return btcdb.ValidateStrict, nil
+	}
+	return 0, fmt.Errorf("unknown validation mode %q", *validate)
+}
+
+// network returns the network whose blocks are read along with its genesis
+// block.
+func network() (btcwire.BitcoinNet, *btcwire.MsgBlock) {
+	switch {
+	case *testnet:
+		return btcwire.TestNet3, &btcwire.TestNet3GenesisBlock
+	case *regtest:
+		return btcwire.TestNet, &btcwire.TestNetGenesisBlock
+	}
+	return btcwire.MainNet, &btcwire.GenesisBlock
+}
+
+// reportProgress logs the height of the database along with the rate blocks
+// are inserted and input is read at the configured interval until quit is
+// closed.
+func reportProgress(db btcdb.Db, in *countingReader, quit chan struct{}) {
+	ticker := time.NewTicker(*progress)
+	defer ticker.Stop()
+
+	_, lastHeight, _ := db.NewestSha()
+	var lastRead int64
+	lastTime := time.Now()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			_, height, err := db.NewestSha()
+			if err != nil {
+				log.Warnf("Unable to read height: %v", err)
+				continue
+			}
+			read := in.count()
+			secs := now.Sub(lastTime).Seconds()
+			rate := float64(height-lastHeight) / secs
+			if *format == "blocksdir" {
+				log.Infof("Height %d, %.1f blocks/s", height,
+					rate)
+			} else {
+				log.Infof("Height %d, %.1f blocks/s, %.2f MB/s",
+					height, rate, float64(read-lastRead)/secs/1e6)
+			}
+			lastHeight, lastRead, lastTime = height, read, now
+		}
+	}
+}
+
+// load reads the configured input into the passed database and returns the
+// number of blocks inserted.
+func load(db btcdb.Db, in *countingReader) (int64, error) {
+	switch *format {
+	case "export":
+		_, before, err := db.NewestSha()
+		if err != nil {
+			return 0, err
+		}
+		if err := btcdb.Import(db, in); err != nil {
+			return 0, err
+		}
+		_, after, err := db.NewestSha()
+		return after - before, err
+
+	case "bootstrap":
+		net, _ := network()
+		return btcdb.ImportBootstrap(db, in, net)
+
+	case "blocksdir":
+		net, _ := network()
+		return btcdb.ImportBlockFiles(db, *inPath, net)
+	}
+	return 0, fmt.Errorf("unknown input format %q", *format)
+}
+
+func realMain() error {
+	flag.Parse()
+	backendLog, err := btclog.NewLoggerFromWriter(os.Stdout, btclog.InfoLvl)
+	if err != nil {
+		return err
+	}
+	log = backendLog
+	if err := btcdb.SetLogWriter(os.Stdout, *logLevel); err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		return fmt.Errorf("no database path given")
+	}
+	if *format == "blocksdir" && *inPath == "" {
+		return fmt.Errorf("no blocks directory given")
+	}
+
+	in := &countingReader{r: os.Stdin}
+	if *inPath != "" && *format != "blocksdir" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in.r = f
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if height > 0 {
+		log.Infof("Resuming after block %v at height %d", sha, height)
+	}
+
+	quit := make(chan struct{})
+	go reportProgress(db, in, quit)
+	start := time.Now()
+	n, err := load(db, in)
+	close(quit)
+	if err != nil {
+		return err
+	}
+
+	secs := time.Since(start).Seconds()
+	_, height, err = db.NewestSha()
+	if err != nil {
+		return err
+	}
+	log.Infof("Inserted %d blocks in %.1fs (%.1f blocks/s), height is now "+
+		"%d", n, secs, float64(n)/secs, height)
+	return nil
+}
+
+func main() {
+	if err := realMain(); err != nil {
+		fmt.Fprintf(os.Stderr, "btcdbload: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// CoinbaseIndexPrefix is the prefix of the keys of the metadata namespace under
+// which a CoinbaseIndex keeps its state.
+var CoinbaseIndexPrefix = []byte("btcdb/coinbase/")
+
+var (
+	// coinbaseIndexTipKey is the key of the hash and height of the newest
+	// block indexed by the coinbase index.
+	coinbaseIndexTipKey = []byte("btcdb/coinbase/tip")
+
+	// coinbaseHeightPrefix is the prefix of the keys of the coinbase
+	// transactions of each block, which are followed by the height of the
+	// block as a big endian number.  Each maps to the serialized coinbase.
+	coinbaseHeightPrefix = []byte("btcdb/coinbase/height/")
+)
+
+// coinbaseHeightKey returns the key of the coinbase of the block at the passed
+// height.
+func coinbaseHeightKey(height int64) []byte {
+	key := make([]byte, len(coinbaseHeightPrefix)+8)
+	copy(key, coinbaseHeightPrefix)
+	binary.BigEndian.PutUint64(key[len(coinbaseHeightPrefix):],
+		uint64(height))
+	return key
+}
+
+// CoinbaseIndex is an optional indexer which keeps the coinbase transaction of
+// every block of the chain, so tools which only look at coinbases, such as
+// those attributing blocks to mining pools by their coinbase script or auditing
+// the subsidy claimed by each block, read them with FetchCoinbaseByHeight
+// rather than fetching whole blocks.  A coinbase is usually a few hundred bytes,
+// so the index is a small fraction of the size of the chain.
+type CoinbaseIndex struct {
+	mtx sync.Mutex
+	db  Db
+}
+
+// Ensure CoinbaseIndex implements the Indexer interface.
+var _ Indexer = (*CoinbaseIndex)(nil)
+
+// NewCoinbaseIndex returns a coinbase index which starts indexing once it is
+// added to a database with AddIndexer.
+func NewCoinbaseIndex() *CoinbaseIndex {
+	return new(CoinbaseIndex)
+}
+
+// Init prepares the index for the passed database.  The index is rebuilt from
+// the genesis block when its tip is no longer in the chain.  This is part of
+// the Indexer interface implementation.
+func (idx *CoinbaseIndex) Init(db Db) error {
+	_, err := initIndexerState(db, "Coinbase index", CoinbaseIndexPrefix,
+		coinbaseIndexTipKey)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *CoinbaseIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, coinbaseIndexTipKey)
+}
+
+// ConnectBlock adds the coinbase of the passed block.  This is part of the
+// Indexer interface implementation.
+func (idx *CoinbaseIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	txs := block.MsgBlock().Transactions
+	if len(txs) == 0 {
+		return fmt.Errorf("block %v at height %d has no coinbase", sha,
+			height)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(txs[0].SerializeSize())
+	if err := txs[0].Serialize(&buf); err != nil {
+		return err
+	}
+	meta.Put(coinbaseHeightKey(height), buf.Bytes())
+	putTipRecord(meta, coinbaseIndexTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the coinbase of the passed block.  This is part of the
+// Indexer interface implementation.
+func (idx *CoinbaseIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	meta.Delete(coinbaseHeightKey(height))
+	putTipRecord(meta, coinbaseIndexTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// FetchCoinbaseByHeight returns the coinbase transaction of the block at the
+// passed height of the chain of the passed database, using the CoinbaseIndex
+// of the database.  ErrBlockNotFound is returned when the chain has no block
+// at the height and ErrNoCoinbaseIndex when the database has no coinbase
+// index.
+func FetchCoinbaseByHeight(db Db, height int64) (*btcwire.MsgTx, error) {
+	tipSha, tipHeight, err := fetchTipRecord(db, coinbaseIndexTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoCoinbaseIndex
+	}
+	if height < 0 || height > tipHeight {
+		return nil, ErrBlockNotFound
+	}
+
+	val, err := db.GetMeta(coinbaseHeightKey(height))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, fmt.Errorf("coinbase for height %d is missing",
+			height)
+	}
+	var tx btcwire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(val)); err != nil {
+		return nil, fmt.Errorf("malformed coinbase for height %d: %v",
+			height, err)
+	}
+	return &tx, nil
+}
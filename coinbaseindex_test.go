@@ -0,0 +1,98 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"testing"
+)
+
+// TestCoinbaseIndex ensures the coinbase index returns the coinbase of the
+// blocks of the chain by height for every supported database type as blocks
+// are inserted and dropped.
+func TestCoinbaseIndex(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:20]
+
+	// checkCoinbases ensures the coinbases of the blocks up to the passed
+	// height are found and none above it.
+	checkCoinbases := func(dbType string, db btcdb.Db, tipHeight int64) {
+		for height := int64(0); height < int64(len(blocks)); height++ {
+			tx, err := btcdb.FetchCoinbaseByHeight(db, height)
+			if height > tipHeight {
+				if err != btcdb.ErrBlockNotFound {
+					t.Errorf("FetchCoinbaseByHeight (%s): got "+
+						"%v for height %d above the tip, "+
+						"want %v", dbType, err, height,
+						btcdb.ErrBlockNotFound)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("FetchCoinbaseByHeight (%s): height "+
+					"%d: %v", dbType, height, err)
+				continue
+			}
+			gotSha, _ := tx.TxSha()
+			wantSha := blocks[height].Transactions()[0].Sha()
+			if !gotSha.IsEqual(wantSha) {
+				t.Errorf("FetchCoinbaseByHeight (%s): got %v "+
+					"for height %d, want %v", dbType, gotSha,
+					height, wantSha)
+			}
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "coinbaseindex", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:10]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.FetchCoinbaseByHeight(db, 0); err != btcdb.ErrNoCoinbaseIndex {
+			t.Errorf("FetchCoinbaseByHeight (%s): got %v without an "+
+				"index, want %v", dbType, err,
+				btcdb.ErrNoCoinbaseIndex)
+		}
+
+		// The index is caught up with the blocks already stored and
+		// kept up to date by those inserted and dropped later.
+		if err := db.AddIndexer(btcdb.NewCoinbaseIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkCoinbases(dbType, db, 9)
+		if _, err := db.InsertBlocks(blocks[10:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkCoinbases(dbType, db, 19)
+
+		keepSha, _ := blocks[14].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkCoinbases(dbType, db, 14)
+		if _, err := btcdb.FetchCoinbaseByHeight(db, -1); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchCoinbaseByHeight (%s): got %v for a "+
+				"negative height, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		teardown()
+	}
+}
@@ -6,18 +6,24 @@ package btcdb_test
 
 import (
 	"compress/bzip2"
+	"database/sql"
 	"encoding/binary"
 	"fmt"
 	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/badgerdb"
+	_ "github.com/conformal/btcdb/boltdb"
 	_ "github.com/conformal/btcdb/ldb"
 	_ "github.com/conformal/btcdb/memdb"
+	_ "github.com/conformal/btcdb/sqldb"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -32,10 +38,42 @@ var (
 	// blockDataFile is the path to a file containing the first 256 blocks
 	// of the block chain.
 	blockDataFile = filepath.Join("testdata", "blocks1-256.bz2")
+
+	// ignoreDbTypes are types which should be ignored when running tests
+	// that iterate all supported DB types.  This allows some tests to add
+	// bogus drivers for testing purposes while still allowing other tests
+	// to easily iterate all supported drivers.
+	ignoreDbTypes = map[string]bool{"createopenfail": true}
 )
 
 var zeroHash = btcwire.ShaHash{}
 
+// postgresDSN is the connection string of the PostgreSQL database used to test
+// the postgres driver.  It is taken from the BTCDB_TEST_POSTGRES environment
+// variable and the postgres driver is not tested when it is not set.  The
+// tables of the database are dropped by the tests.
+var postgresDSN = os.Getenv("BTCDB_TEST_POSTGRES")
+
+func init() {
+	if postgresDSN == "" {
+		ignoreDbTypes["postgres"] = true
+	}
+}
+
+// dropPostgresTables removes the tables of the postgres test database so it
+// can be created again.
+func dropPostgresTables() error {
+	sdb, err := sql.Open("postgres", postgresDSN)
+	if err != nil {
+		return err
+	}
+	defer sdb.Close()
+
+	_, err = sdb.Exec("DROP TABLE IF EXISTS outputs, inputs, transactions, " +
+		"blocks, filters, chain_work, meta")
+	return err
+}
+
 // testDbRoot is the root directory used to create all test databases.
 const testDbRoot = "testdbs"
 
@@ -53,7 +91,7 @@ func fileExists(name string) bool {
 // name.
 func openDB(dbType, dbName string) (btcdb.Db, error) {
 	// Handle memdb specially since it has no files on disk.
-	if dbType == "memdb" {
+	if dbType == "memory" {
 		db, err := btcdb.OpenDB(dbType)
 		if err != nil {
 			return nil, fmt.Errorf("error opening db: %v", err)
@@ -61,6 +99,15 @@ func openDB(dbType, dbName string) (btcdb.Db, error) {
 		return db, nil
 	}
 
+	// The postgres database lives on a server rather than on disk.
+	if dbType == "postgres" {
+		db, err := btcdb.OpenDB(dbType, postgresDSN)
+		if err != nil {
+			return nil, fmt.Errorf("error opening db: %v", err)
+		}
+		return db, nil
+	}
+
 	dbPath := filepath.Join(testDbRoot, dbName)
 	db, err := btcdb.OpenDB(dbType, dbPath)
 	if err != nil {
@@ -77,7 +124,7 @@ func openDB(dbType, dbName string) (btcdb.Db, error) {
 func createDB(dbType, dbName string, close bool) (btcdb.Db, func(), error) {
 	// Handle memory database specially since it doesn't need the disk
 	// specific handling.
-	if dbType == "memdb" {
+	if dbType == "memory" {
 		db, err := btcdb.CreateDB(dbType)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error creating db: %v", err)
@@ -94,6 +141,28 @@ func createDB(dbType, dbName string, close bool) (btcdb.Db, func(), error) {
 		return db, teardown, nil
 	}
 
+	// The postgres database lives on a server, so start from a clean set
+	// of tables and drop them again during teardown.
+	if dbType == "postgres" {
+		if err := dropPostgresTables(); err != nil {
+			return nil, nil, fmt.Errorf("error dropping tables: %v", err)
+		}
+		db, err := btcdb.CreateDB(dbType, postgresDSN)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating db: %v", err)
+		}
+
+		teardown := func() {
+			if close {
+				db.Sync()
+				db.Close()
+			}
+			dropPostgresTables()
+		}
+
+		return db, teardown, nil
+	}
+
 	// Create the root directory for test databases.
 	if !fileExists(testDbRoot) {
 		if err := os.MkdirAll(testDbRoot, 0700); err != nil {
@@ -217,3 +286,51 @@ func loadBlocks(t *testing.T) ([]*btcutil.Block, error) {
 	savedBlocks = blocks
 	return blocks, nil
 }
+
+// altChain returns a run of blocks after the passed one which are not part of
+// the test chain.
+func altChain(prev *btcutil.Block, n int) []*btcutil.Block {
+	run := make([]*btcutil.Block, 0, n)
+	for i := 0; i < n; i++ {
+		prevSha, _ := prev.Sha()
+		prevHdr := &prev.MsgBlock().Header
+		tx := btcwire.NewMsgTx()
+		prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{byte(i), 0x51}))
+		tx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash, prevHdr.Bits,
+			uint32(i))
+		hdr.Timestamp = prevHdr.Timestamp.Add(time.Minute)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		msgBlock.AddTransaction(tx)
+		prev = btcutil.NewBlock(msgBlock)
+		run = append(run, prev)
+	}
+	return run
+}
+
+// mineRun returns a run of blocks after the passed one with the passed target
+// and version, each with a coinbase of its own.
+func mineRun(prev *btcutil.Block, n int, bits uint32, version int32) []*btcutil.Block {
+	run := make([]*btcutil.Block, 0, n)
+	for i := 0; i < n; i++ {
+		prevSha, _ := prev.Sha()
+		prevHdr := &prev.MsgBlock().Header
+		var script [9]byte
+		binary.LittleEndian.PutUint64(script[:8],
+			uint64(prevHdr.Timestamp.Unix()))
+		script[8] = 0x51
+		tx := btcwire.NewMsgTx()
+		prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, script[:]))
+		tx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash, bits, 0)
+		hdr.Version = version
+		hdr.Timestamp = prevHdr.Timestamp.Add(time.Minute)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		msgBlock.AddTransaction(tx)
+		prev = btcutil.NewBlock(msgBlock)
+		run = append(run, prev)
+	}
+	return run
+}
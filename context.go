@@ -0,0 +1,111 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"context"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// LockContext acquires the passed lock unless the context is done first, in
+// which case it returns the error of the context and the lock is released as
+// soon as it is acquired.  It is intended for use by drivers to bound the time
+// the context variants of the functions of Db wait for their locks.
+func LockContext(ctx context.Context, l sync.Locker) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Contexts which are never done don't need to wait on a goroutine.
+	if ctx.Done() == nil {
+		l.Lock()
+		return nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			l.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// contextIterator implements BlockIterator on top of another BlockIterator
+// which stops once its context is done.
+type contextIterator struct {
+	ctx context.Context
+	it  BlockIterator
+	err error
+}
+
+// ContextBlockIterator returns a BlockIterator over the same blocks as the
+// passed one which stops with the error of the given context once it is done,
+// so long scans end when their caller goes away.  It is intended for use by
+// drivers.
+func ContextBlockIterator(ctx context.Context, it BlockIterator) BlockIterator {
+	return &contextIterator{ctx: ctx, it: it}
+}
+
+// Next moves to the next block unless the context is done.  This is part of
+// the BlockIterator interface implementation.
+func (c *contextIterator) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.err = err
+		return false
+	}
+	return c.it.Next()
+}
+
+// Sha returns the hash of the current block.  This is part of the
+// BlockIterator interface implementation.
+func (c *contextIterator) Sha() *btcwire.ShaHash {
+	if c.err != nil {
+		return nil
+	}
+	return c.it.Sha()
+}
+
+// Height returns the height of the current block.  This is part of the
+// BlockIterator interface implementation.
+func (c *contextIterator) Height() int64 {
+	return c.it.Height()
+}
+
+// RawBytes returns the serialized current block.  This is part of the
+// BlockIterator interface implementation.
+func (c *contextIterator) RawBytes() []byte {
+	if c.err != nil {
+		return nil
+	}
+	return c.it.RawBytes()
+}
+
+// Err returns the error which stopped the iteration, if any.  This is part of
+// the BlockIterator interface implementation.
+func (c *contextIterator) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.it.Err()
+}
+
+// Release frees the snapshot the wrapped iterator reads from.  This is part of
+// the BlockIterator interface implementation.
+func (c *contextIterator) Release() {
+	c.it.Release()
+}
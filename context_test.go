@@ -0,0 +1,214 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"context"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/dbtest"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestContextCancel ensures the context variants of the functions of every
+// supported database type stop with the error of their context once it is
+// done.
+func TestContextCancel(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "ctxcancel", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		sha, _ := blocks[1].Sha()
+		if _, err := db.FetchBlockByShaCtx(done, sha); err != context.Canceled {
+			t.Errorf("FetchBlockByShaCtx (%s): unexpected error - "+
+				"got %v, want %v", dbType, err, context.Canceled)
+		}
+		if _, err := db.FetchHeightRangeCtx(done, 0, btcdb.AllShas); err != context.Canceled {
+			t.Errorf("FetchHeightRangeCtx (%s): unexpected error - "+
+				"got %v, want %v", dbType, err, context.Canceled)
+		}
+		if _, err := db.FetchHeaderRangeCtx(done, 0, int64(len(blocks))); err != context.Canceled {
+			t.Errorf("FetchHeaderRangeCtx (%s): unexpected error - "+
+				"got %v, want %v", dbType, err, context.Canceled)
+		}
+		if _, err := db.BlockIteratorCtx(done, 0); err != context.Canceled {
+			t.Errorf("BlockIteratorCtx (%s): unexpected error - got "+
+				"%v, want %v", dbType, err, context.Canceled)
+		}
+
+		// Contexts which are not done behave the same as the functions
+		// without one.
+		blk, err := db.FetchBlockByShaCtx(context.Background(), sha)
+		if err != nil {
+			t.Errorf("FetchBlockByShaCtx (%s): %v", dbType, err)
+		} else if blk.Height() != 1 {
+			t.Errorf("FetchBlockByShaCtx (%s): got block at height "+
+				"%d, want 1", dbType, blk.Height())
+		}
+
+		// An iterator stops once its context is cancelled part way.
+		ctx, cancelIter := context.WithCancel(context.Background())
+		iter, err := db.TxIteratorCtx(ctx, 0)
+		if err != nil {
+			t.Errorf("TxIteratorCtx (%s): %v", dbType, err)
+			cancelIter()
+			teardown()
+			continue
+		}
+		n := 0
+		for iter.Next() {
+			n++
+			if n == 10 {
+				cancelIter()
+			}
+		}
+		cancelIter()
+		if err := iter.Err(); err != context.Canceled {
+			t.Errorf("TxIteratorCtx (%s): unexpected error - got %v, "+
+				"want %v", dbType, err, context.Canceled)
+		}
+		if n != 10 {
+			t.Errorf("TxIteratorCtx (%s): iterated %d transactions "+
+				"after cancel, want 10", dbType, n)
+		}
+		iter.Release()
+		teardown()
+	}
+}
+
+// TestLockContext ensures waiting for a lock ends with the deadline of the
+// context and the lock is released once it is eventually acquired.
+func TestLockContext(t *testing.T) {
+	var mtx sync.Mutex
+	mtx.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if err := btcdb.LockContext(ctx, &mtx); err != context.DeadlineExceeded {
+		t.Errorf("LockContext: unexpected error - got %v, want %v",
+			err, context.DeadlineExceeded)
+	}
+	mtx.Unlock()
+
+	if err := btcdb.LockContext(context.Background(), &mtx); err != nil {
+		t.Errorf("LockContext: %v", err)
+		return
+	}
+	mtx.Unlock()
+}
+
+// TestFetchBlockContext ensures the blocks fetched by hash carry their height
+// and the transactions fetched by hash the hash and height of their block, so
+// callers need no second lookup, for all supported database types.
+func TestFetchBlockContext(t *testing.T) {
+	g := dbtest.NewChainGenerator(3)
+	g.OutputsPerTx = 2
+	blocks := g.NextBlocks(20)
+
+	// checkReply ensures the passed reply is for the passed transaction,
+	// which is at the passed index of the block at the passed height.
+	checkReply := func(dbType, fn string, reply *btcdb.TxListReply, txSha *btcwire.ShaHash, height int64, idx int) {
+		wantSha, _ := blocks[height].Sha()
+		if reply.Err != nil || reply.BlkSha == nil ||
+			!reply.BlkSha.IsEqual(wantSha) || reply.Height != height {
+			t.Errorf("%s (%s): tx %v got block %v at height %d (err "+
+				"%v), want %v at height %d", fn, dbType, txSha,
+				reply.BlkSha, reply.Height, reply.Err, wantSha,
+				height)
+		}
+		if reply.BlkIndex != idx {
+			t.Errorf("%s (%s): tx %v got index %d in its block, "+
+				"want %d", fn, dbType, txSha, reply.BlkIndex, idx)
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "blockcontext", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		snap, err := db.Snapshot()
+		if err != nil {
+			t.Errorf("Snapshot (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		for height, blk := range blocks {
+			sha, _ := blk.Sha()
+			for i, fetch := range []func(*btcwire.ShaHash) (*btcutil.Block, error){
+				db.FetchBlockBySha, snap.FetchBlockBySha,
+			} {
+				got, err := fetch(sha)
+				if err != nil || got.Height() != int64(height) {
+					t.Errorf("FetchBlockBySha (%s): fetch %d of "+
+						"block %d got height %d (err %v)",
+						dbType, i, height, got.Height(), err)
+				}
+			}
+
+			var txShas []*btcwire.ShaHash
+			for idx, tx := range blk.Transactions() {
+				replies, err := db.FetchTxBySha(tx.Sha())
+				if err != nil || len(replies) != 1 {
+					t.Errorf("FetchTxBySha (%s): got %d replies "+
+						"(err %v), want 1", dbType,
+						len(replies), err)
+					continue
+				}
+				checkReply(dbType, "FetchTxBySha", replies[0],
+					tx.Sha(), int64(height), idx)
+				txShas = append(txShas, tx.Sha())
+			}
+			for i, reply := range db.FetchTxByShaList(txShas) {
+				checkReply(dbType, "FetchTxByShaList", reply,
+					txShas[i], int64(height), i)
+			}
+			for i, reply := range db.FetchUnSpentTxByShaList(txShas) {
+				if reply.Err == btcdb.TxShaMissing && reply.FullySpent {
+					continue
+				}
+				checkReply(dbType, "FetchUnSpentTxByShaList",
+					reply, txShas[i], int64(height), i)
+			}
+		}
+		snap.Release()
+		teardown()
+	}
+}
@@ -5,9 +5,13 @@
 package btcdb
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
+	"io"
+	"math/big"
 )
 
 // Errors that the various database functions may return.
@@ -17,8 +21,182 @@ var (
 	DuplicateSha   = errors.New("Duplicate insert attempted")
 	DbDoesNotExist = errors.New("Non-existent database")
 	DbUnknownType  = errors.New("Non-existent database type")
+
+	// ErrBlockNotFound is returned when a requested block, whether by hash
+	// or by height, does not exist.
+	ErrBlockNotFound = errors.New("Requested block does not exist")
+
+	// ErrTxNotFound is returned when a requested transaction does not
+	// exist.  It is the same error as TxShaMissing.
+	ErrTxNotFound = TxShaMissing
+
+	// ErrDbClosed is returned when a database is used after it has been
+	// closed.
+	ErrDbClosed = errors.New("Database is closed")
+
+	// ErrReadOnly is returned when a database which was opened read-only is
+	// asked to modify its contents.
+	ErrReadOnly = errors.New("Database is read-only")
+
+	// ErrCorruption is returned when data read from the database is not in
+	// the expected format.
+	ErrCorruption = errors.New("Database is corrupt")
+
+	// ErrInvalidRegion is returned when a requested region of a block
+	// does not lie within the block.
+	ErrInvalidRegion = errors.New("Requested region is outside of the block")
+
+	// ErrNoSpendIndex is returned when the transaction which spent an
+	// output is requested from a database which does not maintain the
+	// spend index.
+	ErrNoSpendIndex = errors.New("Spend index is not enabled")
+
+	// ErrNoFilterIndex is returned when a compact block filter is
+	// requested from a database which does not maintain them.
+	ErrNoFilterIndex = errors.New("Filter index is not enabled")
+
+	// ErrHeadersOnly is returned when block bodies or transactions are
+	// requested from a database which only stores block headers.
+	ErrHeadersOnly = errors.New("Database only stores block headers")
+
+	// ErrPruned is returned when the body of a block, or data which can
+	// only be read from it, is requested after the block was pruned.
+	ErrPruned = errors.New("Requested block has been pruned")
+
+	// ErrEmptyMetaKey is returned when a change to the metadata namespace
+	// has an empty key.
+	ErrEmptyMetaKey = errors.New("Metadata key is empty")
+
+	// ErrMetaNotReadable is returned by MetaBatch.Get for keys the batch
+	// does not change when the batch was not handed to an indexer.
+	ErrMetaNotReadable = errors.New("Metadata batch can not read the " +
+		"metadata namespace")
+
+	// ErrBackupUnsupported is returned when a backup is requested from a
+	// database which can not be copied to a path.
+	ErrBackupUnsupported = errors.New("Database does not support backups")
+
+	// ErrPipelineClosed is returned when blocks are added to an
+	// ImportPipeline after it was closed.
+	ErrPipelineClosed = errors.New("Import pipeline is closed")
+
+	// ErrEncryptionKey is returned when an encrypted database is opened
+	// without its key or with another one.
+	ErrEncryptionKey = errors.New("Database encryption key is missing " +
+		"or wrong")
+
+	// ErrUpgradeRequired is returned when a database written in an older
+	// format is opened read-only, since its format can only be upgraded
+	// by opening it for writing.
+	ErrUpgradeRequired = errors.New("Database format must be upgraded " +
+		"by opening it for writing")
+
+	// ErrHeaderMissing is returned when the body of a block is inserted
+	// with InsertBlockBody before its header was stored with
+	// InsertHeaders.
+	ErrHeaderMissing = errors.New("Header of block is not stored")
+
+	// ErrNoTimeIndex is returned by the queries of the time index when
+	// no TimeIndex was added to the database.
+	ErrNoTimeIndex = errors.New("Time index is not enabled")
+
+	// ErrNoStatsIndex is returned by FetchBlockStats when no StatsIndex
+	// was added to the database.
+	ErrNoStatsIndex = errors.New("Stats index is not enabled")
+
+	// ErrNoAddrBalanceIndex is returned by FetchAddrBalance and
+	// FetchRichList when no AddrBalanceIndex was added to the database.
+	ErrNoAddrBalanceIndex = errors.New("Balance index is not enabled")
+
+	// ErrNoSupplyIndex is returned by FetchSupplyAtHeight when no
+	// SupplyIndex was added to the database.
+	ErrNoSupplyIndex = errors.New("Supply index is not enabled")
+
+	// ErrNoUtxoHashIndex is returned by UtxoSetHash when no
+	// UtxoHashIndex was added to the database.
+	ErrNoUtxoHashIndex = errors.New("Unspent output set hash index is " +
+		"not enabled")
+
+	// ErrNoVersionBitsIndex is returned by the queries of the version bits
+	// index when no VersionBitsIndex was added to the database.
+	ErrNoVersionBitsIndex = errors.New("Version bits index is not enabled")
+
+	// ErrNoNullDataIndex is returned by FetchNullData when no
+	// NullDataIndex was added to the database.
+	ErrNoNullDataIndex = errors.New("OP_RETURN index is not enabled")
+
+	// ErrNoCoinbaseIndex is returned by FetchCoinbaseByHeight when no
+	// CoinbaseIndex was added to the database.
+	ErrNoCoinbaseIndex = errors.New("Coinbase index is not enabled")
+
+	// ErrNoScriptClassIndex is returned by FetchScriptClasses,
+	// FetchScriptClassTotals and FetchScriptClassOutputs when no
+	// ScriptClassIndex was added to the database.
+	ErrNoScriptClassIndex = errors.New("Script class index is not enabled")
+
+	// ErrNoWatchIndex is returned by FetchWatchHistory when no WatchIndex
+	// was added to the database.
+	ErrNoWatchIndex = errors.New("Watch index is not enabled")
+
+	// ErrNotWatching is returned by the functions of a WatchIndex which
+	// change the watched set before the index was added to a database.
+	ErrNotWatching = errors.New("Watch index was not added to a database")
+
+	// ErrNoMempoolStore is returned by the functions of a MempoolStore
+	// which change the stored transactions before the store was added to
+	// a database.
+	ErrNoMempoolStore = errors.New("Mempool store was not added to a database")
+
+	// ErrPeerNotFound is returned by FetchPeerAddress and FetchPeerBan when
+	// the address or a ban score which has not expired is not stored.
+	ErrPeerNotFound = errors.New("Peer not found")
+
+	// ErrChainChanged is returned by a ShaIterator when a block it
+	// returned was disconnected while it ran.
+	ErrChainChanged = errors.New("Chain changed during iteration")
+
+	// ErrDbBusy is returned when a database is opened while another
+	// process, or another instance in the same process, has it open.
+	ErrDbBusy = errors.New("Database is in use by another process")
 )
 
+// CorruptionError is returned when a value read from the database fails the
+// checksum stored with it, meaning the data on disk is no longer what was
+// written.  Key is the database key of the offending value.
+type CorruptionError struct {
+	Key []byte
+}
+
+// Error returns the offending key as part of a human-readable string.
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: checksum mismatch for key %x", ErrCorruption,
+		e.Key)
+}
+
+// IsCorruption returns whether the passed error reports that the database is
+// corrupt, either as ErrCorruption or as a CorruptionError.
+func IsCorruption(err error) bool {
+	if _, ok := err.(*CorruptionError); ok {
+		return true
+	}
+	return err == ErrCorruption
+}
+
+// IdentityError is returned when a database is opened for another network than
+// the one whose chain it holds, or with another backend than the one which
+// created it.  Kind is "network" or "backend", Have names the network or
+// backend of the database and Want the one it was opened for.
+type IdentityError struct {
+	Kind string
+	Have string
+	Want string
+}
+
+// Error returns the mismatch as a human-readable string.
+func (e *IdentityError) Error() string {
+	return fmt.Sprintf("Database %s is %s, not %s", e.Kind, e.Have, e.Want)
+}
+
 // AllShas is a special value that can be used as the final sha when requesting
 // a range of shas by height to request them all.
 const AllShas = int64(^uint64(0) >> 1)
@@ -27,10 +205,21 @@ const AllShas = int64(^uint64(0) >> 1)
 // the bitcoin block chain.  This interface is intended to be agnostic to actual
 // mechanism used for backend data storage.  The AddDBDriver function can be
 // used to add a new backend data storage method.
+//
+// All implementations are safe for concurrent use by multiple goroutines.
+// Functions which modify the database are serialized with each other and
+// readers never observe a partially inserted or dropped block.  Backends are
+// free to let functions which only read from the database, such as
+// FetchBlockBySha and FetchTxBySha, proceed in parallel with each other.
 type Db interface {
-	// Close cleanly shuts down the database and syncs all data.
+	// Close cleanly shuts down the database and syncs all data.  It waits
+	// for the functions already in progress to return, while functions
+	// called once it has begun return ErrDbClosed.
 	Close()
 
+	// Closed returns whether the database has been closed.
+	Closed() bool
+
 	// DropAfterBlockBySha will remove any blocks from the database after
 	// the given block.  It terminates any existing transaction and performs
 	// its operations in an atomic transaction which is commited before
@@ -41,10 +230,37 @@ type Db interface {
 	// the database.
 	ExistsSha(sha *btcwire.ShaHash) (exists bool)
 
+	// ExistsShas returns whether or not each of the given block hashes is
+	// present in the database.  It answers for all of the hashes at once,
+	// such as those of an inventory message, rather than looking each up
+	// separately.
+	ExistsShas(shas []btcwire.ShaHash) []bool
+
 	// FetchBlockBySha returns a btcutil Block.  The implementation may
-	// cache the underlying data if desired.
+	// cache the underlying data if desired.  The height of the block is
+	// always set on it, so callers which also need the height read it
+	// with Height rather than calling FetchBlockHeightBySha.
 	FetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, err error)
 
+	// FetchBlockByShaCtx is the same as FetchBlockBySha, except it returns
+	// the error of the passed context should it be done before the block
+	// is fetched, including while waiting for the locks of the database.
+	FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error)
+
+	// FetchBlockRegion returns length bytes of the serialized block with
+	// the given hash starting at offset, such as just its header or a
+	// single transaction located with TxLoc, without loading the rest of
+	// the block where the backend allows it.
+	FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error)
+
+	// FetchBlockBytesBySha appends the serialized block with the given
+	// hash to buf[:0], growing it as needed, and returns the result.  Scans
+	// reading many blocks reuse the same buffer, such as one from
+	// GetBlockBuffer, rather than allocating one for every block.  The
+	// returned slice belongs to the caller and the database keeps no
+	// reference to it.
+	FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error)
+
 	// FetchBlockHeightBySha returns the block height for the given hash.
 	FetchBlockHeightBySha(sha *btcwire.ShaHash) (height int64, err error)
 
@@ -56,16 +272,59 @@ type Db interface {
 	// block chain.
 	FetchBlockShaByHeight(height int64) (sha *btcwire.ShaHash, err error)
 
+	// FetchBlockHeaderByHeight returns the block header at the given
+	// height in the main chain.
+	FetchBlockHeaderByHeight(height int64) (bh *btcwire.BlockHeader, err error)
+
+	// FetchHeaderRange returns the headers of a range of blocks by the
+	// start and ending heights.  Like FetchHeightRange, it is inclusive of
+	// the start height and exclusive of the ending height and `AllShas'
+	// may be used as the ending height to fetch all headers from the start
+	// height on.  Only the headers are read where the backend allows it.
+	FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error)
+
+	// FetchHeaderRangeCtx is the same as FetchHeaderRange, except it stops
+	// with the error of the passed context should it be done before all
+	// of the headers are fetched.
+	FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error)
+
+	// FetchChainWorkBySha returns the cumulative work of the main chain
+	// through the block with the given hash, which is the sum of the
+	// work of the block and every block before it as given by CalcWork.
+	// It is maintained as blocks are inserted.
+	FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error)
+
 	// FetchHeightRange looks up a range of blocks by the start and ending
 	// heights.  Fetch is inclusive of the start height and exclusive of the
 	// ending height. To fetch all hashes from the start height until no
-	// more are present, use the special id `AllShas'.
+	// more are present, use the special id `AllShas'.  The range is not
+	// capped, so callers serving long ranges a page at a time use
+	// FetchHeightRangePage and those walking them use a ShaIterator.
 	FetchHeightRange(startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error)
 
+	// FetchHeightRangeCtx is the same as FetchHeightRange, except it stops
+	// with the error of the passed context should it be done before all
+	// of the hashes are fetched.
+	FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error)
+
+	// BlockLocatorFromSha returns a block locator for the block with the
+	// given hash, looking up the hashes of the blocks it references from
+	// the height index.
+	BlockLocatorFromSha(sha *btcwire.ShaHash) (BlockLocator, error)
+
+	// LatestBlockLocator returns a block locator for the most recent
+	// block.  The locator is empty when there are no blocks.
+	LatestBlockLocator() (BlockLocator, error)
+
 	// ExistsTxSha returns whether or not the given tx hash is present in
 	// the database
 	ExistsTxSha(sha *btcwire.ShaHash) (exists bool)
 
+	// ExistsTxShas returns whether or not each of the given tx hashes is
+	// present in the database.  Like ExistsShas, it answers for all of the
+	// hashes at once.
+	ExistsTxShas(shas []btcwire.ShaHash) []bool
+
 	// FetchTxBySha returns some data for the given transaction hash. The
 	// implementation may cache the underlying data if desired.
 	FetchTxBySha(txsha *btcwire.ShaHash) ([]*TxListReply, error)
@@ -79,15 +338,124 @@ type Db interface {
 	// FetchUnSpentTxByShaList returns a TxListReply given an array of
 	// transaction hashes.  The implementation may cache the underlying
 	// data if desired. Fully spent transactions will not normally not
-	// be returned in this operation.
+	// be returned in this operation.  Their replies have an Err of
+	// TxShaMissing with FullySpent set, which is not set for transactions
+	// which do not exist.  All of the transactions are looked up in a
+	// single pass under one acquisition of the database lock.
 	FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*TxListReply
 
+	// FetchUtxoEntry returns the unspent transaction output referenced by
+	// the given outpoint.  A nil entry and no error is returned when the
+	// output does not exist or has already been spent.
+	FetchUtxoEntry(outpoint *btcwire.OutPoint) (*UtxoEntry, error)
+
+	// FetchSpendingTx returns the transaction which spent the output
+	// referenced by the given outpoint.  A nil result and no error is
+	// returned when the output does not exist or is unspent.  The spend
+	// index is optional for some backends, which return ErrNoSpendIndex
+	// when it is not enabled.
+	FetchSpendingTx(outpoint *btcwire.OutPoint) (*SpendingTx, error)
+
+	// IsOutpointSpent returns whether the output referenced by the given
+	// outpoint was spent by a transaction of the main chain, without
+	// reading the transaction.  Outputs past the last one of the
+	// transaction are reported as spent since they can never be spent.
+	// ErrTxNotFound is returned when the transaction does not exist.
+	IsOutpointSpent(outpoint *btcwire.OutPoint) (bool, error)
+
+	// FetchFilterBySha returns the serialized BIP0158 basic filter of the
+	// block with the given hash, as built by the gcs package.  Filters are
+	// optional for some backends, which return ErrNoFilterIndex when they
+	// are not enabled.
+	FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error)
+
+	// FetchFilterHeaderBySha returns the header of the basic filter of the
+	// block with the given hash, which commits to the filters of every
+	// block up to and including it.
+	FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error)
+
+	// FetchFilterRange returns the basic filters of a range of blocks by
+	// the start and ending heights following the same rules as
+	// FetchHeaderRange.
+	FetchFilterRange(startHeight, endHeight int64) ([][]byte, error)
+
+	// FetchFilterHeaderRange returns the basic filter headers of a range of
+	// blocks by the start and ending heights following the same rules as
+	// FetchHeaderRange.
+	FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error)
+
+	// UtxoSetSize returns the total number of unspent transaction outputs
+	// in the database.
+	UtxoSetSize() (int64, error)
+
 	// InsertBlock inserts raw block and transaction data from a block
 	// into the database.  The first block inserted into the database
 	// will be treated as the genesis block.  Every subsequent block insert
-	// requires the referenced parent block to already exist.
+	// requires the referenced parent block to already exist.  A block
+	// which contains a transaction more than once, or a transaction whose
+	// hash is the one of an earlier transaction which is not fully spent,
+	// is rejected with DuplicateSha unless IsBIP30Exception allows it.
+	// Blocks failing the checks selected by the Validation field of
+	// Options are rejected with a ValidationError.
 	InsertBlock(block *btcutil.Block) (height int64, err error)
 
+	// InsertBlocks inserts a run of blocks in order as a single atomic
+	// change and returns the height of each.  Every block must connect
+	// to the one before it and the first to a block already in the
+	// database, following the same rules as InsertBlock.  When any of the
+	// blocks fails to insert, none of them are.
+	InsertBlocks(blocks []*btcutil.Block) (heights []int64, err error)
+
+	// InsertBlocksWithMeta behaves the same as InsertBlocks and also
+	// applies the passed changes to the metadata namespace in the same
+	// atomic change, so state kept by consumers of the database can not
+	// get out of step with the chain.  A nil batch is allowed.
+	InsertBlocksWithMeta(blocks []*btcutil.Block, meta *MetaBatch) (heights []int64, err error)
+
+	// DropAfterBlockByShaWithMeta behaves the same as DropAfterBlockBySha
+	// and also applies the passed changes to the metadata namespace in the
+	// same atomic change.  A nil batch is allowed.
+	DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *MetaBatch) error
+
+	// ReorganizeWithMeta removes the blocks after the block with the given
+	// hash as DropAfterBlockBySha does, inserts the passed run of blocks,
+	// which must connect to that block, as InsertBlocks does and applies
+	// the passed changes to the metadata namespace, all in the same atomic
+	// change, so the heights of the chain never refer to a mix of the
+	// removed and inserted blocks.  It returns the height of each inserted
+	// block.  When any part fails, nothing is changed.  An empty run and a
+	// nil batch are allowed.
+	ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *MetaBatch) (heights []int64, err error)
+
+	// GetMeta returns the value stored under the given key in the
+	// metadata namespace, which holds arbitrary data for consumers of the
+	// database apart from the chain.  It returns nil when the key does
+	// not exist.
+	GetMeta(key []byte) ([]byte, error)
+
+	// PutMeta stores the value under the given key in the metadata
+	// namespace.
+	PutMeta(key, value []byte) error
+
+	// DeleteMeta removes the given key from the metadata namespace.
+	DeleteMeta(key []byte) error
+
+	// WriteMeta applies all changes in the passed batch to the metadata
+	// namespace as a single atomic change.
+	WriteMeta(meta *MetaBatch) error
+
+	// MetaIterator returns an iterator over the keys of the metadata
+	// namespace which begin with the given prefix in ascending byte
+	// order.  An empty prefix walks every key.  The iterator sees the
+	// keys as they were when it was created and must be released.
+	MetaIterator(prefix []byte) (MetaIterator, error)
+
+	// ReverseMetaIterator returns an iterator over the keys of the
+	// metadata namespace which begin with the given prefix in descending
+	// byte order, so the newest of keys ending with a big endian height
+	// or sequence come first.  It is otherwise the same as MetaIterator.
+	ReverseMetaIterator(prefix []byte) (MetaIterator, error)
+
 	// NewestSha returns the hash and block height of the most recent (end)
 	// block of the block chain.  It will return the zero hash, -1 for
 	// the block height, and no error (nil) if there are not any blocks in
@@ -98,28 +466,197 @@ type Db interface {
 	// saved data at last Sync and closes the database.
 	RollbackClose()
 
-	// Sync verifies that the database is coherent on disk and no
-	// outstanding transactions are in flight.
+	// BlockIterator returns an iterator over the blocks of the chain in
+	// height order beginning at the given height.  The iterator reads
+	// from a snapshot of the database taken when it is created, so it
+	// must be released once it is no longer needed.
+	BlockIterator(startHeight int64) (BlockIterator, error)
+
+	// TxIterator returns an iterator over every transaction of the chain
+	// beginning with the block at the given height.  Like BlockIterator,
+	// it reads from a snapshot and must be released.
+	TxIterator(startHeight int64) (TxIterator, error)
+
+	// BlockIteratorCtx and TxIteratorCtx are the same as BlockIterator
+	// and TxIterator, except the iterators stop with the error of the
+	// passed context once it is done, so scans of the chain end when
+	// their caller goes away.  Transaction iterators finish the block
+	// they are in first.
+	BlockIteratorCtx(ctx context.Context, startHeight int64) (BlockIterator, error)
+	TxIteratorCtx(ctx context.Context, startHeight int64) (TxIterator, error)
+
+	// AddIndexer initializes the passed indexer, catches it up with the
+	// chain and from then on has it index every block inserted into or
+	// dropped from the database in the same atomic change.  It must not
+	// be called while blocks are inserted or dropped.
+	AddIndexer(idx Indexer) error
+
+	// Subscribe returns a subscription to the blocks connected to and
+	// disconnected from the chain by InsertBlock, InsertBlocks and
+	// DropAfterBlockBySha.  The events of a change are delivered once it
+	// is committed.  The subscription must be cancelled with Unsubscribe
+	// once it is no longer needed.
+	Subscribe() (*Subscription, error)
+
+	// Snapshot returns a read-only view of the database pinned to the
+	// point in time it was taken.  Blocks inserted or dropped afterwards
+	// are not visible through it.  The snapshot must be released once it
+	// is no longer needed and before the database is closed.
+	Snapshot() (Snapshot, error)
+
+	// VerifyIntegrity performs the checks of the given level, one of
+	// VerifyIndexes, VerifyBlocks and VerifyMerkleRoots, on every block of
+	// the chain and returns an IntegrityError for the first problem found.
+	// The checks run on a snapshot, so blocks may be inserted and dropped
+	// meanwhile.  Progress, when not nil, is called with the height of
+	// each block once it has been checked.
+	VerifyIntegrity(level int, progress func(height int64)) error
+
+	// Backup writes a copy of the database as of the time it is called to
+	// a new database at the passed path.  The copy is made from a
+	// snapshot, so the database remains available for reads and writes
+	// meanwhile.  Progress, when not nil, is called with the number of
+	// bytes written to the copy so far.  Databases which can not be copied
+	// to a path return ErrBackupUnsupported.
+	Backup(destPath string, progress func(copied int64)) error
+
+	// ExportBootstrap writes the blocks of a range of heights in the
+	// format of bootstrap.dat, framed by the magic of the network the
+	// chain belongs to and their length, so they can be loaded by other
+	// nodes.  Like FetchHeightRange, the range is inclusive of the start
+	// height and exclusive of the ending height and `AllShas' may be used
+	// as the ending height to write every block from the start height on.
+	// The blocks are read from a snapshot.
+	ExportBootstrap(w io.Writer, startHeight, endHeight int64) error
+
+	// BlockCacheStats returns the use of the cache of recent blocks set
+	// up by the BlockCacheSize of Options, which is all zero when blocks
+	// are not cached.
+	BlockCacheStats() BlockCacheStats
+
+	// Sync waits for outstanding transactions to finish and syncs all
+	// data written so far to disk, whatever the sync policy the database
+	// was opened with.
 	Sync()
 }
 
+// Snapshot is a read-only view of a database pinned to the point in time it
+// was taken, which allows long-running scans to see a consistent chain while
+// blocks are inserted into or dropped from the database.  The functions behave
+// the same as those of Db.  All functions return ErrDbClosed once the snapshot
+// has been released.
+type Snapshot interface {
+	ExistsSha(sha *btcwire.ShaHash) (exists bool)
+	ExistsShas(shas []btcwire.ShaHash) []bool
+	FetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, err error)
+	FetchBlockHeightBySha(sha *btcwire.ShaHash) (height int64, err error)
+	FetchBlockHeaderBySha(sha *btcwire.ShaHash) (bh *btcwire.BlockHeader, err error)
+	FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error)
+	FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error)
+	FetchBlockShaByHeight(height int64) (sha *btcwire.ShaHash, err error)
+	FetchHeightRange(startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error)
+	FetchBlockHeaderByHeight(height int64) (bh *btcwire.BlockHeader, err error)
+	FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error)
+	FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error)
+	BlockLocatorFromSha(sha *btcwire.ShaHash) (BlockLocator, error)
+	LatestBlockLocator() (BlockLocator, error)
+	ExistsTxSha(sha *btcwire.ShaHash) (exists bool)
+	ExistsTxShas(shas []btcwire.ShaHash) []bool
+	FetchTxBySha(txsha *btcwire.ShaHash) ([]*TxListReply, error)
+	FetchTxByShaList(txShaList []*btcwire.ShaHash) []*TxListReply
+	FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*TxListReply
+	FetchUtxoEntry(outpoint *btcwire.OutPoint) (*UtxoEntry, error)
+	FetchSpendingTx(outpoint *btcwire.OutPoint) (*SpendingTx, error)
+	IsOutpointSpent(outpoint *btcwire.OutPoint) (bool, error)
+	FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error)
+	FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error)
+	FetchFilterRange(startHeight, endHeight int64) ([][]byte, error)
+	FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error)
+	UtxoSetSize() (int64, error)
+	NewestSha() (sha *btcwire.ShaHash, height int64, err error)
+	GetMeta(key []byte) ([]byte, error)
+	MetaIterator(prefix []byte) (MetaIterator, error)
+	ReverseMetaIterator(prefix []byte) (MetaIterator, error)
+
+	// Release frees the resources held by the snapshot.
+	Release()
+}
+
+// BlockIterator walks the blocks of the chain in height order without loading
+// more than one block at a time.  It starts out positioned before its first
+// block, so Next must be called before the first block can be accessed.
+type BlockIterator interface {
+	// Next moves to the next block and returns whether there is one.  It
+	// returns false once the end of the chain is reached or an error
+	// occurs, in which case Err returns the error.
+	Next() bool
+
+	// Sha returns the hash of the current block.
+	Sha() *btcwire.ShaHash
+
+	// Height returns the height of the current block.
+	Height() int64
+
+	// RawBytes returns the serialized current block.
+	RawBytes() []byte
+
+	// Err returns the error which stopped the iteration, if any.
+	Err() error
+
+	// Release frees the snapshot the iterator reads from.
+	Release()
+}
+
 // DriverDB defines a structure for backend drivers to use when they registered
-// themselves as a backend which implements the Db interface.
+// themselves as a backend which implements the Db interface.  Aliases are other
+// names the driver is also found by, such as the names it was registered
+// under in the past, which SupportedDBs does not list.
 type DriverDB struct {
 	DbType   string
+	Aliases  []string
 	CreateDB func(args ...interface{}) (pbdb Db, err error)
 	OpenDB   func(args ...interface{}) (pbdb Db, err error)
 }
 
 // TxListReply is used to return individual transaction information when
-// data about multiple transactions is requested in a single call.
+// data about multiple transactions is requested in a single call.  BlkSha and
+// Height are the hash and height of the block containing the transaction, and
+// BlkIndex is the index of the transaction within the block, so callers need
+// not look up the block to place it in the chain.  BlkIndex is -1 in the rare
+// case the database can not tell it, such as for the transactions of pruned
+// blocks indexed before their position was recorded.  TxSpent holds the spent
+// status of each output of the transaction.
+//
+// FullySpent is only set by FetchUnSpentTxByShaList, along with an Err of
+// TxShaMissing, to tell a transaction which exists but has all of its outputs
+// spent from one which never existed.  Height is then the height of the block
+// containing its most recent instance.
 type TxListReply struct {
-	Sha     *btcwire.ShaHash
-	Tx      *btcwire.MsgTx
-	BlkSha  *btcwire.ShaHash
-	Height  int64
-	TxSpent []bool
-	Err     error
+	Sha        *btcwire.ShaHash
+	Tx         *btcwire.MsgTx
+	BlkSha     *btcwire.ShaHash
+	Height     int64
+	BlkIndex   int
+	TxSpent    []bool
+	FullySpent bool
+	Err        error
+}
+
+// UtxoEntry houses details about an individual unspent transaction output
+// tracked by the database.
+type UtxoEntry struct {
+	Height   int64
+	Coinbase bool
+	Value    int64
+	PkScript []byte
+}
+
+// SpendingTx houses details about the transaction which spent a transaction
+// output.
+type SpendingTx struct {
+	Sha        *btcwire.ShaHash
+	Height     int64
+	InputIndex uint32
 }
 
 // driverList holds all of the registered database backends.
@@ -139,22 +676,36 @@ func AddDBDriver(instance DriverDB) {
 
 // CreateDB intializes and opens a database.
 func CreateDB(dbtype string, args ...interface{}) (pbdb Db, err error) {
-	for _, drv := range driverList {
-		if drv.DbType == dbtype {
-			return drv.CreateDB(args...)
-		}
+	drv, ok := findDriver(dbtype)
+	if !ok {
+		return nil, DbUnknownType
 	}
-	return nil, DbUnknownType
+	return drv.CreateDB(args...)
 }
 
 // OpenDB opens an existing database.
 func OpenDB(dbtype string, args ...interface{}) (pbdb Db, err error) {
+	drv, ok := findDriver(dbtype)
+	if !ok {
+		return nil, DbUnknownType
+	}
+	return drv.OpenDB(args...)
+}
+
+// findDriver returns the registered driver whose type or one of whose aliases
+// is the passed name.
+func findDriver(dbtype string) (DriverDB, bool) {
 	for _, drv := range driverList {
 		if drv.DbType == dbtype {
-			return drv.OpenDB(args...)
+			return drv, true
+		}
+		for _, alias := range drv.Aliases {
+			if alias == dbtype {
+				return drv, true
+			}
 		}
 	}
-	return nil, DbUnknownType
+	return DriverDB{}, false
 }
 
 // SupportedDBs returns a slice of strings that represent the database drivers
@@ -5,19 +5,20 @@
 package btcdb_test
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/bloom"
+	"github.com/conformal/btcdb/gcs"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 )
 
-var (
-	// ignoreDbTypes are types which should be ignored when running tests
-	// that iterate all supported DB types.  This allows some tests to add
-	// bogus drivers for testing purposes while still allowing other tests
-	// to easily iterate all supported drivers.
-	ignoreDbTypes = map[string]bool{"createopenfail": true}
-)
-
 // testNewestShaEmpty ensures the NewestSha returns the values expected by
 // the interface contract.
 func testNewestShaEmpty(t *testing.T, db btcdb.Db) {
@@ -37,6 +38,10 @@ func testNewestShaEmpty(t *testing.T, db btcdb.Db) {
 // TestEmptyDB tests that empty databases are handled properly.
 func TestEmptyDB(t *testing.T) {
 	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
 		// Ensure NewestSha returns expected values for a newly created
 		// db.
 		db, teardown, err := createDB(dbType, "emptydb", false)
@@ -166,6 +171,1236 @@ func TestCreateOpenUnsupported(t *testing.T) {
 	}
 }
 
+// TestSentinelErrors ensures every supported database type reports missing
+// data, modifications to a read-only database, and use after close with the
+// errors defined by btcdb.
+func TestSentinelErrors(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	genesis := btcutil.NewBlock(&btcwire.GenesisBlock)
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "errdb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.FetchBlockBySha(&zeroHash); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockBySha (%s): unexpected error - got "+
+				"%v, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		if _, err := db.FetchBlockShaByHeight(1); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockShaByHeight (%s): unexpected error "+
+				"- got %v, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		if _, err := db.FetchTxBySha(&zeroHash); err != btcdb.ErrTxNotFound {
+			t.Errorf("FetchTxBySha (%s): unexpected error - got %v, "+
+				"want %v", dbType, err, btcdb.ErrTxNotFound)
+		}
+		db.Sync()
+		db.Close()
+
+		if _, err := db.InsertBlock(genesis); err != btcdb.ErrDbClosed {
+			t.Errorf("InsertBlock after close (%s): unexpected "+
+				"error - got %v, want %v", dbType, err,
+				btcdb.ErrDbClosed)
+		}
+
+		// A memory database does not persist across opens, so create
+		// a new read-only one instead.
+		opts.ReadOnly = true
+		if dbType == "memory" {
+			db, err = btcdb.CreateDBWithOptions(dbType, opts)
+		} else {
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+		}
+		if err != nil {
+			t.Errorf("OpenDBWithOptions read-only (%s): %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlock(genesis); err != btcdb.ErrReadOnly {
+			t.Errorf("InsertBlock read-only (%s): unexpected error "+
+				"- got %v, want %v", dbType, err, btcdb.ErrReadOnly)
+		}
+		db.Close()
+	}
+}
+
+// TestCloseInFlight ensures closing a database waits for the operations in
+// progress, which either complete or fail with btcdb.ErrDbClosed, for every
+// supported database type.
+func TestCloseInFlight(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	genesis := btcutil.NewBlock(&btcwire.GenesisBlock)
+	sha, _ := genesis.Sha()
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "closedb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlock(genesis); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+		if db.Closed() {
+			t.Errorf("Closed (%s): open database reported closed",
+				dbType)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 100)
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.FetchBlockBySha(sha)
+				errs <- err
+			}()
+		}
+		db.Close()
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil && err != btcdb.ErrDbClosed {
+				t.Errorf("FetchBlockBySha while closing (%s): "+
+					"unexpected error - got %v, want nil or %v",
+					dbType, err, btcdb.ErrDbClosed)
+			}
+		}
+		if !db.Closed() {
+			t.Errorf("Closed (%s): closed database reported open",
+				dbType)
+		}
+	}
+}
+
+// TestInsertBlocks ensures runs of blocks insert atomically for every supported
+// database type.
+func TestInsertBlocks(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "insertblocks", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		// A run with a gap must fail without inserting any of its
+		// blocks.
+		_, err = db.InsertBlocks([]*btcutil.Block{blocks[0], blocks[2]})
+		if err != btcdb.PrevShaMissing {
+			t.Errorf("InsertBlocks (%s): unexpected error for "+
+				"unconnected run - got %v, want %v", dbType, err,
+				btcdb.PrevShaMissing)
+		}
+		testNewestShaEmpty(t, db)
+
+		half := len(blocks) / 2
+		for _, run := range [][]*btcutil.Block{blocks[:half], blocks[half:]} {
+			heights, err := db.InsertBlocks(run)
+			if err != nil {
+				t.Errorf("InsertBlocks (%s): %v", dbType, err)
+				break
+			}
+			for i, block := range run {
+				wantSha, _ := block.Sha()
+				sha, err := db.FetchBlockShaByHeight(heights[i])
+				if err != nil || !sha.IsEqual(wantSha) {
+					t.Errorf("InsertBlocks (%s): block %v "+
+						"not at reported height %d", dbType,
+						wantSha, heights[i])
+					break
+				}
+			}
+		}
+
+		_, height, err := db.NewestSha()
+		if err != nil || height != int64(len(blocks)-1) {
+			t.Errorf("NewestSha (%s): got height %d, want %d (err %v)",
+				dbType, height, len(blocks)-1, err)
+		}
+		teardown()
+	}
+}
+
+// TestSnapshot ensures snapshots of every supported database type are not
+// affected by blocks inserted after they were taken.
+func TestSnapshot(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "snapshot", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		half := len(blocks) / 2
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		wantSha, _ := blocks[half-1].Sha()
+		wantUtxos, err := db.UtxoSetSize()
+		if err != nil {
+			t.Errorf("UtxoSetSize (%s): %v", dbType, err)
+		}
+
+		snap, err := db.Snapshot()
+		if err != nil {
+			t.Errorf("Snapshot (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		// Bolt can't grow its memory map while a read transaction is
+		// open, so the inserts may have to wait for the snapshot to be
+		// released.
+		done := make(chan error, 1)
+		go func() {
+			_, err := db.InsertBlocks(blocks[half:])
+			done <- err
+		}()
+		if dbType != "boltdb" {
+			if err := <-done; err != nil {
+				t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			}
+			done <- nil
+		}
+
+		sha, height, err := snap.NewestSha()
+		if err != nil || height != int64(half-1) || !sha.IsEqual(wantSha) {
+			t.Errorf("Snapshot NewestSha (%s): got %v at height %d "+
+				"(err %v), want %v at height %d", dbType, sha,
+				height, err, wantSha, half-1)
+		}
+		laterSha, _ := blocks[len(blocks)-1].Sha()
+		if snap.ExistsSha(laterSha) {
+			t.Errorf("Snapshot ExistsSha (%s): later block %v is "+
+				"visible", dbType, laterSha)
+		}
+		_, err = snap.FetchBlockShaByHeight(int64(half))
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("Snapshot FetchBlockShaByHeight (%s): unexpected "+
+				"error - got %v, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		utxos, err := snap.UtxoSetSize()
+		if err != nil || utxos != wantUtxos {
+			t.Errorf("Snapshot UtxoSetSize (%s): got %d (err %v), "+
+				"want %d", dbType, utxos, err, wantUtxos)
+		}
+
+		snap.Release()
+		if _, _, err := snap.NewestSha(); err != btcdb.ErrDbClosed {
+			t.Errorf("NewestSha after release (%s): unexpected error "+
+				"- got %v, want %v", dbType, err, btcdb.ErrDbClosed)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+
+		_, height, err = db.NewestSha()
+		if err != nil || height != int64(len(blocks)-1) {
+			t.Errorf("NewestSha (%s): got height %d, want %d (err %v)",
+				dbType, height, len(blocks)-1, err)
+		}
+		teardown()
+	}
+}
+
+// TestFetchBlockRegion ensures partial reads of stored blocks return the same
+// bytes as the serialized block and reject regions outside of it.
+func TestFetchBlockRegion(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "blockregion", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		for height, block := range blocks {
+			sha, _ := block.Sha()
+			raw, _ := block.Bytes()
+			txLocs, err := block.TxLoc()
+			if err != nil {
+				t.Errorf("TxLoc: %v", err)
+				break
+			}
+
+			regions := [][2]int{{0, 80}, {0, len(raw)}}
+			for _, loc := range txLocs {
+				regions = append(regions, [2]int{loc.TxStart, loc.TxLen})
+			}
+			for _, r := range regions {
+				got, err := db.FetchBlockRegion(sha, r[0], r[1])
+				if err != nil {
+					t.Errorf("FetchBlockRegion (%s): height %d "+
+						"region %v: %v", dbType, height, r, err)
+					continue
+				}
+				if !bytes.Equal(got, raw[r[0]:r[0]+r[1]]) {
+					t.Errorf("FetchBlockRegion (%s): height %d "+
+						"region %v mismatch", dbType, height, r)
+				}
+			}
+
+			invalid := [][2]int{{-1, 10}, {0, -1}, {0, len(raw) + 1},
+				{len(raw), 1}}
+			for _, r := range invalid {
+				_, err := db.FetchBlockRegion(sha, r[0], r[1])
+				if err != btcdb.ErrInvalidRegion {
+					t.Errorf("FetchBlockRegion (%s): region %v "+
+						"got %v, want %v", dbType, r, err,
+						btcdb.ErrInvalidRegion)
+				}
+			}
+		}
+
+		var missing btcwire.ShaHash
+		_, err = db.FetchBlockRegion(&missing, 0, 80)
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockRegion (%s): missing block got %v, "+
+				"want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		teardown()
+	}
+}
+
+// TestFetchBlockBytes ensures blocks read into a caller's buffer match the
+// serialized blocks and reuse the buffer when it has room.
+func TestFetchBlockBytes(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "blockbytes", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		buf := btcdb.GetBlockBuffer()
+		for height, block := range blocks {
+			sha, _ := block.Sha()
+			raw, _ := block.Bytes()
+
+			got, err := db.FetchBlockBytesBySha(sha, buf)
+			if err != nil {
+				t.Errorf("FetchBlockBytesBySha (%s): height %d: %v",
+					dbType, height, err)
+				continue
+			}
+			if !bytes.Equal(got, raw) {
+				t.Errorf("FetchBlockBytesBySha (%s): height %d "+
+					"mismatch", dbType, height)
+			}
+			if &got[:1][0] != &buf[:1][0] {
+				t.Errorf("FetchBlockBytesBySha (%s): height %d "+
+					"did not reuse the buffer", dbType, height)
+			}
+
+			// A buffer which is too small is grown.
+			got, err = db.FetchBlockBytesBySha(sha, make([]byte, 5, 10))
+			if err != nil || !bytes.Equal(got, raw) {
+				t.Errorf("FetchBlockBytesBySha (%s): height %d "+
+					"small buffer mismatch (%v)", dbType,
+					height, err)
+			}
+		}
+		btcdb.PutBlockBuffer(buf)
+
+		var missing btcwire.ShaHash
+		_, err = db.FetchBlockBytesBySha(&missing, nil)
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockBytesBySha (%s): missing block got "+
+				"%v, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		teardown()
+	}
+}
+
+// TestFetchHeaders ensures headers fetched by height, individually and as a
+// range, match the headers of the inserted blocks.
+func TestFetchHeaders(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:20]
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "fetchheaders", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		for height, block := range blocks {
+			wantSha, _ := block.Sha()
+			bh, err := db.FetchBlockHeaderByHeight(int64(height))
+			if err != nil {
+				t.Errorf("FetchBlockHeaderByHeight (%s): height "+
+					"%d: %v", dbType, height, err)
+				continue
+			}
+			gotSha, _ := bh.BlockSha()
+			if !gotSha.IsEqual(wantSha) {
+				t.Errorf("FetchBlockHeaderByHeight (%s): height "+
+					"%d got %v, want %v", dbType, height,
+					gotSha, wantSha)
+			}
+		}
+		_, err = db.FetchBlockHeaderByHeight(int64(len(blocks)))
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockHeaderByHeight (%s): past the end "+
+				"got %v, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+
+		tests := []struct {
+			start, end int64
+			want       int
+		}{
+			{0, int64(len(blocks)), len(blocks)},
+			{5, 10, 5},
+			{7, 7, 0},
+			{15, btcdb.AllShas, len(blocks) - 15},
+			{int64(len(blocks)) - 2, int64(len(blocks)) + 10, 2},
+		}
+		for _, test := range tests {
+			headers, err := db.FetchHeaderRange(test.start, test.end)
+			if err != nil {
+				t.Errorf("FetchHeaderRange (%s): %d-%d: %v", dbType,
+					test.start, test.end, err)
+				continue
+			}
+			if len(headers) != test.want {
+				t.Errorf("FetchHeaderRange (%s): %d-%d got %d "+
+					"headers, want %d", dbType, test.start,
+					test.end, len(headers), test.want)
+				continue
+			}
+			for i := range headers {
+				wantSha, _ := blocks[int(test.start)+i].Sha()
+				gotSha, _ := headers[i].BlockSha()
+				if !gotSha.IsEqual(wantSha) {
+					t.Errorf("FetchHeaderRange (%s): %d-%d "+
+						"header %d got %v, want %v", dbType,
+						test.start, test.end, i, gotSha,
+						wantSha)
+				}
+			}
+		}
+		if _, err := db.FetchHeaderRange(-1, 5); err == nil {
+			t.Errorf("FetchHeaderRange (%s): negative start height "+
+				"did not fail", dbType)
+		}
+		if _, err := db.FetchHeaderRange(5, 4); err == nil {
+			t.Errorf("FetchHeaderRange (%s): end height before start "+
+				"height did not fail", dbType)
+		}
+		teardown()
+	}
+}
+
+// TestExistsShas ensures the batch existence checks agree with looking up each
+// hash on its own.
+func TestExistsShas(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	var blockShas, txShas []btcwire.ShaHash
+	for _, block := range blocks {
+		sha, _ := block.Sha()
+		blockShas = append(blockShas, *sha)
+		for _, tx := range block.Transactions() {
+			txShas = append(txShas, *tx.Sha())
+		}
+	}
+	// Hashes which are not in the database are mixed in with those which
+	// are, and a block hash is never a transaction hash.
+	blockShas = append(blockShas, btcwire.ShaHash{}, txShas[0])
+	txShas = append(txShas, btcwire.ShaHash{}, blockShas[0])
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "existsshas", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		exists := db.ExistsShas(blockShas)
+		if len(exists) != len(blockShas) {
+			t.Errorf("ExistsShas (%s): got %d results, want %d",
+				dbType, len(exists), len(blockShas))
+		} else {
+			for i := range blockShas {
+				want := i < len(blocks)
+				if exists[i] != want ||
+					db.ExistsSha(&blockShas[i]) != want {
+
+					t.Errorf("ExistsShas (%s): %v got %v, "+
+						"want %v", dbType, blockShas[i],
+						exists[i], want)
+				}
+			}
+		}
+
+		exists = db.ExistsTxShas(txShas)
+		if len(exists) != len(txShas) {
+			t.Errorf("ExistsTxShas (%s): got %d results, want %d",
+				dbType, len(exists), len(txShas))
+		} else {
+			for i := range txShas {
+				want := db.ExistsTxSha(&txShas[i])
+				if exists[i] != want {
+					t.Errorf("ExistsTxShas (%s): %v got %v, "+
+						"want %v", dbType, txShas[i],
+						exists[i], want)
+				}
+			}
+			if exists[len(txShas)-1] || exists[len(txShas)-2] {
+				t.Errorf("ExistsTxShas (%s): missing hash "+
+					"reported as present", dbType)
+			}
+		}
+
+		if len(db.ExistsShas(nil)) != 0 || len(db.ExistsTxShas(nil)) != 0 {
+			t.Errorf("Exists (%s): results for no hashes", dbType)
+		}
+		teardown()
+	}
+}
+
+// TestFetchSpendingTx ensures the spending transaction of every output spent by
+// the test blocks is reported and that the entries are removed along with the
+// blocks which spent them.  Drivers which only maintain the spend index on
+// request have it enabled part way through to ensure it is built from the
+// blocks already stored.
+func TestFetchSpendingTx(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	type spendIndexer interface {
+		EnableSpendIndex(bool) error
+	}
+
+	half := len(blocks) / 2
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "spendingtx", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		if indexer, ok := db.(spendIndexer); ok {
+			op := blocks[0].MsgBlock().Transactions[0].TxIn[0].PreviousOutpoint
+			_, err := db.FetchSpendingTx(&op)
+			if err != btcdb.ErrNoSpendIndex {
+				t.Errorf("FetchSpendingTx (%s): unexpected error "+
+					"with index disabled - got %v, want %v",
+					dbType, err, btcdb.ErrNoSpendIndex)
+			}
+			if err := indexer.EnableSpendIndex(true); err != nil {
+				t.Errorf("EnableSpendIndex (%s): %v", dbType, err)
+				teardown()
+				continue
+			}
+		}
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		var spends int
+		checkSpends := func(from int, spent bool) {
+			for height := from; height < len(blocks); height++ {
+				for _, tx := range blocks[height].Transactions()[1:] {
+					for inIdx, txIn := range tx.MsgTx().TxIn {
+						op := txIn.PreviousOutpoint
+						got, err := db.FetchSpendingTx(&op)
+						if err != nil {
+							t.Errorf("FetchSpendingTx (%s): %v",
+								dbType, err)
+							return
+						}
+						if !spent {
+							if got != nil {
+								t.Errorf("FetchSpendingTx (%s): "+
+									"%v still spent", dbType, op)
+							}
+							continue
+						}
+						spends++
+						if got == nil || !got.Sha.IsEqual(tx.Sha()) ||
+							got.Height != int64(height) ||
+							got.InputIndex != uint32(inIdx) {
+
+							t.Errorf("FetchSpendingTx (%s): %v got "+
+								"%+v, want %v at height %d "+
+								"input %d", dbType, op, got,
+								tx.Sha(), height, inIdx)
+						}
+					}
+				}
+			}
+		}
+		checkSpends(0, true)
+		if spends == 0 {
+			t.Errorf("FetchSpendingTx (%s): test blocks spend no outputs",
+				dbType)
+		}
+
+		// The outputs of the last coinbase are never spent.
+		lastTx := blocks[len(blocks)-1].Transactions()[0]
+		op := btcwire.NewOutPoint(lastTx.Sha(), 0)
+		if got, err := db.FetchSpendingTx(op); got != nil || err != nil {
+			t.Errorf("FetchSpendingTx (%s): unspent output got %+v, %v",
+				dbType, got, err)
+		}
+
+		dropSha, _ := blocks[half-1].Sha()
+		if err := db.DropAfterBlockBySha(dropSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkSpends(half, false)
+		teardown()
+	}
+}
+
+// TestIsOutpointSpent ensures the spent status of every output of the test
+// blocks is reported for every supported database type, and that the outputs
+// spent by blocks which are dropped are unspent again.
+func TestIsOutpointSpent(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// checkSpent ensures every output of the passed blocks is reported as
+	// spent exactly when it is spent by one of them.
+	checkSpent := func(dbType string, db btcdb.Db, blocks []*btcutil.Block) {
+		spent := make(map[btcwire.OutPoint]bool)
+		for _, block := range blocks {
+			for _, tx := range block.Transactions()[1:] {
+				for _, txIn := range tx.MsgTx().TxIn {
+					spent[txIn.PreviousOutpoint] = true
+				}
+			}
+		}
+		var spends int
+		for _, block := range blocks {
+			for _, tx := range block.Transactions() {
+				outs := uint32(len(tx.MsgTx().TxOut))
+				for idx := uint32(0); idx <= outs; idx++ {
+					op := btcwire.NewOutPoint(tx.Sha(), idx)
+					want := idx == outs || spent[*op]
+					got, err := db.IsOutpointSpent(op)
+					if err != nil || got != want {
+						t.Errorf("IsOutpointSpent (%s): got %v "+
+							"(err %v) for %v, want %v",
+							dbType, got, err, op, want)
+					}
+					if got && idx != outs {
+						spends++
+					}
+				}
+			}
+		}
+		if spends == 0 {
+			t.Errorf("IsOutpointSpent (%s): test blocks spend no "+
+				"outputs", dbType)
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "outpointspent", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkSpent(dbType, db, blocks)
+
+		op := btcwire.NewOutPoint(&zeroHash, 0)
+		if _, err := db.IsOutpointSpent(op); err != btcdb.ErrTxNotFound {
+			t.Errorf("IsOutpointSpent (%s): got %v for an unknown "+
+				"transaction, want %v", dbType, err,
+				btcdb.ErrTxNotFound)
+		}
+
+		// The test blocks spend outputs both before and after the
+		// block which is kept.
+		dropSha, _ := blocks[200].Sha()
+		if err := db.DropAfterBlockBySha(dropSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkSpent(dbType, db, blocks[:201])
+		teardown()
+	}
+}
+
+// TestFetchUnSpentTxByShaList ensures every supported database type returns
+// the spent status of each output and the height of every transaction of the
+// test blocks, tells fully spent transactions from ones which never existed,
+// and keeps the replies in the order of the requested hashes.
+func TestFetchUnSpentTxByShaList(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// Build the requested hashes in reverse so they are not in the order
+	// the transactions are stored in, along with the expected spent status
+	// of their outputs.  Every other hash is one that does not exist.
+	spent := make(map[btcwire.OutPoint]bool)
+	for _, block := range blocks {
+		for _, tx := range block.MsgBlock().Transactions {
+			for _, txIn := range tx.TxIn {
+				spent[txIn.PreviousOutpoint] = true
+			}
+		}
+	}
+	var txShas []*btcwire.ShaHash
+	var wantSpent [][]bool
+	var heights []int64
+	var fullySpent int
+	for height := len(blocks) - 1; height >= 0; height-- {
+		for _, tx := range blocks[height].Transactions() {
+			txSpent := make([]bool, len(tx.MsgTx().TxOut))
+			allSpent := true
+			for idx := range txSpent {
+				op := btcwire.NewOutPoint(tx.Sha(), uint32(idx))
+				txSpent[idx] = spent[*op]
+				allSpent = allSpent && txSpent[idx]
+			}
+			if allSpent {
+				txSpent = nil
+				fullySpent++
+			}
+			txShas = append(txShas, tx.Sha())
+			wantSpent = append(wantSpent, txSpent)
+			heights = append(heights, int64(height))
+
+			missing := *tx.Sha()
+			missing[0] ^= 0xff
+			txShas = append(txShas, &missing)
+			wantSpent = append(wantSpent, nil)
+			heights = append(heights, -1)
+		}
+	}
+	if fullySpent == 0 {
+		t.Errorf("FetchUnSpentTxByShaList: test blocks fully spend no " +
+			"transactions")
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "unspenttxlist", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		replies := db.FetchUnSpentTxByShaList(txShas)
+		if len(replies) != len(txShas) {
+			t.Errorf("FetchUnSpentTxByShaList (%s): got %d replies, "+
+				"want %d", dbType, len(replies), len(txShas))
+			teardown()
+			continue
+		}
+		for i, reply := range replies {
+			if !reply.Sha.IsEqual(txShas[i]) {
+				t.Errorf("FetchUnSpentTxByShaList (%s): reply %d "+
+					"is for %v, want %v", dbType, i, reply.Sha,
+					txShas[i])
+				break
+			}
+
+			switch {
+			// Transactions which do not exist are not fully spent.
+			case heights[i] == -1:
+				if reply.Err != btcdb.TxShaMissing || reply.FullySpent {
+					t.Errorf("FetchUnSpentTxByShaList (%s): "+
+						"missing tx %v got err %v fully "+
+						"spent %v", dbType, txShas[i],
+						reply.Err, reply.FullySpent)
+				}
+
+			// Transactions whose outputs are all spent are only
+			// reported as fully spent at their height.
+			case wantSpent[i] == nil:
+				if reply.Err != btcdb.TxShaMissing ||
+					!reply.FullySpent || reply.Tx != nil ||
+					reply.Height != heights[i] {
+
+					t.Errorf("FetchUnSpentTxByShaList (%s): "+
+						"fully spent tx %v got err %v "+
+						"fully spent %v at height %d, "+
+						"want height %d", dbType,
+						txShas[i], reply.Err,
+						reply.FullySpent, reply.Height,
+						heights[i])
+				}
+
+			default:
+				if reply.Err != nil || reply.FullySpent ||
+					reply.Height != heights[i] ||
+					!reflect.DeepEqual(reply.TxSpent, wantSpent[i]) {
+
+					t.Errorf("FetchUnSpentTxByShaList (%s): "+
+						"tx %v got err %v fully spent %v "+
+						"spent %v at height %d, want "+
+						"spent %v at height %d", dbType,
+						txShas[i], reply.Err,
+						reply.FullySpent, reply.TxSpent,
+						reply.Height, wantSpent[i],
+						heights[i])
+				}
+			}
+		}
+		teardown()
+	}
+}
+
+// TestFilters ensures the basic filter and filter header of every block match
+// ones built directly from the test blocks, including after blocks are dropped
+// and inserted again.  Drivers which only maintain filters on request have them
+// enabled part way through to ensure they are built from the blocks already
+// stored.
+func TestFilters(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// Build the expected filters and filter headers of the test blocks.
+	txns := make(map[btcwire.ShaHash]*btcwire.MsgTx)
+	for _, block := range blocks {
+		for _, tx := range block.Transactions() {
+			txns[*tx.Sha()] = tx.MsgTx()
+		}
+	}
+	fetchTx := func(sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+		return txns[*sha], nil
+	}
+	filters := make([][]byte, len(blocks))
+	headers := make([]btcwire.ShaHash, len(blocks))
+	for i, block := range blocks {
+		filters[i], err = gcs.BuildBasicFilter(block, fetchTx)
+		if err != nil {
+			t.Errorf("BuildBasicFilter: %v", err)
+			return
+		}
+		var prevHeader btcwire.ShaHash
+		if i > 0 {
+			prevHeader = headers[i-1]
+		}
+		headers[i] = gcs.FilterHeader(filters[i], &prevHeader)
+	}
+
+	type filterIndexer interface {
+		EnableFilterIndex(bool) error
+	}
+
+	half := len(blocks) / 2
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "filters", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		if indexer, ok := db.(filterIndexer); ok {
+			sha, _ := blocks[0].Sha()
+			_, err := db.FetchFilterBySha(sha)
+			if err != btcdb.ErrNoFilterIndex {
+				t.Errorf("FetchFilterBySha (%s): unexpected error "+
+					"with filters disabled - got %v, want %v",
+					dbType, err, btcdb.ErrNoFilterIndex)
+			}
+			if err := indexer.EnableFilterIndex(true); err != nil {
+				t.Errorf("EnableFilterIndex (%s): %v", dbType, err)
+				teardown()
+				continue
+			}
+		}
+
+		checkFilters := func() {
+			for i, block := range blocks {
+				sha, _ := block.Sha()
+				filter, err := db.FetchFilterBySha(sha)
+				if err != nil || !bytes.Equal(filter, filters[i]) {
+					t.Errorf("FetchFilterBySha (%s): height %d "+
+						"got %x, %v, want %x", dbType, i,
+						filter, err, filters[i])
+					return
+				}
+				header, err := db.FetchFilterHeaderBySha(sha)
+				if err != nil || !header.IsEqual(&headers[i]) {
+					t.Errorf("FetchFilterHeaderBySha (%s): "+
+						"height %d got %v, %v, want %v",
+						dbType, i, header, err, &headers[i])
+					return
+				}
+			}
+
+			gotFilters, err := db.FetchFilterRange(0, btcdb.AllShas)
+			if err != nil || !reflect.DeepEqual(gotFilters, filters) {
+				t.Errorf("FetchFilterRange (%s): got %d filters, "+
+					"%v, want %d", dbType, len(gotFilters), err,
+					len(filters))
+			}
+			gotHeaders, err := db.FetchFilterHeaderRange(int64(half),
+				int64(half+3))
+			if err != nil ||
+				!reflect.DeepEqual(gotHeaders, headers[half:half+3]) {
+
+				t.Errorf("FetchFilterHeaderRange (%s): got %v, %v, "+
+					"want %v", dbType, gotHeaders, err,
+					headers[half:half+3])
+			}
+		}
+
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkFilters()
+
+		// Every script the last block pays to is in its filter.
+		last := blocks[len(blocks)-1]
+		lastSha, _ := last.Sha()
+		for _, tx := range last.Transactions() {
+			for _, txOut := range tx.MsgTx().TxOut {
+				match, err := gcs.MatchBasic(filters[len(blocks)-1],
+					lastSha, txOut.PkScript)
+				if err != nil || !match {
+					t.Errorf("MatchBasic (%s): script %x "+
+						"got %v, %v", dbType, txOut.PkScript,
+						match, err)
+				}
+			}
+		}
+
+		// The filters of blocks inserted again after a drop chain from
+		// the block they were dropped back to.
+		dropSha, _ := blocks[half-1].Sha()
+		if err := db.DropAfterBlockBySha(dropSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		gotHeaders, err := db.FetchFilterHeaderRange(0, btcdb.AllShas)
+		if err != nil || len(gotHeaders) != half {
+			t.Errorf("FetchFilterHeaderRange (%s): got %d headers "+
+				"after drop, %v, want %d", dbType,
+				len(gotHeaders), err, half)
+		}
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkFilters()
+
+		if _, err := db.FetchFilterRange(-1, 1); err == nil {
+			t.Errorf("FetchFilterRange (%s): negative start height "+
+				"did not fail", dbType)
+		}
+		teardown()
+	}
+}
+
+// TestFetchMerkleBlock ensures merkle blocks of stored blocks prove the
+// transactions matched by a bloom filter for all supported database types.
+func TestFetchMerkleBlock(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:171]
+
+	// The second transaction of block 170 pays change to the public key
+	// the coinbase of block 9 pays to.
+	pkScript := blocks[9].MsgBlock().Transactions[0].TxOut[0].PkScript
+	pubKey := pkScript[1 : len(pkScript)-1]
+	sha, _ := blocks[170].Sha()
+	want := blocks[170].Transactions()[1].Sha()
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "merkleblock", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		filter := bloom.NewFilter(1, 0, 0.0001, bloom.UpdateNone)
+		filter.Add(pubKey)
+		mb, txs, err := bloom.FetchMerkleBlock(db, sha, filter)
+		if err != nil {
+			t.Errorf("FetchMerkleBlock (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		matches, err := mb.ExtractMatches()
+		if err != nil || len(txs) != 1 || !txs[0].Sha().IsEqual(want) ||
+			!reflect.DeepEqual(matches, []*btcwire.ShaHash{want}) {
+			t.Errorf("FetchMerkleBlock (%s): got %d txs and matches "+
+				"%v (err %v), want %v", dbType, len(txs), matches,
+				err, want)
+		}
+
+		_, _, err = bloom.FetchMerkleBlock(db, &zeroHash, filter)
+		if err == nil {
+			t.Errorf("FetchMerkleBlock (%s): found a block which is "+
+				"not stored", dbType)
+		}
+		teardown()
+	}
+}
+
+// TestDropAfterBlockAtomic ensures a drop which fails part way leaves the
+// blocks, the transaction index and the indexers as they were, including once
+// later changes are committed.
+func TestDropAfterBlockAtomic(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	const n = 10
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "dropatomic", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		idx := new(testIndexer)
+		if err := db.AddIndexer(idx); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:n]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		// Fail the drop once every block has been unwound and then
+		// commit another block so any changes left behind by the
+		// failed drop would be written along with it.
+		idx.failDisconnect = true
+		keepSha, _ := blocks[n/2-1].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err == nil {
+			t.Errorf("DropAfterBlockBySha (%s): unexpected success "+
+				"with failing indexer", dbType)
+		}
+		idx.failDisconnect = false
+		if _, err := db.InsertBlock(blocks[n]); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+		}
+
+		wantSha, _ := blocks[n].Sha()
+		sha, height, err := db.NewestSha()
+		if err != nil || height != n || !sha.IsEqual(wantSha) {
+			t.Errorf("NewestSha (%s): got %v at %d (%v), want %v "+
+				"at %d", dbType, sha, height, err, wantSha, n)
+		}
+		for height := n / 2; height <= n; height++ {
+			for _, tx := range blocks[height].Transactions() {
+				replies, err := db.FetchTxBySha(tx.Sha())
+				if err != nil || len(replies) == 0 ||
+					replies[len(replies)-1].Height != int64(height) {
+					t.Errorf("FetchTxBySha (%s): tx %v of "+
+						"block %d missing (%v)", dbType,
+						tx.Sha(), height, err)
+				}
+			}
+		}
+		tipSha, tipHeight, err := idx.Tip()
+		if err != nil || tipHeight != n || !tipSha.IsEqual(wantSha) {
+			t.Errorf("Tip (%s): got %v at %d (%v), want %v at %d",
+				dbType, tipSha, tipHeight, err, wantSha, n)
+		}
+		teardown()
+	}
+}
+
 // TestInterface performs tests for the various interfaces of btcdb which
 // require state in the database for each supported database type (those loaded
 // in common_test.go that is).
@@ -0,0 +1,274 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package dbtest
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"math/big"
+	"time"
+)
+
+// regtestHalvingInterval is the number of blocks after which the subsidy of the
+// regression test network halves.
+const regtestHalvingInterval = 150
+
+// opTrue is an output script anyone can spend, which is also pushed by the
+// signature scripts spending it.
+var opTrue = []byte{0x51}
+
+// RegtestGenesis returns the genesis block of the regression test network.
+func RegtestGenesis() *btcutil.Block {
+	return btcutil.NewBlock(&btcwire.TestNetGenesisBlock)
+}
+
+// merkleRoot returns the merkle root of the passed transactions.
+func merkleRoot(txs []*btcwire.MsgTx) btcwire.ShaHash {
+	level := make([]btcwire.ShaHash, 0, len(txs))
+	for _, tx := range txs {
+		sha, _ := tx.TxSha()
+		level = append(level, sha)
+	}
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]btcwire.ShaHash, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			var buf [btcwire.HashSize * 2]byte
+			copy(buf[:btcwire.HashSize], level[i].Bytes())
+			copy(buf[btcwire.HashSize:], level[i+1].Bytes())
+			var sha btcwire.ShaHash
+			sha.SetBytes(btcwire.DoubleSha256(buf[:]))
+			next = append(next, sha)
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// solveBlock sets the nonce of the passed block to the first one giving it a
+// hash which meets its target difficulty.
+func solveBlock(msgBlock *btcwire.MsgBlock) {
+	header := &msgBlock.Header
+	exp := uint(header.Bits >> 24)
+	target := new(big.Int).SetUint64(uint64(header.Bits & 0x007fffff))
+	target.Lsh(target, 8*(exp-3))
+
+	for nonce := uint32(0); nonce < math.MaxUint32; nonce++ {
+		header.Nonce = nonce
+		sha, _ := header.BlockSha()
+		buf := sha.Bytes()
+		for i := 0; i < len(buf)/2; i++ {
+			buf[i], buf[len(buf)-1-i] = buf[len(buf)-1-i], buf[i]
+		}
+		if new(big.Int).SetBytes(buf).Cmp(target) <= 0 {
+			return
+		}
+	}
+}
+
+// spendable is an output created by a ChainGenerator which a later block may
+// spend.
+type spendable struct {
+	outPoint btcwire.OutPoint
+	value    int64
+	height   int64
+	coinbase bool
+}
+
+// ChainGenerator generates a deterministic chain of regression test blocks
+// starting with the genesis block, for tests which need blocks without
+// hand-crafted fixtures or network access.  The blocks meet their target
+// difficulty and commit to their transactions, so they pass the checks of
+// btcdb.ValidateStrict, and the same generator settings always give the same
+// blocks.
+//
+// Each block has a coinbase claiming the subsidy, whose signature script holds
+// the height of the block and the tag of the generator, followed by up to
+// TxsPerBlock transactions.  Each of those spends the InputsPerTx oldest
+// outputs created by earlier blocks which are still unspent, once coinbase
+// outputs are CoinbaseMaturity blocks deep, and splits their value evenly into
+// OutputsPerTx outputs.  Fewer transactions are made when there are not enough
+// outputs to spend.  Every output pays to a script anyone can spend.
+type ChainGenerator struct {
+	// TxsPerBlock is the largest number of transactions of each block
+	// besides its coinbase.
+	TxsPerBlock int
+
+	// InputsPerTx and OutputsPerTx are the number of inputs and outputs
+	// of each transaction besides the coinbase.  Zero stands for one.
+	InputsPerTx  int
+	OutputsPerTx int
+
+	// CoinbaseMaturity is the number of blocks the output of a coinbase
+	// must be below the block spending it, which is 100 on every network
+	// but is not checked by the database.  Zero spends coinbases from the
+	// next block on.
+	CoinbaseMaturity int64
+
+	tag     byte
+	prev    *btcutil.Block
+	height  int64
+	unspent []spendable
+}
+
+// NewChainGenerator returns a generator whose first block is the genesis block
+// of the regression test network, followed by blocks with the passed number of
+// transactions besides the coinbase.
+func NewChainGenerator(txsPerBlock int) *ChainGenerator {
+	return &ChainGenerator{TxsPerBlock: txsPerBlock, height: -1}
+}
+
+// Height returns the height of the last block generated, which is -1 before
+// the genesis block is.
+func (g *ChainGenerator) Height() int64 {
+	return g.height
+}
+
+// Tip returns the last block generated, which is nil before the genesis block
+// is.
+func (g *ChainGenerator) Tip() *btcutil.Block {
+	return g.prev
+}
+
+// Fork returns a generator with the same settings whose blocks follow the last
+// block generated, such as to build a side chain, while the blocks of g go on
+// as before.  The passed tag is put into the coinbases of the blocks of the
+// new generator so they differ from the blocks of g at the same heights, which
+// they do not when the tags are the same.
+func (g *ChainGenerator) Fork(tag byte) *ChainGenerator {
+	fork := *g
+	fork.tag = tag
+	fork.unspent = append([]spendable(nil), g.unspent...)
+	return &fork
+}
+
+// takeSpendable removes the passed number of the oldest unspent outputs which
+// the block at the passed height may spend and returns them, or returns nil
+// and leaves the outputs as they are when there are not as many.
+func (g *ChainGenerator) takeSpendable(height int64, n int) []spendable {
+	taken := make([]spendable, 0, n)
+	rest := make([]spendable, 0, len(g.unspent))
+	for _, s := range g.unspent {
+		if len(taken) == n || (s.coinbase &&
+			height-s.height < g.CoinbaseMaturity) {
+			rest = append(rest, s)
+			continue
+		}
+		taken = append(taken, s)
+	}
+	if len(taken) < n {
+		return nil
+	}
+	g.unspent = rest
+	return taken
+}
+
+// NextBlock generates the block following the last one.
+func (g *ChainGenerator) NextBlock() *btcutil.Block {
+	if g.prev == nil {
+		genesis := RegtestGenesis()
+		g.prev, g.height = genesis, 0
+		return genesis
+	}
+	g.height++
+
+	var script [6]byte
+	script[0] = 5
+	binary.LittleEndian.PutUint32(script[1:5], uint32(g.height))
+	script[5] = g.tag
+	coinbase := btcwire.NewMsgTx()
+	coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(
+		&btcwire.ShaHash{}, math.MaxUint32), script[:]))
+	coinbase.AddTxOut(btcwire.NewTxOut(btcdb.CalcBlockSubsidy(g.height,
+		regtestHalvingInterval), opTrue))
+	txs := []*btcwire.MsgTx{coinbase}
+
+	inputs, outputs := g.InputsPerTx, g.OutputsPerTx
+	if inputs < 1 {
+		inputs = 1
+	}
+	if outputs < 1 {
+		outputs = 1
+	}
+	var created []spendable
+	for i := 0; i < g.TxsPerBlock; i++ {
+		spent := g.takeSpendable(g.height, inputs)
+		if spent == nil {
+			break
+		}
+		tx := btcwire.NewMsgTx()
+		var total int64
+		for j := range spent {
+			tx.AddTxIn(btcwire.NewTxIn(&spent[j].outPoint, opTrue))
+			total += spent[j].value
+		}
+
+		value := total / int64(outputs)
+		for j := 0; j < outputs; j++ {
+			if j == 0 {
+				tx.AddTxOut(btcwire.NewTxOut(total-value*
+					int64(outputs-1), opTrue))
+				continue
+			}
+			tx.AddTxOut(btcwire.NewTxOut(value, opTrue))
+		}
+		txs = append(txs, tx)
+
+		sha, _ := tx.TxSha()
+		for j, txOut := range tx.TxOut {
+			created = append(created, spendable{
+				outPoint: *btcwire.NewOutPoint(&sha, uint32(j)),
+				value:    txOut.Value,
+				height:   g.height,
+			})
+		}
+	}
+	coinbaseSha, _ := coinbase.TxSha()
+	g.unspent = append(g.unspent, spendable{
+		outPoint: *btcwire.NewOutPoint(&coinbaseSha, 0),
+		value:    coinbase.TxOut[0].Value,
+		height:   g.height,
+		coinbase: true,
+	})
+	g.unspent = append(g.unspent, created...)
+
+	prevSha, _ := g.prev.Sha()
+	prevHeader := &g.prev.MsgBlock().Header
+	root := merkleRoot(txs)
+	header := btcwire.NewBlockHeader(prevSha, &root, prevHeader.Bits, 0)
+	header.Timestamp = prevHeader.Timestamp.Add(10 * time.Minute)
+	msgBlock := btcwire.NewMsgBlock(header)
+	for _, tx := range txs {
+		msgBlock.AddTransaction(tx)
+	}
+	solveBlock(msgBlock)
+
+	g.prev = btcutil.NewBlock(msgBlock)
+	return g.prev
+}
+
+// NextBlocks generates the passed number of blocks following the last one.
+func (g *ChainGenerator) NextBlocks(n int) []*btcutil.Block {
+	blocks := make([]*btcutil.Block, 0, n)
+	for i := 0; i < n; i++ {
+		blocks = append(blocks, g.NextBlock())
+	}
+	return blocks
+}
+
+// InsertChain generates the passed number of blocks with the passed generator
+// and inserts them into the passed database, which must hold the blocks the
+// generator made before, as a single change.  The blocks are returned along
+// with the error from InsertBlocks.
+func InsertChain(db btcdb.Db, g *ChainGenerator, n int) ([]*btcutil.Block, error) {
+	blocks := g.NextBlocks(n)
+	_, err := db.InsertBlocks(blocks)
+	return blocks, err
+}
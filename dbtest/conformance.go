@@ -0,0 +1,596 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package dbtest
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+const (
+	// suiteChainLen is the number of blocks after the genesis block of the
+	// chain inserted by RunInterfaceTests.
+	suiteChainLen = 20
+
+	// suiteForkHeight is the height of the block after which the chain is
+	// reorganized to a side chain.
+	suiteForkHeight = 12
+
+	// suiteSideLen is the number of blocks of the side chain, which is
+	// longer than the part of the chain it replaces.
+	suiteSideLen = 10
+)
+
+// suite is the state of a running RunInterfaceTests.  Blocks holds the chain
+// the database is expected to hold, starting with the genesis block.
+type suite struct {
+	t      *testing.T
+	dbType string
+	db     btcdb.Db
+	blocks []*btcutil.Block
+}
+
+// errorf reports a failure of the driver under test.
+func (s *suite) errorf(format string, args ...interface{}) {
+	s.t.Errorf("%s: "+format, append([]interface{}{s.dbType}, args...)...)
+}
+
+// RunInterfaceTests checks that the database driver registered under the
+// passed type follows the contract of btcdb.Db as the leveldb driver does, so
+// the authors of other drivers run it from their own tests.  A database is
+// created with btcdb.CreateDB and the passed arguments, which must create a new
+// empty database, such as the path of a directory which does not exist yet,
+// and is closed before it returns.
+//
+// The suite inserts a chain of regression test blocks one at a time and checks
+// every block and transaction can be fetched back, the spent state of their
+// outputs, the errors returned for blocks and transactions which are not
+// stored and for blocks which do not connect, dropping and inserting blocks
+// again, reorganizing to a side chain, the metadata namespace and the behavior
+// once the database is closed.
+func RunInterfaceTests(t *testing.T, dbType string, args ...interface{}) {
+	db, err := btcdb.CreateDB(dbType, args...)
+	if err != nil {
+		t.Errorf("%s: unable to create database: %v", dbType, err)
+		return
+	}
+	defer func() {
+		if !db.Closed() {
+			db.Close()
+		}
+	}()
+
+	s := &suite{t: t, dbType: dbType, db: db}
+	if !s.testEmpty() {
+		return
+	}
+
+	// Every block spends the oldest outputs left unspent into two
+	// outputs each, leaving transactions unspent, partly spent and fully
+	// spent.
+	gen := NewChainGenerator(2)
+	gen.OutputsPerTx = 2
+	var fork *ChainGenerator
+	for height := int64(0); height <= suiteChainLen; height++ {
+		if !s.testInsertBlock(gen.NextBlock(), height) {
+			return
+		}
+		if height == suiteForkHeight {
+			fork = gen.Fork(2)
+		}
+	}
+	for height := range s.blocks {
+		if !s.testBlock(int64(height)) {
+			return
+		}
+	}
+	if !s.testHeightRange() || !s.testNotFound() ||
+		!s.testBadInserts(gen.Fork(1)) {
+		return
+	}
+	if !s.testDrop(suiteChainLen / 2) {
+		return
+	}
+	if !s.testReorg(fork) || !s.testMeta() {
+		return
+	}
+	s.testClose()
+}
+
+// checkNewest ensures the newest block of the database is the last block of
+// the expected chain.
+func (s *suite) checkNewest() bool {
+	sha, height, err := s.db.NewestSha()
+	if err != nil {
+		s.errorf("NewestSha: %v", err)
+		return false
+	}
+	wantHeight := int64(len(s.blocks) - 1)
+	wantSha := &btcwire.ShaHash{}
+	if wantHeight >= 0 {
+		wantSha, _ = s.blocks[wantHeight].Sha()
+	}
+	if height != wantHeight || !sha.IsEqual(wantSha) {
+		s.errorf("NewestSha: got %v at height %d, want %v at height %d",
+			sha, height, wantSha, wantHeight)
+		return false
+	}
+	return true
+}
+
+// testEmpty ensures a new database holds no blocks.
+func (s *suite) testEmpty() bool {
+	if !s.checkNewest() {
+		return false
+	}
+	genesisSha, _ := RegtestGenesis().Sha()
+	if s.db.ExistsSha(genesisSha) {
+		s.errorf("ExistsSha: new database holds the genesis block")
+		return false
+	}
+	if _, err := s.db.FetchBlockShaByHeight(0); err != btcdb.ErrBlockNotFound {
+		s.errorf("FetchBlockShaByHeight: got %v for height 0 of a new "+
+			"database, want %v", err, btcdb.ErrBlockNotFound)
+		return false
+	}
+	return true
+}
+
+// testInsertBlock ensures the passed block inserts at the passed height and
+// becomes the newest block.
+func (s *suite) testInsertBlock(block *btcutil.Block, height int64) bool {
+	got, err := s.db.InsertBlock(block)
+	if err != nil {
+		s.errorf("InsertBlock: block #%d: %v", height, err)
+		return false
+	}
+	if got != height {
+		s.errorf("InsertBlock: got height %d, want %d", got, height)
+		return false
+	}
+	s.blocks = append(s.blocks, block)
+	return s.checkNewest()
+}
+
+// spentOutputs returns the outputs spent by the expected chain.
+func (s *suite) spentOutputs() map[btcwire.OutPoint]bool {
+	spent := make(map[btcwire.OutPoint]bool)
+	for _, block := range s.blocks {
+		for _, tx := range block.MsgBlock().Transactions[1:] {
+			for _, txIn := range tx.TxIn {
+				spent[txIn.PreviousOutpoint] = true
+			}
+		}
+	}
+	return spent
+}
+
+// testBlock ensures the block of the expected chain at the passed height and
+// its transactions are fetched back as they were inserted, along with the
+// spent state of their outputs.
+func (s *suite) testBlock(height int64) bool {
+	block := s.blocks[height]
+	sha, _ := block.Sha()
+	if !s.db.ExistsSha(sha) {
+		s.errorf("ExistsSha: block #%d does not exist", height)
+		return false
+	}
+
+	got, err := s.db.FetchBlockBySha(sha)
+	if err != nil {
+		s.errorf("FetchBlockBySha: block #%d: %v", height, err)
+		return false
+	}
+	gotBytes, _ := got.Bytes()
+	wantBytes, _ := block.Bytes()
+	if !bytes.Equal(gotBytes, wantBytes) {
+		s.errorf("FetchBlockBySha: block #%d differs from the one "+
+			"inserted", height)
+		return false
+	}
+
+	gotHeight, err := s.db.FetchBlockHeightBySha(sha)
+	if err != nil || gotHeight != height {
+		s.errorf("FetchBlockHeightBySha: got %d (err %v), want %d",
+			gotHeight, err, height)
+		return false
+	}
+	header, err := s.db.FetchBlockHeaderBySha(sha)
+	if err != nil || !reflect.DeepEqual(header, &block.MsgBlock().Header) {
+		s.errorf("FetchBlockHeaderBySha: block #%d: got %v (err %v)",
+			height, header, err)
+		return false
+	}
+	gotSha, err := s.db.FetchBlockShaByHeight(height)
+	if err != nil || !gotSha.IsEqual(sha) {
+		s.errorf("FetchBlockShaByHeight: got %v (err %v) at height %d, "+
+			"want %v", gotSha, err, height, sha)
+		return false
+	}
+
+	spent := s.spentOutputs()
+	for _, tx := range block.Transactions() {
+		wantSpent := make([]bool, len(tx.MsgTx().TxOut))
+		fullySpent := true
+		for i := range wantSpent {
+			wantSpent[i] = spent[*btcwire.NewOutPoint(tx.Sha(),
+				uint32(i))]
+			fullySpent = fullySpent && wantSpent[i]
+		}
+
+		// Transactions which are fully spent are no longer reported as
+		// existing, although they are still fetched.
+		if s.db.ExistsTxSha(tx.Sha()) == fullySpent {
+			s.errorf("ExistsTxSha: got %v for transaction %v of "+
+				"block #%d, which is fully spent: %v",
+				!fullySpent, tx.Sha(), height, fullySpent)
+			return false
+		}
+		replies, err := s.db.FetchTxBySha(tx.Sha())
+		if err != nil || len(replies) == 0 {
+			s.errorf("FetchTxBySha: transaction %v of block #%d: "+
+				"got %d replies (err %v)", tx.Sha(), height,
+				len(replies), err)
+			return false
+		}
+		reply := replies[len(replies)-1]
+		if reply.Height != height || !reply.BlkSha.IsEqual(sha) ||
+			!reflect.DeepEqual(reply.Tx, tx.MsgTx()) {
+			s.errorf("FetchTxBySha: transaction %v of block #%d: "+
+				"got block %v at height %d", tx.Sha(), height,
+				reply.BlkSha, reply.Height)
+			return false
+		}
+
+		unspent := s.db.FetchUnSpentTxByShaList([]*btcwire.ShaHash{tx.Sha()})
+		if len(unspent) != 1 {
+			s.errorf("FetchUnSpentTxByShaList: got %d replies, want 1",
+				len(unspent))
+			return false
+		}
+		if fullySpent {
+			if unspent[0].Err != btcdb.TxShaMissing ||
+				!unspent[0].FullySpent {
+				s.errorf("FetchUnSpentTxByShaList: fully spent "+
+					"transaction %v: got err %v and fully "+
+					"spent %v", tx.Sha(), unspent[0].Err,
+					unspent[0].FullySpent)
+				return false
+			}
+			continue
+		}
+		if unspent[0].Err != nil ||
+			!reflect.DeepEqual(unspent[0].TxSpent, wantSpent) {
+			s.errorf("FetchUnSpentTxByShaList: transaction %v: got "+
+				"spent %v (err %v), want %v", tx.Sha(),
+				unspent[0].TxSpent, unspent[0].Err, wantSpent)
+			return false
+		}
+		for i := range wantSpent {
+			op := btcwire.NewOutPoint(tx.Sha(), uint32(i))
+			entry, err := s.db.FetchUtxoEntry(op)
+			if err != nil || (entry == nil) != wantSpent[i] {
+				s.errorf("FetchUtxoEntry: output %v: got %v (err "+
+					"%v), want spent %v", op, entry, err,
+					wantSpent[i])
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// testHeightRange ensures the hashes of the expected chain are fetched by
+// height and the number of unspent outputs is the one left by the chain.
+func (s *suite) testHeightRange() bool {
+	shas, err := s.db.FetchHeightRange(0, btcdb.AllShas)
+	if err != nil || len(shas) != len(s.blocks) {
+		s.errorf("FetchHeightRange: got %d hashes (err %v), want %d",
+			len(shas), err, len(s.blocks))
+		return false
+	}
+	for i := range shas {
+		sha, _ := s.blocks[i].Sha()
+		if !shas[i].IsEqual(sha) {
+			s.errorf("FetchHeightRange: got %v at height %d, want %v",
+				&shas[i], i, sha)
+			return false
+		}
+	}
+	shas, err = s.db.FetchHeightRange(2, 5)
+	if err != nil || len(shas) != 3 {
+		s.errorf("FetchHeightRange: got %d hashes (err %v) from 2 to "+
+			"5, want 3", len(shas), err)
+		return false
+	}
+
+	var want int64
+	for _, block := range s.blocks {
+		for _, tx := range block.MsgBlock().Transactions {
+			want += int64(len(tx.TxOut))
+		}
+	}
+	want -= int64(len(s.spentOutputs()))
+	size, err := s.db.UtxoSetSize()
+	if err != nil || size != want {
+		s.errorf("UtxoSetSize: got %d (err %v), want %d", size, err,
+			want)
+		return false
+	}
+	return true
+}
+
+// testNotFound ensures fetching blocks and transactions which are not stored
+// returns the errors of the leveldb driver.
+func (s *suite) testNotFound() bool {
+	unknown := &btcwire.ShaHash{0x01}
+	if s.db.ExistsSha(unknown) || s.db.ExistsTxSha(unknown) {
+		s.errorf("ExistsSha: unknown hash exists")
+		return false
+	}
+	if _, err := s.db.FetchBlockBySha(unknown); err != btcdb.ErrBlockNotFound {
+		s.errorf("FetchBlockBySha: got %v for an unknown block, want "+
+			"%v", err, btcdb.ErrBlockNotFound)
+		return false
+	}
+	if _, err := s.db.FetchBlockHeightBySha(unknown); err != btcdb.ErrBlockNotFound {
+		s.errorf("FetchBlockHeightBySha: got %v for an unknown block, "+
+			"want %v", err, btcdb.ErrBlockNotFound)
+		return false
+	}
+	height := int64(len(s.blocks))
+	if _, err := s.db.FetchBlockShaByHeight(height); err != btcdb.ErrBlockNotFound {
+		s.errorf("FetchBlockShaByHeight: got %v past the newest block, "+
+			"want %v", err, btcdb.ErrBlockNotFound)
+		return false
+	}
+	if _, err := s.db.FetchTxBySha(unknown); err != btcdb.TxShaMissing {
+		s.errorf("FetchTxBySha: got %v for an unknown transaction, "+
+			"want %v", err, btcdb.TxShaMissing)
+		return false
+	}
+	replies := s.db.FetchUnSpentTxByShaList([]*btcwire.ShaHash{unknown})
+	if len(replies) != 1 || replies[0].Err != btcdb.TxShaMissing ||
+		replies[0].FullySpent {
+		s.errorf("FetchUnSpentTxByShaList: wrong reply for an unknown " +
+			"transaction")
+		return false
+	}
+	entry, err := s.db.FetchUtxoEntry(btcwire.NewOutPoint(unknown, 0))
+	if entry != nil || err != nil {
+		s.errorf("FetchUtxoEntry: got %v (err %v) for an unknown "+
+			"output, want neither", entry, err)
+		return false
+	}
+	return true
+}
+
+// testBadInserts ensures blocks which are already stored, do not connect to
+// the newest block or spend outputs which do not exist are rejected and leave
+// the database unchanged.  The passed generator follows the newest block.
+func (s *suite) testBadInserts(gen *ChainGenerator) bool {
+	tip := s.blocks[len(s.blocks)-1]
+	if _, err := s.db.InsertBlock(tip); err == nil {
+		s.errorf("InsertBlock: inserted the newest block twice")
+		return false
+	}
+
+	orphan := gen.Fork(1).NextBlocks(2)[1]
+	if _, err := s.db.InsertBlock(orphan); err == nil {
+		s.errorf("InsertBlock: inserted a block whose parent is not " +
+			"stored")
+		return false
+	}
+
+	// The block spends an output of a transaction which does not exist.
+	bad := gen.NextBlock()
+	msgBlock := *bad.MsgBlock()
+	spend := msgBlock.Transactions[1].Copy()
+	spend.TxIn[0].PreviousOutpoint.Hash = btcwire.ShaHash{0x01}
+	msgBlock.Transactions = append([]*btcwire.MsgTx{
+		msgBlock.Transactions[0], spend}, msgBlock.Transactions[2:]...)
+	msgBlock.Header.MerkleRoot = merkleRoot(msgBlock.Transactions)
+	solveBlock(&msgBlock)
+	if _, err := s.db.InsertBlock(btcutil.NewBlock(&msgBlock)); err == nil {
+		s.errorf("InsertBlock: inserted a block spending an output " +
+			"which does not exist")
+		return false
+	}
+
+	if err := s.db.DropAfterBlockBySha(&btcwire.ShaHash{0x01}); err == nil {
+		s.errorf("DropAfterBlockBySha: dropped after an unknown block")
+		return false
+	}
+	return s.checkNewest() && s.testBlock(int64(len(s.blocks)-1))
+}
+
+// testDrop ensures dropping the blocks after the passed height removes them and
+// their transactions, makes the outputs they spent unspent again and allows
+// inserting them again.
+func (s *suite) testDrop(height int64) bool {
+	dropped := s.blocks[height+1:]
+	sha, _ := s.blocks[height].Sha()
+	if err := s.db.DropAfterBlockBySha(sha); err != nil {
+		s.errorf("DropAfterBlockBySha: %v", err)
+		return false
+	}
+	s.blocks = s.blocks[:height+1]
+	if !s.checkNewest() {
+		return false
+	}
+	for _, block := range dropped {
+		sha, _ := block.Sha()
+		if s.db.ExistsSha(sha) {
+			s.errorf("ExistsSha: dropped block %v exists", sha)
+			return false
+		}
+		for _, tx := range block.Transactions() {
+			if s.db.ExistsTxSha(tx.Sha()) {
+				s.errorf("ExistsTxSha: transaction %v of a "+
+					"dropped block exists", tx.Sha())
+				return false
+			}
+		}
+	}
+	if !s.testBlock(height) || !s.testHeightRange() {
+		return false
+	}
+
+	for i, block := range dropped {
+		if !s.testInsertBlock(block, height+1+int64(i)) {
+			return false
+		}
+	}
+	return s.testHeightRange()
+}
+
+// testReorg ensures reorganizing the chain to a side chain made by the passed
+// generator replaces the blocks after the one the side chain follows along
+// with the metadata changes made with it, and that a failed reorganization
+// changes nothing.
+func (s *suite) testReorg(gen *ChainGenerator) bool {
+	height := gen.Height()
+	forkSha, _ := gen.Tip().Sha()
+	side := gen.NextBlocks(suiteSideLen)
+
+	// The last block of the run does not connect, so nothing changes.
+	broken := append(append([]*btcutil.Block(nil), side[:3]...), side[4])
+	var meta btcdb.MetaBatch
+	meta.Put([]byte("dbtest/reorg"), []byte("side"))
+	if _, err := s.db.ReorganizeWithMeta(forkSha, broken, &meta); err == nil {
+		s.errorf("ReorganizeWithMeta: reorganized to a run of blocks " +
+			"which do not connect")
+		return false
+	}
+	if val, err := s.db.GetMeta([]byte("dbtest/reorg")); val != nil || err != nil {
+		s.errorf("GetMeta: got %q (err %v) after a failed reorganization",
+			val, err)
+		return false
+	}
+	if !s.checkNewest() || !s.testHeightRange() {
+		return false
+	}
+
+	replaced := append([]*btcutil.Block(nil), s.blocks[height+1:]...)
+	heights, err := s.db.ReorganizeWithMeta(forkSha, side, &meta)
+	if err != nil {
+		s.errorf("ReorganizeWithMeta: %v", err)
+		return false
+	}
+	for i, got := range heights {
+		if got != height+1+int64(i) {
+			s.errorf("ReorganizeWithMeta: got height %d for block %d "+
+				"of the side chain", got, i)
+			return false
+		}
+	}
+	s.blocks = append(s.blocks[:height+1], side...)
+	if !s.checkNewest() || !s.testHeightRange() {
+		return false
+	}
+	for _, block := range replaced {
+		sha, _ := block.Sha()
+		if s.db.ExistsSha(sha) {
+			s.errorf("ExistsSha: replaced block %v exists", sha)
+			return false
+		}
+	}
+	for h := height; h < int64(len(s.blocks)); h++ {
+		if !s.testBlock(h) {
+			return false
+		}
+	}
+	val, err := s.db.GetMeta([]byte("dbtest/reorg"))
+	if err != nil || string(val) != "side" {
+		s.errorf("GetMeta: got %q (err %v) after reorganizing, want %q",
+			val, err, "side")
+		return false
+	}
+	return true
+}
+
+// testMeta ensures keys are stored, iterated in either order and removed from
+// the metadata namespace.
+func (s *suite) testMeta() bool {
+	if val, err := s.db.GetMeta([]byte("dbtest/missing")); val != nil || err != nil {
+		s.errorf("GetMeta: got %q (err %v) for a missing key, want "+
+			"neither", val, err)
+		return false
+	}
+	if err := s.db.PutMeta(nil, []byte("v")); err != btcdb.ErrEmptyMetaKey {
+		s.errorf("PutMeta: got %v for an empty key, want %v", err,
+			btcdb.ErrEmptyMetaKey)
+		return false
+	}
+
+	keys := []string{"dbtest/meta/a", "dbtest/meta/b", "dbtest/meta/c"}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := s.db.PutMeta([]byte(keys[i]), []byte(keys[i])); err != nil {
+			s.errorf("PutMeta: %v", err)
+			return false
+		}
+	}
+	if err := s.db.DeleteMeta([]byte(keys[1])); err != nil {
+		s.errorf("DeleteMeta: %v", err)
+		return false
+	}
+	if !s.testMetaIterator("MetaIterator", s.db.MetaIterator,
+		[]string{keys[0], keys[2]}) {
+		return false
+	}
+	return s.testMetaIterator("ReverseMetaIterator",
+		s.db.ReverseMetaIterator, []string{keys[2], keys[0]})
+}
+
+// testMetaIterator ensures the iterator returned by the passed function for the
+// keys of testMeta walks the wanted keys in order.
+func (s *suite) testMetaIterator(name string, fn func(prefix []byte) (btcdb.MetaIterator, error), want []string) bool {
+	iter, err := fn([]byte("dbtest/meta/"))
+	if err != nil {
+		s.errorf("%s: %v", name, err)
+		return false
+	}
+	defer iter.Release()
+	var got []string
+	for iter.Next() {
+		if !bytes.Equal(iter.Key(), iter.Value()) {
+			s.errorf("%s: wrong value %q for key %q", name,
+				iter.Value(), iter.Key())
+			return false
+		}
+		got = append(got, string(iter.Key()))
+	}
+	if err := iter.Err(); err != nil || !reflect.DeepEqual(got, want) {
+		s.errorf("%s: got keys %q (err %v), want %q", name, got, err,
+			want)
+		return false
+	}
+	return true
+}
+
+// testClose ensures a closed database says so and returns ErrDbClosed.
+func (s *suite) testClose() bool {
+	s.db.Close()
+	if !s.db.Closed() {
+		s.errorf("Closed: database is not closed after Close")
+		return false
+	}
+	if _, _, err := s.db.NewestSha(); err != btcdb.ErrDbClosed {
+		s.errorf("NewestSha: got %v once closed, want %v", err,
+			btcdb.ErrDbClosed)
+		return false
+	}
+	sha, _ := s.blocks[0].Sha()
+	if _, err := s.db.FetchBlockBySha(sha); err != btcdb.ErrDbClosed {
+		s.errorf("FetchBlockBySha: got %v once closed, want %v", err,
+			btcdb.ErrDbClosed)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package dbtest_test
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/badgerdb"
+	_ "github.com/conformal/btcdb/boltdb"
+	"github.com/conformal/btcdb/dbtest"
+	_ "github.com/conformal/btcdb/ldb"
+	_ "github.com/conformal/btcdb/memdb"
+	_ "github.com/conformal/btcdb/sqldb"
+	"github.com/conformal/btcwire"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRunInterfaceTests ensures every supported database type passes the
+// conformance suite.
+func TestRunInterfaceTests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbtest")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		switch dbType {
+		case "postgres":
+			// The postgres driver needs a server.
+		case "memory":
+			dbtest.RunInterfaceTests(t, dbType)
+		default:
+			dbtest.RunInterfaceTests(t, dbType,
+				filepath.Join(dir, dbType))
+		}
+	}
+}
+
+// TestChainGenerator ensures the generated blocks are deterministic, pass
+// strict validation and only spend outputs of earlier blocks which are unspent
+// and mature.
+func TestChainGenerator(t *testing.T) {
+	newGen := func() *dbtest.ChainGenerator {
+		gen := dbtest.NewChainGenerator(3)
+		gen.InputsPerTx = 2
+		gen.OutputsPerTx = 3
+		gen.CoinbaseMaturity = 5
+		return gen
+	}
+
+	db, err := btcdb.CreateDB("memory", btcdb.Options{
+		Validation: btcdb.ValidateStrict,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create database: %v", err)
+	}
+	defer db.Close()
+
+	gen := newGen()
+	blocks, err := dbtest.InsertChain(db, gen, 40)
+	if err != nil {
+		t.Fatalf("InsertChain: %v", err)
+	}
+	if gen.Height() != 39 {
+		t.Errorf("Height: got %d, want 39", gen.Height())
+	}
+	again := newGen().NextBlocks(40)
+	for i := range blocks {
+		sha, _ := blocks[i].Sha()
+		againSha, _ := again[i].Sha()
+		if !sha.IsEqual(againSha) {
+			t.Errorf("NextBlocks: block %d differs between runs", i)
+		}
+	}
+
+	type output struct {
+		height   int64
+		coinbase bool
+		value    int64
+	}
+	unspent := make(map[btcwire.OutPoint]output)
+	var spends int
+	for height, block := range blocks[1:] {
+		height++
+		txs := block.Transactions()
+		if len(txs) > 4 {
+			t.Errorf("block %d has %d transactions", height, len(txs))
+		}
+		for i, tx := range txs {
+			var in int64
+			for _, txIn := range tx.MsgTx().TxIn {
+				if i == 0 {
+					continue
+				}
+				spent, ok := unspent[txIn.PreviousOutpoint]
+				if !ok || spent.height == int64(height) ||
+					(spent.coinbase && int64(height)-spent.height < 5) {
+					t.Errorf("block %d spends %v, which is not "+
+						"spendable", height, txIn.PreviousOutpoint)
+				}
+				delete(unspent, txIn.PreviousOutpoint)
+				in += spent.value
+				spends++
+			}
+			var out int64
+			for j, txOut := range tx.MsgTx().TxOut {
+				out += txOut.Value
+				unspent[*btcwire.NewOutPoint(tx.Sha(), uint32(j))] =
+					output{int64(height), i == 0, txOut.Value}
+			}
+			if i != 0 && in != out {
+				t.Errorf("block %d transaction %d spends %d into %d",
+					height, i, in, out)
+			}
+		}
+	}
+	if spends == 0 {
+		t.Errorf("generated blocks spend no outputs")
+	}
+	// The output of the genesis coinbase is counted as well.
+	size, err := db.UtxoSetSize()
+	if err != nil || size != int64(len(unspent))+1 {
+		t.Errorf("UtxoSetSize: got %d (err %v), want %d", size, err,
+			len(unspent)+1)
+	}
+
+	// A fork with another tag generates other blocks after the same one.
+	fork := newGen()
+	fork.NextBlocks(10)
+	side := fork.Fork(1).NextBlock()
+	main := fork.NextBlock()
+	sideSha, _ := side.Sha()
+	mainSha, _ := main.Sha()
+	if sideSha.IsEqual(mainSha) ||
+		side.MsgBlock().Header.PrevBlock != main.MsgBlock().Header.PrevBlock {
+		t.Errorf("Fork: side block %v does not share the parent of %v",
+			sideSha, mainSha)
+	}
+}
+
+// recorder is a testing.TB which records the errors reported to it.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// TestMockDb ensures the mock database returns the scripted results and
+// reports the calls which do not follow its script.
+func TestMockDb(t *testing.T) {
+	rec := &recorder{TB: t}
+	db := dbtest.NewMockDb(rec)
+	sha := &btcwire.ShaHash{0x01}
+	db.Expect("NewestSha").Return(sha, int64(7), nil)
+	db.Expect("FetchBlockBySha", dbtest.Any).Return(nil,
+		btcdb.ErrBlockNotFound)
+	db.Expect("ExistsSha", sha).Return(true)
+
+	gotSha, height, err := db.NewestSha()
+	if gotSha != sha || height != 7 || err != nil {
+		t.Errorf("NewestSha: got %v, %d, %v", gotSha, height, err)
+	}
+	blk, err := db.FetchBlockBySha(sha)
+	if blk != nil || err != btcdb.ErrBlockNotFound {
+		t.Errorf("FetchBlockBySha: got %v, %v", blk, err)
+	}
+	if len(rec.errors) != 0 {
+		t.Errorf("MockDb reported %q for scripted calls", rec.errors)
+	}
+
+	// A call with other arguments than scripted is reported, as are the
+	// calls which are not scripted and the scripted calls not made.
+	if db.ExistsSha(&btcwire.ShaHash{0x02}) {
+		t.Errorf("ExistsSha: got the scripted result for other " +
+			"arguments")
+	}
+	db.Expect("UtxoSetSize").Return(int64(1), nil)
+	db.Expect("Sync")
+	if _, err := db.FetchUtxoEntry(btcwire.NewOutPoint(sha, 0)); err != nil {
+		t.Errorf("FetchUtxoEntry: got %v for a call out of order", err)
+	}
+	db.Verify()
+	if len(rec.errors) != 3 {
+		t.Errorf("MockDb reported %d errors, want 3: %q",
+			len(rec.errors), rec.errors)
+	}
+
+	// Results of the wrong type are reported.
+	rec.errors = nil
+	db.Expect("UtxoSetSize").Return(1, nil)
+	if n, _ := db.UtxoSetSize(); n != 0 || len(rec.errors) != 1 {
+		t.Errorf("UtxoSetSize: got %d and %d errors for a result of "+
+			"the wrong type", n, len(rec.errors))
+	}
+}
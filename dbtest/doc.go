@@ -0,0 +1,38 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package dbtest provides helpers for testing code which uses btcdb and the
+drivers which implement it.
+
+MockDb is a btcdb.Db which follows a script of the calls a unit test expects,
+so code using a database is tested without creating one:
+
+	db := dbtest.NewMockDb(t)
+	db.Expect("NewestSha").Return(sha, int64(100), nil)
+	db.Expect("FetchBlockBySha", sha).Return(nil, btcdb.ErrBlockNotFound)
+	...
+	db.Verify()
+
+ChainGenerator generates a deterministic chain of valid regression test blocks,
+with a configurable number of transactions spending the outputs of earlier
+blocks, so tests of indexes and reorganizations need no fixtures.  Fork starts
+a side chain after the last block generated:
+
+	gen := dbtest.NewChainGenerator(4)
+	blocks, err := dbtest.InsertChain(db, gen, 100)
+	...
+	side := gen.Fork(1)
+	sideBlocks := side.NextBlocks(10)
+
+RunInterfaceTests checks a driver follows the contract of btcdb.Db as the
+leveldb driver does, including the errors it returns, dropping blocks and
+reorganizing to a side chain.  The authors of drivers run it from their own
+tests:
+
+	func TestInterface(t *testing.T) {
+		dbtest.RunInterfaceTests(t, "mydriver", filepath.Join(dir, "db"))
+	}
+*/
+package dbtest
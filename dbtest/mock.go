@@ -0,0 +1,501 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// anyArg is the type of Any.
+type anyArg struct{}
+
+// String returns a placeholder for any argument.
+func (anyArg) String() string {
+	return "<any>"
+}
+
+// Any matches any argument of a call expected with MockDb.Expect, such as a
+// context or a progress function which can not be compared.
+var Any = anyArg{}
+
+// Call is a call to a method of a MockDb expected by its script along with the
+// results the method returns.
+type Call struct {
+	method  string
+	args    []interface{}
+	results []interface{}
+}
+
+// Return sets the results returned by the method when the call is made, in the
+// order of the results of the method.  Results which are not set are the zero
+// value of their type.
+func (c *Call) Return(results ...interface{}) *Call {
+	c.results = results
+	return c
+}
+
+// String returns the call as it would be written in Go.
+func (c *Call) String() string {
+	args := make([]string, 0, len(c.args))
+	for _, arg := range c.args {
+		args = append(args, fmt.Sprintf("%v", arg))
+	}
+	return fmt.Sprintf("%s(%s)", c.method, strings.Join(args, ", "))
+}
+
+// MockDb is a btcdb.Db whose methods follow a script of expected calls, for
+// unit testing code which uses a database without creating one.  Each method
+// takes the next call of the script, reports an error to the test unless it is
+// a call to the same method with arguments equal to the expected ones as given
+// by reflect.DeepEqual, and returns the results set with Call.Return.  Calls
+// which are not expected return the zero value of every result.
+//
+// A MockDb is safe for concurrent access, although the order of concurrent
+// calls is only known to the script when the calls are made in turn.
+type MockDb struct {
+	t      testing.TB
+	mtx    sync.Mutex
+	script []*Call
+}
+
+// Ensure MockDb implements the btcdb.Db interface.
+var _ btcdb.Db = (*MockDb)(nil)
+
+// NewMockDb returns a mock database with an empty script which reports the
+// calls which do not follow the script to the passed test.
+func NewMockDb(t testing.TB) *MockDb {
+	return &MockDb{t: t}
+}
+
+// Expect adds a call to the passed method with the passed arguments to the end
+// of the script and returns it so its results are set with Return.  Arguments
+// may be Any to match any value.
+func (m *MockDb) Expect(method string, args ...interface{}) *Call {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	c := &Call{method: method, args: args}
+	m.script = append(m.script, c)
+	return c
+}
+
+// Verify reports the calls of the script which were not made to the test.
+func (m *MockDb) Verify() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, c := range m.script {
+		m.t.Errorf("MockDb: expected call %v was not made", c)
+	}
+}
+
+// argsMatch returns whether the arguments of a call match the expected ones.
+func argsMatch(want, got []interface{}) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if _, ok := want[i].(anyArg); ok {
+			continue
+		}
+		if !reflect.DeepEqual(want[i], got[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// call takes the next call of the script, which must be to the passed method
+// with the passed arguments, and stores its results through the passed
+// pointers.
+func (m *MockDb) call(method string, args []interface{}, results ...interface{}) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	got := &Call{method: method, args: args}
+	if len(m.script) == 0 {
+		m.t.Errorf("MockDb: unexpected call %v", got)
+		return
+	}
+	c := m.script[0]
+	m.script = m.script[1:]
+	if c.method != method || !argsMatch(c.args, args) {
+		m.t.Errorf("MockDb: got call %v, want %v", got, c)
+		return
+	}
+	if len(c.results) > len(results) {
+		m.t.Errorf("MockDb: %d results set for %v, which returns %d",
+			len(c.results), c, len(results))
+		return
+	}
+	for i, result := range c.results {
+		if result == nil {
+			continue
+		}
+		dst := reflect.ValueOf(results[i]).Elem()
+		val := reflect.ValueOf(result)
+		if !val.Type().AssignableTo(dst.Type()) {
+			m.t.Errorf("MockDb: result %d of %v is a %v instead of "+
+				"a %v", i, c, val.Type(), dst.Type())
+			continue
+		}
+		dst.Set(val)
+	}
+}
+
+// Close is part of the btcdb.Db interface implementation.
+func (m *MockDb) Close() {
+	m.call("Close", nil)
+}
+
+// Closed is part of the btcdb.Db interface implementation.
+func (m *MockDb) Closed() (closed bool) {
+	m.call("Closed", nil, &closed)
+	return
+}
+
+// DropAfterBlockBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) DropAfterBlockBySha(sha *btcwire.ShaHash) (err error) {
+	m.call("DropAfterBlockBySha", []interface{}{sha}, &err)
+	return
+}
+
+// ExistsSha is part of the btcdb.Db interface implementation.
+func (m *MockDb) ExistsSha(sha *btcwire.ShaHash) (exists bool) {
+	m.call("ExistsSha", []interface{}{sha}, &exists)
+	return
+}
+
+// ExistsShas is part of the btcdb.Db interface implementation.
+func (m *MockDb) ExistsShas(shas []btcwire.ShaHash) (exists []bool) {
+	m.call("ExistsShas", []interface{}{shas}, &exists)
+	return
+}
+
+// FetchBlockBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, err error) {
+	m.call("FetchBlockBySha", []interface{}{sha}, &blk, &err)
+	return
+}
+
+// FetchBlockByShaCtx is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (blk *btcutil.Block, err error) {
+	m.call("FetchBlockByShaCtx", []interface{}{ctx, sha}, &blk, &err)
+	return
+}
+
+// FetchBlockRegion is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) (val []byte, err error) {
+	m.call("FetchBlockRegion", []interface{}{sha, offset, length}, &val, &err)
+	return
+}
+
+// FetchBlockBytesBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) (val []byte, err error) {
+	m.call("FetchBlockBytesBySha", []interface{}{sha, buf}, &val, &err)
+	return
+}
+
+// FetchBlockHeightBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockHeightBySha(sha *btcwire.ShaHash) (height int64, err error) {
+	m.call("FetchBlockHeightBySha", []interface{}{sha}, &height, &err)
+	return
+}
+
+// FetchBlockHeaderBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (bh *btcwire.BlockHeader, err error) {
+	m.call("FetchBlockHeaderBySha", []interface{}{sha}, &bh, &err)
+	return
+}
+
+// FetchBlockShaByHeight is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockShaByHeight(height int64) (sha *btcwire.ShaHash, err error) {
+	m.call("FetchBlockShaByHeight", []interface{}{height}, &sha, &err)
+	return
+}
+
+// FetchBlockHeaderByHeight is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchBlockHeaderByHeight(height int64) (bh *btcwire.BlockHeader, err error) {
+	m.call("FetchBlockHeaderByHeight", []interface{}{height}, &bh, &err)
+	return
+}
+
+// FetchHeaderRange is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchHeaderRange(startHeight, endHeight int64) (headers []btcwire.BlockHeader, err error) {
+	m.call("FetchHeaderRange", []interface{}{startHeight, endHeight}, &headers, &err)
+	return
+}
+
+// FetchHeaderRangeCtx is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) (headers []btcwire.BlockHeader, err error) {
+	m.call("FetchHeaderRangeCtx", []interface{}{ctx, startHeight, endHeight}, &headers, &err)
+	return
+}
+
+// FetchChainWorkBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchChainWorkBySha(sha *btcwire.ShaHash) (work *big.Int, err error) {
+	m.call("FetchChainWorkBySha", []interface{}{sha}, &work, &err)
+	return
+}
+
+// FetchHeightRange is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchHeightRange(startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error) {
+	m.call("FetchHeightRange", []interface{}{startHeight, endHeight}, &rshalist, &err)
+	return
+}
+
+// FetchHeightRangeCtx is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) (shas []btcwire.ShaHash, err error) {
+	m.call("FetchHeightRangeCtx", []interface{}{ctx, startHeight, endHeight}, &shas, &err)
+	return
+}
+
+// BlockLocatorFromSha is part of the btcdb.Db interface implementation.
+func (m *MockDb) BlockLocatorFromSha(sha *btcwire.ShaHash) (locator btcdb.BlockLocator, err error) {
+	m.call("BlockLocatorFromSha", []interface{}{sha}, &locator, &err)
+	return
+}
+
+// LatestBlockLocator is part of the btcdb.Db interface implementation.
+func (m *MockDb) LatestBlockLocator() (locator btcdb.BlockLocator, err error) {
+	m.call("LatestBlockLocator", nil, &locator, &err)
+	return
+}
+
+// ExistsTxSha is part of the btcdb.Db interface implementation.
+func (m *MockDb) ExistsTxSha(sha *btcwire.ShaHash) (exists bool) {
+	m.call("ExistsTxSha", []interface{}{sha}, &exists)
+	return
+}
+
+// ExistsTxShas is part of the btcdb.Db interface implementation.
+func (m *MockDb) ExistsTxShas(shas []btcwire.ShaHash) (exists []bool) {
+	m.call("ExistsTxShas", []interface{}{shas}, &exists)
+	return
+}
+
+// FetchTxBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchTxBySha(txsha *btcwire.ShaHash) (replies []*btcdb.TxListReply, err error) {
+	m.call("FetchTxBySha", []interface{}{txsha}, &replies, &err)
+	return
+}
+
+// FetchTxByShaList is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) (replies []*btcdb.TxListReply) {
+	m.call("FetchTxByShaList", []interface{}{txShaList}, &replies)
+	return
+}
+
+// FetchUnSpentTxByShaList is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) (replies []*btcdb.TxListReply) {
+	m.call("FetchUnSpentTxByShaList", []interface{}{txShaList}, &replies)
+	return
+}
+
+// FetchUtxoEntry is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchUtxoEntry(outpoint *btcwire.OutPoint) (entry *btcdb.UtxoEntry, err error) {
+	m.call("FetchUtxoEntry", []interface{}{outpoint}, &entry, &err)
+	return
+}
+
+// FetchSpendingTx is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchSpendingTx(outpoint *btcwire.OutPoint) (spend *btcdb.SpendingTx, err error) {
+	m.call("FetchSpendingTx", []interface{}{outpoint}, &spend, &err)
+	return
+}
+
+// IsOutpointSpent is part of the btcdb.Db interface implementation.
+func (m *MockDb) IsOutpointSpent(outpoint *btcwire.OutPoint) (spent bool, err error) {
+	m.call("IsOutpointSpent", []interface{}{outpoint}, &spent, &err)
+	return
+}
+
+// FetchFilterBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchFilterBySha(sha *btcwire.ShaHash) (val []byte, err error) {
+	m.call("FetchFilterBySha", []interface{}{sha}, &val, &err)
+	return
+}
+
+// FetchFilterHeaderBySha is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (rsha *btcwire.ShaHash, err error) {
+	m.call("FetchFilterHeaderBySha", []interface{}{sha}, &rsha, &err)
+	return
+}
+
+// FetchFilterRange is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchFilterRange(startHeight, endHeight int64) (filters [][]byte, err error) {
+	m.call("FetchFilterRange", []interface{}{startHeight, endHeight}, &filters, &err)
+	return
+}
+
+// FetchFilterHeaderRange is part of the btcdb.Db interface implementation.
+func (m *MockDb) FetchFilterHeaderRange(startHeight, endHeight int64) (shas []btcwire.ShaHash, err error) {
+	m.call("FetchFilterHeaderRange", []interface{}{startHeight, endHeight}, &shas, &err)
+	return
+}
+
+// UtxoSetSize is part of the btcdb.Db interface implementation.
+func (m *MockDb) UtxoSetSize() (n int64, err error) {
+	m.call("UtxoSetSize", nil, &n, &err)
+	return
+}
+
+// InsertBlock is part of the btcdb.Db interface implementation.
+func (m *MockDb) InsertBlock(block *btcutil.Block) (height int64, err error) {
+	m.call("InsertBlock", []interface{}{block}, &height, &err)
+	return
+}
+
+// InsertBlocks is part of the btcdb.Db interface implementation.
+func (m *MockDb) InsertBlocks(blocks []*btcutil.Block) (heights []int64, err error) {
+	m.call("InsertBlocks", []interface{}{blocks}, &heights, &err)
+	return
+}
+
+// InsertBlocksWithMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) (heights []int64, err error) {
+	m.call("InsertBlocksWithMeta", []interface{}{blocks, meta}, &heights, &err)
+	return
+}
+
+// DropAfterBlockByShaWithMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) (err error) {
+	m.call("DropAfterBlockByShaWithMeta", []interface{}{sha, meta}, &err)
+	return
+}
+
+// ReorganizeWithMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) (heights []int64, err error) {
+	m.call("ReorganizeWithMeta", []interface{}{sha, blocks, meta}, &heights, &err)
+	return
+}
+
+// GetMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) GetMeta(key []byte) (val []byte, err error) {
+	m.call("GetMeta", []interface{}{key}, &val, &err)
+	return
+}
+
+// PutMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) PutMeta(key, value []byte) (err error) {
+	m.call("PutMeta", []interface{}{key, value}, &err)
+	return
+}
+
+// DeleteMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) DeleteMeta(key []byte) (err error) {
+	m.call("DeleteMeta", []interface{}{key}, &err)
+	return
+}
+
+// WriteMeta is part of the btcdb.Db interface implementation.
+func (m *MockDb) WriteMeta(meta *btcdb.MetaBatch) (err error) {
+	m.call("WriteMeta", []interface{}{meta}, &err)
+	return
+}
+
+// MetaIterator is part of the btcdb.Db interface implementation.
+func (m *MockDb) MetaIterator(prefix []byte) (iter btcdb.MetaIterator, err error) {
+	m.call("MetaIterator", []interface{}{prefix}, &iter, &err)
+	return
+}
+
+// ReverseMetaIterator is part of the btcdb.Db interface implementation.
+func (m *MockDb) ReverseMetaIterator(prefix []byte) (iter btcdb.MetaIterator, err error) {
+	m.call("ReverseMetaIterator", []interface{}{prefix}, &iter, &err)
+	return
+}
+
+// NewestSha is part of the btcdb.Db interface implementation.
+func (m *MockDb) NewestSha() (sha *btcwire.ShaHash, height int64, err error) {
+	m.call("NewestSha", nil, &sha, &height, &err)
+	return
+}
+
+// RollbackClose is part of the btcdb.Db interface implementation.
+func (m *MockDb) RollbackClose() {
+	m.call("RollbackClose", nil)
+}
+
+// BlockIterator is part of the btcdb.Db interface implementation.
+func (m *MockDb) BlockIterator(startHeight int64) (iter btcdb.BlockIterator, err error) {
+	m.call("BlockIterator", []interface{}{startHeight}, &iter, &err)
+	return
+}
+
+// TxIterator is part of the btcdb.Db interface implementation.
+func (m *MockDb) TxIterator(startHeight int64) (iter btcdb.TxIterator, err error) {
+	m.call("TxIterator", []interface{}{startHeight}, &iter, &err)
+	return
+}
+
+// BlockIteratorCtx is part of the btcdb.Db interface implementation.
+func (m *MockDb) BlockIteratorCtx(ctx context.Context, startHeight int64) (iter btcdb.BlockIterator, err error) {
+	m.call("BlockIteratorCtx", []interface{}{ctx, startHeight}, &iter, &err)
+	return
+}
+
+// TxIteratorCtx is part of the btcdb.Db interface implementation.
+func (m *MockDb) TxIteratorCtx(ctx context.Context, startHeight int64) (iter btcdb.TxIterator, err error) {
+	m.call("TxIteratorCtx", []interface{}{ctx, startHeight}, &iter, &err)
+	return
+}
+
+// AddIndexer is part of the btcdb.Db interface implementation.
+func (m *MockDb) AddIndexer(idx btcdb.Indexer) (err error) {
+	m.call("AddIndexer", []interface{}{idx}, &err)
+	return
+}
+
+// Subscribe is part of the btcdb.Db interface implementation.
+func (m *MockDb) Subscribe() (sub *btcdb.Subscription, err error) {
+	m.call("Subscribe", nil, &sub, &err)
+	return
+}
+
+// Snapshot is part of the btcdb.Db interface implementation.
+func (m *MockDb) Snapshot() (snap btcdb.Snapshot, err error) {
+	m.call("Snapshot", nil, &snap, &err)
+	return
+}
+
+// VerifyIntegrity is part of the btcdb.Db interface implementation.
+func (m *MockDb) VerifyIntegrity(level int, progress func(height int64)) (err error) {
+	m.call("VerifyIntegrity", []interface{}{level, progress}, &err)
+	return
+}
+
+// Backup is part of the btcdb.Db interface implementation.
+func (m *MockDb) Backup(destPath string, progress func(copied int64)) (err error) {
+	m.call("Backup", []interface{}{destPath, progress}, &err)
+	return
+}
+
+// ExportBootstrap is part of the btcdb.Db interface implementation.
+func (m *MockDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) (err error) {
+	m.call("ExportBootstrap", []interface{}{w, startHeight, endHeight}, &err)
+	return
+}
+
+// BlockCacheStats is part of the btcdb.Db interface implementation.
+func (m *MockDb) BlockCacheStats() (stats btcdb.BlockCacheStats) {
+	m.call("BlockCacheStats", nil, &stats)
+	return
+}
+
+// Sync is part of the btcdb.Db interface implementation.
+func (m *MockDb) Sync() {
+	m.call("Sync", nil)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// RetargetInterval is the number of blocks between the adjustments of the
+// target difficulty of every Bitcoin network.  The difficulty is retargeted at
+// the heights which are a multiple of it.
+const RetargetInterval = 2016
+
+// maxTargetBits is the compact form of the highest target of the main network,
+// whose blocks have a difficulty of 1.
+const maxTargetBits = 0x1d00ffff
+
+// maxTarget is the highest target of the main network as a big.Int.  It is
+// defined here to avoid the overhead of creating it multiple times.
+var maxTarget = compactToBig(maxTargetBits)
+
+// CalcDifficulty returns the difficulty of the given compact target, which is
+// the number of times harder it is to find a block with it than with the
+// highest target of the main network, as reported by getdifficulty.  A zero or
+// negative target, which no valid block has, has a difficulty of zero.
+func CalcDifficulty(bits uint32) float64 {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+	diff, _ := new(big.Rat).SetFrac(maxTarget, target).Float64()
+	return diff
+}
+
+// FetchDifficultyByHeight returns the difficulty of the block at the passed
+// height of the chain of the passed database, computed from its stored
+// header.
+func FetchDifficultyByHeight(db Db, height int64) (float64, error) {
+	bh, err := db.FetchBlockHeaderByHeight(height)
+	if err != nil {
+		return 0, err
+	}
+	return CalcDifficulty(bh.Bits), nil
+}
+
+// Retarget describes the block at a retarget boundary of the chain, whose
+// target applies until the next boundary.  On networks whose rules allow
+// blocks of the minimum difficulty between boundaries, such blocks may have a
+// lower difficulty.
+type Retarget struct {
+	Height     int64
+	Sha        btcwire.ShaHash
+	Bits       uint32
+	Timestamp  time.Time
+	Difficulty float64
+}
+
+// RetargetHistory reads the retarget boundaries of the chain of a database.
+// The boundaries read from the stored headers are cached, so charting the
+// difficulty of the chain again only reads the hash of each boundary block to
+// check it is still part of the chain.  It is safe for concurrent access.
+type RetargetHistory struct {
+	db        Db
+	mtx       sync.Mutex
+	retargets map[int64]*Retarget
+}
+
+// NewRetargetHistory returns a RetargetHistory over the chain of the passed
+// database with an empty cache.
+func NewRetargetHistory(db Db) *RetargetHistory {
+	return &RetargetHistory{
+		db:        db,
+		retargets: make(map[int64]*Retarget),
+	}
+}
+
+// FetchRetarget returns the retarget boundary at the passed height, which must
+// be a multiple of RetargetInterval.  ErrBlockNotFound is returned when the
+// chain is not that high.
+func (h *RetargetHistory) FetchRetarget(height int64) (*Retarget, error) {
+	if height < 0 || height%RetargetInterval != 0 {
+		return nil, ErrBlockNotFound
+	}
+	sha, err := h.db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mtx.Lock()
+	cached, ok := h.retargets[height]
+	h.mtx.Unlock()
+	if ok && cached.Sha.IsEqual(sha) {
+		r := *cached
+		return &r, nil
+	}
+
+	bh, err := h.db.FetchBlockHeaderByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	hdrSha, err := bh.BlockSha()
+	if err != nil {
+		return nil, err
+	}
+	r := &Retarget{
+		Height:     height,
+		Sha:        hdrSha,
+		Bits:       bh.Bits,
+		Timestamp:  bh.Timestamp,
+		Difficulty: CalcDifficulty(bh.Bits),
+	}
+
+	// The chain changed between the two reads, so the boundary is not
+	// cached.
+	if !hdrSha.IsEqual(sha) {
+		return r, nil
+	}
+
+	// A boundary which is no longer part of the chain means those after
+	// it were replaced as well.
+	h.mtx.Lock()
+	if ok {
+		for cachedHeight := range h.retargets {
+			if cachedHeight > r.Height {
+				delete(h.retargets, cachedHeight)
+			}
+		}
+	}
+	cached = new(Retarget)
+	*cached = *r
+	h.retargets[r.Height] = cached
+	h.mtx.Unlock()
+	return r, nil
+}
+
+// Iterator returns an iterator over the retarget boundaries of the chain from
+// the first one at or after the passed height.  It ends at the newest block of
+// the chain as of each call to Next.
+func (h *RetargetHistory) Iterator(startHeight int64) *RetargetIterator {
+	if startHeight < 0 {
+		startHeight = 0
+	}
+	next := (startHeight + RetargetInterval - 1) / RetargetInterval *
+		RetargetInterval
+	return &RetargetIterator{history: h, next: next}
+}
+
+// RetargetIterator walks the retarget boundaries of a chain from the lowest to
+// the highest.  It starts out positioned before its first boundary, so Next
+// must be called before the first boundary can be accessed.
+type RetargetIterator struct {
+	history *RetargetHistory
+	next    int64
+	cur     *Retarget
+	err     error
+}
+
+// Next moves to the next retarget boundary and returns whether there is one.
+func (it *RetargetIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	_, newest, err := it.history.db.NewestSha()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if it.next > newest {
+		it.cur = nil
+		return false
+	}
+	it.cur, it.err = it.history.FetchRetarget(it.next)
+	if it.err != nil {
+		it.cur = nil
+		return false
+	}
+	it.next += RetargetInterval
+	return true
+}
+
+// Retarget returns the current retarget boundary.
+func (it *RetargetIterator) Retarget() *Retarget {
+	return it.cur
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *RetargetIterator) Err() error {
+	return it.err
+}
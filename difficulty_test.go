@@ -0,0 +1,112 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestRetargetHistory ensures the difficulty of blocks and the retarget
+// boundaries of the chain are read from the stored headers for every supported
+// database type, and that boundaries which were replaced are not served from
+// the cache.
+func TestRetargetHistory(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The difficulty of each target is the multiple of the highest
+	// target it is below.
+	chain := append([]*btcutil.Block{blocks[0]},
+		mineRun(blocks[0], btcdb.RetargetInterval-1, 0x1d00ffff,
+			btcwire.BlockVersion)...)
+	chain = append(chain, mineRun(chain[len(chain)-1], btcdb.RetargetInterval,
+		0x1c7fff80, btcwire.BlockVersion)...)
+	chain = append(chain, mineRun(chain[len(chain)-1], 4, 0x1c3fffc0,
+		btcwire.BlockVersion)...)
+	fork := mineRun(chain[2*btcdb.RetargetInterval-1], 4, 0x1c1fffe0,
+		btcwire.BlockVersion)
+
+	// checkRetargets ensures the iterator from the passed height returns
+	// the boundaries at the passed heights with the passed difficulties.
+	checkRetargets := func(dbType, desc string, history *btcdb.RetargetHistory, start int64, heights []int64, diffs []float64) {
+		it := history.Iterator(start)
+		var i int
+		for ; it.Next(); i++ {
+			r := it.Retarget()
+			if i >= len(heights) || r.Height != heights[i] ||
+				r.Difficulty != diffs[i] {
+				t.Errorf("RetargetIterator (%s) %s: got height %d "+
+					"with difficulty %v at index %d, want %v "+
+					"with %v", dbType, desc, r.Height,
+					r.Difficulty, i, heights, diffs)
+				return
+			}
+		}
+		if err := it.Err(); err != nil || i != len(heights) {
+			t.Errorf("RetargetIterator (%s) %s: got %d boundaries "+
+				"(err %v), want %d", dbType, desc, i, err,
+				len(heights))
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "retarget", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(chain); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		for _, test := range []struct {
+			height int64
+			diff   float64
+		}{{0, 1}, {2015, 1}, {2016, 2}, {4033, 4}} {
+			diff, err := btcdb.FetchDifficultyByHeight(db, test.height)
+			if err != nil || diff != test.diff {
+				t.Errorf("FetchDifficultyByHeight (%s): got %v "+
+					"(err %v) at height %d, want %v", dbType,
+					diff, err, test.height, test.diff)
+			}
+		}
+
+		history := btcdb.NewRetargetHistory(db)
+		checkRetargets(dbType, "from genesis", history, 0,
+			[]int64{0, 2016, 4032}, []float64{1, 2, 4})
+		checkRetargets(dbType, "after genesis", history, 1,
+			[]int64{2016, 4032}, []float64{2, 4})
+
+		// A replaced boundary is read from its new header.
+		keepSha, _ := chain[2*btcdb.RetargetInterval-1].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkRetargets(dbType, "after dropping a boundary", history, 0,
+			[]int64{0, 2016}, []float64{1, 2})
+		if _, err := db.InsertBlocks(fork); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkRetargets(dbType, "after replacing a boundary", history, 0,
+			[]int64{0, 2016, 4032}, []float64{1, 2, 8})
+		if _, err := history.FetchRetarget(2000); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchRetarget (%s): got %v for a height which "+
+				"is not a boundary, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		teardown()
+	}
+}
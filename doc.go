@@ -52,5 +52,442 @@ referenced parent block to already exist.  In a more concrete example:
 	if err != nil {
 		// Log and handle the error
 	}
+
+Options
+
+The arguments accepted by CreateDB and OpenDB depend on the driver, but are
+usually just the location of the database.  CreateDBWithOptions and
+OpenDBWithOptions accept an Options struct instead, which may also tune the
+cache size, write buffer size, compression and sync policy of the backend along
+with settings specific to a single driver:
+
+	db, err := btcdb.CreateDBWithOptions("leveldb", btcdb.Options{
+		Path:      dbName,
+		CacheSize: 64 * 1024 * 1024,
+		Sync:      btcdb.SyncAlways,
+	})
+
+The sync policy trades throughput for crash safety.  SyncAlways syncs every
+change before it is reported as complete, SyncPeriodic syncs at the given
+SyncInterval so a crash loses at most that much of the most recent changes, and
+SyncNever leaves writing data out to the operating system.  Under every policy
+the Sync function of a database syncs everything written so far.
+
+BlockCacheSize keeps the most recently fetched and inserted blocks in memory up
+to the given number of bytes, so blocks requested by many peers at once are
+served without reading the backend.  The BlockCacheStats function of a database
+reports the size of the cache and the fraction of fetches it served.
+
+PrefetchDepth reads up to the given number of blocks ahead of the caller on a
+goroutine of its own.  Block iterators read ahead as they are advanced, and
+drivers with a block cache read the following blocks into it once blocks are
+fetched in height order or the hashes of consecutive ranges are listed with
+FetchHeightRange, so scans of the chain rarely wait for the backend.
+
+Blocks are stored as they are given unless Validation selects checks performed
+on each of them first.  ValidateSanity rejects blocks which do not extend the
+newest block, whose hash does not meet the target difficulty of their header or
+whose transactions do not match the merkle root of their header, and
+ValidateStrict also rejects those breaking the rules of the block chain which
+do not depend on the outputs they spend.  Rejected blocks are reported with a
+ValidationError.
+
+Databases stored in files are locked while they are open through a lock of the
+operating system on a lock file next to them, so opening a database which is
+open already returns ErrDbBusy rather than letting two processes write to it at
+once.  The lock is released when the process holding it exits, even when it
+crashes, and recovery tools set ForceOpen to open a database without it.
+
+Scans which read many blocks may avoid allocating memory for each of them with
+FetchBlockBytesBySha, which reads the serialized block into a buffer given by
+the caller, such as one from GetBlockBuffer.  The returned bytes belong to the
+caller, and the buffer is handed back with PutBlockBuffer once nothing refers
+to it, including blocks created from it with btcutil.NewBlockFromBytes:
+
+	buf := btcdb.GetBlockBuffer()
+	for _, sha := range shas {
+		buf, err = db.FetchBlockBytesBySha(&sha, buf)
+		...
+	}
+	btcdb.PutBlockBuffer(buf)
+
+Metrics
+
+The Metrics field of Options receives the latency of block inserts, drops and
+fetches, the time they waited for the lock of the database and the number of
+blocks each insert held, along with gauges of the statistics kept by the
+storage engine, such as the compactions of leveldb.  ExpvarMetrics publishes
+them on the /debug/vars page of the default HTTP server, and other monitoring
+systems are supported by implementing the Metrics interface:
+
+	db, err := btcdb.OpenDBWithOptions("leveldb", btcdb.Options{
+		Path:    dbName,
+		Metrics: btcdb.NewExpvarMetrics("btcdb"),
+	})
+
+Operations taking at least the SlowOpThreshold of Options are logged as
+warnings along with the block they were given and how much of the time was
+spent waiting for the lock of the database rather than in the storage engine.
+
+Logging
+
+The package and its drivers log nothing until a logger is given to UseLogger.
+Any type with the functions of the Logger interface may be used, so output is
+routed to a logging package other than btclog through a small wrapper.  The
+output of a single driver, named by its package such as "ldb", may be sent to
+a logger of its own with UseDriverLogger and filtered with SetDriverLogLevel:
+
+	btcdb.UseLogger(logger)
+	btcdb.SetDriverLogLevel("ldb", "trace")
+
+Invalid Blocks
+
+Layers which validate the chain mark a stored block found to be invalid with
+InvalidateBlock, which removes it and the blocks after it from the chain while
+keeping them in the metadata namespace, so NewestSha and the queries by height
+no longer see them and the mark survives reopening the database.
+IsInvalidBlock tells whether a block is marked, so it is not fetched and
+inserted again, and ReconsiderBlock removes the mark and connects the blocks to
+the chain again when it has no blocks with more work in their place:
+
+	if err := btcdb.InvalidateBlock(db, sha); err != nil {
+		// Log and handle the error
+	}
+	...
+	err = btcdb.ReconsiderBlock(db, sha)
+
+Side Chains
+
+Blocks which do not extend the chain are stored with InsertSideBlock, which
+keeps them in the metadata namespace linked to their parent, in the chain or on
+a side chain itself, until SetMainChain makes the branch ending at one of them
+the chain.  SetMainChain moves the blocks it replaces to a side chain and
+switches the heights of the chain from one branch to the other in a single
+change with ReorganizeWithMeta.  Side blocks and blocks marked as invalid only
+hold their header and the hashes of their transactions, whose bytes are stored
+once under KeptTxPrefix however many of those blocks share them, as competing
+branches mostly do.  Transactions which are already in the chain are not stored
+again but read from it, until the blocks holding them leave the chain.
+FetchChainTips lists the newest block of the chain and of
+every branch off it, so callers find the branch with the most work:
+
+	tips, err := btcdb.FetchChainTips(db)
+	if err != nil {
+		// Log and handle the error
+	}
+	for _, tip := range tips {
+		if tip.Status == btcdb.ChainTipValidFork && ... {
+			err = btcdb.SetMainChain(db, &tip.Sha)
+		}
+	}
+
+Blocks whose parent is not stored yet are kept in an orphan pool with
+PutOrphan, which survives reopening the database, and FetchOrphansByParent
+lists the ones waiting for a block.  Orphans are promoted into the chain, or to
+a side chain when their parent is not the newest block, by PromoteOrphans once
+their parent is stored, and a promoter started with StartOrphanPromoter does so
+for every block connected to the chain.  EvictOrphans limits the age and size
+of the pool:
+
+	promoter, err := btcdb.StartOrphanPromoter(db)
+	if err != nil {
+		// Log and handle the error
+	}
+	defer promoter.Stop()
+	...
+	err = btcdb.PutOrphan(db, block)
+	...
+	_, err = btcdb.EvictOrphans(db, time.Hour, 64*1024*1024)
+
+Headers-First Sync
+
+Downloaders which fetch the headers of the chain before the bodies of its
+blocks store them with InsertHeaders, which keeps them in the metadata
+namespace ahead of the chain.  FetchHeaderTip returns the newest header known
+and FetchMissingBlockHeights lists the heights whose bodies are still to be
+fetched.  InsertBlockBody accepts the bodies in any order, keeping those which
+arrive ahead of the bodies below them, and connects them to the chain once they
+are contiguous, so NewestSha is the point up to which the database is fully
+synced while FetchBodyTip returns the highest body stored:
+
+	if _, err := btcdb.InsertHeaders(db, headers); err != nil {
+		// Log and handle the error
+	}
+	heights, err := btcdb.FetchMissingBlockHeights(db, 128)
+	...
+	_, err = btcdb.InsertBlockBody(db, block)
+
+Time Index
+
+A TimeIndex added with AddIndexer records the timestamp and median time past of
+every block of the chain along with an index from timestamps to heights.
+FetchMedianTimeByHeight returns the median time past of a block, and
+FetchBlockByTimestamp and HeightBeforeTime find the blocks of a point in time
+without fetching headers, so wallets rescan from a date:
+
+	if err := db.AddIndexer(btcdb.NewTimeIndex()); err != nil {
+		// Log and handle the error
+	}
+	height, err := btcdb.HeightBeforeTime(db, birthday)
+	...
+
+Difficulty
+
+FetchDifficultyByHeight returns the difficulty of a block of the chain computed
+from its stored header.  A RetargetHistory walks the blocks at the retarget
+boundaries of the chain, which are every RetargetInterval blocks, and caches
+them so charting the difficulty again does not read every header:
+
+	history := btcdb.NewRetargetHistory(db)
+	it := history.Iterator(0)
+	for it.Next() {
+		r := it.Retarget()
+		fmt.Println(r.Height, r.Timestamp, r.Difficulty)
+	}
+	if err := it.Err(); err != nil {
+		// Log and handle the error
+	}
+
+Block Statistics
+
+A StatsIndex added with AddIndexer records the size, number of transactions,
+total output value and fees of every block of the chain, which FetchBlockStats
+returns for a range of heights.  The fees of a block are computed from the
+outputs it spends, which the database passes to its indexers along with the
+block, so they are not reported when the database does not know them, such as
+when it only stores headers:
+
+	stats, err := btcdb.FetchBlockStats(db, start, btcdb.AllShas)
+	if err != nil {
+		// Log and handle the error
+	}
+
+A SupplyIndex added with AddIndexer tallies the coins created by the chain up
+to every block, which FetchSupplyAtHeight returns along with the subsidy and
+fees its coinbases left unclaimed, so auditing the supply curve reads no
+blocks.
+
+A UtxoHashIndex added with AddIndexer keeps the MuHash3072 of the unspent
+output set as of every block, computed the way Bitcoin Core computes the muhash
+of gettxoutsetinfo, so the state of a synced database can be checked against
+other implementations.  The hash is updated along with each block connected or
+disconnected, and UtxoSetHash returns it without reading any blocks:
+
+	hash, err := btcdb.UtxoSetHash(db, height)
+	if err != nil {
+		// Log and handle the error
+	}
+	fmt.Printf("muhash at height %d: %v\n", height, hash)
+
+An AddrBalanceIndex added with AddIndexer keeps the balance of every output
+script as of the newest block, updated with the outputs each block connected or
+disconnected creates and spends.  FetchAddrBalance returns the balance of a
+script and FetchRichList the scripts holding the most coins:
+
+	richest, err := btcdb.FetchRichList(db, 100)
+	if err != nil {
+		// Log and handle the error
+	}
+	for _, b := range richest {
+		fmt.Printf("%x: %d\n", b.PkScript, b.Balance)
+	}
+
+Version Bits
+
+A VersionBitsIndex added with AddIndexer counts the blocks of each retarget
+window which signal each bit of the block version as set out by BIP0009, so
+soft fork deployments are followed without reading headers.
+FetchVersionBitsWindow returns the counts of a window and FetchThresholdWindow
+the first complete window in which a bit reached a threshold:
+
+	w, err := btcdb.FetchThresholdWindow(db, bit, 1916, 0)
+	if err != nil {
+		// Log and handle the error
+	}
+	if w != nil {
+		fmt.Printf("locked in at height %d\n", w.StartHeight+
+			btcdb.RetargetInterval)
+	}
+
+OP_RETURN Outputs
+
+A NullDataIndex added with AddIndexer records every OP_RETURN output of the
+chain by the start of the data it carries, so protocols embedding records in
+such outputs find them with FetchNullData rather than by scanning the chain:
+
+	outs, err := btcdb.FetchNullData(db, []byte("protocol"), 100)
+	if err != nil {
+		// Log and handle the error
+	}
+	for _, out := range outs {
+		fmt.Println(out.Height, out.TxSha, out.Index, out.Payload)
+	}
+
+Coinbases
+
+A CoinbaseIndex added with AddIndexer keeps the coinbase transaction of every
+block, so tools attributing blocks to mining pools by their coinbase script or
+auditing the subsidy of each block read it with FetchCoinbaseByHeight without
+fetching the whole block:
+
+	tx, err := btcdb.FetchCoinbaseByHeight(db, height)
+	if err != nil {
+		// Log and handle the error
+	}
+	fmt.Printf("%x\n", tx.TxIn[0].SignatureScript)
+
+Script Classes
+
+A ScriptClassIndex added with AddIndexer counts the outputs of every block by
+the class of their script, such as pay-to-pubkey-hash, pay-to-script-hash or
+multisig, along with the outputs of the chain up to each block, so breakdowns
+of output types are read with FetchScriptClasses and FetchScriptClassTotals:
+
+	totals, err := btcdb.FetchScriptClassTotals(db, height)
+	if err != nil {
+		// Log and handle the error
+	}
+	fmt.Println(totals[btcdb.ScriptHashTy], "of", totals.Total(),
+		"outputs pay to script hashes")
+
+The index also records every output by its class, so FetchScriptClassOutputs
+lists the outputs of a class over a range of heights, such as the bare multisig
+outputs of the chain:
+
+	outs, err := btcdb.FetchScriptClassOutputs(db, btcdb.MultiSigTy, 0,
+		btcdb.AllShas, 100)
+	if err != nil {
+		// Log and handle the error
+	}
+	for _, out := range outs {
+		fmt.Println(out.Height, out.TxSha, out.Index, out.Value)
+	}
+
+Witness programs are classed by their version and, for version 0, by whether
+they pay to the hash of a public key or of a script.  Indexes recorded before
+witness programs were classed are rebuilt when they are added to the database.
+
+Rescanning
+
+Rescan walks the stored chain from a height on and calls back with every
+transaction paying to an output script the caller matches, and every
+transaction spending such an output, so wallets find their history without
+writing the loop themselves.  The blocks are decoded in parallel while the
+transactions are matched in order:
+
+	err := btcdb.Rescan(db, birthHeight, func(pkScript []byte) bool {
+		return wallet.IsMine(pkScript)
+	}, func(tx *btcutil.Tx, blockSha *btcwire.ShaHash, height int64) error {
+		return wallet.AddTx(tx, blockSha, height)
+	}, func(height int64) {
+		fmt.Println("rescanned through height", height)
+	})
+	if err != nil {
+		// Log and handle the error
+	}
+
+Watch-Only Wallets
+
+A WatchIndex added with AddIndexer records the outputs paying to a persistent
+set of watched scripts, and the inputs spending them, in the same change as
+each block inserted, so watch-only wallets read their history with
+FetchWatchHistory without a full address index:
+
+	idx := btcdb.NewWatchIndex()
+	if err := db.AddIndexer(idx); err != nil {
+		// Log and handle the error
+	}
+	if err := idx.WatchScript(pkScript); err != nil {
+		// Log and handle the error
+	}
+	...
+	events, err := btcdb.FetchWatchHistory(db, pkScript)
+
+The entry of each output records the input spending it, if any.
+FetchWatchHistoryPage returns a page of the history instead, from the oldest or
+the newest entry and optionally keeping only the outputs received or those still
+unspent, reading the history only up to the end of the page, so explorers serve
+scripts with long histories a page at a time:
+
+	events, err := btcdb.FetchWatchHistoryPage(db, pkScript,
+		btcdb.WatchHistoryQuery{Skip: 50, Limit: 25, NewestFirst: true})
+
+Mempool Persistence
+
+A MempoolStore added with AddIndexer keeps the unconfirmed transactions of a
+node in the metadata namespace, so the mempool is reloaded with
+ForEachMempoolTx after a restart.  The transactions confirmed by each block
+inserted, or conflicting with it, are removed in the same change as the block,
+and the transactions of each block dropped are returned to the store:
+
+	store := btcdb.NewMempoolStore()
+	if err := db.AddIndexer(store); err != nil {
+		// Log and handle the error
+	}
+	if err := store.PutMempoolTx(tx, time.Now()); err != nil {
+		// Log and handle the error
+	}
+	...
+	err = btcdb.ForEachMempoolTx(db, func(tx *btcdb.MempoolTx) error {
+		// Check the transaction and add it to the mempool
+		return nil
+	})
+
+Peer Addresses
+
+The address manager of a node keeps the addresses of network peers with
+PutPeerAddress and their ban scores with PutPeerBan under PeerPrefix in the
+metadata namespace, so it needs no database file of its own.  Ban scores are
+ignored once they expire, and EvictPeers removes them along with the addresses
+which were not seen for too long or exceed a limit:
+
+	err := btcdb.PutPeerAddress(db, &btcdb.PeerAddress{
+		Addr:     "10.0.0.1:8333",
+		LastSeen: time.Now(),
+	})
+	...
+	err = btcdb.PutPeerBan(db, &btcdb.PeerBan{
+		Host:    "10.0.0.2",
+		Score:   100,
+		Expires: time.Now().Add(24 * time.Hour),
+	})
+	...
+	_, err = btcdb.EvictPeers(db, 30*24*time.Hour, 20000)
+
+Migration
+
+Export writes the chain and metadata of a database to a stream in a format
+which does not depend on the driver, and Import reads such a stream into a
+database of any type, so a database is moved to another driver without
+downloading the chain again:
+
+	f, err := os.Create("chain.export")
+	if err != nil {
+		// Log and handle the error
+	}
+	err = btcdb.Export(oldDb, f)
+	...
+	err = btcdb.Import(newDb, f)
+
+Importing the same export again after an interrupted import resumes it.
+
+ImportBootstrap similarly loads the bootstrap.dat and blk*.dat files of the
+reference client, so a new database is filled from local files rather than
+from the network.  ImportBlockFiles loads its whole blocks directory and records
+its progress in the metadata namespace, so it resumes after an interruption.
+The ExportBootstrap function of a database writes its blocks in the same format
+to seed other nodes.
+
+Callers with serialized blocks in chain order from elsewhere load them with an
+ImportPipeline, which deserializes the blocks and hashes their transactions on
+a worker for each processor while inserting the decoded blocks in order:
+
+	p := btcdb.NewImportPipeline(db, 0)
+	for _, raw := range blocks {
+		if err := p.Add(raw); err != nil {
+			break
+		}
+	}
+	n, err := p.Close()
 */
 package btcdb
@@ -0,0 +1,365 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// ExportVersion is the version of the export format written by Export.
+const ExportVersion = 1
+
+// ExportHeadersOnly is set in the flags of an export of a database which only
+// stores block headers, in which case every block is exported as a header.
+const ExportHeadersOnly = 1 << 0
+
+// exportMagic identifies a stream written by Export.
+var exportMagic = [8]byte{'b', 't', 'c', 'd', 'b', 'e', 'x', 'p'}
+
+// The types of the records which follow the header of an export.
+const (
+	recordEnd    = 0
+	recordBlock  = 1
+	recordHeader = 2
+	recordMeta   = 3
+)
+
+// importBatchSize is the number of blocks inserted together by Import.
+const importBatchSize = 100
+
+// exportHdr is the header at the start of an export.  The block count is a
+// hint of the number of blocks which follow for progress reporting, while the
+// trailing end record holds the actual counts.
+type exportHdr struct {
+	Magic      [8]byte
+	Version    uint32
+	Flags      uint32
+	BlockCount int64
+}
+
+// Export writes every block of the chain followed by the metadata namespace of
+// the passed database to the passed writer in a format which Import reads
+// into a database of any type.  Everything is read from a snapshot, so the
+// database may be changed meanwhile.
+//
+// The export starts with a header holding the format version, flags such as
+// ExportHeadersOnly and the number of blocks.  It is followed by one record for
+// every block in height order, holding its height and hash along with the
+// length-prefixed serialized block, or only the header for databases which
+// don't store bodies, and one length-prefixed key and value record for every
+// metadata key.  An end record with the number of blocks and keys completes
+// the export, so truncated streams are detected.  All integers are little
+// endian.  Databases with pruned blocks can not be exported and return
+// ErrPruned.
+func Export(db Db, w io.Writer) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	_, newest, err := snap.NewestSha()
+	if err != nil {
+		return err
+	}
+	hdr := exportHdr{Magic: exportMagic, Version: ExportVersion,
+		BlockCount: newest + 1}
+	if newest >= 0 {
+		sha, err := snap.FetchBlockShaByHeight(0)
+		if err != nil {
+			return err
+		}
+		if _, err := snap.FetchBlockBySha(sha); err == ErrHeadersOnly {
+			hdr.Flags |= ExportHeadersOnly
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for height := int64(0); height <= newest; height++ {
+		if err := exportBlock(bw, snap, height, hdr.Flags); err != nil {
+			return err
+		}
+	}
+
+	var metaCount int64
+	iter, err := snap.MetaIterator(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for iter.Next() {
+		if err := writeExportRecord(bw, recordMeta, nil, iter.Key(),
+			iter.Value()); err != nil {
+			return err
+		}
+		metaCount++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	var end [16]byte
+	binary.LittleEndian.PutUint64(end[0:], uint64(newest+1))
+	binary.LittleEndian.PutUint64(end[8:], uint64(metaCount))
+	if err := writeExportRecord(bw, recordEnd, nil, end[:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// exportBlock writes the record of the block at the given height to the
+// passed writer.
+func exportBlock(w io.Writer, snap Snapshot, height int64, flags uint32) error {
+	sha, err := snap.FetchBlockShaByHeight(height)
+	if err != nil {
+		return err
+	}
+	var prefix [8 + btcwire.HashSize]byte
+	binary.LittleEndian.PutUint64(prefix[:], uint64(height))
+	copy(prefix[8:], sha.Bytes())
+
+	if flags&ExportHeadersOnly != 0 {
+		bh, err := snap.FetchBlockHeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := bh.Serialize(&buf); err != nil {
+			return err
+		}
+		return writeExportRecord(w, recordHeader, prefix[:], buf.Bytes())
+	}
+
+	blk, err := snap.FetchBlockBySha(sha)
+	if err != nil {
+		return err
+	}
+	raw, err := blk.Bytes()
+	if err != nil {
+		return err
+	}
+	return writeExportRecord(w, recordBlock, prefix[:], raw)
+}
+
+// writeExportRecord writes a record of the given type made of the passed fixed
+// size prefix followed by each of the passed fields with its length.
+func writeExportRecord(w io.Writer, recType byte, prefix []byte, fields ...[]byte) error {
+	if _, err := w.Write([]byte{recType}); err != nil {
+		return err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(len(field)))
+		if _, err := w.Write(n[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExportField reads a length-prefixed field of an export record.
+func readExportField(r io.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(n[:])
+	if size > btcwire.MaxBlockPayload {
+		return nil, fmt.Errorf("export record field of %d bytes is "+
+			"too large", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Import reads an export written by Export into the passed database.  Blocks
+// the database already has at the same heights are skipped, so an interrupted
+// import is resumed by importing the same export again, while a block which
+// differs from the one the database has at its height fails the import.  The
+// metadata keys are written once all blocks are inserted.
+func Import(db Db, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var hdr exportHdr
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.Magic != exportMagic {
+		return fmt.Errorf("stream is not a btcdb export")
+	}
+	if hdr.Version != ExportVersion {
+		return fmt.Errorf("unsupported export version %d", hdr.Version)
+	}
+
+	_, next, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	next++
+
+	var blocks []*btcutil.Block
+	flush := func() error {
+		if len(blocks) == 0 {
+			return nil
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			return err
+		}
+		next += int64(len(blocks))
+		blocks = blocks[:0]
+		return nil
+	}
+
+	var blockCount, metaCount int64
+	var meta MetaBatch
+	for {
+		recType, err := br.ReadByte()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		switch recType {
+		case recordBlock, recordHeader:
+			if metaCount != 0 {
+				return fmt.Errorf("export has a block after " +
+					"its metadata")
+			}
+			blk, height, err := readExportBlock(br, recType)
+			if err != nil {
+				return err
+			}
+			if height != blockCount {
+				return fmt.Errorf("export has a block at "+
+					"height %d instead of %d", height,
+					blockCount)
+			}
+			blockCount++
+
+			// Blocks the database already has are checked to be
+			// the same and skipped.
+			if height < next {
+				have, err := db.FetchBlockShaByHeight(height)
+				if err != nil {
+					return err
+				}
+				sha, _ := blk.Sha()
+				if !have.IsEqual(sha) {
+					return fmt.Errorf("database has block "+
+						"%v at height %d instead of "+
+						"%v", have, height, sha)
+				}
+				continue
+			}
+			blocks = append(blocks, blk)
+			if len(blocks) >= importBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+
+		case recordMeta:
+			if err := flush(); err != nil {
+				return err
+			}
+			key, err := readExportField(br)
+			if err != nil {
+				return err
+			}
+			value, err := readExportField(br)
+			if err != nil {
+				return err
+			}
+			meta.Put(key, value)
+			metaCount++
+			if meta.Len() >= importBatchSize {
+				if err := db.WriteMeta(&meta); err != nil {
+					return err
+				}
+				meta.Reset()
+			}
+
+		case recordEnd:
+			end, err := readExportField(br)
+			if err != nil {
+				return err
+			}
+			if len(end) != 16 ||
+				int64(binary.LittleEndian.Uint64(end)) != blockCount ||
+				int64(binary.LittleEndian.Uint64(end[8:])) != metaCount {
+				return fmt.Errorf("export is incomplete")
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if meta.Len() != 0 {
+				return db.WriteMeta(&meta)
+			}
+			return nil
+
+		default:
+			return fmt.Errorf("export has unknown record type %d",
+				recType)
+		}
+	}
+}
+
+// readExportBlock reads the rest of a block or header record of an export and
+// returns the block along with its height.  The block is checked against the
+// hash recorded with it.
+func readExportBlock(r io.Reader, recType byte) (*btcutil.Block, int64, error) {
+	var prefix [8 + btcwire.HashSize]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, 0, err
+	}
+	height := int64(binary.LittleEndian.Uint64(prefix[:]))
+	var sha btcwire.ShaHash
+	sha.SetBytes(prefix[8:])
+
+	buf, err := readExportField(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	var blk *btcutil.Block
+	if recType == recordHeader {
+		var msgBlock btcwire.MsgBlock
+		err = msgBlock.Header.Deserialize(bytes.NewReader(buf))
+		blk = btcutil.NewBlock(&msgBlock)
+	} else {
+		blk, err = btcutil.NewBlockFromBytes(buf)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blkSha, err := blk.Sha()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !blkSha.IsEqual(&sha) {
+		return nil, 0, fmt.Errorf("block at height %d of export hashes "+
+			"to %v instead of %v", height, blkSha, &sha)
+	}
+	return blk, height, nil
+}
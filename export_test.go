@@ -0,0 +1,32 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// SetBIP30Exception makes the transaction with the passed hash in the block at
+// the given height a duplicate allowed by IsBIP30Exception and returns a
+// function which restores the exceptions as they were.
+// This is a testing only interface.
+func SetBIP30Exception(height int64, sha *btcwire.ShaHash) func() {
+	prev, ok := bip30Exceptions[height]
+	bip30Exceptions[height] = sha
+	return func() {
+		if ok {
+			bip30Exceptions[height] = prev
+		} else {
+			delete(bip30Exceptions, height)
+		}
+	}
+}
+
+// CalcMerkleRoot returns the merkle root of the passed transactions.
+// This is a testing only interface.
+func CalcMerkleRoot(txs []*btcutil.Tx) btcwire.ShaHash {
+	return calcMerkleRoot(txs)
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBackup ensures every supported database type which supports backups
+// produces a copy which opens as a consistent database ending at a block
+// between the tips before and after blocks inserted while the backup runs.
+func TestBackup(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The copies are kept apart from the test databases, which are
+	// removed by the teardown before the copies are opened.
+	backupRoot := "tstbackups"
+	if err := os.MkdirAll(backupRoot, 0700); err != nil {
+		t.Errorf("Unable to create backup root: %v", err)
+		return
+	}
+	defer os.RemoveAll(backupRoot)
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "backup", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		half := len(blocks) / 2
+		for height, block := range blocks[:half] {
+			if _, err := db.InsertBlock(block); err != nil {
+				t.Errorf("InsertBlock (%s): failed to insert "+
+					"block %v: %v", dbType, height, err)
+				break
+			}
+		}
+
+		destPath := filepath.Join(backupRoot, dbType)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, block := range blocks[half:] {
+				if _, err := db.InsertBlock(block); err != nil {
+					return
+				}
+			}
+		}()
+		var copied int64
+		err = db.Backup(destPath, func(n int64) {
+			if n < copied {
+				t.Errorf("Backup (%s): progress went from %d "+
+					"to %d", dbType, copied, n)
+			}
+			copied = n
+		})
+		<-done
+		teardown()
+
+		switch {
+		case err == btcdb.ErrBackupUnsupported:
+			continue
+		case err != nil:
+			t.Errorf("Backup (%s): %v", dbType, err)
+			continue
+		case copied == 0:
+			t.Errorf("Backup (%s): no progress reported", dbType)
+		}
+
+		backup, err := btcdb.OpenDB(dbType, destPath)
+		if err != nil {
+			t.Errorf("OpenDB of backup (%s): %v", dbType, err)
+			continue
+		}
+		sha, height, err := backup.NewestSha()
+		if err != nil || height < int64(half-1) ||
+			height >= int64(len(blocks)) {
+
+			t.Errorf("NewestSha of backup (%s): got height %d (err "+
+				"%v), want at least %d", dbType, height, err,
+				half-1)
+		} else if wantSha, _ := blocks[height].Sha(); !sha.IsEqual(wantSha) {
+			t.Errorf("NewestSha of backup (%s): got %v, want %v",
+				dbType, sha, wantSha)
+		}
+		err = backup.VerifyIntegrity(btcdb.VerifyBlocks, nil)
+		if err != nil {
+			t.Errorf("VerifyIntegrity of backup (%s): %v", dbType,
+				err)
+		}
+		backup.Close()
+	}
+}
+
+// TestExportImport ensures a database exported from one database type imports
+// into every supported database type with the same chain and metadata, and that
+// an import of a truncated export fails and is resumed by importing the whole
+// export.
+func TestExportImport(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	src, teardown, err := createDB("leveldb", "export", true)
+	if err != nil {
+		t.Errorf("Failed to create test database %v", err)
+		return
+	}
+	if _, err := src.InsertBlocks(blocks); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		teardown()
+		return
+	}
+	wantMeta := map[string][]byte{
+		"exportkey1": []byte("value1"),
+		"exportkey2": []byte{},
+	}
+	var meta btcdb.MetaBatch
+	for key, value := range wantMeta {
+		meta.Put([]byte(key), value)
+	}
+	if err := src.WriteMeta(&meta); err != nil {
+		t.Errorf("WriteMeta: %v", err)
+		teardown()
+		return
+	}
+	var buf bytes.Buffer
+	err = btcdb.Export(src, &buf)
+	teardown()
+	if err != nil {
+		t.Errorf("Export: %v", err)
+		return
+	}
+	export := buf.Bytes()
+	wantSha, _ := blocks[len(blocks)-1].Sha()
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "import", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		err = btcdb.Import(db, bytes.NewReader([]byte("notanexport")))
+		if err == nil {
+			t.Errorf("Import (%s): unexpected success for stream "+
+				"which is not an export", dbType)
+		}
+		truncated := bytes.NewReader(export[:len(export)*2/3])
+		if err := btcdb.Import(db, truncated); err == nil {
+			t.Errorf("Import (%s): unexpected success for truncated "+
+				"export", dbType)
+		}
+		if err := btcdb.Import(db, bytes.NewReader(export)); err != nil {
+			t.Errorf("Import (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		sha, height, err := db.NewestSha()
+		if err != nil || height != int64(len(blocks)-1) ||
+			!sha.IsEqual(wantSha) {
+
+			t.Errorf("NewestSha (%s): got %v at height %d (err %v), "+
+				"want %v at height %d", dbType, sha, height, err,
+				wantSha, len(blocks)-1)
+		}
+		for key, want := range wantMeta {
+			got, err := db.GetMeta([]byte(key))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("GetMeta (%s): got %q (err %v) for %q, "+
+					"want %q", dbType, got, err, key, want)
+			}
+		}
+		teardown()
+	}
+}
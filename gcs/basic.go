@@ -0,0 +1,110 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+const (
+	// BasicFilterP is the Golomb-Rice parameter of basic filters.
+	BasicFilterP = 19
+
+	// BasicFilterM is the inverse false positive rate of basic filters.
+	BasicFilterM = 784931
+)
+
+// opReturn is the opcode which marks an output as provably unspendable.
+const opReturn = 0x6a
+
+// BasicFilterKey returns the key the basic filter of the block with the passed
+// hash is built with, which is the first KeySize bytes of the hash.
+func BasicFilterKey(blockSha *btcwire.ShaHash) [KeySize]byte {
+	var key [KeySize]byte
+	copy(key[:], blockSha.Bytes())
+	return key
+}
+
+// BuildBasicFilter returns the basic filter of the passed block.  It holds the
+// script of every output created by the block other than empty and OP_RETURN
+// scripts, and the script of every output spent by the block.  The outputs
+// spent from earlier blocks are looked up with the passed function, which must
+// return the transaction with the given hash.
+func BuildBasicFilter(block *btcutil.Block, fetchTx func(*btcwire.ShaHash) (*btcwire.MsgTx, error)) ([]byte, error) {
+	blockSha, err := block.Sha()
+	if err != nil {
+		return nil, err
+	}
+
+	// Transactions in the block may spend the outputs of earlier ones and
+	// blocks often spend several outputs of the same transaction, so keep
+	// every transaction looked at around.
+	txns := make(map[btcwire.ShaHash]*btcwire.MsgTx)
+	for _, tx := range block.Transactions() {
+		txns[*tx.Sha()] = tx.MsgTx()
+	}
+
+	var items [][]byte
+	for i, tx := range block.Transactions() {
+		msgTx := tx.MsgTx()
+		for _, txOut := range msgTx.TxOut {
+			script := txOut.PkScript
+			if len(script) == 0 || script[0] == opReturn {
+				continue
+			}
+			items = append(items, script)
+		}
+
+		// The coinbase does not spend any outputs.
+		if i == 0 {
+			continue
+		}
+		for _, txIn := range msgTx.TxIn {
+			op := &txIn.PreviousOutpoint
+			prevTx, ok := txns[op.Hash]
+			if !ok {
+				prevTx, err = fetchTx(&op.Hash)
+				if err != nil {
+					return nil, err
+				}
+				txns[op.Hash] = prevTx
+			}
+			if op.Index >= uint32(len(prevTx.TxOut)) {
+				return nil, fmt.Errorf("unable to build filter for "+
+					"block %v: output %v:%d does not exist",
+					blockSha, &op.Hash, op.Index)
+			}
+			if script := prevTx.TxOut[op.Index].PkScript; len(script) != 0 {
+				items = append(items, script)
+			}
+		}
+	}
+
+	return Build(BasicFilterP, BasicFilterM, BasicFilterKey(blockSha),
+		items), nil
+}
+
+// MatchBasic returns whether or not the passed script is in the basic filter
+// of the block with the given hash.
+func MatchBasic(filter []byte, blockSha *btcwire.ShaHash, script []byte) (bool, error) {
+	return Match(filter, BasicFilterP, BasicFilterM,
+		BasicFilterKey(blockSha), script)
+}
+
+// FilterHeader returns the header of the passed filter which commits to the
+// filter and, through the passed header of the filter of the previous block,
+// to the filters of every block before it.  The previous header of the
+// genesis block is all zeros.
+func FilterHeader(filter []byte, prevHeader *btcwire.ShaHash) btcwire.ShaHash {
+	buf := make([]byte, 0, 2*btcwire.HashSize)
+	buf = append(buf, btcwire.DoubleSha256(filter)...)
+	buf = append(buf, prevHeader.Bytes()...)
+
+	var header btcwire.ShaHash
+	header.SetBytes(btcwire.DoubleSha256(buf))
+	return header
+}
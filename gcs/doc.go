@@ -0,0 +1,23 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package gcs implements the Golomb-coded set filters described by BIP0158 which
+are used to serve compact block filters to light clients.
+
+A filter commits to a set of items, such as the scripts a block pays to and
+spends from, in far less space than the items themselves.  Clients test
+whether an item is in the set with Match, which never misses an item that was
+added but reports an item that was not with a small probability.
+
+BuildBasicFilter builds the basic filter of a block and FilterHeader chains
+the filters of successive blocks together:
+
+	filter, err := gcs.BuildBasicFilter(block, fetchTx)
+	if err != nil {
+		return err
+	}
+	header := gcs.FilterHeader(filter, &prevHeader)
+*/
+package gcs
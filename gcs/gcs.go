@@ -0,0 +1,193 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/conformal/btcwire"
+	"math/bits"
+	"sort"
+)
+
+// KeySize is the size of the SipHash key which items are hashed with.
+const KeySize = 16
+
+// ErrMalformedFilter is returned when a serialized filter ends before all of
+// the items it claims to hold have been read.
+var ErrMalformedFilter = errors.New("malformed filter")
+
+// uint64Slice implements sort.Interface to sort the hashed items of a filter.
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// hashToRange hashes the passed item and maps the result uniformly onto the
+// range [0, f).
+func hashToRange(k0, k1 uint64, f uint64, item []byte) uint64 {
+	hi, _ := bits.Mul64(sipHash(k0, k1, item), f)
+	return hi
+}
+
+// splitKey returns the two halves of the passed key as used by SipHash.
+func splitKey(key *[KeySize]byte) (uint64, uint64) {
+	return binary.LittleEndian.Uint64(key[0:8]),
+		binary.LittleEndian.Uint64(key[8:16])
+}
+
+// bitWriter appends bits to a byte slice starting with the most significant
+// bit of each byte.
+type bitWriter struct {
+	buf  []byte
+	free uint
+}
+
+// writeBit appends a single bit.
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+// writeBits appends the n least significant bits of v, most significant
+// first.
+func (w *bitWriter) writeBits(v uint64, n uint8) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<uint(i)) != 0)
+	}
+}
+
+// bitReader reads the bits written by a bitWriter.
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+// readBit returns the next bit.
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.buf))*8 {
+		return false, ErrMalformedFilter
+	}
+	bit := r.buf[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+// readBits returns the next n bits as an integer.
+func (r *bitReader) readBits(n uint8) (uint64, error) {
+	var v uint64
+	for i := uint8(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+// readDelta returns the next Golomb-Rice coded value with the parameter p.
+func (r *bitReader) readDelta(p uint8) (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+	rem, err := r.readBits(p)
+	if err != nil {
+		return 0, err
+	}
+	return q<<p | rem, nil
+}
+
+// Build returns the serialized filter of the passed items using the Golomb-Rice
+// parameter p, the inverse false positive rate m, and the given key.  Duplicate
+// items are only added once.  The filter is the number of items as a variable
+// length integer followed by the sorted differences between the hashes of the
+// items, each Golomb-Rice coded.
+func Build(p uint8, m uint64, key [KeySize]byte, items [][]byte) []byte {
+	set := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		set[string(item)] = struct{}{}
+	}
+
+	var buf bytes.Buffer
+	n := uint64(len(set))
+	btcwire.WriteVarInt(&buf, 0, n)
+	if n == 0 {
+		return buf.Bytes()
+	}
+
+	k0, k1 := splitKey(&key)
+	values := make(uint64Slice, 0, n)
+	for item := range set {
+		values = append(values, hashToRange(k0, k1, n*m, []byte(item)))
+	}
+	sort.Sort(values)
+
+	w := bitWriter{buf: buf.Bytes()}
+	var last uint64
+	for _, v := range values {
+		delta := v - last
+		last = v
+		for q := delta >> p; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, p)
+	}
+	return w.buf
+}
+
+// Match returns whether or not the passed item is in the serialized filter
+// which was built with the given parameters and key.  Items which were added
+// to the filter always match while others match with a probability of 1/m.
+func Match(filter []byte, p uint8, m uint64, key [KeySize]byte, item []byte) (bool, error) {
+	r := bytes.NewReader(filter)
+	n, err := btcwire.ReadVarInt(r, 0)
+	if err != nil {
+		return false, ErrMalformedFilter
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	k0, k1 := splitKey(&key)
+	target := hashToRange(k0, k1, n*m, item)
+
+	br := bitReader{buf: filter[len(filter)-r.Len():]}
+	var value uint64
+	for i := uint64(0); i < n; i++ {
+		delta, err := br.readDelta(p)
+		if err != nil {
+			return false, err
+		}
+		value += delta
+		if value == target {
+			return true, nil
+		}
+		if value > target {
+			return false, nil
+		}
+	}
+	return false, nil
+}
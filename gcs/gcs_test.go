@@ -0,0 +1,129 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package gcs_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/conformal/btcdb/gcs"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestSipHash ensures SipHash-2-4 produces the reference test vectors, which
+// hash the bytes 0 through n-1 with the key 0 through 15.
+func TestSipHash(t *testing.T) {
+	tests := []struct {
+		n    int
+		want uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{15, 0xa129ca6149be45e5},
+	}
+
+	var key [gcs.KeySize]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for _, test := range tests {
+		data := make([]byte, test.n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		if got := gcs.SipHash(key, data); got != test.want {
+			t.Errorf("SipHash of %d bytes: got %x, want %x", test.n,
+				got, test.want)
+		}
+	}
+}
+
+// TestBasicFilterGenesis ensures the basic filter and filter header of the
+// testnet genesis block match the BIP0158 test vector.
+func TestBasicFilterGenesis(t *testing.T) {
+	block := btcutil.NewBlock(&btcwire.TestNet3GenesisBlock)
+	fetchTx := func(*btcwire.ShaHash) (*btcwire.MsgTx, error) {
+		t.Errorf("genesis block looked up a transaction")
+		return nil, nil
+	}
+	filter, err := gcs.BuildBasicFilter(block, fetchTx)
+	if err != nil {
+		t.Errorf("BuildBasicFilter: %v", err)
+		return
+	}
+	if got := hex.EncodeToString(filter); got != "019dfca8" {
+		t.Errorf("BuildBasicFilter: got %s, want 019dfca8", got)
+	}
+
+	header := gcs.FilterHeader(filter, &btcwire.ShaHash{})
+	want := "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750"
+	if got := header.String(); got != want {
+		t.Errorf("FilterHeader: got %s, want %s", got, want)
+	}
+}
+
+// TestBuildMatch ensures every item added to a filter matches while other
+// items only match at about the expected false positive rate.
+func TestBuildMatch(t *testing.T) {
+	var key [gcs.KeySize]byte
+	copy(key[:], "0123456789abcdef")
+
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		items = append(items, []byte{byte(i), byte(i >> 8), 0xaa})
+	}
+	filter := gcs.Build(gcs.BasicFilterP, gcs.BasicFilterM, key, items)
+
+	// Duplicates are only added once.
+	dupFilter := gcs.Build(gcs.BasicFilterP, gcs.BasicFilterM, key,
+		append(items, items[0], items[1]))
+	if !bytes.Equal(filter, dupFilter) {
+		t.Errorf("Build: duplicate items changed the filter")
+	}
+
+	for _, item := range items {
+		match, err := gcs.Match(filter, gcs.BasicFilterP,
+			gcs.BasicFilterM, key, item)
+		if err != nil || !match {
+			t.Errorf("Match %x: got %v, %v, want true", item, match,
+				err)
+		}
+	}
+
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		item := []byte{byte(i), byte(i >> 8), 0xbb}
+		match, err := gcs.Match(filter, gcs.BasicFilterP,
+			gcs.BasicFilterM, key, item)
+		if err != nil {
+			t.Errorf("Match %x: %v", item, err)
+			return
+		}
+		if match {
+			falsePositives++
+		}
+	}
+	if falsePositives > 1 {
+		t.Errorf("Match: %d false positives out of 10000",
+			falsePositives)
+	}
+
+	// An empty filter holds no items and a truncated one is malformed.
+	empty := gcs.Build(gcs.BasicFilterP, gcs.BasicFilterM, key, nil)
+	if !bytes.Equal(empty, []byte{0}) {
+		t.Errorf("Build: empty filter got %x, want 00", empty)
+	}
+	if match, err := gcs.Match(empty, gcs.BasicFilterP,
+		gcs.BasicFilterM, key, items[0]); match || err != nil {
+		t.Errorf("Match: empty filter got %v, %v", match, err)
+	}
+	_, err := gcs.Match(filter[:len(filter)/2], gcs.BasicFilterP,
+		gcs.BasicFilterM, key, []byte("missing"))
+	if err != gcs.ErrMalformedFilter {
+		t.Errorf("Match: truncated filter got %v, want %v", err,
+			gcs.ErrMalformedFilter)
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package gcs
+
+// SipHash returns the SipHash-2-4 of the passed data under the given key.
+// This is a testing only interface.
+func SipHash(key [KeySize]byte, data []byte) uint64 {
+	k0, k1 := splitKey(&key)
+	return sipHash(k0, k1, data)
+}
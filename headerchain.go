@@ -0,0 +1,476 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// SyncHeaderPrefix is the prefix of the keys of the metadata namespace under
+// which InsertHeaders keeps the headers of blocks whose bodies are not in the
+// chain yet.  Each key is the prefix followed by the height of a header as a
+// big endian number, so the headers are iterated in height order, and its
+// value is the serialized header.
+var SyncHeaderPrefix = []byte("btcdb/syncheader/")
+
+// SyncHeaderShaPrefix is the prefix of the keys of the metadata namespace
+// which map the hash of each header kept under SyncHeaderPrefix to its height.
+var SyncHeaderShaPrefix = []byte("btcdb/syncheadersha/")
+
+// HeaderTipKey is the key of the metadata namespace under which the height and
+// hash of the newest header kept under SyncHeaderPrefix are stored.
+var HeaderTipKey = []byte("btcdb/headertip")
+
+// SyncBodyPrefix is the prefix of the keys of the metadata namespace under
+// which InsertBlockBody keeps the bodies of blocks which arrived before the
+// bodies of the blocks below them.  Each key is the prefix followed by the
+// height of a block as a big endian number, and its value is the serialized
+// block.  The header kept for the height is marked while its body is kept.
+var SyncBodyPrefix = []byte("btcdb/syncbody/")
+
+// BodyTipKey is the key of the metadata namespace under which the height and
+// hash of the highest block whose body is kept under SyncBodyPrefix are
+// stored.
+var BodyTipKey = []byte("btcdb/bodytip")
+
+// syncBodyMark is appended to the header kept for a height while the body of
+// its block is kept under SyncBodyPrefix.
+const syncBodyMark = 1
+
+// syncHeaderKey returns the key of the metadata namespace under which the
+// header at the passed height is kept.
+func syncHeaderKey(height int64) []byte {
+	key := make([]byte, len(SyncHeaderPrefix)+8)
+	copy(key, SyncHeaderPrefix)
+	binary.BigEndian.PutUint64(key[len(SyncHeaderPrefix):], uint64(height))
+	return key
+}
+
+// syncBodyKey returns the key of the metadata namespace under which the body
+// of the block at the passed height is kept.
+func syncBodyKey(height int64) []byte {
+	key := make([]byte, len(SyncBodyPrefix)+8)
+	copy(key, SyncBodyPrefix)
+	binary.BigEndian.PutUint64(key[len(SyncBodyPrefix):], uint64(height))
+	return key
+}
+
+// syncHeaderShaKey returns the key of the metadata namespace under which the
+// height of the header with the passed hash is kept.
+func syncHeaderShaKey(sha *btcwire.ShaHash) []byte {
+	key := make([]byte, len(SyncHeaderShaPrefix)+btcwire.HashSize)
+	copy(key, SyncHeaderShaPrefix)
+	copy(key[len(SyncHeaderShaPrefix):], sha.Bytes())
+	return key
+}
+
+// fetchSyncHeight returns the height of the header with the passed hash kept
+// under SyncHeaderPrefix, or -1 when there is no such header.
+func fetchSyncHeight(db Db, sha *btcwire.ShaHash) (int64, error) {
+	val, err := db.GetMeta(syncHeaderShaKey(sha))
+	if err != nil {
+		return 0, err
+	}
+	if val == nil {
+		return -1, nil
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("malformed header height record %x", val)
+	}
+	return int64(binary.LittleEndian.Uint64(val)), nil
+}
+
+// fetchTipRecord returns the hash and height stored under the passed key, such
+// as HeaderTipKey, or a height of -1 when there are none.
+func fetchTipRecord(db Db, key []byte) (*btcwire.ShaHash, int64, error) {
+	val, err := db.GetMeta(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if val == nil {
+		return nil, -1, nil
+	}
+	if len(val) != 8+btcwire.HashSize {
+		return nil, 0, fmt.Errorf("malformed tip record %x", val)
+	}
+	var sha btcwire.ShaHash
+	copy(sha[:], val[8:])
+	return &sha, int64(binary.LittleEndian.Uint64(val[:8])), nil
+}
+
+// putTipRecord adds storing the passed hash and height under the passed key to
+// the passed batch.
+func putTipRecord(meta *MetaBatch, key []byte, sha *btcwire.ShaHash, height int64) {
+	val := make([]byte, 8+btcwire.HashSize)
+	binary.LittleEndian.PutUint64(val, uint64(height))
+	copy(val[8:], sha.Bytes())
+	meta.Put(key, val)
+}
+
+// fetchSyncHeader returns the header kept for the passed height along with
+// whether the body of its block is kept under SyncBodyPrefix.  A nil header is
+// returned when no header is kept for the height.
+func fetchSyncHeader(db Db, height int64) (*btcwire.BlockHeader, bool, error) {
+	val, err := db.GetMeta(syncHeaderKey(height))
+	if err != nil {
+		return nil, false, err
+	}
+	if val == nil {
+		return nil, false, nil
+	}
+	var bh btcwire.BlockHeader
+	if err := bh.Deserialize(bytes.NewReader(val)); err != nil {
+		return nil, false, err
+	}
+	return &bh, len(val) > blockHeaderLen, nil
+}
+
+// deleteSyncHeaders adds removing the headers kept for the heights from the
+// start height through the end height, along with their hashes and the bodies
+// kept for them, to the passed batch.  The body tip is moved back to the
+// highest body kept below the start height.
+func deleteSyncHeaders(db Db, startHeight, endHeight int64, meta *MetaBatch) error {
+	for height := startHeight; height <= endHeight; height++ {
+		bh, hasBody, err := fetchSyncHeader(db, height)
+		if err != nil {
+			return err
+		}
+		if bh == nil {
+			continue
+		}
+		sha, err := bh.BlockSha()
+		if err != nil {
+			return err
+		}
+		meta.Delete(syncHeaderKey(height))
+		meta.Delete(syncHeaderShaKey(&sha))
+		if hasBody {
+			meta.Delete(syncBodyKey(height))
+		}
+	}
+
+	_, bodyTip, err := fetchTipRecord(db, BodyTipKey)
+	if err != nil || bodyTip < startHeight {
+		return err
+	}
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	for height := startHeight - 1; height > newest; height-- {
+		bh, hasBody, err := fetchSyncHeader(db, height)
+		if err != nil {
+			return err
+		}
+		if bh != nil && hasBody {
+			sha, err := bh.BlockSha()
+			if err != nil {
+				return err
+			}
+			putTipRecord(meta, BodyTipKey, &sha, height)
+			return nil
+		}
+	}
+	meta.Delete(BodyTipKey)
+	return nil
+}
+
+// FetchHeaderTip returns the hash and height of the newest header known to the
+// passed database, which is the newest header stored with InsertHeaders or the
+// newest block of the chain when the chain has caught up with the headers.
+func FetchHeaderTip(db Db) (*btcwire.ShaHash, int64, error) {
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		return nil, 0, err
+	}
+	hdrSha, hdrHeight, err := fetchTipRecord(db, HeaderTipKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hdrHeight > height {
+		return hdrSha, hdrHeight, nil
+	}
+	return sha, height, nil
+}
+
+// FetchBodyTip returns the hash and height of the highest block whose body is
+// stored in the passed database, which is either a body inserted with
+// InsertBlockBody ahead of the bodies below it or the newest block of the
+// chain.  The chain itself, as returned by NewestSha, only advances over
+// bodies which are contiguous, so it is the point up to which the database is
+// fully synced.
+func FetchBodyTip(db Db) (*btcwire.ShaHash, int64, error) {
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		return nil, 0, err
+	}
+	bodySha, bodyHeight, err := fetchTipRecord(db, BodyTipKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bodyHeight > height {
+		return bodySha, bodyHeight, nil
+	}
+	return sha, height, nil
+}
+
+// FetchSyncHeaderByHeight returns the header at the passed height of the
+// header chain of the passed database, which is read from the chain up to its
+// newest block and from the headers stored with InsertHeaders after it.
+// ErrBlockNotFound is returned when no header is known at the height.
+func FetchSyncHeaderByHeight(db Db, height int64) (*btcwire.BlockHeader, error) {
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	if height <= newest {
+		return db.FetchBlockHeaderByHeight(height)
+	}
+
+	bh, _, err := fetchSyncHeader(db, height)
+	if err != nil {
+		return nil, err
+	}
+	if bh == nil {
+		return nil, ErrBlockNotFound
+	}
+	return bh, nil
+}
+
+// InsertHeaders stores the passed run of headers, which must connect to each
+// other in order, ahead of the bodies of their blocks, so the bodies are
+// downloaded afterwards and inserted with InsertBlockBody.  Leading headers of
+// blocks already in the chain are skipped, and the first of the rest must
+// follow the newest block of the chain or a header stored before.  Stored
+// headers after that one are replaced, so a header chain with more work takes
+// the place of the one stored.  It returns the height of each stored header.
+//
+// The headers are kept under SyncHeaderPrefix in the metadata namespace until
+// the bodies of their blocks are inserted.  They are expected to be validated
+// by the caller, and only their linkage is checked: PrevShaMissing is returned
+// when they do not connect.
+func InsertHeaders(db Db, headers []btcwire.BlockHeader) ([]int64, error) {
+	for len(headers) != 0 {
+		sha, err := headers[0].BlockSha()
+		if err != nil {
+			return nil, err
+		}
+		if !db.ExistsSha(&sha) {
+			break
+		}
+		headers = headers[1:]
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	// Find the height the headers start at.
+	parent := &headers[0].PrevBlock
+	newestSha, newest, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	parentHeight := newest
+	if !parent.IsEqual(newestSha) {
+		parentHeight, err = fetchSyncHeight(db, parent)
+		if err != nil {
+			return nil, err
+		}
+		if parentHeight <= newest {
+			return nil, PrevShaMissing
+		}
+	}
+
+	var meta MetaBatch
+	_, tipHeight, err := fetchTipRecord(db, HeaderTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteSyncHeaders(db, parentHeight+1, tipHeight, &meta); err != nil {
+		return nil, err
+	}
+
+	heights := make([]int64, len(headers))
+	var sha btcwire.ShaHash
+	for i := range headers {
+		if i != 0 && !headers[i].PrevBlock.IsEqual(&sha) {
+			return nil, PrevShaMissing
+		}
+		sha, err = headers[i].BlockSha()
+		if err != nil {
+			return nil, err
+		}
+		heights[i] = parentHeight + 1 + int64(i)
+
+		var buf bytes.Buffer
+		if err := headers[i].Serialize(&buf); err != nil {
+			return nil, err
+		}
+		height := make([]byte, 8)
+		binary.LittleEndian.PutUint64(height, uint64(heights[i]))
+		meta.Put(syncHeaderKey(heights[i]), buf.Bytes())
+		meta.Put(syncHeaderShaKey(&sha), height)
+	}
+	putTipRecord(&meta, HeaderTipKey, &sha, heights[len(heights)-1])
+
+	log.Debugf("Storing %d headers from height %d", len(headers),
+		heights[0])
+	if err := db.WriteMeta(&meta); err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// InsertBlockBody inserts the passed block, whose header was stored with
+// InsertHeaders, and returns its height.  Bodies may arrive in any order: a
+// body which follows the newest block of the chain is connected to the chain
+// along with the bodies kept for the heights right after it, while any other
+// body is kept under SyncBodyPrefix in the metadata namespace until the bodies
+// below it arrive.  The headers and bodies kept for the connected blocks are
+// removed in the same change as they are connected.
+//
+// ErrHeaderMissing is returned when the header of the block is not stored and
+// DuplicateSha when its body is already stored.
+func InsertBlockBody(db Db, block *btcutil.Block) (int64, error) {
+	sha, err := block.Sha()
+	if err != nil {
+		return 0, err
+	}
+	height, err := fetchSyncHeight(db, sha)
+	if err != nil {
+		return 0, err
+	}
+	if height < 0 {
+		if db.ExistsSha(sha) {
+			return 0, DuplicateSha
+		}
+		return 0, ErrHeaderMissing
+	}
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return 0, err
+	}
+	bh, hasBody, err := fetchSyncHeader(db, height)
+	if err != nil {
+		return 0, err
+	}
+	if bh == nil || height <= newest {
+		return 0, ErrHeaderMissing
+	}
+	if hasBody {
+		return 0, DuplicateSha
+	}
+	_, bodyTip, err := fetchTipRecord(db, BodyTipKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keep a body which can not be connected yet.
+	var meta MetaBatch
+	if height > newest+1 {
+		raw, err := block.Bytes()
+		if err != nil {
+			return 0, err
+		}
+		var buf bytes.Buffer
+		if err := bh.Serialize(&buf); err != nil {
+			return 0, err
+		}
+		buf.WriteByte(syncBodyMark)
+		meta.Put(syncHeaderKey(height), buf.Bytes())
+		meta.Put(syncBodyKey(height), raw)
+		if height > bodyTip {
+			putTipRecord(&meta, BodyTipKey, sha, height)
+		}
+		if err := db.WriteMeta(&meta); err != nil {
+			return 0, err
+		}
+		return height, nil
+	}
+
+	// Connect the body along with the kept bodies right after it.
+	run := []*btcutil.Block{block}
+	meta.Delete(syncHeaderKey(height))
+	meta.Delete(syncHeaderShaKey(sha))
+	last := height
+	for {
+		next, hasBody, err := fetchSyncHeader(db, last+1)
+		if err != nil {
+			return 0, err
+		}
+		if next == nil || !hasBody {
+			break
+		}
+		raw, err := db.GetMeta(syncBodyKey(last + 1))
+		if err != nil {
+			return 0, err
+		}
+		blk, err := btcutil.NewBlockFromBytes(raw)
+		if err != nil {
+			return 0, err
+		}
+		blkSha, err := blk.Sha()
+		if err != nil {
+			return 0, err
+		}
+		last++
+		run = append(run, blk)
+		meta.Delete(syncHeaderKey(last))
+		meta.Delete(syncHeaderShaKey(blkSha))
+		meta.Delete(syncBodyKey(last))
+	}
+	_, tipHeight, err := fetchTipRecord(db, HeaderTipKey)
+	if err != nil {
+		return 0, err
+	}
+	if last >= tipHeight {
+		meta.Delete(HeaderTipKey)
+	}
+	if last >= bodyTip {
+		meta.Delete(BodyTipKey)
+	}
+	if len(run) > 1 {
+		log.Debugf("Connecting %d bodies from height %d", len(run),
+			height)
+	}
+	if _, err := db.InsertBlocksWithMeta(run, &meta); err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// FetchMissingBlockHeights returns the heights of up to max blocks, lowest
+// first, whose headers were stored with InsertHeaders but whose bodies are
+// neither in the chain of the passed database nor kept ahead of it, so a
+// downloader knows which bodies to request and may fetch them in any order.  Every such height is returned when max is not positive.
+func FetchMissingBlockHeights(db Db, max int) ([]int64, error) {
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	_, tipHeight, err := fetchTipRecord(db, HeaderTipKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var heights []int64
+	for height := newest + 1; height <= tipHeight; height++ {
+		if max > 0 && len(heights) == max {
+			break
+		}
+		bh, hasBody, err := fetchSyncHeader(db, height)
+		if err != nil {
+			return nil, err
+		}
+		if bh != nil && !hasBody {
+			heights = append(heights, height)
+		}
+	}
+	return heights, nil
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestHeadersFirst ensures headers are stored ahead of the bodies of their
+// blocks, that the heights missing bodies are reported and that bodies which
+// arrive out of order are connected to the chain once they are contiguous for
+// every supported database type.
+func TestHeadersFirst(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:13]
+	headers := make([]btcwire.BlockHeader, len(blocks))
+	for i, blk := range blocks {
+		headers[i] = blk.MsgBlock().Header
+	}
+	tipSha, _ := blocks[12].Sha()
+	alt := altChain(blocks[10], 4)
+	altHeaders := make([]btcwire.BlockHeader, len(alt))
+	for i, blk := range alt {
+		altHeaders[i] = blk.MsgBlock().Header
+	}
+	altSha, _ := alt[3].Sha()
+
+	// checkHeaderTip ensures the newest header is the passed one.
+	checkHeaderTip := func(dbType, desc string, db btcdb.Db, wantSha *btcwire.ShaHash, wantHeight int64) {
+		sha, height, err := btcdb.FetchHeaderTip(db)
+		if err != nil || height != wantHeight || !sha.IsEqual(wantSha) {
+			t.Errorf("FetchHeaderTip (%s) %s: got %v at height %d "+
+				"(err %v), want %v at height %d", dbType, desc, sha,
+				height, err, wantSha, wantHeight)
+		}
+	}
+
+	shas := make([]*btcwire.ShaHash, len(blocks))
+	for i, blk := range blocks {
+		shas[i], _ = blk.Sha()
+	}
+
+	// checkTip ensures the chain ends with the block with the passed hash
+	// at the passed height.
+	checkTip := func(dbType, desc string, db btcdb.Db, wantSha *btcwire.ShaHash, wantHeight int64) {
+		sha, height, err := db.NewestSha()
+		if err != nil || height != wantHeight || !sha.IsEqual(wantSha) {
+			t.Errorf("NewestSha (%s) %s: got %v at height %d (err "+
+				"%v), want %v at height %d", dbType, desc, sha,
+				height, err, wantSha, wantHeight)
+		}
+	}
+
+	// checkBodyTip ensures the highest stored body is the passed one.
+	checkBodyTip := func(dbType, desc string, db btcdb.Db, wantSha *btcwire.ShaHash, wantHeight int64) {
+		sha, height, err := btcdb.FetchBodyTip(db)
+		if err != nil || height != wantHeight || !sha.IsEqual(wantSha) {
+			t.Errorf("FetchBodyTip (%s) %s: got %v at height %d (err "+
+				"%v), want %v at height %d", dbType, desc, sha,
+				height, err, wantSha, wantHeight)
+		}
+	}
+
+	// checkMissing ensures the first heights missing bodies are the
+	// passed ones.
+	checkMissing := func(dbType, desc string, db btcdb.Db, max int, want []int64) {
+		heights, err := btcdb.FetchMissingBlockHeights(db, max)
+		if err != nil || !reflect.DeepEqual(heights, want) {
+			t.Errorf("FetchMissingBlockHeights (%s) %s: got %v (err "+
+				"%v), want %v", dbType, desc, heights, err, want)
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "headersdb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:5]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+
+		// Headers of blocks in the chain are skipped.
+		heights, err := btcdb.InsertHeaders(db, headers[3:])
+		if err != nil || len(heights) != 8 || heights[0] != 5 {
+			t.Errorf("InsertHeaders (%s): got heights %v (err %v), "+
+				"want 5 through 12", dbType, heights, err)
+		}
+		if _, err := btcdb.InsertHeaders(db, altHeaders[1:]); err != btcdb.PrevShaMissing {
+			t.Errorf("InsertHeaders (%s): got %v for headers which do "+
+				"not connect, want %v", dbType, err,
+				btcdb.PrevShaMissing)
+		}
+		checkHeaderTip(dbType, "after inserting headers", db, tipSha, 12)
+		checkMissing(dbType, "after inserting headers", db, 3,
+			[]int64{5, 6, 7})
+		bh, err := btcdb.FetchSyncHeaderByHeight(db, 9)
+		if err != nil || !reflect.DeepEqual(*bh, headers[9]) {
+			t.Errorf("FetchSyncHeaderByHeight (%s): got %v (err %v), "+
+				"want the header of block 9", dbType, bh, err)
+		}
+
+		// Bodies are accepted in any order once their header is known,
+		// and only connected to the chain once they are contiguous.
+		if _, err := btcdb.InsertBlockBody(db, alt[0]); err != btcdb.ErrHeaderMissing {
+			t.Errorf("InsertBlockBody (%s): got %v for a block without "+
+				"a header, want %v", dbType, err,
+				btcdb.ErrHeaderMissing)
+		}
+		for _, i := range []int{6, 10, 12} {
+			height, err := btcdb.InsertBlockBody(db, blocks[i])
+			if err != nil || height != int64(i) {
+				t.Errorf("InsertBlockBody (%s): got height %d (err "+
+					"%v), want %d", dbType, height, err, i)
+			}
+		}
+		if _, err := btcdb.InsertBlockBody(db, blocks[6]); err != btcdb.DuplicateSha {
+			t.Errorf("InsertBlockBody (%s): got %v for a kept body, "+
+				"want %v", dbType, err, btcdb.DuplicateSha)
+		}
+		checkTip(dbType, "after inserting bodies out of order", db,
+			shas[4], 4)
+		checkBodyTip(dbType, "after inserting bodies out of order", db,
+			shas[12], 12)
+		checkMissing(dbType, "after inserting bodies out of order", db,
+			4, []int64{5, 7, 8, 9})
+		if _, err := btcdb.InsertBlockBody(db, blocks[5]); err != nil {
+			t.Errorf("InsertBlockBody (%s): %v", dbType, err)
+		}
+		checkTip(dbType, "after filling a gap", db, shas[6], 6)
+		if _, err := btcdb.InsertBlockBody(db, blocks[7]); err != nil {
+			t.Errorf("InsertBlockBody (%s): %v", dbType, err)
+		}
+		if _, err := btcdb.InsertBlockBody(db, blocks[5]); err != btcdb.DuplicateSha {
+			t.Errorf("InsertBlockBody (%s): got %v for a connected "+
+				"body, want %v", dbType, err, btcdb.DuplicateSha)
+		}
+		checkMissing(dbType, "after inserting bodies", db, 0,
+			[]int64{8, 9, 11})
+
+		// The headers must survive reopening the database.
+		if dbType != "memory" {
+			db.Close()
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+			checkHeaderTip(dbType, "after reopening", db, tipSha, 12)
+			checkBodyTip(dbType, "after reopening", db, shas[12], 12)
+		}
+
+		// A branch of headers replaces the stored ones after its
+		// parent.
+		if _, err := btcdb.InsertHeaders(db, altHeaders); err != nil {
+			t.Errorf("InsertHeaders (%s): %v", dbType, err)
+		}
+		checkHeaderTip(dbType, "after replacing headers", db, altSha, 14)
+		bh, err = btcdb.FetchSyncHeaderByHeight(db, 11)
+		if err != nil || !reflect.DeepEqual(*bh, altHeaders[0]) {
+			t.Errorf("FetchSyncHeaderByHeight (%s): got %v (err %v), "+
+				"want the replacing header", dbType, bh, err)
+		}
+		if _, err := btcdb.InsertBlockBody(db, blocks[11]); err != btcdb.ErrHeaderMissing {
+			t.Errorf("InsertBlockBody (%s): got %v for a replaced "+
+				"header, want %v", dbType, err,
+				btcdb.ErrHeaderMissing)
+		}
+		checkBodyTip(dbType, "after replacing headers", db, shas[10], 10)
+		checkMissing(dbType, "after replacing headers", db, 0,
+			[]int64{8, 9, 11, 12, 13, 14})
+		for _, blk := range blocks[8:10] {
+			if _, err := btcdb.InsertBlockBody(db, blk); err != nil {
+				t.Errorf("InsertBlockBody (%s): %v", dbType, err)
+			}
+		}
+		checkTip(dbType, "after filling the gaps", db, shas[10], 10)
+		checkBodyTip(dbType, "after filling the gaps", db, shas[10], 10)
+		db.Close()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"context"
+	"github.com/conformal/btcwire"
+)
+
+// shaIteratorPageSize is the number of hashes a ShaIterator fetches at a time.
+const shaIteratorPageSize = 500
+
+// FetchHeightRangePage returns the hashes of at most limit blocks of the range
+// from startHeight to endHeight, which is inclusive of the start height and
+// exclusive of the ending height as for FetchHeightRange, along with the start
+// height of the next page.  The next height is -1 once the page holds the rest
+// of the range, so callers serving the range a page at a time pass it back as
+// a continuation token until then.  A limit which is not positive returns the
+// whole range in a single page.
+func FetchHeightRangePage(db Db, startHeight, endHeight int64, limit int) ([]btcwire.ShaHash, int64, error) {
+	// One hash more than the limit is fetched to find out whether there
+	// is a next page without another lookup.
+	fetchEnd := endHeight
+	if limit > 0 && endHeight-startHeight > int64(limit) {
+		fetchEnd = startHeight + int64(limit) + 1
+	}
+	shas, err := db.FetchHeightRange(startHeight, fetchEnd)
+	if err != nil {
+		return nil, -1, err
+	}
+	if limit > 0 && len(shas) > limit {
+		return shas[:limit], startHeight + int64(limit), nil
+	}
+	return shas, -1, nil
+}
+
+// ShaIterator walks the hashes of a range of blocks in height order, fetching
+// a page of them at a time, so ranges of any length are walked without holding
+// all of their hashes in memory.
+//
+// Each page starts with the last block of the page before it, so blocks
+// disconnected while the iterator runs are noticed.  The iterator stops with
+// ErrChainChanged when a block it returned is no longer in the chain, which
+// means the hashes it returned so far are all of the same chain.  Blocks
+// connected while it runs are returned unless it already reached the end of
+// the chain.
+type ShaIterator struct {
+	ctx  context.Context
+	db   Db
+	next int64
+	end  int64
+	page []btcwire.ShaHash
+	pos  int
+	last *btcwire.ShaHash
+	done bool
+	err  error
+}
+
+// NewShaIterator returns an iterator over the hashes of the blocks of the
+// passed database from startHeight to endHeight, which is inclusive of the
+// start height and exclusive of the ending height.  `AllShas' may be used as
+// the ending height to walk every block from the start height on.  The
+// iterator stops with the error of the passed context once it is done.
+func NewShaIterator(ctx context.Context, db Db, startHeight, endHeight int64) *ShaIterator {
+	return &ShaIterator{ctx: ctx, db: db, next: startHeight, end: endHeight}
+}
+
+// Next moves to the next block and returns whether there is one.  It returns
+// false once the end of the range or of the chain is reached or an error
+// occurs, in which case Err returns the error.
+func (it *ShaIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.pos+1 < len(it.page) {
+		it.pos++
+		return true
+	}
+	if it.done || it.next >= it.end {
+		return false
+	}
+
+	start, end := it.next, it.next+shaIteratorPageSize
+	if it.last != nil {
+		start--
+	}
+	if end > it.end || end < it.next {
+		end = it.end
+	}
+	page, err := it.db.FetchHeightRangeCtx(it.ctx, start, end)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if it.last != nil {
+		if len(page) == 0 || !page[0].IsEqual(it.last) {
+			it.err = ErrChainChanged
+			return false
+		}
+		page = page[1:]
+	}
+	if len(page) == 0 {
+		it.done = true
+		return false
+	}
+
+	// A short page means the end of the chain was reached.
+	if int64(len(page)) < end-it.next {
+		it.done = true
+	}
+	it.page, it.pos = page, 0
+	it.next += int64(len(page))
+	it.last = &page[len(page)-1]
+	return true
+}
+
+// Height returns the height of the current block.
+func (it *ShaIterator) Height() int64 {
+	return it.next - int64(len(it.page)-it.pos)
+}
+
+// Sha returns the hash of the current block.
+func (it *ShaIterator) Sha() *btcwire.ShaHash {
+	if it.pos >= len(it.page) {
+		return nil
+	}
+	return &it.page[it.pos]
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *ShaIterator) Err() error {
+	return it.err
+}
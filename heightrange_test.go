@@ -0,0 +1,145 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"context"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/dbtest"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// TestHeightRangePaging ensures FetchHeightRange returns every block for
+// AllShas, FetchHeightRangePage walks ranges a page at a time and ShaIterator
+// walks them across pages and notices blocks disconnected meanwhile for all
+// supported database types.
+func TestHeightRangePaging(t *testing.T) {
+	// The chain is longer than two pages of a ShaIterator.
+	blocks := dbtest.NewChainGenerator(0).NextBlocks(1201)
+	shas := make([]btcwire.ShaHash, len(blocks))
+	for i, blk := range blocks {
+		sha, _ := blk.Sha()
+		shas[i] = *sha
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "heightrange", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		for _, start := range []int64{0, 700} {
+			got, err := db.FetchHeightRange(start, btcdb.AllShas)
+			if err != nil || !reflect.DeepEqual(got, shas[start:]) {
+				t.Errorf("FetchHeightRange (%s): got %d hashes "+
+					"from %d (err %v), want %d", dbType,
+					len(got), start, err, len(shas)-int(start))
+			}
+		}
+
+		tests := []struct {
+			end   int64
+			limit int
+			pages int
+		}{
+			{btcdb.AllShas, 250, 5},
+			{btcdb.AllShas, 1201, 1},
+			{btcdb.AllShas, 0, 1},
+			{600, 200, 3},
+		}
+		for _, test := range tests {
+			var got []btcwire.ShaHash
+			pages := 0
+			for next := int64(0); next != -1; pages++ {
+				page, n, err := btcdb.FetchHeightRangePage(db,
+					next, test.end, test.limit)
+				if err != nil {
+					t.Errorf("FetchHeightRangePage (%s): %v",
+						dbType, err)
+					break
+				}
+				got = append(got, page...)
+				next = n
+			}
+			want := shas
+			if test.end < int64(len(shas)) {
+				want = shas[:test.end]
+			}
+			if pages != test.pages || !reflect.DeepEqual(got, want) {
+				t.Errorf("FetchHeightRangePage (%s): limit %d got "+
+					"%d hashes in %d pages, want %d in %d",
+					dbType, test.limit, len(got), pages,
+					len(want), test.pages)
+			}
+		}
+
+		ranges := []struct {
+			start, end int64
+		}{
+			{0, btcdb.AllShas},
+			{10, 20},
+			{499, 1001},
+			{1200, btcdb.AllShas},
+			{1201, btcdb.AllShas},
+		}
+		for _, r := range ranges {
+			it := btcdb.NewShaIterator(context.Background(), db,
+				r.start, r.end)
+			var got []btcwire.ShaHash
+			for it.Next() {
+				if it.Height() != r.start+int64(len(got)) {
+					t.Errorf("ShaIterator (%s): got height %d, "+
+						"want %d", dbType, it.Height(),
+						r.start+int64(len(got)))
+				}
+				got = append(got, *it.Sha())
+			}
+			want := shas[r.start:]
+			if r.end < int64(len(shas)) {
+				want = shas[r.start:r.end]
+			}
+			if it.Err() != nil || len(got) != len(want) ||
+				(len(got) != 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("ShaIterator (%s): got %d hashes from %d "+
+					"to %d (err %v), want %d", dbType, len(got),
+					r.start, r.end, it.Err(), len(want))
+			}
+		}
+
+		// Dropping blocks the iterator already returned stops it once
+		// it fetches the next page.
+		it := btcdb.NewShaIterator(context.Background(), db, 0,
+			btcdb.AllShas)
+		if !it.Next() {
+			t.Errorf("ShaIterator (%s): no blocks", dbType)
+		}
+		if err := db.DropAfterBlockBySha(&shas[100]); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		n := 1
+		for it.Next() {
+			n++
+		}
+		if it.Err() != btcdb.ErrChainChanged || n != 500 {
+			t.Errorf("ShaIterator (%s): got %d hashes and %v after "+
+				"the chain changed, want 500 and %v", dbType, n,
+				it.Err(), btcdb.ErrChainChanged)
+		}
+		teardown()
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"runtime"
+	"sync"
+)
+
+// importJob is a serialized block on its way through an ImportPipeline.  The
+// block or the error which prevented decoding it is set before ready is
+// closed.
+type importJob struct {
+	num   int64
+	raw   []byte
+	blk   *btcutil.Block
+	err   error
+	ready chan struct{}
+}
+
+// ImportPipeline inserts serialized blocks given in chain order into a
+// database.  The blocks are deserialized and the hashes of them and their
+// transactions are computed by a number of worker goroutines, while a single
+// goroutine inserts the decoded blocks in the order they were added in batches,
+// so loading a chain is not bound by a single processor.
+//
+// The queues between the stages are bounded, so Add blocks once the workers or
+// the database fall behind and the memory held by the pipeline stays limited
+// to a few batches of blocks.  The first error stops the pipeline, after which
+// Add returns it and no more blocks are inserted.
+//
+// The functions of a pipeline must not be called concurrently, since the order
+// blocks are added in is the order they are inserted in.
+type ImportPipeline struct {
+	db      Db
+	added   int64
+	work    chan *importJob
+	pending chan *importJob
+	workers sync.WaitGroup
+	done    chan struct{}
+	closed  bool
+
+	mtx      sync.Mutex
+	err      error
+	inserted int64
+}
+
+// NewImportPipeline returns a pipeline inserting blocks into the passed
+// database which decodes them with the given number of workers, or with one for
+// every processor when the number is not positive.
+func NewImportPipeline(db Db, workers int) *ImportPipeline {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	p := &ImportPipeline{
+		db:      db,
+		work:    make(chan *importJob, workers),
+		pending: make(chan *importJob, 2*workers),
+		done:    make(chan struct{}),
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.decode()
+	}
+	go p.insert()
+	return p
+}
+
+// Add queues the passed serialized block, which must extend the block added
+// before it or the tip of the database for the first one, for insertion.  The
+// pipeline keeps the slice, which must not be modified afterwards.  It returns
+// the error which stopped the pipeline, if any.
+func (p *ImportPipeline) Add(raw []byte) error {
+	if p.closed {
+		return ErrPipelineClosed
+	}
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	job := &importJob{num: p.added, raw: raw, ready: make(chan struct{})}
+	p.added++
+	p.pending <- job
+	p.work <- job
+	return nil
+}
+
+// Close waits for the queued blocks to be inserted and stops the pipeline.  It
+// returns the number of blocks inserted along with the error which stopped the
+// pipeline, if any.
+func (p *ImportPipeline) Close() (int64, error) {
+	if !p.closed {
+		p.closed = true
+		close(p.work)
+		close(p.pending)
+	}
+	<-p.done
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.inserted, p.err
+}
+
+// Err returns the error which stopped the pipeline, or nil while it runs.
+func (p *ImportPipeline) Err() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.err
+}
+
+// Inserted returns the number of blocks inserted so far.
+func (p *ImportPipeline) Inserted() int64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.inserted
+}
+
+// fail stops the pipeline with the passed error unless it was stopped already.
+func (p *ImportPipeline) fail(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// decode deserializes the queued blocks and computes the hashes of them and
+// their transactions, so inserting them does not.  It must be run as a
+// goroutine.
+func (p *ImportPipeline) decode() {
+	defer p.workers.Done()
+
+	for job := range p.work {
+		// Blocks are no longer decoded once the pipeline stopped, but
+		// are still handed on so the inserting goroutine drains the
+		// queue.
+		if p.Err() == nil {
+			job.blk, job.err = decodeImportBlock(job.raw)
+			if job.err != nil {
+				job.err = fmt.Errorf("block %d of the import: %v",
+					job.num, job.err)
+			}
+		}
+		job.raw = nil
+		close(job.ready)
+	}
+}
+
+// decodeImportBlock deserializes the passed block and computes the hashes of it
+// and its transactions, which are cached by the returned block.
+func decodeImportBlock(raw []byte) (*btcutil.Block, error) {
+	blk, err := btcutil.NewBlockFromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blk.Sha(); err != nil {
+		return nil, err
+	}
+	for _, tx := range blk.Transactions() {
+		tx.Sha()
+	}
+	return blk, nil
+}
+
+// insert inserts the decoded blocks in the order they were added in batches of
+// importBatchSize blocks.  It must be run as a goroutine.
+func (p *ImportPipeline) insert() {
+	defer close(p.done)
+
+	var batch []*btcutil.Block
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if _, err := p.db.InsertBlocks(batch); err != nil {
+			p.fail(err)
+		} else {
+			p.mtx.Lock()
+			p.inserted += int64(len(batch))
+			p.mtx.Unlock()
+		}
+		batch = batch[:0]
+	}
+
+	for job := range p.pending {
+		<-job.ready
+		if p.Err() != nil {
+			continue
+		}
+		if job.err != nil {
+			p.fail(job.err)
+			continue
+		}
+		batch = append(batch, job.blk)
+		if len(batch) >= importBatchSize {
+			flush()
+		}
+	}
+	if p.Err() == nil {
+		flush()
+	}
+	p.workers.Wait()
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"testing"
+)
+
+// TestImportPipeline ensures every supported database type inserts the blocks
+// added to an import pipeline in order and stops at the first bad block.
+func TestImportPipeline(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	var raws [][]byte
+	for _, block := range blocks {
+		raw, err := block.Bytes()
+		if err != nil {
+			t.Errorf("Bytes: %v", err)
+			return
+		}
+		raws = append(raws, raw)
+	}
+
+	const have = 10
+	wantSha, _ := blocks[len(blocks)-1].Sha()
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "pipeline", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:have]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		p := btcdb.NewImportPipeline(db, 4)
+		for _, raw := range raws[have:] {
+			if err := p.Add(raw); err != nil {
+				t.Errorf("Add (%s): %v", dbType, err)
+				break
+			}
+		}
+		n, err := p.Close()
+		if err != nil || n != int64(len(blocks)-have) {
+			t.Errorf("Close (%s): inserted %d blocks (err %v), "+
+				"want %d", dbType, n, err, len(blocks)-have)
+		}
+		sha, height, err := db.NewestSha()
+		if err != nil || height != int64(len(blocks)-1) ||
+			!sha.IsEqual(wantSha) {
+
+			t.Errorf("NewestSha (%s): got %v at height %d (err %v), "+
+				"want %v at height %d", dbType, sha, height, err,
+				wantSha, len(blocks)-1)
+		}
+		if err := p.Add(raws[0]); err != btcdb.ErrPipelineClosed {
+			t.Errorf("Add (%s): got %v after close, want %v",
+				dbType, err, btcdb.ErrPipelineClosed)
+		}
+		teardown()
+
+		// A block which can not be decoded stops the pipeline, so the
+		// blocks after it are not inserted.
+		db, teardown, err = createDB(dbType, "pipeline", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		p = btcdb.NewImportPipeline(db, 0)
+		for i, raw := range raws[:have] {
+			if i == 5 {
+				raw = raw[:10]
+			}
+			if err := p.Add(raw); err != nil {
+				break
+			}
+		}
+		if n, err := p.Close(); err == nil || n != 0 {
+			t.Errorf("Close (%s): inserted %d blocks (err %v) with "+
+				"a truncated block", dbType, n, err)
+		}
+		if _, height, _ := db.NewestSha(); height != -1 {
+			t.Errorf("NewestSha (%s): got height %d after a failed "+
+				"import, want -1", dbType, height)
+		}
+		teardown()
+	}
+}
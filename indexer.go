@@ -0,0 +1,386 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// indexerCatchUpBatch is the number of blocks an indexer which is behind the
+// chain is caught up by in a single write.
+const indexerCatchUpBatch = 100
+
+// Indexer is a secondary index kept outside of the database drivers which is
+// updated in the same atomic change as the blocks it indexes.  Indexers keep
+// their state in the metadata namespace, so it can never get out of step with
+// the chain, and should use keys under a prefix of their own.
+type Indexer interface {
+	// Init is called once when the indexer is added to a database,
+	// before its tip is requested, so it can load its state.
+	Init(db Db) error
+
+	// Tip returns the hash and height of the most recent block the
+	// indexer has indexed, or the zero hash and -1 when it has not
+	// indexed any blocks.  It must reflect the committed state of the
+	// metadata namespace, so it is usually stored there by ConnectBlock
+	// and DisconnectBlock.
+	Tip() (*btcwire.ShaHash, int64, error)
+
+	// ConnectBlock adds the changes which index the passed block at the
+	// given height to the passed batch.  The spent outputs are those
+	// spent by the transactions of the block other than its coinbase, one
+	// for each of their inputs in the order they appear in the block, as
+	// returned by FetchSpentTxOuts.  They are nil when the database does
+	// not know them, such as when it only stores headers.  It is called
+	// while the database is locked for writing, so it must not call any
+	// of its functions, but may read the metadata namespace as of the
+	// changes made so far with the Get function of the batch.
+	ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error
+
+	// DisconnectBlock adds the changes which remove the passed block at
+	// the given height, which spent the passed outputs, from the index to
+	// the passed batch.  Blocks are disconnected from the tip down.  Like
+	// ConnectBlock, it must not call any of the functions of the database.
+	DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error
+}
+
+// FetchSpentTxOuts returns the outputs spent by the transactions of the passed
+// block at the passed height other than its coinbase, one for each of their
+// inputs in the order they appear in the block.  Outputs created by the block
+// itself are taken from it and the others from the newest instance of their
+// transaction stored below the block, which the passed function returns along
+// with every other instance like FetchTxBySha.  An error is returned when one
+// of them is not stored.
+//
+// It is used by drivers which do not keep the spent outputs of each block to
+// pass them to their indexers, before the block is removed when disconnecting
+// it, and to catch indexers up with the chain.
+func FetchSpentTxOuts(block *btcutil.Block, height int64, fetch func(sha *btcwire.ShaHash) ([]*TxListReply, error)) ([]*UtxoEntry, error) {
+	inBlock := make(map[btcwire.ShaHash]int)
+	instances := make(map[btcwire.ShaHash]*TxListReply)
+
+	// resolve returns the output the passed outpoint refers to, or nil
+	// when it is not stored.
+	resolve := func(op *btcwire.OutPoint) (*UtxoEntry, error) {
+		var prevTx *btcwire.MsgTx
+		entry := &UtxoEntry{Height: height}
+		if idx, ok := inBlock[op.Hash]; ok {
+			prevTx = block.MsgBlock().Transactions[idx]
+			entry.Coinbase = idx == 0
+		} else {
+			reply, ok := instances[op.Hash]
+			if !ok {
+				var err error
+				reply, err = fetchInstanceBefore(fetch, &op.Hash,
+					height)
+				if err != nil {
+					return nil, err
+				}
+				instances[op.Hash] = reply
+			}
+			if reply != nil {
+				prevTx = reply.Tx
+				entry.Height = reply.Height
+				entry.Coinbase = isCoinbaseTx(reply.Tx)
+			}
+		}
+		if prevTx == nil || op.Index >= uint32(len(prevTx.TxOut)) {
+			return nil, nil
+		}
+		entry.Value = prevTx.TxOut[op.Index].Value
+		entry.PkScript = prevTx.TxOut[op.Index].PkScript
+		return entry, nil
+	}
+
+	var spent []*UtxoEntry
+	for i, tx := range block.MsgBlock().Transactions {
+		if i > 0 {
+			for _, txIn := range tx.TxIn {
+				op := &txIn.PreviousOutpoint
+				entry, err := resolve(op)
+				if err != nil {
+					return nil, err
+				}
+				if entry == nil {
+					sha, _ := block.Sha()
+					return nil, fmt.Errorf("output %v:%d spent "+
+						"by block %v at height %d is not "+
+						"stored", &op.Hash, op.Index, sha,
+						height)
+				}
+				spent = append(spent, entry)
+			}
+		}
+
+		txSha, err := tx.TxSha()
+		if err != nil {
+			return nil, err
+		}
+		inBlock[txSha] = i
+	}
+	return spent, nil
+}
+
+// spentKnown returns whether the passed outputs spent by the passed block, as
+// passed to an indexer, are known, which is when there is one for each input
+// of its transactions other than its coinbase.
+func spentKnown(block *btcutil.Block, spent []*UtxoEntry) bool {
+	txs := block.MsgBlock().Transactions
+	if len(txs) == 0 {
+		return false
+	}
+	var inputs int
+	for _, tx := range txs[1:] {
+		inputs += len(tx.TxIn)
+	}
+	return len(spent) == inputs
+}
+
+// fetchInstanceBefore returns the newest instance of the transaction with the
+// passed hash stored below the passed height, as returned by the passed
+// function, or nil when there is none.
+func fetchInstanceBefore(fetch func(sha *btcwire.ShaHash) ([]*TxListReply, error), sha *btcwire.ShaHash, height int64) (*TxListReply, error) {
+	replies, err := fetch(sha)
+	if err == ErrTxNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var found *TxListReply
+	for _, reply := range replies {
+		if reply.Err != nil || reply.Tx == nil || reply.Height >= height {
+			continue
+		}
+		if found == nil || reply.Height > found.Height {
+			found = reply
+		}
+	}
+	return found, nil
+}
+
+// initIndexerState returns the height of the newest block indexed by an
+// indexer which keeps its state under the passed prefix of the metadata
+// namespace of the passed database and its tip, written with putTipRecord,
+// under the passed key.  When there is no tip or it is no longer in the main
+// chain, the state is removed and the tip set to height -1, so the indexer is
+// rebuilt as it is caught up with the chain.  The name of the indexer is used
+// for logging.
+func initIndexerState(db Db, name string, prefix, tipKey []byte) (int64, error) {
+	return initVersionedIndexerState(db, name, prefix, tipKey, nil, 0)
+}
+
+// initVersionedIndexerState behaves like initIndexerState for an indexer whose
+// records are laid out according to the passed version, which is kept under
+// the passed key outside of its prefix so removing the state of the indexer
+// never removes it.  State written by another version of the indexer, or by
+// one from before it recorded a version, is removed so the indexer is rebuilt,
+// and the version is written along with the tip it starts over from.  A nil
+// key means the indexer has no version.
+func initVersionedIndexerState(db Db, name string, prefix, tipKey, versionKey []byte, version uint32) (int64, error) {
+	tipSha, tipHeight, err := fetchTipRecord(db, tipKey)
+	if err != nil {
+		return 0, err
+	}
+	if versionKey != nil && tipSha != nil && tipHeight >= 0 {
+		val, err := db.GetMeta(versionKey)
+		if err != nil {
+			return 0, err
+		}
+		if len(val) != 4 || binary.LittleEndian.Uint32(val) != version {
+			log.Warnf("%s was written by another version of the "+
+				"index -- rebuilding the index", name)
+			tipSha = nil
+		}
+	}
+	if tipSha != nil && tipHeight >= 0 {
+		sha, err := db.FetchBlockShaByHeight(tipHeight)
+		if err != nil && err != ErrBlockNotFound {
+			return 0, err
+		}
+		if err != nil || !sha.IsEqual(tipSha) {
+			log.Warnf("%s tip %v at height %d is not in the main "+
+				"chain -- rebuilding the index", name, tipSha,
+				tipHeight)
+			tipSha = nil
+		}
+	}
+	if tipSha != nil {
+		return tipHeight, nil
+	}
+
+	// Start over, removing what is left of an earlier index.
+	var meta MetaBatch
+	iter, err := db.MetaIterator(prefix)
+	if err != nil {
+		return 0, err
+	}
+	for iter.Next() {
+		meta.Delete(append([]byte(nil), iter.Key()...))
+	}
+	err = iter.Err()
+	iter.Release()
+	if err != nil {
+		return 0, err
+	}
+	putTipRecord(&meta, tipKey, &btcwire.ShaHash{}, -1)
+	if versionKey != nil {
+		var val [4]byte
+		binary.LittleEndian.PutUint32(val[:], version)
+		meta.Put(versionKey, val[:])
+	}
+	if err := db.WriteMeta(&meta); err != nil {
+		return 0, err
+	}
+	return -1, nil
+}
+
+// IndexerSet holds the indexers added to a database.  The zero value is an
+// empty set ready for use.  It is intended for use by drivers, which call
+// ConnectBlocks and DisconnectBlocks while they build each change and commit
+// the returned changes to the metadata namespace along with it.
+type IndexerSet struct {
+	mtx      sync.RWMutex
+	indexers []Indexer
+}
+
+// Add initializes the passed indexer, catches it up with the chain stored in
+// the passed database and adds it to the set.  It must not be called while
+// blocks are inserted into or dropped from the database.
+func (s *IndexerSet) Add(db Db, idx Indexer) error {
+	if err := idx.Init(db); err != nil {
+		return err
+	}
+	tipSha, tipHeight, err := idx.Tip()
+	if err != nil {
+		return err
+	}
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+
+	// The indexer must have been kept on the chain of this database.
+	if tipHeight >= 0 {
+		sha, err := db.FetchBlockShaByHeight(tipHeight)
+		if err != nil && err != ErrBlockNotFound {
+			return err
+		}
+		if err != nil || !sha.IsEqual(tipSha) {
+			return fmt.Errorf("indexer tip %v at height %d is not "+
+				"in the main chain", tipSha, tipHeight)
+		}
+	}
+
+	meta := newMetaBatchView(db.GetMeta)
+	for height := tipHeight + 1; height <= newest; height++ {
+		sha, err := db.FetchBlockShaByHeight(height)
+		if err != nil {
+			return err
+		}
+		block, err := db.FetchBlockBySha(sha)
+		if err != nil {
+			return err
+		}
+		spent, err := FetchSpentTxOuts(block, height, db.FetchTxBySha)
+		if err != nil {
+			return err
+		}
+		err = idx.ConnectBlock(block, height, spent, meta)
+		if err != nil {
+			return err
+		}
+		if (height+1)%indexerCatchUpBatch == 0 || height == newest {
+			if err := db.WriteMeta(meta); err != nil {
+				return err
+			}
+			meta.Reset()
+		}
+	}
+
+	s.mtx.Lock()
+	s.indexers = append(s.indexers, idx)
+	s.mtx.Unlock()
+	return nil
+}
+
+// Len returns the number of indexers in the set.
+func (s *IndexerSet) Len() int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return len(s.indexers)
+}
+
+// ConnectBlocks has every indexer in the set index the passed blocks, which
+// were inserted at the given heights and spent the given outputs, and returns
+// the resulting changes to the metadata namespace.  The spent outputs of a
+// block may be nil when they are not known.  The passed view reads the
+// metadata namespace for the indexers as of the changes being committed along
+// with the blocks.  It returns nil when the set is empty.
+func (s *IndexerSet) ConnectBlocks(blocks []*btcutil.Block, heights []int64, spent [][]*UtxoEntry, view MetaView) (*MetaBatch, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if len(s.indexers) == 0 {
+		return nil, nil
+	}
+	meta := newMetaBatchView(view)
+	for i, block := range blocks {
+		for _, idx := range s.indexers {
+			err := idx.ConnectBlock(block, heights[i],
+				spentAt(spent, i), meta)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// spentAt returns the outputs spent by the block at the passed index of a run
+// of blocks, or nil when they were not passed, such as when the driver found
+// no indexers to compute them for.
+func spentAt(spent [][]*UtxoEntry, i int) []*UtxoEntry {
+	if i >= len(spent) {
+		return nil
+	}
+	return spent[i]
+}
+
+// DisconnectBlocks has every indexer in the set remove the passed blocks, which
+// are ordered from the tip down, were stored at the given heights and spent the
+// given outputs, and returns the resulting changes to the metadata namespace.
+// Like ConnectBlocks, the indexers read the metadata namespace through the
+// passed view.  It returns nil when the set is empty.
+func (s *IndexerSet) DisconnectBlocks(blocks []*btcutil.Block, heights []int64, spent [][]*UtxoEntry, view MetaView) (*MetaBatch, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if len(s.indexers) == 0 {
+		return nil, nil
+	}
+	meta := newMetaBatchView(view)
+	for i, block := range blocks {
+		for _, idx := range s.indexers {
+			err := idx.DisconnectBlock(block, heights[i],
+				spentAt(spent, i), meta)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// testIndexer is an indexer which records the hash of every block it indexes
+// under its height so the tests can check what it was given.  The outputs
+// spent by the blocks it was given are kept by height when spent is set.
+type testIndexer struct {
+	db             btcdb.Db
+	fail           bool
+	failDisconnect bool
+	spent          map[int64][]*btcdb.UtxoEntry
+	unspent        map[int64][]*btcdb.UtxoEntry
+}
+
+var testIndexerTipKey = []byte("testidx/tip")
+
+func testIndexerKey(height int64) []byte {
+	return []byte(fmt.Sprintf("testidx/h/%08d", height))
+}
+
+func (idx *testIndexer) Init(db btcdb.Db) error {
+	idx.db = db
+	return nil
+}
+
+func (idx *testIndexer) Tip() (*btcwire.ShaHash, int64, error) {
+	value, err := idx.db.GetMeta(testIndexerTipKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if value == nil {
+		return &btcwire.ShaHash{}, -1, nil
+	}
+	sha, err := btcwire.NewShaHash(value[:btcwire.HashSize])
+	if err != nil {
+		return nil, 0, err
+	}
+	height := int64(binary.LittleEndian.Uint64(value[btcwire.HashSize:]))
+	return sha, height, nil
+}
+
+func (idx *testIndexer) setTip(sha *btcwire.ShaHash, height int64, meta *btcdb.MetaBatch) {
+	if height < 0 {
+		meta.Delete(testIndexerTipKey)
+		return
+	}
+	value := make([]byte, btcwire.HashSize+8)
+	copy(value, sha.Bytes())
+	binary.LittleEndian.PutUint64(value[btcwire.HashSize:], uint64(height))
+	meta.Put(testIndexerTipKey, value)
+}
+
+func (idx *testIndexer) ConnectBlock(block *btcutil.Block, height int64, spent []*btcdb.UtxoEntry, meta *btcdb.MetaBatch) error {
+	if idx.fail {
+		return fmt.Errorf("test indexer failure")
+	}
+	if idx.spent != nil {
+		idx.spent[height] = spent
+	}
+	sha, _ := block.Sha()
+	meta.Put(testIndexerKey(height), sha.Bytes())
+	idx.setTip(sha, height, meta)
+	return nil
+}
+
+func (idx *testIndexer) DisconnectBlock(block *btcutil.Block, height int64, spent []*btcdb.UtxoEntry, meta *btcdb.MetaBatch) error {
+	if idx.failDisconnect {
+		return fmt.Errorf("test indexer failure")
+	}
+	if idx.unspent != nil {
+		idx.unspent[height] = spent
+	}
+	meta.Delete(testIndexerKey(height))
+	idx.setTip(&block.MsgBlock().Header.PrevBlock, height-1, meta)
+	return nil
+}
+
+// TestIndexer ensures indexers are caught up when they are added and then
+// updated along with the blocks, and that a failing indexer leaves both the
+// blocks and the index unchanged.
+func TestIndexer(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// checkIndex ensures the indexer holds exactly the blocks up to the
+	// passed height.
+	checkIndex := func(dbType string, db btcdb.Db, idx *testIndexer, height int64) {
+		tipSha, tipHeight, err := idx.Tip()
+		if err != nil {
+			t.Errorf("Tip (%s): %v", dbType, err)
+			return
+		}
+		wantSha, _ := blocks[height].Sha()
+		if tipHeight != height || !tipSha.IsEqual(wantSha) {
+			t.Errorf("Tip (%s): got %v at %d, want %v at %d", dbType,
+				tipSha, tipHeight, wantSha, height)
+		}
+		it, err := db.MetaIterator([]byte("testidx/h/"))
+		if err != nil {
+			t.Errorf("MetaIterator (%s): %v", dbType, err)
+			return
+		}
+		defer it.Release()
+
+		var i int64
+		for ; it.Next(); i++ {
+			sha, _ := blocks[i].Sha()
+			if !bytes.Equal(it.Key(), testIndexerKey(i)) ||
+				!bytes.Equal(it.Value(), sha.Bytes()) {
+				t.Errorf("MetaIterator (%s): entry %d got %q, "+
+					"want %q", dbType, i, it.Key(),
+					testIndexerKey(i))
+				return
+			}
+		}
+		if i != height+1 {
+			t.Errorf("MetaIterator (%s): got %d entries, want %d",
+				dbType, i, height+1)
+		}
+	}
+
+	const n = 10
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "indexer", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		// The indexer is caught up with the blocks already stored.
+		if _, err := db.InsertBlocks(blocks[:n/2]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		idx := new(testIndexer)
+		if err := db.AddIndexer(idx); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkIndex(dbType, db, idx, n/2-1)
+
+		if _, err := db.InsertBlocks(blocks[n/2 : n-1]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		if _, err := db.InsertBlock(blocks[n-1]); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+		}
+		checkIndex(dbType, db, idx, n-1)
+
+		// A block the indexer fails on is not inserted.
+		idx.fail = true
+		if _, err := db.InsertBlock(blocks[n]); err == nil {
+			t.Errorf("InsertBlock (%s): unexpected success with "+
+				"failing indexer", dbType)
+		}
+		idx.fail = false
+		if _, height, err := db.NewestSha(); err != nil || height != n-1 {
+			t.Errorf("NewestSha (%s): got height %d (%v), want %d",
+				dbType, height, err, n-1)
+		}
+		checkIndex(dbType, db, idx, n-1)
+
+		keepSha, _ := blocks[n/2-1].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkIndex(dbType, db, idx, n/2-1)
+		teardown()
+	}
+}
+
+// TestIndexerSpent ensures indexers are given the outputs spent by each block
+// they index, both when it is connected, including while they are caught up
+// with the chain, and when it is disconnected.
+func TestIndexerSpent(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The outputs spent by each block are worked out from the blocks
+	// before it.
+	type txLoc struct {
+		tx     *btcwire.MsgTx
+		height int64
+		idx    int
+	}
+	txs := make(map[btcwire.ShaHash]txLoc)
+	want := make([][]*btcdb.UtxoEntry, len(blocks))
+	for height, block := range blocks {
+		for i, tx := range block.MsgBlock().Transactions {
+			if i > 0 {
+				for _, txIn := range tx.TxIn {
+					op := txIn.PreviousOutpoint
+					loc := txs[op.Hash]
+					txOut := loc.tx.TxOut[op.Index]
+					want[height] = append(want[height],
+						&btcdb.UtxoEntry{
+							Height:   loc.height,
+							Coinbase: loc.idx == 0,
+							Value:    txOut.Value,
+							PkScript: txOut.PkScript,
+						})
+				}
+			}
+			txs[*block.Transactions()[i].Sha()] = txLoc{tx,
+				int64(height), i}
+		}
+	}
+
+	// checkSpent ensures the passed outputs recorded by the indexer for
+	// each height from the passed one on are the expected ones.
+	checkSpent := func(dbType, what string, got map[int64][]*btcdb.UtxoEntry, from, to int64) {
+		for height := from; height < to; height++ {
+			spent, ok := got[height]
+			if !ok {
+				t.Errorf("%s (%s): block %d not given", what,
+					dbType, height)
+				continue
+			}
+			if len(spent) != len(want[height]) {
+				t.Errorf("%s (%s): block %d got %d spent "+
+					"outputs, want %d", what, dbType, height,
+					len(spent), len(want[height]))
+				continue
+			}
+			for i := range spent {
+				if !reflect.DeepEqual(spent[i], want[height][i]) {
+					t.Errorf("%s (%s): block %d spent output "+
+						"%d got %+v, want %+v", what,
+						dbType, height, i, spent[i],
+						want[height][i])
+				}
+			}
+		}
+	}
+
+	// The first block spending an output of another block is at height
+	// 170, and a few more follow it.
+	const caughtUp, n, keep = 100, 200, 150
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "indexerspent", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:caughtUp]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		idx := &testIndexer{
+			spent:   make(map[int64][]*btcdb.UtxoEntry),
+			unspent: make(map[int64][]*btcdb.UtxoEntry),
+		}
+		if err := db.AddIndexer(idx); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[caughtUp:n]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkSpent(dbType, "ConnectBlock", idx.spent, 0, n)
+
+		keepSha, _ := blocks[keep].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkSpent(dbType, "DisconnectBlock", idx.unspent, keep+1, n)
+		teardown()
+	}
+}
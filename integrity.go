@@ -0,0 +1,186 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// The levels of checks performed by VerifyIntegrity.  Each level includes the
+// checks of the levels below it.
+const (
+	// VerifyIndexes checks that the hash and height recorded for every
+	// block refer to each other, that its header hashes to its hash and
+	// that it links to the block before it.
+	VerifyIndexes = 1
+
+	// VerifyBlocks also re-hashes every stored block against the hash it
+	// is stored under and checks that each of its transactions is found
+	// at its height.  Pruned blocks and databases which only store
+	// headers skip these checks.
+	VerifyBlocks = 2
+
+	// VerifyMerkleRoots also checks that the merkle root of the
+	// transactions of every stored block matches its header.
+	VerifyMerkleRoots = 3
+)
+
+// IntegrityError describes the first problem found with a block by
+// VerifyIntegrity.
+type IntegrityError struct {
+	Height      int64
+	Sha         btcwire.ShaHash
+	Description string
+}
+
+// Error returns the problem with the block as a human-readable string.
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("block %v at height %d: %s", &e.Sha, e.Height,
+		e.Description)
+}
+
+// VerifyChain performs the integrity checks of the given level on every block
+// of the chain seen by the passed snapshot, calling progress, when it is not
+// nil, with the height of each block once it has been checked.  An
+// IntegrityError is returned for the first problem found.  It is intended for
+// drivers, which implement VerifyIntegrity by running it on a snapshot of the
+// database.
+func VerifyChain(snap Snapshot, level int, progress func(height int64)) error {
+	if level < VerifyIndexes || level > VerifyMerkleRoots {
+		return fmt.Errorf("invalid integrity check level %d", level)
+	}
+
+	_, newest, err := snap.NewestSha()
+	if err != nil {
+		return err
+	}
+	var prevSha *btcwire.ShaHash
+	for height := int64(0); height <= newest; height++ {
+		sha, err := verifyBlock(snap, height, prevSha, level)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(height)
+		}
+		prevSha = sha
+	}
+	return nil
+}
+
+// verifyBlock performs the integrity checks of the given level on the block at
+// the given height, whose parent has the passed hash, and returns its hash.
+func verifyBlock(snap Snapshot, height int64, prevSha *btcwire.ShaHash, level int) (*btcwire.ShaHash, error) {
+	var sha btcwire.ShaHash
+	fail := func(format string, args ...interface{}) error {
+		return &IntegrityError{Height: height, Sha: sha,
+			Description: fmt.Sprintf(format, args...)}
+	}
+
+	blkSha, err := snap.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, fail("unable to fetch hash: %v", err)
+	}
+	sha = *blkSha
+	blkHeight, err := snap.FetchBlockHeightBySha(&sha)
+	if err != nil {
+		return nil, fail("unable to fetch height: %v", err)
+	}
+	if blkHeight != height {
+		return nil, fail("hash is recorded at height %d", blkHeight)
+	}
+
+	bh, err := snap.FetchBlockHeaderByHeight(height)
+	if err != nil {
+		return nil, fail("unable to fetch header: %v", err)
+	}
+	hdrSha, err := bh.BlockSha()
+	if err != nil {
+		return nil, fail("unable to hash header: %v", err)
+	}
+	if !hdrSha.IsEqual(&sha) {
+		return nil, fail("header hashes to %v", &hdrSha)
+	}
+	if prevSha != nil && !bh.PrevBlock.IsEqual(prevSha) {
+		return nil, fail("previous block is %v instead of %v",
+			&bh.PrevBlock, prevSha)
+	}
+	if level < VerifyBlocks {
+		return &sha, nil
+	}
+
+	blk, err := snap.FetchBlockBySha(&sha)
+	if err == ErrPruned || err == ErrHeadersOnly {
+		return &sha, nil
+	}
+	if err != nil {
+		return nil, fail("unable to fetch block: %v", err)
+	}
+	msgBlock := blk.MsgBlock()
+	bodySha, err := msgBlock.Header.BlockSha()
+	if err != nil {
+		return nil, fail("unable to hash block: %v", err)
+	}
+	if !bodySha.IsEqual(&sha) {
+		return nil, fail("stored block hashes to %v", &bodySha)
+	}
+	for _, tx := range blk.Transactions() {
+		replies, err := snap.FetchTxBySha(tx.Sha())
+		if err != nil {
+			return nil, fail("unable to fetch transaction %v: %v",
+				tx.Sha(), err)
+		}
+		found := false
+		for _, reply := range replies {
+			if reply.Height == height {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fail("transaction %v is not recorded at "+
+				"the height of the block", tx.Sha())
+		}
+	}
+	if level < VerifyMerkleRoots {
+		return &sha, nil
+	}
+
+	merkleRoot := calcMerkleRoot(blk.Transactions())
+	if !merkleRoot.IsEqual(&msgBlock.Header.MerkleRoot) {
+		return nil, fail("merkle root of transactions is %v instead "+
+			"of %v", &merkleRoot, &msgBlock.Header.MerkleRoot)
+	}
+	return &sha, nil
+}
+
+// calcMerkleRoot returns the merkle root of the passed transactions.  Levels
+// of the tree with an odd number of nodes pair the last node with itself.
+func calcMerkleRoot(txs []*btcutil.Tx) btcwire.ShaHash {
+	if len(txs) == 0 {
+		return btcwire.ShaHash{}
+	}
+
+	level := make([]btcwire.ShaHash, len(txs))
+	for i, tx := range txs {
+		level[i] = *tx.Sha()
+	}
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]btcwire.ShaHash, len(level)/2)
+		var buf [btcwire.HashSize * 2]byte
+		for i := range next {
+			copy(buf[:btcwire.HashSize], level[2*i].Bytes())
+			copy(buf[btcwire.HashSize:], level[2*i+1].Bytes())
+			next[i].SetBytes(btcwire.DoubleSha256(buf[:]))
+		}
+		level = next
+	}
+	return level[0]
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"testing"
+)
+
+// TestVerifyIntegrity ensures the integrity checks pass for an intact chain,
+// report the progress of every block and catch a block whose transactions do
+// not match its merkle root only at the level which checks it.
+func TestVerifyIntegrity(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The stored copy of the last block has a coinbase paying out more
+	// than it should, which leaves the hash of its header as it was.
+	// Several of the blocks before it have more than one transaction.
+	n := len(blocks)
+	buf, _ := blocks[n-1].Bytes()
+	tampered, err := btcutil.NewBlockFromBytes(buf)
+	if err != nil {
+		t.Errorf("NewBlockFromBytes: %v", err)
+		return
+	}
+	tampered.MsgBlock().Transactions[0].TxOut[0].Value++
+	tampered = btcutil.NewBlock(tampered.MsgBlock())
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "verify", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:n-1]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		for _, level := range []int{0, btcdb.VerifyMerkleRoots + 1} {
+			if err := db.VerifyIntegrity(level, nil); err == nil {
+				t.Errorf("VerifyIntegrity (%s): unexpected "+
+					"success for level %d", dbType, level)
+			}
+		}
+		var heights []int64
+		err = db.VerifyIntegrity(btcdb.VerifyMerkleRoots, func(height int64) {
+			heights = append(heights, height)
+		})
+		if err != nil {
+			t.Errorf("VerifyIntegrity (%s): %v", dbType, err)
+		}
+		if len(heights) != n-1 || heights[n-2] != int64(n-2) {
+			t.Errorf("VerifyIntegrity (%s): got progress %v, want "+
+				"heights 0 through %d", dbType, heights, n-2)
+		}
+
+		if _, err := db.InsertBlock(tampered); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		for _, level := range []int{btcdb.VerifyIndexes, btcdb.VerifyBlocks} {
+			if err := db.VerifyIntegrity(level, nil); err != nil {
+				t.Errorf("VerifyIntegrity (%s): level %d: %v",
+					dbType, level, err)
+			}
+		}
+		err = db.VerifyIntegrity(btcdb.VerifyMerkleRoots, nil)
+		if ierr, ok := err.(*btcdb.IntegrityError); !ok || ierr.Height != int64(n-1) {
+			t.Errorf("VerifyIntegrity (%s): got %v, want integrity "+
+				"error at height %d", dbType, err, n-1)
+		}
+		teardown()
+	}
+}
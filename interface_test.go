@@ -448,6 +448,174 @@ func testFetchUnSpentTxByShaList(tc *testContext) bool {
 	return testFetchTxByShaListCommon(tc, false)
 }
 
+// testFetchUtxoEntry ensures FetchUtxoEntry conforms to the interface
+// contract.
+func testFetchUtxoEntry(tc *testContext) bool {
+	for i, tx := range tc.block.Transactions() {
+		spentBuf := expectedSpentBuf(tc, i)
+		for idx, txOut := range tx.MsgTx().TxOut {
+			op := btcwire.NewOutPoint(tx.Sha(), uint32(idx))
+			entry, err := tc.db.FetchUtxoEntry(op)
+			if err != nil {
+				tc.t.Errorf("FetchUtxoEntry (%s): block #%d (%s) "+
+					"tx #%d (%s) output %d err: %v", tc.dbType,
+					tc.blockHeight, tc.blockHash, i, tx.Sha(),
+					idx, err)
+				return false
+			}
+
+			// Spent outputs must not be returned.
+			if spentBuf[idx] {
+				if entry != nil {
+					tc.t.Errorf("FetchUtxoEntry (%s): block "+
+						"#%d (%s) tx #%d (%s) output %d "+
+						"returned for spent output",
+						tc.dbType, tc.blockHeight,
+						tc.blockHash, i, tx.Sha(), idx)
+					return false
+				}
+				continue
+			}
+
+			want := &btcdb.UtxoEntry{
+				Height:   tc.blockHeight,
+				Coinbase: i == 0,
+				Value:    txOut.Value,
+				PkScript: txOut.PkScript,
+			}
+			if !reflect.DeepEqual(entry, want) {
+				tc.t.Errorf("FetchUtxoEntry (%s): block #%d (%s) "+
+					"tx #%d (%s) output %d does not match "+
+					"\ngot: %v\nwant: %v", tc.dbType,
+					tc.blockHeight, tc.blockHash, i, tx.Sha(),
+					idx, spew.Sdump(entry), spew.Sdump(want))
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// testUtxoSetSize ensures UtxoSetSize reports the number of outputs created
+// by the passed blocks less those spent by them.
+func testUtxoSetSize(t *testing.T, dbType string, db btcdb.Db,
+	blocks []*btcutil.Block) bool {
+
+	var want int64
+	for _, block := range blocks {
+		for _, tx := range block.MsgBlock().Transactions {
+			want += int64(len(tx.TxOut))
+			for _, txIn := range tx.TxIn {
+				if txIn.PreviousOutpoint.Index != ^uint32(0) {
+					want--
+				}
+			}
+		}
+	}
+
+	size, err := db.UtxoSetSize()
+	if err != nil {
+		t.Errorf("UtxoSetSize (%s): unexpected error %v", dbType, err)
+		return false
+	}
+	if size != want {
+		t.Errorf("UtxoSetSize (%s): got %d, want %d", dbType, size,
+			want)
+		return false
+	}
+
+	return true
+}
+
+// testDropAfterBlockBySha ensures DropAfterBlockBySha removes every block after
+// the passed one such that the removed blocks no longer exist, FetchHeightRange
+// only returns the remaining blocks, and the removed blocks can be inserted
+// again.
+func testDropAfterBlockBySha(t *testing.T, dbType string, db btcdb.Db,
+	blocks []*btcutil.Block) bool {
+
+	dropHeight := int64(len(blocks) / 2)
+	dropHash, err := blocks[dropHeight].Sha()
+	if err != nil {
+		t.Errorf("block.Sha: %v", err)
+		return false
+	}
+	if err := db.DropAfterBlockBySha(dropHash); err != nil {
+		t.Errorf("DropAfterBlockBySha (%s): block #%d (%s) error %v",
+			dbType, dropHeight, dropHash, err)
+		return false
+	}
+
+	sha, height, err := db.NewestSha()
+	if err != nil {
+		t.Errorf("NewestSha (%s): unexpected error %v", dbType, err)
+		return false
+	}
+	if !sha.IsEqual(dropHash) || height != dropHeight {
+		t.Errorf("NewestSha (%s): wrong block after drop got: #%d "+
+			"(%s), want: #%d (%s)", dbType, height, sha,
+			dropHeight, dropHash)
+		return false
+	}
+
+	shas, err := db.FetchHeightRange(0, btcdb.AllShas)
+	if err != nil {
+		t.Errorf("FetchHeightRange (%s): unexpected error %v", dbType,
+			err)
+		return false
+	}
+	if int64(len(shas)) != dropHeight+1 {
+		t.Errorf("FetchHeightRange (%s): wrong number of hashes after "+
+			"drop got: %d, want: %d", dbType, len(shas),
+			dropHeight+1)
+		return false
+	}
+	for i := range shas {
+		blockHash, err := blocks[i].Sha()
+		if err != nil {
+			t.Errorf("block.Sha: %v", err)
+			return false
+		}
+		if !shas[i].IsEqual(blockHash) {
+			t.Errorf("FetchHeightRange (%s): block #%d wrong hash "+
+				"got: %s, want: %s", dbType, i, &shas[i],
+				blockHash)
+			return false
+		}
+	}
+
+	for i := dropHeight + 1; i < int64(len(blocks)); i++ {
+		blockHash, err := blocks[i].Sha()
+		if err != nil {
+			t.Errorf("block.Sha: %v", err)
+			return false
+		}
+		if db.ExistsSha(blockHash) {
+			t.Errorf("ExistsSha (%s): block #%d (%s) exists after "+
+				"drop", dbType, i, blockHash)
+			return false
+		}
+	}
+
+	// The dropped blocks must insert again at their original heights.
+	for i := dropHeight + 1; i < int64(len(blocks)); i++ {
+		height, err := db.InsertBlock(blocks[i])
+		if err != nil {
+			t.Errorf("InsertBlock (%s): failed to reinsert block "+
+				"#%d: %v", dbType, i, err)
+			return false
+		}
+		if height != i {
+			t.Errorf("InsertBlock (%s): reinserted block #%d at "+
+				"height %d", dbType, i, height)
+			return false
+		}
+	}
+
+	return true
+}
+
 // testIntegrity performs a series of tests against the interface functions
 // which fetch and check for data existence.
 func testIntegrity(tc *testContext) bool {
@@ -506,6 +674,12 @@ func testIntegrity(tc *testContext) bool {
 		return false
 	}
 
+	// All of the unspent outputs created by the block must be fetchable
+	// via FetchUtxoEntry while spent ones must not.
+	if !testFetchUtxoEntry(tc) {
+		return false
+	}
+
 	return true
 }
 
@@ -569,6 +743,12 @@ func testInterface(t *testing.T, dbType string) {
 		}
 	}
 
+	// The unspent output set must contain every output that has not been
+	// spent by the inserted blocks.
+	if !testUtxoSetSize(t, dbType, db, blocks) {
+		return
+	}
+
 	// Run the data integrity tests again after all blocks have been
 	// inserted to ensure the spend tracking  is working properly.
 	context.useSpends = true
@@ -588,16 +768,25 @@ func testInterface(t *testing.T, dbType string) {
 		testIntegrity(&context)
 	}
 
-	// TODO(davec): Need to figure out how to handle the special checks
-	// required for the duplicate transactions allowed by blocks 91842 and
-	// 91880 on the main network due to the old miner + Satoshi client bug.
+	// Dropping the upper half of the blocks must remove them and leave
+	// the database in a state where they can be inserted again.
+	if !testDropAfterBlockBySha(t, dbType, db, blocks) {
+		return
+	}
+
+	// The unspent output set must be the same once the dropped blocks
+	// have been reinserted.
+	if !testUtxoSetSize(t, dbType, db, blocks) {
+		return
+	}
+
+	// The duplicate transactions allowed by blocks 91842 and 91880 on the
+	// main network and the duplicate transaction error conditions are
+	// tested by TestBIP30.
 
 	// TODO(davec): Add tests for error conditions:
 	/*
 	   - Don't allow duplicate blocks
-	   - Don't allow insertion of block that contains a transaction that
-	     already exists unless the previous one is fully spent
-	   - Don't allow block that has a duplicate transaction in itself
 	   - Don't allow block which contains a tx that references a missing tx
 	   - Don't allow block which contains a tx that references another tx
 	     that comes after it in the same block
@@ -606,18 +795,20 @@ func testInterface(t *testing.T, dbType string) {
 	// TODO(davec): Add tests for the following functions:
 	/*
 	   - Close()
-	   - DropAfterBlockBySha(*btcwire.ShaHash) (err error)
+	   x DropAfterBlockBySha(*btcwire.ShaHash) (err error)
 	   x ExistsSha(sha *btcwire.ShaHash) (exists bool)
 	   x FetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, err error)
 	   x FetchBlockShaByHeight(height int64) (sha *btcwire.ShaHash, err error)
-	   - FetchHeightRange(startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error)
+	   x FetchHeightRange(startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error)
 	   x ExistsTxSha(sha *btcwire.ShaHash) (exists bool)
 	   x FetchTxBySha(txsha *btcwire.ShaHash) ([]*TxListReply, error)
 	   x FetchTxByShaList(txShaList []*btcwire.ShaHash) []*TxListReply
 	   x FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*TxListReply
+	   x FetchUtxoEntry(outpoint *btcwire.OutPoint) (*UtxoEntry, error)
 	   x InsertBlock(block *btcutil.Block) (height int64, err error)
 	   x NewestSha() (sha *btcwire.ShaHash, height int64, err error)
 	   - RollbackClose()
 	   - Sync()
+	   x UtxoSetSize() (int64, error)
 	*/
 }
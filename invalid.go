@@ -0,0 +1,266 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// InvalidBlockPrefix is the prefix of the keys of the metadata namespace under
+// which InvalidateBlock keeps the blocks it marks as invalid.  Each key is the
+// prefix followed by the hash of a block, and its value is the height the
+// block had in the chain followed by the header of the block and the hashes of
+// its transactions, which are stored under KeptTxPrefix.  The top bit of the
+// 8-byte little-endian height is set, and blocks kept before transactions were
+// stored apart, which have it clear, hold the serialized block instead.
+var InvalidBlockPrefix = []byte("btcdb/invalid/")
+
+// invalidBlockKey returns the key of the metadata namespace under which the
+// block with the passed hash is kept while it is marked as invalid.
+func invalidBlockKey(sha *btcwire.ShaHash) []byte {
+	key := make([]byte, len(InvalidBlockPrefix)+btcwire.HashSize)
+	copy(key, InvalidBlockPrefix)
+	copy(key[len(InvalidBlockPrefix):], sha.Bytes())
+	return key
+}
+
+// InvalidateBlock marks the block with the passed hash, which must be in the
+// chain of the passed database, and every block after it as invalid.  The
+// blocks are removed from the chain, so NewestSha and the queries by height
+// see the chain end at the parent of the block and subscribers are told they
+// are disconnected, but they are not deleted: they are kept under
+// InvalidBlockPrefix in the metadata namespace, in the same change as they are
+// removed, until ReconsiderBlock is called for one of them.  Marking a block
+// which is already marked is not an error.  The genesis block can not be
+// marked.
+//
+// Blocks known to be invalid are not rejected by InsertBlock, so layers which
+// validate the chain check IsInvalidBlock before inserting a block.  Nothing
+// else may change the chain while the blocks are being marked.
+func InvalidateBlock(db Db, sha *btcwire.ShaHash) error {
+	invalid, err := IsInvalidBlock(db, sha)
+	if err != nil || invalid {
+		return err
+	}
+
+	height, err := db.FetchBlockHeightBySha(sha)
+	if err != nil {
+		return err
+	}
+	if height == 0 {
+		return fmt.Errorf("genesis block %v can not be marked as "+
+			"invalid", sha)
+	}
+	parent, err := db.FetchBlockShaByHeight(height - 1)
+	if err != nil {
+		return err
+	}
+	shas, err := db.FetchHeightRange(height, AllShas)
+	if err != nil {
+		return err
+	}
+
+	var meta MetaBatch
+	refs := newKeptTxRefs()
+	for i := range shas {
+		blk, err := db.FetchBlockBySha(&shas[i])
+		if err != nil {
+			return err
+		}
+		val, err := encodeKeptBlock(height+int64(i), blk, refs)
+		if err != nil {
+			return err
+		}
+		meta.Put(invalidBlockKey(&shas[i]), val)
+		refs.leaveChain(blk)
+	}
+	if err := refs.write(db, &meta); err != nil {
+		return err
+	}
+	log.Infof("Marking %d blocks from %v at height %d as invalid",
+		len(shas), sha, height)
+	return db.DropAfterBlockByShaWithMeta(parent, &meta)
+}
+
+// IsInvalidBlock returns whether the block with the passed hash is marked as
+// invalid in the passed database by InvalidateBlock.
+func IsInvalidBlock(db Db, sha *btcwire.ShaHash) (bool, error) {
+	val, err := db.GetMeta(invalidBlockKey(sha))
+	if err != nil {
+		return false, err
+	}
+	return val != nil, nil
+}
+
+// FetchInvalidBlock returns the block with the passed hash which is marked as
+// invalid in the passed database, with its height set to the one it had in the
+// chain.  ErrBlockNotFound is returned when the block is not marked.
+func FetchInvalidBlock(db Db, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	val, err := db.GetMeta(invalidBlockKey(sha))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrBlockNotFound
+	}
+	return decodeKeptBlock(db, val)
+}
+
+// ReconsiderBlock removes the marks InvalidateBlock left on the block with the
+// passed hash, on the marked blocks before it back to the chain and on every
+// marked block after it.  When the block is not marked, nothing is done if it
+// is in the chain and ErrBlockNotFound is returned otherwise.
+//
+// The unmarked blocks are connected to the chain again when they link to it,
+// following the blocks after the block with the most work where there are
+// several.  Blocks added to the chain since they were marked are replaced by
+// them when they have more work and moved to a side chain, as SetMainChain
+// does, and otherwise the unmarked blocks are kept on a side chain instead.
+// Unmarked blocks which are not connected or kept, such as those which no
+// longer link to the chain, are forgotten.
+func ReconsiderBlock(db Db, sha *btcwire.ShaHash) error {
+	marked, err := keptBlocks(db, InvalidBlockPrefix)
+	if err != nil {
+		return err
+	}
+	if _, ok := marked[*sha]; !ok {
+		if db.ExistsSha(sha) {
+			return nil
+		}
+		return ErrBlockNotFound
+	}
+
+	// Collect the marked blocks from the one linking to the chain up to
+	// the reconsidered block.
+	var branch []*btcutil.Block
+	for cur := *sha; ; {
+		blk, ok := marked[cur]
+		if !ok {
+			break
+		}
+		branch = append([]*btcutil.Block{blk}, branch...)
+		cur = blk.MsgBlock().Header.PrevBlock
+	}
+
+	// The reconsidered block is followed by the marked blocks after it
+	// with the most work, and the marks on all of them are removed.
+	children := make(map[btcwire.ShaHash][]btcwire.ShaHash)
+	for childSha, blk := range marked {
+		prev := blk.MsgBlock().Header.PrevBlock
+		children[prev] = append(children[prev], childSha)
+	}
+	var meta MetaBatch
+	refs := newKeptTxRefs()
+	for _, blk := range branch {
+		blkSha, _ := blk.Sha()
+		err := deleteKeptBlock(db, invalidBlockKey(blkSha), &meta, refs)
+		if err != nil {
+			return err
+		}
+	}
+	_, best, err := bestDescendants(db, marked, children, sha, &meta, refs)
+	if err != nil {
+		return err
+	}
+	branch = append(branch, best...)
+
+	forkSha := branch[0].MsgBlock().Header.PrevBlock
+	forkHeight, err := db.FetchBlockHeightBySha(&forkSha)
+	if err == ErrBlockNotFound {
+		log.Infof("Forgetting %d reconsidered blocks which no longer "+
+			"link to the chain", meta.Len())
+		if err := refs.write(db, &meta); err != nil {
+			return err
+		}
+		return db.WriteMeta(&meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if newest > forkHeight {
+		hdrs, err := db.FetchHeaderRange(forkHeight+1, newest+1)
+		if err != nil {
+			return err
+		}
+		chainWork := new(big.Int)
+		for i := range hdrs {
+			chainWork.Add(chainWork, CalcWork(hdrs[i].Bits))
+		}
+		if branchWork(branch).Cmp(chainWork) <= 0 {
+			log.Infof("Keeping %d reconsidered blocks with no more "+
+				"work than the chain as side blocks", len(branch))
+			for i, blk := range branch {
+				blkSha, _ := blk.Sha()
+				val, err := encodeKeptBlock(
+					forkHeight+1+int64(i), blk, refs)
+				if err != nil {
+					return err
+				}
+				meta.Put(sideBlockKey(blkSha), val)
+			}
+			if err := refs.write(db, &meta); err != nil {
+				return err
+			}
+			return db.WriteMeta(&meta)
+		}
+		err = putSideBlocks(db, forkHeight+1, newest, &meta, refs)
+		if err != nil {
+			return err
+		}
+	}
+	if err := refs.write(db, &meta); err != nil {
+		return err
+	}
+
+	log.Infof("Connecting %d reconsidered blocks after height %d",
+		len(branch), forkHeight)
+	_, err = db.ReorganizeWithMeta(&forkSha, branch, &meta)
+	return err
+}
+
+// bestDescendants adds removing the marks on every marked block after the
+// block with the passed hash to the passed batch and set of changes to kept
+// transactions, and returns the work of the run of those blocks with the most
+// work along with the run.
+func bestDescendants(db Db, marked map[btcwire.ShaHash]*btcutil.Block, children map[btcwire.ShaHash][]btcwire.ShaHash, sha *btcwire.ShaHash, meta *MetaBatch, refs *keptTxRefs) (*big.Int, []*btcutil.Block, error) {
+	bestWork := new(big.Int)
+	var best []*btcutil.Block
+	for _, childSha := range children[*sha] {
+		childSha := childSha
+		err := deleteKeptBlock(db, invalidBlockKey(&childSha), meta, refs)
+		if err != nil {
+			return nil, nil, err
+		}
+		work, run, err := bestDescendants(db, marked, children,
+			&childSha, meta, refs)
+		if err != nil {
+			return nil, nil, err
+		}
+		blk := marked[childSha]
+		work.Add(work, CalcWork(blk.MsgBlock().Header.Bits))
+		if best == nil || work.Cmp(bestWork) > 0 {
+			bestWork = work
+			best = append([]*btcutil.Block{blk}, run...)
+		}
+	}
+	return bestWork, best, nil
+}
+
+// branchWork returns the sum of the work of the passed blocks.
+func branchWork(blocks []*btcutil.Block) *big.Int {
+	work := new(big.Int)
+	for _, blk := range blocks {
+		work.Add(work, CalcWork(blk.MsgBlock().Header.Bits))
+	}
+	return work
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestInvalidateBlock ensures blocks marked as invalid in every supported
+// database type leave the chain while staying marked across reopening the
+// database, and that reconsidering them connects them again unless blocks with
+// more work took their place.
+func TestInvalidateBlock(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:20]
+	shas := make([]*btcwire.ShaHash, len(blocks))
+	for i, blk := range blocks {
+		shas[i], _ = blk.Sha()
+	}
+
+	// checkTip ensures the chain ends with the block with the passed hash
+	// at the passed height.
+	checkTip := func(dbType, desc string, db btcdb.Db, wantSha *btcwire.ShaHash, wantHeight int64) {
+		sha, height, err := db.NewestSha()
+		if err != nil || height != wantHeight || !sha.IsEqual(wantSha) {
+			t.Errorf("NewestSha (%s) %s: got %v at height %d (err "+
+				"%v), want %v at height %d", dbType, desc, sha,
+				height, err, wantSha, wantHeight)
+		}
+		if _, err := db.FetchBlockShaByHeight(wantHeight + 1); err == nil {
+			t.Errorf("FetchBlockShaByHeight (%s) %s: found a block "+
+				"after the chain", dbType, desc)
+		}
+	}
+
+	// checkMarked ensures the blocks of the test chain from the passed
+	// height on are the ones marked as invalid.
+	checkMarked := func(dbType, desc string, db btcdb.Db, from int) {
+		for i, sha := range shas {
+			invalid, err := btcdb.IsInvalidBlock(db, sha)
+			if err != nil || invalid != (i >= from) {
+				t.Errorf("IsInvalidBlock (%s) %s: got %v for "+
+					"block %d (err %v)", dbType, desc,
+					invalid, i, err)
+			}
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "invaliddb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+
+		if err := btcdb.InvalidateBlock(db, shas[0]); err == nil {
+			t.Errorf("InvalidateBlock (%s): marked the genesis block",
+				dbType)
+		}
+		if err := btcdb.InvalidateBlock(db, shas[15]); err != nil {
+			t.Errorf("InvalidateBlock (%s): %v", dbType, err)
+		}
+		if err := btcdb.InvalidateBlock(db, shas[17]); err != nil {
+			t.Errorf("InvalidateBlock (%s): unexpected error for a "+
+				"marked block: %v", dbType, err)
+		}
+		checkTip(dbType, "after invalidating", db, shas[14], 14)
+		checkMarked(dbType, "after invalidating", db, 15)
+		blk, err := btcdb.FetchInvalidBlock(db, shas[17])
+		if err != nil {
+			t.Errorf("FetchInvalidBlock (%s): %v", dbType, err)
+		} else if sha, _ := blk.Sha(); !sha.IsEqual(shas[17]) ||
+			blk.Height() != 17 {
+
+			t.Errorf("FetchInvalidBlock (%s): got %v at height %d, "+
+				"want %v at height 17", dbType, sha, blk.Height(),
+				shas[17])
+		}
+
+		// The marks must survive reopening the database.
+		if dbType != "memory" {
+			db.Close()
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+			checkTip(dbType, "after reopening", db, shas[14], 14)
+			checkMarked(dbType, "after reopening", db, 15)
+		}
+
+		// Reconsidering a block in the middle of the marked blocks
+		// reconnects all of them, even when a shorter chain took their
+		// place.
+		if _, err := db.InsertBlocks(altChain(blocks[14], 2)); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		if err := btcdb.ReconsiderBlock(db, shas[17]); err != nil {
+			t.Errorf("ReconsiderBlock (%s): %v", dbType, err)
+		}
+		checkTip(dbType, "after reconsidering", db, shas[19], 19)
+		checkMarked(dbType, "after reconsidering", db, len(blocks))
+
+		// Only the coinbases of the two replaced blocks are left among
+		// the kept transactions.
+		iter, err := db.MetaIterator(btcdb.KeptTxPrefix)
+		if err != nil {
+			t.Errorf("MetaIterator (%s): %v", dbType, err)
+		} else {
+			var kept int
+			for iter.Next() {
+				kept++
+			}
+			iter.Release()
+			if kept != 2 {
+				t.Errorf("kept transactions (%s): got %d after "+
+					"reconsidering, want 2", dbType, kept)
+			}
+		}
+		if err := btcdb.ReconsiderBlock(db, shas[17]); err != nil {
+			t.Errorf("ReconsiderBlock (%s): unexpected error for a "+
+				"block in the chain: %v", dbType, err)
+		}
+		if err := btcdb.ReconsiderBlock(db, &zeroHash); err != btcdb.ErrBlockNotFound {
+			t.Errorf("ReconsiderBlock (%s): got %v for an unknown "+
+				"block, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+
+		// Marked blocks are forgotten when reconsidered after a chain
+		// with more work took their place.
+		if err := btcdb.InvalidateBlock(db, shas[18]); err != nil {
+			t.Errorf("InvalidateBlock (%s): %v", dbType, err)
+		}
+		alt := altChain(blocks[17], 3)
+		if _, err := db.InsertBlocks(alt); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		if err := btcdb.ReconsiderBlock(db, shas[18]); err != nil {
+			t.Errorf("ReconsiderBlock (%s): %v", dbType, err)
+		}
+		altSha, _ := alt[2].Sha()
+		checkTip(dbType, "after reconsidering with less work", db,
+			altSha, 20)
+		checkMarked(dbType, "after reconsidering with less work", db,
+			len(blocks))
+		if _, err := btcdb.FetchInvalidBlock(db, shas[19]); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchInvalidBlock (%s): got %v for a "+
+				"forgotten block, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// KeptTxPrefix is the prefix of the keys of the metadata namespace under which
+// the transactions of the blocks kept under SideBlockPrefix and
+// InvalidBlockPrefix are stored, once each however many of those blocks hold
+// them.  Each key is the prefix followed by the hash of a transaction, and its
+// value is the number of kept blocks referring to the transaction as a 4-byte
+// little-endian integer followed by the serialized transaction.  Transactions
+// which are already in the chain when they are first kept are not stored
+// again, so their value only holds the number and they are read from the
+// chain.  They are stored once the blocks holding them leave the chain through
+// SetMainChain, InvalidateBlock or ReconsiderBlock.
+var KeptTxPrefix = []byte("btcdb/tx/")
+
+// keptBlockRefs is set in the height of the values of kept blocks whose
+// transactions are stored under KeptTxPrefix and which only hold their
+// hashes.  Blocks kept before the transactions were stored apart hold the
+// serialized block and are read as they are.
+const keptBlockRefs = 1 << 63
+
+// keptTxKey returns the key of the metadata namespace under which the kept
+// transaction with the passed hash is stored.
+func keptTxKey(sha *btcwire.ShaHash) []byte {
+	key := make([]byte, len(KeptTxPrefix)+btcwire.HashSize)
+	copy(key, KeptTxPrefix)
+	copy(key[len(KeptTxPrefix):], sha.Bytes())
+	return key
+}
+
+// keptTxRefs collects the changes made to the number of kept blocks referring
+// to each kept transaction by a batch of changes to the kept blocks, so that
+// blocks sharing transactions in the same batch are counted correctly.
+// leaving holds the transactions of the blocks the batch removes from the
+// chain, which can no longer be read from it.
+type keptTxRefs struct {
+	counts  map[btcwire.ShaHash]int
+	txs     map[btcwire.ShaHash]*btcwire.MsgTx
+	leaving map[btcwire.ShaHash]struct{}
+}
+
+// newKeptTxRefs returns a new empty set of changes to kept transactions.
+func newKeptTxRefs() *keptTxRefs {
+	return &keptTxRefs{
+		counts:  make(map[btcwire.ShaHash]int),
+		txs:     make(map[btcwire.ShaHash]*btcwire.MsgTx),
+		leaving: make(map[btcwire.ShaHash]struct{}),
+	}
+}
+
+// leaveChain records that the passed block, which must be kept by the same
+// batch, is removed from the chain, so its transactions are stored rather than
+// read from the chain.
+func (refs *keptTxRefs) leaveChain(block *btcutil.Block) {
+	for _, tx := range block.Transactions() {
+		refs.leaving[*tx.Sha()] = struct{}{}
+	}
+}
+
+// encodeKeptBlock returns the value under which a block with the passed height
+// is kept in the metadata namespace, which is the height followed by the
+// header of the block and the hashes of its transactions, and adds the
+// references to the transactions of the block to the passed set.
+func encodeKeptBlock(height int64, block *btcutil.Block, refs *keptTxRefs) ([]byte, error) {
+	var buf bytes.Buffer
+	var h [8]byte
+	binary.LittleEndian.PutUint64(h[:], uint64(height)|keptBlockRefs)
+	buf.Write(h[:])
+	if err := block.MsgBlock().Header.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	for _, tx := range block.Transactions() {
+		sha := tx.Sha()
+		buf.Write(sha.Bytes())
+		refs.counts[*sha]++
+		refs.txs[*sha] = tx.MsgTx()
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeKeptBlock returns the block kept in the passed value of the metadata
+// namespace of the passed database with its height set to the one kept along
+// with it.
+func decodeKeptBlock(db Db, val []byte) (*btcutil.Block, error) {
+	if len(val) < 8 {
+		return nil, fmt.Errorf("malformed kept block record %x", val)
+	}
+	height := binary.LittleEndian.Uint64(val[:8])
+	if height&keptBlockRefs == 0 {
+		blk, err := btcutil.NewBlockFromBytes(val[8:])
+		if err != nil {
+			return nil, err
+		}
+		blk.SetHeight(int64(height))
+		return blk, nil
+	}
+
+	shas, err := keptBlockTxShas(val)
+	if err != nil {
+		return nil, err
+	}
+	var msgBlock btcwire.MsgBlock
+	err = msgBlock.Header.Deserialize(bytes.NewReader(val[8:]))
+	if err != nil {
+		return nil, err
+	}
+	for i := range shas {
+		txVal, err := db.GetMeta(keptTxKey(&shas[i]))
+		if err != nil {
+			return nil, err
+		}
+		if len(txVal) < 4 {
+			return nil, fmt.Errorf("kept transaction %v is missing",
+				&shas[i])
+		}
+		if len(txVal) == 4 {
+			tx, err := fetchChainTx(db, &shas[i])
+			if err != nil {
+				return nil, err
+			}
+			msgBlock.AddTransaction(tx)
+			continue
+		}
+		var tx btcwire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(txVal[4:])); err != nil {
+			return nil, err
+		}
+		msgBlock.AddTransaction(&tx)
+	}
+	blk := btcutil.NewBlock(&msgBlock)
+	blk.SetHeight(int64(height &^ keptBlockRefs))
+	return blk, nil
+}
+
+// fetchChainTx returns the most recent instance of the transaction with the
+// passed hash in the chain of the passed database, which a kept transaction
+// which is only counted is read from.
+func fetchChainTx(db Db, sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+	replies, err := db.FetchTxBySha(sha)
+	if err != nil && err != TxShaMissing {
+		return nil, err
+	}
+	for i := len(replies) - 1; i >= 0; i-- {
+		if replies[i].Err == nil && replies[i].Tx != nil {
+			return replies[i].Tx, nil
+		}
+	}
+	return nil, fmt.Errorf("kept transaction %v is missing from the chain",
+		sha)
+}
+
+// keptBlockTxShas returns the hashes of the transactions held by the passed
+// value of a kept block whose transactions are stored under KeptTxPrefix.
+func keptBlockTxShas(val []byte) ([]btcwire.ShaHash, error) {
+	const hdrEnd = 8 + btcwire.MaxBlockHeaderPayload
+	if len(val) < hdrEnd || (len(val)-hdrEnd)%btcwire.HashSize != 0 {
+		return nil, fmt.Errorf("malformed kept block record %x", val)
+	}
+	shas := make([]btcwire.ShaHash, (len(val)-hdrEnd)/btcwire.HashSize)
+	for i := range shas {
+		off := hdrEnd + i*btcwire.HashSize
+		shas[i].SetBytes(val[off : off+btcwire.HashSize])
+	}
+	return shas, nil
+}
+
+// deleteKeptBlock adds removing the block kept under the passed key of the
+// metadata namespace of the passed database to the passed batch, and removing
+// its references to its transactions to the passed set.  Nothing is done when
+// no block is kept under the key.
+func deleteKeptBlock(db Db, key []byte, meta *MetaBatch, refs *keptTxRefs) error {
+	val, err := db.GetMeta(key)
+	if err != nil || val == nil {
+		return err
+	}
+	meta.Delete(key)
+	if len(val) < 8 ||
+		binary.LittleEndian.Uint64(val[:8])&keptBlockRefs == 0 {
+		return nil
+	}
+	shas, err := keptBlockTxShas(val)
+	if err != nil {
+		return err
+	}
+	for i := range shas {
+		refs.counts[shas[i]]--
+	}
+	return nil
+}
+
+// write adds the changes to the kept transactions of the passed database
+// collected in the set to the passed batch.  Transactions no longer referred
+// to by any kept block are removed and those referred to for the first time
+// are stored, unless they are in the chain and stay there.  Transactions which
+// are read from the chain are stored once the blocks holding them leave it.  It
+// must be called once, after every change to the kept blocks of the batch is
+// collected.
+func (refs *keptTxRefs) write(db Db, meta *MetaBatch) error {
+	for sha, delta := range refs.counts {
+		_, leaving := refs.leaving[sha]
+		if delta == 0 && !leaving {
+			continue
+		}
+		sha := sha
+		key := keptTxKey(&sha)
+		val, err := db.GetMeta(key)
+		if err != nil {
+			return err
+		}
+		count := int64(delta)
+		if len(val) >= 4 {
+			count += int64(binary.LittleEndian.Uint32(val[:4]))
+		}
+		if count <= 0 {
+			if val != nil {
+				meta.Delete(key)
+			}
+			continue
+		}
+
+		var buf bytes.Buffer
+		var c [4]byte
+		binary.LittleEndian.PutUint32(c[:], uint32(count))
+		buf.Write(c[:])
+
+		// Transactions in the chain which stay there are only counted.
+		counted := !leaving &&
+			(len(val) == 4 || val == nil && inChain(db, &sha))
+		switch {
+		case len(val) > 4:
+			buf.Write(val[4:])
+
+		case !counted:
+			tx, ok := refs.txs[sha]
+			if !ok {
+				return fmt.Errorf("kept transaction %v is missing",
+					&sha)
+			}
+			if err := tx.Serialize(&buf); err != nil {
+				return err
+			}
+		}
+		meta.Put(key, buf.Bytes())
+	}
+	return nil
+}
+
+// inChain returns whether the transaction with the passed hash can be read from
+// the chain of the passed database.
+func inChain(db Db, sha *btcwire.ShaHash) bool {
+	_, err := fetchChainTx(db, sha)
+	return err == nil
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestKeptTxs ensures the transactions of side blocks are stored once however
+// many side blocks share them, are removed along with the last block holding
+// them and that side blocks kept with their serialized block are still read
+// for every supported database type.
+func TestKeptTxs(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:15]
+	tipSha, _ := blocks[14].Sha()
+
+	// The coinbases of runs built by altChain only depend on their
+	// position, so the two branches share both of their transactions.
+	alt := altChain(blocks[12], 2)
+	altSha, _ := alt[1].Sha()
+	other := altChain(blocks[11], 2)
+	legacy := altChain(blocks[10], 1)[0]
+	legacySha, _ := legacy.Sha()
+
+	// keptRefs returns the passed map of kept transactions with the
+	// transactions of the passed blocks set to the passed number of blocks
+	// referring to them.
+	keptRefs := func(want map[btcwire.ShaHash]uint32, refs uint32, blks ...*btcutil.Block) map[btcwire.ShaHash]uint32 {
+		if want == nil {
+			want = make(map[btcwire.ShaHash]uint32)
+		}
+		for _, blk := range blks {
+			for _, tx := range blk.Transactions() {
+				want[*tx.Sha()] = refs
+			}
+		}
+		return want
+	}
+
+	// checkKept ensures the kept transactions and the number of blocks
+	// referring to each are the passed ones.
+	checkKept := func(dbType, desc string, db btcdb.Db, want map[btcwire.ShaHash]uint32) {
+		iter, err := db.MetaIterator(btcdb.KeptTxPrefix)
+		if err != nil {
+			t.Errorf("MetaIterator (%s) %s: %v", dbType, desc, err)
+			return
+		}
+		defer iter.Release()
+		got := make(map[btcwire.ShaHash]uint32)
+		for iter.Next() {
+			var sha btcwire.ShaHash
+			sha.SetBytes(iter.Key()[len(btcdb.KeptTxPrefix):])
+			got[sha] = binary.LittleEndian.Uint32(iter.Value())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("kept transactions (%s) %s: got %v, want %v",
+				dbType, desc, got, want)
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "keptdb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+
+		for _, blk := range append(append([]*btcutil.Block{}, alt...),
+			other...) {
+			if _, err := btcdb.InsertSideBlock(db, blk); err != nil {
+				t.Errorf("InsertSideBlock (%s): %v", dbType, err)
+			}
+		}
+		checkKept(dbType, "after inserting side blocks", db,
+			keptRefs(nil, 2, alt...))
+		blk, err := btcdb.FetchSideBlock(db, altSha)
+		if err != nil {
+			t.Errorf("FetchSideBlock (%s): %v", dbType, err)
+		} else if !reflect.DeepEqual(blk.MsgBlock(), alt[1].MsgBlock()) {
+			t.Errorf("FetchSideBlock (%s): block does not match",
+				dbType)
+		}
+
+		// The connected branch no longer refers to its transactions
+		// while the replaced blocks refer to theirs.
+		if err := btcdb.SetMainChain(db, altSha); err != nil {
+			t.Errorf("SetMainChain (%s): %v", dbType, err)
+		}
+		checkKept(dbType, "after switching", db, keptRefs(nil, 1,
+			alt[0], alt[1], blocks[13], blocks[14]))
+		if err := btcdb.SetMainChain(db, tipSha); err != nil {
+			t.Errorf("SetMainChain (%s): %v", dbType, err)
+		}
+		checkKept(dbType, "after switching back", db,
+			keptRefs(nil, 2, alt...))
+
+		// Side blocks kept with their serialized block have the top
+		// bit of their height clear.
+		raw, _ := legacy.Bytes()
+		val := make([]byte, 8+len(raw))
+		binary.LittleEndian.PutUint64(val, 11)
+		copy(val[8:], raw)
+		key := append(append([]byte{}, btcdb.SideBlockPrefix...),
+			legacySha.Bytes()...)
+		if err := db.PutMeta(key, val); err != nil {
+			t.Errorf("PutMeta (%s): %v", dbType, err)
+		}
+		blk, err = btcdb.FetchSideBlock(db, legacySha)
+		if err != nil || blk.Height() != 11 {
+			t.Errorf("FetchSideBlock (%s): got %v (err %v) for a "+
+				"legacy side block, want height 11", dbType, blk, err)
+		}
+		if err := btcdb.SetMainChain(db, legacySha); err != nil {
+			t.Errorf("SetMainChain (%s): %v", dbType, err)
+		}
+		want := keptRefs(nil, 1, blocks[11], blocks[12], blocks[13],
+			blocks[14])
+		checkKept(dbType, "after connecting a legacy side block", db,
+			keptRefs(want, 2, alt...))
+
+		// A side block sharing its transaction with the chain only
+		// counts it, until the block holding it leaves the chain.
+		dupBlock := *blocks[10].MsgBlock()
+		dupBlock.Header.Nonce++
+		dup := btcutil.NewBlock(&dupBlock)
+		dupSha, _ := dup.Sha()
+		txKey := append(append([]byte{}, btcdb.KeptTxPrefix...),
+			dup.Transactions()[0].Sha().Bytes()...)
+		if _, err := btcdb.InsertSideBlock(db, dup); err != nil {
+			t.Errorf("InsertSideBlock (%s): %v", dbType, err)
+		}
+		if val, err := db.GetMeta(txKey); err != nil || len(val) != 4 {
+			t.Errorf("GetMeta (%s): got %x (err %v) for a transaction "+
+				"in the chain, want only its count", dbType, val, err)
+		}
+		blk, err = btcdb.FetchSideBlock(db, dupSha)
+		if err != nil || !reflect.DeepEqual(blk.MsgBlock(), &dupBlock) {
+			t.Errorf("FetchSideBlock (%s): got %v (err %v) for a "+
+				"block sharing the chain's transaction", dbType, blk,
+				err)
+		}
+		if err := btcdb.SetMainChain(db, dupSha); err != nil {
+			t.Errorf("SetMainChain (%s): %v", dbType, err)
+		}
+		if val, err := db.GetMeta(txKey); err != nil || len(val) <= 4 {
+			t.Errorf("GetMeta (%s): got %x (err %v) for a transaction "+
+				"leaving the chain, want it stored", dbType, val, err)
+		}
+		sha10, _ := blocks[10].Sha()
+		blk, err = btcdb.FetchSideBlock(db, sha10)
+		if err != nil ||
+			!reflect.DeepEqual(blk.MsgBlock(), blocks[10].MsgBlock()) {
+			t.Errorf("FetchSideBlock (%s): got %v (err %v) for a "+
+				"block which left the chain", dbType, blk, err)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"github.com/conformal/goleveldb/leveldb/cache"
+	"github.com/conformal/goleveldb/leveldb/opt"
+	"os"
+)
+
+// backupBatchSize is the number of bytes of keys and values written to the
+// copy in a single batch while backing up a database.
+const backupBatchSize = 4 * 1024 * 1024 // 4 MB
+
+// Backup writes a copy of the database as of the time it is called to a new
+// database at the passed path, which must not exist yet.  This is part of the
+// btcdb.Db interface implementation.
+//
+// The copy is made from a snapshot.  When blocks are stored in flat files they
+// are copied into new files of the same maximum size, and dropping blocks while
+// the backup runs can make it fail like any read of a dropped block through a
+// snapshot.
+func (db *LevelDb) Backup(destPath string, progress func(copied int64)) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return snap.(*snapshot).backupTo(destPath, progress)
+}
+
+// blockKeyHeight returns the height of the block whose hash and body, or flat
+// file location, are stored under the given key and whether the key is such a
+// key.
+func blockKeyHeight(key []byte) (int64, bool) {
+	return keyHeight(blockNs, key)
+}
+
+// backupTo writes a copy of the database seen by the snapshot to a new database
+// at the passed path.  Every key is copied as it is except for the blocks
+// stored in flat files, which are written to the files of the copy in height
+// order with their locations updated to match.
+func (db *LevelDb) backupTo(destPath string, progress func(copied int64)) (rerr error) {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination %v already exists",
+			destPath)
+	}
+
+	opts := &opt.Options{
+		BlockCache:   cache.NewEmptyCache(),
+		MaxOpenFiles: 256,
+		Compression:  opt.NoCompression,
+		ErrorIfExist: true,
+	}
+	lDb, err := leveldb.OpenFile(destPath, opts)
+	if err != nil {
+		return err
+	}
+	dest := &LevelDb{lDb: lDb, metrics: btcdb.DiscardMetrics}
+	defer func() {
+		if dest.blkFiles != nil {
+			dest.blkFiles.close()
+		}
+		if err := lDb.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+		if rerr != nil {
+			os.RemoveAll(destPath)
+			os.Remove(destPath + ".ver")
+		}
+	}()
+	if db.blkFiles != nil {
+		err := dest.setupBlockFiles(destPath, db.blkFiles.maxFileSize)
+		if err != nil {
+			return err
+		}
+		if err := dest.blkFiles.truncate(blockLoc{}); err != nil {
+			return err
+		}
+	}
+
+	var copied int64
+	batch := new(leveldb.Batch)
+	batchSize := 0
+	flush := func(wo *opt.WriteOptions) error {
+		if err := lDb.Write(batch, wo); err != nil {
+			return err
+		}
+		batch.Reset()
+		batchSize = 0
+		if progress != nil {
+			progress(copied)
+		}
+		return nil
+	}
+	put := func(key, value []byte) error {
+		batch.Put(key, value)
+		batchSize += len(key) + len(value)
+		copied += int64(len(key) + len(value))
+		if batchSize < backupBatchSize {
+			return nil
+		}
+		return flush(nil)
+	}
+
+	iter := db.snap.NewIterator(nil, db.ro)
+	for iter.Next() {
+		// Blocks stored in flat files are copied below.
+		if db.blkFiles != nil {
+			if _, ok := blockKeyHeight(iter.Key()); ok {
+				continue
+			}
+		}
+		if err := put(iter.Key(), iter.Value()); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if db.blkFiles != nil {
+		for height := int64(0); height <= db.lastBlkIdx; height++ {
+			val, n, err := db.backupBlock(dest.blkFiles, height)
+			if err != nil {
+				return err
+			}
+			copied += int64(n)
+			if err := put(heightBlkToKey(height), val); err != nil {
+				return err
+			}
+		}
+		if err := dest.blkFiles.sync(); err != nil {
+			return err
+		}
+	}
+
+	// The final batch is synced, which also syncs the earlier ones.
+	batch.Delete(syncKey)
+	if err := flush(&opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+
+	fo, err := os.Create(destPath + ".ver")
+	if err != nil {
+		return err
+	}
+	defer fo.Close()
+	return binary.Write(fo, binary.LittleEndian, CurrentDBVersion)
+}
+
+// backupBlock writes the block at the given height, which is stored in a flat
+// file, to the passed block files of a copy of the database.  It returns the
+// value which records the block in the copy and the number of bytes written to
+// the files.  Pruned blocks keep no location since they are never read.
+func (db *LevelDb) backupBlock(bf *blockFiles, height int64) ([]byte, int, error) {
+	var sha *btcwire.ShaHash
+	var loc blockLoc
+	var buf []byte
+	var err error
+	if height < db.pruneHeight {
+		sha, err = db.fetchBlockShaByHeight(height)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		sha, buf, err = db.getBlkByHeight(height)
+		if err != nil {
+			return nil, 0, err
+		}
+		loc, err = bf.writeBlock(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		loc.checksum = checksum(buf)
+	}
+
+	val := append(sha.Bytes(), formatBlockLoc(loc, db.checksums)...)
+	return val, len(buf), nil
+}
@@ -6,22 +6,65 @@ package ldb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/conformal/btcdb"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
 )
 
 // FetchBlockBySha - return a btcutil Block
 func (db *LevelDb) FetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, err error) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
-	return db.fetchBlockBySha(sha)
+	return db.FetchBlockByShaCtx(context.Background(), sha)
+}
+
+// FetchBlockByShaCtx returns a btcutil Block unless the passed context is done
+// first.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha)
+	defer op.Done()
+	if err := btcdb.LockContext(ctx, db.dbLock.RLocker()); err != nil {
+		return nil, err
+	}
+	op.Locked()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	if blk := db.blockCache.Lookup(sha); blk != nil {
+		db.readAhead.Fetched(blk.Height())
+		return blk, nil
+	}
+	blk, err := db.fetchBlockBySha(sha)
+	if err != nil {
+		return nil, err
+	}
+	db.readAhead.Fetched(blk.Height())
+	return blk, nil
+}
+
+// readAheadBlock reads the block at the given height into the block cache
+// ahead of the caller.  It returns false once there is no such block.
+func (db *LevelDb) readAheadBlock(height int64) bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed || height >= db.nextBlock {
+		return false
+	}
+	sha, buf, err := db.getBlkByHeight(height)
+	if err != nil {
+		return false
+	}
+	db.blockCache.Add(sha, height, buf)
+	return true
 }
 
 // fetchBlockBySha - return a btcutil Block
-// Must be called with db lock held.
+// Must be called with db read lock held.
 func (db *LevelDb) fetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, err error) {
 
 	buf, height, err := db.fetchSha(sha)
@@ -34,49 +77,190 @@ func (db *LevelDb) fetchBlockBySha(sha *btcwire.ShaHash) (blk *btcutil.Block, er
 		return
 	}
 	blk.SetHeight(height)
+	db.blockCache.Add(sha, height, buf)
 
 	return
 }
 
+// BlockCacheStats returns the use of the cache of recent blocks.  This is part
+// of the btcdb.Db interface implementation.
+func (db *LevelDb) BlockCacheStats() btcdb.BlockCacheStats {
+	return db.blockCache.Stats()
+}
+
+// FetchBlockRegion returns length bytes of the serialized block with the given
+// hash starting at offset.  Only the region is read when blocks are stored in
+// flat files.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	height, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	if height < db.pruneHeight {
+		return nil, btcdb.ErrPruned
+	}
+	if db.blkFiles != nil {
+		_, loc, err := db.getBlkLocByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		return db.blkFiles.readRegion(loc, offset, length)
+	}
+
+	_, buf, err := db.getBlkByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > len(buf) {
+		return nil, btcdb.ErrInvalidRegion
+	}
+	return buf[offset : offset+length], nil
+}
+
+// FetchBlockBytesBySha appends the serialized block with the given hash to
+// buf[:0] and returns the result.  Blocks stored in flat files are read straight
+// into the buffer.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha)
+	defer op.Done()
+	db.readLock()
+	op.Locked()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	height, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	_, buf, err = db.readBlkByHeight(height, buf[:0])
+	return buf, err
+}
+
 // FetchBlockHeightBySha returns the block height for the given hash.  This is
 // part of the btcdb.Db interface implementation.
 func (db *LevelDb) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return 0, btcdb.ErrDbClosed
+	}
 
 	return db.getBlkLoc(sha)
 }
 
 // FetchBlockHeaderBySha - return a btcwire ShaHash
 func (db *LevelDb) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (bh *btcwire.BlockHeader, err error) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, sha)
+	defer op.Done()
+	db.readLock()
+	op.Locked()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
 
-	// Read the raw block from the database.
-	buf, _, err := db.fetchSha(sha)
+	height, err := db.getBlkLoc(sha)
 	if err != nil {
 		return nil, err
 	}
+	return db.fetchHeaderByHeight(height)
+}
 
-	// Only deserialize the header portion and ensure the transaction count
-	// is zero since this is a standalone header.
-	var blockHeader btcwire.BlockHeader
-	err = blockHeader.Deserialize(bytes.NewBuffer(buf))
-	if err != nil {
+// FetchBlockHeaderByHeight returns the block header at the given height in the
+// main chain.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) FetchBlockHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, height)
+	defer op.Done()
+	db.readLock()
+	op.Locked()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	return db.fetchHeaderByHeight(height)
+}
+
+// FetchHeaderRange returns the block headers from the start height up to but
+// not including the end height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return db.FetchHeaderRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeaderRangeCtx returns the block headers from the start height up to but
+// not including the end height unless the passed context is done first.  This
+// is part of the btcdb.Db interface implementation.
+func (db *LevelDb) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	if err := btcdb.LockContext(ctx, db.dbLock.RLocker()); err != nil {
 		return nil, err
 	}
-	bh = &blockHeader
+	defer db.dbLock.RUnlock()
 
-	return bh, err
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	// Fetch as many as are available within the specified range.
+	if endHeight > db.lastBlkIdx+1 {
+		endHeight = db.lastBlkIdx + 1
+	}
+	if endHeight < startHeight {
+		endHeight = startHeight
+	}
+
+	headers := make([]btcwire.BlockHeader, 0, endHeight-startHeight)
+	for height := startHeight; height < endHeight; height++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		bh, err := db.fetchHeaderByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, *bh)
+	}
+	return headers, nil
 }
 
 func (db *LevelDb) getBlkLoc(sha *btcwire.ShaHash) (int64, error) {
 	var blkHeight int64
 
-	key := shaBlkToKey(sha)
+	if height, ok := db.hdrCache.lookupHeight(sha); ok {
+		return height, nil
+	}
 
-	data, err := db.lDb.Get(key, db.ro)
+	key := shaBlkToKey(sha)
 
+	data, err := db.get(key)
+	if err == leveldb.ErrNotFound {
+		return 0, btcdb.ErrBlockNotFound
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -86,36 +270,102 @@ func (db *LevelDb) getBlkLoc(sha *btcwire.ShaHash) (int64, error) {
 	err = binary.Read(dr, binary.LittleEndian, &blkHeight)
 	if err != nil {
 		log.Tracef("get getBlkLoc len %v\n", len(data))
-		err = fmt.Errorf("Db Corrupt 0")
+		err = btcdb.ErrCorruption
 		return 0, err
 	}
+	db.hdrCache.add(blkHeight, sha, nil)
+	db.locCache.add(sha, blkHeight)
 	return blkHeight, nil
 }
 
 func (db *LevelDb) getBlkByHeight(blkHeight int64) (rsha *btcwire.ShaHash, rbuf []byte, err error) {
-	var blkVal []byte
+	return db.readBlkByHeight(blkHeight, nil)
+}
 
-	key := int64ToKey(blkHeight)
+// readBlkByHeight returns the hash of the block at the given height along with
+// the block read into buf, growing it as needed, or into a new slice when buf
+// is nil.
+// Must be called with db read lock held.
+func (db *LevelDb) readBlkByHeight(blkHeight int64, buf []byte) (*btcwire.ShaHash, []byte, error) {
+	if db.headersOnly {
+		return nil, nil, btcdb.ErrHeadersOnly
+	}
+	if blkHeight < db.pruneHeight {
+		return nil, nil, btcdb.ErrPruned
+	}
 
-	blkVal, err = db.lDb.Get(key, db.ro)
-	if err != nil {
+	if db.blkFiles != nil {
+		sha, loc, err := db.getBlkLocByHeight(blkHeight)
+		if err != nil {
+			return nil, nil, err
+		}
+		buf, err = db.blkFiles.readBlockInto(buf, loc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if db.checksums {
+			err := verifyChecksum(heightBlkToKey(blkHeight), buf,
+				loc.checksum)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return sha, buf, nil
+	}
+
+	key := heightBlkToKey(blkHeight)
+
+	blkVal, err := db.get(key)
+	if err == leveldb.ErrNotFound {
 		log.Tracef("failed to find height %v", blkHeight)
-		return // exists ???
+		return nil, nil, btcdb.ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(blkVal) < btcwire.HashSize {
+		return nil, nil, btcdb.ErrCorruption
 	}
 
 	var sha btcwire.ShaHash
 
 	sha.SetBytes(blkVal[0:32])
 
-	blockdata := make([]byte, len(blkVal[32:]))
-	copy(blockdata[:], blkVal[32:])
+	raw := blkVal[32:]
+	if db.checksums {
+		raw, err = splitChecksum(key, raw)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	raw, err = db.decodeBlock(key, blkHeight, raw)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return &sha, blockdata, nil
+	// Values read from the database itself are already a copy which may be
+	// handed out, while those read through a snapshot must not be
+	// modified.
+	if buf == nil && db.snap == nil {
+		return &sha, raw, nil
+	}
+	return &sha, append(buf[:0], raw...), nil
 }
 
 func (db *LevelDb) getBlk(sha *btcwire.ShaHash) (rblkHeight int64, rbuf []byte, err error) {
 	var blkHeight int64
 
+	// Blocks whose height is remembered are read with a single lookup,
+	// which only counts when the block at the height is still the one
+	// asked for.  Otherwise the height is looked up as usual.
+	if height, ok := db.locCache.lookup(sha); ok {
+		blkSha, buf, err := db.getBlkByHeight(height)
+		if err == nil && blkSha.IsEqual(sha) {
+			return height, buf, nil
+		}
+	}
+
 	blkHeight, err = db.getBlkLoc(sha)
 	if err != nil {
 		return
@@ -141,7 +391,43 @@ func (db *LevelDb) setBlk(sha *btcwire.ShaHash, blkHeight int64, buf []byte) err
 	}
 	shaKey := shaBlkToKey(sha)
 
-	blkKey := int64ToKey(blkHeight)
+	blkKey := heightBlkToKey(blkHeight)
+
+	if db.headerIndex {
+		if err := db.putHeader(blkHeight, buf); err != nil {
+			return err
+		}
+	}
+
+	// Headers-only databases keep nothing but the hash at the height.
+	if db.headersOnly {
+		buf = nil
+	}
+
+	// The raw block is kept in leveldb alongside its hash unless the
+	// database stores blocks in flat files, in which case only the
+	// location of the block is kept.  Blocks kept in leveldb are
+	// compressed with the codec of the database.  Either way, the checksum
+	// of the stored block is kept with it when the database stores them.
+	if db.blkFiles == nil && !db.headersOnly {
+		var err error
+		buf, err = db.encodeBlock(blkHeight, buf)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case db.blkFiles != nil:
+		loc, err := db.blkFiles.writeBlock(buf)
+		if err != nil {
+			return err
+		}
+		loc.checksum = checksum(buf)
+		buf = formatBlockLoc(loc, db.checksums)
+
+	case db.checksums && !db.headersOnly:
+		buf = putChecksum(buf)
+	}
 
 	shaB := sha.Bytes()
 	blkVal := make([]byte, len(shaB)+len(buf))
@@ -157,20 +443,28 @@ func (db *LevelDb) setBlk(sha *btcwire.ShaHash, blkHeight int64, buf []byte) err
 
 // insertSha stores a block hash and its associated data block with a
 // previous sha of `prevSha'.
-// insertSha shall be called with db lock held
+// insertSha shall be called with db write lock held
 func (db *LevelDb) insertBlockData(sha *btcwire.ShaHash, prevSha *btcwire.ShaHash, buf []byte) (blockid int64, err error) {
 
+	// The parent is usually the current tip, which may only exist in the
+	// pending batch when several blocks are inserted at once.
 	var oBlkHeight int64
-	oBlkHeight, err = db.getBlkLoc(prevSha)
+	if db.lastBlkShaCached && db.lastBlkIdx != -1 &&
+		prevSha.IsEqual(&db.lastBlkSha) {
+
+		oBlkHeight = db.lastBlkIdx
+	} else {
+		oBlkHeight, err = db.getBlkLoc(prevSha)
+	}
 
 	if err != nil {
-		// check current block count
-		// if count != 0  {
-		//	err = btcdb.PrevShaMissing
-		//	return
-		// }
+		// The previous block may only be missing when this is the
+		// first block.
 		oBlkHeight = -1
 		if db.nextBlock != 0 {
+			if err == btcdb.ErrBlockNotFound {
+				err = btcdb.PrevShaMissing
+			}
 			return 0, err
 		}
 	}
@@ -210,20 +504,48 @@ func (db *LevelDb) fetchSha(sha *btcwire.ShaHash) (rbuf []byte,
 // ExistsSha looks up the given block hash
 // returns true if it is present in the database.
 func (db *LevelDb) ExistsSha(sha *btcwire.ShaHash) (exists bool) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return false
+	}
 
 	// not in cache, try database
 	exists = db.blkExistsSha(sha)
 	return
 }
 
+// ExistsShas returns whether or not each of the given block hashes is present
+// in the database.  All of the hashes are looked up under a single acquisition
+// of the db lock.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) ExistsShas(shas []btcwire.ShaHash) []bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	exists := make([]bool, len(shas))
+	if db.closed {
+		return exists
+	}
+
+	for i := range shas {
+		exists[i] = db.blkExistsSha(&shas[i])
+	}
+	return exists
+}
+
 // blkExistsSha looks up the given block hash
 // returns true if it is present in the database.
 // CALLED WITH LOCK HELD
 func (db *LevelDb) blkExistsSha(sha *btcwire.ShaHash) bool {
+	if db.blkMisses.contains(sha) {
+		return false
+	}
 
 	_, err := db.getBlkLoc(sha)
+	if err == btcdb.ErrBlockNotFound {
+		db.blkMisses.add(sha)
+	}
 
 	if err != nil {
 		/*
@@ -238,8 +560,12 @@ func (db *LevelDb) blkExistsSha(sha *btcwire.ShaHash) bool {
 // FetchBlockShaByHeight returns a block hash based on its height in the
 // block chain.
 func (db *LevelDb) FetchBlockShaByHeight(height int64) (sha *btcwire.ShaHash, err error) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
 
 	return db.fetchBlockShaByHeight(height)
 }
@@ -247,16 +573,28 @@ func (db *LevelDb) FetchBlockShaByHeight(height int64) (sha *btcwire.ShaHash, er
 // fetchBlockShaByHeight returns a block hash based on its height in the
 // block chain.
 func (db *LevelDb) fetchBlockShaByHeight(height int64) (rsha *btcwire.ShaHash, err error) {
-	key := int64ToKey(height)
+	if sha := db.hdrCache.lookupSha(height); sha != nil {
+		return sha, nil
+	}
 
-	blkVal, err := db.lDb.Get(key, db.ro)
-	if err != nil {
+	key := heightBlkToKey(height)
+
+	blkVal, err := db.get(key)
+	if err == leveldb.ErrNotFound {
 		log.Tracef("failed to find height %v", height)
-		return // exists ???
+		return nil, btcdb.ErrBlockNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	if len(blkVal) < btcwire.HashSize {
+		return nil, btcdb.ErrCorruption
 	}
 
 	var sha btcwire.ShaHash
-	sha.SetBytes(blkVal[0:32])
+	sha.SetBytes(blkVal[0:btcwire.HashSize])
+	db.hdrCache.add(height, &sha, nil)
 
 	return &sha, nil
 }
@@ -266,22 +604,42 @@ func (db *LevelDb) fetchBlockShaByHeight(height int64) (rsha *btcwire.ShaHash, e
 // ending height. To fetch all hashes from the start height until no
 // more are present, use the special id `AllShas'.
 func (db *LevelDb) FetchHeightRange(startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	return db.FetchHeightRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
 
-	var endidx int64
-	if endHeight == btcdb.AllShas {
-		endidx = startHeight + 500
-	} else {
-		endidx = endHeight
+// FetchHeightRangeCtx looks up a range of blocks by the start and ending
+// heights unless the passed context is done first.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) (rshalist []btcwire.ShaHash, err error) {
+	if err := btcdb.LockContext(ctx, db.dbLock.RLocker()); err != nil {
+		return nil, err
+	}
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	// Fetch as many as are available within the specified range, which
+	// for AllShas is every block from the start height on.
+	endidx := endHeight
+	if endidx > db.lastBlkIdx+1 {
+		endidx = db.lastBlkIdx + 1
+	}
+	if endidx < startHeight {
+		endidx = startHeight
 	}
 
 	shalist := make([]btcwire.ShaHash, 0, endidx-startHeight)
 	for height := startHeight; height < endidx; height++ {
 		// TODO(drahn) fix blkFile from height
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-		key := int64ToKey(height)
-		blkVal, lerr := db.lDb.Get(key, db.ro)
+		key := heightBlkToKey(height)
+		blkVal, lerr := db.get(key)
 		if lerr != nil {
 			break
 		}
@@ -296,6 +654,7 @@ func (db *LevelDb) FetchHeightRange(startHeight, endHeight int64) (rshalist []bt
 	}
 	//log.Tracef("FetchIdxRange idx %v %v returned %v shas err %v", startHeight, endHeight, len(shalist), err)
 
+	db.readAhead.Listed(startHeight, startHeight+int64(len(shalist)))
 	return shalist, nil
 }
 
@@ -303,8 +662,12 @@ func (db *LevelDb) FetchHeightRange(startHeight, endHeight int64) (rshalist []bt
 // the block chain.  It will return the zero hash, -1 for the block height, and
 // no error (nil) if there are not any blocks in the database yet.
 func (db *LevelDb) NewestSha() (rsha *btcwire.ShaHash, rblkid int64, err error) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, 0, btcdb.ErrDbClosed
+	}
 
 	if db.lastBlkIdx == -1 {
 		return &btcwire.ShaHash{}, -1, nil
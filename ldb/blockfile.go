@@ -0,0 +1,504 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// blkFileKey is the key used to record that the raw blocks of the database are
+// stored in flat files instead of leveldb.  Its value is the maximum size of a
+// single block file.
+var blkFileKey = settingKey("blockfiles")
+
+const (
+	// DefaultBlockFileSize is the maximum size of a single flat block
+	// file used when none is specified.
+	DefaultBlockFileSize = 128 * 1024 * 1024 // 128 MB
+
+	// BlockFileSizeOption is the key of the btcdb.Options Backend setting
+	// which holds the maximum size of a flat block file.
+	BlockFileSizeOption = "blockfilesize"
+
+	// blkFileDir is the name of the directory inside the database
+	// directory which holds the flat block files.
+	blkFileDir = "blocks"
+
+	// maxOpenBlkFiles is the maximum number of block files kept open for
+	// reading.
+	maxOpenBlkFiles = 25
+
+	// blkLocLen is the length of a serialized block location.
+	blkLocLen = 12
+)
+
+var ffSelf = btcdb.DriverDB{DbType: "ffldb", CreateDB: CreateFlatFileDB, OpenDB: OpenDB}
+
+func init() {
+	btcdb.AddDBDriver(ffSelf)
+}
+
+// blockLoc identifies the location of a raw block within the flat files.
+type blockLoc struct {
+	fileNum uint32
+	offset  uint32
+	length  uint32
+
+	// checksum is the checksum of the block when the database stores
+	// them.
+	checksum uint32
+}
+
+// blockFiles houses the state for reading and writing raw blocks to
+// append-only flat files.
+type blockFiles struct {
+	dir         string
+	maxFileSize int64
+
+	// writeFile is the file blocks are currently appended to and writeLoc
+	// is the file number and offset of the next write.  commitLoc is the
+	// write position as of the last committed batch.
+	writeFile *os.File
+	writeLoc  blockLoc
+	commitLoc blockLoc
+
+	// readFiles caches the files open for reading.  readLock protects it
+	// since blocks are read by concurrent readers of the database and by
+	// its snapshots.
+	readLock  sync.RWMutex
+	readFiles map[uint32]blockFileReader
+
+	// cold is the cold tier old block files are moved to when storage is
+	// tiered, nil when it is not.  tierLock serializes the moves and
+	// nextHot is the number of the first file which may still be on the
+	// hot path, which is also protected by the db lock.
+	cold     ColdStore
+	tierLock sync.Mutex
+	nextHot  uint32
+}
+
+// blockFileReader is a block file open for reading from either tier.
+type blockFileReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// formatBlockLoc serializes a block location, followed by the checksum of the
+// block when withSum is set.
+func formatBlockLoc(loc blockLoc, withSum bool) []byte {
+	n := blkLocLen
+	if withSum {
+		n += checksumLen
+	}
+	buf := make([]byte, n)
+	binary.LittleEndian.PutUint32(buf[0:], loc.fileNum)
+	binary.LittleEndian.PutUint32(buf[4:], loc.offset)
+	binary.LittleEndian.PutUint32(buf[8:], loc.length)
+	if withSum {
+		binary.LittleEndian.PutUint32(buf[blkLocLen:], loc.checksum)
+	}
+	return buf
+}
+
+// parseBlockLoc deserializes a block location, which is followed by the
+// checksum of the block when withSum is set.
+func parseBlockLoc(buf []byte, withSum bool) (blockLoc, error) {
+	n := blkLocLen
+	if withSum {
+		n += checksumLen
+	}
+	if len(buf) != n {
+		return blockLoc{}, btcdb.ErrCorruption
+	}
+	loc := blockLoc{
+		fileNum: binary.LittleEndian.Uint32(buf[0:]),
+		offset:  binary.LittleEndian.Uint32(buf[4:]),
+		length:  binary.LittleEndian.Uint32(buf[8:]),
+	}
+	if withSum {
+		loc.checksum = binary.LittleEndian.Uint32(buf[blkLocLen:])
+	}
+	return loc, nil
+}
+
+// blockFilePath returns the path of the flat block file with the given number.
+func (bf *blockFiles) blockFilePath(fileNum uint32) string {
+	return filepath.Join(bf.dir, blockFileName(fileNum))
+}
+
+// writeBlock appends the passed raw block to the current block file, moving on
+// to a new file when the block would push the current one over the maximum
+// file size.  The returned location is only durable once the batch which
+// references it is committed.
+func (bf *blockFiles) writeBlock(buf []byte) (blockLoc, error) {
+	if bf.writeLoc.offset != 0 &&
+		int64(bf.writeLoc.offset)+int64(len(buf)) > bf.maxFileSize {
+
+		// The finished file is flushed since only the current one
+		// is synced along with the batches.
+		if err := bf.writeFile.Sync(); err != nil {
+			return blockLoc{}, err
+		}
+		if err := bf.writeFile.Close(); err != nil {
+			return blockLoc{}, err
+		}
+		bf.writeFile = nil
+		next := blockLoc{fileNum: bf.writeLoc.fileNum + 1}
+		file, err := os.OpenFile(bf.blockFilePath(next.fileNum),
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+		if err != nil {
+			return blockLoc{}, err
+		}
+		bf.writeFile = file
+		bf.writeLoc = next
+	}
+
+	loc := bf.writeLoc
+	loc.length = uint32(len(buf))
+	_, err := bf.writeFile.WriteAt(buf, int64(loc.offset))
+	if err != nil {
+		return blockLoc{}, err
+	}
+	bf.writeLoc.offset += loc.length
+	return loc, nil
+}
+
+// readRegion reads length bytes starting at offset within the block at the
+// passed location.
+func (bf *blockFiles) readRegion(loc blockLoc, offset, length int) ([]byte, error) {
+	return bf.readRegionInto(nil, loc, offset, length)
+}
+
+// readRegionInto reads length bytes starting at offset within the block at the
+// passed location into buf, which is only replaced by a new slice when it does
+// not have room for them.
+func (bf *blockFiles) readRegionInto(buf []byte, loc blockLoc, offset, length int) ([]byte, error) {
+	if offset < 0 || length < 0 || offset+length > int(loc.length) {
+		return nil, btcdb.ErrInvalidRegion
+	}
+	if cap(buf) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+
+	// Files are only closed with the exclusive lock held, so reads from an
+	// already open file only need the shared lock.
+	bf.readLock.RLock()
+	file, ok := bf.readFiles[loc.fileNum]
+	if ok {
+		_, err := file.ReadAt(buf, int64(loc.offset)+int64(offset))
+		bf.readLock.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	bf.readLock.RUnlock()
+
+	bf.readLock.Lock()
+	defer bf.readLock.Unlock()
+	file, ok = bf.readFiles[loc.fileNum]
+	if !ok {
+		var err error
+		file, err = bf.openBlockFile(loc.fileNum)
+		if err != nil {
+			return nil, err
+		}
+		if len(bf.readFiles) >= maxOpenBlkFiles {
+			bf.closeReadFiles()
+		}
+		bf.readFiles[loc.fileNum] = file
+	}
+
+	_, err := file.ReadAt(buf, int64(loc.offset)+int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readBlock reads the entire raw block at the passed location.
+func (bf *blockFiles) readBlock(loc blockLoc) ([]byte, error) {
+	return bf.readRegion(loc, 0, int(loc.length))
+}
+
+// readBlockInto reads the whole block at the passed location into buf, which
+// is only replaced by a new slice when it does not have room for the block.
+func (bf *blockFiles) readBlockInto(buf []byte, loc blockLoc) ([]byte, error) {
+	return bf.readRegionInto(buf, loc, 0, int(loc.length))
+}
+
+// truncate discards all block data from the passed location onward, including
+// any later block files, and makes the location the new write position.
+func (bf *blockFiles) truncate(loc blockLoc) error {
+	bf.readLock.Lock()
+	bf.closeReadFiles()
+	bf.readLock.Unlock()
+	if bf.writeFile != nil {
+		bf.writeFile.Close()
+		bf.writeFile = nil
+	}
+
+	for fileNum := loc.fileNum + 1; ; fileNum++ {
+		removed, err := bf.removeBlockFile(fileNum)
+		if err != nil {
+			return err
+		}
+		if removed < 0 {
+			break
+		}
+	}
+
+	// The file written to must be on the hot path, which only takes a
+	// move when blocks are dropped back into a file moved to the cold
+	// path.
+	if err := bf.promote(loc.fileNum); err != nil {
+		return err
+	}
+	bf.nextHot = 0
+
+	file, err := os.OpenFile(bf.blockFilePath(loc.fileNum),
+		os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(loc.offset)); err != nil {
+		file.Close()
+		return err
+	}
+	bf.writeFile = file
+	bf.writeLoc = blockLoc{fileNum: loc.fileNum, offset: loc.offset}
+	bf.commitLoc = bf.writeLoc
+	return nil
+}
+
+// sync flushes the block data written to the current block file to disk.
+func (bf *blockFiles) sync() error {
+	if bf.writeFile == nil {
+		return nil
+	}
+	return bf.writeFile.Sync()
+}
+
+// commit records the current write position as committed.
+func (bf *blockFiles) commit() {
+	bf.commitLoc = bf.writeLoc
+}
+
+// rollback discards any block data written since the last commit.
+func (bf *blockFiles) rollback() error {
+	if bf.writeLoc == bf.commitLoc {
+		return nil
+	}
+	return bf.truncate(bf.commitLoc)
+}
+
+// closeReadFiles closes all files open for reading.  The read lock must be held
+// exclusively.
+func (bf *blockFiles) closeReadFiles() {
+	for fileNum, file := range bf.readFiles {
+		file.Close()
+		delete(bf.readFiles, fileNum)
+	}
+}
+
+// close closes all open block files.
+func (bf *blockFiles) close() {
+	bf.readLock.Lock()
+	bf.closeReadFiles()
+	bf.readLock.Unlock()
+	if bf.writeFile != nil {
+		bf.writeFile.Sync()
+		bf.writeFile.Close()
+		bf.writeFile = nil
+	}
+}
+
+// loadBlockFileSetting reads whether raw blocks are stored in flat files from
+// the database and prepares the block files for use.  The write position is
+// established by initBlockFiles once the last block is known.
+func (db *LevelDb) loadBlockFileSetting(dbpath string) error {
+	buf, err := db.get(blkFileKey)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 8 {
+		return btcdb.ErrCorruption
+	}
+	return db.setupBlockFiles(dbpath, int64(binary.LittleEndian.Uint64(buf)))
+}
+
+// setupBlockFiles creates the flat block file state for the database.
+func (db *LevelDb) setupBlockFiles(dbpath string, maxFileSize int64) error {
+	dir := filepath.Join(dbpath, blkFileDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	db.blkFiles = &blockFiles{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		readFiles:   make(map[uint32]blockFileReader),
+		cold:        db.coldStore,
+	}
+	return nil
+}
+
+// initBlockFiles positions the block files for writing just after the last
+// block in the database.  Any data beyond it, such as that left behind by a
+// crash before the batch referencing it was committed, is discarded.
+// Must be called with db write lock held.
+func (db *LevelDb) initBlockFiles() error {
+	var end blockLoc
+	if db.lastBlkIdx != -1 {
+		_, loc, err := db.getBlkLocByHeight(db.lastBlkIdx)
+		if err != nil {
+			return err
+		}
+		end = blockLoc{fileNum: loc.fileNum, offset: loc.offset + loc.length}
+	}
+	return db.blkFiles.truncate(end)
+}
+
+// getBlkLocByHeight returns the hash and flat file location of the block at
+// the given height.
+// Must be called with db read lock held.
+func (db *LevelDb) getBlkLocByHeight(blkHeight int64) (*btcwire.ShaHash, blockLoc, error) {
+	blkVal, err := db.get(heightBlkToKey(blkHeight))
+	if err == leveldb.ErrNotFound {
+		return nil, blockLoc{}, btcdb.ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, blockLoc{}, err
+	}
+	if len(blkVal) < btcwire.HashSize {
+		return nil, blockLoc{}, btcdb.ErrCorruption
+	}
+
+	var sha btcwire.ShaHash
+	sha.SetBytes(blkVal[0:btcwire.HashSize])
+	loc, err := parseBlockLoc(blkVal[btcwire.HashSize:], db.checksums)
+	if err != nil {
+		return nil, blockLoc{}, err
+	}
+	return &sha, loc, nil
+}
+
+// parseFlatFileArgs parses the arguments from the btcdb Create method for the
+// flat file database type.  The database path may optionally be followed by
+// the maximum size of a block file in bytes.  Alternatively, a btcdb.Options
+// may be passed with the maximum size in its BlockFileSizeOption setting.
+func parseFlatFileArgs(funcName string, args ...interface{}) (*btcdb.Options, int64, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, 0, fmt.Errorf("Invalid arguments to ldb.%s -- "+
+			"expected database path string and optional maximum "+
+			"block file size", funcName)
+	}
+
+	var dbOpts *btcdb.Options
+	var sizeArg interface{}
+	switch arg := args[0].(type) {
+	case string:
+		dbOpts = &btcdb.Options{Path: arg}
+		if len(args) == 2 {
+			sizeArg = args[1]
+		}
+	case btcdb.Options:
+		if len(args) == 2 {
+			return nil, 0, fmt.Errorf("Invalid arguments to ldb.%s "+
+				"-- unexpected argument after options", funcName)
+		}
+		dbOpts = &arg
+		sizeArg = arg.Backend[BlockFileSizeOption]
+	default:
+		return nil, 0, fmt.Errorf("First argument to ldb.%s is invalid "+
+			"-- expected database path string or options", funcName)
+	}
+
+	maxFileSize := int64(DefaultBlockFileSize)
+	if sizeArg != nil {
+		switch size := sizeArg.(type) {
+		case int:
+			maxFileSize = int64(size)
+		case int64:
+			maxFileSize = size
+		default:
+			return nil, 0, fmt.Errorf("Maximum block file size "+
+				"argument to ldb.%s is invalid -- expected "+
+				"integer", funcName)
+		}
+		if maxFileSize <= 0 || maxFileSize > math.MaxUint32 {
+			return nil, 0, fmt.Errorf("maximum block file size %d "+
+				"is out of range", maxFileSize)
+		}
+	}
+	return dbOpts, maxFileSize, nil
+}
+
+// CreateFlatFileDB creates, initializes and opens a database for use which
+// stores raw blocks in append-only flat files rather than in leveldb.  Only
+// the location of each block along with the usual indexes is kept in leveldb.
+// The database path may optionally be followed by the maximum size in bytes
+// of a block file, which defaults to DefaultBlockFileSize.
+//
+// Since the storage mode is recorded in the database, it is opened with the
+// same OpenDB as a regular leveldb database.
+func CreateFlatFileDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, maxFileSize, err := parseFlatFileArgs("CreateFlatFileDB",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	headersOnly, err := parseHeadersOnly("CreateFlatFileDB", dbOpts)
+	if err != nil {
+		return nil, err
+	}
+	if headersOnly {
+		return nil, fmt.Errorf("ldb.CreateFlatFileDB can not create a " +
+			"headers-only database -- there are no blocks to store " +
+			"in flat files")
+	}
+	if _, ok := dbOpts.Backend[EncryptionKeyOption]; ok {
+		return nil, fmt.Errorf("ldb.CreateFlatFileDB can not encrypt " +
+			"blocks -- blocks stored in flat files are not encrypted")
+	}
+	if _, ok := dbOpts.Backend[CompressionOption]; ok {
+		return nil, fmt.Errorf("ldb.CreateFlatFileDB can not compress " +
+			"blocks -- blocks stored in flat files are not compressed")
+	}
+
+	ldb, err := createDB(dbOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sizeBuf [8]byte
+	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(maxFileSize))
+	err = ldb.put(blkFileKey, sizeBuf[:])
+	if err == nil {
+		err = ldb.setupBlockFiles(dbOpts.Path, maxFileSize)
+	}
+	if err == nil {
+		err = ldb.initBlockFiles()
+	}
+	if err != nil {
+		ldb.close()
+		return nil, err
+	}
+	ldb.startSyncer(dbOpts)
+	return ldb, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBlockFiles ensures blocks stored in flat files roll over to new files
+// once the maximum file size is reached, that dropped blocks are removed from
+// the files, and that the files are picked up again when the database is
+// reopened.
+func TestBlockFiles(t *testing.T) {
+	dbname := "tstdbblkfiles"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("ffldb", dbname, 16*1024)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+	for height, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block %v: %v", height, err)
+			db.Close()
+			return
+		}
+	}
+
+	blkFile := func(name string) string {
+		return filepath.Join(dbname, "blocks", name)
+	}
+	if _, err := os.Stat(blkFile("blk00001.dat")); err != nil {
+		t.Errorf("block files did not roll over: %v", err)
+	}
+
+	keepHeight := 10
+	keepSha, _ := blocks[keepHeight].Sha()
+	if err := db.DropAfterBlockBySha(keepSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		db.Close()
+		return
+	}
+	if _, err := os.Stat(blkFile("blk00001.dat")); !os.IsNotExist(err) {
+		t.Errorf("block file of dropped blocks not removed: %v", err)
+	}
+	db.Close()
+
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to reopen test database %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, height, err := db.NewestSha()
+	if err != nil || height != int64(keepHeight) {
+		t.Errorf("NewestSha: got height %d, want %d (err %v)", height,
+			keepHeight, err)
+		return
+	}
+
+	// The dropped blocks must insert again and every block must read back
+	// the same as it was inserted.
+	for i := keepHeight + 1; i < len(blocks); i++ {
+		if _, err := db.InsertBlock(blocks[i]); err != nil {
+			t.Errorf("failed to reinsert block %v: %v", i, err)
+			return
+		}
+	}
+	for i, block := range blocks {
+		sha, _ := block.Sha()
+		blk, err := db.FetchBlockBySha(sha)
+		if err != nil {
+			t.Errorf("FetchBlockBySha: block %v: %v", i, err)
+			return
+		}
+		got, _ := blk.Bytes()
+		want, _ := block.Bytes()
+		if !bytes.Equal(got, want) {
+			t.Errorf("FetchBlockBySha: block %v does not match", i)
+			return
+		}
+
+		for _, tx := range block.Transactions() {
+			replies, err := db.FetchTxBySha(tx.Sha())
+			if err != nil {
+				t.Errorf("FetchTxBySha: tx %v: %v", tx.Sha(), err)
+				return
+			}
+			gotSha, _ := replies[len(replies)-1].Tx.TxSha()
+			if !gotSha.IsEqual(tx.Sha()) {
+				t.Errorf("FetchTxBySha: got tx %v, want %v",
+					&gotSha, tx.Sha())
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/goleveldb/leveldb"
+	"hash/crc32"
+)
+
+// checksumKey is the key used to record that a checksum is stored with every
+// raw block.  Databases created before
+// checksums were stored do not have it and are read without verification.
+var checksumKey = settingKey("checksums")
+
+// checksumLen is the length of a serialized checksum.
+const checksumLen = 4
+
+// castagnoli is the table of the CRC-32C polynomial used for checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the checksum of the passed data.
+func checksum(buf []byte) uint32 {
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// verifyChecksum returns a btcdb.CorruptionError for the value stored under
+// the given key when the passed data does not match its stored checksum.
+func verifyChecksum(key []byte, buf []byte, sum uint32) error {
+	if checksum(buf) != sum {
+		log.Errorf("Value of key %x failed its checksum", key)
+		return &btcdb.CorruptionError{Key: key}
+	}
+	return nil
+}
+
+// putChecksum returns the passed data prefixed by its checksum.
+func putChecksum(buf []byte) []byte {
+	val := make([]byte, checksumLen+len(buf))
+	binary.LittleEndian.PutUint32(val, checksum(buf))
+	copy(val[checksumLen:], buf)
+	return val
+}
+
+// splitChecksum verifies data prefixed by its checksum, as created by
+// putChecksum, which is stored under the given key and returns the data.
+func splitChecksum(key []byte, val []byte) ([]byte, error) {
+	if len(val) < checksumLen {
+		return nil, &btcdb.CorruptionError{Key: key}
+	}
+	buf := val[checksumLen:]
+	err := verifyChecksum(key, buf, binary.LittleEndian.Uint32(val))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// loadChecksumSetting reads whether values are stored with a checksum.
+func (db *LevelDb) loadChecksumSetting() error {
+	_, err := db.get(checksumKey)
+	switch err {
+	case nil:
+		db.checksums = true
+	case leveldb.ErrNotFound:
+		db.checksums = false
+	default:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"os"
+	"testing"
+)
+
+// TestChecksums ensures blocks which were altered on disk fail their checksums
+// when read, with the offending key reported, for blocks stored both in leveldb
+// and in flat files.
+func TestChecksums(t *testing.T) {
+	for _, dbType := range []string{"leveldb", "ffldb"} {
+		testChecksums(t, dbType)
+	}
+}
+
+func testChecksums(t *testing.T, dbType string) {
+	dbname := "tstdbchecksum"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB(dbType, dbname)
+	if err != nil {
+		t.Errorf("%s: Failed to open test database %v", dbType, err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)[:40]
+	for height, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("%s: failed to insert block %v: %v", dbType,
+				height, err)
+			db.Close()
+			return
+		}
+	}
+
+	const badHeight = 10
+	if err := ldb.CorruptBlock(db, badHeight); err != nil {
+		t.Errorf("%s: CorruptBlock: %v", dbType, err)
+		db.Close()
+		return
+	}
+
+	// The checksums must still be verified once the database is reopened.
+	db.Close()
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("%s: Failed to reopen test database %v", dbType, err)
+		return
+	}
+	defer db.Close()
+
+	badSha, _ := blocks[badHeight].Sha()
+	_, err = db.FetchBlockBySha(badSha)
+	cerr, ok := err.(*btcdb.CorruptionError)
+	if !ok {
+		t.Errorf("%s: FetchBlockBySha of corrupt block: got %v, want "+
+			"CorruptionError", dbType, err)
+	} else if !bytes.Equal(cerr.Key, ldb.BlockKey(badHeight)) {
+		t.Errorf("%s: CorruptionError key: got %x, want %x", dbType,
+			cerr.Key, ldb.BlockKey(badHeight))
+	}
+	if !btcdb.IsCorruption(err) {
+		t.Errorf("%s: IsCorruption(%v) is false", dbType, err)
+	}
+
+	// Reading a transaction of the altered block must fail whether the
+	// whole block is read or only the transaction.
+	_, err = db.FetchTxBySha(blocks[badHeight].Transactions()[0].Sha())
+	if !btcdb.IsCorruption(err) {
+		t.Errorf("%s: FetchTxBySha from corrupt block: got %v, want "+
+			"corruption", dbType, err)
+	}
+
+	goodSha, _ := blocks[badHeight-1].Sha()
+	if _, err := db.FetchBlockBySha(goodSha); err != nil {
+		t.Errorf("%s: FetchBlockBySha of intact block: %v", dbType, err)
+	}
+	err = db.VerifyIntegrity(btcdb.VerifyBlocks, nil)
+	if ierr, ok := err.(*btcdb.IntegrityError); !ok ||
+		ierr.Height != badHeight {
+		t.Errorf("%s: VerifyIntegrity: got %v, want failure at height "+
+			"%d", dbType, err, badHeight)
+	}
+}
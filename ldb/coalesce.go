@@ -0,0 +1,209 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"time"
+)
+
+const (
+	// CoalesceSizeOption is the key of the btcdb.Options Backend setting
+	// which turns on coalescing of InsertBlock calls.  Its value is the
+	// number of bytes of serialized blocks InsertBlock holds before it
+	// inserts them together in a single batch.  Every block is inserted
+	// by its own batch when it is not given.
+	CoalesceSizeOption = "coalescesize"
+
+	// CoalesceIntervalOption is the key of the btcdb.Options Backend
+	// setting which sets the longest time, as a time.Duration, the blocks
+	// held by InsertBlock wait before they are inserted.  It defaults to
+	// defaultCoalesceInterval.
+	CoalesceIntervalOption = "coalesceinterval"
+
+	// defaultCoalesceInterval is the longest time held blocks wait when
+	// the CoalesceIntervalOption setting is not given.
+	defaultCoalesceInterval = time.Second
+)
+
+// parseCoalesce returns the number of bytes of blocks the passed options ask
+// InsertBlock to hold, zero when blocks are not held, and how long they may be
+// held.
+func parseCoalesce(funcName string, dbOpts *btcdb.Options) (int, time.Duration, error) {
+	arg, ok := dbOpts.Backend[CoalesceSizeOption]
+	if !ok {
+		return 0, 0, nil
+	}
+	size, ok := arg.(int)
+	if !ok || size <= 0 {
+		return 0, 0, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected positive integer", CoalesceSizeOption, funcName)
+	}
+
+	interval := defaultCoalesceInterval
+	if arg, ok := dbOpts.Backend[CoalesceIntervalOption]; ok {
+		interval, ok = arg.(time.Duration)
+		if !ok || interval <= 0 {
+			return 0, 0, fmt.Errorf("%s setting to ldb.%s is "+
+				"invalid -- expected positive time.Duration",
+				CoalesceIntervalOption, funcName)
+		}
+	}
+	return size, interval, nil
+}
+
+// Flush inserts the blocks held by InsertBlock when coalescing is turned on
+// with the CoalesceSizeOption setting.  It returns the error of the first held
+// block which failed to insert since the last call to Flush or InsertBlock, in
+// which case the blocks held before it are inserted and the others discarded.
+func (db *LevelDb) Flush() error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	db.flush()
+	return db.takeHeldErr()
+}
+
+// flushHeld is run at the coalescing interval to insert the blocks held by
+// InsertBlock.
+func (db *LevelDb) flushHeld() {
+	if err := db.Flush(); err != nil && err != btcdb.ErrDbClosed {
+		log.Warnf("Unable to insert held blocks: %v", err)
+	}
+}
+
+// holdBlock holds the passed block to be inserted along with those inserted
+// after it when it extends the chain, and inserts the held blocks once they
+// reach the coalescing size.  Any other block is inserted at once after the
+// held ones.  It returns the height the block is inserted at.
+// Must be called with db write lock held.
+func (db *LevelDb) holdBlock(block *btcutil.Block) (int64, error) {
+	// Report a failure of the blocks held before this one first since
+	// the chain no longer includes them.
+	if err := db.takeHeldErr(); err != nil {
+		return 0, err
+	}
+	extends, err := db.extendsHeld(block)
+	if err != nil {
+		return 0, err
+	}
+	if !extends {
+		db.flush()
+		if err := db.takeHeldErr(); err != nil {
+			return 0, err
+		}
+		heights, err := db.insertBlocks([]*btcutil.Block{block}, nil)
+		if err != nil {
+			return 0, err
+		}
+		return heights[0], nil
+	}
+
+	// Validate the block now so a block which can never be inserted is
+	// refused by its own call.
+	raw, err := block.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	tipSha := &block.MsgBlock().Header.PrevBlock
+	if err := btcdb.CheckBlock(block, db.opts.Validation, tipSha); err != nil {
+		return 0, err
+	}
+	height := db.nextBlock + int64(len(db.held))
+	db.held = append(db.held, block)
+	db.heldSize += len(raw)
+	if db.heldSize >= db.coalesceSize {
+		db.flush()
+		if err := db.takeHeldErr(); err != nil {
+			return 0, err
+		}
+	}
+	return height, nil
+}
+
+// extendsHeld returns whether the passed block extends the last held block, or
+// the chain tip when no blocks are held.
+// Must be called with db write lock held.
+func (db *LevelDb) extendsHeld(block *btcutil.Block) (bool, error) {
+	prevSha := &block.MsgBlock().Header.PrevBlock
+	if len(db.held) != 0 {
+		sha, err := db.held[len(db.held)-1].Sha()
+		if err != nil {
+			return false, err
+		}
+		return prevSha.IsEqual(sha), nil
+	}
+
+	// The genesis block is inserted at once.
+	if db.nextBlock == 0 {
+		return false, nil
+	}
+	sha, err := db.fetchBlockShaByHeight(db.nextBlock - 1)
+	if err != nil {
+		return false, err
+	}
+	return prevSha.IsEqual(sha), nil
+}
+
+// flush inserts the held blocks in a single batch.  When the batch fails, the
+// blocks are inserted one at a time so those before the failing block are
+// kept, and the error is kept to be returned by the next call to Flush or
+// InsertBlock rather than failing the unrelated call which flushed them.
+// Must be called with db write lock held.
+func (db *LevelDb) flush() {
+	if len(db.held) == 0 {
+		return
+	}
+	blocks := db.held
+	db.held = nil
+	db.heldSize = 0
+
+	if _, err := db.insertBlocks(blocks, nil); err == nil {
+		return
+	}
+	for i, block := range blocks {
+		_, err := db.insertBlocks([]*btcutil.Block{block}, nil)
+		if err != nil {
+			log.Warnf("Discarding %d held blocks: %v", len(blocks)-i,
+				err)
+			if db.heldErr == nil {
+				db.heldErr = err
+			}
+			return
+		}
+	}
+}
+
+// takeHeldErr returns the error of the first held block which failed to
+// insert since it was last called, if any.
+// Must be called with db write lock held.
+func (db *LevelDb) takeHeldErr() error {
+	err := db.heldErr
+	db.heldErr = nil
+	return err
+}
+
+// readLock takes the db read lock once the blocks held by InsertBlock are
+// inserted, so reads see every block whose insert returned.  Blocks held by
+// inserts made after readLock is called may still be held.
+func (db *LevelDb) readLock() {
+	db.dbLock.RLock()
+	if len(db.held) == 0 {
+		return
+	}
+	db.dbLock.RUnlock()
+
+	db.dbLock.Lock()
+	if !db.closed {
+		db.flush()
+	}
+	db.dbLock.Unlock()
+	db.dbLock.RLock()
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+	"time"
+)
+
+// checkTip ensures the newest block of the passed database is at the given
+// height.
+func checkTip(t *testing.T, db btcdb.Db, want int64) {
+	_, height, err := db.NewestSha()
+	if err != nil || height != want {
+		t.Errorf("NewestSha: got height %d (err %v), want %d", height,
+			err, want)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	dbname := "tstdbcoalesce"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+	if len(blocks) < 250 {
+		t.Errorf("not enough test blocks")
+		return
+	}
+
+	// The blocks are held until blocks 1 through 100 are.
+	var size int
+	for _, block := range blocks[1:101] {
+		raw, _ := block.Bytes()
+		size += len(raw)
+	}
+	opts := btcdb.Options{
+		Path: dbname,
+		Backend: map[string]interface{}{
+			ldb.CoalesceSizeOption:     size,
+			ldb.CoalesceIntervalOption: time.Hour,
+		},
+	}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for i, block := range blocks[:100] {
+		height, err := db.InsertBlock(block)
+		if err != nil || height != int64(i) {
+			t.Errorf("InsertBlock: got height %d (err %v), want %d",
+				height, err, i)
+			db.Close()
+			return
+		}
+	}
+
+	// Reads see the held blocks.
+	sha, _ := blocks[50].Sha()
+	if got, err := db.FetchBlockShaByHeight(50); err != nil || !got.IsEqual(sha) {
+		t.Errorf("FetchBlockShaByHeight: got %v (err %v), want %v", got,
+			err, sha)
+	}
+	if _, err := db.FetchBlockBySha(sha); err != nil {
+		t.Errorf("FetchBlockBySha: %v", err)
+	}
+	txSha, _ := blocks[99].TxSha(0)
+	if txs, err := db.FetchTxBySha(txSha); err != nil || len(txs) != 1 {
+		t.Errorf("FetchTxBySha: got %d transactions (err %v), want 1",
+			len(txs), err)
+	}
+	if _, err := db.InsertBlock(blocks[100]); err != nil {
+		t.Errorf("InsertBlock: %v", err)
+	}
+	sha, _ = blocks[100].Sha()
+	if !db.ExistsSha(sha) {
+		t.Errorf("ExistsSha: held block is missing")
+	}
+	checkTip(t, db, 100)
+
+	for _, block := range blocks[101:170] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+
+	// A block spending a missing transaction fails once it is inserted,
+	// which keeps the blocks held before it.  The read which inserts it
+	// succeeds and the error is returned by the next InsertBlock.
+	raw, _ := blocks[170].Bytes()
+	bad, _ := btcutil.NewBlockFromBytes(raw)
+	msgBlock := bad.MsgBlock()
+	msgBlock.Transactions[1].TxIn[0].PreviousOutpoint.Hash = btcwire.ShaHash{}
+	if _, err := db.InsertBlock(btcutil.NewBlock(msgBlock)); err != nil {
+		t.Errorf("InsertBlock: %v", err)
+	}
+	checkTip(t, db, 169)
+	if _, err := db.InsertBlock(blocks[170]); err == nil {
+		t.Errorf("InsertBlock: held block error is not returned")
+	}
+	if err := db.(*ldb.LevelDb).Flush(); err != nil {
+		t.Errorf("Flush: error returned twice: %v", err)
+	}
+
+	for _, block := range blocks[170:180] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	if err := db.(*ldb.LevelDb).Flush(); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	checkTip(t, db, 179)
+
+	// Closing the database inserts the held blocks.
+	for _, block := range blocks[180:200] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	db.Close()
+
+	opts.Backend[ldb.CoalesceIntervalOption] = 10 * time.Millisecond
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	checkTip(t, db, 199)
+
+	// Held blocks are inserted once the interval passed.
+	for _, block := range blocks[200:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	want := int64(len(blocks) - 1)
+	for i := 0; i < 500; i++ {
+		if _, height, _ := db.NewestSha(); height == want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkTip(t, db, want)
+
+	// A block failing validation is refused by its own InsertBlock.
+	db.Close()
+	opts.Validation = btcdb.ValidateSanity
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	tipSha, _ := blocks[len(blocks)-1].Sha()
+	fake := *blocks[len(blocks)-1].MsgBlock()
+	fake.Header.PrevBlock = *tipSha
+	fake.Header.MerkleRoot = btcwire.ShaHash{}
+	if _, err := db.InsertBlock(btcutil.NewBlock(&fake)); err == nil {
+		t.Errorf("InsertBlock: unexpected success with invalid block")
+	}
+	checkTip(t, db, want)
+
+	opts.Backend[ldb.CoalesceSizeOption] = "1MB"
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err == nil {
+		t.Errorf("OpenDBWithOptions: unexpected success with invalid " +
+			"coalescing size")
+	}
+}
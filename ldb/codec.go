@@ -0,0 +1,379 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+//go:generate go run genzstddict.go
+
+// Codec compresses the blocks stored by a database.  Every codec has an ID of
+// its own which is stored in front of each block it compressed, so blocks are
+// decompressed by the codec which compressed them whichever codec the database
+// is opened with.  Codecs other than the built-in ones must be registered with
+// RegisterCodec before a database holding blocks they compressed is read.
+type Codec interface {
+	// ID returns the byte stored in front of the blocks compressed by the
+	// codec.  IDs below MinCodecID are reserved for the built-in codecs.
+	ID() byte
+
+	// Name returns the name the codec is selected by.
+	Name() string
+
+	// Encode returns the compressed form of the passed block.
+	Encode(src []byte) ([]byte, error)
+
+	// Decode returns the block whose compressed form is passed.
+	Decode(src []byte) ([]byte, error)
+}
+
+// The IDs of the built-in codecs.
+const (
+	// NoCodecID marks blocks which are stored as they are.
+	NoCodecID = 0
+
+	// SnappyCodecID marks blocks compressed with snappy.
+	SnappyCodecID = 1
+
+	// DeflateCodecID marks blocks compressed with deflate using the
+	// preset dictionary of common block data.
+	DeflateCodecID = 2
+
+	// ZstdCodecID marks blocks compressed with zstd using the dictionary
+	// trained on blocks of the chain.  It is the codec of new databases.
+	ZstdCodecID = 3
+
+	// MinCodecID is the lowest ID available to codecs registered with
+	// RegisterCodec.
+	MinCodecID = 16
+)
+
+// codecs holds every known codec by ID.
+var (
+	codecsMtx sync.RWMutex
+	codecs    = map[byte]Codec{
+		NoCodecID:      noCodec{},
+		SnappyCodecID:  snappyCodec{},
+		DeflateCodecID: NewDeflateCodec(DeflateCodecID, "deflate", blockDict),
+		ZstdCodecID:    builtinZstdCodec(),
+	}
+)
+
+// RegisterCodec makes the passed codec known, so databases may be opened with
+// it and blocks it compressed can be read.  Registering the same codec again
+// does nothing, while another codec with the ID or name of a known one is an
+// error.
+func RegisterCodec(c Codec) error {
+	if c.ID() < MinCodecID {
+		return fmt.Errorf("codec ID %d is reserved", c.ID())
+	}
+
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+
+	for id, known := range codecs {
+		if id != c.ID() && known.Name() == c.Name() {
+			return fmt.Errorf("a codec named %q is already "+
+				"registered", c.Name())
+		}
+	}
+	if known, ok := codecs[c.ID()]; ok {
+		if known.Name() != c.Name() {
+			return fmt.Errorf("codec ID %d is already registered "+
+				"to %q", c.ID(), known.Name())
+		}
+		return nil
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+// codecByID returns the known codec with the given ID, or nil.
+func codecByID(id byte) Codec {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	return codecs[id]
+}
+
+// codecByName returns the known codec with the given name, or nil.
+func codecByName(name string) Codec {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// noCodec stores blocks as they are.
+type noCodec struct{}
+
+func (noCodec) ID() byte                          { return NoCodecID }
+func (noCodec) Name() string                      { return "none" }
+func (noCodec) Encode(src []byte) ([]byte, error) { return src, nil }
+func (noCodec) Decode(src []byte) ([]byte, error) { return src, nil }
+
+// snappyCodec compresses blocks with snappy, which is fast but saves less than
+// deflate.
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte     { return SnappyCodecID }
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// deflateCodec compresses blocks with deflate using a preset dictionary.
+type deflateCodec struct {
+	id      byte
+	name    string
+	dict    []byte
+	writers sync.Pool
+}
+
+// NewDeflateCodec returns a codec with the given ID and name which compresses
+// blocks with deflate using the passed preset dictionary, such as one built by
+// TrainDictionary from blocks of the chain.  Blocks must be read with the same
+// dictionary they were written with, so a codec with another dictionary needs
+// an ID of its own.
+func NewDeflateCodec(id byte, name string, dict []byte) Codec {
+	return &deflateCodec{id: id, name: name, dict: dict}
+}
+
+func (c *deflateCodec) ID() byte     { return c.id }
+func (c *deflateCodec) Name() string { return c.name }
+
+func (c *deflateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		w, err = flate.NewWriterDict(&buf, flate.DefaultCompression,
+			c.dict)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *deflateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(src), c.dict)
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// blockDict is the preset dictionary of the built-in deflate codec.  It holds
+// the parts of transactions which recur across blocks, such as the templates of
+// the common output scripts, the framing of signatures and public keys in input
+// scripts and the usual versions, sequence numbers and amounts, with the most
+// common last since deflate refers to the end of the dictionary most cheaply.
+var blockDict = func() []byte {
+	parts := []string{
+		// Coinbase input spending no previous output.
+		"0000000000000000000000000000000000000000000000000000000000000000ffffffff",
+		// Amounts of block subsidies and round values.
+		"00f2052a01000000", "00f90295000000", "40be402500000000",
+		"0065cd1d00000000", "00e1f50500000000", "80969800",
+		// Pay to public key outputs.
+		"434104", "ac00000000", "232102", "232103",
+		// Pay to script hash outputs.
+		"17a914", "87",
+		// Signatures followed by a public key in input scripts.
+		"8b483045022100", "8a47304402", "6a4730440220", "6b483045022100",
+		"0141", "012102", "012103",
+		// Version, sequence and lock time framing transactions.
+		"01000000", "ffffffff", "feffffff", "0000000001000000",
+		// Pay to public key hash outputs, the most common of all.
+		"88acffffffff", "88ac", "1976a914",
+	}
+	var dict []byte
+	for _, part := range parts {
+		b, err := hex.DecodeString(part)
+		if err != nil {
+			panic("invalid dictionary part in source")
+		}
+		dict = append(dict, b...)
+	}
+	return dict
+}()
+
+// dictGramLen is the length of the substrings TrainDictionary counts.
+const dictGramLen = 8
+
+// TrainDictionary returns a preset dictionary of at most the given size for
+// NewDeflateCodec built from the substrings which recur most often across the
+// passed serialized blocks.  The samples should be a few hundred recent blocks.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	counts := make(map[string]int)
+	for _, sample := range samples {
+		for i := 0; i+dictGramLen <= len(sample); i++ {
+			counts[string(sample[i:i+dictGramLen])]++
+		}
+	}
+
+	type gram struct {
+		s     string
+		count int
+	}
+	grams := make([]gram, 0, len(counts))
+	for s, count := range counts {
+		if count > 1 {
+			grams = append(grams, gram{s, count})
+		}
+	}
+	sort.Slice(grams, func(i, j int) bool {
+		if grams[i].count != grams[j].count {
+			return grams[i].count > grams[j].count
+		}
+		return grams[i].s < grams[j].s
+	})
+	if max := size / dictGramLen; len(grams) > max {
+		grams = grams[:max]
+	}
+
+	// The most common substrings go last, where deflate refers to them
+	// most cheaply.
+	dict := make([]byte, 0, len(grams)*dictGramLen)
+	for i := len(grams) - 1; i >= 0; i-- {
+		dict = append(dict, grams[i].s...)
+	}
+	return dict
+}
+
+// maxDecodedBlockSize is the largest block the zstd codecs decompress, which
+// keeps a corrupted value from claiming an unbounded amount of memory.
+const maxDecodedBlockSize = 32 * 1024 * 1024
+
+// zstdCodec compresses blocks with zstd using a dictionary.  The encoder and
+// decoder are created the first time they are needed, so databases which do
+// not use the codec don't pay for them.
+type zstdCodec struct {
+	id      byte
+	name    string
+	dict    []byte
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+// NewZstdCodec returns a codec with the given ID and name which compresses
+// blocks with zstd using the passed dictionary, such as one built by
+// TrainZstdDictionary from blocks of the chain, or without one when it is nil.
+// Blocks must be read with the same dictionary they were written with, so a
+// codec with another dictionary needs an ID of its own.
+func NewZstdCodec(id byte, name string, dict []byte) (Codec, error) {
+	if dict != nil {
+		if _, err := zstd.InspectDictionary(dict); err != nil {
+			return nil, fmt.Errorf("invalid zstd dictionary: %v", err)
+		}
+	}
+	return &zstdCodec{id: id, name: name, dict: dict}, nil
+}
+
+// builtinZstdCodec returns the built-in zstd codec, which uses the dictionary
+// generated from the blocks of the test chain by genzstddict.go.
+func builtinZstdCodec() Codec {
+	c, err := NewZstdCodec(ZstdCodecID, "zstd", zstdBlockDict)
+	if err != nil {
+		panic("invalid zstd dictionary in source")
+	}
+	return c
+}
+
+// init creates the encoder and decoder of the codec.  Blocks are compressed
+// with the write lock of the database held, so a single encoder is enough,
+// while blocks are decompressed by as many readers as there are processors.
+// The frames carry no checksum of their own since the database already stores
+// one with every block.
+func (c *zstdCodec) init() {
+	eopts := []zstd.EOption{
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(false),
+	}
+	dopts := []zstd.DOption{
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(maxDecodedBlockSize),
+	}
+	if c.dict != nil {
+		eopts = append(eopts, zstd.WithEncoderDict(c.dict))
+		dopts = append(dopts, zstd.WithDecoderDicts(c.dict))
+	}
+	c.encoder, c.err = zstd.NewWriter(nil, eopts...)
+	if c.err == nil {
+		c.decoder, c.err = zstd.NewReader(nil, dopts...)
+	}
+}
+
+func (c *zstdCodec) ID() byte     { return c.id }
+func (c *zstdCodec) Name() string { return c.name }
+
+func (c *zstdCodec) Encode(src []byte) ([]byte, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.encoder.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCodec) Decode(src []byte) ([]byte, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.decoder.DecodeAll(src, nil)
+}
+
+// TrainZstdDictionary returns a dictionary of about the given size for
+// NewZstdCodec built from the passed serialized blocks, which should be a few
+// hundred recent blocks.  Its content is the substrings found by
+// TrainDictionary and its entropy tables are tuned by compressing the samples.
+// The ID of the dictionary is derived from its content.
+func TrainZstdDictionary(samples [][]byte, size int) ([]byte, error) {
+	history := TrainDictionary(samples, size)
+	if len(history) < 8 {
+		return nil, fmt.Errorf("samples hold too few recurring " +
+			"substrings to train a dictionary")
+	}
+
+	// IDs below 32768 and from 2^31 are reserved by zstd.
+	id := 32768 + crc32.ChecksumIEEE(history)%(1<<31-32768)
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/goleveldb/leveldb/util"
+)
+
+// Compact compacts the whole key space of the database, which drops the
+// overwritten and deleted values still held by its tables.  Reads and writes
+// continue meanwhile.
+func (db *LevelDb) Compact() error {
+	db.dbLock.RLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	return db.lDb.CompactRange(util.Range{})
+}
+
+// Stats returns the statistics leveldb keeps about the tables of each level
+// of the database and the compactions run on them.
+func (db *LevelDb) Stats() (string, error) {
+	db.dbLock.RLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return "", btcdb.ErrDbClosed
+	}
+	return db.lDb.GetProperty("leveldb.stats")
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"os"
+	"testing"
+)
+
+// TestCompact ensures a database which had blocks dropped is compacted and
+// keeps the rest of its blocks readable, while read-only opens refuse it.
+func TestCompact(t *testing.T) {
+	dbname := "tstdbcompact"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+	if _, err := db.InsertBlocks(blocks); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		db.Close()
+		return
+	}
+	keepSha, _ := blocks[50].Sha()
+	if err := db.DropAfterBlockBySha(keepSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		db.Close()
+		return
+	}
+
+	if err := db.(*ldb.LevelDb).Compact(); err != nil {
+		t.Errorf("Compact: %v", err)
+	}
+	if _, err := db.(*ldb.LevelDb).Stats(); err != nil {
+		t.Errorf("Stats: %v", err)
+	}
+	if err := db.VerifyIntegrity(btcdb.VerifyBlocks, nil); err != nil {
+		t.Errorf("VerifyIntegrity: %v", err)
+	}
+	db.Close()
+
+	db, err = btcdb.OpenDBWithOptions("leveldb", btcdb.Options{Path: dbname,
+		ReadOnly: true})
+	if err != nil {
+		t.Errorf("Failed to reopen test database %v", err)
+		return
+	}
+	defer db.Close()
+	if err := db.(*ldb.LevelDb).Compact(); err != btcdb.ErrReadOnly {
+		t.Errorf("Compact of read-only database: got %v, want %v", err,
+			btcdb.ErrReadOnly)
+	}
+}
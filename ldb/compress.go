@@ -0,0 +1,254 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"math"
+)
+
+// CompressionOption is the key of the btcdb.Options Backend setting which
+// selects the codec blocks stored in leveldb are compressed with.  Its value is
+// the name of a registered codec, such as "zstd", "deflate", "snappy" or
+// "none", or a Codec, which is registered if it is not yet known.  Blocks are
+// compressed with "zstd" when it is not given, except by databases created
+// before blocks were compressed, which store them as they are.
+const CompressionOption = "compression"
+
+// blockFlagsKey records the height below which every block stored in leveldb
+// is preceded by the ID of the codec which compressed it.  Databases created
+// before blocks were compressed don't have it and store every block as it is.
+var blockFlagsKey = settingKey("blockflags")
+
+// allBlocksFlagged is the flag height of databases in which every block is
+// preceded by the ID of its codec.
+const allBlocksFlagged = math.MaxInt64
+
+// parseCompression returns the codec the passed options ask blocks to be
+// compressed with, or nil when none is requested and the default applies.
+func parseCompression(funcName string, dbOpts *btcdb.Options) (Codec, error) {
+	arg, ok := dbOpts.Backend[CompressionOption]
+	if !ok {
+		return nil, nil
+	}
+
+	var codec Codec
+	switch arg := arg.(type) {
+	case string:
+		codec = codecByName(arg)
+	case Codec:
+		codec = arg
+		known := codecByID(codec.ID())
+		if known == nil || known.Name() != codec.Name() {
+			if err := RegisterCodec(codec); err != nil {
+				return nil, fmt.Errorf("%s setting to ldb.%s is "+
+					"invalid -- %v", CompressionOption,
+					funcName, err)
+			}
+		}
+	}
+	if codec == nil {
+		return nil, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected name of a registered codec or ldb.Codec",
+			CompressionOption, funcName)
+	}
+	return codec, nil
+}
+
+// loadBlockFlagsSetting reads the height below which blocks are preceded by the
+// ID of their codec from the database.
+func (db *LevelDb) loadBlockFlagsSetting() error {
+	val, err := db.get(blockFlagsKey)
+	switch {
+	case err == leveldb.ErrNotFound:
+		db.flagHeight = 0
+	case err != nil:
+		return err
+	case len(val) != 8:
+		return btcdb.ErrCorruption
+	default:
+		db.flagHeight = int64(binary.LittleEndian.Uint64(val))
+	}
+	return nil
+}
+
+// blockFlagsValue returns the serialized flag height stored under
+// blockFlagsKey.
+func blockFlagsValue(height int64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(height))
+	return buf[:]
+}
+
+// encodeBlock returns the passed block in the form it is stored in leveldb at
+// the given height, which is compressed and preceded by the ID of the codec
+// when blocks at the height carry one.
+func (db *LevelDb) encodeBlock(height int64, buf []byte) ([]byte, error) {
+	if height >= db.flagHeight {
+		return buf, nil
+	}
+
+	codec := db.codec
+	if codec == nil {
+		codec = noCodec{}
+	}
+	enc, err := codec.Encode(buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.ID()}, enc...), nil
+}
+
+// decodeBlock returns the block stored in leveldb under the given key in the
+// passed form, as created by encodeBlock.  The result refers to the passed
+// value when the block is stored uncompressed.
+func (db *LevelDb) decodeBlock(key []byte, height int64, val []byte) ([]byte, error) {
+	if height >= db.flagHeight {
+		return val, nil
+	}
+	if len(val) == 0 {
+		return nil, &btcdb.CorruptionError{Key: key}
+	}
+
+	codec := codecByID(val[0])
+	if codec == nil {
+		return nil, fmt.Errorf("block at height %d is compressed with "+
+			"unknown codec %d -- it must be registered with "+
+			"ldb.RegisterCodec", height, val[0])
+	}
+	buf, err := codec.Decode(val[1:])
+	if err != nil {
+		return nil, &btcdb.CorruptionError{Key: key}
+	}
+	return buf, nil
+}
+
+// Recompress rewrites every block stored in leveldb which is not compressed
+// with the codec selected by the CompressionOption setting, or which is
+// compressed when no codec is selected, so a database can be moved to another
+// codec.  Blocks stored in flat files are not compressed.
+func (db *LevelDb) Recompress() error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	db.flush()
+
+	return db.rewriteBlocks(0)
+}
+
+// migrateBlockFlags compresses the blocks of a database which are not yet
+// preceded by the ID of their codec when it is opened for writing with a codec.
+// Databases opened without one keep storing such blocks as they are.
+// Must be called with db write lock held.
+func (db *LevelDb) migrateBlockFlags() error {
+	if db.codec == nil || db.flagHeight == allBlocksFlagged ||
+		db.readOnly {
+
+		return nil
+	}
+
+	if db.nextBlock > db.flagHeight {
+		log.Infof("Compressing %d blocks with %s",
+			db.nextBlock-db.flagHeight, db.codec.Name())
+	}
+	return db.rewriteBlocks(db.flagHeight)
+}
+
+// rewriteBlocks stores the blocks from the given height onward with the codec
+// of the database, leaving those already stored with it as they are, and marks
+// every block as preceded by the ID of its codec.  The flag height is recorded
+// along with each batch of blocks, so an interrupted rewrite resumes where it
+// stopped.
+// Must be called with db write lock held.
+func (db *LevelDb) rewriteBlocks(from int64) error {
+	if db.blkFiles != nil || db.headersOnly {
+		return nil
+	}
+
+	codec := db.codec
+	if codec == nil {
+		codec = noCodec{}
+	}
+
+	defer db.lBatch().Reset()
+
+	if from < db.pruneHeight {
+		from = db.pruneHeight
+	}
+	for height := from; height < db.nextBlock; height++ {
+		key := heightBlkToKey(height)
+		val, err := db.get(key)
+		if err == leveldb.ErrNotFound {
+			return btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if len(val) < btcwire.HashSize {
+			return btcdb.ErrCorruption
+		}
+
+		stored := val[btcwire.HashSize:]
+		if db.checksums {
+			stored, err = splitChecksum(key, stored)
+			if err != nil {
+				return err
+			}
+		}
+		if height < db.flagHeight && len(stored) != 0 &&
+			stored[0] == codec.ID() {
+
+			continue
+		}
+		raw, err := db.decodeBlock(key, height, stored)
+		if err != nil {
+			return err
+		}
+
+		enc, err := codec.Encode(raw)
+		if err != nil {
+			return err
+		}
+		buf := append([]byte{codec.ID()}, enc...)
+		if db.checksums {
+			buf = putChecksum(buf)
+		}
+		sha := val[:btcwire.HashSize:btcwire.HashSize]
+		db.lBatch().Put(key, append(sha, buf...))
+
+		if (height+1)%headerMigrateBatch == 0 {
+			if height+1 > db.flagHeight {
+				db.lBatch().Put(blockFlagsKey,
+					blockFlagsValue(height+1))
+			}
+			err := db.writeBatch(db.lBatch(), db.wo)
+			if err != nil {
+				return err
+			}
+			db.lBatch().Reset()
+			if height+1 > db.flagHeight {
+				db.flagHeight = height + 1
+			}
+			log.Infof("Blocks compressed through height %d", height)
+		}
+	}
+
+	db.lBatch().Put(blockFlagsKey, blockFlagsValue(allBlocksFlagged))
+	if err := db.writeBatch(db.lBatch(), db.wo); err != nil {
+		return err
+	}
+	db.flagHeight = allBlocksFlagged
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+)
+
+// checkStoredBlocks ensures the passed database returns the given blocks as
+// they were inserted and returns the total size they are stored in.
+func checkStoredBlocks(t *testing.T, db btcdb.Db, blocks []*btcutil.Block) int {
+	var stored int
+	for height, block := range blocks {
+		sha, _ := block.Sha()
+		want, _ := block.Bytes()
+		got, err := db.FetchBlockBytesBySha(sha, nil)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("FetchBlockBytesBySha: block %d does not match "+
+				"(err %v)", height, err)
+		}
+		hdr, err := db.FetchBlockHeaderByHeight(int64(height))
+		if err == nil {
+			var hdrSha btcwire.ShaHash
+			hdrSha, err = hdr.BlockSha()
+			if err == nil && !hdrSha.IsEqual(sha) {
+				err = btcdb.ErrCorruption
+			}
+		}
+		if err != nil {
+			t.Errorf("FetchBlockHeaderByHeight: header %d does not "+
+				"match (err %v)", height, err)
+		}
+		size, err := ldb.StoredBlockSize(db, int64(height))
+		if err != nil {
+			t.Errorf("StoredBlockSize: %v", err)
+		}
+		stored += size
+	}
+	return stored
+}
+
+func TestCompression(t *testing.T) {
+	dbname := "tstdbcompress"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+
+	opts := btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.CompressionOption: "deflate"},
+	}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range blocks[:100] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	db.Close()
+
+	// Blocks compressed by another codec are still read.
+	opts.Backend[ldb.CompressionOption] = "snappy"
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range blocks[100:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	checkStoredBlocks(t, db, blocks)
+
+	// Strip the codec IDs to get a database in the old format, which is
+	// read as it is without a codec.
+	if err := ldb.RemoveBlockFlags(db); err != nil {
+		t.Errorf("RemoveBlockFlags: %v", err)
+	}
+	db.Close()
+	delete(opts.Backend, ldb.CompressionOption)
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	uncompressed := checkStoredBlocks(t, db, blocks)
+	db.Close()
+
+	// Opening it with a codec compresses the blocks, here with one using
+	// a dictionary trained on the blocks.
+	var samples [][]byte
+	for _, block := range blocks[:50] {
+		buf, _ := block.Bytes()
+		samples = append(samples, buf)
+	}
+	dict := ldb.TrainDictionary(samples, 4096)
+	if len(dict) == 0 || len(dict) > 4096 {
+		t.Errorf("TrainDictionary: got %d bytes", len(dict))
+	}
+	codec := ldb.NewDeflateCodec(ldb.MinCodecID, "trained", dict)
+	opts.Backend[ldb.CompressionOption] = codec
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	compressed := checkStoredBlocks(t, db, blocks)
+	if compressed >= uncompressed {
+		t.Errorf("migration stored blocks of %d bytes in %d bytes",
+			uncompressed, compressed)
+	}
+
+	// Recompressing with no codec stores the blocks as they are.
+	db.Close()
+	opts.Backend[ldb.CompressionOption] = "none"
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	if err := db.(*ldb.LevelDb).Recompress(); err != nil {
+		t.Errorf("Recompress: %v", err)
+	}
+	if stored := checkStoredBlocks(t, db, blocks); stored <= compressed {
+		t.Errorf("Recompress: blocks still stored in %d bytes", stored)
+	}
+	db.Close()
+
+	// Opening the database without a codec compresses new blocks with
+	// zstd, which Recompress applies to the others.
+	delete(opts.Backend, ldb.CompressionOption)
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	if err := db.(*ldb.LevelDb).Recompress(); err != nil {
+		t.Errorf("Recompress: %v", err)
+	}
+	zstdSize := checkStoredBlocks(t, db, blocks)
+	if zstdSize >= uncompressed {
+		t.Errorf("Recompress: zstd stored blocks of %d bytes in %d bytes",
+			uncompressed, zstdSize)
+	}
+	db.Close()
+
+	// New databases compress blocks with zstd by default.
+	zname := "tstdbcompresszstd"
+	_ = os.RemoveAll(zname)
+	_ = os.RemoveAll(zname + ".ver")
+	defer os.RemoveAll(zname)
+	defer os.RemoveAll(zname + ".ver")
+	zdb, err := btcdb.CreateDBWithOptions("leveldb", btcdb.Options{
+		Path: zname,
+	})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range blocks {
+		if _, err := zdb.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	if stored := checkStoredBlocks(t, zdb, blocks); stored != zstdSize {
+		t.Errorf("CreateDB: blocks stored in %d bytes, want %d with "+
+			"zstd", stored, zstdSize)
+	}
+	zdb.Close()
+
+	// A zstd codec with a dictionary trained on the blocks reads the
+	// blocks of the others.
+	zdict, err := ldb.TrainZstdDictionary(samples, 4096)
+	if err != nil {
+		t.Errorf("TrainZstdDictionary: %v", err)
+		return
+	}
+	zcodec, err := ldb.NewZstdCodec(ldb.MinCodecID+1, "trainedzstd", zdict)
+	if err != nil {
+		t.Errorf("NewZstdCodec: %v", err)
+		return
+	}
+	opts.Backend[ldb.CompressionOption] = zcodec
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	checkStoredBlocks(t, db, blocks)
+	if err := db.(*ldb.LevelDb).Recompress(); err != nil {
+		t.Errorf("Recompress: %v", err)
+	}
+	if stored := checkStoredBlocks(t, db, blocks); stored >= uncompressed {
+		t.Errorf("Recompress: trained zstd stored blocks of %d bytes "+
+			"in %d bytes", uncompressed, stored)
+	}
+	db.Close()
+	if _, err := ldb.NewZstdCodec(ldb.MinCodecID+2, "bad", dict); err == nil {
+		t.Errorf("NewZstdCodec: unexpected success with a deflate " +
+			"dictionary")
+	}
+
+	if err := ldb.RegisterCodec(ldb.NewDeflateCodec(ldb.DeflateCodecID,
+		"other", nil)); err == nil {
+		t.Errorf("RegisterCodec: unexpected success with reserved ID")
+	}
+	if err := ldb.RegisterCodec(ldb.NewDeflateCodec(ldb.MinCodecID,
+		"other", nil)); err == nil {
+		t.Errorf("RegisterCodec: unexpected success with used ID")
+	}
+	opts.Backend[ldb.CompressionOption] = "lz4"
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err == nil {
+		t.Errorf("OpenDBWithOptions: unexpected success with unknown " +
+			"codec")
+	}
+
+	ffname := "tstdbcompressff"
+	defer os.RemoveAll(ffname)
+	defer os.RemoveAll(ffname + ".ver")
+	opts.Path = ffname
+	opts.Backend[ldb.CompressionOption] = "snappy"
+	if _, err := ldb.CreateFlatFileDB(opts); err == nil {
+		t.Errorf("CreateFlatFileDB: unexpected success compressing " +
+			"blocks")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReaders ensures blocks and transactions may be fetched by many
+// goroutines at once while further blocks are being inserted.
+func TestConcurrentReaders(t *testing.T) {
+	dbname := "tstdbconcurrent"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("ffldb", dbname, 16*1024)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	blocks := loadblocks(t)
+	half := len(blocks) / 2
+	for height, block := range blocks[:half] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block %v: %v", height, err)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for height := half; height < len(blocks); height++ {
+			if _, err := db.InsertBlock(blocks[height]); err != nil {
+				t.Errorf("failed to insert block %v: %v",
+					height, err)
+				return
+			}
+		}
+	}()
+
+	const numReaders = 8
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for height, block := range blocks[:half] {
+				sha, _ := block.Sha()
+				if _, err := db.FetchBlockBySha(sha); err != nil {
+					t.Errorf("FetchBlockBySha %v: %v", height,
+						err)
+					return
+				}
+				for _, tx := range block.Transactions() {
+					_, err := db.FetchTxBySha(tx.Sha())
+					if err != nil {
+						t.Errorf("FetchTxBySha %v: %v",
+							tx.Sha(), err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, height, err := db.NewestSha()
+	if err != nil || height != int64(len(blocks)-1) {
+		t.Errorf("NewestSha: got height %d, want %d (err %v)", height,
+			len(blocks)-1, err)
+	}
+}
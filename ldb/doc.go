@@ -10,5 +10,173 @@ Currently a single (littlendian) integer in the file. If there is
 additional data to save in the future, the presence of additional
 data can be indicated by changing the version number, then parsing the
 file differently.
+
+Databases created through the "ffldb" driver store the raw blocks in
+append-only flat files named blkNNNNN.dat in the blocks directory of the
+database rather than in leveldb, which only keeps the file, offset and length
+of each block along with the usual indexes.  A new file is started once the
+current one would exceed the maximum file size given on creation.  The storage
+mode is recorded in the database, so both drivers open either kind.
+
+Block headers are stored on their own, keyed by height, in addition to being
+part of the block bodies, so they can be fetched without reading whole blocks.
+Databases created before this are migrated the first time they are opened
+for writing, while read-only opens keep reading headers out of the blocks.
+The cumulative chain work through each block is kept the same way, and is
+computed from the headers on request for unmigrated read-only opens.
+
+The hashes, heights and headers of the blocks most recently looked up or
+inserted are kept in memory, so the lookups of the blocks near the tip done by
+nearly every operation don't read leveldb.  HeaderCacheOption in the Backend
+settings of btcdb.Options sets how many blocks are cached, with zero turning
+the cache off.  Likewise, the block and transaction hashes ExistsSha and
+ExistsTxSha recently found missing are remembered until a block or transaction
+with the hash is stored, so the many unknown hashes announced by peers are not
+looked up in leveldb again.  MissCacheOption sets how many of each are kept.
+
+Fetching a block by its hash normally reads its height stored under the hash
+and then the block stored under the height.  The heights of the blocks inserted
+or looked up are remembered as well, compactly enough to hold those of the
+whole chain, so the common fetch reads the block at once and falls back to the
+two reads when the block found there is a different one.  LocationCacheOption
+sets how many heights are kept, with zero turning the cache off.
+
+Setting HeadersOnlyOption to true in the Backend settings of btcdb.Options on
+creation gives a database which only stores block headers along with their
+heights and the cumulative work of the chain through each, as needed by SPV
+clients.  Blocks are inserted as usual, or with nothing but the header filled
+in, and only their headers are kept.  Fetching headers, hashes and heights as
+well as dropping blocks work as for any other database, while block bodies,
+transactions and the unspent output set are not available and requesting them
+returns btcdb.ErrHeadersOnly.  The mode is recorded in the database.
+
+Block bodies and undo data which are no longer needed can be pruned with
+PruneTo, while the headers, hashes and heights of the pruned blocks and the
+spend information of their transactions are kept.  Setting PruneRetentionOption
+in the Backend settings of btcdb.Options to a number of blocks instead prunes
+everything but that many of the most recent blocks as new blocks are inserted.
+Flat block files are removed once all of their blocks are pruned.  Requesting
+the body of a pruned block, or a transaction stored in one, returns
+btcdb.ErrPruned.  The filter index needs full blocks and can not be used with
+pruning, and the other indexes and the unspent output set can no longer be
+rebuilt once blocks are pruned.
+
+Flat block files may be kept on two tiers of storage.  Setting ColdPathOption in
+the Backend settings of btcdb.Options to a directory, such as one on a slower
+disk or a mounted object store, has the files whose blocks are all older than
+the HotRetentionOption duration, judged by their timestamps, moved there from
+the blocks directory.  Files are moved every hour while the database is open for
+writing, or right away by Demote, and are renamed when both directories are on
+the same file system and copied otherwise.  Blocks are read from either
+directory, so the move is not seen by readers, and a file is moved back should
+blocks be dropped into it.  A database with moved files must always be opened
+with the same cold path.
+
+The cold tier may instead be a bucket of an S3-compatible object store, which
+leaves the capacity for old blocks practically unlimited while the indexes stay
+in leveldb.  An S3Store set as ColdStoreOption uploads each block file whole
+once it is moved, retrying failed requests with exponential backoff, and reads
+blocks with ranged requests.  It keeps the files it most recently uploaded in a
+local write-through cache so blocks of them are read without a request.  Writes
+to the database wait for the upload of a file to finish, and other ColdStore
+implementations may be given the same way.
+
+Every change is written to leveldb in a single batch, but with flat files the
+block data is written separately beforehand and may not survive a crash the
+batch does.  When the database is opened, the last blocks of the chain are
+checked for records which disagree with each other or block data which can no
+longer be read, and any blocks from the first such one onward are removed so
+the chain ends at the last consistent block.  Blocks which can still be read
+are unwound like dropped ones, while for the others the outputs they spent are
+restored from their undo data and their transactions are found by scanning the
+transaction records.  Read-only opens fail instead.
+
+With the btcdb.SyncAlways policy the flat files and every batch are synced as
+they are written.  Otherwise Sync syncs the flat files followed by the leveldb
+journal, and is called at the requested interval under the btcdb.SyncPeriodic
+policy and when the database is closed.
+
+Setting CoalesceSizeOption in the Backend settings of btcdb.Options to a number
+of bytes has InsertBlock hold the blocks which extend the chain and insert them
+in a single batch once they reach that size, which cuts the writes made while
+the chain is downloaded block by block.  Held blocks are also inserted after the
+CoalesceIntervalOption interval, by Flush and Sync, before any other change or
+read and when the database is closed, so a block is visible as soon as
+InsertBlock returns.  A block failing validation is refused by its own
+InsertBlock, while an error inserting a held block is returned by the next
+InsertBlock or Flush, after the blocks held before the failing one are inserted.
+
+New databases store a CRC-32C checksum with every block, whether it is kept in
+leveldb or in a flat file.  It is verified each time the block is read and a
+mismatch returns a btcdb.CorruptionError naming the offending key.  Transactions
+read from a region of a flat block file are checked against their hash instead,
+while other partial reads of flat file blocks are not verified.  Databases created before
+checksums were stored are read without verification.
+
+Blocks kept in leveldb are compressed with zstd using a dictionary trained on
+blocks of the chain unless CompressionOption in the Backend settings of
+btcdb.Options names another codec, such as "snappy", "deflate", which uses a
+preset dictionary of the byte sequences common to transactions, or "none" to
+store them as they are.  Other codecs are added by implementing the Codec
+interface and passing it to RegisterCodec.  NewZstdCodec and NewDeflateCodec
+give codecs with a dictionary of their own, such as one built by
+TrainZstdDictionary or TrainDictionary from recent blocks of the chain.  Every
+block is stored behind the ID of its codec, so a database holds blocks of
+several codecs once it is opened with another one, and Recompress rewrites them
+all with the current codec.  Blocks of databases created before this are
+stored without an ID and are kept as they are until the database is opened for
+writing with a codec named by CompressionOption, which compresses them.
+Blocks kept in flat files are not compressed.
+
+Setting EncryptionKeyOption in the Backend settings of btcdb.Options on
+creation to an AES key of 16, 24 or 32 bytes encrypts every value stored in
+leveldb with AES-GCM under a random nonce, authenticated along with its key so
+values can not be moved between keys.  The keys themselves, which are made of
+hashes and heights, are stored in the clear so leveldb can order them.  The
+database must then be opened with the same key, while opening it without the
+key or with another one returns btcdb.ErrEncryptionKey.  Backups stay encrypted
+with the key of the database.  Flat block files are not encrypted, so the
+option can not be used with them.
+
+Every key starts with a byte naming the kind of record it holds, such as
+blocks, headers, transactions or settings, and heights in keys are stored big
+endian so records keyed by them are ordered by height.  The version of the
+format of the database is recorded in it, and databases written in an older
+format are upgraded when they are opened for writing by running the migrations
+to each later version in turn, reporting their progress to the UpgradeProgress
+function of btcdb.Options.  Migrations write their changes in batches which
+resume where they stopped should the upgrade be interrupted.  Databases in an
+older format can not be opened read-only, which returns
+btcdb.ErrUpgradeRequired, and those in a newer one can not be opened at all.
+
+Transaction records hold the index of the transaction within its block, which
+is returned as the BlkIndex of btcdb.TxListReply.  Databases upgraded from a
+format without it keep their existing records as they are, and the index of
+the transactions of the blocks stored before the upgrade is found by reading
+their block when they are fetched.
+
+The records of transactions which are not fully spent hold a bit for each of
+their outputs telling whether it is spent, which IsOutpointSpent reads without
+touching the transaction itself.  The bits are stored behind a byte naming
+their encoding, either as they are or as the lengths of the runs of unspent and
+spent outputs, whichever is shorter, so the records of transactions with many
+outputs stay small while few or most of them are spent.
+
+New databases record the backend which created them, and the network whose
+chain they hold when Net is set in btcdb.Options.  Opening a database for
+another network returns a btcdb.IdentityError before anything is written to
+it.  Databases which don't record their network are checked against their
+genesis block instead and record the network the first time they are opened
+for writing with one.
+
+A database may hold the chains of several networks.  ForNetwork returns a view
+holding the chain of the given network, which is a database of its own kept in
+a directory inside the database directory and created with the same options
+the first time it is requested.  Views are closed along with the database and
+are not part of its backups.
+
+Any number of goroutines may read from the database at the same time, while
+inserting and dropping blocks waits for the readers to finish and holds off new
+ones until the change is complete.
 */
 package ldb
@@ -0,0 +1,161 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/goleveldb/leveldb"
+	"github.com/conformal/goleveldb/leveldb/opt"
+	"io"
+)
+
+// EncryptionKeyOption is the key of the btcdb.Options Backend setting which
+// encrypts the values stored in leveldb with AES-GCM.  Its value is the AES key
+// as a []byte of 16, 24 or 32 bytes.  A database created with a key must be
+// opened with the same key.
+const EncryptionKeyOption = "encryptionkey"
+
+// encryptionKey holds a known value sealed with the key of an encrypted
+// database, which is used to tell whether a database is opened with the
+// right key.  Unencrypted databases don't have it.
+var encryptionKey = settingKey("encryption")
+
+// encryptionCheck is the value sealed under encryptionKey.
+var encryptionCheck = []byte("btcdb encryption check")
+
+// parseEncryptionKey returns the cipher the passed options ask values to be
+// encrypted with, or nil when they are stored in the clear.
+func parseEncryptionKey(funcName string, dbOpts *btcdb.Options) (cipher.AEAD, error) {
+	arg, ok := dbOpts.Backend[EncryptionKeyOption]
+	if !ok {
+		return nil, nil
+	}
+	key, ok := arg.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected []byte", EncryptionKeyOption, funcName)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected 16, 24 or 32 byte key", EncryptionKeyOption,
+			funcName)
+	}
+	return cipher.NewGCM(block)
+}
+
+// setupEncryption checks the passed cipher against the database, or records
+// it when the database is being created.  An encrypted database must be opened
+// with its key, and an unencrypted one can not be opened with a key.
+func (db *LevelDb) setupEncryption(funcName string, aead cipher.AEAD, create bool) error {
+	if create {
+		if aead == nil {
+			return nil
+		}
+		db.aead = aead
+		val := db.seal(encryptionKey, encryptionCheck)
+		return db.lDb.Put(encryptionKey, val, db.wo)
+	}
+
+	// Databases whose key layout is not upgraded yet keep the check under
+	// its legacy key.
+	key := encryptionKey
+	val, err := db.lDb.Get(key, db.ro)
+	if err == leveldb.ErrNotFound {
+		key = legacyEncryptionKey
+		val, err = db.lDb.Get(key, db.ro)
+	}
+	switch {
+	case err == leveldb.ErrNotFound && aead == nil:
+		return nil
+	case err == leveldb.ErrNotFound:
+		return fmt.Errorf("%s setting to ldb.%s is invalid -- the "+
+			"database is not encrypted", EncryptionKeyOption,
+			funcName)
+	case err != nil:
+		return err
+	case aead == nil:
+		return btcdb.ErrEncryptionKey
+	}
+
+	db.aead = aead
+	check, err := db.unseal(key, val)
+	if err != nil || !bytes.Equal(check, encryptionCheck) {
+		db.aead = nil
+		return btcdb.ErrEncryptionKey
+	}
+	return nil
+}
+
+// seal returns the passed value encrypted to be stored under the given key,
+// which is authenticated along with it so values can not be moved to other
+// keys.  The random nonce precedes the sealed value.
+func (db *LevelDb) seal(key, val []byte) []byte {
+	size := db.aead.NonceSize()
+	buf := make([]byte, size, size+len(val)+db.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(fmt.Sprintf("unable to read random nonce: %v", err))
+	}
+	return db.aead.Seal(buf, buf, val, key)
+}
+
+// unseal returns the value stored under the given key in the passed form, as
+// created by seal.
+func (db *LevelDb) unseal(key, val []byte) ([]byte, error) {
+	size := db.aead.NonceSize()
+	if len(val) < size {
+		return nil, &btcdb.CorruptionError{Key: key}
+	}
+	plain, err := db.aead.Open(nil, val[:size], val[size:], key)
+	if err != nil {
+		return nil, &btcdb.CorruptionError{Key: key}
+	}
+	return plain, nil
+}
+
+// put stores a single value outside of a batch, encrypting it when the
+// database is encrypted.
+func (db *LevelDb) put(key, val []byte) error {
+	if db.aead != nil {
+		val = db.seal(key, val)
+	}
+	return db.lDb.Put(key, val, db.wo)
+}
+
+// writeBatch writes the passed batch, encrypting its values when the database
+// is encrypted.
+func (db *LevelDb) writeBatch(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	if db.aead == nil {
+		return db.lDb.Write(batch, wo)
+	}
+
+	sealed := sealingReplay{db: db, batch: new(leveldb.Batch)}
+	if err := batch.Replay(&sealed); err != nil {
+		return err
+	}
+	return db.lDb.Write(sealed.batch, wo)
+}
+
+// sealingReplay copies the records of a batch into another with the values
+// encrypted.
+type sealingReplay struct {
+	db    *LevelDb
+	batch *leveldb.Batch
+}
+
+// Put is called for each value put by the replayed batch.
+func (r *sealingReplay) Put(key, val []byte) {
+	r.batch.Put(key, r.db.seal(key, val))
+}
+
+// Delete is called for each key deleted by the replayed batch.
+func (r *sealingReplay) Delete(key []byte) {
+	r.batch.Delete(key)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dbname := "tstdbencrypt"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)[:100]
+	key := bytes.Repeat([]byte{0x42}, 32)
+	opts := btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.EncryptionKeyOption: key},
+	}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	meta := []byte("secret value")
+	if err := db.PutMeta([]byte("secret"), meta); err != nil {
+		t.Errorf("PutMeta: %v", err)
+	}
+
+	// Nothing of the blocks may be found on disk.
+	for height, block := range blocks {
+		raw, _ := block.Bytes()
+		stored, err := ldb.StoredBlock(db, int64(height))
+		if err != nil {
+			t.Errorf("StoredBlock: %v", err)
+			continue
+		}
+		if bytes.Contains(stored, raw[:80]) {
+			t.Errorf("block %d is stored in the clear", height)
+		}
+	}
+	db.Close()
+
+	// The database can only be opened with its key.
+	delete(opts.Backend, ldb.EncryptionKeyOption)
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err != btcdb.ErrEncryptionKey {
+		t.Errorf("OpenDBWithOptions without key: got %v, want %v", err,
+			btcdb.ErrEncryptionKey)
+	}
+	opts.Backend[ldb.EncryptionKeyOption] = bytes.Repeat([]byte{0x24}, 32)
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err != btcdb.ErrEncryptionKey {
+		t.Errorf("OpenDBWithOptions with wrong key: got %v, want %v",
+			err, btcdb.ErrEncryptionKey)
+	}
+
+	opts.Backend[ldb.EncryptionKeyOption] = key
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Errorf("Snapshot: %v", err)
+		db.Close()
+		return
+	}
+	for _, block := range blocks {
+		sha, _ := block.Sha()
+		want, _ := block.Bytes()
+		got, err := snap.FetchBlockBytesBySha(sha, nil)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("FetchBlockBytesBySha: block %v does not match "+
+				"(err %v)", sha, err)
+		}
+		coinbase := block.Transactions()[0].Sha()
+		replies := snap.FetchUnSpentTxByShaList(
+			[]*btcwire.ShaHash{coinbase})
+		if replies[0].Err != nil || replies[0].Tx == nil {
+			t.Errorf("FetchUnSpentTxByShaList: coinbase %v got err "+
+				"%v", coinbase, replies[0].Err)
+		}
+	}
+	snap.Release()
+	_, height, err := db.NewestSha()
+	if err != nil || height != int64(len(blocks)-1) {
+		t.Errorf("NewestSha: got height %d (err %v), want %d", height,
+			err, len(blocks)-1)
+	}
+	if got, err := db.GetMeta([]byte("secret")); !bytes.Equal(got, meta) {
+		t.Errorf("GetMeta: got %q (err %v), want %q", got, err, meta)
+	}
+	it, err := db.MetaIterator([]byte("sec"))
+	if err != nil || !it.Next() || !bytes.Equal(it.Value(), meta) {
+		t.Errorf("MetaIterator: value does not match (err %v)", err)
+	}
+	db.Close()
+
+	opts.Backend[ldb.EncryptionKeyOption] = []byte("short")
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err == nil {
+		t.Errorf("OpenDBWithOptions: unexpected success with invalid " +
+			"key")
+	}
+
+	// Unencrypted databases can not be opened with a key.
+	plainname := "tstdbencryptplain"
+	defer os.RemoveAll(plainname)
+	defer os.RemoveAll(plainname + ".ver")
+	db, err = btcdb.CreateDB("leveldb", plainname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	db.Close()
+	opts.Path = plainname
+	opts.Backend[ldb.EncryptionKeyOption] = key
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err == nil {
+		t.Errorf("OpenDBWithOptions: unexpected success with a key " +
+			"for an unencrypted database")
+	}
+
+	opts.Path = "tstdbencryptff"
+	defer os.RemoveAll(opts.Path)
+	defer os.RemoveAll(opts.Path + ".ver")
+	if _, err := ldb.CreateFlatFileDB(opts); err == nil {
+		t.Errorf("CreateFlatFileDB: unexpected success encrypting " +
+			"blocks")
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/gcs"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// filterIndexKey is the key used to record that basic compact filters are
+// maintained for the database.
+var filterIndexKey = settingKey("filterindex")
+
+// filterIndexRebuildBatch is the number of blocks whose filters are written in
+// a single batch while (re)building the filters.
+const filterIndexRebuildBatch = 500
+
+// heightFilterToKey returns the key for the filter header and basic filter of
+// the block at the given height.
+func heightFilterToKey(height int64) []byte {
+	return heightKey(filterNs, height)
+}
+
+// fetchFilterTx returns the transaction with the passed hash for building a
+// filter.  Transactions of blocks which are still in the current batch are
+// not in leveldb yet, so they are kept aside until the batch is written.
+// Must be called with db write lock held.
+func (db *LevelDb) fetchFilterTx(sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+	if tx, ok := db.filterTxs[*sha]; ok {
+		return tx, nil
+	}
+	tx, _, _, _, _, err := db.fetchTxDataBySha(sha)
+	return tx, err
+}
+
+// fetchFilterHeader returns the filter header of the block at the given height
+// taking the filters in the current batch into account.
+// Must be called with db write lock held.
+func (db *LevelDb) fetchFilterHeader(height int64) (*btcwire.ShaHash, error) {
+	if header, ok := db.filterHeaders[height]; ok {
+		return &header, nil
+	}
+	buf, err := db.get(heightFilterToKey(height))
+	if err == leveldb.ErrNotFound {
+		return nil, btcdb.ErrCorruption
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < btcwire.HashSize {
+		return nil, btcdb.ErrCorruption
+	}
+	var header btcwire.ShaHash
+	header.SetBytes(buf[0:btcwire.HashSize])
+	return &header, nil
+}
+
+// putFilter adds the filter header and basic filter of the passed block, which
+// is at the given height, to the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) putFilter(height int64, block *btcutil.Block) error {
+	filter, err := gcs.BuildBasicFilter(block, db.fetchFilterTx)
+	if err != nil {
+		return err
+	}
+
+	prevHeader := &btcwire.ShaHash{}
+	if height > 0 {
+		prevHeader, err = db.fetchFilterHeader(height - 1)
+		if err != nil {
+			return err
+		}
+	}
+	header := gcs.FilterHeader(filter, prevHeader)
+
+	buf := make([]byte, btcwire.HashSize+len(filter))
+	copy(buf, header.Bytes())
+	copy(buf[btcwire.HashSize:], filter)
+	db.lBatch().Put(heightFilterToKey(height), buf)
+
+	if db.filterTxs == nil {
+		db.filterTxs = make(map[btcwire.ShaHash]*btcwire.MsgTx)
+		db.filterHeaders = make(map[int64]btcwire.ShaHash)
+	}
+	for _, tx := range block.Transactions() {
+		db.filterTxs[*tx.Sha()] = tx.MsgTx()
+	}
+	db.filterHeaders[height] = header
+	return nil
+}
+
+// resetFilterUpdates discards the transactions and filter headers kept aside
+// for the blocks in the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) resetFilterUpdates() {
+	db.filterTxs = nil
+	db.filterHeaders = nil
+}
+
+// fetchFilterEntry returns the filter header and basic filter of the block
+// with the given hash.
+// Must be called with db read lock held.
+func (db *LevelDb) fetchFilterEntry(sha *btcwire.ShaHash) ([]byte, error) {
+	if !db.filterIndex {
+		return nil, btcdb.ErrNoFilterIndex
+	}
+	height, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := db.get(heightFilterToKey(height))
+	if err == leveldb.ErrNotFound {
+		return nil, btcdb.ErrCorruption
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < btcwire.HashSize {
+		return nil, btcdb.ErrCorruption
+	}
+	return buf, nil
+}
+
+// FetchFilterBySha returns the basic filter of the block with the given hash.
+// This is part of the btcdb.Db interface implementation.
+//
+// Filters are optional for this backend and btcdb.ErrNoFilterIndex is returned
+// unless they have been enabled with EnableFilterIndex.
+func (db *LevelDb) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	buf, err := db.fetchFilterEntry(sha)
+	if err != nil {
+		return nil, err
+	}
+	return buf[btcwire.HashSize:], nil
+}
+
+// FetchFilterHeaderBySha returns the basic filter header of the block with the
+// given hash.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	buf, err := db.fetchFilterEntry(sha)
+	if err != nil {
+		return nil, err
+	}
+	var header btcwire.ShaHash
+	header.SetBytes(buf[0:btcwire.HashSize])
+	return &header, nil
+}
+
+// fetchFilterRange returns the filter header and basic filter of each block
+// from the start height up to but not including the end height.
+// Must be called with db read lock held.
+func (db *LevelDb) fetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	if !db.filterIndex {
+		return nil, btcdb.ErrNoFilterIndex
+	}
+
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	// Fetch as many as are available within the specified range.
+	if endHeight > db.lastBlkIdx+1 {
+		endHeight = db.lastBlkIdx + 1
+	}
+	if endHeight < startHeight {
+		endHeight = startHeight
+	}
+
+	entries := make([][]byte, 0, endHeight-startHeight)
+	for height := startHeight; height < endHeight; height++ {
+		buf, err := db.get(heightFilterToKey(height))
+		if err == leveldb.ErrNotFound {
+			return nil, btcdb.ErrCorruption
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < btcwire.HashSize {
+			return nil, btcdb.ErrCorruption
+		}
+		entries = append(entries, buf)
+	}
+	return entries, nil
+}
+
+// FetchFilterRange returns the basic filters of the blocks from the start
+// height up to but not including the end height.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	entries, err := db.fetchFilterRange(startHeight, endHeight)
+	if err != nil {
+		return nil, err
+	}
+	for i, buf := range entries {
+		entries[i] = buf[btcwire.HashSize:]
+	}
+	return entries, nil
+}
+
+// FetchFilterHeaderRange returns the basic filter headers of the blocks from
+// the start height up to but not including the end height.  This is part of
+// the btcdb.Db interface implementation.
+func (db *LevelDb) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	entries, err := db.fetchFilterRange(startHeight, endHeight)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]btcwire.ShaHash, len(entries))
+	for i, buf := range entries {
+		headers[i].SetBytes(buf[0:btcwire.HashSize])
+	}
+	return headers, nil
+}
+
+// FilterIndexEnabled returns whether or not basic filters are maintained for
+// the database.
+func (db *LevelDb) FilterIndexEnabled() bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return false
+	}
+
+	return db.filterIndex
+}
+
+// EnableFilterIndex turns maintenance of basic filters on or off.  The setting
+// is persisted in the database.  When filters are turned on for a database
+// which already contains blocks, they are built from the stored blocks.  When
+// they are turned off, all stored filters are removed.
+func (db *LevelDb) EnableFilterIndex(enable bool) error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	db.flush()
+	if enable && db.headersOnly {
+		return btcdb.ErrHeadersOnly
+	}
+	if enable && (db.pruneHeight > 0 || db.pruneRetention > 0) {
+		return errPruneFilterIndex
+	}
+
+	if enable == db.filterIndex {
+		return nil
+	}
+
+	if enable {
+		// The setting is only recorded once every filter is in place,
+		// so an interrupted build leaves filters disabled.
+		if err := db.walkFilterIndex(true); err != nil {
+			return err
+		}
+		if err := db.put(filterIndexKey, []byte{1}); err != nil {
+			return err
+		}
+		db.filterIndex = true
+		return nil
+	}
+
+	if err := db.lDb.Delete(filterIndexKey, db.wo); err != nil {
+		return err
+	}
+	db.filterIndex = false
+	return db.walkFilterIndex(false)
+}
+
+// walkFilterIndex iterates every stored block and either adds or removes its
+// filter.  Filters chain to the one of the previous block, so they are built in
+// height order.  The changes are committed in batches to bound memory usage.
+// Must be called with db write lock held.
+func (db *LevelDb) walkFilterIndex(add bool) error {
+	defer db.resetFilterUpdates()
+	defer db.lBatch().Reset()
+
+	for height := int64(0); height < db.nextBlock; height++ {
+		if add {
+			_, buf, err := db.getBlkByHeight(height)
+			if err != nil {
+				return err
+			}
+			blk, err := btcutil.NewBlockFromBytes(buf)
+			if err != nil {
+				return err
+			}
+			if err := db.putFilter(height, blk); err != nil {
+				return err
+			}
+		} else {
+			db.lBatch().Delete(heightFilterToKey(height))
+		}
+
+		if (height+1)%filterIndexRebuildBatch == 0 {
+			err := db.writeBatch(db.lBatch(), db.wo)
+			if err != nil {
+				return err
+			}
+			db.lBatch().Reset()
+			db.resetFilterUpdates()
+			log.Infof("Filters processed through height %d", height)
+		}
+	}
+
+	return db.writeBatch(db.lBatch(), db.wo)
+}
+
+// loadFilterIndexSetting reads whether basic filters are maintained from the
+// database.
+func (db *LevelDb) loadFilterIndexSetting() error {
+	_, err := db.get(filterIndexKey)
+	switch err {
+	case nil:
+		db.filterIndex = true
+	case leveldb.ErrNotFound:
+		db.filterIndex = false
+	default:
+		return err
+	}
+	return nil
+}
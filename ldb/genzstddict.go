@@ -0,0 +1,124 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+// +build ignore
+
+// This file is ignored during the regular build due to the build tag above.
+// It is called by go generate and used to automatically generate the
+// dictionary of the built-in zstd codec, which is trained on the blocks of the
+// test chain.  Blocks stored with the built-in codec are read with the
+// dictionary, so once databases hold such blocks a new dictionary needs a codec
+// ID of its own rather than replacing this one.
+
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcwire"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dictSize is the size of the content of the generated dictionary.
+const dictSize = 8192
+
+// loadSamples returns the serialized blocks of the passed file, which holds
+// each block behind the network it belongs to and its length.
+func loadSamples(path string) ([][]byte, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	var genesis bytes.Buffer
+	if err := btcwire.GenesisBlock.Serialize(&genesis); err != nil {
+		return nil, err
+	}
+	samples := [][]byte{genesis.Bytes()}
+
+	r := bzip2.NewReader(fi)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(hdr[:]) != uint32(btcwire.MainNet) {
+			return nil, fmt.Errorf("block %d is not of the main network",
+				len(samples))
+		}
+		buf := make([]byte, binary.LittleEndian.Uint32(hdr[4:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		samples = append(samples, buf)
+	}
+}
+
+func main() {
+	samples, err := loadSamples(filepath.Join("..", "testdata",
+		"blocks1-256.bz2"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load blocks: %v\n", err)
+		os.Exit(1)
+	}
+	dict, err := ldb.TrainZstdDictionary(samples, dictSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to train dictionary: %v\n", err)
+		os.Exit(1)
+	}
+
+	fi, err := os.Create("zstddict.go")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create file: %v\n", err)
+		os.Exit(1)
+	}
+	defer fi.Close()
+
+	fmt.Fprintln(fi, "// Copyright (c) 2013-2014 Conformal Systems LLC.")
+	fmt.Fprintln(fi, "// Use of this source code is governed by an ISC")
+	fmt.Fprintln(fi, "// license that can be found in the LICENSE file.")
+	fmt.Fprintln(fi)
+	fmt.Fprintln(fi, "package ldb")
+	fmt.Fprintln(fi)
+	fmt.Fprintln(fi, "// Auto-generated file (see genzstddict.go)")
+	fmt.Fprintln(fi, "// DO NOT EDIT")
+	fmt.Fprintln(fi)
+	fmt.Fprintln(fi, "import (")
+	fmt.Fprintln(fi, "\t\"encoding/hex\"")
+	fmt.Fprintln(fi, ")")
+	fmt.Fprintln(fi)
+	fmt.Fprintln(fi, "// zstdBlockDict is the dictionary of the built-in zstd codec, trained by")
+	fmt.Fprintln(fi, "// TrainZstdDictionary on the blocks of the test chain.  Blocks stored with")
+	fmt.Fprintln(fi, "// ZstdCodecID are read with it, so it must never change.")
+	fmt.Fprintln(fi, "var zstdBlockDict = func() []byte {")
+	fmt.Fprintln(fi, "\tdict, err := hex.DecodeString(\"\" +")
+	enc := hex.EncodeToString(dict)
+	for len(enc) > 0 {
+		n := 64
+		if n > len(enc) {
+			n = len(enc)
+		}
+		sep := " +"
+		if n == len(enc) {
+			sep = ")"
+		}
+		fmt.Fprintf(fi, "\t\t%q%s\n", enc[:n], sep)
+		enc = enc[n:]
+	}
+	fmt.Fprintln(fi, "\tif err != nil {")
+	fmt.Fprintln(fi, "\t\tpanic(\"invalid zstd dictionary in source\")")
+	fmt.Fprintln(fi, "\t}")
+	fmt.Fprintln(fi, "\treturn dict")
+	fmt.Fprintln(fi, "}()")
+}
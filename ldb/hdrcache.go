@@ -0,0 +1,225 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+const (
+	// HeaderCacheOption is the key of the btcdb.Options Backend setting
+	// which sets the number of recent blocks whose hash, height and header
+	// are kept in memory.  Zero turns the cache off, and
+	// defaultHeaderCacheSize blocks are cached when it is not given.
+	HeaderCacheOption = "headercache"
+
+	// defaultHeaderCacheSize is the number of blocks cached when the
+	// HeaderCacheOption setting is not given.
+	defaultHeaderCacheSize = 2048
+)
+
+// hdrCache holds the mappings between the hashes and heights of the blocks most
+// recently looked up or inserted along with their deserialized headers, so the
+// lookups done by nearly every operation don't need to read leveldb.  The
+// blocks used least recently are evicted first.
+//
+// Entries are only added for blocks which are committed and removed once the
+// blocks are dropped, so the cache never disagrees with the database.  Its
+// functions are safe for concurrent use since readers only hold the db read
+// lock, and do nothing on a nil cache, which is used when caching is off.
+type hdrCache struct {
+	mtx      sync.Mutex
+	maxSize  int
+	lru      *list.List
+	byHeight map[int64]*list.Element
+	bySha    map[btcwire.ShaHash]*list.Element
+}
+
+// hdrCacheEntry is the block at a single height held by a hdrCache.  Either of
+// the hash and header is nil until it has been read.
+type hdrCacheEntry struct {
+	height int64
+	sha    *btcwire.ShaHash
+	header *btcwire.BlockHeader
+}
+
+// parseHeaderCacheSize returns the number of blocks the passed options ask to
+// cache.
+func parseHeaderCacheSize(funcName string, dbOpts *btcdb.Options) (int, error) {
+	arg, ok := dbOpts.Backend[HeaderCacheOption]
+	if !ok {
+		return defaultHeaderCacheSize, nil
+	}
+	size, ok := arg.(int)
+	if !ok || size < 0 {
+		return 0, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected non-negative integer", HeaderCacheOption,
+			funcName)
+	}
+	return size, nil
+}
+
+// newHdrCache returns a cache of the given number of blocks, or nil when the
+// size is zero.
+func newHdrCache(maxSize int) *hdrCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &hdrCache{
+		maxSize:  maxSize,
+		lru:      list.New(),
+		byHeight: make(map[int64]*list.Element),
+		bySha:    make(map[btcwire.ShaHash]*list.Element),
+	}
+}
+
+// lookupHeight returns the height of the block with the given hash and whether
+// it was cached.
+func (c *hdrCache) lookupHeight(sha *btcwire.ShaHash) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.bySha[*sha]
+	if !ok {
+		return 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*hdrCacheEntry).height, true
+}
+
+// lookupSha returns the hash of the block at the given height, or nil when it
+// is not cached.
+func (c *hdrCache) lookupSha(height int64) *btcwire.ShaHash {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.byHeight[height]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*hdrCacheEntry)
+	if entry.sha == nil {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	sha := *entry.sha
+	return &sha
+}
+
+// lookupHeader returns a copy of the header of the block at the given height,
+// or nil when it is not cached.
+func (c *hdrCache) lookupHeader(height int64) *btcwire.BlockHeader {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.byHeight[height]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*hdrCacheEntry)
+	if entry.header == nil {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	bh := *entry.header
+	return &bh
+}
+
+// add records the hash and header of the block at the given height, either of
+// which may be nil when it is not known.  The block must be committed to the
+// database, which callers ensure by only adding blocks they read from leveldb
+// or inserted once the batch holding them is written.
+func (c *hdrCache) add(height int64, sha *btcwire.ShaHash, bh *btcwire.BlockHeader) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.byHeight[height]
+	if !ok {
+		elem = c.lru.PushFront(&hdrCacheEntry{height: height})
+		c.byHeight[height] = elem
+		for c.lru.Len() > c.maxSize {
+			c.remove(c.lru.Back())
+		}
+	} else {
+		c.lru.MoveToFront(elem)
+	}
+
+	entry := elem.Value.(*hdrCacheEntry)
+	if sha != nil && entry.sha == nil {
+		shaCopy := *sha
+		entry.sha = &shaCopy
+		c.bySha[shaCopy] = elem
+	}
+	if bh != nil && entry.header == nil {
+		bhCopy := *bh
+		entry.header = &bhCopy
+	}
+}
+
+// removeFrom removes the blocks at or above the given height, which is done
+// once they are dropped from the database.
+func (c *hdrCache) removeFrom(height int64) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*hdrCacheEntry).height >= height {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// remove removes the passed element from the cache.
+//
+// This function must be called with the cache lock held.
+func (c *hdrCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*hdrCacheEntry)
+	delete(c.byHeight, entry.height)
+	if entry.sha != nil && c.bySha[*entry.sha] == elem {
+		delete(c.bySha, *entry.sha)
+	}
+}
+
+// cacheHeaders adds the hashes and headers of the passed blocks, which were
+// inserted at the given heights, to the header cache and their heights to the
+// location cache.
+// Must be called with db write lock held once the blocks are committed.
+func (db *LevelDb) cacheHeaders(blocks []*btcutil.Block, heights []int64) {
+	for i, blk := range blocks {
+		sha, err := blk.Sha()
+		if err != nil {
+			continue
+		}
+		db.hdrCache.add(heights[i], sha, &blk.MsgBlock().Header)
+		db.locCache.add(sha, heights[i])
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// headerIndexKey is the key used to record that block headers are stored
+// apart from the block bodies.  Databases created before headers were stored
+// separately do not have it and are migrated when they are opened.
+var headerIndexKey = settingKey("headers")
+
+// headerMigrateBatch is the number of blocks whose headers are written in a
+// single batch while migrating a database.
+const headerMigrateBatch = 2000
+
+// heightHeaderToKey returns the key for the header of the block at the given
+// height.
+func heightHeaderToKey(height int64) []byte {
+	return heightKey(headerNs, height)
+}
+
+// putHeader adds the header of the passed serialized block at the given height
+// to the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) putHeader(height int64, buf []byte) error {
+	if len(buf) < btcwire.MaxBlockHeaderPayload {
+		return btcdb.ErrCorruption
+	}
+	header := make([]byte, btcwire.MaxBlockHeaderPayload)
+	copy(header, buf)
+	db.lBatch().Put(heightHeaderToKey(height), header)
+	return nil
+}
+
+// fetchHeaderByHeight returns the block header at the given height.  The
+// header is read on its own when headers are stored separately.  Otherwise
+// only the header is read when blocks are stored in flat files and the block
+// body is not copied when they are kept in leveldb.
+// Must be called with db read lock held.
+func (db *LevelDb) fetchHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	if bh := db.hdrCache.lookupHeader(height); bh != nil {
+		return bh, nil
+	}
+
+	var buf []byte
+	switch {
+	case db.headerIndex:
+		var err error
+		buf, err = db.get(heightHeaderToKey(height))
+		if err == leveldb.ErrNotFound {
+			return nil, btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	case db.blkFiles != nil:
+		_, loc, err := db.getBlkLocByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		buf, err = db.blkFiles.readRegion(loc, 0,
+			btcwire.MaxBlockHeaderPayload)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		key := heightBlkToKey(height)
+		blkVal, err := db.get(key)
+		if err == leveldb.ErrNotFound {
+			return nil, btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(blkVal) < btcwire.HashSize {
+			return nil, btcdb.ErrCorruption
+		}
+		buf = blkVal[btcwire.HashSize:]
+		if db.checksums {
+			buf, err = splitChecksum(key, buf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf, err = db.decodeBlock(key, height, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var bh btcwire.BlockHeader
+	if err := bh.Deserialize(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	db.hdrCache.add(height, nil, &bh)
+	return &bh, nil
+}
+
+// loadHeaderIndexSetting reads whether block headers are stored separately
+// from the database.
+func (db *LevelDb) loadHeaderIndexSetting() error {
+	_, err := db.get(headerIndexKey)
+	switch err {
+	case nil:
+		db.headerIndex = true
+	case leveldb.ErrNotFound:
+		db.headerIndex = false
+	default:
+		return err
+	}
+	return nil
+}
+
+// migrateHeaders stores the headers of all blocks in a database created before
+// headers were stored separately.  Databases opened read-only are left as they
+// are and keep reading headers from the block bodies.
+// Must be called with db write lock held.
+func (db *LevelDb) migrateHeaders() error {
+	if db.headerIndex || db.readOnly {
+		return nil
+	}
+
+	defer db.lBatch().Reset()
+
+	if db.nextBlock > 0 {
+		log.Infof("Migrating block headers of %d blocks", db.nextBlock)
+	}
+	for height := int64(0); height < db.nextBlock; height++ {
+		_, buf, err := db.getBlkByHeight(height)
+		if err != nil {
+			return err
+		}
+		if err := db.putHeader(height, buf); err != nil {
+			return err
+		}
+
+		if (height+1)%headerMigrateBatch == 0 {
+			err := db.writeBatch(db.lBatch(), db.wo)
+			if err != nil {
+				return err
+			}
+			db.lBatch().Reset()
+			log.Infof("Block headers migrated through height %d",
+				height)
+		}
+	}
+
+	// The index is only recorded once every header is in place, so an
+	// interrupted migration starts over on the next open.
+	db.lBatch().Put(headerIndexKey, []byte{1})
+	if err := db.writeBatch(db.lBatch(), db.wo); err != nil {
+		return err
+	}
+	db.headerIndex = true
+	return nil
+}
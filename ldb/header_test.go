@@ -0,0 +1,189 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"os"
+	"testing"
+)
+
+// checkHeaders ensures the header of every passed block can be fetched by both
+// hash and height.
+func checkHeaders(t *testing.T, db btcdb.Db, blocks []*btcutil.Block) {
+	for height, block := range blocks {
+		wantSha, _ := block.Sha()
+
+		bh, err := db.FetchBlockHeaderBySha(wantSha)
+		if err != nil {
+			t.Errorf("FetchBlockHeaderBySha %v: %v", wantSha, err)
+			return
+		}
+		gotSha, _ := bh.BlockSha()
+		if !gotSha.IsEqual(wantSha) {
+			t.Errorf("FetchBlockHeaderBySha %v: got header of %v",
+				wantSha, gotSha)
+		}
+
+		bh, err = db.FetchBlockHeaderByHeight(int64(height))
+		if err != nil {
+			t.Errorf("FetchBlockHeaderByHeight %d: %v", height, err)
+			return
+		}
+		gotSha, _ = bh.BlockSha()
+		if !gotSha.IsEqual(wantSha) {
+			t.Errorf("FetchBlockHeaderByHeight %d: got header of "+
+				"%v, want %v", height, gotSha, wantSha)
+		}
+	}
+}
+
+func TestHeaderMigration(t *testing.T) {
+	dbname := "tstdbhdrmig"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)[:100]
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			db.Close()
+			return
+		}
+	}
+	if !ldb.HeaderIndexed(db) {
+		t.Errorf("headers not stored separately in a new database")
+	}
+	checkHeaders(t, db, blocks)
+
+	// Strip the headers to get a database in the old format.
+	if err := ldb.RemoveHeaderIndex(db); err != nil {
+		t.Errorf("RemoveHeaderIndex: %v", err)
+		db.Close()
+		return
+	}
+	db.Close()
+
+	// A read-only open must leave the database alone and still be able to
+	// read headers out of the block bodies.
+	db, err = btcdb.OpenDB("leveldb", btcdb.Options{Path: dbname,
+		ReadOnly: true})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	if ldb.HeaderIndexed(db) {
+		t.Errorf("headers migrated by a read-only open")
+	}
+	checkHeaders(t, db, blocks)
+	db.Close()
+
+	// A normal open migrates the database.
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	if !ldb.HeaderIndexed(db) {
+		t.Errorf("headers not migrated on open")
+	}
+	checkHeaders(t, db, blocks)
+
+	// Dropped blocks must take their headers with them.
+	dropSha, _ := blocks[49].Sha()
+	if err := db.DropAfterBlockBySha(dropSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	checkHeaders(t, db, blocks[:50])
+	if _, err := db.FetchBlockHeaderByHeight(50); err != btcdb.ErrBlockNotFound {
+		t.Errorf("FetchBlockHeaderByHeight of dropped block: got %v, "+
+			"want %v", err, btcdb.ErrBlockNotFound)
+	}
+}
+
+func TestHeaderCache(t *testing.T) {
+	dbname := "tstdbhdrcache"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+
+	_, err := btcdb.CreateDBWithOptions("leveldb", btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.HeaderCacheOption: -1},
+	})
+	if err == nil {
+		t.Errorf("CreateDB accepted a negative header cache size")
+	}
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+
+	// The cache is kept smaller than the chain so blocks are evicted.
+	db, err := btcdb.CreateDBWithOptions("leveldb", btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.HeaderCacheOption: 10},
+	})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	blocks := loadblocks(t)[:100]
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+	checkHeaders(t, db, blocks)
+
+	// The dropped blocks, which were just cached, must no longer be found.
+	keepSha, _ := blocks[49].Sha()
+	if err := db.DropAfterBlockBySha(keepSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	for height := int64(50); height < 100; height++ {
+		sha, _ := blocks[height].Sha()
+		if _, err := db.FetchBlockHeightBySha(sha); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockHeightBySha of dropped block %d: "+
+				"got %v, want %v", height, err,
+				btcdb.ErrBlockNotFound)
+		}
+		if _, err := db.FetchBlockShaByHeight(height); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockShaByHeight of dropped block %d: "+
+				"got %v, want %v", height, err,
+				btcdb.ErrBlockNotFound)
+		}
+		if _, err := db.FetchBlockHeaderByHeight(height); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchBlockHeaderByHeight of dropped block %d: "+
+				"got %v, want %v", height, err,
+				btcdb.ErrBlockNotFound)
+		}
+	}
+	checkHeaders(t, db, blocks[:50])
+
+	for _, block := range blocks[50:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+	checkHeaders(t, db, blocks)
+}
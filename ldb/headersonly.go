@@ -0,0 +1,82 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+const (
+	// HeadersOnlyOption is the key of the btcdb.Options Backend setting
+	// which creates a database that only stores block headers.  Its value
+	// must be a bool.
+	HeadersOnlyOption = "headersonly"
+)
+
+// headersOnlyKey is the key used to record that the database only stores block
+// headers along with their heights and the cumulative work of the chain.
+var headersOnlyKey = settingKey("headersonly")
+
+// parseHeadersOnly returns whether the passed options request a headers-only
+// database.
+func parseHeadersOnly(funcName string, dbOpts *btcdb.Options) (bool, error) {
+	arg, ok := dbOpts.Backend[HeadersOnlyOption]
+	if !ok {
+		return false, nil
+	}
+	headersOnly, ok := arg.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected bool", HeadersOnlyOption, funcName)
+	}
+	return headersOnly, nil
+}
+
+// insertHeader adds the header of the passed block along with its height and
+// the cumulative work of the chain through it to the current batch.  Nothing
+// else about the block is stored.
+// Must be called with db write lock held.
+func (db *LevelDb) insertHeader(sha *btcwire.ShaHash, bh *btcwire.BlockHeader) (int64, error) {
+	var buf bytes.Buffer
+	if err := bh.Serialize(&buf); err != nil {
+		return 0, err
+	}
+
+	tipIdx, tipWork := db.lastBlkIdx, db.lastBlkWork
+	height, err := db.insertBlockData(sha, &bh.PrevBlock, buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if err := db.putChainWork(height, bh.Bits, tipIdx, tipWork); err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// HeadersOnly returns whether the database only stores block headers.
+func (db *LevelDb) HeadersOnly() bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	return db.headersOnly
+}
+
+// loadHeadersOnlySetting reads whether the database only stores block headers.
+func (db *LevelDb) loadHeadersOnlySetting() error {
+	_, err := db.get(headersOnlyKey)
+	switch err {
+	case nil:
+		db.headersOnly = true
+	case leveldb.ErrNotFound:
+		db.headersOnly = false
+	default:
+		return err
+	}
+	return nil
+}
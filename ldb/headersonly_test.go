@@ -0,0 +1,140 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math/big"
+	"os"
+	"testing"
+)
+
+// checkChainWork ensures the cumulative work of every passed block is the sum
+// of the work of it and all blocks before it.
+func checkChainWork(t *testing.T, db btcdb.Db, blocks []*btcutil.Block) {
+	want := new(big.Int)
+	for _, block := range blocks {
+		want.Add(want, btcdb.CalcWork(block.MsgBlock().Header.Bits))
+		sha, _ := block.Sha()
+		got, err := db.FetchChainWorkBySha(sha)
+		if err != nil {
+			t.Errorf("FetchChainWorkBySha %v: %v", sha, err)
+			return
+		}
+		if got.Cmp(want) != 0 {
+			t.Errorf("FetchChainWorkBySha %v: got %v, want %v", sha,
+				got, want)
+			return
+		}
+	}
+}
+
+func TestHeadersOnly(t *testing.T) {
+	dbname := "tstdbhdronly"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", btcdb.Options{Path: dbname,
+		Backend: map[string]interface{}{ldb.HeadersOnlyOption: true}})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	// The first half is inserted as full blocks and the rest as bare
+	// headers, which is all a headers-only database keeps either way.
+	blocks := loadblocks(t)
+	half := len(blocks) / 2
+	if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		db.Close()
+		return
+	}
+	for _, block := range blocks[half:] {
+		hdrBlock := btcutil.NewBlock(&btcwire.MsgBlock{
+			Header: block.MsgBlock().Header,
+		})
+		if _, err := db.InsertBlock(hdrBlock); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+			db.Close()
+			return
+		}
+	}
+	checkHeaders(t, db, blocks)
+	checkChainWork(t, db, blocks)
+
+	// The genesis block has the minimum difficulty.
+	genesisSha, _ := blocks[0].Sha()
+	work, err := db.FetchChainWorkBySha(genesisSha)
+	if err != nil || work.Cmp(big.NewInt(0x100010001)) != 0 {
+		t.Errorf("FetchChainWorkBySha of genesis: got %v %v, want %v",
+			work, err, 0x100010001)
+	}
+
+	// Block bodies and everything derived from them are not available.
+	sha, _ := blocks[1].Sha()
+	if _, err := db.FetchBlockBySha(sha); err != btcdb.ErrHeadersOnly {
+		t.Errorf("FetchBlockBySha: got %v, want %v", err,
+			btcdb.ErrHeadersOnly)
+	}
+	if _, err := db.FetchBlockRegion(sha, 0, 80); err != btcdb.ErrHeadersOnly {
+		t.Errorf("FetchBlockRegion: got %v, want %v", err,
+			btcdb.ErrHeadersOnly)
+	}
+	txSha, _ := blocks[1].TxSha(0)
+	if db.ExistsTxSha(txSha) {
+		t.Errorf("ExistsTxSha: transaction stored")
+	}
+	if _, err := db.UtxoSetSize(); err != btcdb.ErrHeadersOnly {
+		t.Errorf("UtxoSetSize: got %v, want %v", err,
+			btcdb.ErrHeadersOnly)
+	}
+	if err := db.(*ldb.LevelDb).EnableTxIndex(true); err != btcdb.ErrHeadersOnly {
+		t.Errorf("EnableTxIndex: got %v, want %v", err,
+			btcdb.ErrHeadersOnly)
+	}
+
+	// Dropped headers must take their work with them.
+	dropSha, _ := blocks[half-1].Sha()
+	if err := db.DropAfterBlockBySha(dropSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		db.Close()
+		return
+	}
+	newest, height, err := db.NewestSha()
+	if err != nil || !newest.IsEqual(dropSha) || height != int64(half-1) {
+		t.Errorf("NewestSha after drop: got %v %d %v, want %v %d",
+			newest, height, err, dropSha, half-1)
+	}
+	sha, _ = blocks[half].Sha()
+	if _, err := db.FetchBlockHeaderBySha(sha); err != btcdb.ErrBlockNotFound {
+		t.Errorf("FetchBlockHeaderBySha of dropped block: got %v, "+
+			"want %v", err, btcdb.ErrBlockNotFound)
+	}
+	db.Close()
+
+	// The mode is recorded in the database, so a plain open keeps it and
+	// picks up the work of the tip for the headers which follow.
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	if !db.(*ldb.LevelDb).HeadersOnly() {
+		t.Errorf("HeadersOnly: mode not kept across open")
+	}
+	if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		return
+	}
+	checkHeaders(t, db, blocks)
+	checkChainWork(t, db, blocks)
+}
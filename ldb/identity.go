@@ -0,0 +1,104 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// backendName identifies the databases of this driver, whether they store
+// blocks in leveldb or in flat files.
+const backendName = "leveldb"
+
+// backendKey records the backend which created the database and networkKey
+// the magic of the network whose chain it holds.  Databases created before
+// they were recorded don't have them, and neither do those created without a
+// network.
+var (
+	backendKey = settingKey("backend")
+	networkKey = settingKey("network")
+)
+
+// netValue returns the passed network as it is stored.
+func netValue(net btcwire.BitcoinNet) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(net))
+	return buf[:]
+}
+
+// loadIdentity records the backend and network of a new database, and checks
+// those of an existing one against the network it is opened for.  A database
+// which does not record its network yet gets the one it is opened for once its
+// genesis block is checked by checkGenesisNetwork.
+func (db *LevelDb) loadIdentity(create bool, net btcwire.BitcoinNet) error {
+	if create {
+		if err := db.put(backendKey, []byte(backendName)); err != nil {
+			return err
+		}
+		if net == 0 {
+			return nil
+		}
+		db.net = net
+		return db.put(networkKey, netValue(net))
+	}
+
+	val, err := db.get(backendKey)
+	switch {
+	case err == leveldb.ErrNotFound:
+	case err != nil:
+		return err
+	case string(val) != backendName:
+		return &btcdb.IdentityError{Kind: "backend", Have: string(val),
+			Want: backendName}
+	}
+
+	val, err = db.get(networkKey)
+	switch {
+	case err == leveldb.ErrNotFound:
+		return nil
+	case err != nil:
+		return err
+	case len(val) != 4:
+		return btcdb.ErrCorruption
+	}
+	db.net = btcwire.BitcoinNet(binary.LittleEndian.Uint32(val))
+	if net != 0 && net != db.net {
+		return &btcdb.IdentityError{Kind: "network",
+			Have: db.net.String(), Want: net.String()}
+	}
+	return nil
+}
+
+// checkGenesisNetwork checks the genesis block of a database which does not
+// record its network against the network it is opened for, and records the
+// network when the database is opened for writing.
+func (db *LevelDb) checkGenesisNetwork(net btcwire.BitcoinNet) error {
+	if net == 0 || db.net != 0 {
+		return nil
+	}
+	if db.nextBlock > 0 {
+		sha, err := db.fetchBlockShaByHeight(0)
+		if err != nil {
+			return err
+		}
+		have, ok := btcdb.GenesisNetwork(sha)
+		switch {
+		case !ok:
+			return &btcdb.IdentityError{Kind: "network",
+				Have: "unknown", Want: net.String()}
+		case have != net:
+			return &btcdb.IdentityError{Kind: "network",
+				Have: have.String(), Want: net.String()}
+		}
+	}
+	if db.readOnly {
+		return nil
+	}
+	db.net = net
+	return db.put(networkKey, netValue(net))
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+)
+
+// openNet opens the database at the passed path for the given network and
+// returns the IdentityError it fails with, if any.
+func openNet(t *testing.T, dbname string, net btcwire.BitcoinNet) *btcdb.IdentityError {
+	opts := btcdb.Options{Path: dbname, Net: net}
+	db, err := btcdb.OpenDBWithOptions("leveldb", opts)
+	if err == nil {
+		db.Close()
+		return nil
+	}
+	ierr, ok := err.(*btcdb.IdentityError)
+	if !ok {
+		t.Errorf("OpenDBWithOptions: %v", err)
+	}
+	return ierr
+}
+
+func TestNetworkIdentity(t *testing.T) {
+	for _, recorded := range []bool{true, false} {
+		testNetworkIdentity(t, recorded)
+	}
+}
+
+func testNetworkIdentity(t *testing.T, recorded bool) {
+	dbname := "tstdbidentity"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	// The test blocks belong to the main network.  Databases created
+	// without a network learn it from their genesis block.
+	opts := btcdb.Options{Path: dbname}
+	if recorded {
+		opts.Net = btcwire.MainNet
+	}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range loadblocks(t)[:10] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	db.Close()
+
+	ierr := openNet(t, dbname, btcwire.TestNet3)
+	if ierr == nil || ierr.Kind != "network" ||
+		ierr.Have != btcwire.MainNet.String() ||
+		ierr.Want != btcwire.TestNet3.String() {
+		t.Errorf("recorded %v: opening for %v got %v", recorded,
+			btcwire.TestNet3, ierr)
+	}
+	if ierr := openNet(t, dbname, btcwire.MainNet); ierr != nil {
+		t.Errorf("recorded %v: opening for %v got %v", recorded,
+			btcwire.MainNet, ierr)
+	}
+	if ierr := openNet(t, dbname, 0); ierr != nil {
+		t.Errorf("recorded %v: opening without a network got %v",
+			recorded, ierr)
+	}
+	if ierr := openNet(t, dbname, btcwire.TestNet); ierr == nil {
+		t.Errorf("recorded %v: opening for %v succeeded", recorded,
+			btcwire.TestNet)
+	}
+}
@@ -5,9 +5,15 @@
 package ldb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/conformal/btcdb"
 	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"net/http"
+	"os"
+	"time"
 )
 
 // FetchSha returns the datablock and pver for the given ShaHash.
@@ -22,3 +28,356 @@ func FetchSha(db btcdb.Db, sha *btcwire.ShaHash) (buf []byte, pver uint32,
 	buf, blkid, err = sqldb.fetchSha(sha)
 	return
 }
+
+// RemoveHeaderIndex removes the separately stored block headers so the
+// database looks like one created before headers were stored on their own.
+// This is a testing only interface.
+func RemoveHeaderIndex(db btcdb.Db) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	for height := int64(0); height < ldb.nextBlock; height++ {
+		ldb.lBatch().Delete(heightHeaderToKey(height))
+	}
+	ldb.lBatch().Delete(headerIndexKey)
+	err := ldb.lDb.Write(ldb.lBatch(), ldb.wo)
+	ldb.lBatch().Reset()
+	return err
+}
+
+// HeaderIndexed returns whether the block headers are stored separately.
+// This is a testing only interface.
+func HeaderIndexed(db btcdb.Db) bool {
+	ldb, ok := db.(*LevelDb)
+	return ok && ldb.headerIndex
+}
+
+// RemoveChainWork removes the stored cumulative chain work so the database
+// looks like one created before it was stored.
+// This is a testing only interface.
+func RemoveChainWork(db btcdb.Db) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	for height := int64(0); height < ldb.nextBlock; height++ {
+		ldb.lBatch().Delete(heightWorkToKey(height))
+	}
+	ldb.lBatch().Delete(chainWorkKey)
+	err := ldb.lDb.Write(ldb.lBatch(), ldb.wo)
+	ldb.lBatch().Reset()
+	return err
+}
+
+// ChainWorkStored returns whether the cumulative chain work is stored.
+// This is a testing only interface.
+func ChainWorkStored(db btcdb.Db) bool {
+	ldb, ok := db.(*LevelDb)
+	return ok && ldb.chainWork
+}
+
+// RemoveBlockShaRecord removes the record of the height of the block with the
+// given hash so the database looks like a write to it was only partially
+// applied.
+// This is a testing only interface.
+func RemoveBlockShaRecord(db btcdb.Db, sha *btcwire.ShaHash) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	return ldb.lDb.Delete(shaBlkToKey(sha), ldb.wo)
+}
+
+// RemoveTxIndexEntry removes the standalone transaction index entry of the
+// transaction with the given hash so the index looks damaged.
+// This is a testing only interface.
+func RemoveTxIndexEntry(db btcdb.Db, sha *btcwire.ShaHash) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	return ldb.lDb.Delete(shaTxIndexToKey(sha), ldb.wo)
+}
+
+// CorruptBlock flips the bits of the last byte of the stored block at the given
+// height, wherever it is stored, so it reads back different from what was
+// written.
+// This is a testing only interface.
+func CorruptBlock(db btcdb.Db, height int64) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	if ldb.blkFiles == nil {
+		return flipLastByte(ldb, heightBlkToKey(height))
+	}
+
+	_, loc, err := ldb.getBlkLocByHeight(height)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ldb.blkFiles.blockFilePath(loc.fileNum),
+		os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	off := int64(loc.offset + loc.length - 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	return err
+}
+
+// flipLastByte flips the bits of the last byte of the value of the given key.
+func flipLastByte(ldb *LevelDb, key []byte) error {
+	val, err := ldb.lDb.Get(key, ldb.ro)
+	if err != nil {
+		return err
+	}
+	val[len(val)-1] ^= 0xff
+	return ldb.lDb.Put(key, val, ldb.wo)
+}
+
+// RemoveBlockFlags stores every block in leveldb as it is without the ID of a
+// codec so the database looks like one created before blocks were compressed.
+// This is a testing only interface.
+func RemoveBlockFlags(db btcdb.Db) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	for height := ldb.pruneHeight; height < ldb.nextBlock; height++ {
+		sha, buf, err := ldb.getBlkByHeight(height)
+		if err != nil {
+			return err
+		}
+		if ldb.checksums {
+			buf = putChecksum(buf)
+		}
+		val := append(sha.Bytes(), buf...)
+		ldb.lBatch().Put(heightBlkToKey(height), val)
+	}
+	ldb.lBatch().Delete(blockFlagsKey)
+	err := ldb.lDb.Write(ldb.lBatch(), ldb.wo)
+	ldb.lBatch().Reset()
+	ldb.flagHeight = 0
+	return err
+}
+
+// StoredBlockSize returns the size of the value the block at the given height
+// is stored under in leveldb.
+// This is a testing only interface.
+func StoredBlockSize(db btcdb.Db, height int64) (int, error) {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return 0, fmt.Errorf("Invalid data type")
+	}
+	val, err := ldb.lDb.Get(heightBlkToKey(height), ldb.ro)
+	return len(val), err
+}
+
+// StoredBlock returns the value the block at the given height is stored under
+// in leveldb as it is on disk.
+// This is a testing only interface.
+func StoredBlock(db btcdb.Db, height int64) ([]byte, error) {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return nil, fmt.Errorf("Invalid data type")
+	}
+	return ldb.lDb.Get(heightBlkToKey(height), ldb.ro)
+}
+
+// BlockKey returns the key the block at the given height is stored under.
+// This is a testing only interface.
+func BlockKey(height int64) []byte {
+	return heightBlkToKey(height)
+}
+
+// DowngradeSchema moves every record to the key it was stored under before
+// keys started with the kind of their record, removes the index of
+// transactions within their block from their records, stores their spent bits
+// as they are and stores a copy of each transaction in its standalone
+// transaction index entry, so the database looks like one created before
+// then.
+// This is a testing only interface.
+func DowngradeSchema(db btcdb.Db) error {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return fmt.Errorf("Invalid data type")
+	}
+	suffixes := map[byte]string{
+		blockNs: "", headerNs: "hd", workNs: "wk", filterNs: "cf",
+		txNs: "tx", spentTxNs: "sx", txIndexNs: "tr", undoNs: "ud",
+		utxoNs: "ux", spendNs: "sp",
+	}
+
+	// The records are parsed as they are stored now and written back as
+	// if no record held the index.
+	const noTxPositions = int64(^uint64(0) >> 1)
+	txPosHeight := ldb.txPosHeight
+	defer func() {
+		ldb.txPosHeight = txPosHeight
+	}()
+	legacyValue := func(ns byte, val []byte) ([]byte, error) {
+		ldb.txPosHeight = txPosHeight
+		switch ns {
+		case txNs, overwrittenTxNs:
+			height, txOff, txLen, txIdx, spent, err := ldb.parseTxData(val)
+			if err != nil {
+				return nil, err
+			}
+			ldb.txPosHeight = noTxPositions
+			buf, err := ldb.formatTxLocation(&txUpdateObj{
+				blkHeight: height, txoff: txOff, txlen: txLen,
+				txidx: txIdx})
+			if err != nil {
+				return nil, err
+			}
+			return append(buf, spent...), nil
+		case spentTxNs:
+			sTxList, err := ldb.parseTxFullySpent(val)
+			if err != nil {
+				return nil, err
+			}
+			ldb.txPosHeight = noTxPositions
+			return ldb.formatTxFullySpent(sTxList)
+		case txIndexNs:
+			// Standalone transaction index entries held a copy
+			// of their transaction.
+			blkSha, height, txOff, txLen, _, err := ldb.parseTxIndex(val)
+			if err != nil {
+				return nil, err
+			}
+			tx, _, _, _, err := ldb.fetchTxDataByLoc(height, txOff,
+				txLen, nil)
+			if err != nil {
+				return nil, err
+			}
+			var rawTx bytes.Buffer
+			if err := tx.Serialize(&rawTx); err != nil {
+				return nil, err
+			}
+			raw := rawTx.Bytes()
+			if ldb.checksums {
+				raw = putChecksum(raw)
+			}
+			buf := make([]byte, btcwire.HashSize+8, btcwire.HashSize+8+
+				len(raw))
+			copy(buf, blkSha.Bytes())
+			binary.LittleEndian.PutUint64(buf[btcwire.HashSize:],
+				uint64(height))
+			return append(buf, raw...), nil
+		}
+		return val, nil
+	}
+
+	iter := ldb.lDb.NewIterator(nil, ldb.ro)
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		key := iter.Key()
+		var legacy []byte
+		switch {
+		case bytes.Equal(key, schemaKey), bytes.Equal(key, txPosKey):
+		case key[0] == settingNs:
+			legacy = key[1:]
+		case key[0] == metaNs:
+			legacy = append([]byte("meta/"), key[1:]...)
+		case key[0] == blockShaNs:
+			legacy = key[1:]
+		default:
+			if height, ok := keyHeight(key[0], key); ok {
+				legacy = []byte(fmt.Sprintf("%d%s", height,
+					suffixes[key[0]]))
+			} else {
+				legacy = append(append([]byte(nil), key[1:]...),
+					suffixes[key[0]]...)
+			}
+		}
+
+		val := iter.Value()
+		if ldb.aead != nil {
+			var err error
+			if val, err = ldb.unseal(key, val); err != nil {
+				iter.Release()
+				return err
+			}
+		}
+		val, err := legacyValue(key[0], val)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		if ldb.aead != nil && legacy != nil {
+			val = ldb.seal(legacy, val)
+		}
+		batch.Delete(key)
+		if legacy != nil {
+			batch.Put(legacy, val)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return ldb.lDb.Write(batch, ldb.wo)
+}
+
+// AddSchemaMigration appends a migration to the next version of the format of
+// the database, which calls the passed function with the cursor of an
+// interrupted run and the function checkpointing its progress.  The returned
+// function removes the migration again.
+// This is a testing only interface.
+func AddSchemaMigration(description string, migrate func(cursor []byte,
+	checkpoint func(cursor []byte, upgraded int64) error) error) func() {
+
+	saved := schemaMigrations
+	m := schemaMigration{
+		version:     schemaVersion() + 1,
+		description: description,
+		migrate: func(u *schemaUpgrade, cursor []byte) error {
+			return migrate(cursor, u.checkpoint)
+		},
+	}
+	schemaMigrations = append(append([]schemaMigration(nil), saved...), m)
+	return func() {
+		schemaMigrations = saved
+	}
+}
+
+// SchemaVersion returns the version of the format recorded in the database.
+// This is a testing only interface.
+func SchemaVersion(db btcdb.Db) (uint32, error) {
+	ldb, ok := db.(*LevelDb)
+	if !ok {
+		return 0, fmt.Errorf("Invalid data type")
+	}
+	val, err := ldb.get(schemaKey)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(val), nil
+}
+
+// SignS3 signs the passed request for the object store of the passed S3Store
+// as of the passed time.
+// This is a testing only interface.
+func SignS3(s *S3Store, req *http.Request, payloadHash string, now time.Time) {
+	s.sign(req, payloadHash, now)
+}
+
+// EncodeSpentBits returns the stored form of the passed spent bits.
+// This is a testing only interface.
+func EncodeSpentBits(spent []byte) []byte {
+	return encodeSpentBits(spent)
+}
+
+// DecodeSpentBits returns the spent bits stored in the passed buffer.
+// This is a testing only interface.
+func DecodeSpentBits(buf []byte) ([]byte, error) {
+	return decodeSpentBits(buf)
+}
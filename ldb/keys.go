@@ -0,0 +1,103 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcwire"
+)
+
+// Every key of the database starts with a byte naming the kind of record it
+// holds, so the records of one kind can be iterated on their own and new kinds
+// can be added without running into the keys of others.  Heights are stored
+// big endian so the records keyed by them are ordered by height.
+const (
+	// settingNs holds the settings of the database by name.
+	settingNs byte = 0x01
+
+	// blockShaNs maps block hashes to heights.
+	blockShaNs byte = 0x02
+
+	// blockNs maps heights to the hash of the block followed by its body,
+	// or its location in the flat block files.
+	blockNs byte = 0x03
+
+	// headerNs, workNs and filterNs map heights to the header, cumulative
+	// chain work and compact filter of the block.
+	headerNs byte = 0x04
+	workNs   byte = 0x05
+	filterNs byte = 0x06
+
+	// txNs, spentTxNs, txIndexNs and undoNs map hashes to the transaction
+	// records, the spend records of fully spent transactions, the entries
+	// of the standalone transaction index and the undo data of blocks.
+	txNs      byte = 0x07
+	spentTxNs byte = 0x08
+	txIndexNs byte = 0x09
+	undoNs    byte = 0x0a
+
+	// utxoNs and spendNs map outpoints to their entries in the unspent
+	// transaction output set and the spend index.
+	utxoNs  byte = 0x0b
+	spendNs byte = 0x0c
+
+	// metaNs holds the metadata namespace of btcdb.MetaBatch.
+	metaNs byte = 0x0d
+
+	// overwrittenTxNs maps hashes to the records of the earlier instances
+	// of transactions overwritten by the duplicates allowed by
+	// btcdb.IsBIP30Exception.
+	overwrittenTxNs byte = 0x0e
+)
+
+// settingKey returns the key of the setting with the given name.
+func settingKey(name string) []byte {
+	return append([]byte{settingNs}, name...)
+}
+
+// heightKey returns the key of the record of the given kind for the block at
+// the given height.
+func heightKey(ns byte, height int64) []byte {
+	key := make([]byte, 9)
+	key[0] = ns
+	binary.BigEndian.PutUint64(key[1:], uint64(height))
+	return key
+}
+
+// keyHeight returns the height of the block whose record of the given kind is
+// stored under the passed key and whether the key is such a key.
+func keyHeight(ns byte, key []byte) (int64, bool) {
+	if len(key) != 9 || key[0] != ns {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(key[1:])), true
+}
+
+// shaKey returns the key of the record of the given kind for the passed hash.
+func shaKey(ns byte, sha *btcwire.ShaHash) []byte {
+	key := make([]byte, 1+btcwire.HashSize)
+	key[0] = ns
+	copy(key[1:], sha.Bytes())
+	return key
+}
+
+// outPointKey returns the key of the record of the given kind for the passed
+// outpoint.
+func outPointKey(ns byte, op *btcwire.OutPoint) []byte {
+	key := make([]byte, 1+btcwire.HashSize+4)
+	key[0] = ns
+	copy(key[1:], op.Hash.Bytes())
+	binary.BigEndian.PutUint32(key[1+btcwire.HashSize:], op.Index)
+	return key
+}
+
+// keyOutPoint returns the outpoint whose record is stored under the passed key
+// made by outPointKey.
+func keyOutPoint(key []byte) *btcwire.OutPoint {
+	var sha btcwire.ShaHash
+	sha.SetBytes(key[1 : 1+btcwire.HashSize])
+	index := binary.BigEndian.Uint32(key[1+btcwire.HashSize:])
+	return btcwire.NewOutPoint(&sha, index)
+}
@@ -5,26 +5,32 @@
 package ldb
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"github.com/conformal/btcdb"
-	"github.com/conformal/btclog"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
 	"github.com/conformal/goleveldb/leveldb"
 	"github.com/conformal/goleveldb/leveldb/cache"
 	"github.com/conformal/goleveldb/leveldb/opt"
+	"math/big"
 	"os"
 	"sync"
+	"time"
 )
 
+// syncKey is the key whose deletion is written to force the leveldb journal
+// to be synced.  It is never stored.
+var syncKey = settingKey("sync")
+
 const (
 	dbVersion     int = 2
 	dbMaxTransCnt     = 20000
 	dbMaxTransMem     = 64 * 1024 * 1024 // 64 MB
 )
 
-var log = btclog.Disabled
+var log = btcdb.DriverLogger("ldb")
 
 type tTxInsertData struct {
 	txsha   *btcwire.ShaHash
@@ -35,8 +41,42 @@ type tTxInsertData struct {
 }
 
 type LevelDb struct {
-	// lock preventing multiple entry
-	dbLock sync.Mutex
+	// dbLock allows any number of concurrent readers while functions
+	// which modify the database hold it exclusively.  Read paths must
+	// not modify any of the state below.
+	dbLock sync.RWMutex
+
+	// metrics receives the measurements of the operations of the database.
+	metrics btcdb.Metrics
+
+	// blockCache holds the blocks most recently fetched and inserted.  It
+	// is nil when blocks are not cached and for snapshots, which may not
+	// see every block it holds.
+	blockCache *btcdb.BlockCache
+
+	// prefetch is the number of blocks read ahead by block iterators and
+	// readAhead reads the blocks following those fetched in height order
+	// into the block cache.  readAhead is nil without a block cache and
+	// for snapshots.
+	prefetch  int
+	readAhead *btcdb.ReadAhead
+
+	// hdrCache holds the hashes, heights and headers of the blocks most
+	// recently looked up and inserted.  It is nil when they are not cached
+	// and for snapshots.
+	hdrCache *hdrCache
+
+	// locCache holds the heights of the blocks inserted and looked up by
+	// hash, so they are fetched with a single read.  It is nil when they
+	// are not cached, and is shared with snapshots since the heights are
+	// checked before they are used.
+	locCache *locCache
+
+	// blkMisses and txMisses remember the block and transaction hashes
+	// recently found missing.  They are nil when misses are not cached
+	// and for snapshots.
+	blkMisses *missCache
+	txMisses  *missCache
 
 	// leveldb pieces
 	lDb *leveldb.DB
@@ -51,8 +91,129 @@ type LevelDb struct {
 	lastBlkSha       btcwire.ShaHash
 	lastBlkIdx       int64
 
+	// chainWork indicates whether the cumulative chain work of each block
+	// is stored and lastBlkWork is the work through the cached tip.
+	chainWork   bool
+	lastBlkWork *big.Int
+
+	// headersOnly is set when the database only stores block headers.
+	headersOnly bool
+
 	txUpdateMap      map[btcwire.ShaHash]*txUpdateObj
 	txSpentUpdateMap map[btcwire.ShaHash]*spentTxUpdate
+
+	// txIndex indicates whether the standalone transaction index is
+	// maintained.
+	txIndex bool
+
+	// spendIndex indicates whether the spend index, which maps spent
+	// outputs to the transactions which spent them, is maintained.
+	spendIndex bool
+
+	// filterIndex indicates whether basic compact filters are maintained.
+	// filterTxs and filterHeaders hold the transactions and filter headers
+	// of the blocks whose filters are pending in the batch.
+	filterIndex   bool
+	filterTxs     map[btcwire.ShaHash]*btcwire.MsgTx
+	filterHeaders map[int64]btcwire.ShaHash
+
+	// utxoTracked indicates whether the unspent transaction output set is
+	// maintained.  utxoSetSize is the committed size of the set while
+	// utxoUpdateMap and utxoDelta hold the changes pending in the batch.
+	utxoTracked   bool
+	utxoSetSize   int64
+	utxoUpdateMap map[btcwire.OutPoint]*utxoUpdate
+	utxoDelta     int64
+
+	// pruneHeight is the height of the lowest block whose body is still
+	// stored and pruneRetention the number of most recent blocks kept
+	// when pruning as blocks are inserted, zero when not pruning.
+	pruneHeight    int64
+	pruneRetention int64
+
+	// headerIndex indicates whether block headers are stored apart from
+	// the block bodies.
+	headerIndex bool
+
+	// checksums indicates whether raw blocks are stored with a checksum
+	// which is verified on read.
+	checksums bool
+
+	// flagHeight is the height below which blocks stored in leveldb are
+	// preceded by the ID of the codec which compressed them, and codec is
+	// the codec new blocks are compressed with, nil when they are not.
+	flagHeight int64
+	codec      Codec
+
+	// txPosHeight is the height from which the transaction records of
+	// blocks hold the index of the transaction within its block.
+	txPosHeight int64
+
+	// aead encrypts the values stored in leveldb, nil when they are stored
+	// in the clear.
+	aead cipher.AEAD
+
+	// net is the network whose chain the database holds, zero when it is
+	// not recorded.
+	net btcwire.BitcoinNet
+
+	// opts are the options the database was opened with.  networks holds
+	// the views of the chains of other networks opened by ForNetwork and
+	// snaps the snapshots which are open, both protected by networksLock.
+	// root is the database a view or snapshot belongs to, nil for the
+	// database itself.
+	opts         btcdb.Options
+	networks     map[btcwire.BitcoinNet]*LevelDb
+	snaps        map[*LevelDb]struct{}
+	networksLock sync.Mutex
+	root         *LevelDb
+
+	// blkFiles is set when raw blocks are stored in flat files rather
+	// than in leveldb.
+	blkFiles *blockFiles
+
+	// coldStore is the cold tier the block files of blocks older than
+	// hotRetention are moved to, nil when storage is not tiered.  demoter
+	// moves them every demoteInterval.
+	coldStore    ColdStore
+	hotRetention time.Duration
+	demoter      btcdb.PeriodicSyncer
+
+	// notifier delivers the blocks connected and disconnected by each
+	// committed change to subscribers and indexers holds the secondary
+	// indexes updated in the same batch as the blocks.
+	notifier btcdb.Notifier
+	indexers btcdb.IndexerSet
+
+	// syncer performs the periodic syncs of the SyncPeriodic policy.
+	syncer btcdb.PeriodicSyncer
+
+	// coalesceSize is the number of bytes of blocks InsertBlock holds
+	// before inserting them in a single batch, zero when every block is
+	// inserted at once.  held are the blocks which are held, which reads
+	// insert before they proceed, and heldSize their size.  heldErr is the
+	// error of the first held block which failed to insert, kept until it
+	// is returned by Flush or InsertBlock.  flusher inserts the held
+	// blocks every coalesceInterval.
+	coalesceSize     int
+	coalesceInterval time.Duration
+	held             []*btcutil.Block
+	heldSize         int
+	heldErr          error
+	flusher          btcdb.PeriodicSyncer
+
+	// lock keeps other processes from opening the database while it is
+	// open.
+	lock *btcdb.DbLock
+
+	// closed is set once the database has been closed and readOnly when it
+	// was opened without allowing changes.
+	closed   bool
+	readOnly bool
+
+	// snap is the leveldb snapshot all reads go through when the instance
+	// is a snapshot of the database rather than the database itself.
+	snap *leveldb.Snapshot
 }
 
 var self = btcdb.DriverDB{DbType: "leveldb", CreateDB: CreateDB, OpenDB: OpenDB}
@@ -61,30 +222,31 @@ func init() {
 	btcdb.AddDBDriver(self)
 }
 
-// parseArgs parses the arguments from the btcdb Open/Create methods.
-func parseArgs(funcName string, args ...interface{}) (string, error) {
+// parseArgs parses the arguments from the btcdb Open/Create methods.  The
+// database is described by either its path or a btcdb.Options.
+func parseArgs(funcName string, args ...interface{}) (*btcdb.Options, error) {
 	if len(args) != 1 {
-		return "", fmt.Errorf("Invalid arguments to ldb.%s -- "+
-			"expected database path string", funcName)
+		return nil, fmt.Errorf("Invalid arguments to ldb.%s -- "+
+			"expected database path string or options", funcName)
 	}
-	dbPath, ok := args[0].(string)
-	if !ok {
-		return "", fmt.Errorf("First argument to ldb.%s is invalid -- "+
-			"expected database path string", funcName)
+	switch arg := args[0].(type) {
+	case string:
+		return &btcdb.Options{Path: arg}, nil
+	case btcdb.Options:
+		return &arg, nil
 	}
-	return dbPath, nil
+	return nil, fmt.Errorf("First argument to ldb.%s is invalid -- "+
+		"expected database path string or options", funcName)
 }
 
 // OpenDB opens an existing database for use.
 func OpenDB(args ...interface{}) (btcdb.Db, error) {
-	dbpath, err := parseArgs("OpenDB", args...)
+	dbOpts, err := parseArgs("OpenDB", args...)
 	if err != nil {
 		return nil, err
 	}
 
-	log = btcdb.GetLog()
-
-	db, err := openDB(dbpath, false)
+	db, err := openDB(dbOpts, false)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +258,12 @@ func OpenDB(args ...interface{}) (btcdb.Db, error) {
 	increment := int64(100000)
 	ldb := db.(*LevelDb)
 
+	// The records of the blocks at the tip are checked against each other
+	// below, so they are read from leveldb rather than the header cache
+	// until any damage has been repaired.
+	hdrCache := ldb.hdrCache
+	ldb.hdrCache = nil
+
 	var lastSha *btcwire.ShaHash
 	// forward scan
 blockforward:
@@ -141,12 +309,70 @@ blocknarrow:
 	ldb.lastBlkIdx = lastknownblock
 	ldb.nextBlock = lastknownblock + 1
 
+	// Databases which don't record their network yet are checked against
+	// their genesis block before anything is written to them.
+	if err := ldb.checkGenesisNetwork(dbOpts.Net); err != nil {
+		ldb.close()
+		return nil, err
+	}
+
+	// Repair any writes to the blocks at the tip which were only
+	// partially applied before the database was last closed.
+	if err := ldb.recoverTip(); err != nil {
+		ldb.close()
+		return nil, err
+	}
+	ldb.hdrCache = hdrCache
+
+	if ldb.blkFiles != nil {
+		if err := ldb.initBlockFiles(); err != nil {
+			ldb.close()
+			return nil, err
+		}
+	}
+
+	// Databases created before headers were stored separately get them
+	// added now.
+	if err := ldb.migrateHeaders(); err != nil {
+		ldb.close()
+		return nil, err
+	}
+
+	// The same goes for the cumulative chain work, which is computed from
+	// the headers.
+	if err := ldb.migrateChainWork(); err != nil {
+		ldb.close()
+		return nil, err
+	}
+	if err := ldb.loadTipWork(); err != nil {
+		ldb.close()
+		return nil, err
+	}
+
+	// Blocks stored before they were preceded by the ID of their codec
+	// are compressed when a codec is requested.
+	if err := ldb.migrateBlockFlags(); err != nil {
+		ldb.close()
+		return nil, err
+	}
+
+	// The standalone transaction index is built from the stored blocks
+	// when it is requested for a database which does not keep it yet.
+	if dbOpts.TxIndex && !ldb.readOnly {
+		if err := ldb.enableTxIndex(true); err != nil {
+			ldb.close()
+			return nil, err
+		}
+	}
+
+	ldb.startSyncer(dbOpts)
 	return db, nil
 }
 
 var CurrentDBVersion int32 = 1
 
-func openDB(dbpath string, create bool) (pbdb btcdb.Db, err error) {
+func openDB(dbOpts *btcdb.Options, create bool) (pbdb btcdb.Db, err error) {
+	dbpath := dbOpts.Path
 	var db LevelDb
 	var tlDb *leveldb.DB
 	var dbversion int32
@@ -157,8 +383,11 @@ func openDB(dbpath string, create bool) (pbdb btcdb.Db, err error) {
 
 			db.txUpdateMap = map[btcwire.ShaHash]*txUpdateObj{}
 			db.txSpentUpdateMap = make(map[btcwire.ShaHash]*spentTxUpdate)
+			db.utxoUpdateMap = make(map[btcwire.OutPoint]*utxoUpdate)
 
 			pbdb = &db
+		} else {
+			db.lock.Unlock()
 		}
 	}()
 
@@ -176,6 +405,12 @@ func openDB(dbpath string, create bool) (pbdb btcdb.Db, err error) {
 		}
 	}
 
+	// Other processes are kept from opening the database at the same time.
+	db.lock, err = btcdb.LockDb(dbpath, dbOpts.ForceOpen)
+	if err != nil {
+		return
+	}
+
 	needVersionFile := false
 	verfile := dbpath + ".ver"
 	fi, ferr := os.Open(verfile)
@@ -210,10 +445,146 @@ func openDB(dbpath string, create bool) (pbdb btcdb.Db, err error) {
 		return
 	}
 
+	// Apply any tuning requested by the caller.
+	if dbOpts.CacheSize > 0 {
+		opts.BlockCache = cache.NewLRUCache(dbOpts.CacheSize)
+	}
+	if dbOpts.WriteBufferSize > 0 {
+		opts.WriteBuffer = dbOpts.WriteBufferSize
+	}
+	switch dbOpts.Compression {
+	case btcdb.NoCompression:
+		opts.Compression = opt.NoCompression
+	case btcdb.SnappyCompression:
+		opts.Compression = opt.SnappyCompression
+	}
+	if dbOpts.Sync == btcdb.SyncAlways {
+		db.wo = &opt.WriteOptions{Sync: true}
+	}
+	db.readOnly = dbOpts.ReadOnly
+	db.opts = *dbOpts
+	db.metrics = btcdb.DriverMetrics(dbOpts)
+	db.blockCache = btcdb.NewBlockCache(dbOpts.BlockCacheSize)
+	db.prefetch = dbOpts.PrefetchDepth
+	if db.blockCache != nil {
+		db.readAhead = btcdb.NewReadAhead(dbOpts.PrefetchDepth,
+			db.readAheadBlock)
+	}
+
 	tlDb, err = leveldb.OpenFile(dbpath, opts)
 	if err != nil {
 		return
 	}
+	db.lDb = tlDb
+
+	funcName := "OpenDB"
+	if create {
+		funcName = "CreateDB"
+	}
+
+	// Every other value is read through the cipher of an encrypted
+	// database, so it is set up first.
+	aead, err := parseEncryptionKey(funcName, dbOpts)
+	if err == nil {
+		err = db.setupEncryption(funcName, aead, create)
+	}
+	if err == nil {
+		err = db.loadSchema(create, dbOpts.UpgradeProgress)
+	}
+	if err == nil {
+		err = db.loadIdentity(create, dbOpts.Net)
+	}
+	if err == nil {
+		err = db.loadTxIndexSetting()
+	}
+	if err == nil {
+		err = db.loadHeadersOnlySetting()
+	}
+	if err == nil {
+		err = db.loadChainWorkSetting()
+	}
+	if err == nil {
+		err = db.loadSpendIndexSetting()
+	}
+	if err == nil {
+		err = db.loadFilterIndexSetting()
+	}
+	if err == nil {
+		err = db.loadPruneSetting(funcName, dbOpts)
+	}
+	if err == nil {
+		var size int
+		size, err = parseHeaderCacheSize(funcName, dbOpts)
+		db.hdrCache = newHdrCache(size)
+	}
+	if err == nil {
+		var size int
+		size, err = parseMissCacheSize(funcName, dbOpts)
+		db.blkMisses = newMissCache(size)
+		db.txMisses = newMissCache(size)
+	}
+	if err == nil {
+		var size int
+		size, err = parseLocationCacheSize(funcName, dbOpts)
+		db.locCache = newLocCache(size)
+	}
+	if err == nil {
+		db.coalesceSize, db.coalesceInterval, err =
+			parseCoalesce(funcName, dbOpts)
+	}
+	if err == nil {
+		db.codec, err = parseCompression(funcName, dbOpts)
+	}
+	if err == nil {
+		db.coldStore, db.hotRetention, err = parseTier(funcName, dbOpts)
+	}
+	if err == nil {
+		err = db.loadUtxoState()
+	}
+	if err == nil {
+		err = db.loadHeaderIndexSetting()
+	}
+	if err == nil {
+		err = db.loadChecksumSetting()
+	}
+	if err == nil {
+		err = db.loadBlockFlagsSetting()
+	}
+	if err == nil {
+		err = db.loadTxPosSetting()
+	}
+	if err == nil {
+		err = db.loadBlockFileSetting(dbpath)
+	}
+	if err == nil && db.blkFiles != nil && db.codec != nil {
+		err = fmt.Errorf("%s setting to ldb.%s is invalid -- blocks "+
+			"stored in flat files are not compressed",
+			CompressionOption, funcName)
+	}
+	if err == nil && db.blkFiles != nil && db.aead != nil {
+		err = fmt.Errorf("%s setting to ldb.%s is invalid -- blocks "+
+			"stored in flat files are not encrypted",
+			EncryptionKeyOption, funcName)
+	}
+	if err == nil && !create && db.blkFiles == nil && db.coldStore != nil {
+		err = fmt.Errorf("%s and %s settings to ldb.%s are invalid -- "+
+			"only blocks stored in flat files are moved to a cold tier",
+			ColdPathOption, ColdStoreOption, funcName)
+	}
+
+	// Blocks are compressed with the built-in zstd codec unless another
+	// codec is requested, except by databases holding blocks stored before
+	// they were preceded by the ID of their codec, which are only migrated
+	// when a codec is requested.
+	if err == nil && db.codec == nil && db.blkFiles == nil &&
+		(create || db.flagHeight == allBlocksFlagged) {
+
+		db.codec = codecByID(ZstdCodecID)
+	}
+	if err != nil {
+		tlDb.Close()
+		return
+	}
 
 	// If we opened the database successfully on 'create'
 	// update the
@@ -236,56 +607,326 @@ func openDB(dbpath string, create bool) (pbdb btcdb.Db, err error) {
 
 // CreateDB creates, initializes and opens a database for use.
 func CreateDB(args ...interface{}) (btcdb.Db, error) {
-	dbpath, err := parseArgs("Create", args...)
+	dbOpts, err := parseArgs("Create", args...)
+	if err != nil {
+		return nil, err
+	}
+	_, coldPath := dbOpts.Backend[ColdPathOption]
+	_, coldStore := dbOpts.Backend[ColdStoreOption]
+	if coldPath || coldStore {
+		return nil, fmt.Errorf("ldb.CreateDB can not tier blocks -- " +
+			"only blocks stored in flat files are moved to a cold tier")
+	}
+
+	db, err := createDB(dbOpts)
 	if err != nil {
 		return nil, err
 	}
+	db.startSyncer(dbOpts)
+	return db, nil
+}
 
-	log = btcdb.GetLog()
+// createDB creates, initializes and opens a database described by the passed
+// options without starting its periodic syncs.
+func createDB(dbOpts *btcdb.Options) (*LevelDb, error) {
+	headersOnly, err := parseHeadersOnly("CreateDB", dbOpts)
+	if err != nil {
+		return nil, err
+	}
 
 	// No special setup needed, just OpenBB
-	db, err := openDB(dbpath, true)
+	db, err := openDB(dbOpts, true)
 	if err == nil {
 		ldb := db.(*LevelDb)
 		ldb.lastBlkIdx = -1
 		ldb.nextBlock = 0
+
+		// New databases maintain the unspent transaction output set
+		// from the start unless they only store headers.
+		if headersOnly {
+			err = ldb.put(headersOnlyKey, []byte{1})
+			ldb.headersOnly = true
+		} else {
+			err = ldb.put(utxoStateKey, make([]byte, 8))
+			ldb.utxoTracked = true
+		}
+		if err != nil {
+			ldb.close()
+			return nil, err
+		}
+
+		err = ldb.put(headerIndexKey, []byte{1})
+		if err != nil {
+			ldb.close()
+			return nil, err
+		}
+		ldb.headerIndex = true
+
+		err = ldb.put(checksumKey, []byte{1})
+		if err != nil {
+			ldb.close()
+			return nil, err
+		}
+		ldb.checksums = true
+
+		err = ldb.put(chainWorkKey, []byte{1})
+		if err != nil {
+			ldb.close()
+			return nil, err
+		}
+		ldb.chainWork = true
+
+		err = ldb.put(blockFlagsKey, blockFlagsValue(allBlocksFlagged))
+		if err != nil {
+			ldb.close()
+			return nil, err
+		}
+		ldb.flagHeight = allBlocksFlagged
+
+		err = ldb.put(txPosKey, txPosValue(0))
+		if err != nil {
+			ldb.close()
+			return nil, err
+		}
+		ldb.txPosHeight = 0
+
+		if dbOpts.TxIndex {
+			err = ldb.enableTxIndex(true)
+			if err != nil {
+				ldb.close()
+				return nil, err
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
-	return db, err
+	return db.(*LevelDb), nil
 }
 
 func (db *LevelDb) close() {
+	// A snapshot only owns the leveldb snapshot it reads from.
+	if db.snap != nil {
+		db.snap.Release()
+		db.closed = true
+		db.root.forgetSnapshot(db)
+		return
+	}
+
+	// Snapshots which are still open read from leveldb, so they are
+	// closed first.
+	db.closeSnapshots()
+
+	if db.blkFiles != nil {
+		db.blkFiles.close()
+	}
+	db.notifier.Close()
 	db.lDb.Close()
+	db.lock.Unlock()
+	db.closed = true
 }
 
-// Sync verifies that the database is coherent on disk,
-// and no outstanding transactions are in flight.
+// Sync waits for outstanding transactions to finish and syncs all data
+// written so far to disk.  This is part of the btcdb.Db interface
+// implementation.
 func (db *LevelDb) Sync() {
 	db.dbLock.Lock()
 	defer db.dbLock.Unlock()
 
-	// while specified by the API, does nothing
-	// however does grab lock to verify it does not return until other operations are complete.
+	if db.closed || db.readOnly {
+		return
+	}
+	db.flush()
+	if err := db.sync(); err != nil {
+		log.Warnf("Sync: %v", err)
+	}
+}
+
+// sync syncs the flat block files followed by the leveldb journal.  Leveldb
+// only syncs its journal as part of a write, so the deletion of a key which is
+// never stored is written with syncing enabled.
+// Must be called with db write lock held.
+func (db *LevelDb) sync() error {
+	if db.blkFiles != nil {
+		if err := db.blkFiles.sync(); err != nil {
+			return err
+		}
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(syncKey)
+	return db.writeBatch(batch, &opt.WriteOptions{Sync: true})
+}
+
+// startSyncer starts the periodic syncs of the SyncPeriodic policy when the
+// database was opened for writing with it, along with the periodic inserts of
+// the blocks held by InsertBlock when coalescing is turned on and the periodic
+// moves of old block files when storage is tiered.
+func (db *LevelDb) startSyncer(dbOpts *btcdb.Options) {
+	if dbOpts.Sync == btcdb.SyncPeriodic && !db.readOnly {
+		db.syncer.Start(dbOpts.SyncInterval, db.Sync)
+	}
+	if db.coalesceSize > 0 && !db.readOnly {
+		db.flusher.Start(db.coalesceInterval, db.flushHeld)
+	}
+	if db.blkFiles != nil && db.coldStore != nil && !db.readOnly {
+		db.demoter.Start(demoteInterval, db.demoteOld)
+	}
 }
 
 // Close cleanly shuts down database, syncing all data.
 func (db *LevelDb) Close() {
+	// The periodic syncs and flushes and reading ahead take the lock, so
+	// they are stopped first.
+	db.syncer.Stop()
+	db.flusher.Stop()
+	db.demoter.Stop()
+	db.readAhead.Stop()
+
+	// The chains of other networks are closed along with the database.
+	db.closeNetworks()
+
 	db.dbLock.Lock()
 	defer db.dbLock.Unlock()
 
+	if db.closed {
+		return
+	}
+
+	if !db.readOnly {
+		db.flush()
+		if err := db.sync(); err != nil {
+			log.Warnf("Close: %v", err)
+		}
+	}
 	db.close()
 }
 
+// Closed returns whether the database has been closed.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) Closed() bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	return db.closed
+}
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain.  Events are delivered once the leveldb batch of a change is
+// written.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) Subscribe() (*btcdb.Subscription, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	return db.notifier.Subscribe()
+}
+
+// AddIndexer initializes the passed indexer, catches it up with the chain and
+// from then on updates it in the same leveldb batch as the blocks.  This is
+// part of the btcdb.Db interface implementation.
+func (db *LevelDb) AddIndexer(idx btcdb.Indexer) error {
+	db.readLock()
+	closed, readOnly := db.closed, db.readOnly
+	db.dbLock.RUnlock()
+
+	if closed {
+		return btcdb.ErrDbClosed
+	}
+	if readOnly {
+		return btcdb.ErrReadOnly
+	}
+	return db.indexers.Add(db, idx)
+}
+
 // DropAfterBlockBySha will remove any blocks from the database after
 // the given block.
-func (db *LevelDb) DropAfterBlockBySha(sha *btcwire.ShaHash) (rerr error) {
+func (db *LevelDb) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
+	db.dbLock.Lock()
+	op.Locked()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	return db.dropAfterBlockBySha(sha, nil)
+}
+
+// DropAfterBlockByShaWithMeta removes any blocks from the database after the
+// given block and applies the passed changes to the metadata namespace in the
+// same batch.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
 	db.dbLock.Lock()
+	op.Locked()
 	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	return db.dropAfterBlockBySha(sha, meta)
+}
+
+// dropAfterBlockBySha adds the removal of all blocks after the given block
+// along with the passed changes to the metadata namespace to a single batch and
+// commits it.  The batch is discarded and the cached chain tip restored when
+// any of the blocks fails to be removed or the batch fails to commit.
+// Must be called with db write lock held.
+func (db *LevelDb) dropAfterBlockBySha(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) (rerr error) {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	db.flush()
+
+	// dropLoc is the flat file location of the lowest dropped block, the
+	// block files are truncated to it once the drop is committed.  Any
+	// data left beyond it by a crash before then is discarded when the
+	// database is next opened.
+	var dropLoc *blockLoc
+	var disconnected []btcdb.ChainEvent
+	lastBlkShaCached := db.lastBlkShaCached
+	lastBlkSha := db.lastBlkSha
+	lastBlkIdx := db.lastBlkIdx
+	lastBlkWork := db.lastBlkWork
+	nextBlock := db.nextBlock
 	defer func() {
 		if rerr == nil {
 			rerr = db.processBatches()
+			if rerr == nil {
+				db.blockCache.RemoveFrom(db.nextBlock)
+				db.hdrCache.removeFrom(db.nextBlock)
+				db.notifier.Notify(disconnected...)
+				if dropLoc != nil {
+					rerr = db.blkFiles.truncate(*dropLoc)
+				}
+				return
+			}
 		} else {
 			db.lBatch().Reset()
+			db.resetUtxoUpdates()
 		}
+
+		// Nothing was committed, so the pending transaction updates
+		// are discarded and the cached chain tip restored.
+		db.txUpdateMap = map[btcwire.ShaHash]*txUpdateObj{}
+		db.txSpentUpdateMap = make(map[btcwire.ShaHash]*spentTxUpdate)
+		db.lastBlkShaCached = lastBlkShaCached
+		db.lastBlkSha = lastBlkSha
+		db.lastBlkIdx = lastBlkIdx
+		db.lastBlkWork = lastBlkWork
+		db.nextBlock = nextBlock
 	}()
 
 	startheight := db.nextBlock - 1
@@ -296,88 +937,368 @@ func (db *LevelDb) DropAfterBlockBySha(sha *btcwire.ShaHash) (rerr error) {
 		log.Tracef("block loc failed %v ", sha)
 		return err
 	}
+	if keepidx+1 < db.pruneHeight {
+		return btcdb.ErrPruned
+	}
 
+	// The dropped blocks are only kept when there are indexers to
+	// disconnect them from.
+	var dropped []*btcutil.Block
+	var droppedHeights []int64
+	var droppedSpent [][]*btcdb.UtxoEntry
 	for height := startheight; height > keepidx; height = height - 1 {
-		var blk *btcutil.Block
-		blksha, buf, err := db.getBlkByHeight(height)
+		blksha, blk, spent, err := db.dropBlock(height)
 		if err != nil {
 			return err
 		}
-		blk, err = btcutil.NewBlockFromBytes(buf)
+		if db.indexers.Len() != 0 {
+			dropped = append(dropped, blk)
+			droppedHeights = append(droppedHeights, height)
+			droppedSpent = append(droppedSpent, spent)
+		}
+		disconnected = append(disconnected,
+			btcdb.BlockDisconnected{Sha: *blksha, Height: height})
+	}
+	if db.blkFiles != nil && startheight > keepidx {
+		_, loc, err := db.getBlkLocByHeight(keepidx + 1)
 		if err != nil {
 			return err
 		}
+		loc.length = 0
+		dropLoc = &loc
+	}
+	idxMeta, err := db.indexers.DisconnectBlocks(dropped, droppedHeights,
+		droppedSpent, db.getMeta)
+	if err != nil {
+		return err
+	}
+	db.putMeta(meta)
+	db.putMeta(idxMeta)
+
+	db.nextBlock = keepidx + 1
+	db.lastBlkShaCached = true
+	db.lastBlkSha = *sha
+	db.lastBlkIdx = keepidx
+
+	return db.loadTipWork()
+}
+
+// dropBlock adds the removal of the block at the given height, which must be
+// the newest block not already removed, to the current batch and unwinds its
+// spend information.  It returns the hash of the block along with the block,
+// which only has a header when the database only stores headers, and the
+// outputs spent by it recorded by its undo data, which are nil when they are
+// not known.
+// Must be called with db write lock held.
+func (db *LevelDb) dropBlock(height int64) (*btcwire.ShaHash, *btcutil.Block, []*btcdb.UtxoEntry, error) {
+	if db.headersOnly {
+		blksha, err := db.fetchBlockShaByHeight(height)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bh, err := db.fetchHeaderByHeight(height)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		db.dropBlockRecords(blksha, height)
+		blk := btcutil.NewBlock(&btcwire.MsgBlock{Header: *bh})
+		return blksha, blk, nil, nil
+	}
+
+	blksha, buf, err := db.getBlkByHeight(height)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	blk, err := btcutil.NewBlockFromBytes(buf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	undo, err := db.getUndo(blksha)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, tx := range blk.MsgBlock().Transactions {
+		err = db.unSpend(tx, undo)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	db.lBatch().Delete(shaUndoToKey(blksha))
+	// rather than iterate the list of tx backward, do it twice.
+	for _, tx := range blk.Transactions() {
+		var txUo txUpdateObj
+		txUo.delete = true
+		db.txUpdateMap[*tx.Sha()] = &txUo
 
-		for _, tx := range blk.MsgBlock().Transactions {
-			err = db.unSpend(tx)
+		if db.utxoTracked {
+			err = db.removeTxUtxos(tx.MsgTx(), tx.Sha())
 			if err != nil {
-				return err
+				return nil, nil, nil, err
 			}
 		}
-		// rather than iterate the list of tx backward, do it twice.
-		for _, tx := range blk.Transactions() {
-			var txUo txUpdateObj
-			txUo.delete = true
-			db.txUpdateMap[*tx.Sha()] = &txUo
+	}
+	if db.txIndex {
+		db.unindexBlockTxs(blk)
+	}
+	// The earlier instances of transactions overwritten by duplicates in
+	// the block are available again once the duplicates are removed.
+	for _, tx := range blk.Transactions() {
+		if err := db.restoreOverwrittenTx(tx.Sha()); err != nil {
+			return nil, nil, nil, err
 		}
-		db.lBatch().Delete(shaBlkToKey(blksha))
-		db.lBatch().Delete(int64ToKey(height))
 	}
+	if db.spendIndex {
+		db.unindexBlockSpends(blk)
+	}
+	db.dropBlockRecords(blksha, height)
+	return blksha, blk, spentFromUndo(blk, undo), nil
+}
 
-	db.nextBlock = keepidx + 1
-
-	return nil
+// dropBlockRecords adds the removal of the records kept for the block with the
+// given hash at the given height to the current batch.  Only the records kept
+// by height are removed when the hash is nil.
+// Must be called with db write lock held.
+func (db *LevelDb) dropBlockRecords(sha *btcwire.ShaHash, height int64) {
+	if sha != nil {
+		db.lBatch().Delete(shaBlkToKey(sha))
+	}
+	db.lBatch().Delete(heightBlkToKey(height))
+	db.lBatch().Delete(heightHeaderToKey(height))
+	db.lBatch().Delete(heightWorkToKey(height))
+	if db.filterIndex {
+		db.lBatch().Delete(heightFilterToKey(height))
+	}
 }
 
 // InsertBlock inserts raw block and transaction data from a block into the
 // database.  The first block inserted into the database will be treated as the
 // genesis block.  Every subsequent block insert requires the referenced parent
 // block to already exist.
+//
+// When coalescing is turned on with the CoalesceSizeOption setting, blocks which
+// extend the chain are held and inserted together once enough of them are held,
+// the coalescing interval passed, Flush is called, the database is changed
+// otherwise or read.  Reads therefore see every block once InsertBlock returns.
+// A block which fails validation is refused by its own call, while an error
+// inserting a held block is returned by the next call to InsertBlock or Flush,
+// after the blocks held before the failing one are inserted.
 func (db *LevelDb) InsertBlock(block *btcutil.Block) (height int64, rerr error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, block)
+	defer op.Done()
 	db.dbLock.Lock()
+	op.Locked()
 	defer db.dbLock.Unlock()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, 1)
+
+	if db.closed {
+		return 0, btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return 0, btcdb.ErrReadOnly
+	}
+
+	if db.coalesceSize > 0 {
+		return db.holdBlock(block)
+	}
+	heights, err := db.insertBlocks([]*btcutil.Block{block}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return heights[0], nil
+}
+
+// InsertBlocks inserts a run of blocks in order using a single leveldb write
+// batch and returns the height of each.  Every block must connect to the one
+// before it and the first to a block already in the database.  When any of
+// the blocks fails to insert, none of them are.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) InsertBlocks(blocks []*btcutil.Block) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.dbLock.Lock()
+	op.Locked()
+	defer db.dbLock.Unlock()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+	db.flush()
+
+	return db.insertBlocks(blocks, nil)
+}
+
+// insertBlocks adds the passed blocks along with the passed changes to the
+// metadata namespace to a single batch and commits it.  The batch is discarded
+// and the cached chain tip restored when any of the blocks fails to insert or
+// the batch fails to commit.
+// Must be called with db write lock held.
+func (db *LevelDb) insertBlocks(blocks []*btcutil.Block, meta *btcdb.MetaBatch) (heights []int64, rerr error) {
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Validate the linkage of the whole run up front since the blocks
+	// earlier in the run are not in leveldb until the batch is written.
+	for i := 1; i < len(blocks); i++ {
+		prevSha, err := blocks[i-1].Sha()
+		if err != nil {
+			return nil, err
+		}
+		if !blocks[i].MsgBlock().Header.PrevBlock.IsEqual(prevSha) {
+			return nil, btcdb.PrevShaMissing
+		}
+	}
+
+	lastBlkShaCached := db.lastBlkShaCached
+	lastBlkSha := db.lastBlkSha
+	lastBlkIdx := db.lastBlkIdx
+	lastBlkWork := db.lastBlkWork
+	nextBlock := db.nextBlock
+	var connected []btcdb.ChainEvent
 	defer func() {
 		if rerr == nil {
 			rerr = db.processBatches()
+			if rerr == nil {
+				if !db.headersOnly {
+					db.blockCache.AddBlocks(blocks, heights)
+				}
+				db.cacheHeaders(blocks, heights)
+				db.forgetInsertedBlocks(blocks)
+				db.notifier.Notify(connected...)
+				db.pruneRetained()
+			}
 		} else {
 			db.lBatch().Reset()
+			db.resetUtxoUpdates()
+			db.rollbackBlockFiles()
+		}
+		db.resetFilterUpdates()
+		if rerr != nil {
+			heights = nil
+			db.txUpdateMap = map[btcwire.ShaHash]*txUpdateObj{}
+			db.txSpentUpdateMap = make(map[btcwire.ShaHash]*spentTxUpdate)
+			db.lastBlkShaCached = lastBlkShaCached
+			db.lastBlkSha = lastBlkSha
+			db.lastBlkIdx = lastBlkIdx
+			db.lastBlkWork = lastBlkWork
+			db.nextBlock = nextBlock
 		}
 	}()
 
+	heights = make([]int64, 0, len(blocks))
+	spent := make([][]*btcdb.UtxoEntry, 0, len(blocks))
+	for _, block := range blocks {
+		height, blkSpent, err := db.insertBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		heights = append(heights, height)
+		spent = append(spent, blkSpent)
+		sha, _ := block.Sha()
+		connected = append(connected,
+			btcdb.BlockConnected{Sha: *sha, Height: height})
+	}
+	idxMeta, err := db.indexers.ConnectBlocks(blocks, heights, spent,
+		db.getMeta)
+	if err != nil {
+		return nil, err
+	}
+	db.putMeta(meta)
+	db.putMeta(idxMeta)
+	return heights, nil
+}
+
+// insertBlock adds the raw block and transaction data of the passed block to
+// the current batch.  It returns the height of the block along with the outputs
+// spent by it, which are nil when they are not known because the unspent output
+// set is not kept.
+// Must be called with db write lock held.
+func (db *LevelDb) insertBlock(block *btcutil.Block) (int64, []*btcdb.UtxoEntry, error) {
 	blocksha, err := block.Sha()
 	if err != nil {
 		log.Warnf("Failed to compute block sha %v", blocksha)
-		return 0, err
+		return 0, nil, err
+	}
+	var tipSha *btcwire.ShaHash
+	if db.lastBlkIdx != -1 {
+		tipSha = &db.lastBlkSha
+	}
+	if err := btcdb.CheckBlock(block, db.opts.Validation, tipSha); err != nil {
+		log.Warnf("Failed to validate block %v: %v", blocksha, err)
+		return 0, nil, err
 	}
 	mblock := block.MsgBlock()
+
+	// Only the header is kept when the database stores nothing else.
+	if db.headersOnly {
+		newheight, err := db.insertHeader(blocksha, &mblock.Header)
+		if err != nil {
+			log.Warnf("Failed to insert header %v %v %v", blocksha,
+				&mblock.Header.PrevBlock, err)
+			return 0, nil, err
+		}
+		return newheight, nil, nil
+	}
+
 	rawMsg, err := block.Bytes()
 	if err != nil {
 		log.Warnf("Failed to obtain raw block sha %v", blocksha)
-		return 0, err
+		return 0, nil, err
 	}
 	txloc, err := block.TxLoc()
 	if err != nil {
 		log.Warnf("Failed to obtain raw block sha %v", blocksha)
-		return 0, err
+		return 0, nil, err
 	}
 
 	// Insert block into database
+	tipIdx, tipWork := db.lastBlkIdx, db.lastBlkWork
 	newheight, err := db.insertBlockData(blocksha, &mblock.Header.PrevBlock,
 		rawMsg)
 	if err != nil {
 		log.Warnf("Failed to insert block %v %v %v", blocksha,
 			&mblock.Header.PrevBlock, err)
-		return 0, err
+		return 0, nil, err
+	}
+	err = db.putChainWork(newheight, mblock.Header.Bits, tipIdx, tipWork)
+	if err != nil {
+		log.Warnf("Failed to store chain work of block %v %v",
+			blocksha, err)
+		return 0, nil, err
 	}
 
-	// At least two blocks in the long past were generated by faulty
-	// miners, the sha of the transaction exists in a previous block,
-	// detect this condition and 'accept' the block.
+	if db.txIndex {
+		err = db.indexBlockTxs(blocksha, newheight, block)
+		if err != nil {
+			log.Warnf("Failed to index transactions for block %v %v",
+				blocksha, err)
+			return 0, nil, err
+		}
+	}
+	if db.spendIndex {
+		db.indexBlockSpends(newheight, block)
+	}
+	if db.filterIndex {
+		if err := db.putFilter(newheight, block); err != nil {
+			log.Warnf("Failed to build filter for block %v %v",
+				blocksha, err)
+			return 0, nil, err
+		}
+	}
+
+	var undo []byte
+	var spent []*btcdb.UtxoEntry
+	inBlock := make(map[btcwire.ShaHash]struct{}, len(mblock.Transactions))
 	for txidx, tx := range mblock.Transactions {
 		txsha, err := block.TxSha(txidx)
 		if err != nil {
 			log.Warnf("failed to compute tx name block %v idx %v err %v", blocksha, txidx, err)
-			return 0, err
+			return 0, nil, err
 		}
 		spentbuflen := (len(tx.TxOut) + 7) / 8
 		spentbuf := make([]byte, spentbuflen, spentbuflen)
@@ -387,61 +1308,64 @@ func (db *LevelDb) InsertBlock(block *btcutil.Block) (height int64, rerr error)
 			}
 		}
 
-		err = db.insertTx(txsha, newheight, txloc[txidx].TxStart, txloc[txidx].TxLen, spentbuf)
+		// Prevent duplicate transactions in the same block, and in
+		// earlier blocks unless the old one is fully spent or the
+		// duplicate is one of the two which were accepted before
+		// BIP0030, which overwrite the old one.
+		if _, ok := inBlock[*txsha]; ok {
+			log.Warnf("Block contains duplicate transaction %s", txsha)
+			return 0, nil, btcdb.DuplicateSha
+		}
+		inBlock[*txsha] = struct{}{}
+		prevTx, err := db.fetchUnspentTx(txsha)
 		if err != nil {
-			log.Warnf("block %v idx %v failed to insert tx %v %v err %v", blocksha, newheight, &txsha, txidx, err)
-			return 0, err
+			return 0, nil, err
 		}
-
-		// Some old blocks contain duplicate transactions
-		// Attempt to cleanly bypass this problem by marking the
-		// first as fully spent.
-		// http://blockexplorer.com/b/91812 dup in 91842
-		// http://blockexplorer.com/b/91722 dup in 91880
-		if newheight == 91812 {
-			dupsha, err := btcwire.NewShaHashFromStr("d5d27987d2a3dfc724e359870c6644b40e497bdc0589a033220fe15429d88599")
-			if err != nil {
-				panic("invalid sha string in source")
+		if prevTx != nil {
+			if !btcdb.IsBIP30Exception(newheight, txsha) {
+				log.Warnf("Attempt to insert duplicate "+
+					"transaction %s", txsha)
+				return 0, nil, btcdb.DuplicateSha
 			}
-			if txsha.IsEqual(dupsha) {
-				// marking TxOut[0] as spent
-				po := btcwire.NewOutPoint(dupsha, 0)
-				txI := btcwire.NewTxIn(po, []byte("garbage"))
-
-				var spendtx btcwire.MsgTx
-				spendtx.AddTxIn(txI)
-				err = db.doSpend(&spendtx)
-				if err != nil {
-					log.Warnf("block %v idx %v failed to spend tx %v %v err %v", blocksha, newheight, &txsha, txidx, err)
-				}
+			if err := db.overwriteTx(txsha, prevTx); err != nil {
+				log.Warnf("block %v idx %v failed to overwrite tx %v err %v", blocksha, txidx, txsha, err)
+				return 0, nil, err
 			}
 		}
-		if newheight == 91722 {
-			dupsha, err := btcwire.NewShaHashFromStr("e3bf3d07d4b0375638d5f1db5255fe07ba2c4cb067cd81b84ee974b6585fb468")
+
+		err = db.insertTx(txsha, newheight, txidx, txloc[txidx].TxStart, txloc[txidx].TxLen, spentbuf)
+		if err != nil {
+			log.Warnf("block %v idx %v failed to insert tx %v %v err %v", blocksha, newheight, &txsha, txidx, err)
+			return 0, nil, err
+		}
+		if db.utxoTracked {
+			db.addTxUtxos(tx, txsha, newheight)
+		}
+
+		if db.utxoTracked && txidx != 0 {
+			undo, spent, err = db.appendUndo(undo, spent, tx)
 			if err != nil {
-				panic("invalid sha string in source")
-			}
-			if txsha.IsEqual(dupsha) {
-				// marking TxOut[0] as spent
-				po := btcwire.NewOutPoint(dupsha, 0)
-				txI := btcwire.NewTxIn(po, []byte("garbage"))
-
-				var spendtx btcwire.MsgTx
-				spendtx.AddTxIn(txI)
-				err = db.doSpend(&spendtx)
-				if err != nil {
-					log.Warnf("block %v idx %v failed to spend tx %v %v err %v", blocksha, newheight, &txsha, txidx, err)
-				}
+				log.Warnf("block %v idx %v failed to record undo data for tx %v err %v", blocksha, newheight, txsha, err)
+				return 0, nil, err
 			}
 		}
 
 		err = db.doSpend(tx)
 		if err != nil {
 			log.Warnf("block %v idx %v failed to spend tx %v %v err %v", blocksha, newheight, txsha, txidx, err)
-			return 0, err
+			return 0, nil, err
+		}
+	}
+	if !db.utxoTracked {
+		return newheight, nil, nil
+	}
+	db.lBatch().Put(shaUndoToKey(blocksha), undo)
+	for _, entry := range spent {
+		if entry == nil {
+			return newheight, nil, nil
 		}
 	}
-	return newheight, nil
+	return newheight, spent, nil
 }
 
 // doSpend iterates all TxIn in a bitcoin transaction marking each associated
@@ -463,13 +1387,17 @@ func (db *LevelDb) doSpend(tx *btcwire.MsgTx) error {
 		if err != nil {
 			return err
 		}
+		if db.utxoTracked {
+			db.spendUtxo(&txin.PreviousOutpoint)
+		}
 	}
 	return nil
 }
 
 // unSpend iterates all TxIn in a bitcoin transaction marking each associated
-// TxOut as unspent.
-func (db *LevelDb) unSpend(tx *btcwire.MsgTx) error {
+// TxOut as unspent.  The passed undo entries, if any, are used to restore the
+// outputs to the unspent transaction output set.
+func (db *LevelDb) unSpend(tx *btcwire.MsgTx, undo map[btcwire.OutPoint]*btcdb.UtxoEntry) error {
 	for txinidx := range tx.TxIn {
 		txin := tx.TxIn[txinidx]
 
@@ -484,6 +1412,16 @@ func (db *LevelDb) unSpend(tx *btcwire.MsgTx) error {
 		if err != nil {
 			return err
 		}
+		if db.utxoTracked {
+			if entry, ok := undo[txin.PreviousOutpoint]; ok {
+				db.restoreUtxoEntry(&txin.PreviousOutpoint, entry)
+				continue
+			}
+			err = db.restoreUtxo(&txin.PreviousOutpoint)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -503,7 +1441,7 @@ func (db *LevelDb) setclearSpentData(txsha *btcwire.ShaHash, idx uint32, set boo
 	if txUo, ok = db.txUpdateMap[*txsha]; !ok {
 		// not cached, load from db
 		var txU txUpdateObj
-		blkHeight, txOff, txLen, spentData, err := db.getTxData(txsha)
+		blkHeight, txOff, txLen, txIdx, spentData, err := db.getTxData(txsha)
 		if err != nil {
 			// setting a fully spent tx is an error.
 			if set == true {
@@ -512,24 +1450,14 @@ func (db *LevelDb) setclearSpentData(txsha *btcwire.ShaHash, idx uint32, set boo
 			// if we are clearing a tx and it wasn't found
 			// in the tx table, it could be in the fully spent
 			// (duplicates) table.
-			spentTxList, err := db.getTxFullySpent(txsha)
+			sTx, err := db.popFullySpent(txsha)
 			if err != nil {
 				return err
 			}
 
-			// need to reslice the list to exclude the most recent.
-			sTx := spentTxList[len(spentTxList)-1]
-			spentTxList[len(spentTxList)-1] = nil
-			if len(spentTxList) == 1 {
-				// write entry to delete tx from spent pool
-				// XXX
-			} else {
-				spentTxList = spentTxList[:len(spentTxList)-1]
-				// XXX format sTxList and set update Table
-			}
-
 			// Create 'new' Tx update data.
 			blkHeight = sTx.blkHeight
+			txIdx = sTx.txidx
 			txOff = sTx.txoff
 			txLen = sTx.txlen
 			spentbuflen := (sTx.numTxO + 7) / 8
@@ -541,6 +1469,7 @@ func (db *LevelDb) setclearSpentData(txsha *btcwire.ShaHash, idx uint32, set boo
 
 		txU.txSha = txsha
 		txU.blkHeight = blkHeight
+		txU.txidx = txIdx
 		txU.txoff = txOff
 		txU.txlen = txLen
 		txU.spentData = spentData
@@ -566,37 +1495,11 @@ func (db *LevelDb) setclearSpentData(txsha *btcwire.ShaHash, idx uint32, set boo
 		}
 	}
 	if fullySpent {
-		var txSu *spentTxUpdate
-		// Look up Tx in fully spent table
-		if txSuOld, ok := db.txSpentUpdateMap[*txsha]; ok {
-			txSu = txSuOld
-		} else {
-			var txSuStore spentTxUpdate
-			txSu = &txSuStore
-
-			txSuOld, err := db.getTxFullySpent(txsha)
-			if err == nil {
-				txSu.txl = txSuOld
-			}
-		}
-
-		// Fill in spentTx
-		var sTx spentTx
-		sTx.blkHeight = txUo.blkHeight
-		sTx.txoff = txUo.txoff
-		sTx.txlen = txUo.txlen
-		// XXX -- there is no way to comput the real TxOut
-		// from the spent array.
-		sTx.numTxO = 8 * len(txUo.spentData)
-
-		// append this txdata to fully spent txlist
-		txSu.txl = append(txSu.txl, &sTx)
+		db.appendFullySpent(txsha, txUo)
 
 		// mark txsha as deleted in the txUpdateMap
 		log.Tracef("***tx %v is fully spent\n", txsha)
 
-		db.txSpentUpdateMap[*txsha] = txSu
-
 		txUo.delete = true
 		db.txUpdateMap[*txsha] = txUo
 	} else {
@@ -606,26 +1509,33 @@ func (db *LevelDb) setclearSpentData(txsha *btcwire.ShaHash, idx uint32, set boo
 	return nil
 }
 
-func int64ToKey(keyint int64) []byte {
-	key := fmt.Sprintf("%d", keyint)
-	return []byte(key)
+// heightBlkToKey returns the key for the hash and body, or flat file location,
+// of the block at the given height.
+func heightBlkToKey(height int64) []byte {
+	return heightKey(blockNs, height)
 }
 
+// shaBlkToKey returns the key for the height of the block with the given hash.
 func shaBlkToKey(sha *btcwire.ShaHash) []byte {
-	shaB := sha.Bytes()
-	return shaB
+	return shaKey(blockShaNs, sha)
 }
 
+// shaTxToKey returns the key for the record of the transaction with the given
+// hash.
 func shaTxToKey(sha *btcwire.ShaHash) []byte {
-	shaB := sha.Bytes()
-	shaB = append(shaB, "tx"...)
-	return shaB
+	return shaKey(txNs, sha)
 }
 
+// shaSpentTxToKey returns the key for the spend record of the fully spent
+// transaction with the given hash.
 func shaSpentTxToKey(sha *btcwire.ShaHash) []byte {
-	shaB := sha.Bytes()
-	shaB = append(shaB, "sx"...)
-	return shaB
+	return shaKey(spentTxNs, sha)
+}
+
+// shaOverwrittenTxToKey returns the key for the record of the earlier instance
+// of the transaction with the given hash which was overwritten by a duplicate.
+func shaOverwrittenTxToKey(sha *btcwire.ShaHash) []byte {
+	return shaKey(overwrittenTxNs, sha)
 }
 
 func (db *LevelDb) lBatch() *leveldb.Batch {
@@ -635,10 +1545,23 @@ func (db *LevelDb) lBatch() *leveldb.Batch {
 	return db.lbatch
 }
 
+// rollbackBlockFiles discards any raw block data written to the flat block
+// files which is not referenced by a committed batch.
+// Must be called with db write lock held.
+func (db *LevelDb) rollbackBlockFiles() {
+	if db.blkFiles == nil {
+		return
+	}
+	if err := db.blkFiles.rollback(); err != nil {
+		log.Warnf("unable to discard uncommitted block data: %v", err)
+	}
+}
+
 func (db *LevelDb) processBatches() error {
 	var err error
 
-	if len(db.txUpdateMap) != 0 || len(db.txSpentUpdateMap) != 0 || db.lbatch != nil {
+	if len(db.txUpdateMap) != 0 || len(db.txSpentUpdateMap) != 0 ||
+		len(db.utxoUpdateMap) != 0 || db.lbatch != nil {
 		if db.lbatch == nil {
 			db.lbatch = new(leveldb.Batch)
 		}
@@ -674,21 +1597,63 @@ func (db *LevelDb) processBatches() error {
 			}
 		}
 
-		err = db.lDb.Write(db.lbatch, db.wo)
+		var newUtxoSetSize int64
+		if db.utxoTracked {
+			newUtxoSetSize = db.processUtxoUpdates()
+		}
+
+		// The block data has to be on disk before the batch which
+		// references it when writes are synced.
+		if db.blkFiles != nil && db.wo != nil && db.wo.Sync {
+			if err := db.blkFiles.sync(); err != nil {
+				db.resetUtxoUpdates()
+				db.rollbackBlockFiles()
+				return err
+			}
+		}
+
+		err = db.writeBatch(db.lbatch, db.wo)
 		if err != nil {
 			log.Tracef("batch failed %v\n", err)
+			db.resetUtxoUpdates()
+			db.rollbackBlockFiles()
 			return err
 		}
+		if db.blkFiles != nil {
+			db.blkFiles.commit()
+		}
+		if db.txMisses != nil {
+			for txSha, txU := range db.txUpdateMap {
+				if !txU.delete {
+					db.txMisses.remove(&txSha)
+				}
+			}
+		}
 		db.txUpdateMap = map[btcwire.ShaHash]*txUpdateObj{}
 		db.txSpentUpdateMap = make(map[btcwire.ShaHash]*spentTxUpdate)
+		if db.utxoTracked {
+			db.utxoSetSize = newUtxoSetSize
+		}
+		db.resetUtxoUpdates()
+		db.reportStats()
 	}
 
 	return nil
 }
 
 func (db *LevelDb) RollbackClose() {
+	db.flusher.Stop()
+	db.readAhead.Stop()
+
+	// The chains of other networks are closed along with the database.
+	db.closeNetworks()
+
 	db.dbLock.Lock()
 	defer db.dbLock.Unlock()
 
+	if db.closed {
+		return
+	}
+
 	db.close()
 }
@@ -0,0 +1,55 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	height, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	return db.blockLocator(height)
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (db *LevelDb) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	return db.blockLocator(db.lastBlkIdx)
+}
+
+// blockLocator returns a block locator for the block at the given height.
+// Must be called with db read lock held.
+func (db *LevelDb) blockLocator(height int64) (btcdb.BlockLocator, error) {
+	heights := btcdb.LocatorHeights(height)
+	locator := make(btcdb.BlockLocator, 0, len(heights))
+	for _, h := range heights {
+		sha, err := db.fetchBlockShaByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, sha)
+	}
+	return locator, nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+const (
+	// LocationCacheOption is the key of the btcdb.Options Backend setting
+	// which sets the number of blocks whose height is remembered by their
+	// hash, so fetching them by hash reads leveldb once.  Each takes about
+	// 24 bytes of memory.  Zero turns the cache off, and
+	// defaultLocationCacheSize blocks are remembered when it is not given.
+	LocationCacheOption = "locationcache"
+
+	// defaultLocationCacheSize is the number of blocks remembered when the
+	// LocationCacheOption setting is not given, which holds every block of
+	// the main chain for years to come.
+	defaultLocationCacheSize = 1 << 20
+)
+
+// locCache remembers the heights of the blocks inserted or looked up by hash,
+// so fetching a block by hash reads its body at the height without first
+// reading the height stored under the hash.  Unlike the header cache it is
+// meant to hold the heights of the whole chain, so it keeps them compactly,
+// keyed by the first bytes of the hash only.  Once full, an arbitrary block is
+// forgotten for each one added.
+//
+// The heights it returns are hints which callers check against the hash stored
+// along with the block at the height, so heights left behind by dropped blocks
+// and blocks whose hashes share a key are harmless, and the cache is never
+// invalidated.  Its functions are safe for concurrent use since readers only
+// hold the db read lock, and do nothing on a nil cache, which is used when
+// caching is off.
+type locCache struct {
+	mtx     sync.Mutex
+	maxSize int
+	heights map[uint64]uint32
+}
+
+// parseLocationCacheSize returns the number of blocks the passed options ask to
+// remember.
+func parseLocationCacheSize(funcName string, dbOpts *btcdb.Options) (int, error) {
+	arg, ok := dbOpts.Backend[LocationCacheOption]
+	if !ok {
+		return defaultLocationCacheSize, nil
+	}
+	size, ok := arg.(int)
+	if !ok || size < 0 {
+		return 0, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected non-negative integer", LocationCacheOption,
+			funcName)
+	}
+	return size, nil
+}
+
+// newLocCache returns a cache of the given number of blocks, or nil when the
+// size is zero.
+func newLocCache(maxSize int) *locCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &locCache{
+		maxSize: maxSize,
+		heights: make(map[uint64]uint32),
+	}
+}
+
+// locCacheKey returns the key the height of the block with the passed hash is
+// remembered under.
+func locCacheKey(sha *btcwire.ShaHash) uint64 {
+	return binary.LittleEndian.Uint64(sha[:8])
+}
+
+// lookup returns the height the block with the given hash was last seen at and
+// whether there is one.
+func (c *locCache) lookup(sha *btcwire.ShaHash) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	height, ok := c.heights[locCacheKey(sha)]
+	return int64(height), ok
+}
+
+// add remembers that the block with the given hash is at the given height.
+func (c *locCache) add(sha *btcwire.ShaHash, height int64) {
+	if c == nil || height < 0 || height > int64(^uint32(0)) {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := locCacheKey(sha)
+	if _, ok := c.heights[key]; !ok && len(c.heights) >= c.maxSize {
+		for old := range c.heights {
+			delete(c.heights, old)
+			break
+		}
+	}
+	c.heights[key] = uint32(height)
+}
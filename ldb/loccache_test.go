@@ -0,0 +1,132 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/dbtest"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"os"
+	"testing"
+)
+
+// checkFetch ensures the passed blocks, which start at the passed height, are
+// fetched by hash through the passed fetch function when want is true, and are
+// not found otherwise.
+func checkFetch(t *testing.T, fetch func(*btcutil.Block) (*btcutil.Block, error),
+	blocks []*btcutil.Block, height int64, want bool) {
+
+	for i, blk := range blocks {
+		sha, _ := blk.Sha()
+		got, err := fetch(blk)
+		if !want {
+			if err == nil {
+				t.Errorf("FetchBlockBySha %v: found block which "+
+					"is no longer stored", sha)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FetchBlockBySha %v: %v", sha, err)
+			continue
+		}
+		gotSha, _ := got.Sha()
+		if !gotSha.IsEqual(sha) || got.Height() != height+int64(i) {
+			t.Errorf("FetchBlockBySha %v: got block %v at height "+
+				"%d, want height %d", sha, gotSha, got.Height(),
+				height+int64(i))
+		}
+	}
+}
+
+func TestLocationCache(t *testing.T) {
+	dbname := "tstdbloccache"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+
+	_, err := btcdb.CreateDBWithOptions("leveldb", btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.LocationCacheOption: -1},
+	})
+	if err == nil {
+		t.Errorf("CreateDB accepted a negative location cache size")
+	}
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+
+	// The header cache is turned off so heights which are not in the
+	// location cache are read from leveldb.
+	db, err := btcdb.CreateDBWithOptions("leveldb", btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.HeaderCacheOption: 0},
+	})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	g := dbtest.NewChainGenerator(3)
+	if _, err := dbtest.InsertChain(db, g, 21); err != nil {
+		t.Errorf("InsertChain: %v", err)
+		return
+	}
+	forkSha, _ := g.Tip().Sha()
+	side := g.Fork(1).NextBlocks(10)
+	main, err := dbtest.InsertChain(db, g, 10)
+	if err != nil {
+		t.Errorf("InsertChain: %v", err)
+		return
+	}
+	fetch := func(blk *btcutil.Block) (*btcutil.Block, error) {
+		sha, _ := blk.Sha()
+		return db.FetchBlockBySha(sha)
+	}
+
+	// The heights of inserted blocks are remembered, so they are fetched
+	// without reading the height stored under their hash.
+	sha, _ := main[5].Sha()
+	if err := ldb.RemoveBlockShaRecord(db, sha); err != nil {
+		t.Errorf("RemoveBlockShaRecord: %v", err)
+		return
+	}
+	checkFetch(t, fetch, main, 21, true)
+
+	// The remembered heights of blocks which were disconnected now hold
+	// other blocks, which must not be returned in their place.
+	if _, err := db.ReorganizeWithMeta(forkSha, side, nil); err != nil {
+		t.Errorf("ReorganizeWithMeta: %v", err)
+		return
+	}
+	checkFetch(t, fetch, main, 21, false)
+	checkFetch(t, fetch, side, 21, true)
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Errorf("Snapshot: %v", err)
+		return
+	}
+	defer snap.Release()
+
+	if _, err := db.ReorganizeWithMeta(forkSha, main, nil); err != nil {
+		t.Errorf("ReorganizeWithMeta: %v", err)
+		return
+	}
+	checkFetch(t, fetch, main, 21, true)
+	checkFetch(t, fetch, side, 21, false)
+
+	// Snapshots share the cache, which must not let them see the blocks
+	// connected after they were taken.
+	snapFetch := func(blk *btcutil.Block) (*btcutil.Block, error) {
+		sha, _ := blk.Sha()
+		return snap.FetchBlockBySha(sha)
+	}
+	checkFetch(t, snapFetch, main, 21, false)
+	checkFetch(t, snapFetch, side, 21, true)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// metaKeyPrefix is prepended to the keys of the metadata namespace to keep
+// them apart from the keys the database uses itself.
+var metaKeyPrefix = []byte{metaNs}
+
+// metaToKey returns the leveldb key of the given metadata key.
+func metaToKey(key []byte) []byte {
+	return append(append([]byte(nil), metaKeyPrefix...), key...)
+}
+
+// putMeta adds the passed changes to the metadata namespace to the current
+// batch.
+// Must be called with db write lock held.
+func (db *LevelDb) putMeta(meta *btcdb.MetaBatch) {
+	for _, op := range meta.Ops() {
+		if op.Delete {
+			db.lBatch().Delete(metaToKey(op.Key))
+		} else {
+			db.lBatch().Put(metaToKey(op.Key), op.Value)
+		}
+	}
+}
+
+// InsertBlocksWithMeta inserts a run of blocks along with the passed changes to
+// the metadata namespace using a single leveldb write batch.  This is part of
+// the btcdb.Db interface implementation.
+func (db *LevelDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.dbLock.Lock()
+	op.Locked()
+	defer db.dbLock.Unlock()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+	db.flush()
+
+	return db.insertBlocks(blocks, meta)
+}
+
+// ReorganizeWithMeta removes any blocks from the database after the given
+// block, inserts the passed run of blocks after it and applies the passed
+// changes to the metadata namespace.  The removal and the insertion are
+// committed as two leveldb write batches while the write lock is held, so
+// readers never see the chain between them, and the removed blocks are
+// inserted again when the run fails to insert.  A crash between the two
+// batches leaves the chain ending at the given block.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricReorganize, blocks)
+	defer op.Done()
+	db.dbLock.Lock()
+	op.Locked()
+	defer db.dbLock.Unlock()
+	db.metrics.ObserveBatchSize(btcdb.MetricReorganize, len(blocks))
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+	db.flush()
+
+	keepidx, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	var removed []*btcutil.Block
+	for height := keepidx + 1; height < db.nextBlock; height++ {
+		if db.headersOnly {
+			bh, err := db.fetchHeaderByHeight(height)
+			if err != nil {
+				return nil, err
+			}
+			removed = append(removed,
+				btcutil.NewBlock(&btcwire.MsgBlock{Header: *bh}))
+			continue
+		}
+		_, buf, err := db.getBlkByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		blk, err := btcutil.NewBlockFromBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, blk)
+	}
+
+	if err := db.dropAfterBlockBySha(sha, nil); err != nil {
+		return nil, err
+	}
+	heights, err := db.insertBlocks(blocks, meta)
+	if err != nil {
+		if _, rerr := db.insertBlocks(removed, nil); rerr != nil {
+			log.Warnf("Unable to restore the blocks removed by a "+
+				"failed reorganization: %v", rerr)
+		}
+		return nil, err
+	}
+	return heights, nil
+}
+
+// GetMeta returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) GetMeta(key []byte) ([]byte, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	return db.getMeta(key)
+}
+
+// getMeta returns the value stored under the given key in the metadata
+// namespace as of the last write batch, or nil when the key does not exist.
+// Must be called with db read lock held.
+func (db *LevelDb) getMeta(key []byte) ([]byte, error) {
+	value, err := db.get(metaToKey(key))
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// PutMeta stores the value under the given key in the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) PutMeta(key, value []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Put(key, value)
+	return db.WriteMeta(&meta)
+}
+
+// DeleteMeta removes the given key from the metadata namespace.  This is part
+// of the btcdb.Db interface implementation.
+func (db *LevelDb) DeleteMeta(key []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Delete(key)
+	return db.WriteMeta(&meta)
+}
+
+// WriteMeta applies the passed changes to the metadata namespace in a single
+// leveldb write batch.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) WriteMeta(meta *btcdb.MetaBatch) error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	db.flush()
+
+	defer db.lBatch().Reset()
+	db.putMeta(meta)
+	return db.writeBatch(db.lBatch(), db.wo)
+}
+
+// MetaIterator returns an iterator over the keys of the metadata namespace
+// which begin with the given prefix.  The iterator reads from a snapshot of the
+// database which is held until it is released.  This is part of the btcdb.Db
+// interface implementation.
+func (db *LevelDb) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	return db.newMetaIterator(prefix, false)
+}
+
+// ReverseMetaIterator returns an iterator over the keys of the metadata
+// namespace which begin with the given prefix in descending order, the same as
+// MetaIterator otherwise.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	return db.newMetaIterator(prefix, true)
+}
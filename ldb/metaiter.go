@@ -0,0 +1,173 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/goleveldb/leveldb/iterator"
+	"github.com/conformal/goleveldb/leveldb/util"
+)
+
+// metaIteratorChunk is the number of entries a metadata iterator reads from
+// leveldb at a time.
+const metaIteratorChunk = 256
+
+// metaIterator walks the keys of the metadata namespace which share a prefix as
+// of a leveldb snapshot.  The entries are read a chunk at a time with a leveldb
+// iterator which is released before returning, so only the snapshot is held
+// between calls and no more entries are read than are walked, which keeps
+// reading a page of a long history from its newest end cheap.
+type metaIterator struct {
+	snap    *LevelDb
+	owned   bool
+	slice   *util.Range
+	reverse bool
+	keys    [][]byte
+	values  [][]byte
+	pos     int
+	last    []byte
+	done    bool
+	err     error
+}
+
+// newMetaIterator returns an iterator over the keys of the metadata namespace
+// which begin with the given prefix, in descending order when reverse is set.
+// A snapshot of the database is taken for the iterator unless the instance is
+// a snapshot itself.
+func (db *LevelDb) newMetaIterator(prefix []byte, reverse bool) (btcdb.MetaIterator, error) {
+	it := &metaIterator{
+		snap:    db,
+		slice:   util.BytesPrefix(metaToKey(prefix)),
+		reverse: reverse,
+		pos:     -1,
+	}
+	if db.snap == nil {
+		snap, err := db.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		it.snap = snap.(*snapshot).LevelDb
+		it.owned = true
+	} else if db.Closed() {
+		return nil, btcdb.ErrDbClosed
+	}
+	return it, nil
+}
+
+// fill reads the next chunk of entries after the last one read.
+func (it *metaIterator) fill() {
+	db := it.snap
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		it.err = btcdb.ErrDbClosed
+		return
+	}
+
+	iter := db.snap.NewIterator(it.slice, db.ro)
+	defer iter.Release()
+
+	// Seeking moves to the last entry read, which still exists in the
+	// snapshot, so the entry after it in either order comes next.
+	var ok bool
+	switch {
+	case it.last == nil && it.reverse:
+		ok = iter.Last()
+	case it.last == nil:
+		ok = iter.First()
+	case it.reverse:
+		ok = iter.Seek(it.last) && iter.Prev()
+	default:
+		ok = iter.Seek(it.last)
+		if ok && bytes.Equal(iter.Key(), it.last) {
+			ok = iter.Next()
+		}
+	}
+	for ; ok && len(it.keys) < metaIteratorChunk; ok = advance(iter, it.reverse) {
+		value := append([]byte{}, iter.Value()...)
+		if db.aead != nil {
+			var err error
+			value, err = db.unseal(iter.Key(), value)
+			if err != nil {
+				it.err = err
+				return
+			}
+		}
+		key := iter.Key()[len(metaKeyPrefix):]
+		it.keys = append(it.keys, append([]byte(nil), key...))
+		it.values = append(it.values, value)
+		it.last = append(it.last[:0], iter.Key()...)
+	}
+	if err := iter.Error(); err != nil {
+		it.err = err
+		return
+	}
+	it.done = !ok
+}
+
+// advance moves the passed leveldb iterator to the next entry in the passed
+// order.
+func advance(iter iterator.Iterator, reverse bool) bool {
+	if reverse {
+		return iter.Prev()
+	}
+	return iter.Next()
+}
+
+// Next moves to the next key, reading the next chunk of entries once those
+// read are walked.  This is part of the btcdb.MetaIterator interface
+// implementation.
+func (it *metaIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.pos++
+	if it.pos < len(it.keys) {
+		return true
+	}
+	it.keys, it.values, it.pos = nil, nil, 0
+	if it.done {
+		return false
+	}
+	it.fill()
+	return it.err == nil && len(it.keys) > 0
+}
+
+// Key returns the current key.  This is part of the btcdb.MetaIterator
+// interface implementation.
+func (it *metaIterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.keys[it.pos]
+}
+
+// Value returns the value of the current key.  This is part of the
+// btcdb.MetaIterator interface implementation.
+func (it *metaIterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+// Err returns the error which stopped the iteration.  This is part of the
+// btcdb.MetaIterator interface implementation.
+func (it *metaIterator) Err() error {
+	return it.err
+}
+
+// Release frees the snapshot the iterator reads from when it was taken for the
+// iterator.  This is part of the btcdb.MetaIterator interface implementation.
+func (it *metaIterator) Release() {
+	if it.owned {
+		it.snap.Close()
+		it.owned = false
+	}
+	it.keys, it.values = nil, nil
+	it.done = true
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestMetaIterator ensures the metadata iterators walk more keys than they read
+// at a time in either order, as of the time they were created, and fail once
+// the database is closed.
+func TestMetaIterator(t *testing.T) {
+	dbname := "tstdbmetaiter"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Keys sharing part of the prefix sort on either side of those walked.
+	var meta btcdb.MetaBatch
+	meta.Put([]byte("iter"), []byte("before"))
+	meta.Put([]byte("iter0"), []byte("after"))
+	var keys []string
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("iter/%04d", i)
+		keys = append(keys, key)
+		meta.Put([]byte(key), []byte(key))
+	}
+	if err := db.WriteMeta(&meta); err != nil {
+		t.Errorf("WriteMeta: %v", err)
+		return
+	}
+	reversed := make([]string, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+
+	// walk returns the keys walked by the passed iterator, changing the
+	// metadata namespace once the first key is walked.
+	walk := func(name string, it btcdb.MetaIterator) []string {
+		defer it.Release()
+		var got []string
+		for it.Next() {
+			if string(it.Key()) != string(it.Value()) {
+				t.Errorf("%s: wrong value %q for key %q", name,
+					it.Value(), it.Key())
+			}
+			got = append(got, string(it.Key()))
+			if len(got) == 1 {
+				db.PutMeta([]byte("iter/9999"), []byte("late"))
+				db.DeleteMeta([]byte(keys[300]))
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		db.DeleteMeta([]byte("iter/9999"))
+		db.PutMeta([]byte(keys[300]), []byte(keys[300]))
+		return got
+	}
+
+	it, err := db.MetaIterator([]byte("iter/"))
+	if err != nil {
+		t.Errorf("MetaIterator: %v", err)
+		return
+	}
+	if got := walk("MetaIterator", it); !reflect.DeepEqual(got, keys) {
+		t.Errorf("MetaIterator: got %d keys, want %d in order",
+			len(got), len(keys))
+	}
+
+	it, err = db.ReverseMetaIterator([]byte("iter/"))
+	if err != nil {
+		t.Errorf("ReverseMetaIterator: %v", err)
+		return
+	}
+	if got := walk("ReverseMetaIterator", it); !reflect.DeepEqual(got, reversed) {
+		t.Errorf("ReverseMetaIterator: got %d keys, want %d in "+
+			"descending order", len(got), len(reversed))
+	}
+
+	// An iterator created from a snapshot reads from it.
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Errorf("Snapshot: %v", err)
+		return
+	}
+	db.PutMeta([]byte("iter/9999"), []byte("late"))
+	it, err = snap.ReverseMetaIterator([]byte("iter/"))
+	if err != nil {
+		t.Errorf("ReverseMetaIterator: %v", err)
+		return
+	}
+	if !it.Next() || string(it.Key()) != reversed[0] {
+		t.Errorf("ReverseMetaIterator: snapshot got first key %q, "+
+			"want %q", it.Key(), reversed[0])
+	}
+	it.Release()
+	snap.Release()
+
+	// Iterators stop with ErrDbClosed once the database is closed.
+	it, err = db.MetaIterator([]byte("iter/"))
+	if err != nil {
+		t.Errorf("MetaIterator: %v", err)
+		return
+	}
+	it.Next()
+	db.Close()
+	walked := 1
+	for it.Next() {
+		walked++
+	}
+	if walked == len(keys) || it.Err() != btcdb.ErrDbClosed {
+		t.Errorf("MetaIterator: walked %d keys (err %v) once closed, "+
+			"want %v", walked, it.Err(), btcdb.ErrDbClosed)
+	}
+	it.Release()
+	if _, err := db.ReverseMetaIterator(nil); err != btcdb.ErrDbClosed {
+		t.Errorf("ReverseMetaIterator: got %v once closed, want %v",
+			err, btcdb.ErrDbClosed)
+	}
+}
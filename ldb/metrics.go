@@ -0,0 +1,44 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// reportStats passes the statistics leveldb keeps about its tables and
+// compactions to the metrics of the database as gauges.  It is called after
+// each batch is written.
+func (db *LevelDb) reportStats() {
+	if db.metrics == btcdb.DiscardMetrics {
+		return
+	}
+
+	var stats leveldb.DBStats
+	if err := db.lDb.Stats(&stats); err != nil {
+		log.Warnf("Unable to read leveldb stats: %v", err)
+		return
+	}
+	var tables, size, read, write, compactTime int64
+	for i := range stats.LevelSizes {
+		tables += int64(stats.LevelTablesCounts[i])
+		size += stats.LevelSizes[i]
+		read += stats.LevelRead[i]
+		write += stats.LevelWrite[i]
+		compactTime += int64(stats.LevelDurations[i])
+	}
+
+	m := db.metrics
+	m.SetGauge("leveldb.tables", tables)
+	m.SetGauge("leveldb.size_bytes", size)
+	m.SetGauge("leveldb.compaction.read_bytes", read)
+	m.SetGauge("leveldb.compaction.write_bytes", write)
+	m.SetGauge("leveldb.compaction.time_ns", compactTime)
+	m.SetGauge("leveldb.writedelay.count", int64(stats.WriteDelayCount))
+	m.SetGauge("leveldb.writedelay.time_ns", int64(stats.WriteDelayDuration))
+	m.SetGauge("leveldb.io.read_bytes", int64(stats.IORead))
+	m.SetGauge("leveldb.io.write_bytes", int64(stats.IOWrite))
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+const (
+	// MissCacheOption is the key of the btcdb.Options Backend setting
+	// which sets the number of block and transaction hashes recently found
+	// missing by ExistsSha and ExistsTxSha which are remembered, each.
+	// Zero turns the caches off, and defaultMissCacheSize hashes are
+	// remembered when it is not given.
+	MissCacheOption = "misscache"
+
+	// defaultMissCacheSize is the number of hashes remembered when the
+	// MissCacheOption setting is not given.
+	defaultMissCacheSize = 16384
+)
+
+// missCache remembers hashes which were recently looked up and not found in
+// the database, so the lookups of the many unknown blocks and transactions
+// announced by peers don't each need to read leveldb.  Once full, the hashes
+// added first are forgotten first.
+//
+// Hashes are removed once a batch which stores a record under them is
+// committed, so the cache never claims a hash is missing when it is present.
+// Its functions are safe for concurrent use since readers only hold the db
+// read lock, and do nothing on a nil cache, which is used when caching is off.
+type missCache struct {
+	mtx sync.Mutex
+
+	// ring holds the hashes in the order they were added, the oldest at
+	// the slot of next once it has wrapped around.  shas maps each hash
+	// still remembered to the number it was added as, so a hash which was
+	// removed and added again is not forgotten early when its old slot is
+	// reused.
+	ring []btcwire.ShaHash
+	next uint64
+	shas map[btcwire.ShaHash]uint64
+}
+
+// parseMissCacheSize returns the number of hashes the passed options ask to
+// remember.
+func parseMissCacheSize(funcName string, dbOpts *btcdb.Options) (int, error) {
+	arg, ok := dbOpts.Backend[MissCacheOption]
+	if !ok {
+		return defaultMissCacheSize, nil
+	}
+	size, ok := arg.(int)
+	if !ok || size < 0 {
+		return 0, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected non-negative integer", MissCacheOption,
+			funcName)
+	}
+	return size, nil
+}
+
+// newMissCache returns a cache of the given number of hashes, or nil when the
+// size is zero.
+func newMissCache(size int) *missCache {
+	if size <= 0 {
+		return nil
+	}
+	return &missCache{
+		ring: make([]btcwire.ShaHash, size),
+		shas: make(map[btcwire.ShaHash]uint64),
+	}
+}
+
+// contains returns whether the given hash is known to be missing.
+func (c *missCache) contains(sha *btcwire.ShaHash) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	_, ok := c.shas[*sha]
+	return ok
+}
+
+// add records that the given hash is missing from the database, which callers
+// ensure by only adding hashes they failed to read from leveldb.
+func (c *missCache) add(sha *btcwire.ShaHash) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.shas[*sha]; ok {
+		return
+	}
+	size := uint64(len(c.ring))
+	slot := c.next % size
+	if c.next >= size {
+		old := c.ring[slot]
+		if n, ok := c.shas[old]; ok && n == c.next-size {
+			delete(c.shas, old)
+		}
+	}
+	c.ring[slot] = *sha
+	c.shas[*sha] = c.next
+	c.next++
+}
+
+// remove forgets the given hash, which is done once a record is stored under
+// it.
+func (c *missCache) remove(sha *btcwire.ShaHash) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	delete(c.shas, *sha)
+}
+
+// forgetInsertedBlocks removes the hashes of the passed blocks from the cache
+// of missing blocks.
+// Must be called with db write lock held once the blocks are committed.
+func (db *LevelDb) forgetInsertedBlocks(blocks []*btcutil.Block) {
+	for _, blk := range blocks {
+		if sha, err := blk.Sha(); err == nil {
+			db.blkMisses.remove(sha)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"os"
+	"testing"
+)
+
+// checkExists ensures ExistsSha and ExistsTxSha report the passed block and
+// its transactions as stored or not.
+func checkExists(t *testing.T, db btcdb.Db, blk *btcutil.Block, want bool) {
+	sha, _ := blk.Sha()
+	if got := db.ExistsSha(sha); got != want {
+		t.Errorf("ExistsSha %v: got %v, want %v", sha, got, want)
+	}
+	for _, tx := range blk.Transactions() {
+		if got := db.ExistsTxSha(tx.Sha()); got != want {
+			t.Errorf("ExistsTxSha %v: got %v, want %v", tx.Sha(),
+				got, want)
+		}
+	}
+}
+
+func TestMissCache(t *testing.T) {
+	dbname := "tstdbmisscache"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	blocks := loadblocks(t)[:100]
+	for _, block := range blocks[:50] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+
+	// Looking the missing blocks up twice has them answered from the cache
+	// the second time, which must not outlive their insertion.
+	for _, block := range blocks[50:] {
+		checkExists(t, db, block, false)
+		checkExists(t, db, block, false)
+	}
+	for _, block := range blocks[50:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+	for _, block := range blocks {
+		checkExists(t, db, block, true)
+	}
+
+	// The same goes for blocks which were dropped and inserted again.
+	keepSha, _ := blocks[49].Sha()
+	if err := db.DropAfterBlockBySha(keepSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	for _, block := range blocks[50:] {
+		checkExists(t, db, block, false)
+	}
+	if _, err := db.InsertBlocks(blocks[50:]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		return
+	}
+	for _, block := range blocks {
+		checkExists(t, db, block, true)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// networksDir is the name of the directory inside the database directory which
+// holds the chains of networks other than the one of the database.
+const networksDir = "networks"
+
+// ForNetwork returns a view of the database holding the chain of the passed
+// network, which is the database itself for the network it records.  The
+// chains of other networks are kept apart from it inside the database
+// directory, created with the options of the database the first time they are
+// requested unless it is read-only, and share nothing with it or each other.
+// A view is opened once and closed along with the database, and opened again
+// should it be closed on its own.
+func (db *LevelDb) ForNetwork(net btcwire.BitcoinNet) (btcdb.Db, error) {
+	if db.root != nil {
+		return db.root.ForNetwork(net)
+	}
+	if net == 0 {
+		return nil, fmt.Errorf("ForNetwork: a network is required")
+	}
+
+	db.dbLock.RLock()
+	closed, own := db.closed, db.net
+	db.dbLock.RUnlock()
+	switch {
+	case closed:
+		return nil, btcdb.ErrDbClosed
+	case net == own:
+		return db, nil
+	}
+
+	db.networksLock.Lock()
+	defer db.networksLock.Unlock()
+
+	if view, ok := db.networks[net]; ok {
+		view.dbLock.RLock()
+		closed := view.closed
+		view.dbLock.RUnlock()
+		if !closed {
+			return view, nil
+		}
+	}
+	view, err := db.openNetwork(net)
+	if err != nil {
+		return nil, err
+	}
+	view.root = db
+	if db.networks == nil {
+		db.networks = make(map[btcwire.BitcoinNet]*LevelDb)
+	}
+	db.networks[net] = view
+	return view, nil
+}
+
+// openNetwork opens the chain of the passed network kept inside the database
+// directory, creating it when it does not exist yet.
+func (db *LevelDb) openNetwork(net btcwire.BitcoinNet) (*LevelDb, error) {
+	dir := filepath.Join(db.opts.Path, networksDir)
+	opts := db.opts
+	opts.Path = filepath.Join(dir, fmt.Sprintf("%08x", uint32(net)))
+	opts.Net = net
+
+	// The block files of the view are moved to a directory of their own
+	// inside the cold tier.
+	if db.coldStore != nil {
+		backend := make(map[string]interface{}, len(opts.Backend))
+		for k, v := range opts.Backend {
+			backend[k] = v
+		}
+		delete(backend, ColdPathOption)
+		backend[ColdStoreOption] = &prefixStore{
+			store:  db.coldStore,
+			prefix: path.Join(networksDir, fmt.Sprintf("%08x", uint32(net))),
+		}
+		opts.Backend = backend
+	}
+
+	view, err := OpenDB(opts)
+	if err == btcdb.DbDoesNotExist && !db.readOnly {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+		if db.blkFiles != nil {
+			view, err = CreateFlatFileDB(opts)
+		} else {
+			view, err = CreateDB(opts)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return view.(*LevelDb), nil
+}
+
+// closeNetworks closes the views of the chains of other networks opened by
+// ForNetwork.
+func (db *LevelDb) closeNetworks() {
+	db.networksLock.Lock()
+	defer db.networksLock.Unlock()
+
+	for net, view := range db.networks {
+		view.Close()
+		delete(db.networks, net)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"testing"
+)
+
+// networkDb is implemented by databases which hold the chains of several
+// networks.
+type networkDb interface {
+	ForNetwork(net btcwire.BitcoinNet) (btcdb.Db, error)
+}
+
+func TestForNetwork(t *testing.T) {
+	dbname := "tstdbnetworks"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	opts := btcdb.Options{Path: dbname, Net: btcwire.MainNet}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	blocks := loadblocks(t)[:10]
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+
+	if view, err := db.(networkDb).ForNetwork(btcwire.MainNet); view != db {
+		t.Errorf("ForNetwork: got %v (err %v) for the network of the "+
+			"database", view, err)
+	}
+	testnet, err := db.(networkDb).ForNetwork(btcwire.TestNet3)
+	if err != nil {
+		t.Errorf("ForNetwork: %v", err)
+		db.Close()
+		return
+	}
+	checkTip(t, testnet, -1)
+	genesis := btcutil.NewBlock(&btcwire.TestNet3GenesisBlock)
+	if _, err := testnet.InsertBlock(genesis); err != nil {
+		t.Errorf("InsertBlock: %v", err)
+	}
+	db.Close()
+
+	// The chains are kept apart across opens, and views can't be created
+	// through read-only databases.
+	opts.ReadOnly = true
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	checkTip(t, db, int64(len(blocks)-1))
+	testnet, err = db.(networkDb).ForNetwork(btcwire.TestNet3)
+	if err != nil {
+		t.Errorf("ForNetwork: %v", err)
+		return
+	}
+	checkTip(t, testnet, 0)
+	sha, err := testnet.FetchBlockShaByHeight(0)
+	if err != nil || !sha.IsEqual(&btcwire.TestNet3GenesisHash) {
+		t.Errorf("FetchBlockShaByHeight: got %v (err %v), want %v", sha,
+			err, btcwire.TestNet3GenesisHash)
+	}
+	if _, err := db.(networkDb).ForNetwork(btcwire.TestNet); err == nil {
+		t.Errorf("ForNetwork: unexpected success creating a chain " +
+			"through a read-only database")
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+const (
+	// PruneRetentionOption is the key of the btcdb.Options Backend setting
+	// which turns on pruning.  Its value is the number of most recent
+	// blocks whose bodies and undo data are kept, the bodies of all older
+	// blocks are removed as new blocks are inserted.
+	PruneRetentionOption = "pruneretention"
+
+	// pruneBatch is the number of blocks pruned in a single batch.
+	pruneBatch = 500
+)
+
+// pruneHeightKey is the key used to record the height of the lowest block
+// whose body is still stored.  The bodies of all blocks below it have been
+// pruned.
+var pruneHeightKey = settingKey("pruneheight")
+
+// errPruneFilterIndex is returned when pruning is combined with the filter
+// index, which needs the outputs spent by every new block from their bodies.
+var errPruneFilterIndex = fmt.Errorf("the filter index needs full blocks " +
+	"and can not be used with pruning")
+
+// parsePruneRetention returns the number of blocks the passed options ask to
+// keep when pruning, or zero when pruning is not requested.
+func parsePruneRetention(funcName string, dbOpts *btcdb.Options) (int64, error) {
+	arg, ok := dbOpts.Backend[PruneRetentionOption]
+	if !ok {
+		return 0, nil
+	}
+	var retention int64
+	switch n := arg.(type) {
+	case int:
+		retention = int64(n)
+	case int64:
+		retention = n
+	default:
+		return 0, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected integer", PruneRetentionOption, funcName)
+	}
+	if retention <= 0 {
+		return 0, fmt.Errorf("%s setting to ldb.%s is invalid -- "+
+			"expected positive integer", PruneRetentionOption, funcName)
+	}
+	return retention, nil
+}
+
+// PruneTo removes the bodies and undo data of all blocks below the given
+// height, keeping their headers, hashes and heights along with the spend
+// information of their transactions.  The chain tip is never pruned.  It
+// returns the number of bytes of block data removed.
+//
+// Pruned blocks, and the transactions stored in them, can no longer be fetched
+// and btcdb.ErrPruned is returned instead.  Blocks can not be dropped back
+// past the lowest block still stored and indexes can not be rebuilt once a
+// block has been pruned.
+func (db *LevelDb) PruneTo(height int64) (int64, error) {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return 0, btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return 0, btcdb.ErrReadOnly
+	}
+	db.flush()
+
+	return db.pruneTo(height)
+}
+
+// PruneHeight returns the height of the lowest block whose body is still
+// stored.  It is zero when no blocks have been pruned.
+func (db *LevelDb) PruneHeight() int64 {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	return db.pruneHeight
+}
+
+// pruneTo removes the bodies and undo data of all blocks below the given
+// height.  The changes are committed in batches, each of which records how far
+// pruning has progressed.
+// Must be called with db write lock held.
+func (db *LevelDb) pruneTo(height int64) (int64, error) {
+	if db.headersOnly {
+		return 0, btcdb.ErrHeadersOnly
+	}
+	if db.filterIndex {
+		return 0, errPruneFilterIndex
+	}
+	if height > db.lastBlkIdx {
+		return 0, fmt.Errorf("prune height %d is past the chain tip %d",
+			height, db.lastBlkIdx)
+	}
+	if height <= db.pruneHeight {
+		return 0, nil
+	}
+
+	defer db.lBatch().Reset()
+
+	// The cache must not serve the bodies which are pruned, including
+	// those pruned before a failure.
+	defer func() { db.blockCache.RemoveBelow(db.pruneHeight) }()
+
+	var reclaimed int64
+	for h := db.pruneHeight; h < height; h++ {
+		blkVal, err := db.get(heightBlkToKey(h))
+		if err == leveldb.ErrNotFound {
+			return reclaimed, btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return reclaimed, err
+		}
+		if len(blkVal) < btcwire.HashSize {
+			return reclaimed, btcdb.ErrCorruption
+		}
+		var sha btcwire.ShaHash
+		sha.SetBytes(blkVal[0:btcwire.HashSize])
+
+		// The location of a block stored in a flat file is kept since
+		// the file is only removed once all of its blocks are pruned.
+		if db.blkFiles == nil {
+			reclaimed += int64(len(blkVal) - btcwire.HashSize)
+			db.lBatch().Put(heightBlkToKey(h), sha.Bytes())
+		}
+
+		undo, err := db.get(shaUndoToKey(&sha))
+		if err != nil && err != leveldb.ErrNotFound {
+			return reclaimed, err
+		}
+		if err == nil {
+			reclaimed += int64(len(undo))
+			db.lBatch().Delete(shaUndoToKey(&sha))
+		}
+
+		if (h+1)%pruneBatch == 0 || h == height-1 {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], uint64(h+1))
+			db.lBatch().Put(pruneHeightKey, buf[:])
+			if err := db.writeBatch(db.lBatch(), db.wo); err != nil {
+				return reclaimed, err
+			}
+			db.lBatch().Reset()
+			db.pruneHeight = h + 1
+		}
+	}
+
+	if db.blkFiles != nil {
+		_, loc, err := db.getBlkLocByHeight(height)
+		if err != nil {
+			return reclaimed, err
+		}
+		n, err := db.blkFiles.removeBefore(loc.fileNum)
+		reclaimed += n
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	log.Infof("Pruned blocks below height %d, %d bytes removed", height,
+		reclaimed)
+	return reclaimed, nil
+}
+
+// pruneRetained prunes the blocks which fall out of the number of blocks kept
+// by the database.  A failure is only logged since the blocks which caused it
+// are already committed and pruning is retried after the next insert.
+// Must be called with db write lock held.
+func (db *LevelDb) pruneRetained() {
+	height := db.lastBlkIdx - db.pruneRetention + 1
+	if db.pruneRetention <= 0 || height <= db.pruneHeight {
+		return
+	}
+	if _, err := db.pruneTo(height); err != nil {
+		log.Warnf("Failed to prune blocks: %v", err)
+	}
+}
+
+// removeBefore removes all block files numbered below the given one and
+// returns their total size.  Files removed by an earlier call are skipped.
+func (bf *blockFiles) removeBefore(fileNum uint32) (int64, error) {
+	bf.readLock.Lock()
+	bf.closeReadFiles()
+	bf.readLock.Unlock()
+
+	var removed int64
+	for n := fileNum; n > 0; n-- {
+		size, err := bf.removeBlockFile(n - 1)
+		if err != nil {
+			return removed, err
+		}
+		if size < 0 {
+			break
+		}
+		removed += size
+	}
+	return removed, nil
+}
+
+// loadPruneSetting reads the height of the lowest block whose body is still
+// stored from the database and applies the pruning requested by the options.
+func (db *LevelDb) loadPruneSetting(funcName string, dbOpts *btcdb.Options) error {
+	retention, err := parsePruneRetention(funcName, dbOpts)
+	if err != nil {
+		return err
+	}
+	if retention > 0 && db.filterIndex {
+		return errPruneFilterIndex
+	}
+	db.pruneRetention = retention
+
+	buf, err := db.get(pruneHeightKey)
+	if err == leveldb.ErrNotFound {
+		db.pruneHeight = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 8 {
+		return btcdb.ErrCorruption
+	}
+	db.pruneHeight = int64(binary.LittleEndian.Uint64(buf))
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPruneTo ensures pruned blocks lose their bodies but keep their headers,
+// that pruning is persisted and that the operations which need the pruned
+// bodies are refused.
+func TestPruneTo(t *testing.T) {
+	dbname := "tstdbprune"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+	if _, err := db.InsertBlocks(blocks); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		db.Close()
+		return
+	}
+
+	pruneHeight := 100
+	ldbDb := db.(*ldb.LevelDb)
+	reclaimed, err := ldbDb.PruneTo(int64(pruneHeight))
+	if err != nil {
+		t.Errorf("PruneTo: %v", err)
+		db.Close()
+		return
+	}
+	if reclaimed <= 0 {
+		t.Errorf("PruneTo: no space reclaimed")
+	}
+	if _, err := ldbDb.PruneTo(int64(len(blocks))); err == nil {
+		t.Errorf("PruneTo past the tip: unexpected success")
+	}
+	if n, err := ldbDb.PruneTo(10); n != 0 || err != nil {
+		t.Errorf("PruneTo of pruned height: got %d %v, want 0", n, err)
+	}
+	db.Close()
+
+	// Pruning is recorded in the database.
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	ldbDb = db.(*ldb.LevelDb)
+	if got := ldbDb.PruneHeight(); got != int64(pruneHeight) {
+		t.Errorf("PruneHeight: got %d, want %d", got, pruneHeight)
+	}
+	checkHeaders(t, db, blocks)
+
+	sha, _ := blocks[pruneHeight-1].Sha()
+	if _, err := db.FetchBlockBySha(sha); err != btcdb.ErrPruned {
+		t.Errorf("FetchBlockBySha of pruned block: got %v, want %v",
+			err, btcdb.ErrPruned)
+	}
+	tx := blocks[pruneHeight-1].Transactions()[0]
+	if !db.ExistsTxSha(tx.Sha()) {
+		t.Errorf("ExistsTxSha: transaction of pruned block missing")
+	}
+	if _, err := db.FetchTxBySha(tx.Sha()); err != btcdb.ErrPruned {
+		t.Errorf("FetchTxBySha of pruned block: got %v, want %v",
+			err, btcdb.ErrPruned)
+	}
+	sha, _ = blocks[pruneHeight].Sha()
+	if _, err := db.FetchBlockBySha(sha); err != nil {
+		t.Errorf("FetchBlockBySha of kept block: %v", err)
+	}
+
+	// Pruned bodies can not be dropped back to or indexed.
+	sha, _ = blocks[pruneHeight-2].Sha()
+	if err := db.DropAfterBlockBySha(sha); err != btcdb.ErrPruned {
+		t.Errorf("DropAfterBlockBySha into pruned blocks: got %v, "+
+			"want %v", err, btcdb.ErrPruned)
+	}
+	if err := ldbDb.EnableSpendIndex(true); err != btcdb.ErrPruned {
+		t.Errorf("EnableSpendIndex: got %v, want %v", err,
+			btcdb.ErrPruned)
+	}
+	sha, _ = blocks[pruneHeight-1].Sha()
+	if err := db.DropAfterBlockBySha(sha); err != nil {
+		t.Errorf("DropAfterBlockBySha to last pruned block: %v", err)
+		return
+	}
+	if _, err := db.InsertBlocks(blocks[pruneHeight:]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+	}
+}
+
+// TestPruneRetention ensures blocks stored in flat files are pruned as new
+// blocks are inserted and the files holding only pruned blocks are removed.
+func TestPruneRetention(t *testing.T) {
+	dbname := "tstdbpruneret"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	retention := 50
+	db, err := btcdb.CreateDB("ffldb", btcdb.Options{Path: dbname,
+		Backend: map[string]interface{}{
+			ldb.BlockFileSizeOption:  4096,
+			ldb.PruneRetentionOption: retention,
+		}})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	blocks := loadblocks(t)
+	for height, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block %v: %v", height, err)
+			return
+		}
+	}
+
+	ldbDb := db.(*ldb.LevelDb)
+	wantHeight := int64(len(blocks) - retention)
+	if got := ldbDb.PruneHeight(); got != wantHeight {
+		t.Errorf("PruneHeight: got %d, want %d", got, wantHeight)
+	}
+	if _, err := os.Stat(filepath.Join(dbname, "blocks",
+		"blk00000.dat")); !os.IsNotExist(err) {
+		t.Errorf("block file of pruned blocks not removed: %v", err)
+	}
+	checkHeaders(t, db, blocks)
+	for height := wantHeight; height < int64(len(blocks)); height++ {
+		sha, _ := blocks[height].Sha()
+		if _, err := db.FetchBlockBySha(sha); err != nil {
+			t.Errorf("FetchBlockBySha of kept block %d: %v", height,
+				err)
+			return
+		}
+	}
+
+	if err := ldbDb.EnableFilterIndex(true); err == nil {
+		t.Errorf("EnableFilterIndex: unexpected success with pruning")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb/util"
+)
+
+// recoverDepth is the number of blocks at the tip of the chain which are
+// checked for partially applied writes when the database is opened.
+const recoverDepth = 10
+
+// checkBlock returns the hash of the block at the given height after ensuring
+// the records kept for it agree with each other and with the passed hash of
+// its parent, which is nil for the lowest block checked, and that its body
+// can be read back unless only headers are stored or it was pruned.
+func (db *LevelDb) checkBlock(height int64, prevSha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	sha, err := db.fetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	blkHeight, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	if blkHeight != height {
+		return nil, fmt.Errorf("block %v is recorded at height %d",
+			sha, blkHeight)
+	}
+
+	bh, err := db.fetchHeaderByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	hdrSha, err := bh.BlockSha()
+	if err != nil {
+		return nil, err
+	}
+	if !hdrSha.IsEqual(sha) {
+		return nil, fmt.Errorf("header hashes to %v", &hdrSha)
+	}
+	if prevSha != nil && !bh.PrevBlock.IsEqual(prevSha) {
+		return nil, fmt.Errorf("previous block %v is not %v",
+			&bh.PrevBlock, prevSha)
+	}
+
+	if !db.headersOnly && height >= db.pruneHeight {
+		if _, err := db.readBlock(height); err != nil {
+			return nil, err
+		}
+	}
+	return sha, nil
+}
+
+// readBlock returns the block at the given height after ensuring its body
+// hashes to the hash it is stored under.
+func (db *LevelDb) readBlock(height int64) (*btcutil.Block, error) {
+	sha, buf, err := db.getBlkByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := btcutil.NewBlockFromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	blkSha, err := blk.Sha()
+	if err != nil {
+		return nil, err
+	}
+	if !blkSha.IsEqual(sha) {
+		return nil, fmt.Errorf("block body hashes to %v", blkSha)
+	}
+	return blk, nil
+}
+
+// recoverTip checks the blocks nearest the tip of the chain for writes which
+// were only partially applied, such as block data lost from the flat files by
+// a crash after the batch referencing it was committed, and removes every
+// block after the last consistent one.  It must be called while opening the
+// database once the tip has been found.
+func (db *LevelDb) recoverTip() error {
+	if db.lastBlkIdx < 0 {
+		return nil
+	}
+
+	low := db.lastBlkIdx - recoverDepth + 1
+	if low < 0 {
+		low = 0
+	}
+	var prevSha *btcwire.ShaHash
+	if low > 0 {
+		var err error
+		prevSha, err = db.fetchBlockShaByHeight(low - 1)
+		if err != nil {
+			return err
+		}
+	}
+	good := low - 1
+	for height := low; height <= db.lastBlkIdx; height++ {
+		sha, err := db.checkBlock(height, prevSha)
+		if err != nil {
+			log.Warnf("Block at height %d is inconsistent: %v", height,
+				err)
+			break
+		}
+		good, prevSha = height, sha
+	}
+	if good == db.lastBlkIdx {
+		return nil
+	}
+
+	// None of the checked blocks being consistent points to damage which
+	// goes deeper than a partially applied write.
+	if good < low && low > 0 {
+		return btcdb.ErrCorruption
+	}
+	if db.readOnly {
+		return fmt.Errorf("blocks after height %d were only partially "+
+			"written and the database is open read-only", good)
+	}
+
+	log.Warnf("Removing blocks %d through %d which were only partially "+
+		"written", good+1, db.lastBlkIdx)
+	return db.truncateAfter(good)
+}
+
+// truncateAfter removes every block after the given height.  Blocks which can
+// still be read are unwound like any dropped block, while the others are
+// salvaged from what is left of them.
+func (db *LevelDb) truncateAfter(height int64) (rerr error) {
+	defer func() {
+		if rerr != nil {
+			db.lBatch().Reset()
+			db.resetUtxoUpdates()
+			db.txUpdateMap = map[btcwire.ShaHash]*txUpdateObj{}
+			db.txSpentUpdateMap = make(map[btcwire.ShaHash]*spentTxUpdate)
+		}
+	}()
+
+	salvaged := make(map[int64]bool)
+	for h := db.lastBlkIdx; h > height; h-- {
+		intact := db.headersOnly || h < db.pruneHeight
+		if !intact {
+			_, err := db.readBlock(h)
+			intact = err == nil
+		}
+		if intact {
+			if _, _, _, err := db.dropBlock(h); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := db.salvageBlock(h); err != nil {
+			return err
+		}
+		salvaged[h] = true
+	}
+	if len(salvaged) != 0 {
+		if err := db.dropSalvagedTxs(salvaged); err != nil {
+			return err
+		}
+	}
+	if err := db.processBatches(); err != nil {
+		return err
+	}
+
+	var sha btcwire.ShaHash
+	if height >= 0 {
+		tipSha, err := db.fetchBlockShaByHeight(height)
+		if err != nil {
+			return err
+		}
+		sha = *tipSha
+	}
+	db.lastBlkSha = sha
+	db.lastBlkIdx = height
+	db.nextBlock = height + 1
+	return nil
+}
+
+// salvageBlock adds the removal of the block at the given height, whose body
+// can no longer be read, to the current batch.  The outputs it spent are
+// restored from its undo record, while its own transactions are removed by
+// dropSalvagedTxs.
+// Must be called with db write lock held.
+func (db *LevelDb) salvageBlock(height int64) error {
+	sha, err := db.fetchBlockShaByHeight(height)
+	if err == btcdb.ErrBlockNotFound {
+		db.dropBlockRecords(nil, height)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	undo, err := db.getUndo(sha)
+	if err != nil {
+		return err
+	}
+	if undo == nil {
+		log.Warnf("Block %v has no undo data, the outputs it spent "+
+			"remain marked spent", sha)
+	}
+	for op, entry := range undo {
+		op := op
+		if err := db.clearSpentData(&op.Hash, op.Index); err != nil {
+			return err
+		}
+		if db.utxoTracked {
+			db.restoreUtxoEntry(&op, entry)
+		}
+		if db.spendIndex {
+			db.lBatch().Delete(outPointSpendToKey(&op))
+		}
+	}
+	db.lBatch().Delete(shaUndoToKey(sha))
+
+	// The hash record is left alone when it belongs to the block at
+	// another height.
+	if blkHeight, err := db.getBlkLoc(sha); err != nil || blkHeight != height {
+		sha = nil
+	}
+	db.dropBlockRecords(sha, height)
+	return nil
+}
+
+// dropSalvagedTxs adds the removal of the transactions of the salvaged blocks
+// at the given heights, along with their outputs, to the current batch.  Their
+// hashes can't be had from the blocks, so every transaction record in the
+// database is scanned for the ones at those heights.
+// Must be called with db write lock held.
+func (db *LevelDb) dropSalvagedTxs(heights map[int64]bool) error {
+	iter := db.lDb.NewIterator(util.BytesPrefix([]byte{txNs}), db.ro)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+		if db.aead != nil {
+			var err error
+			value, err = db.unseal(key, value)
+			if err != nil {
+				return err
+			}
+		}
+		if len(value) < 8 {
+			return btcdb.ErrCorruption
+		}
+		if !heights[int64(binary.LittleEndian.Uint64(value))] {
+			continue
+		}
+
+		var txSha btcwire.ShaHash
+		txSha.SetBytes(key[1:])
+		db.txUpdateMap[txSha] = &txUpdateObj{delete: true}
+		if db.txIndex {
+			db.lBatch().Delete(shaTxIndexToKey(&txSha))
+		}
+		if db.utxoTracked {
+			if err := db.removeSalvagedUtxos(&txSha); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Error()
+}
+
+// removeSalvagedUtxos removes every output of the transaction with the given
+// hash from the unspent transaction output set.  The number of outputs is not
+// known without the transaction, so the outputs are found by their keys.
+// Must be called with db write lock held.
+func (db *LevelDb) removeSalvagedUtxos(txSha *btcwire.ShaHash) error {
+	var ops []btcwire.OutPoint
+	for op := range db.utxoUpdateMap {
+		if op.Hash.IsEqual(txSha) {
+			ops = append(ops, op)
+		}
+	}
+	iter := db.lDb.NewIterator(util.BytesPrefix(shaKey(utxoNs, txSha)), db.ro)
+	for iter.Next() {
+		ops = append(ops, *keyOutPoint(iter.Key()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for i := range ops {
+		live, err := db.utxoExists(&ops[i])
+		if err != nil {
+			return err
+		}
+		if live {
+			db.utxoDelta--
+		}
+		db.utxoUpdateMap[ops[i]] = &utxoUpdate{delete: true}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestRecoverTip ensures opening a database whose last block was only
+// partially written removes the block along with everything it changed, both
+// when the block data was lost from the flat files and when one of its records
+// is missing.
+func TestRecoverTip(t *testing.T) {
+	blocks := loadblocks(t)
+	if len(blocks) < 184 {
+		t.Errorf("not enough test blocks")
+		return
+	}
+
+	// Block 183 spends an output of block 182 which must be restored when
+	// it is removed.
+	const tip = 183
+	spentOp := &blocks[tip].MsgBlock().Transactions[1].TxIn[0].PreviousOutpoint
+
+	tests := []struct {
+		name   string
+		dbType string
+		damage func(db btcdb.Db, dbname string) error
+	}{
+		{
+			name:   "lost block data",
+			dbType: "ffldb",
+			damage: func(db btcdb.Db, dbname string) error {
+				db.Close()
+				files, err := filepath.Glob(filepath.Join(dbname,
+					"blocks", "blk*.dat"))
+				if err != nil {
+					return err
+				}
+				sort.Strings(files)
+				last := files[len(files)-1]
+				fi, err := os.Stat(last)
+				if err != nil {
+					return err
+				}
+				return os.Truncate(last, fi.Size()-1)
+			},
+		},
+		{
+			name:   "missing hash record",
+			dbType: "leveldb",
+			damage: func(db btcdb.Db, dbname string) error {
+				sha, _ := blocks[tip].Sha()
+				err := ldb.RemoveBlockShaRecord(db, sha)
+				db.Close()
+				return err
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dbname := "tstdbrecover"
+		dbnamever := dbname + ".ver"
+		_ = os.RemoveAll(dbname)
+		_ = os.RemoveAll(dbnamever)
+		db, err := btcdb.CreateDB(test.dbType, dbname)
+		if err != nil {
+			t.Errorf("%s: Failed to open test database %v", test.name,
+				err)
+			return
+		}
+
+		var size int64
+		var spentEntry *btcdb.UtxoEntry
+		for height := 0; height <= tip; height++ {
+			if _, err := db.InsertBlock(blocks[height]); err != nil {
+				t.Errorf("%s: failed to insert block %v: %v",
+					test.name, height, err)
+			}
+			if height == tip-1 {
+				size, _ = db.UtxoSetSize()
+				spentEntry, _ = db.FetchUtxoEntry(spentOp)
+			}
+		}
+		if err := test.damage(db, dbname); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		// A read-only open can't repair the database.
+		db, err = btcdb.OpenDB("leveldb", btcdb.Options{Path: dbname,
+			ReadOnly: true})
+		if err == nil {
+			t.Errorf("%s: read-only open of damaged database "+
+				"succeeded", test.name)
+			db.Close()
+		}
+
+		db, err = btcdb.OpenDB("leveldb", dbname)
+		if err != nil {
+			t.Errorf("%s: Failed to reopen test database %v",
+				test.name, err)
+			os.RemoveAll(dbname)
+			os.RemoveAll(dbnamever)
+			continue
+		}
+		wantSha, _ := blocks[tip-1].Sha()
+		sha, height, err := db.NewestSha()
+		if err != nil || height != tip-1 || !sha.IsEqual(wantSha) {
+			t.Errorf("%s: NewestSha: got %v at %d (%v), want %v at "+
+				"%d", test.name, sha, height, err, wantSha, tip-1)
+		}
+		if got, _ := db.UtxoSetSize(); got != size {
+			t.Errorf("%s: UtxoSetSize: got %d, want %d", test.name,
+				got, size)
+		}
+		entry, err := db.FetchUtxoEntry(spentOp)
+		if err != nil || !reflect.DeepEqual(entry, spentEntry) {
+			t.Errorf("%s: FetchUtxoEntry: output %v not restored - "+
+				"got %v, want %v (err %v)", test.name, spentOp,
+				entry, spentEntry, err)
+		}
+		for _, tx := range blocks[tip].Transactions() {
+			if db.ExistsTxSha(tx.Sha()) {
+				t.Errorf("%s: tx %v of removed block remains",
+					test.name, tx.Sha())
+			}
+			op := btcwire.NewOutPoint(tx.Sha(), 0)
+			if entry, _ := db.FetchUtxoEntry(op); entry != nil {
+				t.Errorf("%s: output %v of removed block "+
+					"remains", test.name, op)
+			}
+		}
+
+		// The removed block must insert again.
+		if _, err := db.InsertBlock(blocks[tip]); err != nil {
+			t.Errorf("%s: failed to reinsert block %v: %v",
+				test.name, tip, err)
+		}
+		for _, tx := range blocks[tip].Transactions() {
+			if _, err := db.FetchTxBySha(tx.Sha()); err != nil {
+				t.Errorf("%s: FetchTxBySha: tx %v: %v",
+					test.name, tx.Sha(), err)
+			}
+		}
+		db.Close()
+		os.RemoveAll(dbname)
+		os.RemoveAll(dbnamever)
+	}
+}
+
+// TestVerifyIntegrityIndexes ensures the integrity checks catch a block whose
+// hash no longer leads back to its height.
+func TestVerifyIntegrityIndexes(t *testing.T) {
+	dbname := "tstdbverify"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	blocks := loadblocks(t)
+	if _, err := db.InsertBlocks(blocks[:10]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		return
+	}
+	sha, _ := blocks[5].Sha()
+	if err := ldb.RemoveBlockShaRecord(db, sha); err != nil {
+		t.Errorf("RemoveBlockShaRecord: %v", err)
+		return
+	}
+	err = db.VerifyIntegrity(btcdb.VerifyIndexes, nil)
+	if ierr, ok := err.(*btcdb.IntegrityError); !ok || ierr.Height != 5 {
+		t.Errorf("VerifyIntegrity: got %v, want integrity error at "+
+			"height 5", err)
+	}
+}
@@ -0,0 +1,664 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultS3CacheSize is the size of the local cache of an S3Store
+	// when none is given.
+	DefaultS3CacheSize = 4 * DefaultBlockFileSize
+
+	// DefaultS3Retries is the number of times a failed request of an
+	// S3Store is retried when no other number is given.
+	DefaultS3Retries = 5
+
+	// DefaultS3RetryDelay is how long an S3Store waits before retrying a
+	// failed request for the first time when no other delay is given.
+	DefaultS3RetryDelay = 500 * time.Millisecond
+
+	// s3MaxRetryDelay is the longest an S3Store waits between retries.
+	s3MaxRetryDelay = 30 * time.Second
+
+	// s3DefaultRegion is the region requests are signed for when none is
+	// given.
+	s3DefaultRegion = "us-east-1"
+
+	// emptyPayloadHash is the hex encoded SHA-256 hash of an empty request
+	// body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config describes the bucket of an S3-compatible object store an S3Store
+// keeps its files in.
+type S3Config struct {
+	// Endpoint is the URL of the object store, such as
+	// "https://s3.us-west-2.amazonaws.com" or "http://127.0.0.1:9000".
+	// Objects are addressed by path, as Endpoint/Bucket/Prefix/name.
+	Endpoint string
+
+	// Region is the region requests are signed for, "us-east-1" when it
+	// is empty.
+	Region string
+
+	// Bucket is the name of the bucket, which must already exist.
+	Bucket string
+
+	// Prefix is prepended to the names of the files to form their object
+	// keys, so a bucket may be shared.
+	Prefix string
+
+	// AccessKey and SecretKey are the credentials requests are signed
+	// with, using AWS Signature Version 4.  Requests are sent unsigned when
+	// they are empty.
+	AccessKey string
+	SecretKey string
+
+	// CacheDir is the local directory of the write-through cache, which
+	// keeps the files most recently stored so they are read without a
+	// request to the object store.  Files are not cached when it is
+	// empty.
+	CacheDir string
+
+	// CacheSize is the number of bytes the cache may hold, and
+	// DefaultS3CacheSize when it is zero.
+	CacheSize int64
+
+	// Retries is the number of times a request which fails with a network
+	// error, a server error or a throttling response is retried, and
+	// DefaultS3Retries when it is zero.  Requests are not retried when it
+	// is negative.
+	Retries int
+
+	// RetryDelay is how long to wait before the first retry of a request,
+	// and DefaultS3RetryDelay when it is zero.  The delay doubles with
+	// each further retry.
+	RetryDelay time.Duration
+
+	// Client is the HTTP client requests are sent with, and
+	// http.DefaultClient when it is nil.
+	Client *http.Client
+}
+
+// S3Error describes a request of an S3Store the object store refused.
+type S3Error struct {
+	Op         string
+	Name       string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// Error returns the error as a human-readable string.
+func (e *S3Error) Error() string {
+	msg := fmt.Sprintf("s3 %s %s: status %d", e.Op, e.Name, e.StatusCode)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// S3Store is a ColdStore which keeps the flat block files of a database as
+// objects of an S3-compatible object store, so the block bodies of a database
+// need not fit on local disks while its indexes stay in leveldb.  It is given
+// to the database through the ColdStoreOption setting:
+//
+//	store, err := ldb.NewS3Store(ldb.S3Config{...})
+//	opts.Backend[ldb.ColdStoreOption] = store
+//
+// Block files are stored whole, so the blocks of a file are uploaded in a
+// single request once the file is moved to the cold tier.  Blocks of files
+// which are not in the local cache are read with ranged requests.
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	cache    *s3Cache
+}
+
+// Ensure S3Store implements the ColdStore interface.
+var _ ColdStore = (*S3Store)(nil)
+
+// NewS3Store returns an S3Store for the bucket described by the passed config.
+// The local cache directory is created when it does not exist.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") ||
+		endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q -- expected "+
+			"http or https URL", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket given")
+	}
+	if (cfg.AccessKey == "") != (cfg.SecretKey == "") {
+		return nil, fmt.Errorf("S3 access key given without secret " +
+			"key or the other way around")
+	}
+	if cfg.Region == "" {
+		cfg.Region = s3DefaultRegion
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultS3CacheSize
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultS3Retries
+	}
+	if cfg.RetryDelay == 0 {
+		cfg.RetryDelay = DefaultS3RetryDelay
+	}
+
+	s := &S3Store{cfg: cfg, endpoint: endpoint, client: cfg.Client}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	if cfg.CacheDir != "" {
+		s.cache, err = openS3Cache(cfg.CacheDir, cfg.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// s3Escape escapes the passed path the way object keys are escaped in signed
+// requests, which is every byte but the unreserved characters and slashes.
+func s3Escape(p string) string {
+	var buf []byte
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' ||
+			'0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			buf = append(buf, c)
+			continue
+		}
+		buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+	}
+	return string(buf)
+}
+
+// objectURL returns the URL of the object of the file with the given name.
+func (s *S3Store) objectURL(name string) string {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" +
+		path.Join(s.cfg.Prefix, name)
+	u.RawPath = s3Escape(u.Path)
+	return u.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under the passed key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign sets the date and payload hash headers of the passed request and signs
+// it with AWS Signature Version 4 as of the passed time.  The host, the range
+// and the x-amz- headers are signed.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.AccessKey == "" {
+		return
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower != "range" && !strings.HasPrefix(lower, "x-amz-") {
+			continue
+		}
+		headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		names = append(names, lower)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key)+"="+
+				strings.Replace(s3Escape(value), "/", "%2F", -1))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	date := amzDate[:8]
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		s.cfg.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// responseError returns the error of the passed response of a failed request,
+// which is one for which os.IsNotExist is true when there is no such object.
+// The body of the response is closed.
+func responseError(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+
+	e := &S3Error{Op: op, Name: name, StatusCode: resp.StatusCode}
+	var body struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &body) == nil {
+		e.Code, e.Message = body.Code, body.Message
+	}
+	return e
+}
+
+// retryable returns whether a request which failed with the passed status code
+// may succeed when sent again.
+func retryable(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusRequestTimeout
+}
+
+// do sends the request for the file with the given name made by newReq and
+// returns the response when it succeeds.  Requests which fail with a network
+// error, a server error or a throttling response are retried with exponential
+// backoff, so newReq is called for each attempt and must supply the body
+// anew.
+func (s *S3Store) do(op, name string, payloadHash string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	delay := s.cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req, payloadHash, time.Now())
+		resp, err := s.client.Do(req)
+		if err == nil {
+			if resp.StatusCode < 300 {
+				return resp, nil
+			}
+			err = responseError(op, name, resp)
+			if !retryable(resp.StatusCode) {
+				return nil, err
+			}
+		}
+		if attempt >= s.cfg.Retries {
+			return nil, err
+		}
+
+		log.Warnf("S3 request failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > s3MaxRetryDelay {
+			delay = s3MaxRetryDelay
+		}
+	}
+}
+
+// request returns a function which makes requests for the file with the given
+// name without a body, for use with do.
+func (s *S3Store) request(method, name string, header http.Header) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		req, err := http.NewRequest(method, s.objectURL(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		return req, nil
+	}
+}
+
+// Put uploads the local file at the passed path as the object of the given
+// name, and then moves it into the local cache.
+func (s *S3Store) Put(name, src string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	resp, err := s.do("PUT", name, payloadHash, func() (*http.Request, error) {
+		var body io.Reader
+		if size != 0 {
+			body = io.NewSectionReader(file, 0, size)
+		}
+		req, err := http.NewRequest("PUT", s.objectURL(name), body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if s.cache != nil {
+		if err := s.cache.add(name, src, size); err != nil {
+			log.Warnf("Unable to cache block file %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// size returns the size of the object of the given name.
+func (s *S3Store) size(name string) (int64, error) {
+	resp, err := s.do("HEAD", name, emptyPayloadHash,
+		s.request("HEAD", name, nil))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("s3 HEAD %s: no content length", name)
+	}
+	return resp.ContentLength, nil
+}
+
+// Open opens the file of the given name for reading, from the local cache when
+// it holds the file.
+func (s *S3Store) Open(name string) (ColdFile, error) {
+	if s.cache != nil {
+		if file, ok := s.cache.open(name); ok {
+			return file, nil
+		}
+	}
+	size, err := s.size(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{store: s, name: name, size: size}, nil
+}
+
+// Remove removes the object of the given name, along with its copy in the
+// local cache, and returns its size.
+func (s *S3Store) Remove(name string) (int64, error) {
+	if s.cache != nil {
+		s.cache.remove(name)
+	}
+	size, err := s.size(name)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.do("DELETE", name, emptyPayloadHash,
+		s.request("DELETE", name, nil))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return size, nil
+}
+
+// s3File is a ColdFile which reads an object of an S3Store with ranged
+// requests.
+type s3File struct {
+	store *S3Store
+	name  string
+	size  int64
+}
+
+// ReadAt reads len(p) bytes of the object starting at offset off.
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("s3 GET %s: negative offset", f.name)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf := p
+	if off+int64(len(buf)) > f.size {
+		buf = buf[:f.size-off]
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off,
+		off+int64(len(buf))-1))
+	resp, err := f.store.do("GET", f.name, emptyPayloadHash,
+		f.store.request("GET", f.name, header))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Servers which ignore the range send the whole object.
+	if resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(resp.Body, buf)
+	if err == nil && len(buf) < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close closes the file.
+func (f *s3File) Close() error {
+	return nil
+}
+
+// Size returns the size of the object in bytes.
+func (f *s3File) Size() int64 {
+	return f.size
+}
+
+// s3Cache is the local write-through cache of an S3Store.  It holds the files
+// stored by the S3Store, up to maxSize bytes, and drops the least recently used
+// ones to make room.
+type s3Cache struct {
+	dir     string
+	maxSize int64
+
+	mtx   sync.Mutex
+	size  int64
+	files map[string]*cacheEntry
+}
+
+// cacheEntry is a file held by an s3Cache.
+type cacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// openS3Cache returns the cache kept in the passed directory, which holds the
+// files left in it by earlier runs.
+func openS3Cache(dir string, maxSize int64) (*s3Cache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	c := &s3Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		files:   make(map[string]*cacheEntry),
+	}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(p, ".tmp") {
+			return os.Remove(p)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		c.files[filepath.ToSlash(rel)] = &cacheEntry{
+			size: fi.Size(),
+			used: fi.ModTime(),
+		}
+		c.size += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.shrink()
+	return c, nil
+}
+
+// path returns the local path of the cached file of the given name.
+func (c *s3Cache) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
+
+// add moves the local file at the passed path into the cache as the file of
+// the given name, or copies it when it can not be moved.
+func (c *s3Cache) add(name, src string, size int64) error {
+	if size > c.maxSize {
+		return nil
+	}
+	dst := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if _, err := copyFile(dst, src); err != nil {
+			return err
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.files[name]; ok {
+		c.size -= e.size
+	}
+	c.files[name] = &cacheEntry{size: size, used: time.Now()}
+	c.size += size
+	c.shrink()
+	return nil
+}
+
+// open opens the cached file of the given name, and returns false when the
+// cache does not hold it.
+func (c *s3Cache) open(name string) (ColdFile, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.files[name]
+	if !ok {
+		return nil, false
+	}
+	file, err := openLocalFile(c.path(name))
+	if err != nil {
+		delete(c.files, name)
+		c.size -= e.size
+		return nil, false
+	}
+	e.used = time.Now()
+	return file, true
+}
+
+// remove drops the file of the given name from the cache.
+func (c *s3Cache) remove(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.drop(name)
+}
+
+// drop removes the file of the given name from the cache.  The cache lock must
+// be held.
+func (c *s3Cache) drop(name string) {
+	e, ok := c.files[name]
+	if !ok {
+		return
+	}
+	os.Remove(c.path(name))
+	delete(c.files, name)
+	c.size -= e.size
+}
+
+// shrink drops the least recently used files until the cache is within its
+// size.  The cache lock must be held.
+func (c *s3Cache) shrink() {
+	for c.size > c.maxSize {
+		var oldest string
+		var used time.Time
+		for name, e := range c.files {
+			if oldest == "" || e.used.Before(used) {
+				oldest, used = name, e.used
+			}
+		}
+		c.drop(oldest)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"strconv"
+)
+
+// schemaKey records the version of the format of the database.  Databases
+// created before it was recorded are at version 0.
+var schemaKey = settingKey("schema")
+
+// schemaUpgradeKey records the version an upgrade of the format of the database
+// is under way to, followed by the cursor from which it resumes should it be
+// interrupted.  It is removed once the database is at the version.
+var schemaUpgradeKey = settingKey("schemaupgrade")
+
+// schemaUpgradeBatch is the number of records upgraded in a single batch.
+const schemaUpgradeBatch = 10000
+
+// schemaMigration upgrades the format of the database from the version before
+// its own.
+type schemaMigration struct {
+	version     uint32
+	description string
+
+	// migrate performs the upgrade.  It is passed the cursor of the last
+	// checkpoint of an interrupted run, or nil when the upgrade starts
+	// afresh, and leaves the records of its final batch in the batch of
+	// the database to be written along with the new version.
+	migrate func(u *schemaUpgrade, cursor []byte) error
+}
+
+// schemaMigrations are the upgrades of the format of the database in the order
+// they are applied.  New formats are added by appending a migration with the
+// next version.
+var schemaMigrations = []schemaMigration{
+	{1, "key records by their kind", upgradeLegacyKeys},
+	{2, "record the position of transactions in their blocks",
+		recordTxPositions},
+	{3, "encode the spent bits of transactions compactly",
+		encodeSpentRecords},
+	{4, "store the location of transactions in the transaction index",
+		locateTxIndexEntries},
+}
+
+// schemaVersion returns the version of the format of new databases.
+func schemaVersion() uint32 {
+	return schemaMigrations[len(schemaMigrations)-1].version
+}
+
+// schemaVersionValue returns the passed version as it is stored.
+func schemaVersionValue(version uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], version)
+	return buf[:]
+}
+
+// schemaUpgrade tracks a migration as it runs.
+type schemaUpgrade struct {
+	db       *LevelDb
+	status   btcdb.UpgradeStatus
+	progress func(btcdb.UpgradeStatus)
+}
+
+// checkpoint writes the batch of the database along with the cursor from which
+// the migration resumes should it be interrupted, and reports that the passed
+// number of records were upgraded by it.
+func (u *schemaUpgrade) checkpoint(cursor []byte, upgraded int64) error {
+	val := append(schemaVersionValue(u.status.Version), cursor...)
+	u.db.lBatch().Put(schemaUpgradeKey, val)
+	if err := u.db.writeBatch(u.db.lBatch(), u.db.wo); err != nil {
+		return err
+	}
+	u.db.lBatch().Reset()
+
+	u.status.Done += upgraded
+	log.Infof("Upgraded %d records to version %d", u.status.Done,
+		u.status.Version)
+	if u.progress != nil {
+		u.progress(u.status)
+	}
+	return nil
+}
+
+// loadSchema records the version of the format of a new database, and
+// upgrades an existing one written in an older format by running the
+// migrations it is missing in turn.  Databases in an older format can not be
+// opened read-only.
+func (db *LevelDb) loadSchema(create bool, progress func(btcdb.UpgradeStatus)) error {
+	if create {
+		return db.put(schemaKey, schemaVersionValue(schemaVersion()))
+	}
+
+	var version uint32
+	val, err := db.get(schemaKey)
+	switch {
+	case err == leveldb.ErrNotFound:
+	case err != nil:
+		return err
+	case len(val) != 4:
+		return btcdb.ErrCorruption
+	default:
+		version = binary.LittleEndian.Uint32(val)
+	}
+	switch {
+	case version > schemaVersion():
+		return fmt.Errorf("unsupported database format version %d -- "+
+			"expected at most %d", version, schemaVersion())
+	case version == schemaVersion():
+		return nil
+	case db.readOnly:
+		return btcdb.ErrUpgradeRequired
+	}
+
+	// An interrupted upgrade resumes from its last checkpoint.
+	var resumeVersion uint32
+	var resumeCursor []byte
+	val, err = db.get(schemaUpgradeKey)
+	switch {
+	case err == leveldb.ErrNotFound:
+	case err != nil:
+		return err
+	case len(val) < 4:
+		return btcdb.ErrCorruption
+	default:
+		resumeVersion = binary.LittleEndian.Uint32(val)
+		resumeCursor = val[4:]
+	}
+
+	defer db.lBatch().Reset()
+	for _, m := range schemaMigrations {
+		if m.version <= version {
+			continue
+		}
+		var cursor []byte
+		if m.version == resumeVersion {
+			cursor = resumeCursor
+			log.Infof("Resuming the upgrade of the database to "+
+				"version %d: %s", m.version, m.description)
+		} else {
+			log.Infof("Upgrading the database to version %d: %s",
+				m.version, m.description)
+		}
+
+		u := schemaUpgrade{
+			db: db,
+			status: btcdb.UpgradeStatus{
+				Version:     m.version,
+				Description: m.description,
+			},
+			progress: progress,
+		}
+		if err := m.migrate(&u, cursor); err != nil {
+			return err
+		}
+
+		db.lBatch().Put(schemaKey, schemaVersionValue(m.version))
+		db.lBatch().Delete(schemaUpgradeKey)
+		if err := db.writeBatch(db.lBatch(), db.wo); err != nil {
+			return err
+		}
+		db.lBatch().Reset()
+
+		u.status.Complete = true
+		if progress != nil {
+			progress(u.status)
+		}
+	}
+	return nil
+}
+
+// legacySettings are the names the settings were stored under before keys
+// started with the kind of their record.
+var legacySettings = []string{
+	"blockfiles", "blockflags", "chainwork", "checksums", "encryption",
+	"filterindex", "headers", "headersonly", "pruneheight", "spendindex",
+	"txindex", "utxosetsize",
+}
+
+// legacyEncryptionKey is the key the encryption check was stored under before
+// keys started with the kind of their record.
+var legacyEncryptionKey = []byte("encryption")
+
+// legacyMetaPrefix preceded the keys of the metadata namespace before keys
+// started with the kind of their record.
+var legacyMetaPrefix = []byte("meta/")
+
+// legacyShaSuffixes and legacyOutPointSuffixes map the suffixes which followed
+// the hashes and outpoints of legacy keys to the kinds of their records.
+var legacyShaSuffixes = map[string]byte{
+	"tx": txNs,
+	"sx": spentTxNs,
+	"tr": txIndexNs,
+	"ud": undoNs,
+}
+var legacyOutPointSuffixes = map[string]byte{
+	"ux": utxoNs,
+	"sp": spendNs,
+}
+
+// legacyHeightSuffixes maps the suffixes which followed the decimal heights of
+// legacy keys to the kinds of their records.
+var legacyHeightSuffixes = map[string]byte{
+	"":   blockNs,
+	"hd": headerNs,
+	"wk": workNs,
+	"cf": filterNs,
+}
+
+// Cursors of the upgrade of legacy keys, naming the pass it is in.
+var (
+	legacyKeysPass = []byte{0}
+	legacyMetaPass = []byte{1}
+)
+
+// upgradeLegacyKeys moves every record of a database created before keys
+// started with the kind of their record to the key it is stored under now.  The
+// keys of the metadata namespace, which may look like the legacy keys of other
+// records once they are upgraded, are moved in a pass of their own, so an
+// interrupted upgrade resumes without mistaking upgraded keys for legacy ones.
+func upgradeLegacyKeys(u *schemaUpgrade, cursor []byte) error {
+	if !bytes.Equal(cursor, legacyMetaPass) {
+		err := u.db.upgradeKeys(u, legacyKeysPass, legacyKeyToKey)
+		if err != nil {
+			return err
+		}
+		if err := u.checkpoint(legacyMetaPass, 0); err != nil {
+			return err
+		}
+	}
+	return u.db.upgradeKeys(u, legacyMetaPass, legacyMetaKeyToKey)
+}
+
+// upgradeKeys moves every record whose key the passed function upgrades to the
+// upgraded key, checkpointing the upgrade with the given cursor after each
+// batch.  The records of the last batch are left for the caller to write.
+func (db *LevelDb) upgradeKeys(u *schemaUpgrade, cursor []byte,
+	upgrade func(key []byte) []byte) error {
+
+	snap, err := db.lDb.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	iter := snap.NewIterator(nil, db.ro)
+	defer iter.Release()
+
+	var moved int64
+	for iter.Next() {
+		key := upgrade(iter.Key())
+		if key == nil {
+			continue
+		}
+		val := iter.Value()
+		if db.aead != nil {
+			val, err = db.unseal(iter.Key(), val)
+			if err != nil {
+				return err
+			}
+		}
+		db.lBatch().Put(key, val)
+		db.lBatch().Delete(iter.Key())
+
+		moved++
+		if moved == schemaUpgradeBatch {
+			if err := u.checkpoint(cursor, moved); err != nil {
+				return err
+			}
+			moved = 0
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	u.status.Done += moved
+	return nil
+}
+
+// legacyKeyToKey returns the key the record stored under the passed legacy key
+// is stored under now, or nil when it is not a legacy key of a record other
+// than those of the metadata namespace.
+func legacyKeyToKey(key []byte) []byte {
+	if bytes.HasPrefix(key, legacyMetaPrefix) {
+		return nil
+	}
+	for _, name := range legacySettings {
+		if string(key) == name {
+			return settingKey(name)
+		}
+	}
+
+	// Records of blocks were keyed by their decimal height followed by
+	// the suffix of their kind.
+	digits := 0
+	for digits < len(key) && key[digits] >= '0' && key[digits] <= '9' {
+		digits++
+	}
+	ns, ok := legacyHeightSuffixes[string(key[digits:])]
+	if ok && digits > 0 {
+		s := string(key[:digits])
+		height, err := strconv.ParseInt(s, 10, 64)
+		if err == nil && strconv.FormatInt(height, 10) == s {
+			return heightKey(ns, height)
+		}
+	}
+
+	// Other records were keyed by a block hash on its own, or by a hash or
+	// outpoint followed by the suffix of their kind.
+	suffixes := legacyShaSuffixes
+	switch len(key) {
+	case btcwire.HashSize:
+		return append([]byte{blockShaNs}, key...)
+	case btcwire.HashSize + 6:
+		suffixes = legacyOutPointSuffixes
+		fallthrough
+	case btcwire.HashSize + 2:
+		end := len(key) - 2
+		if ns, ok := suffixes[string(key[end:])]; ok {
+			return append([]byte{ns}, key[:end]...)
+		}
+	}
+	return nil
+}
+
+// legacyMetaKeyToKey returns the key the record stored under the passed legacy
+// key of the metadata namespace is stored under now, or nil when it is not
+// such a key.
+func legacyMetaKeyToKey(key []byte) []byte {
+	if !bytes.HasPrefix(key, legacyMetaPrefix) {
+		return nil
+	}
+	return metaToKey(key[len(legacyMetaPrefix):])
+}
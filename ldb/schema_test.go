@@ -0,0 +1,276 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// outpointsSpent returns the spent status of every output of the passed blocks
+// as reported by IsOutpointSpent.
+func outpointsSpent(t *testing.T, db btcdb.Db, blocks []*btcutil.Block) map[btcwire.OutPoint]bool {
+	spent := make(map[btcwire.OutPoint]bool)
+	for _, block := range blocks {
+		for _, tx := range block.Transactions() {
+			for idx := range tx.MsgTx().TxOut {
+				op := btcwire.NewOutPoint(tx.Sha(), uint32(idx))
+				got, err := db.IsOutpointSpent(op)
+				if err != nil {
+					t.Errorf("IsOutpointSpent: %v", err)
+				}
+				spent[*op] = got
+			}
+		}
+	}
+	return spent
+}
+
+// checkTxPositions ensures the transactions of the passed blocks, which start
+// at height zero, are fetched along with their index within their block.
+func checkTxPositions(t *testing.T, db btcdb.Db, blocks []*btcutil.Block) {
+	for height, block := range blocks {
+		for idx, tx := range block.Transactions() {
+			replies, err := db.FetchTxBySha(tx.Sha())
+			if err != nil || len(replies) == 0 {
+				t.Errorf("FetchTxBySha: transaction %v of block "+
+					"%d is missing (err %v)", tx.Sha(), height,
+					err)
+				continue
+			}
+			reply := replies[len(replies)-1]
+			if reply.Height != int64(height) || reply.BlkIndex != idx {
+				t.Errorf("FetchTxBySha: transaction %v got index "+
+					"%d of block %d, want %d of block %d",
+					tx.Sha(), reply.BlkIndex, reply.Height,
+					idx, height)
+			}
+		}
+	}
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	dbname := "tstdbschema"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)[:200]
+	key := bytes.Repeat([]byte{0x42}, 32)
+	opts := btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.EncryptionKeyOption: key},
+	}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	meta := []byte("meta value")
+	if err := db.PutMeta([]byte("key"), meta); err != nil {
+		t.Errorf("PutMeta: %v", err)
+	}
+	spent := outpointsSpent(t, db, blocks)
+
+	// Index the transactions so the upgrade has legacy index entries, which
+	// held a copy of the transaction, to replace with their location.
+	if err := db.(*ldb.LevelDb).EnableTxIndex(true); err != nil {
+		t.Errorf("EnableTxIndex: %v", err)
+	}
+
+	// Move the records to their legacy keys to get a database in the old
+	// format.
+	if err := ldb.DowngradeSchema(db); err != nil {
+		t.Errorf("DowngradeSchema: %v", err)
+		db.Close()
+		return
+	}
+	db.Close()
+
+	// Legacy databases can't be read until they are upgraded.
+	opts.ReadOnly = true
+	_, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != btcdb.ErrUpgradeRequired {
+		t.Errorf("OpenDBWithOptions: got %v reading a legacy database, "+
+			"want %v", err, btcdb.ErrUpgradeRequired)
+	}
+
+	opts.ReadOnly = false
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	checkTip(t, db, int64(len(blocks)-1))
+	for height, block := range blocks {
+		sha, _ := block.Sha()
+		want, _ := block.Bytes()
+		got, err := db.FetchBlockBytesBySha(sha, nil)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("FetchBlockBytesBySha: block %d does not match "+
+				"(err %v)", height, err)
+		}
+		if _, err := db.FetchBlockHeaderByHeight(int64(height)); err != nil {
+			t.Errorf("FetchBlockHeaderByHeight: %v", err)
+		}
+	}
+
+	// The records of legacy databases don't hold the index of their
+	// transaction within its block, which is found from the block.
+	checkTxPositions(t, db, blocks)
+	checkTxs(t, db, 0, len(blocks))
+
+	// Spent bits stored as they are by legacy databases are encoded.
+	if got := outpointsSpent(t, db, blocks); !reflect.DeepEqual(got, spent) {
+		t.Errorf("IsOutpointSpent: spent outputs changed by the upgrade")
+	}
+	if got, err := db.GetMeta([]byte("key")); !bytes.Equal(got, meta) {
+		t.Errorf("GetMeta: got %q (err %v), want %q", got, err, meta)
+	}
+
+	// The upgraded database keeps working.
+	sha, _ := blocks[150].Sha()
+	if err := db.DropAfterBlockBySha(sha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+	}
+	for _, block := range blocks[151:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	checkTip(t, db, int64(len(blocks)-1))
+
+	// Blocks connected after the upgrade record the index along with the
+	// transactions spent by them, which were recorded without it.
+	blocks = loadblocks(t)
+	for _, block := range blocks[200:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	checkTip(t, db, int64(len(blocks)-1))
+	checkTxPositions(t, db, blocks)
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	dbname := "tstdbmigrate"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)[:20]
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("InsertBlock: %v", err)
+		}
+	}
+	version, err := ldb.SchemaVersion(db)
+	if err != nil {
+		t.Errorf("SchemaVersion: %v", err)
+	}
+	db.Close()
+
+	// The migration is interrupted after its first checkpoint the first
+	// time it runs, and resumes from there the next.
+	errInterrupted := errors.New("interrupted")
+	var cursors [][]byte
+	remove := ldb.AddSchemaMigration("test migration", func(cursor []byte,
+		checkpoint func([]byte, int64) error) error {
+
+		cursors = append(cursors, cursor)
+		if cursor == nil {
+			if err := checkpoint([]byte("half"), 10); err != nil {
+				return err
+			}
+			return errInterrupted
+		}
+		return checkpoint([]byte("done"), 5)
+	})
+	defer remove()
+
+	var statuses []btcdb.UpgradeStatus
+	opts := btcdb.Options{
+		Path: dbname,
+		UpgradeProgress: func(status btcdb.UpgradeStatus) {
+			statuses = append(statuses, status)
+		},
+	}
+	if _, err := btcdb.OpenDBWithOptions("leveldb", opts); err != errInterrupted {
+		t.Errorf("OpenDBWithOptions: got %v, want %v", err,
+			errInterrupted)
+	}
+
+	opts.ReadOnly = true
+	_, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != btcdb.ErrUpgradeRequired {
+		t.Errorf("OpenDBWithOptions: got %v opening read-only, want %v",
+			err, btcdb.ErrUpgradeRequired)
+	}
+
+	opts.ReadOnly = false
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	if len(cursors) != 2 || cursors[0] != nil ||
+		!bytes.Equal(cursors[1], []byte("half")) {
+		t.Errorf("migration ran with cursors %q, want [nil half]",
+			cursors)
+	}
+	want := []btcdb.UpgradeStatus{
+		{Version: version + 1, Description: "test migration", Done: 10},
+		{Version: version + 1, Description: "test migration", Done: 5},
+		{Version: version + 1, Description: "test migration", Done: 5,
+			Complete: true},
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("got %d progress reports, want %d", len(statuses),
+			len(want))
+	} else {
+		for i := range want {
+			if statuses[i] != want[i] {
+				t.Errorf("progress report %d is %+v, want %+v",
+					i, statuses[i], want[i])
+			}
+		}
+	}
+	if got, err := ldb.SchemaVersion(db); got != version+1 {
+		t.Errorf("SchemaVersion: got %d (err %v), want %d", got, err,
+			version+1)
+	}
+	checkTip(t, db, int64(len(blocks)-1))
+	db.Close()
+
+	// Databases written in a newer format are refused.
+	remove()
+	if db, err := btcdb.OpenDB("leveldb", dbname); err == nil {
+		t.Errorf("OpenDB: unexpected success opening a database in a " +
+			"newer format")
+		db.Close()
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/goleveldb/leveldb/iterator"
+	"io"
+	"sort"
+)
+
+// snapshot is a read-only view of a leveldb database.  It is a copy of the
+// database state at the time it was taken with all reads going through a
+// leveldb snapshot.
+type snapshot struct {
+	*LevelDb
+}
+
+// Release frees the leveldb snapshot.  This is part of the btcdb.Snapshot
+// interface implementation.
+func (s *snapshot) Release() {
+	s.Close()
+}
+
+// get returns the value for the given key from the snapshot the instance reads
+// from, or from the database itself when it is not a snapshot, decrypting it
+// when the database is encrypted.
+func (db *LevelDb) get(key []byte) ([]byte, error) {
+	var val []byte
+	var err error
+	if db.snap != nil {
+		val, err = db.snap.Get(key, db.ro)
+	} else {
+		val, err = db.lDb.Get(key, db.ro)
+	}
+	if err != nil || db.aead == nil {
+		return val, err
+	}
+	return db.unseal(key, val)
+}
+
+// keySorter sorts the positions of keys by the keys they refer to.
+type keySorter struct {
+	keys  [][]byte
+	order []int
+}
+
+func (s *keySorter) Len() int {
+	return len(s.order)
+}
+
+func (s *keySorter) Less(i, j int) bool {
+	return bytes.Compare(s.keys[s.order[i]], s.keys[s.order[j]]) < 0
+}
+
+func (s *keySorter) Swap(i, j int) {
+	s.order[i], s.order[j] = s.order[j], s.order[i]
+}
+
+// getMulti returns the values for the given keys, which are nil for the keys
+// that do not exist, read the same way as get.  Rather than looking up each key
+// on its own, the keys are visited in order with a single iterator, so all of
+// the values are read from the same point in time in one pass.
+func (db *LevelDb) getMulti(keys [][]byte) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return vals, nil
+	}
+
+	sorter := &keySorter{keys: keys, order: make([]int, len(keys))}
+	for i := range sorter.order {
+		sorter.order[i] = i
+	}
+	sort.Sort(sorter)
+
+	var iter iterator.Iterator
+	if db.snap != nil {
+		iter = db.snap.NewIterator(nil, db.ro)
+	} else {
+		iter = db.lDb.NewIterator(nil, db.ro)
+	}
+	defer iter.Release()
+
+	for _, i := range sorter.order {
+		key := keys[i]
+		if !iter.Seek(key) || !bytes.Equal(iter.Key(), key) {
+			continue
+		}
+		val := append([]byte{}, iter.Value()...)
+		if db.aead != nil {
+			var err error
+			val, err = db.unseal(key, val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		vals[i] = val
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// Snapshot returns a read-only view of the database pinned to the current
+// point in time.  When blocks are stored in flat files, the files of blocks
+// dropped after the snapshot was taken are removed and those blocks can no
+// longer be read through it.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) Snapshot() (btcdb.Snapshot, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	snap, err := db.lDb.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	view := &LevelDb{
+		metrics:          db.metrics,
+		lDb:              db.lDb,
+		ro:               db.ro,
+		wo:               db.wo,
+		nextBlock:        db.nextBlock,
+		lastBlkShaCached: db.lastBlkShaCached,
+		lastBlkSha:       db.lastBlkSha,
+		lastBlkIdx:       db.lastBlkIdx,
+		chainWork:        db.chainWork,
+		headersOnly:      db.headersOnly,
+		pruneHeight:      db.pruneHeight,
+		txIndex:          db.txIndex,
+		spendIndex:       db.spendIndex,
+		filterIndex:      db.filterIndex,
+		utxoTracked:      db.utxoTracked,
+		utxoSetSize:      db.utxoSetSize,
+		headerIndex:      db.headerIndex,
+		checksums:        db.checksums,
+		flagHeight:       db.flagHeight,
+		txPosHeight:      db.txPosHeight,
+		aead:             db.aead,
+		blkFiles:         db.blkFiles,
+		locCache:         db.locCache,
+		readOnly:         true,
+		snap:             snap,
+		root:             db,
+	}
+
+	db.networksLock.Lock()
+	if db.snaps == nil {
+		db.snaps = make(map[*LevelDb]struct{})
+	}
+	db.snaps[view] = struct{}{}
+	db.networksLock.Unlock()
+
+	return &snapshot{view}, nil
+}
+
+// forgetSnapshot removes the passed snapshot from those which are open once it
+// is released.
+func (db *LevelDb) forgetSnapshot(snap *LevelDb) {
+	db.networksLock.Lock()
+	defer db.networksLock.Unlock()
+
+	delete(db.snaps, snap)
+}
+
+// closeSnapshots closes the snapshots which are still open, waiting for the
+// reads in progress through them, so later reads return btcdb.ErrDbClosed
+// rather than reading from a closed database.
+func (db *LevelDb) closeSnapshots() {
+	db.networksLock.Lock()
+	snaps := make([]*LevelDb, 0, len(db.snaps))
+	for snap := range db.snaps {
+		snaps = append(snaps, snap)
+	}
+	db.networksLock.Unlock()
+
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
+
+// VerifyIntegrity performs the integrity checks of the given level on every
+// block of the chain using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) VerifyIntegrity(level int, progress func(height int64)) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.VerifyChain(snap, level, progress)
+}
+
+// ExportBootstrap writes the blocks of a range of heights in the format of
+// bootstrap.dat using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *LevelDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.WriteBootstrap(snap, w, startHeight, endHeight)
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// spendIndexKey is the key used to record that the spend index, which maps
+// each spent output to the transaction which spent it, is enabled for the
+// database.
+var spendIndexKey = settingKey("spendindex")
+
+// spendIndexRebuildBatch is the number of blocks whose spends are written in a
+// single batch while (re)building the spend index.
+const spendIndexRebuildBatch = 500
+
+// spendEntryLen is the length of a spend index entry:
+//
+//	spending tx hash (32) | block height (8) | input index (4)
+const spendEntryLen = btcwire.HashSize + 8 + 4
+
+// outPointSpendToKey returns the key for the spend index entry of the given
+// outpoint.
+func outPointSpendToKey(op *btcwire.OutPoint) []byte {
+	return outPointKey(spendNs, op)
+}
+
+// formatSpend generates the value buffer for a spend index entry.
+func formatSpend(txSha *btcwire.ShaHash, blkHeight int64, inIdx int) []byte {
+	buf := make([]byte, spendEntryLen)
+	copy(buf, txSha.Bytes())
+	binary.LittleEndian.PutUint64(buf[btcwire.HashSize:], uint64(blkHeight))
+	binary.LittleEndian.PutUint32(buf[btcwire.HashSize+8:], uint32(inIdx))
+	return buf
+}
+
+// indexBlockSpends adds spend index entries for every output spent by the
+// passed block to the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) indexBlockSpends(blkHeight int64, block *btcutil.Block) {
+	for _, tx := range block.Transactions() {
+		msgTx := tx.MsgTx()
+		if isCoinbaseTx(msgTx) {
+			continue
+		}
+		for inIdx, txIn := range msgTx.TxIn {
+			db.lBatch().Put(outPointSpendToKey(&txIn.PreviousOutpoint),
+				formatSpend(tx.Sha(), blkHeight, inIdx))
+		}
+	}
+}
+
+// unindexBlockSpends removes the spend index entries for every output spent by
+// the passed block from the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) unindexBlockSpends(block *btcutil.Block) {
+	for _, tx := range block.Transactions() {
+		msgTx := tx.MsgTx()
+		if isCoinbaseTx(msgTx) {
+			continue
+		}
+		for _, txIn := range msgTx.TxIn {
+			db.lBatch().Delete(outPointSpendToKey(&txIn.PreviousOutpoint))
+		}
+	}
+}
+
+// FetchSpendingTx returns the transaction which spent the output referenced by
+// the given outpoint.  This is part of the btcdb.Db interface implementation.
+//
+// The spend index is optional for this backend and btcdb.ErrNoSpendIndex is
+// returned unless it has been enabled with EnableSpendIndex.
+func (db *LevelDb) FetchSpendingTx(op *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	if !db.spendIndex {
+		return nil, btcdb.ErrNoSpendIndex
+	}
+
+	buf, err := db.get(outPointSpendToKey(op))
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != spendEntryLen {
+		return nil, btcdb.ErrCorruption
+	}
+
+	var sha btcwire.ShaHash
+	sha.SetBytes(buf[0:btcwire.HashSize])
+	return &btcdb.SpendingTx{
+		Sha:        &sha,
+		Height:     int64(binary.LittleEndian.Uint64(buf[btcwire.HashSize:])),
+		InputIndex: binary.LittleEndian.Uint32(buf[btcwire.HashSize+8:]),
+	}, nil
+}
+
+// SpendIndexEnabled returns whether or not the spend index is maintained for
+// the database.
+func (db *LevelDb) SpendIndexEnabled() bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return false
+	}
+
+	return db.spendIndex
+}
+
+// EnableSpendIndex turns maintenance of the spend index on or off.  The setting
+// is persisted in the database.  When the index is turned on for a database
+// which already contains blocks, it is built from the stored blocks.  When it
+// is turned off, all existing index entries are removed.
+func (db *LevelDb) EnableSpendIndex(enable bool) error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	db.flush()
+	if enable && db.headersOnly {
+		return btcdb.ErrHeadersOnly
+	}
+	if enable && db.pruneHeight > 0 {
+		return btcdb.ErrPruned
+	}
+
+	if enable == db.spendIndex {
+		return nil
+	}
+
+	if enable {
+		// The setting is only recorded once every entry is in place,
+		// so an interrupted build leaves the index disabled.
+		if err := db.walkSpendIndex(true); err != nil {
+			return err
+		}
+		if err := db.put(spendIndexKey, []byte{1}); err != nil {
+			return err
+		}
+		db.spendIndex = true
+		return nil
+	}
+
+	if err := db.lDb.Delete(spendIndexKey, db.wo); err != nil {
+		return err
+	}
+	db.spendIndex = false
+	return db.walkSpendIndex(false)
+}
+
+// walkSpendIndex iterates every stored block and either adds or removes the
+// spend index entries for the outputs it spends.  The changes are committed in
+// batches to bound memory usage.
+// Must be called with db write lock held.
+func (db *LevelDb) walkSpendIndex(add bool) error {
+	defer db.lBatch().Reset()
+
+	for height := int64(0); height < db.nextBlock; height++ {
+		_, buf, err := db.getBlkByHeight(height)
+		if err != nil {
+			return err
+		}
+		blk, err := btcutil.NewBlockFromBytes(buf)
+		if err != nil {
+			return err
+		}
+
+		if add {
+			db.indexBlockSpends(height, blk)
+		} else {
+			db.unindexBlockSpends(blk)
+		}
+
+		if (height+1)%spendIndexRebuildBatch == 0 {
+			err := db.writeBatch(db.lBatch(), db.wo)
+			if err != nil {
+				return err
+			}
+			db.lBatch().Reset()
+			log.Infof("Spend index processed through height %d",
+				height)
+		}
+	}
+
+	return db.writeBatch(db.lBatch(), db.wo)
+}
+
+// loadSpendIndexSetting reads whether the spend index is enabled from the
+// database.
+func (db *LevelDb) loadSpendIndexSetting() error {
+	_, err := db.get(spendIndexKey)
+	switch err {
+	case nil:
+		db.spendIndex = true
+	case leveldb.ErrNotFound:
+		db.spendIndex = false
+	default:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"os"
+	"testing"
+)
+
+func TestSpendIndex(t *testing.T) {
+	dbname := "tstdbspendidx"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+
+	// Find the first output spent by the test blocks.
+	var spendTx *btcutil.Tx
+	var spendHeight int64
+	for height, block := range blocks {
+		if txs := block.Transactions(); len(txs) > 1 {
+			spendTx = txs[1]
+			spendHeight = int64(height)
+			break
+		}
+	}
+	if spendTx == nil {
+		t.Errorf("test blocks spend no outputs")
+		return
+	}
+	op := spendTx.MsgTx().TxIn[0].PreviousOutpoint
+
+	ldbDb := db.(*ldb.LevelDb)
+	if ldbDb.SpendIndexEnabled() {
+		t.Errorf("spend index enabled by default")
+	}
+	if _, err := db.FetchSpendingTx(&op); err != btcdb.ErrNoSpendIndex {
+		t.Errorf("FetchSpendingTx: unexpected error with index "+
+			"disabled - got %v, want %v", err, btcdb.ErrNoSpendIndex)
+	}
+	if err := ldbDb.EnableSpendIndex(true); err != nil {
+		t.Errorf("EnableSpendIndex: %v", err)
+		return
+	}
+
+	// The setting must persist across a reopen.
+	db.Close()
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	ldbDb = db.(*ldb.LevelDb)
+	if !ldbDb.SpendIndexEnabled() {
+		t.Errorf("spend index not enabled after reopen")
+	}
+	spender, err := db.FetchSpendingTx(&op)
+	if err != nil || spender == nil || !spender.Sha.IsEqual(spendTx.Sha()) ||
+		spender.Height != spendHeight || spender.InputIndex != 0 {
+
+		t.Errorf("FetchSpendingTx %v: got %+v, %v", op, spender, err)
+	}
+
+	// Turning the index off removes its entries, so a spend dropped while
+	// it is off is not reported once it is turned back on.
+	if err := ldbDb.EnableSpendIndex(false); err != nil {
+		t.Errorf("EnableSpendIndex: %v", err)
+	}
+	dropSha, _ := blocks[spendHeight-1].Sha()
+	if err := db.DropAfterBlockBySha(dropSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	if err := ldbDb.EnableSpendIndex(true); err != nil {
+		t.Errorf("EnableSpendIndex: %v", err)
+	}
+	spender, err = db.FetchSpendingTx(&op)
+	if err != nil || spender != nil {
+		t.Errorf("FetchSpendingTx %v: dropped spend got %+v, %v", op,
+			spender, err)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"github.com/conformal/goleveldb/leveldb/util"
+)
+
+// The spent bits of the outputs of a transaction, a bit for each output with
+// the bits past the last output set, are stored after a byte naming their
+// encoding so new encodings can be added without upgrading existing records.
+const (
+	// spentBitmapEncoding stores the bits as they are, a byte for every
+	// eight outputs.
+	spentBitmapEncoding byte = 1
+
+	// spentRunsEncoding stores the lengths of the runs of unspent and
+	// spent outputs in turn as unsigned varints, starting with a run of
+	// unspent ones which may be empty.  It is used when it is shorter,
+	// which is the case for transactions with many outputs of which few
+	// or most are spent.
+	spentRunsEncoding byte = 2
+)
+
+// maxSpentBits is the most spent bits decoded from a record, which is more
+// than the outputs of any transaction which fits in a block.
+const maxSpentBits = 8 * btcwire.MaxBlockPayload
+
+// encodeSpentBits returns the stored form of the passed spent bits.
+func encodeSpentBits(spent []byte) []byte {
+	bitmap := make([]byte, 1+len(spent))
+	bitmap[0] = spentBitmapEncoding
+	copy(bitmap[1:], spent)
+
+	runs := []byte{spentRunsEncoding}
+	var varint [binary.MaxVarintLen64]byte
+	var run uint64
+	set := false
+	for i := 0; i < 8*len(spent); i++ {
+		if (spent[i/8]&(byte(1)<<uint(i%8)) != 0) != set {
+			n := binary.PutUvarint(varint[:], run)
+			runs = append(runs, varint[:n]...)
+			if len(runs) >= len(bitmap) {
+				return bitmap
+			}
+			set = !set
+			run = 0
+		}
+		run++
+	}
+	n := binary.PutUvarint(varint[:], run)
+	runs = append(runs, varint[:n]...)
+	if len(runs) >= len(bitmap) {
+		return bitmap
+	}
+	return runs
+}
+
+// decodeSpentBits returns the spent bits stored in the passed buffer made by
+// encodeSpentBits.
+func decodeSpentBits(buf []byte) ([]byte, error) {
+	if len(buf) == 0 {
+		return nil, btcdb.ErrCorruption
+	}
+	switch buf[0] {
+	case spentBitmapEncoding:
+		return append([]byte{}, buf[1:]...), nil
+
+	case spentRunsEncoding:
+		var spent []byte
+		var bits uint64
+		set := false
+		for rest := buf[1:]; len(rest) != 0; set = !set {
+			run, n := binary.Uvarint(rest)
+			if n <= 0 || run > maxSpentBits-bits {
+				return nil, btcdb.ErrCorruption
+			}
+			rest = rest[n:]
+			for need := int((bits + run + 7) / 8); len(spent) < need; {
+				spent = append(spent, 0)
+			}
+			if set {
+				for i := bits; i < bits+run; i++ {
+					spent[i/8] |= byte(1) << (i % 8)
+				}
+			}
+			bits += run
+		}
+		if bits%8 != 0 {
+			return nil, btcdb.ErrCorruption
+		}
+		if spent == nil {
+			spent = []byte{}
+		}
+		return spent, nil
+	}
+	return nil, btcdb.ErrCorruption
+}
+
+// encodeSpentRecords upgrades a database whose transaction records hold their
+// spent bits as they are, a byte for every eight outputs whether or not any is
+// spent, to records holding them as encoded by encodeSpentBits.  The records of
+// the transactions and of their overwritten instances are rewritten in key
+// order, and the cursor is the key of the last record rewritten.
+func encodeSpentRecords(u *schemaUpgrade, cursor []byte) error {
+	// Transaction records are parsed according to the height from which
+	// they hold the index of the transaction within its block, which is
+	// not loaded while the database is upgraded.
+	if err := u.db.loadTxPosSetting(); err != nil {
+		return err
+	}
+
+	var upgraded int64
+	for _, ns := range []byte{txNs, overwrittenTxNs} {
+		iter := u.db.lDb.NewIterator(util.BytesPrefix([]byte{ns}),
+			u.db.ro)
+		ok := iter.First()
+		if cursor != nil {
+			ok = iter.Seek(cursor)
+			if ok && bytes.Equal(iter.Key(), cursor) {
+				ok = iter.Next()
+			}
+		}
+		for ; ok; ok = iter.Next() {
+			key := iter.Key()
+			val := iter.Value()
+			if u.db.aead != nil {
+				var err error
+				val, err = u.db.unseal(key, val)
+				if err != nil {
+					iter.Release()
+					return err
+				}
+			}
+			txU, err := parseLegacyTxData(u.db, val)
+			if err != nil {
+				iter.Release()
+				return err
+			}
+			buf, err := u.db.formatTx(txU)
+			if err != nil {
+				iter.Release()
+				return err
+			}
+			u.db.lBatch().Put(append([]byte{}, key...), buf)
+
+			upgraded++
+			if upgraded == schemaUpgradeBatch {
+				err := u.checkpoint(append([]byte{}, key...),
+					upgraded)
+				if err != nil {
+					iter.Release()
+					return err
+				}
+				upgraded = 0
+			}
+		}
+		err := iter.Error()
+		iter.Release()
+		if err != nil {
+			return err
+		}
+	}
+	u.status.Done += upgraded
+	return nil
+}
+
+// parseLegacyTxData returns the transaction record in the passed buffer, which
+// holds its spent bits as they are.
+func parseLegacyTxData(db *LevelDb, buf []byte) (*txUpdateObj, error) {
+	blkHeight, txOff, txLen, txIdx, rest, err := db.parseTxLocation(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &txUpdateObj{
+		blkHeight: blkHeight,
+		txidx:     txIdx,
+		txoff:     txOff,
+		txlen:     txLen,
+		spentData: append([]byte{}, rest...),
+	}, nil
+}
+
+// IsOutpointSpent returns whether the output referenced by the given outpoint
+// was spent by a transaction of the main chain, reading nothing but the record
+// of its transaction.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) IsOutpointSpent(op *btcwire.OutPoint) (bool, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return false, btcdb.ErrDbClosed
+	}
+	if db.headersOnly {
+		return false, btcdb.ErrHeadersOnly
+	}
+
+	_, _, _, _, spent, err := db.getTxData(&op.Hash)
+	if err == leveldb.ErrNotFound {
+		// Transactions whose outputs are all spent only have records
+		// of their fully spent instances.
+		_, err = db.get(shaSpentTxToKey(&op.Hash))
+		if err == leveldb.ErrNotFound {
+			return false, btcdb.ErrTxNotFound
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if int64(op.Index) >= 8*int64(len(spent)) {
+		return true, nil
+	}
+	return spent[op.Index/8]&(byte(1)<<(op.Index%8)) != 0, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"testing"
+)
+
+// spentBits returns the spent bits of a transaction with the passed number of
+// outputs of which those at the passed indexes are spent.
+func spentBits(outs int, spent ...int) []byte {
+	bits := make([]byte, (outs+7)/8)
+	for i := outs; i < 8*len(bits); i++ {
+		bits[i/8] |= byte(1) << uint(i%8)
+	}
+	for _, i := range spent {
+		bits[i/8] |= byte(1) << uint(i%8)
+	}
+	return bits
+}
+
+func TestSpentBits(t *testing.T) {
+	all := make([]int, 3000)
+	for i := range all {
+		all[i] = i
+	}
+	tests := []struct {
+		name   string
+		spent  []byte
+		maxLen int
+	}{
+		{"no outputs", spentBits(0), 1},
+		{"two unspent", spentBits(2), 2},
+		{"two, one spent", spentBits(2, 1), 2},
+		{"sixteen", spentBits(16, 3, 9), 3},
+		{"many unspent", spentBits(3000), 4},
+		{"many, few spent", spentBits(3000, 5, 1000, 2999), 10},
+		{"many, most spent", spentBits(3000, all[1:2999]...), 6},
+		{"many, alternating", spentBits(64, 0, 2, 4, 6, 8, 10, 12, 14,
+			16, 18, 20, 22, 24, 26, 28, 30), 9},
+	}
+	for _, test := range tests {
+		buf := ldb.EncodeSpentBits(test.spent)
+		if len(buf) > test.maxLen {
+			t.Errorf("EncodeSpentBits (%s): got %d bytes, want at "+
+				"most %d", test.name, len(buf), test.maxLen)
+		}
+		got, err := ldb.DecodeSpentBits(buf)
+		if err != nil || !bytes.Equal(got, test.spent) {
+			t.Errorf("DecodeSpentBits (%s): got %x (err %v), want %x",
+				test.name, got, err, test.spent)
+		}
+	}
+
+	// Malformed and unknown encodings are reported as corruption.
+	bad := [][]byte{
+		nil,
+		{0x00},
+		{0x03, 0x01},
+		{0x02, 0x05},
+		{0x02, 0x80},
+		{0x02, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	}
+	for _, buf := range bad {
+		if _, err := ldb.DecodeSpentBits(buf); err != btcdb.ErrCorruption {
+			t.Errorf("DecodeSpentBits: got %v for %x, want %v", err,
+				buf, btcdb.ErrCorruption)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// ColdPathOption is the key of the btcdb.Options Backend setting which
+	// turns on tiered storage of flat block files.  Its value is the
+	// directory, usually on slower and cheaper storage, the block files
+	// holding only old blocks are moved to.
+	ColdPathOption = "coldpath"
+
+	// ColdStoreOption is the key of the btcdb.Options Backend setting which
+	// turns on tiered storage of flat block files with a ColdStore, such
+	// as an S3Store, as the cold tier.  It may not be given along with the
+	// ColdPathOption setting.
+	ColdStoreOption = "coldstore"
+
+	// HotRetentionOption is the key of the btcdb.Options Backend setting
+	// which sets how old, as a time.Duration, the blocks of a block file
+	// must all be by their timestamps before the file is moved to the
+	// cold path.  It defaults to DefaultHotRetention.
+	HotRetentionOption = "hotretention"
+
+	// DefaultHotRetention is the age of the blocks kept on the hot path
+	// when the HotRetentionOption setting is not given.
+	DefaultHotRetention = 30 * 24 * time.Hour
+
+	// demoteInterval is how often block files are moved to the cold path
+	// while the database is open.
+	demoteInterval = time.Hour
+)
+
+// errNoColdPath is returned by Demote when storage is not tiered.
+var errNoColdPath = fmt.Errorf("the database has neither a %s nor a %s "+
+	"setting", ColdPathOption, ColdStoreOption)
+
+// ColdFile is a file of a ColdStore open for reading.
+type ColdFile interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the size of the file in bytes.
+	Size() int64
+}
+
+// ColdStore is the cold tier of tiered storage, which holds the flat block
+// files moved off the hot path.  Files are named by slash separated paths,
+// such as "blk00012.dat" or "networks/0b110907/blk00003.dat", and are never
+// changed once stored.  Implementations must be safe for concurrent use.
+type ColdStore interface {
+	// Put stores the local file at the passed path under the given name,
+	// replacing any file of the name.  The local file may be moved into
+	// the store rather than copied.
+	Put(name, path string) error
+
+	// Open opens the file of the given name for reading.  It returns an
+	// error for which os.IsNotExist is true when there is no such file.
+	Open(name string) (ColdFile, error)
+
+	// Remove removes the file of the given name and returns its size.  It
+	// returns an error for which os.IsNotExist is true when there is no
+	// such file.
+	Remove(name string) (int64, error)
+}
+
+// localFile is a ColdFile which is a local file.
+type localFile struct {
+	*os.File
+	size int64
+}
+
+// Size returns the size of the file in bytes.
+func (f *localFile) Size() int64 {
+	return f.size
+}
+
+// openLocalFile opens the local file at the passed path as a ColdFile.
+func openLocalFile(path string) (*localFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localFile{File: file, size: fi.Size()}, nil
+}
+
+// dirStore is the ColdStore of the ColdPathOption setting, which keeps the
+// files in a local directory.
+type dirStore struct {
+	dir string
+}
+
+// path returns the local path of the file of the given name.
+func (s *dirStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// Put stores the local file at the passed path under the given name.  The file
+// is renamed when the directory is on the same file system and copied
+// otherwise, in which case it is left at the passed path.
+func (s *dirStore) Put(name, src string) error {
+	dst := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	_, err := copyFile(dst, src)
+	return err
+}
+
+// Open opens the file of the given name for reading.
+func (s *dirStore) Open(name string) (ColdFile, error) {
+	return openLocalFile(s.path(name))
+}
+
+// Remove removes the file of the given name and returns its size.
+func (s *dirStore) Remove(name string) (int64, error) {
+	path := s.path(name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), os.Remove(path)
+}
+
+// prefixStore is a ColdStore which keeps its files in a directory of another
+// store, which is how the chains of other networks share the cold tier of the
+// database.
+type prefixStore struct {
+	store  ColdStore
+	prefix string
+}
+
+// Put stores the local file at the passed path under the given name.
+func (s *prefixStore) Put(name, src string) error {
+	return s.store.Put(path.Join(s.prefix, name), src)
+}
+
+// Open opens the file of the given name for reading.
+func (s *prefixStore) Open(name string) (ColdFile, error) {
+	return s.store.Open(path.Join(s.prefix, name))
+}
+
+// Remove removes the file of the given name and returns its size.
+func (s *prefixStore) Remove(name string) (int64, error) {
+	return s.store.Remove(path.Join(s.prefix, name))
+}
+
+// parseTier returns the cold tier the passed options ask for, nil when storage
+// is not tiered, and how old blocks are once they are moved to it.
+func parseTier(funcName string, dbOpts *btcdb.Options) (ColdStore, time.Duration, error) {
+	var store ColdStore
+	if arg, ok := dbOpts.Backend[ColdPathOption]; ok {
+		coldPath, ok := arg.(string)
+		if !ok || coldPath == "" {
+			return nil, 0, fmt.Errorf("%s setting to ldb.%s is invalid "+
+				"-- expected directory path string",
+				ColdPathOption, funcName)
+		}
+		store = &dirStore{dir: coldPath}
+	}
+	if arg, ok := dbOpts.Backend[ColdStoreOption]; ok {
+		s, ok := arg.(ColdStore)
+		if !ok || s == nil || store != nil {
+			return nil, 0, fmt.Errorf("%s setting to ldb.%s is invalid "+
+				"-- expected ldb.ColdStore without a %s setting",
+				ColdStoreOption, funcName, ColdPathOption)
+		}
+		store = s
+	}
+	if store == nil {
+		return nil, 0, nil
+	}
+
+	retention := DefaultHotRetention
+	if arg, ok := dbOpts.Backend[HotRetentionOption]; ok {
+		retention, ok = arg.(time.Duration)
+		if !ok || retention < 0 {
+			return nil, 0, fmt.Errorf("%s setting to ldb.%s is "+
+				"invalid -- expected non-negative time.Duration",
+				HotRetentionOption, funcName)
+		}
+	}
+	return store, retention, nil
+}
+
+// blockFileName returns the name of the flat block file with the given number.
+func blockFileName(fileNum uint32) string {
+	return fmt.Sprintf("blk%05d.dat", fileNum)
+}
+
+// openBlockFile opens the block file with the given number for reading from
+// the hot path, or from the cold tier once it has been moved there.
+func (bf *blockFiles) openBlockFile(fileNum uint32) (blockFileReader, error) {
+	file, err := os.Open(bf.blockFilePath(fileNum))
+	if err == nil {
+		return file, nil
+	}
+	if bf.cold == nil || !os.IsNotExist(err) {
+		return nil, err
+	}
+	return bf.cold.Open(blockFileName(fileNum))
+}
+
+// removeBlockFile removes the block file with the given number from both tiers
+// and returns its size, or -1 when it did not exist on either.
+func (bf *blockFiles) removeBlockFile(fileNum uint32) (int64, error) {
+	removed := int64(-1)
+	path := bf.blockFilePath(fileNum)
+	fi, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	if err == nil {
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = fi.Size()
+	}
+
+	if bf.cold != nil {
+		size, err := bf.cold.Remove(blockFileName(fileNum))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		if err == nil {
+			if removed < 0 {
+				removed = 0
+			}
+			removed += size
+		}
+	}
+	return removed, nil
+}
+
+// copyFile copies the file at src to dst and returns its size.
+func copyFile(dst, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	return writeFile(dst, in)
+}
+
+// writeFile writes the contents of the passed reader to the file at dst, which
+// is written under a temporary name and synced before it replaces any file at
+// dst, so dst is never left incomplete.
+func writeFile(dst string, r io.Reader) (int64, error) {
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+// closeReadFile closes the block file with the given number when it is open
+// for reading.  The read lock must be held exclusively.
+func (bf *blockFiles) closeReadFile(fileNum uint32) {
+	if file, ok := bf.readFiles[fileNum]; ok {
+		file.Close()
+		delete(bf.readFiles, fileNum)
+	}
+}
+
+// demoteFile moves the block file with the given number from the hot path to
+// the cold tier and returns its size.  It is only removed from the hot path once
+// the cold tier holds it, and reads keep using it until then.
+func (bf *blockFiles) demoteFile(fileNum uint32) (int64, error) {
+	hot := bf.blockFilePath(fileNum)
+	fi, err := os.Stat(hot)
+	if err != nil {
+		return 0, err
+	}
+	if err := bf.cold.Put(blockFileName(fileNum), hot); err != nil {
+		return 0, err
+	}
+
+	bf.readLock.Lock()
+	defer bf.readLock.Unlock()
+	bf.closeReadFile(fileNum)
+	if err := os.Remove(hot); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// promote moves the block file with the given number back from the cold tier
+// to the hot path when it is only on the cold tier, which is needed before it
+// is written to again.
+func (bf *blockFiles) promote(fileNum uint32) error {
+	if bf.cold == nil {
+		return nil
+	}
+	hot := bf.blockFilePath(fileNum)
+	if _, err := os.Stat(hot); !os.IsNotExist(err) {
+		return err
+	}
+	name := blockFileName(fileNum)
+	file, err := bf.cold.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Moving block file %d back to the hot path", fileNum)
+	_, err = writeFile(hot, io.NewSectionReader(file, 0, file.Size()))
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	bf.readLock.Lock()
+	defer bf.readLock.Unlock()
+	bf.closeReadFile(fileNum)
+	_, err = bf.cold.Remove(name)
+	return err
+}
+
+// oldestHot returns the number of the oldest block file on the hot path other
+// than the one blocks are written to, and false when there is none.  Files
+// below nextHot have already been moved.  The tier lock must be held.
+func (bf *blockFiles) oldestHot() (uint32, bool, error) {
+	for ; bf.nextHot < bf.writeLoc.fileNum; bf.nextHot++ {
+		_, err := os.Stat(bf.blockFilePath(bf.nextHot))
+		if err == nil {
+			return bf.nextHot, true, nil
+		}
+		if !os.IsNotExist(err) {
+			return 0, false, err
+		}
+	}
+	return 0, false, nil
+}
+
+// lastHeightInFile returns the height of the last block stored in the block
+// file with the given number, which must not be the file blocks are written
+// to.  Blocks are stored in height order, so it is the block before the first
+// one stored in a later file.
+// Must be called with db read lock held.
+func (db *LevelDb) lastHeightInFile(fileNum uint32) (int64, error) {
+	low, high := int64(0), db.lastBlkIdx
+	for low < high {
+		mid := low + (high-low)/2
+		_, loc, err := db.getBlkLocByHeight(mid)
+		if err != nil {
+			return 0, err
+		}
+		if loc.fileNum > fileNum {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	return low - 1, nil
+}
+
+// Demote moves the flat block files whose blocks are all older than the hot
+// retention to the cold tier given by the ColdPathOption or ColdStoreOption
+// setting and returns the number of bytes moved.  It is run every hour while the database is open
+// for writing, and may be called to move the files right away.  The file
+// blocks are written to is never moved.
+func (db *LevelDb) Demote() (int64, error) {
+	db.readLock()
+	closed, readOnly := db.closed, db.readOnly
+	db.dbLock.RUnlock()
+	if closed {
+		return 0, btcdb.ErrDbClosed
+	}
+	if readOnly {
+		return 0, btcdb.ErrReadOnly
+	}
+	if db.blkFiles == nil || db.blkFiles.cold == nil {
+		return 0, errNoColdPath
+	}
+
+	db.blkFiles.tierLock.Lock()
+	defer db.blkFiles.tierLock.Unlock()
+
+	cutoff := time.Now().Add(-db.hotRetention)
+	var moved int64
+	var files int
+	for {
+		n, ok, err := db.demoteOldest(cutoff)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+		if !ok {
+			break
+		}
+		files++
+	}
+	if files != 0 {
+		log.Infof("Moved %d block files, %d bytes, to the cold tier",
+			files, moved)
+	}
+	return moved, nil
+}
+
+// demoteOldest moves the oldest block file on the hot path to the cold tier
+// when its last block is older than the passed cutoff.  It returns false when
+// there is no such file.  The database is locked for reading, so blocks may be
+// read from the file while it is moved, while changes wait for the move to
+// finish.  The tier lock must be held.
+func (db *LevelDb) demoteOldest(cutoff time.Time) (int64, bool, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return 0, false, btcdb.ErrDbClosed
+	}
+	bf := db.blkFiles
+	fileNum, ok, err := bf.oldestHot()
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	height, err := db.lastHeightInFile(fileNum)
+	if err != nil {
+		return 0, false, err
+	}
+	if height >= 0 {
+		bh, err := db.fetchHeaderByHeight(height)
+		if err != nil {
+			return 0, false, err
+		}
+		if !bh.Timestamp.Before(cutoff) {
+			return 0, false, nil
+		}
+	}
+
+	n, err := bf.demoteFile(fileNum)
+	if err != nil {
+		return 0, false, err
+	}
+	bf.nextHot = fileNum + 1
+	return n, true, nil
+}
+
+// demoteOld is run every demoteInterval to move the block files of old blocks
+// to the cold tier.
+func (db *LevelDb) demoteOld() {
+	if _, err := db.Demote(); err != nil && err != btcdb.ErrDbClosed {
+		log.Warnf("Unable to move block files to the cold tier: %v", err)
+	}
+}
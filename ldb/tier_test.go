@@ -0,0 +1,153 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkBlocks ensures every passed block reads back the same as it was
+// inserted.
+func checkBlocks(t *testing.T, db btcdb.Db, blocks []*btcutil.Block) {
+	for i, block := range blocks {
+		sha, _ := block.Sha()
+		blk, err := db.FetchBlockBySha(sha)
+		if err != nil {
+			t.Errorf("FetchBlockBySha: block %v: %v", i, err)
+			return
+		}
+		got, _ := blk.Bytes()
+		want, _ := block.Bytes()
+		if !bytes.Equal(got, want) {
+			t.Errorf("FetchBlockBySha: block %v does not match", i)
+			return
+		}
+	}
+}
+
+// TestTieredStorage ensures the block files of old blocks are moved to the
+// cold path, that blocks are read from either path, and that a file is moved
+// back when blocks are dropped into it.
+func TestTieredStorage(t *testing.T) {
+	dbname := "tstdbtier"
+	dbnamever := dbname + ".ver"
+	coldPath := "tstdbtiercold"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	_ = os.RemoveAll(coldPath)
+	opts := btcdb.Options{
+		Path: dbname,
+		Backend: map[string]interface{}{
+			ldb.BlockFileSizeOption: 16 * 1024,
+			ldb.ColdPathOption:      coldPath,
+		},
+	}
+	db, err := btcdb.CreateDB("ffldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer os.RemoveAll(coldPath)
+
+	blocks := loadblocks(t)
+	if _, err := db.InsertBlocks(blocks); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		db.Close()
+		return
+	}
+
+	hotFile := func(num int) string {
+		return filepath.Join(dbname, "blocks",
+			fmt.Sprintf("blk%05d.dat", num))
+	}
+	coldFile := func(num int) string {
+		return filepath.Join(coldPath, fmt.Sprintf("blk%05d.dat", num))
+	}
+	if _, err := os.Stat(hotFile(2)); err != nil {
+		t.Errorf("block files did not roll over: %v", err)
+	}
+
+	// Every block of the test data is older than the default retention,
+	// so all files but the one written to are moved.
+	moved, err := db.(*ldb.LevelDb).Demote()
+	if err != nil || moved <= 0 {
+		t.Errorf("Demote: got %d (err %v), want files moved", moved, err)
+	}
+	for _, num := range []int{0, 1} {
+		if _, err := os.Stat(hotFile(num)); !os.IsNotExist(err) {
+			t.Errorf("block file %d was kept on the hot path: %v",
+				num, err)
+		}
+		if _, err := os.Stat(coldFile(num)); err != nil {
+			t.Errorf("block file %d is not on the cold path: %v",
+				num, err)
+		}
+	}
+	if moved, err := db.(*ldb.LevelDb).Demote(); moved != 0 || err != nil {
+		t.Errorf("Demote: got %d (err %v) once moved, want 0", moved, err)
+	}
+	checkBlocks(t, db, blocks)
+	db.Close()
+
+	// Nothing is moved while the blocks are within the retention.
+	opts.Backend[ldb.HotRetentionOption] = 100 * 365 * 24 * time.Hour
+	db, err = btcdb.OpenDB("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to reopen test database %v", err)
+		return
+	}
+	defer db.Close()
+	checkBlocks(t, db, blocks)
+
+	// Dropping blocks into a moved file moves it back.
+	keepSha, _ := blocks[10].Sha()
+	if err := db.DropAfterBlockBySha(keepSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	if _, err := os.Stat(hotFile(0)); err != nil {
+		t.Errorf("block file 0 was not moved back: %v", err)
+	}
+	if _, err := os.Stat(coldFile(1)); !os.IsNotExist(err) {
+		t.Errorf("block file of dropped blocks not removed: %v", err)
+	}
+	if _, err := db.InsertBlocks(blocks[11:]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		return
+	}
+	if moved, err := db.(*ldb.LevelDb).Demote(); moved != 0 || err != nil {
+		t.Errorf("Demote: got %d (err %v) within retention, want 0",
+			moved, err)
+	}
+	checkBlocks(t, db, blocks)
+}
+
+// TestTieredStorageLevelDB ensures storage can only be tiered for blocks stored
+// in flat files.
+func TestTieredStorageLevelDB(t *testing.T) {
+	dbname := "tstdbtierldb"
+	_ = os.RemoveAll(dbname)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbname + ".ver")
+
+	opts := btcdb.Options{
+		Path:    dbname,
+		Backend: map[string]interface{}{ldb.ColdPathOption: "cold"},
+	}
+	if db, err := btcdb.CreateDB("leveldb", opts); err == nil {
+		db.Close()
+		t.Errorf("CreateDB: unexpected success with a cold path")
+	}
+}
@@ -13,9 +13,12 @@ import (
 	"github.com/conformal/goleveldb/leveldb"
 )
 
+// txUpdateObj is a pending change to the record of a transaction.  The index
+// of the transaction within its block, txidx, is -1 when it is not known.
 type txUpdateObj struct {
 	txSha     *btcwire.ShaHash
 	blkHeight int64
+	txidx     int
 	txoff     int
 	txlen     int
 	ntxout    int
@@ -25,6 +28,7 @@ type txUpdateObj struct {
 
 type spentTx struct {
 	blkHeight int64
+	txidx     int
 	txoff     int
 	txlen     int
 	numTxO    int
@@ -35,21 +39,28 @@ type spentTxUpdate struct {
 	delete bool
 }
 
-// InsertTx inserts a tx hash and its associated data into the database.
+// InsertTx inserts a tx hash and its associated data into the database.  The
+// index of the transaction within its block is found from the block when the
+// transaction is fetched.
 func (db *LevelDb) InsertTx(txsha *btcwire.ShaHash, height int64, txoff int, txlen int, spentbuf []byte) (err error) {
 	db.dbLock.Lock()
 	defer db.dbLock.Unlock()
 
-	return db.insertTx(txsha, height, txoff, txlen, spentbuf)
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	return db.insertTx(txsha, height, -1, txoff, txlen, spentbuf)
 }
 
-// insertTx inserts a tx hash and its associated data into the database.
-// Must be called with db lock held.
-func (db *LevelDb) insertTx(txSha *btcwire.ShaHash, height int64, txoff int, txlen int, spentbuf []byte) (err error) {
+// insertTx inserts a tx hash and its associated data, including the index of
+// the transaction within its block, into the database.
+// Must be called with db write lock held.
+func (db *LevelDb) insertTx(txSha *btcwire.ShaHash, height int64, txidx int, txoff int, txlen int, spentbuf []byte) (err error) {
 	var txU txUpdateObj
 
 	txU.txSha = txSha
 	txU.blkHeight = height
+	txU.txidx = txidx
 	txU.txoff = txoff
 	txU.txlen = txlen
 	txU.spentData = spentbuf
@@ -59,13 +70,24 @@ func (db *LevelDb) insertTx(txSha *btcwire.ShaHash, height int64, txoff int, txl
 	return nil
 }
 
-// formatTx generates the value buffer for the Tx db.
+// formatTx generates the value buffer for the Tx db, which is the location of
+// the transaction followed by its spent bits encoded by encodeSpentBits.
 func (db *LevelDb) formatTx(txu *txUpdateObj) ([]byte, error) {
+	buf, err := db.formatTxLocation(txu)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, encodeSpentBits(txu.spentData)...), nil
+}
+
+// formatTxLocation generates the part of the value buffer for the Tx db which
+// comes before the spent bits.  The records of blocks from txPosHeight on hold
+// the index of the transaction within its block after its location.
+func (db *LevelDb) formatTxLocation(txu *txUpdateObj) ([]byte, error) {
 
 	blkHeight := txu.blkHeight
 	txoff := txu.txoff
 	txlen := txu.txlen
-	spentbuf := txu.spentData
 
 	txOff := int32(txoff)
 	txLen := int32(txlen)
@@ -90,72 +112,107 @@ func (db *LevelDb) formatTx(txu *txUpdateObj) ([]byte, error) {
 		return nil, err
 	}
 
-	err = binary.Write(&txW, binary.LittleEndian, spentbuf)
-	if err != nil {
-		err = fmt.Errorf("Write fail")
-		return nil, err
+	if blkHeight >= db.txPosHeight {
+		err = binary.Write(&txW, binary.LittleEndian, int32(txu.txidx))
+		if err != nil {
+			err = fmt.Errorf("Write fail")
+			return nil, err
+		}
 	}
 
 	return txW.Bytes(), nil
 }
 
 func (db *LevelDb) getTxData(txsha *btcwire.ShaHash) (rblkHeight int64,
-	rtxOff int, rtxLen int, rspentBuf []byte, err error) {
+	rtxOff int, rtxLen int, rtxIdx int, rspentBuf []byte, err error) {
 	var buf []byte
 
 	key := shaTxToKey(txsha)
-	buf, err = db.lDb.Get(key, db.ro)
+	buf, err = db.get(key)
 	if err != nil {
 		return
 	}
+	return db.parseTxData(buf)
+}
+
+// parseTxData returns the block height, location, index within the block and
+// spent data of the transaction record in the passed buffer made by formatTx.
+// The index is -1 when the record does not hold it.
+func (db *LevelDb) parseTxData(buf []byte) (rblkHeight int64, rtxOff int,
+	rtxLen int, rtxIdx int, rspentBuf []byte, err error) {
+
+	blkHeight, txOff, txLen, txIdx, rest, err := db.parseTxLocation(buf)
+	if err != nil {
+		return
+	}
+	spentBuf, err := decodeSpentBits(rest)
+	if err != nil {
+		return
+	}
+	return blkHeight, txOff, txLen, txIdx, spentBuf, nil
+}
+
+// parseTxLocation returns the block height, location and index within the
+// block of the transaction record in the passed buffer, along with the rest of
+// the buffer which holds its spent bits.
+func (db *LevelDb) parseTxLocation(buf []byte) (rblkHeight int64, rtxOff int,
+	rtxLen int, rtxIdx int, rest []byte, err error) {
 
 	var blkHeight int64
 	var txOff, txLen int32
+	txIdx := int32(-1)
 	dr := bytes.NewBuffer(buf)
 	err = binary.Read(dr, binary.LittleEndian, &blkHeight)
 	if err != nil {
-		err = fmt.Errorf("Db Corrupt 1")
+		err = btcdb.ErrCorruption
 		return
 	}
 	err = binary.Read(dr, binary.LittleEndian, &txOff)
 	if err != nil {
-		err = fmt.Errorf("Db Corrupt 2")
+		err = btcdb.ErrCorruption
 		return
 	}
 	err = binary.Read(dr, binary.LittleEndian, &txLen)
 	if err != nil {
-		err = fmt.Errorf("Db Corrupt 3")
+		err = btcdb.ErrCorruption
 		return
 	}
-	// remainder of buffer is spentbuf
-	spentBuf := make([]byte, dr.Len())
-	err = binary.Read(dr, binary.LittleEndian, spentBuf)
-	if err != nil {
-		err = fmt.Errorf("Db Corrupt 4")
-		return
+	if blkHeight >= db.txPosHeight {
+		err = binary.Read(dr, binary.LittleEndian, &txIdx)
+		if err != nil {
+			err = btcdb.ErrCorruption
+			return
+		}
 	}
-	return blkHeight, int(txOff), int(txLen), spentBuf, nil
+	// remainder of buffer is the spent bits
+	return blkHeight, int(txOff), int(txLen), int(txIdx), dr.Bytes(), nil
 }
 
 func (db *LevelDb) getTxFullySpent(txsha *btcwire.ShaHash) ([]*spentTx, error) {
 
-	var badTxList, spentTxList []*spentTx
+	var badTxList []*spentTx
 
 	key := shaSpentTxToKey(txsha)
-	buf, err := db.lDb.Get(key, db.ro)
+	buf, err := db.get(key)
 	if err == leveldb.ErrNotFound {
 		return badTxList, btcdb.TxShaMissing
 	} else if err != nil {
 		return badTxList, err
 	}
-	txListLen := len(buf) / 20
-	txR := bytes.NewBuffer(buf)
-	spentTxList = make([]*spentTx, txListLen, txListLen)
+	return db.parseTxFullySpent(buf)
+}
+
+// parseTxFullySpent returns the fully spent instances of a transaction in the
+// passed buffer made by formatTxFullySpent.
+func (db *LevelDb) parseTxFullySpent(buf []byte) ([]*spentTx, error) {
+	var spentTxList []*spentTx
 
-	for i := range spentTxList {
+	txR := bytes.NewBuffer(buf)
+	for txR.Len() != 0 {
 		var sTx spentTx
 		var blkHeight int64
 		var txOff, txLen, numTxO int32
+		txIdx := int32(-1)
 
 		err := binary.Read(txR, binary.LittleEndian, &blkHeight)
 		if err != nil {
@@ -185,12 +242,218 @@ func (db *LevelDb) getTxFullySpent(txsha *btcwire.ShaHash) ([]*spentTx, error) {
 		}
 		sTx.numTxO = int(numTxO)
 
-		spentTxList[i] = &sTx
+		if blkHeight >= db.txPosHeight {
+			err = binary.Read(txR, binary.LittleEndian, &txIdx)
+			if err != nil {
+				err = fmt.Errorf("sTx Read fail 4")
+				return nil, err
+			}
+		}
+		sTx.txidx = int(txIdx)
+
+		spentTxList = append(spentTxList, &sTx)
 	}
 
 	return spentTxList, nil
 }
 
+// appendFullySpent adds the passed transaction record to the instances of the
+// transaction which are fully spent.
+// Must be called with db write lock held.
+func (db *LevelDb) appendFullySpent(txsha *btcwire.ShaHash, txUo *txUpdateObj) {
+	var txSu *spentTxUpdate
+	// Look up Tx in fully spent table
+	if txSuOld, ok := db.txSpentUpdateMap[*txsha]; ok {
+		txSu = txSuOld
+	} else {
+		var txSuStore spentTxUpdate
+		txSu = &txSuStore
+
+		txSuOld, err := db.getTxFullySpent(txsha)
+		if err == nil {
+			txSu.txl = txSuOld
+		}
+	}
+
+	// Fill in spentTx
+	var sTx spentTx
+	sTx.blkHeight = txUo.blkHeight
+	sTx.txidx = txUo.txidx
+	sTx.txoff = txUo.txoff
+	sTx.txlen = txUo.txlen
+	// XXX -- there is no way to comput the real TxOut
+	// from the spent array.
+	sTx.numTxO = 8 * len(txUo.spentData)
+
+	// append this txdata to fully spent txlist
+	txSu.txl = append(txSu.txl, &sTx)
+
+	db.txSpentUpdateMap[*txsha] = txSu
+}
+
+// popFullySpent removes the most recent of the instances of the transaction
+// which are fully spent and returns it.
+// Must be called with db write lock held.
+func (db *LevelDb) popFullySpent(txsha *btcwire.ShaHash) (*spentTx, error) {
+	var spentTxList []*spentTx
+	if txSuOld, ok := db.txSpentUpdateMap[*txsha]; ok && !txSuOld.delete {
+		spentTxList = txSuOld.txl
+	} else {
+		var err error
+		spentTxList, err = db.getTxFullySpent(txsha)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(spentTxList) == 0 {
+		return nil, btcdb.TxShaMissing
+	}
+
+	// need to reslice the list to exclude the most recent.
+	sTx := spentTxList[len(spentTxList)-1]
+	if len(spentTxList) == 1 {
+		// write entry to delete tx from spent pool
+		db.txSpentUpdateMap[*txsha] = &spentTxUpdate{
+			delete: true,
+		}
+	} else {
+		// the copy keeps the cached list intact
+		// should the batch be discarded.
+		remaining := make([]*spentTx, len(spentTxList)-1)
+		copy(remaining, spentTxList)
+		db.txSpentUpdateMap[*txsha] = &spentTxUpdate{
+			txl: remaining,
+		}
+	}
+	return sTx, nil
+}
+
+// fetchUnspentTx returns the pending or stored record of the passed
+// transaction when it has outputs which are not spent, or nil when the
+// transaction does not exist or is fully spent.
+// Must be called with db write lock held.
+func (db *LevelDb) fetchUnspentTx(txsha *btcwire.ShaHash) (*txUpdateObj, error) {
+	if txUo, ok := db.txUpdateMap[*txsha]; ok {
+		if txUo.delete {
+			return nil, nil
+		}
+		return txUo, nil
+	}
+	if db.txMisses.contains(txsha) {
+		return nil, nil
+	}
+
+	blkHeight, txOff, txLen, txIdx, spentData, err := db.getTxData(txsha)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &txUpdateObj{
+		txSha:     txsha,
+		blkHeight: blkHeight,
+		txidx:     txIdx,
+		txoff:     txOff,
+		txlen:     txLen,
+		spentData: spentData,
+	}, nil
+}
+
+// overwriteTx makes the passed record of an earlier instance of a transaction
+// which is not fully spent one of the instances of the transaction which are
+// fully spent, so a duplicate allowed by btcdb.IsBIP30Exception can take its
+// place, and removes its outputs from the unspent transaction output set.  The
+// record is kept so restoreOverwrittenTx can make the earlier instance
+// available again when the block containing the duplicate is removed.
+// Must be called with db write lock held.
+func (db *LevelDb) overwriteTx(txsha *btcwire.ShaHash, txUo *txUpdateObj) error {
+	buf, err := db.formatTx(txUo)
+	if err != nil {
+		return err
+	}
+	db.lBatch().Put(shaOverwrittenTxToKey(txsha), buf)
+	db.appendFullySpent(txsha, txUo)
+
+	if db.utxoTracked {
+		for idx := 0; idx < 8*len(txUo.spentData); idx++ {
+			if txUo.spentData[idx/8]&(byte(1)<<uint(idx%8)) != 0 {
+				continue
+			}
+			db.spendUtxo(btcwire.NewOutPoint(txsha, uint32(idx)))
+		}
+	}
+	return nil
+}
+
+// restoreOverwrittenTx makes the earlier instance of the passed transaction
+// which was overwritten by overwriteTx available again, along with its unspent
+// outputs and standalone transaction index entry.  It does nothing when no
+// instance of the transaction was overwritten.  The record of the duplicate
+// which overwrote it must already be removed.
+// Must be called with db write lock held.
+func (db *LevelDb) restoreOverwrittenTx(txsha *btcwire.ShaHash) error {
+	key := shaOverwrittenTxToKey(txsha)
+	buf, err := db.get(key)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	blkHeight, txOff, txLen, txIdx, spentData, err := db.parseTxData(buf)
+	if err != nil {
+		return err
+	}
+	if _, err := db.popFullySpent(txsha); err != nil {
+		return err
+	}
+	db.txUpdateMap[*txsha] = &txUpdateObj{
+		txSha:     txsha,
+		blkHeight: blkHeight,
+		txidx:     txIdx,
+		txoff:     txOff,
+		txlen:     txLen,
+		spentData: spentData,
+	}
+	db.lBatch().Delete(key)
+
+	if !db.utxoTracked && !db.txIndex {
+		return nil
+	}
+	tx, blkSha, _, _, err := db.fetchTxDataByLoc(blkHeight, txOff, txLen,
+		nil)
+	if err != nil {
+		return err
+	}
+	if db.utxoTracked {
+		coinbase := isCoinbaseTx(tx)
+		for idx, txOut := range tx.TxOut {
+			if spentData[idx/8]&(byte(1)<<uint(idx%8)) != 0 {
+				continue
+			}
+			db.restoreUtxoEntry(btcwire.NewOutPoint(txsha, uint32(idx)),
+				&btcdb.UtxoEntry{
+					Height:   blkHeight,
+					Coinbase: coinbase,
+					Value:    txOut.Value,
+					PkScript: txOut.PkScript,
+				})
+		}
+	}
+	if db.txIndex {
+		val, err := db.formatTxIndex(blkSha, db.txUpdateMap[*txsha])
+		if err != nil {
+			return err
+		}
+		db.lBatch().Put(shaTxIndexToKey(txsha), val)
+	}
+	return nil
+}
+
+// formatTxFullySpent generates the value buffer for the fully spent instances
+// of a transaction.  Those of blocks from txPosHeight on hold the index of the
+// transaction within its block last.
 func (db *LevelDb) formatTxFullySpent(sTxList []*spentTx) ([]byte, error) {
 	var txW bytes.Buffer
 
@@ -223,6 +486,15 @@ func (db *LevelDb) formatTxFullySpent(sTxList []*spentTx) ([]byte, error) {
 			err = fmt.Errorf("Write fail")
 			return nil, err
 		}
+
+		if blkHeight >= db.txPosHeight {
+			txIdx := int32(sTx.txidx)
+			err = binary.Write(&txW, binary.LittleEndian, txIdx)
+			if err != nil {
+				err = fmt.Errorf("Write fail")
+				return nil, err
+			}
+		}
 	}
 
 	return txW.Bytes(), nil
@@ -230,19 +502,49 @@ func (db *LevelDb) formatTxFullySpent(sTxList []*spentTx) ([]byte, error) {
 
 // ExistsTxSha returns if the given tx sha exists in the database
 func (db *LevelDb) ExistsTxSha(txsha *btcwire.ShaHash) (exists bool) {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return false
+	}
 
 	return db.existsTxSha(txsha)
 }
 
+// ExistsTxShas returns whether or not each of the given transaction hashes is
+// present in the database.  All of the hashes are looked up under a single
+// acquisition of the db lock.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) ExistsTxShas(shas []btcwire.ShaHash) []bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	exists := make([]bool, len(shas))
+	if db.closed {
+		return exists
+	}
+
+	for i := range shas {
+		exists[i] = db.existsTxSha(&shas[i])
+	}
+	return exists
+}
+
 // existsTxSha returns if the given tx sha exists in the database.o
-// Must be called with the db lock held.
+// Must be called with db read lock held.
 func (db *LevelDb) existsTxSha(txSha *btcwire.ShaHash) (exists bool) {
-	_, _, _, _, err := db.getTxData(txSha)
+	if db.txMisses.contains(txSha) {
+		return false
+	}
+
+	_, _, _, _, _, err := db.getTxData(txSha)
 	if err == nil {
 		return true
 	}
+	if err == leveldb.ErrNotFound {
+		db.txMisses.add(txSha)
+	}
 
 	// BUG(drahn) If there was an error beside non-existant deal with it.
 
@@ -251,11 +553,19 @@ func (db *LevelDb) existsTxSha(txSha *btcwire.ShaHash) (exists bool) {
 
 // FetchTxByShaList returns the most recent tx of the name fully spent or not
 func (db *LevelDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
 	// until the fully spent separation of tx is complete this is identical
 	// to FetchUnSpentTxByShaList
 	replies := make([]*btcdb.TxListReply, len(txShaList))
 	for i, txsha := range txShaList {
-		tx, blockSha, height, txspent, err := db.fetchTxDataBySha(txsha)
+		if db.closed {
+			replies[i] = &btcdb.TxListReply{Sha: txsha,
+				Err: btcdb.ErrDbClosed}
+			continue
+		}
+		tx, blockSha, height, txidx, txspent, err := db.fetchTxDataBySha(txsha)
 		btxspent := []bool{}
 		if err == nil {
 			btxspent = make([]bool, len(tx.TxOut), len(tx.TxOut))
@@ -274,9 +584,11 @@ func (db *LevelDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxLis
 				idx := len(sTxList) - 1
 				stx := sTxList[idx]
 
-				tx, blockSha, _, _, err = db.fetchTxDataByLoc(
+				tx, blockSha, height, _, err = db.fetchTxDataByLoc(
 					stx.blkHeight, stx.txoff, stx.txlen, []byte{})
 				if err == nil {
+					txidx = db.txPosition(stx.blkHeight,
+						stx.txidx, stx.txoff)
 					btxspent = make([]bool, len(tx.TxOut))
 					for i := range btxspent {
 						btxspent[i] = true
@@ -284,61 +596,241 @@ func (db *LevelDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxLis
 				}
 			}
 		}
-		txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blockSha, Height: height, TxSpent: btxspent, Err: err}
+		txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blockSha, Height: height, BlkIndex: txidx, TxSpent: btxspent, Err: err}
 		replies[i] = &txlre
 	}
 	return replies
 }
 
 // FetchUnSpentTxByShaList given a array of ShaHash, look up the transactions
-// and return them in a TxListReply array.
+// and return them in a TxListReply array.  Transactions which are fully spent
+// have an Err of TxShaMissing with FullySpent and the height of their most
+// recent instance set.
+//
+// The records of all of the transactions are read in a single pass with
+// getMulti, followed by one pass for the fully spent records of those which
+// were not found.
 func (db *LevelDb) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
-	db.dbLock.Lock()
-	defer db.dbLock.Unlock()
+	db.readLock()
+	defer db.dbLock.RUnlock()
 
 	replies := make([]*btcdb.TxListReply, len(txShaList))
 	for i, txsha := range txShaList {
-		tx, blockSha, height, txspent, err := db.fetchTxDataBySha(txsha)
-		btxspent := []bool{}
-		if err == nil {
-			btxspent = make([]bool, len(tx.TxOut), len(tx.TxOut))
-			for idx := range tx.TxOut {
-				byteidx := idx / 8
-				byteoff := uint(idx % 8)
-				btxspent[idx] = (txspent[byteidx] & (byte(1) << byteoff)) != 0
-			}
+		replies[i] = &btcdb.TxListReply{Sha: txsha,
+			Err: btcdb.TxShaMissing}
+	}
+	if db.closed {
+		for _, reply := range replies {
+			reply.Err = btcdb.ErrDbClosed
 		}
-		txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blockSha, Height: height, TxSpent: btxspent, Err: err}
-		replies[i] = &txlre
+		return replies
+	}
+
+	// failAll sets the passed error on every reply.
+	failAll := func(err error) []*btcdb.TxListReply {
+		for _, reply := range replies {
+			reply.Err = err
+		}
+		return replies
+	}
+
+	keys := make([][]byte, len(txShaList))
+	for i, txsha := range txShaList {
+		keys[i] = shaTxToKey(txsha)
+	}
+	bufs, err := db.getMulti(keys)
+	if err != nil {
+		return failAll(err)
+	}
+
+	// Tell the fully spent transactions from the ones which do not exist.
+	var missing, found []int
+	var spentKeys [][]byte
+	for i, buf := range bufs {
+		if buf == nil {
+			missing = append(missing, i)
+			spentKeys = append(spentKeys, shaSpentTxToKey(txShaList[i]))
+			continue
+		}
+		found = append(found, i)
+	}
+	spentBufs, err := db.getMulti(spentKeys)
+	if err != nil {
+		return failAll(err)
+	}
+	for j, i := range missing {
+		if spentBufs[j] == nil {
+			continue
+		}
+		spentTxList, err := db.parseTxFullySpent(spentBufs[j])
+		if err != nil {
+			replies[i].Err = err
+			continue
+		}
+		if len(spentTxList) != 0 {
+			sTx := spentTxList[len(spentTxList)-1]
+			replies[i].Height = sTx.blkHeight
+			replies[i].FullySpent = true
+		}
+	}
+	for _, i := range found {
+		txsha := txShaList[i]
+		blkHeight, txOff, txLen, txIdx, txspent, err := db.parseTxData(bufs[i])
+		if err != nil {
+			replies[i].Err = err
+			continue
+		}
+		tx, blockSha, height, txspent, err := db.fetchTxDataByRecord(
+			txsha, blkHeight, txOff, txLen, txspent)
+		if err != nil {
+			replies[i].Err = err
+			continue
+		}
+		btxspent := make([]bool, len(tx.TxOut), len(tx.TxOut))
+		for idx := range tx.TxOut {
+			byteidx := idx / 8
+			byteoff := uint(idx % 8)
+			btxspent[idx] = (txspent[byteidx] & (byte(1) << byteoff)) != 0
+		}
+		txidx := db.txPosition(blkHeight, txIdx, txOff)
+		replies[i] = &btcdb.TxListReply{Sha: txsha, Tx: tx,
+			BlkSha: blockSha, Height: height, BlkIndex: txidx,
+			TxSpent: btxspent}
 	}
 	return replies
 }
 
-// fetchTxDataBySha returns several pieces of data regarding the given sha.
-func (db *LevelDb) fetchTxDataBySha(txsha *btcwire.ShaHash) (rtx *btcwire.MsgTx, rblksha *btcwire.ShaHash, rheight int64, rtxspent []byte, err error) {
+// fetchTxDataBySha returns several pieces of data regarding the given sha,
+// including the index of the transaction within its block.  When the
+// standalone transaction index is enabled, the transaction is read from the
+// location held by its index entry.
+func (db *LevelDb) fetchTxDataBySha(txsha *btcwire.ShaHash) (rtx *btcwire.MsgTx, rblksha *btcwire.ShaHash, rheight int64, rtxidx int, rtxspent []byte, err error) {
+	if db.txIndex {
+		return db.fetchTxDataByIndex(txsha)
+	}
+
 	var blkHeight int64
 	var txspent []byte
-	var txOff, txLen int
+	var txOff, txLen, txIdx int
 
-	blkHeight, txOff, txLen, txspent, err = db.getTxData(txsha)
+	blkHeight, txOff, txLen, txIdx, txspent, err = db.getTxData(txsha)
 	if err != nil {
 		if err == leveldb.ErrNotFound {
 			err = btcdb.TxShaMissing
 		}
 		return
 	}
-	return db.fetchTxDataByLoc(blkHeight, txOff, txLen, txspent)
+
+	rtx, rblksha, rheight, rtxspent, err = db.fetchTxDataByRecord(txsha,
+		blkHeight, txOff, txLen, txspent)
+	if err != nil {
+		return
+	}
+	rtxidx = db.txPosition(blkHeight, txIdx, txOff)
+	return
+}
+
+// fetchTxDataByIndex returns the same data as fetchTxDataBySha using the
+// standalone transaction index.  The index entry and the record of the
+// transaction are read in a single pass, and the transaction is read from the
+// block region held by the entry, while the record only supplies the spent
+// data.
+// Must be called with db read lock held.
+func (db *LevelDb) fetchTxDataByIndex(txsha *btcwire.ShaHash) (rtx *btcwire.MsgTx, rblksha *btcwire.ShaHash, rheight int64, rtxidx int, rtxspent []byte, err error) {
+	idxKey := shaTxIndexToKey(txsha)
+	bufs, err := db.getMulti([][]byte{shaTxToKey(txsha), idxKey})
+	if err != nil {
+		return
+	}
+	if bufs[0] == nil {
+		err = btcdb.TxShaMissing
+		return
+	}
+	if bufs[1] == nil {
+		err = &btcdb.CorruptionError{Key: idxKey}
+		return
+	}
+	blkHeight, _, _, _, txspent, err := db.parseTxData(bufs[0])
+	if err != nil {
+		return
+	}
+	blkSha, idxHeight, txOff, txLen, txIdx, err := db.parseTxIndex(bufs[1])
+	if err != nil {
+		return
+	}
+	if idxHeight != blkHeight {
+		err = &btcdb.CorruptionError{Key: idxKey}
+		return
+	}
+
+	rtx, rblksha, rheight, rtxspent, err = db.fetchTxDataByRecord(txsha,
+		blkHeight, txOff, txLen, txspent)
+	if err != nil {
+		return
+	}
+	if !rblksha.IsEqual(blkSha) {
+		err = &btcdb.CorruptionError{Key: idxKey}
+		return
+	}
+	rtxidx = db.txPosition(blkHeight, txIdx, txOff)
+	return
+}
+
+// fetchTxDataByRecord returns several pieces of data regarding the given sha
+// from the location and spent data of its transaction record.  The transaction
+// is read from its region of the stored block.
+func (db *LevelDb) fetchTxDataByRecord(txsha *btcwire.ShaHash, blkHeight int64,
+	txOff int, txLen int, txspent []byte) (rtx *btcwire.MsgTx,
+	rblksha *btcwire.ShaHash, rheight int64, rtxspent []byte, err error) {
+
+	rtx, rblksha, rheight, rtxspent, err = db.fetchTxDataByLoc(blkHeight,
+		txOff, txLen, txspent)
+	if err != nil {
+		return
+	}
+
+	// Only the region of the block holding the transaction is read from
+	// the flat files, so it is checked against its hash rather than the
+	// checksum of the whole block.
+	if db.blkFiles != nil && db.checksums {
+		sha, _ := rtx.TxSha()
+		if !sha.IsEqual(txsha) {
+			log.Errorf("Transaction %v read from block %d hashes "+
+				"to %v", txsha, blkHeight, &sha)
+			err = &btcdb.CorruptionError{Key: heightBlkToKey(blkHeight)}
+			return nil, nil, 0, nil, err
+		}
+	}
+	return
 }
 
 // fetchTxDataByLoc returns several pieces of data regarding the given tx
 // located by the block/offset/size location
 func (db *LevelDb) fetchTxDataByLoc(blkHeight int64, txOff int, txLen int, txspent []byte) (rtx *btcwire.MsgTx, rblksha *btcwire.ShaHash, rheight int64, rtxspent []byte, err error) {
 	var blksha *btcwire.ShaHash
-	var blkbuf []byte
+	var txbuf []byte
 
-	blksha, blkbuf, err = db.getBlkByHeight(blkHeight)
+	if blkHeight < db.pruneHeight {
+		err = btcdb.ErrPruned
+		return
+	}
+	if db.blkFiles != nil {
+		// Only the transaction itself needs to be read when the
+		// block is stored in a flat file.
+		var loc blockLoc
+		blksha, loc, err = db.getBlkLocByHeight(blkHeight)
+		if err == nil {
+			txbuf, err = db.blkFiles.readRegion(loc, txOff, txLen)
+		}
+	} else {
+		var blkbuf []byte
+		blksha, blkbuf, err = db.getBlkByHeight(blkHeight)
+		if err == nil {
+			txbuf = blkbuf[txOff : txOff+txLen]
+		}
+	}
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == btcdb.ErrBlockNotFound {
 			err = btcdb.TxShaMissing
 		}
 		return
@@ -347,7 +839,7 @@ func (db *LevelDb) fetchTxDataByLoc(blkHeight int64, txOff int, txLen int, txspe
 	//log.Trace("transaction %v is at block %v %v txoff %v, txlen %v\n",
 	//	txsha, blksha, blkHeight, txOff, txLen)
 
-	rbuf := bytes.NewBuffer(blkbuf[txOff : txOff+txLen])
+	rbuf := bytes.NewBuffer(txbuf)
 
 	var tx btcwire.MsgTx
 	err = tx.Deserialize(rbuf)
@@ -362,10 +854,20 @@ func (db *LevelDb) fetchTxDataByLoc(blkHeight int64, txOff int, txLen int, txspe
 
 // FetchTxBySha returns some data for the given Tx Sha.
 func (db *LevelDb) FetchTxBySha(txsha *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchTx, txsha)
+	defer op.Done()
+	db.readLock()
+	op.Locked()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
 	replylen := 0
 	replycnt := 0
 
-	tx, blksha, height, txspent, txerr := db.fetchTxDataBySha(txsha)
+	tx, blksha, height, txidx, txspent, txerr := db.fetchTxDataBySha(txsha)
 	if txerr == nil {
 		replylen++
 	} else {
@@ -391,7 +893,7 @@ func (db *LevelDb) FetchTxBySha(txsha *btcwire.ShaHash) ([]*btcdb.TxListReply, e
 			tx, blksha, _, _, err := db.fetchTxDataByLoc(
 				stx.blkHeight, stx.txoff, stx.txlen, []byte{})
 			if err != nil {
-				if err != leveldb.ErrNotFound {
+				if err != btcdb.TxShaMissing {
 					return []*btcdb.TxListReply{}, err
 				}
 				continue
@@ -400,7 +902,8 @@ func (db *LevelDb) FetchTxBySha(txsha *btcwire.ShaHash) ([]*btcdb.TxListReply, e
 			for i := range btxspent {
 				btxspent[i] = true
 			}
-			txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blksha, Height: stx.blkHeight, TxSpent: btxspent, Err: nil}
+			stxidx := db.txPosition(stx.blkHeight, stx.txidx, stx.txoff)
+			txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blksha, Height: stx.blkHeight, BlkIndex: stxidx, TxSpent: btxspent, Err: nil}
 			replies[replycnt] = &txlre
 			replycnt++
 		}
@@ -412,9 +915,12 @@ func (db *LevelDb) FetchTxBySha(txsha *btcwire.ShaHash) ([]*btcdb.TxListReply, e
 			byteoff := uint(idx % 8)
 			btxspent[idx] = (txspent[byteidx] & (byte(1) << byteoff)) != 0
 		}
-		txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blksha, Height: height, TxSpent: btxspent, Err: nil}
+		txlre := btcdb.TxListReply{Sha: txsha, Tx: tx, BlkSha: blksha, Height: height, BlkIndex: txidx, TxSpent: btxspent, Err: nil}
 		replies[replycnt] = &txlre
 		replycnt++
 	}
-	return replies, nil
+	if replycnt == 0 {
+		return nil, btcdb.ErrTxNotFound
+	}
+	return replies[:replycnt], nil
 }
@@ -0,0 +1,396 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"github.com/conformal/goleveldb/leveldb/util"
+)
+
+// txIndexKey is the key used to record that the standalone transaction index
+// is enabled for the database.
+var txIndexKey = settingKey("txindex")
+
+// txIndexRebuildBatch is the number of blocks whose transactions are written
+// in a single batch while (re)building the standalone transaction index.
+const txIndexRebuildBatch = 500
+
+// shaTxIndexToKey returns the key for the standalone transaction index entry
+// of the given transaction hash.
+func shaTxIndexToKey(sha *btcwire.ShaHash) []byte {
+	return shaKey(txIndexNs, sha)
+}
+
+// formatTxIndex generates the value buffer for a standalone transaction index
+// entry.  The value is the hash of the containing block followed by the
+// location of the transaction within it, laid out the same way as in the
+// transaction records.  The transaction itself is only stored in its block.
+func (db *LevelDb) formatTxIndex(blkSha *btcwire.ShaHash, txu *txUpdateObj) ([]byte, error) {
+	loc, err := db.formatTxLocation(txu)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, btcwire.HashSize+len(loc))
+	copy(val, blkSha.Bytes())
+	copy(val[btcwire.HashSize:], loc)
+	return val, nil
+}
+
+// parseTxIndex returns the hash of the containing block and the location of
+// the transaction within it of the standalone transaction index entry in the
+// passed buffer made by formatTxIndex.
+func (db *LevelDb) parseTxIndex(buf []byte) (rblkSha *btcwire.ShaHash,
+	rblkHeight int64, rtxOff int, rtxLen int, rtxIdx int, err error) {
+
+	if len(buf) < btcwire.HashSize {
+		err = btcdb.ErrCorruption
+		return
+	}
+	var blkSha btcwire.ShaHash
+	blkSha.SetBytes(buf[:btcwire.HashSize])
+	blkHeight, txOff, txLen, txIdx, rest, err := db.parseTxLocation(
+		buf[btcwire.HashSize:])
+	if err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		err = btcdb.ErrCorruption
+		return
+	}
+	return &blkSha, blkHeight, txOff, txLen, txIdx, nil
+}
+
+// FetchTxRegion returns the hash and height of the block holding the most
+// recent instance of the transaction with the given hash, along with the
+// offset and length of the transaction within the serialized block, as
+// recorded by the standalone transaction index.  The transaction is read with
+// FetchBlockRegion.  TxShaMissing is returned when the transaction is not
+// indexed.
+func (db *LevelDb) FetchTxRegion(txsha *btcwire.ShaHash) (*btcwire.ShaHash, int64, int, int, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, 0, 0, 0, btcdb.ErrDbClosed
+	}
+	if !db.txIndex {
+		return nil, 0, 0, 0, fmt.Errorf("transaction index is not " +
+			"enabled")
+	}
+
+	buf, err := db.get(shaTxIndexToKey(txsha))
+	if err == leveldb.ErrNotFound {
+		return nil, 0, 0, 0, btcdb.TxShaMissing
+	}
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	blkSha, blkHeight, txOff, txLen, _, err := db.parseTxIndex(buf)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return blkSha, blkHeight, txOff, txLen, nil
+}
+
+// indexBlockTxs adds standalone transaction index entries for every
+// transaction in the passed block to the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) indexBlockTxs(blkSha *btcwire.ShaHash, blkHeight int64,
+	block *btcutil.Block) error {
+
+	txloc, err := block.TxLoc()
+	if err != nil {
+		return err
+	}
+	for txidx, loc := range txloc {
+		txsha, err := block.TxSha(txidx)
+		if err != nil {
+			return err
+		}
+		val, err := db.formatTxIndex(blkSha, &txUpdateObj{
+			blkHeight: blkHeight,
+			txidx:     txidx,
+			txoff:     loc.TxStart,
+			txlen:     loc.TxLen,
+		})
+		if err != nil {
+			return err
+		}
+		db.lBatch().Put(shaTxIndexToKey(txsha), val)
+	}
+	return nil
+}
+
+// unindexBlockTxs removes the standalone transaction index entries for every
+// transaction in the passed block from the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) unindexBlockTxs(block *btcutil.Block) {
+	for _, tx := range block.Transactions() {
+		db.lBatch().Delete(shaTxIndexToKey(tx.Sha()))
+	}
+}
+
+// TxIndexEnabled returns whether or not the standalone transaction index is
+// maintained for the database.
+func (db *LevelDb) TxIndexEnabled() bool {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return false
+	}
+
+	return db.txIndex
+}
+
+// EnableTxIndex turns maintenance of the standalone transaction index on or
+// off.  The setting is persisted in the database.  The index is also turned on
+// by opening the database with the TxIndex field of btcdb.Options set.  When the index is turned on
+// for a database which already contains blocks, it is rebuilt from the stored
+// blocks.  When it is turned off, all existing index entries are removed.
+func (db *LevelDb) EnableTxIndex(enable bool) error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	db.flush()
+	return db.enableTxIndex(enable)
+}
+
+// enableTxIndex turns maintenance of the standalone transaction index on or
+// off as described by EnableTxIndex.
+// Must be called with db write lock held.
+func (db *LevelDb) enableTxIndex(enable bool) error {
+	if enable && db.headersOnly {
+		return btcdb.ErrHeadersOnly
+	}
+	if enable && db.pruneHeight > 0 {
+		return btcdb.ErrPruned
+	}
+
+	if enable == db.txIndex {
+		return nil
+	}
+
+	if enable {
+		if err := db.put(txIndexKey, []byte{1}); err != nil {
+			return err
+		}
+		db.txIndex = true
+		return db.rebuildTxIndex()
+	}
+
+	if err := db.walkTxIndex(false); err != nil {
+		return err
+	}
+	db.txIndex = false
+	return db.lDb.Delete(txIndexKey, db.wo)
+}
+
+// RebuildTxIndex regenerates the standalone transaction index from the blocks
+// stored in the database.  This can be used to repair the index or to create
+// it for a database which was populated before the index was enabled.
+func (db *LevelDb) RebuildTxIndex() error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	db.flush()
+
+	if !db.txIndex {
+		return fmt.Errorf("transaction index is not enabled")
+	}
+	return db.rebuildTxIndex()
+}
+
+// rebuildTxIndex regenerates the standalone transaction index.
+// Must be called with db write lock held.
+func (db *LevelDb) rebuildTxIndex() error {
+	return db.walkTxIndex(true)
+}
+
+// walkTxIndex iterates every stored block and either adds or removes the
+// standalone transaction index entries for its transactions.  The changes are
+// committed in batches to bound memory usage.
+// Must be called with db write lock held.
+func (db *LevelDb) walkTxIndex(add bool) error {
+	defer db.lBatch().Reset()
+
+	for height := int64(0); height < db.nextBlock; height++ {
+		blkSha, buf, err := db.getBlkByHeight(height)
+		if err != nil {
+			return err
+		}
+		blk, err := btcutil.NewBlockFromBytes(buf)
+		if err != nil {
+			return err
+		}
+
+		if add {
+			// Transactions in later blocks must replace those of
+			// earlier duplicates, which is guaranteed by walking
+			// the chain in height order.
+			err = db.indexBlockTxs(blkSha, height, blk)
+			if err != nil {
+				return err
+			}
+		} else {
+			db.unindexBlockTxs(blk)
+		}
+
+		if (height+1)%txIndexRebuildBatch == 0 {
+			if err := db.writeTxIndexBatch(); err != nil {
+				return err
+			}
+			log.Infof("Transaction index processed through height %d",
+				height)
+		}
+	}
+
+	return db.writeTxIndexBatch()
+}
+
+// writeTxIndexBatch commits and resets the current batch.
+// Must be called with db write lock held.
+func (db *LevelDb) writeTxIndexBatch() error {
+	err := db.writeBatch(db.lBatch(), db.wo)
+	db.lBatch().Reset()
+	return err
+}
+
+// loadTxIndexSetting reads whether the standalone transaction index is
+// enabled from the database.
+func (db *LevelDb) loadTxIndexSetting() error {
+	_, err := db.get(txIndexKey)
+	switch err {
+	case nil:
+		db.txIndex = true
+	case leveldb.ErrNotFound:
+		db.txIndex = false
+	default:
+		return err
+	}
+	return nil
+}
+
+// locateTxIndexEntries upgrades a database whose standalone transaction index
+// entries hold a copy of their transaction to entries holding its location
+// instead.  The location of the instance an entry refers to, which is the most
+// recent one, is taken from the record of the transaction, or from its fully
+// spent instances when it has none, so no block is read.  Entries left for an
+// instance which is no longer stored are removed.  The entries are rewritten
+// in key order, and the cursor is the key of the last entry rewritten.
+func locateTxIndexEntries(u *schemaUpgrade, cursor []byte) error {
+	// Transaction records are parsed according to the height from which
+	// they hold the index of the transaction within its block, which is
+	// not loaded while the database is upgraded.
+	if err := u.db.loadTxPosSetting(); err != nil {
+		return err
+	}
+
+	iter := u.db.lDb.NewIterator(util.BytesPrefix([]byte{txIndexNs}),
+		u.db.ro)
+	defer iter.Release()
+	ok := iter.First()
+	if cursor != nil {
+		ok = iter.Seek(cursor)
+		if ok && bytes.Equal(iter.Key(), cursor) {
+			ok = iter.Next()
+		}
+	}
+	var upgraded int64
+	for ; ok; ok = iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		val := iter.Value()
+		if u.db.aead != nil {
+			var err error
+			val, err = u.db.unseal(key, val)
+			if err != nil {
+				return err
+			}
+		}
+		if len(val) < btcwire.HashSize+8 {
+			return &btcdb.CorruptionError{Key: key}
+		}
+		var blkSha, txSha btcwire.ShaHash
+		blkSha.SetBytes(val[:btcwire.HashSize])
+		blkHeight := int64(binary.LittleEndian.Uint64(
+			val[btcwire.HashSize:]))
+		txSha.SetBytes(key[1:])
+
+		txu, err := u.db.locateTxInstance(&txSha, blkHeight)
+		if err != nil {
+			return err
+		}
+		if txu == nil {
+			u.db.lBatch().Delete(key)
+		} else {
+			buf, err := u.db.formatTxIndex(&blkSha, txu)
+			if err != nil {
+				return err
+			}
+			u.db.lBatch().Put(key, buf)
+		}
+
+		upgraded++
+		if upgraded == schemaUpgradeBatch {
+			if err := u.checkpoint(key, upgraded); err != nil {
+				return err
+			}
+			upgraded = 0
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	u.status.Done += upgraded
+	return nil
+}
+
+// locateTxInstance returns the location of the instance of the transaction
+// with the passed hash stored in the block at the passed height, or nil when no
+// record of it is left.
+func (db *LevelDb) locateTxInstance(txsha *btcwire.ShaHash, blkHeight int64) (*txUpdateObj, error) {
+	height, txOff, txLen, txIdx, _, err := db.getTxData(txsha)
+	switch {
+	case err == nil && height == blkHeight:
+		return &txUpdateObj{blkHeight: height, txidx: txIdx,
+			txoff: txOff, txlen: txLen}, nil
+	case err != nil && err != leveldb.ErrNotFound:
+		return nil, err
+	}
+
+	sTxList, err := db.getTxFullySpent(txsha)
+	if err == btcdb.TxShaMissing {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, sTx := range sTxList {
+		if sTx.blkHeight == blkHeight {
+			return &txUpdateObj{blkHeight: blkHeight,
+				txidx: sTx.txidx, txoff: sTx.txoff,
+				txlen: sTx.txlen}, nil
+		}
+	}
+	return nil, nil
+}
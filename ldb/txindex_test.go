@@ -0,0 +1,197 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// checkTxs ensures every transaction in the passed range of blocks can be
+// fetched and matches the original, and when the transaction index is enabled
+// that the region it records holds the transaction.
+func checkTxs(t *testing.T, db btcdb.Db, start, end int) {
+	blocks := loadblocks(t)
+	ldbDb := db.(*ldb.LevelDb)
+	indexed := ldbDb.TxIndexEnabled()
+	for height := start; height < end; height++ {
+		blkSha, _ := blocks[height].Sha()
+		for _, tx := range blocks[height].Transactions() {
+			replies, err := db.FetchTxBySha(tx.Sha())
+			if err != nil || len(replies) == 0 {
+				t.Errorf("FetchTxBySha %v: %v", tx.Sha(), err)
+				return
+			}
+			reply := replies[len(replies)-1]
+			if !reflect.DeepEqual(reply.Tx, tx.MsgTx()) {
+				t.Errorf("FetchTxBySha %v: tx mismatch", tx.Sha())
+			}
+			if !reply.BlkSha.IsEqual(blkSha) ||
+				reply.Height != int64(height) {
+				t.Errorf("FetchTxBySha %v: wrong block %v(%d)",
+					tx.Sha(), reply.BlkSha, reply.Height)
+			}
+
+			// The index only records where the transaction is, so
+			// its bytes must come from the block itself.
+			if !indexed {
+				continue
+			}
+			regSha, regHeight, off, txLen, err :=
+				ldbDb.FetchTxRegion(tx.Sha())
+			if err != nil {
+				t.Errorf("FetchTxRegion %v: %v", tx.Sha(), err)
+				continue
+			}
+			if !regSha.IsEqual(blkSha) || regHeight != int64(height) {
+				t.Errorf("FetchTxRegion %v: wrong block %v(%d)",
+					tx.Sha(), regSha, regHeight)
+			}
+			region, err := db.FetchBlockRegion(regSha, off, txLen)
+			if err != nil {
+				t.Errorf("FetchBlockRegion %v: %v", tx.Sha(), err)
+				continue
+			}
+			var buf bytes.Buffer
+			if err := tx.MsgTx().Serialize(&buf); err != nil {
+				t.Errorf("Serialize %v: %v", tx.Sha(), err)
+				continue
+			}
+			if !bytes.Equal(region, buf.Bytes()) {
+				t.Errorf("FetchTxRegion %v: region mismatch", tx.Sha())
+			}
+		}
+	}
+}
+
+func TestTxIndex(t *testing.T) {
+	dbname := "tstdbtxidx"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)
+
+	// Insert half of the blocks without the index, then enable it which
+	// must rebuild the entries for the blocks already present.
+	half := len(blocks) / 2
+	for _, block := range blocks[:half] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+	ldbDb := db.(*ldb.LevelDb)
+	if ldbDb.TxIndexEnabled() {
+		t.Errorf("transaction index enabled by default")
+	}
+	if err := ldbDb.EnableTxIndex(true); err != nil {
+		t.Errorf("EnableTxIndex: %v", err)
+		return
+	}
+	for _, block := range blocks[half:] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			return
+		}
+	}
+	checkTxs(t, db, 0, len(blocks))
+
+	// The setting must persist across a reopen.
+	db.Close()
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	ldbDb = db.(*ldb.LevelDb)
+	if !ldbDb.TxIndexEnabled() {
+		t.Errorf("transaction index not enabled after reopen")
+	}
+
+	// Dropping blocks must leave the remaining transactions fetchable.
+	dropSha, _ := blocks[half].Sha()
+	if err := db.DropAfterBlockBySha(dropSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	checkTxs(t, db, 0, half+1)
+
+	if err := ldbDb.RebuildTxIndex(); err != nil {
+		t.Errorf("RebuildTxIndex: %v", err)
+	}
+	if err := ldbDb.EnableTxIndex(false); err != nil {
+		t.Errorf("EnableTxIndex: %v", err)
+	}
+	checkTxs(t, db, 0, half+1)
+}
+
+func TestTxIndexOption(t *testing.T) {
+	dbname := "tstdbtxidxopt"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	opts := btcdb.Options{Path: dbname, TxIndex: true}
+	db, err := btcdb.CreateDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	if !db.(*ldb.LevelDb).TxIndexEnabled() {
+		t.Errorf("transaction index not enabled by the TxIndex option")
+	}
+	blocks := loadblocks(t)
+	for _, block := range blocks[:100] {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block: %v", err)
+			db.Close()
+			return
+		}
+	}
+	checkTxs(t, db, 0, 100)
+
+	// Opening a database without the index with the option rebuilds it.
+	if err := db.(*ldb.LevelDb).EnableTxIndex(false); err != nil {
+		t.Errorf("EnableTxIndex: %v", err)
+	}
+	db.Close()
+	db, err = btcdb.OpenDBWithOptions("leveldb", opts)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	if !db.(*ldb.LevelDb).TxIndexEnabled() {
+		t.Errorf("transaction index not rebuilt by the TxIndex option")
+	}
+	checkTxs(t, db, 0, 100)
+
+	// Transactions are located through the index once it is enabled, so
+	// a missing entry is reported rather than worked around.
+	txSha := blocks[99].Transactions()[0].Sha()
+	if err := ldb.RemoveTxIndexEntry(db, txSha); err != nil {
+		t.Errorf("RemoveTxIndexEntry: %v", err)
+		return
+	}
+	_, err = db.FetchTxBySha(txSha)
+	if _, ok := err.(*btcdb.CorruptionError); !ok {
+		t.Errorf("FetchTxBySha: got %v, want a corruption error", err)
+	}
+}
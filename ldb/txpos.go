@@ -0,0 +1,98 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/goleveldb/leveldb"
+	"github.com/conformal/goleveldb/leveldb/util"
+)
+
+// txPosKey records the height from which the transaction records of blocks
+// hold the index of the transaction within its block.  It is zero for
+// databases created since, and the height of the next block at the time of
+// their upgrade for the databases created before.
+var txPosKey = settingKey("txpos")
+
+// loadTxPosSetting reads the height from which transaction records hold the
+// index of the transaction within its block from the database.
+func (db *LevelDb) loadTxPosSetting() error {
+	val, err := db.get(txPosKey)
+	switch {
+	case err == leveldb.ErrNotFound:
+		db.txPosHeight = 0
+	case err != nil:
+		return err
+	case len(val) != 8:
+		return btcdb.ErrCorruption
+	default:
+		db.txPosHeight = int64(binary.LittleEndian.Uint64(val))
+	}
+	return nil
+}
+
+// txPosValue returns the serialized height stored under txPosKey.
+func txPosValue(height int64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(height))
+	return buf[:]
+}
+
+// recordTxPositions upgrades a database whose transaction records don't hold
+// the index of the transaction within its block.  Adding it to the existing
+// records would mean reading every block, so they are left as they are and the
+// height of the next block is recorded instead, from which on the records hold
+// the index.  The index of the transactions of the blocks below it is found
+// from their block when they are fetched.
+func recordTxPositions(u *schemaUpgrade, cursor []byte) error {
+	iter := u.db.lDb.NewIterator(util.BytesPrefix([]byte{blockNs}), u.db.ro)
+	defer iter.Release()
+
+	var next int64
+	if iter.Last() {
+		height, ok := keyHeight(blockNs, iter.Key())
+		if !ok {
+			return btcdb.ErrCorruption
+		}
+		next = height + 1
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	u.db.lBatch().Put(txPosKey, txPosValue(next))
+	return nil
+}
+
+// txPosition returns the index within the block at the given height of the
+// transaction at the given offset of the block, which is the passed index read
+// from its record unless the record does not hold one.  The block is read to
+// find it in that case, and -1 is returned when the block is not available.
+// Must be called with db read lock held.
+func (db *LevelDb) txPosition(blkHeight int64, txIdx int, txOff int) int {
+	if txIdx >= 0 {
+		return txIdx
+	}
+
+	_, buf, err := db.getBlkByHeight(blkHeight)
+	if err != nil {
+		return -1
+	}
+	blk, err := btcutil.NewBlockFromBytes(buf)
+	if err != nil {
+		return -1
+	}
+	txLocs, err := blk.TxLoc()
+	if err != nil {
+		return -1
+	}
+	for i, loc := range txLocs {
+		if loc.TxStart == txOff {
+			return i
+		}
+	}
+	return -1
+}
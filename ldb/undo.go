@@ -0,0 +1,141 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+)
+
+// Each undo record is the concatenation of an entry for every output spent by
+// the block, in the order the spending inputs appear in the block:
+//
+//	outpoint hash (32) | outpoint index (4) | height (8) | coinbase flag (1) |
+//	value (8) | script length (4) | script
+//
+// All integers are little endian.
+const undoEntryHeaderLen = btcwire.HashSize + 4 + 8 + 1 + 8 + 4
+
+// shaUndoToKey returns the key for the undo record of the given block hash.
+func shaUndoToKey(sha *btcwire.ShaHash) []byte {
+	return shaKey(undoNs, sha)
+}
+
+// appendUndo appends an undo entry for every output spent by the passed
+// transaction to the passed undo record, and the outputs themselves to the
+// passed list of spent outputs, with nil for those which are not in the set.
+// It must be called before the outputs are spent.
+// Must be called with db write lock held.
+func (db *LevelDb) appendUndo(undo []byte, spent []*btcdb.UtxoEntry, tx *btcwire.MsgTx) ([]byte, []*btcdb.UtxoEntry, error) {
+	for _, txin := range tx.TxIn {
+		op := &txin.PreviousOutpoint
+		entry, err := db.fetchUnspentForUndo(op)
+		if err != nil {
+			return nil, nil, err
+		}
+		spent = append(spent, entry)
+		if entry == nil {
+			// Leave the output out of the record, the drop will
+			// fall back to recovering it from its transaction.
+			log.Warnf("no unspent output %v:%d to record undo data for",
+				&op.Hash, op.Index)
+			continue
+		}
+
+		var hdr [undoEntryHeaderLen]byte
+		copy(hdr[0:], op.Hash.Bytes())
+		binary.LittleEndian.PutUint32(hdr[32:], op.Index)
+		binary.LittleEndian.PutUint64(hdr[36:], uint64(entry.Height))
+		if entry.Coinbase {
+			hdr[44] = 1
+		}
+		binary.LittleEndian.PutUint64(hdr[45:], uint64(entry.Value))
+		binary.LittleEndian.PutUint32(hdr[53:], uint32(len(entry.PkScript)))
+		undo = append(undo, hdr[:]...)
+		undo = append(undo, entry.PkScript...)
+	}
+	return undo, spent, nil
+}
+
+// spentFromUndo returns the outputs spent by the transactions of the passed
+// block other than its coinbase, one for each of their inputs in the order
+// they appear in the block, from the passed undo entries of the block.  It
+// returns nil when one of the outputs has no entry, so they are not known.
+func spentFromUndo(blk *btcutil.Block, undo map[btcwire.OutPoint]*btcdb.UtxoEntry) []*btcdb.UtxoEntry {
+	var spent []*btcdb.UtxoEntry
+	for _, tx := range blk.MsgBlock().Transactions[1:] {
+		for _, txin := range tx.TxIn {
+			entry, ok := undo[txin.PreviousOutpoint]
+			if !ok {
+				return nil
+			}
+			spent = append(spent, entry)
+		}
+	}
+	return spent
+}
+
+// fetchUnspentForUndo returns the unspent transaction output set entry for
+// the passed outpoint taking pending changes into account.  A nil entry is
+// returned when the output is not in the set.
+// Must be called with db write lock held.
+func (db *LevelDb) fetchUnspentForUndo(op *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	if u, ok := db.utxoUpdateMap[*op]; ok {
+		return u.entry, nil
+	}
+
+	buf, err := db.get(outPointToKey(op))
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseUtxo(buf)
+}
+
+// getUndo returns the spent outputs recorded in the undo record for the given
+// block hash keyed by their outpoint.  A nil map is returned when the block
+// has no undo record.
+// Must be called with db write lock held.
+func (db *LevelDb) getUndo(sha *btcwire.ShaHash) (map[btcwire.OutPoint]*btcdb.UtxoEntry, error) {
+	buf, err := db.get(shaUndoToKey(sha))
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	undo := make(map[btcwire.OutPoint]*btcdb.UtxoEntry)
+	r := bytes.NewBuffer(buf)
+	for r.Len() != 0 {
+		hdr := r.Next(undoEntryHeaderLen)
+		if len(hdr) != undoEntryHeaderLen {
+			return nil, btcdb.ErrCorruption
+		}
+		scriptLen := int(binary.LittleEndian.Uint32(hdr[53:]))
+		if scriptLen > r.Len() {
+			return nil, btcdb.ErrCorruption
+		}
+		pkScript := make([]byte, scriptLen)
+		copy(pkScript, r.Next(scriptLen))
+
+		var op btcwire.OutPoint
+		op.Hash.SetBytes(hdr[0:32])
+		op.Index = binary.LittleEndian.Uint32(hdr[32:])
+		undo[op] = &btcdb.UtxoEntry{
+			Height:   int64(binary.LittleEndian.Uint64(hdr[36:])),
+			Coinbase: hdr[44] != 0,
+			Value:    int64(binary.LittleEndian.Uint64(hdr[45:])),
+			PkScript: pkScript,
+		}
+	}
+	return undo, nil
+}
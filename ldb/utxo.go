@@ -0,0 +1,375 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"math"
+)
+
+// utxoStateKey is the key used to store the number of entries in the unspent
+// transaction output set.  Its presence indicates the set is maintained.
+var utxoStateKey = settingKey("utxosetsize")
+
+// utxoRebuildBatch is the number of blocks processed per batch while
+// rebuilding the unspent transaction output set.
+const utxoRebuildBatch = 500
+
+// utxoUpdate holds a pending change to an unspent transaction output.
+type utxoUpdate struct {
+	entry  *btcdb.UtxoEntry
+	delete bool
+}
+
+// isCoinbaseTx returns whether or not the passed transaction is a coinbase.
+func isCoinbaseTx(tx *btcwire.MsgTx) bool {
+	if len(tx.TxIn) != 1 {
+		return false
+	}
+	prevOut := &tx.TxIn[0].PreviousOutpoint
+	if prevOut.Index != math.MaxUint32 || prevOut.Hash != (btcwire.ShaHash{}) {
+		return false
+	}
+	return true
+}
+
+// outPointToKey returns the key for the unspent transaction output set entry
+// of the given outpoint.
+func outPointToKey(op *btcwire.OutPoint) []byte {
+	return outPointKey(utxoNs, op)
+}
+
+// formatUtxo generates the value buffer for an unspent transaction output set
+// entry.
+func formatUtxo(entry *btcdb.UtxoEntry) []byte {
+	buf := make([]byte, 17+len(entry.PkScript))
+	binary.LittleEndian.PutUint64(buf[0:], uint64(entry.Height))
+	if entry.Coinbase {
+		buf[8] = 1
+	}
+	binary.LittleEndian.PutUint64(buf[9:], uint64(entry.Value))
+	copy(buf[17:], entry.PkScript)
+	return buf
+}
+
+// parseUtxo decodes an unspent transaction output set entry.
+func parseUtxo(buf []byte) (*btcdb.UtxoEntry, error) {
+	if len(buf) < 17 {
+		return nil, btcdb.ErrCorruption
+	}
+	pkScript := make([]byte, len(buf)-17)
+	copy(pkScript, buf[17:])
+	entry := btcdb.UtxoEntry{
+		Height:   int64(binary.LittleEndian.Uint64(buf[0:])),
+		Coinbase: buf[8] != 0,
+		Value:    int64(binary.LittleEndian.Uint64(buf[9:])),
+		PkScript: pkScript,
+	}
+	return &entry, nil
+}
+
+// addTxUtxos adds every output of the passed transaction to the unspent
+// transaction output set.
+// Must be called with db write lock held.
+func (db *LevelDb) addTxUtxos(tx *btcwire.MsgTx, txsha *btcwire.ShaHash, height int64) {
+	coinbase := isCoinbaseTx(tx)
+	for idx, txOut := range tx.TxOut {
+		op := btcwire.NewOutPoint(txsha, uint32(idx))
+		db.utxoUpdateMap[*op] = &utxoUpdate{
+			entry: &btcdb.UtxoEntry{
+				Height:   height,
+				Coinbase: coinbase,
+				Value:    txOut.Value,
+				PkScript: txOut.PkScript,
+			},
+		}
+		db.utxoDelta++
+	}
+}
+
+// spendUtxo removes the output referenced by the passed outpoint from the
+// unspent transaction output set.
+// Must be called with db write lock held.
+func (db *LevelDb) spendUtxo(op *btcwire.OutPoint) {
+	if u, ok := db.utxoUpdateMap[*op]; ok && u.delete {
+		return
+	}
+	db.utxoUpdateMap[*op] = &utxoUpdate{delete: true}
+	db.utxoDelta--
+}
+
+// restoreUtxo adds the output referenced by the passed outpoint back to the
+// unspent transaction output set.  The output is recovered from the
+// transaction that created it, whose location must already be loaded into the
+// pending transaction updates by clearSpentData.  This requires loading the
+// block containing the transaction, so it is only used for blocks which have
+// no undo data.
+// Must be called with db write lock held.
+func (db *LevelDb) restoreUtxo(op *btcwire.OutPoint) error {
+	txU, ok := db.txUpdateMap[op.Hash]
+	if !ok {
+		return fmt.Errorf("unable to restore output %v:%d - origin "+
+			"transaction not loaded", &op.Hash, op.Index)
+	}
+	tx, _, _, _, err := db.fetchTxDataByLoc(txU.blkHeight, txU.txoff,
+		txU.txlen, nil)
+	if err != nil {
+		return err
+	}
+	if int(op.Index) >= len(tx.TxOut) {
+		return fmt.Errorf("unable to restore output %v:%d - index out "+
+			"of range", &op.Hash, op.Index)
+	}
+
+	txOut := tx.TxOut[op.Index]
+	db.restoreUtxoEntry(op, &btcdb.UtxoEntry{
+		Height:   txU.blkHeight,
+		Coinbase: isCoinbaseTx(tx),
+		Value:    txOut.Value,
+		PkScript: txOut.PkScript,
+	})
+	return nil
+}
+
+// restoreUtxoEntry adds the passed entry for the output referenced by the
+// passed outpoint back to the unspent transaction output set.
+// Must be called with db write lock held.
+func (db *LevelDb) restoreUtxoEntry(op *btcwire.OutPoint, entry *btcdb.UtxoEntry) {
+	if u, ok := db.utxoUpdateMap[*op]; !ok || u.delete {
+		db.utxoDelta++
+	}
+	db.utxoUpdateMap[*op] = &utxoUpdate{entry: entry}
+}
+
+// removeTxUtxos removes every output of the passed transaction from the
+// unspent transaction output set.  It is used when the block containing the
+// transaction is removed from the database.
+// Must be called with db write lock held.
+func (db *LevelDb) removeTxUtxos(tx *btcwire.MsgTx, txsha *btcwire.ShaHash) error {
+	for idx := range tx.TxOut {
+		op := btcwire.NewOutPoint(txsha, uint32(idx))
+		live, err := db.utxoExists(op)
+		if err != nil {
+			return err
+		}
+		if live {
+			db.utxoDelta--
+		}
+		db.utxoUpdateMap[*op] = &utxoUpdate{delete: true}
+	}
+	return nil
+}
+
+// utxoExists returns whether or not the output referenced by the passed
+// outpoint is in the unspent transaction output set, taking pending changes
+// into account.
+// Must be called with db write lock held.
+func (db *LevelDb) utxoExists(op *btcwire.OutPoint) (bool, error) {
+	if u, ok := db.utxoUpdateMap[*op]; ok {
+		return !u.delete, nil
+	}
+	_, err := db.get(outPointToKey(op))
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// processUtxoUpdates adds the pending unspent transaction output set changes
+// to the batch and returns the resulting set size.
+// Must be called with db write lock held.
+func (db *LevelDb) processUtxoUpdates() int64 {
+	for op, u := range db.utxoUpdateMap {
+		key := outPointToKey(&op)
+		if u.delete {
+			db.lBatch().Delete(key)
+		} else {
+			db.lBatch().Put(key, formatUtxo(u.entry))
+		}
+	}
+
+	newSize := db.utxoSetSize + db.utxoDelta
+	var sizeBuf [8]byte
+	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(newSize))
+	db.lBatch().Put(utxoStateKey, sizeBuf[:])
+	return newSize
+}
+
+// resetUtxoUpdates discards any pending unspent transaction output set
+// changes.
+func (db *LevelDb) resetUtxoUpdates() {
+	db.utxoUpdateMap = make(map[btcwire.OutPoint]*utxoUpdate)
+	db.utxoDelta = 0
+}
+
+// loadUtxoState reads the unspent transaction output set state from the
+// database.
+func (db *LevelDb) loadUtxoState() error {
+	buf, err := db.get(utxoStateKey)
+	if err == leveldb.ErrNotFound {
+		db.utxoTracked = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 8 {
+		return btcdb.ErrCorruption
+	}
+	db.utxoTracked = true
+	db.utxoSetSize = int64(binary.LittleEndian.Uint64(buf))
+	return nil
+}
+
+// errUtxoUntracked is returned when the unspent transaction output set is
+// requested from a database which does not maintain it.
+var errUtxoUntracked = fmt.Errorf("the unspent transaction output set is " +
+	"not available -- it must be built with RebuildUtxoSet")
+
+// FetchUtxoEntry returns the unspent transaction output referenced by the
+// given outpoint.  A nil entry and no error is returned when the output does
+// not exist or has already been spent.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) FetchUtxoEntry(op *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	if db.headersOnly {
+		return nil, btcdb.ErrHeadersOnly
+	}
+	if !db.utxoTracked {
+		return nil, errUtxoUntracked
+	}
+
+	buf, err := db.get(outPointToKey(op))
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseUtxo(buf)
+}
+
+// UtxoSetSize returns the total number of unspent transaction outputs in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (db *LevelDb) UtxoSetSize() (int64, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return 0, btcdb.ErrDbClosed
+	}
+
+	if db.headersOnly {
+		return 0, btcdb.ErrHeadersOnly
+	}
+	if !db.utxoTracked {
+		return 0, errUtxoUntracked
+	}
+	return db.utxoSetSize, nil
+}
+
+// RebuildUtxoSet generates the unspent transaction output set from the blocks
+// and spend information stored in the database.  Databases created before the
+// set was maintained must be rebuilt before it can be queried.
+func (db *LevelDb) RebuildUtxoSet() error {
+	db.dbLock.Lock()
+	defer db.dbLock.Unlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	db.flush()
+	if db.headersOnly {
+		return btcdb.ErrHeadersOnly
+	}
+	if db.pruneHeight > 0 {
+		return btcdb.ErrPruned
+	}
+
+	// Clear the state so a failed rebuild is detected on the next open.
+	err := db.lDb.Delete(utxoStateKey, db.wo)
+	if err != nil {
+		return err
+	}
+	db.utxoTracked = false
+	db.utxoSetSize = 0
+	db.resetUtxoUpdates()
+	defer db.lBatch().Reset()
+
+	for height := int64(0); height < db.nextBlock; height++ {
+		_, buf, err := db.getBlkByHeight(height)
+		if err != nil {
+			return err
+		}
+		blk, err := btcutil.NewBlockFromBytes(buf)
+		if err != nil {
+			return err
+		}
+
+		for _, tx := range blk.Transactions() {
+			// Only the most recent instance of a transaction which
+			// is not fully spent contributes outputs.
+			blkHeight, _, _, _, spentBuf, err := db.getTxData(tx.Sha())
+			if err == leveldb.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if blkHeight != height {
+				continue
+			}
+
+			msgTx := tx.MsgTx()
+			db.addTxUtxos(msgTx, tx.Sha(), height)
+			for idx := range msgTx.TxOut {
+				if spentBuf[idx/8]&(byte(1)<<uint(idx%8)) != 0 {
+					op := btcwire.NewOutPoint(tx.Sha(), uint32(idx))
+					db.spendUtxo(op)
+				}
+			}
+		}
+
+		if (height+1)%utxoRebuildBatch == 0 || height == db.nextBlock-1 {
+			// Write the set entries without the state key until the
+			// rebuild is complete.
+			newSize := db.processUtxoUpdates()
+			if height != db.nextBlock-1 {
+				db.lBatch().Delete(utxoStateKey)
+			}
+			if err := db.writeBatch(db.lBatch(), db.wo); err != nil {
+				db.resetUtxoUpdates()
+				return err
+			}
+			db.lBatch().Reset()
+			db.utxoSetSize = newSize
+			db.resetUtxoUpdates()
+			log.Infof("Unspent output set processed through height %d",
+				height)
+		}
+	}
+
+	if db.nextBlock == 0 {
+		if err := db.put(utxoStateKey, make([]byte, 8)); err != nil {
+			return err
+		}
+	}
+	db.utxoTracked = true
+	return nil
+}
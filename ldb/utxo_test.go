@@ -0,0 +1,92 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcwire"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestUtxoDropRebuild ensures the unspent output set is unwound when blocks
+// are dropped and that rebuilding it yields the same set.
+func TestUtxoDropRebuild(t *testing.T) {
+	dbname := "tstdbutxo"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+	defer db.Close()
+
+	// Block 183 spends an output of block 182 which must be restored when
+	// dropping back to block 182.
+	blocks := loadblocks(t)
+	spentOp := &blocks[183].MsgBlock().Transactions[1].TxIn[0].PreviousOutpoint
+	var spentEntry *btcdb.UtxoEntry
+	sizes := make([]int64, len(blocks))
+	for height, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Errorf("failed to insert block %v: %v", height, err)
+			return
+		}
+		sizes[height], err = db.UtxoSetSize()
+		if err != nil {
+			t.Errorf("UtxoSetSize: %v", err)
+			return
+		}
+		if height == 182 {
+			spentEntry, err = db.FetchUtxoEntry(spentOp)
+			if err != nil || spentEntry == nil {
+				t.Errorf("FetchUtxoEntry: %v", err)
+				return
+			}
+		}
+	}
+
+	if entry, _ := db.FetchUtxoEntry(spentOp); entry != nil {
+		t.Errorf("FetchUtxoEntry: spent output %v returned", spentOp)
+	}
+	keepSha, _ := blocks[182].Sha()
+	if err := db.DropAfterBlockBySha(keepSha); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+		return
+	}
+	if size, _ := db.UtxoSetSize(); size != sizes[182] {
+		t.Errorf("UtxoSetSize after drop: got %d, want %d", size,
+			sizes[182])
+	}
+	entry, err := db.FetchUtxoEntry(spentOp)
+	if err != nil || !reflect.DeepEqual(entry, spentEntry) {
+		t.Errorf("FetchUtxoEntry: output %v not restored - got %v, "+
+			"want %v (err %v)", spentOp, entry, spentEntry, err)
+	}
+	dropped := btcwire.NewOutPoint(blocks[183].Transactions()[0].Sha(), 0)
+	if entry, _ := db.FetchUtxoEntry(dropped); entry != nil {
+		t.Errorf("FetchUtxoEntry: output %v of dropped block returned",
+			dropped)
+	}
+
+	if err := db.(*ldb.LevelDb).RebuildUtxoSet(); err != nil {
+		t.Errorf("RebuildUtxoSet: %v", err)
+		return
+	}
+	if size, _ := db.UtxoSetSize(); size != sizes[182] {
+		t.Errorf("UtxoSetSize after rebuild: got %d, want %d", size,
+			sizes[182])
+	}
+	if entry, _ := db.FetchUtxoEntry(spentOp); entry == nil {
+		t.Errorf("FetchUtxoEntry: output %v missing after rebuild",
+			spentOp)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/goleveldb/leveldb"
+	"math/big"
+)
+
+// chainWorkKey is the key used to record that the cumulative chain work is
+// stored for every block.  Databases created before it was stored do not have
+// it and are migrated when they are opened.
+var chainWorkKey = settingKey("chainwork")
+
+// heightWorkToKey returns the key for the cumulative chain work of the block
+// at the given height.
+func heightWorkToKey(height int64) []byte {
+	return heightKey(workNs, height)
+}
+
+// putChainWork adds the cumulative chain work through the block at the given
+// height, which has the passed compact target difficulty, to the current
+// batch.  The parent is usually the chain tip from before the block was
+// inserted, which may only exist in the pending batch, so its height and work
+// are passed in.
+// Must be called with db write lock held.
+func (db *LevelDb) putChainWork(height int64, bits uint32, tipIdx int64, tipWork *big.Int) error {
+	work := btcdb.CalcWork(bits)
+	if height != 0 {
+		prevWork := tipWork
+		if height-1 != tipIdx || prevWork == nil {
+			var err error
+			prevWork, err = db.fetchWorkByHeight(height - 1)
+			if err != nil {
+				return err
+			}
+		}
+		work.Add(work, prevWork)
+	}
+	db.lBatch().Put(heightWorkToKey(height), work.Bytes())
+	db.lastBlkWork = work
+	return nil
+}
+
+// fetchWorkByHeight returns the cumulative chain work through the block at the
+// given height.  Databases which do not store it yet have it computed from the
+// headers of every block up to the given one.
+// Must be called with db read lock held.
+func (db *LevelDb) fetchWorkByHeight(height int64) (*big.Int, error) {
+	if !db.chainWork {
+		work := new(big.Int)
+		for h := int64(0); h <= height; h++ {
+			bh, err := db.fetchHeaderByHeight(h)
+			if err != nil {
+				return nil, err
+			}
+			work.Add(work, btcdb.CalcWork(bh.Bits))
+		}
+		return work, nil
+	}
+
+	buf, err := db.get(heightWorkToKey(height))
+	if err == leveldb.ErrNotFound {
+		return nil, btcdb.ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// FetchChainWorkBySha returns the cumulative work of the main chain through the
+// block with the given hash.  This is part of the btcdb.Db interface
+// implementation.
+func (db *LevelDb) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	db.readLock()
+	defer db.dbLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	height, err := db.getBlkLoc(sha)
+	if err != nil {
+		return nil, err
+	}
+	return db.fetchWorkByHeight(height)
+}
+
+// loadChainWorkSetting reads whether the cumulative chain work is stored from
+// the database.
+func (db *LevelDb) loadChainWorkSetting() error {
+	_, err := db.get(chainWorkKey)
+	switch err {
+	case nil:
+		db.chainWork = true
+	case leveldb.ErrNotFound:
+		db.chainWork = false
+	default:
+		return err
+	}
+	return nil
+}
+
+// migrateChainWork stores the cumulative chain work of all blocks in a database
+// created before it was stored.  Databases opened read-only are left as they
+// are and compute the work from the block headers when it is requested.
+// Must be called with db write lock held.
+func (db *LevelDb) migrateChainWork() error {
+	if db.chainWork || db.readOnly {
+		return nil
+	}
+
+	defer db.lBatch().Reset()
+
+	if db.nextBlock > 0 {
+		log.Infof("Computing chain work of %d blocks", db.nextBlock)
+	}
+	work := new(big.Int)
+	for height := int64(0); height < db.nextBlock; height++ {
+		bh, err := db.fetchHeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+		work.Add(work, btcdb.CalcWork(bh.Bits))
+		db.lBatch().Put(heightWorkToKey(height), work.Bytes())
+
+		if (height+1)%headerMigrateBatch == 0 {
+			err := db.writeBatch(db.lBatch(), db.wo)
+			if err != nil {
+				return err
+			}
+			db.lBatch().Reset()
+			log.Infof("Chain work computed through height %d",
+				height)
+		}
+	}
+
+	// The setting is only recorded once the work of every block is in
+	// place, so an interrupted migration starts over on the next open.
+	db.lBatch().Put(chainWorkKey, []byte{1})
+	if err := db.writeBatch(db.lBatch(), db.wo); err != nil {
+		return err
+	}
+	db.chainWork = true
+	return nil
+}
+
+// loadTipWork reads the cumulative chain work through the current tip.
+// Must be called with db write lock held.
+func (db *LevelDb) loadTipWork() error {
+	if db.lastBlkIdx < 0 || !db.chainWork {
+		db.lastBlkWork = nil
+		return nil
+	}
+	work, err := db.fetchWorkByHeight(db.lastBlkIdx)
+	if err != nil {
+		return err
+	}
+	db.lastBlkWork = work
+	return nil
+}
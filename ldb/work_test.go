@@ -0,0 +1,77 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"os"
+	"testing"
+)
+
+func TestChainWorkMigration(t *testing.T) {
+	dbname := "tstdbworkmig"
+	dbnamever := dbname + ".ver"
+	_ = os.RemoveAll(dbname)
+	_ = os.RemoveAll(dbnamever)
+	db, err := btcdb.CreateDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer os.RemoveAll(dbname)
+	defer os.RemoveAll(dbnamever)
+
+	blocks := loadblocks(t)[:100]
+	if _, err := db.InsertBlocks(blocks); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		db.Close()
+		return
+	}
+	if !ldb.ChainWorkStored(db) {
+		t.Errorf("chain work not stored in a new database")
+	}
+	checkChainWork(t, db, blocks)
+
+	// Strip the work to get a database in the old format.
+	if err := ldb.RemoveChainWork(db); err != nil {
+		t.Errorf("RemoveChainWork: %v", err)
+		db.Close()
+		return
+	}
+	db.Close()
+
+	// A read-only open must leave the database alone and compute the
+	// work from the headers.
+	db, err = btcdb.OpenDB("leveldb", btcdb.Options{Path: dbname,
+		ReadOnly: true})
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	if ldb.ChainWorkStored(db) {
+		t.Errorf("chain work migrated by a read-only open")
+	}
+	checkChainWork(t, db, blocks)
+	db.Close()
+
+	// A normal open migrates the database and later blocks build on the
+	// migrated work.
+	db, err = btcdb.OpenDB("leveldb", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+	if !ldb.ChainWorkStored(db) {
+		t.Errorf("chain work not migrated on open")
+	}
+	blocks = loadblocks(t)
+	if _, err := db.InsertBlocks(blocks[100:]); err != nil {
+		t.Errorf("InsertBlocks: %v", err)
+		return
+	}
+	checkChainWork(t, db, blocks)
+}
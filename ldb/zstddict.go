@@ -0,0 +1,232 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ldb
+
+// Auto-generated file (see genzstddict.go)
+// DO NOT EDIT
+
+import (
+	"encoding/hex"
+)
+
+// zstdBlockDict is the dictionary of the built-in zstd codec, trained by
+// TrainZstdDictionary on the blocks of the test chain.  Blocks stored with
+// ZstdCodecID are read with it, so it must never change.
+var zstdBlockDict = func() []byte {
+	dict, err := hex.DecodeString("" +
+		"37a430ecc573b7271910209d003d832c715e16c603afa62b110eb30b8bb35895" +
+		"ef0302004002200fd080c39c0f12c0d31800b70d30010084105a42c203a21400" +
+		"02c0847fc0f33510000000fe14000029000000ffffffff0200e1f5ffffffff01" +
+		"00e1f5ffffff0200e1f505ffffff0100e1f505ffff0200e1f50500ffff0100e1" +
+		"f50500ffff001d02d600ffffff001d02d400ffffff001d02c700ffffff001d02" +
+		"c400ffffff001d02bd00ffffff001d02b100ffffff001d02ae00ffffff001d02" +
+		"a700ffffff001d02a100ffffff001d029400ffffff001d028c00ffffff001d02" +
+		"8a00ffffff001d028700ffffff001d028300ffffff001d017affffffff001d01" +
+		"5cffffffff001d0154ffffffff001d014effffffff001d0144ffffffff001d01" +
+		"3fffffffff001d013effffffff001d013cffffffff001d013bffffffff001d01" +
+		"3affffffff001d0138ffffffff001d0137ffffffff001d0136ffffffff001d01" +
+		"2cffffffff001d012affffffff001d011fffffffff001d0111ffffffff001d01" +
+		"10ffffffff001d010fffffff0200e1f5050000ff0100e1f5050000ff001d02d6" +
+		"00ffffff001d02d400ffffff001d02c700ffffff001d02c400ffffff001d02bd" +
+		"00ffffff001d02b100ffffff001d02ae00ffffff001d02a700ffffff001d02a1" +
+		"00ffffff001d029400ffffff001d028c00ffffff001d028a00ffffff001d0287" +
+		"00ffffff001d028300ffffff001d017affffffff001d015cffffffff001d0154" +
+		"ffffffff001d014effffffff001d0144ffffffff001d013fffffffff001d013e" +
+		"ffffffff001d013cffffffff001d013bffffffff001d013affffffff001d0138" +
+		"ffffffff001d0137ffffffff001d0136ffffffff001d012cffffffff001d012a" +
+		"ffffffff001d011fffffffff001d0111ffffffff001d0110ffffffff001d010f" +
+		"fffffffa209c6a852dd906f7837607ab8be7c3f55b862a73b24719f401010000" +
+		"000100f301010000000100f201010000000100f15093f7837607abee01010000" +
+		"000100edce25857fcd3704ea01010000000100e901010000000100e7c3705e29" +
+		"a9d4a1e56e104102fa209ce55a9e2fab4e41f5dd01010000000100db01010000" +
+		"000100da01f15093f78376d90660a20b2d9c35d801010000000100d600ffffff" +
+		"ff0100d5e55a9e2fab4e41d501010000000100d4a12c9116d709f8d400ffffff" +
+		"ff0100d13a527d169c1fadcf01010000000100c997a5e56e104102c700ffffff" +
+		"ff0100c400ffffffff0100c3705e29a9d4a12cc201010000000100c1d5e55a9e" +
+		"2fab4ec101010000000100bd00ffffffff0100ba91c1d5e55a9e2fb701010000" +
+		"000100b24719aad13a527db201010000000100b100ffffffff0100b001010000" +
+		"000100ae00ffffffff0100ab8be7c3705e29a9ab4e41f55b862a73aad13a527d" +
+		"169c1fa9d4a12c9116d709a700ffffffff0100a5e56e104102fa20a20b2d9c35" +
+		"2423eda12c9116d709f891a100ffffffff01009e2fab4e41f55b869d01010000" +
+		"0001009c6a852dd90660a29c352423edce2585980101000000010097a5e56e10" +
+		"4102fa970101000000010095010100000001009400ffffffff010093f7837607" +
+		"ab8be791c1d5e55a9e2fab9116d709f8911e598c00ffffffff01008be7c3705e" +
+		"29a9d48a00ffffffff01008700ffffffff0100862a73b24719aad1852dd90660" +
+		"a20b2d837607ab8be7c3708300ffffffff0100805864da01f150937e01010000" +
+		"0001007d169c1fad3b63b57d010100000001007c010100000001007affffffff" +
+		"0100f27a010100000001007607ab8be7c3705e73ffffffff0100f273b24719aa" +
+		"d13a5273805864da01f1507201010000000100705e29a9d4a12c916e104102fa" +
+		"209c6a6d010100000001006b010100000001006a852dd90660a20b6949ffff00" +
+		"1d1622650101000000010064da01f15093f783610101000000010060a20b2d9c" +
+		"35242360010100000001005e29a9d4a12c91165cffffffff0100f25b862a73b2" +
+		"4719aa5a9e2fab4e41f55b5864da01f15093f754ffffffff0100f25301010000" +
+		"000100527d169c1fad3b635093f7837607ab8b4effffffff0100f24e41f55b86" +
+		"2a73b24719aad13a527d1644ffffffff0100f241f55b862a73b2474102fa209c" +
+		"6a852d3fffffffff0100f23effffffff0100f23cffffffff0100f23bffffffff" +
+		"0100f23affffffff0100f23a527d169c1fad3b38ffffffff0100f237ffffffff" +
+		"0100f236ffffffff0100f2352423edce25857f30010100000001002fab4e41f5" +
+		"5b862a2dd90660a20b2d9c2d9c352423edce252cffffffff0100f22c9116d709" +
+		"f8911e2affffffff0100f22a73b24719aad13a29a9d4a12c9116d72601010000" +
+		"0001002423edce25857fcd240101000000010023edce25857fcd372201010000" +
+		"000100209c6a852dd906601fffffffff0100f21d02d600ffffffff1d02d400ff" +
+		"ffffff1d02c700ffffffff1d02c400ffffffff1d02bd00ffffffff1d02b100ff" +
+		"ffffff1d02ae00ffffffff1d02a700ffffffff1d02a100ffffffff1d029400ff" +
+		"ffffff1d028c00ffffffff1d028a00ffffffff1d028700ffffffff1d028300ff" +
+		"ffffff1d017affffffff011d015cffffffff011d0154ffffffff011d014effff" +
+		"ffff011d0144ffffffff011d013fffffffff011d013effffffff011d013cffff" +
+		"ffff011d013bffffffff011d013affffffff011d0138ffffffff011d0137ffff" +
+		"ffff011d0136ffffffff011d012cffffffff011d012affffffff011d011fffff" +
+		"ffff011d0111ffffffff011d0110ffffffff011d010fffffffff011d01010000" +
+		"00010019aad13a527d169c1901010000000100169c1fad3b63b51211ffffffff" +
+		"0100f210ffffffff0100f2104102fa209c6a850fffffffff0100f20e01010000" +
+		"0001000c010100000001000b2d9c352423edce0804ffff001d02d60804ffff00" +
+		"1d02d40804ffff001d02c70804ffff001d02c40804ffff001d02bd0804ffff00" +
+		"1d02b10804ffff001d02ae0804ffff001d02a70804ffff001d02a10804ffff00" +
+		"1d02940804ffff001d028c0804ffff001d028a0804ffff001d02870804ffff00" +
+		"1d0283080101000000010007ab8be7c3705e290704ffff001d017a0704ffff00" +
+		"1d015c0704ffff001d01540704ffff001d014e0704ffff001d01440704ffff00" +
+		"1d013f0704ffff001d013e0704ffff001d013c0704ffff001d013b0704ffff00" +
+		"1d013a0704ffff001d01380704ffff001d01370704ffff001d01360704ffff00" +
+		"1d012c0704ffff001d012a0704ffff001d011f0704ffff001d01110704ffff00" +
+		"1d01100704ffff001d010f0660a20b2d9c352404ffff001d02d60004ffff001d" +
+		"02d40004ffff001d02c70004ffff001d02c40004ffff001d02bd0004ffff001d" +
+		"02b10004ffff001d02ae0004ffff001d02a70004ffff001d02a10004ffff001d" +
+		"02940004ffff001d028c0004ffff001d028a0004ffff001d02870004ffff001d" +
+		"02830004ffff001d017aff04ffff001d015cff04ffff001d0154ff04ffff001d" +
+		"014eff04ffff001d0144ff04ffff001d013fff04ffff001d013eff04ffff001d" +
+		"013cff04ffff001d013bff04ffff001d013aff04ffff001d0138ff04ffff001d" +
+		"0137ff04ffff001d0136ff04ffff001d012cff04ffff001d012aff04ffff001d" +
+		"011fff04ffff001d0111ff04ffff001d0110ff04ffff001d010fff0401010000" +
+		"00010002fa209c6a852dd902d600ffffffff0102d400ffffffff0102c700ffff" +
+		"ffff0102c400ffffffff0102bd00ffffffff0102b100ffffffff0102ae00ffff" +
+		"ffff0102a700ffffffff0102a100ffffffff01029400ffffffff01028c00ffff" +
+		"ffff01028a00ffffffff01028700ffffffff01028300ffffffff010200e1f505" +
+		"00000001ffffffff0200e101ffffffff0100e101f15093f783760701ba91c1d5" +
+		"e55a9e017affffffff01000173805864da01f1015cffffffff01000154ffffff" +
+		"ff0100014effffffff01000144ffffffff0100013fffffffff0100013effffff" +
+		"ff0100013cffffffff0100013bffffffff0100013affffffff01000138ffffff" +
+		"ff01000137ffffffff01000136ffffffff0100012cffffffff0100012affffff" +
+		"ff0100011fffffffff01000111ffffffff01000110ffffffff0100010fffffff" +
+		"ff01000100e1f505000000010000004948304501000000484730440100000043" +
+		"4104f001000000434104e701000000434104e101000000434104e00100000043" +
+		"4104dc01000000434104db01000000434104d501000000434104d30100000043" +
+		"4104cf01000000434104ce01000000434104cd01000000434104cc0100000043" +
+		"4104cb01000000434104c901000000434104c801000000434104c50100000043" +
+		"4104bc01000000434104b901000000434104b201000000434104b00100000043" +
+		"4104a801000000434104a501000000434104a1010000004341049f0100000043" +
+		"41049c010000004341049a010000004341049401000000434104930100000043" +
+		"41048d010000004341047f010000004341047401000000434104730100000043" +
+		"41046d010000004341046a010000004341046801000000434104660100000043" +
+		"4104630100000043410461010000004341045501000000434104510100000043" +
+		"41044c010000004341043c010000004341043601000000434104350100000043" +
+		"4104320100000043410430010000004341042d010000004341042b0100000043" +
+		"4104270100000043410421010000004341041f010000004341041a0100000043" +
+		"410419010000004341040b01000000434104000100000001ba91c10100000001" +
+		"738058001d02d600ffffff001d02d400ffffff001d02c700ffffff001d02c400" +
+		"ffffff001d02bd00ffffff001d02b100ffffff001d02ae00ffffff001d02a700" +
+		"ffffff001d02a100ffffff001d029400ffffff001d028c00ffffff001d028a00" +
+		"ffffff001d028700ffffff001d028300ffffff001d017affffffff001d015cff" +
+		"ffffff001d0154ffffffff001d014effffffff001d0144ffffffff001d013fff" +
+		"ffffff001d013effffffff001d013cffffffff001d013bffffffff001d013aff" +
+		"ffffff001d0138ffffffff001d0137ffffffff001d0136ffffffff001d012cff" +
+		"ffffff001d012affffffff001d011fffffffff001d0111ffffffff001d0110ff" +
+		"ffffff001d010fffffffff0001ba91c1d5e55a000173805864da010001010000" +
+		"000100000100000001ba910001000000017380000001ba91c1d5e50000017380" +
+		"5864da00000100000001ba0000010000000173000000494830450200000001ba" +
+		"91c1d500000001738058640000000048473044ffffffff0200ca9affffff0200" +
+		"ca9a3bffff0200ca9a3b00ffff001d014dffffffff001d0129ffffffff001d01" +
+		"24ffffffff001d0123ffffffff001d010cffffffff001d010affffffff001d01" +
+		"07ffffffff001d0106ffffffff001d0105ffffffff001d0102ffffff0200ca9a" +
+		"3b0000ff001d014dffffffff001d0129ffffffff001d0124ffffffff001d0123" +
+		"ffffffff001d010cffffffff001d010affffffff001d0107ffffffff001d0106" +
+		"ffffffff001d0105ffffffff001d0102fffffff801010000000100ef01010000" +
+		"000100e201010000000100ca9a3b0000000043b301010000000100b101010000" +
+		"000100a5010100000001009a3b00000000434199010100000001008c01010000" +
+		"00010086010100000001007b0101000000010066010100000001006201010000" +
+		"0001005d0101000000010055010100000001004dffffffff0100f23b00000000" +
+		"4341042f010100000001002a0101000000010029ffffffff0100f224ffffffff" +
+		"0100f223ffffffff0100f21f010100000001001d014dffffffff011d0129ffff" +
+		"ffff011d0124ffffffff011d0123ffffffff011d010cffffffff011d010affff" +
+		"ffff011d0107ffffffff011d0106ffffffff011d0105ffffffff011d0102ffff" +
+		"ffff01130101000000010010010100000001000cffffffff0100f20affffffff" +
+		"0100f207ffffffff0100f20704ffff001d014d0704ffff001d01290704ffff00" +
+		"1d01240704ffff001d01230704ffff001d010c0704ffff001d010a0704ffff00" +
+		"1d01070704ffff001d01060704ffff001d01050704ffff001d010206ffffffff" +
+		"0100f205ffffffff0100f204ffff001d014dff04ffff001d0129ff04ffff001d" +
+		"0124ff04ffff001d0123ff04ffff001d010cff04ffff001d010aff04ffff001d" +
+		"0107ff04ffff001d0106ff04ffff001d0105ff04ffff001d0102ff02ffffffff" +
+		"0100f20200ca9a3b00000001ffffffff0200ca014dffffffff01000129ffffff" +
+		"ff01000124ffffffff01000123ffffffff0100010cffffffff0100010affffff" +
+		"ff01000107ffffffff01000106ffffffff01000105ffffffff01000102ffffff" +
+		"ff0100010101000000010001000000434104d401000000434104ca0100000043" +
+		"4104c601000000434104c001000000434104be01000000434104bb0100000043" +
+		"41048b010000004341045c0100000043410456010000004341042f0100000043" +
+		"410408010000004341040600ca9a3b00000000001d014dffffffff001d0129ff" +
+		"ffffff001d0124ffffffff001d0123ffffffff001d010cffffffff001d010aff" +
+		"ffffff001d0107ffffffff001d0106ffffffff001d0105ffffffff001d0102ff" +
+		"ffffffffff001d0130ffffffff001d0120ffffffff001d011affffffff001d01" +
+		"16ffffffff001d0115ffffffff001d0112ffffffff001d010dffffffff001d01" +
+		"09ffffffff001d0104ffffffff001d0103ffffffff001d0101ffffff001d0130" +
+		"ffffffff001d0120ffffffff001d011affffffff001d0116ffffffff001d0115" +
+		"ffffffff001d0112ffffffff001d010dffffffff001d0109ffffffff001d0104" +
+		"ffffffff001d0103ffffffff001d0101fffffff505000000004341f501010000" +
+		"000100e1f5050000000043a001010000000100710101000000010030ffffffff" +
+		"0100f220ffffffff0100f21d0130ffffffff011d0120ffffffff011d011affff" +
+		"ffff011d0116ffffffff011d0115ffffffff011d0112ffffffff011d010dffff" +
+		"ffff011d0109ffffffff011d0104ffffffff011d0103ffffffff011d0101ffff" +
+		"ffff011affffffff0100f216ffffffff0100f215ffffffff0100f212ffffffff" +
+		"0100f20dffffffff0100f209ffffffff0100f20704ffff001d01300704ffff00" +
+		"1d01200704ffff001d011a0704ffff001d01160704ffff001d01150704ffff00" +
+		"1d01120704ffff001d010d0704ffff001d01090704ffff001d01040704ffff00" +
+		"1d01030704ffff001d0101050000000043410404ffffffff0100f204ffff001d" +
+		"0130ff04ffff001d0120ff04ffff001d011aff04ffff001d0116ff04ffff001d" +
+		"0115ff04ffff001d0112ff04ffff001d010dff04ffff001d0109ff04ffff001d" +
+		"0104ff04ffff001d0103ff04ffff001d0101ff03ffffffff0100f20130ffffff" +
+		"ff01000120ffffffff0100011affffffff01000116ffffffff01000115ffffff" +
+		"ff01000112ffffffff0100010dffffffff01000109ffffffff01000104ffffff" +
+		"ff01000103ffffffff01000101ffffffff010001000000434104a40100000043" +
+		"410495010000004341041800e1f50500000000001d0130ffffffff001d0120ff" +
+		"ffffff001d011affffffff001d0116ffffffff001d0115ffffffff001d0112ff" +
+		"ffffff001d010dffffffff001d0109ffffffff001d0104ffffffff001d0103ff" +
+		"ffffff001d0101ffffffff00004847304402200000004847304402ffff001d01" +
+		"21ffffffff001d010effffff001d0121ffffffff001d010effffffd601010000" +
+		"00010021ffffffff0100f21d0121ffffffff011d010effffffff010effffffff" +
+		"0100f20704ffff001d01210704ffff001d010e04ffff001d0121ff04ffff001d" +
+		"010eff0121ffffffff0100010effffffff010001000000434104f5001d0121ff" +
+		"ffffff001d010effffffff0000000043410411ffff001d010bffffff001d010b" +
+		"fffffffb84ccf9744464f8fa9b8b64f9d4c03ff9d4c03f999b8643f9744464f8" +
+		"2e160bf82e160bfa9b8b64f656b412a3ac0000eaddfb84ccf97444e1dcdb8a01" +
+		"6b4984e0eaddfb84ccf974ddfb84ccf9744464dcdb8a016b49840fdb93e1dcdb" +
+		"8a016bdb8a016b49840f8cd7b148a6909a5cb2d4c03f999b8643f6ccf9744464" +
+		"f82e16cad7b148a6909a5cc03f999b8643f656bc1eb68a382e97b1b68a382e97" +
+		"b1482eb412a3ac00000000b2e0eaddfb84ccf9b148a6909a5cb2e0b1482ecad7" +
+		"b148a6a6909a5cb2e0eadd9b8b64f9d4c03f999b8643f656b412a39a5cb2e0ea" +
+		"ddfb84999b8643f656b41297b1482ecad7b14893e1dcdb8a016b49909a5cb2e0" +
+		"eaddfb8c53bc1eb68a382e8b64f9d4c03f999b8a382e97b1482eca8a016b4984" +
+		"0f8c538643f656b412a3ac84ccf9744464f82e840f8c53bc1eb68a744464f82e" +
+		"160bfa6b49840f8c53bc1e64f9d4c03f999b8664f82e160bfa9b8b5cb2e0eadd" +
+		"fb84cc56b412a3ac00000053bc1eb68a382e9749840f8c53bc1eb648a6909a5c" +
+		"b2e0ea482ecad7b148a6904464f82e160bfa9b43f656b412a3ac0043410411db" +
+		"93e1dc410411db93e1dcdb3f999b8643f656b4382e97b1482ecad72ecad7b148" +
+		"a6909a2e97b1482ecad7b12e160bfa9b8b64f91eb68a382e97b1481d010bffff" +
+		"ffff01160bfa9b8b64f9d411db93e1dcdb8a010f8c53bc1eb68a380bffffffff" +
+		"0100f20bfa9b8b64f9d4c00704ffff001d010b04ffff001d010bff0411db93e1" +
+		"dcdb8a016b49840f8c53bc010bffffffff01000043410411db93e1001d010bff" +
+		"ffffff000043410411db9300000043410411dbac000000000100000201000000" +
+		"0100000000000100000001000000000100000001ffffffff0100f200ffffffff" +
+		"0100f2ffffffff0804ffffffffff0804ffff00ffff0804ffff001dff0804ffff" +
+		"001d0200ffffffff0804ff0000ffffffff0804000000ffffffff08ffffffff07" +
+		"04ffffffffff0704ffff00ffff0704ffff001dff0704ffff001d0100ffffffff" +
+		"0704ff0000ffffffff0704000000ffffffff070101000000010000ffffffff01" +
+		"00f205ffffff0100f2052affff0100f2052a01ff0100f2052a0100f2052a0100" +
+		"0000432a01000000434104052a0100000043410100f2052a0100000100000001" +
+		"00000000f2052a01000000000100000000000000000100000000000000000100" +
+		"00000000000000ffffffff0000000000ffffff000000000000ffff0000000000" +
+		"0000ff01000000000000000000000000000000")
+	if err != nil {
+		panic("invalid zstd dictionary in source")
+	}
+	return dict
+}()
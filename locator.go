@@ -0,0 +1,39 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+)
+
+// BlockLocator is a list of block hashes used by getblocks and getheaders
+// messages to find the point where two chains diverge.  It starts with the
+// most recent block and steps back through the chain, one block at a time for
+// the first entries and exponentially further after that, always ending with
+// the genesis block.
+type BlockLocator []*btcwire.ShaHash
+
+// locatorDenseEntries is the number of entries at the start of a block
+// locator which are one block apart.
+const locatorDenseEntries = 10
+
+// LocatorHeights returns the heights of the blocks which make up the block
+// locator of the block at the given height.  It is intended for use by drivers
+// so the hashes can be looked up from their height index in one pass.
+func LocatorHeights(height int64) []int64 {
+	if height < 0 {
+		return nil
+	}
+
+	heights := make([]int64, 0, locatorDenseEntries+32)
+	step := int64(1)
+	for h := height; h > 0; h -= step {
+		heights = append(heights, h)
+		if len(heights) >= locatorDenseEntries {
+			step *= 2
+		}
+	}
+	return append(heights, 0)
+}
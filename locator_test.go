@@ -0,0 +1,104 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// TestBlockLocator ensures block locators reference the expected blocks.
+func TestBlockLocator(t *testing.T) {
+	// The first entries step back one block at a time before the steps
+	// start doubling, and the genesis block always ends the locator.
+	wantHeights := []int64{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85,
+		77, 61, 29, 0}
+	if heights := btcdb.LocatorHeights(100); !reflect.DeepEqual(heights,
+		wantHeights) {
+
+		t.Errorf("LocatorHeights: got %v, want %v", heights, wantHeights)
+	}
+	if heights := btcdb.LocatorHeights(0); !reflect.DeepEqual(heights,
+		[]int64{0}) {
+
+		t.Errorf("LocatorHeights: got %v, want [0]", heights)
+	}
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "locator", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		locator, err := db.LatestBlockLocator()
+		if err != nil || len(locator) != 0 {
+			t.Errorf("LatestBlockLocator (%s): empty database got "+
+				"%v, %v", dbType, locator, err)
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		checkLocator := func(name string, locator btcdb.BlockLocator,
+			height int64) {
+
+			heights := btcdb.LocatorHeights(height)
+			if len(locator) != len(heights) {
+				t.Errorf("%s (%s): got %d hashes, want %d", name,
+					dbType, len(locator), len(heights))
+				return
+			}
+			for i, h := range heights {
+				wantSha, _ := blocks[h].Sha()
+				if !locator[i].IsEqual(wantSha) {
+					t.Errorf("%s (%s): entry %d got %v, want "+
+						"%v", name, dbType, i, locator[i],
+						wantSha)
+				}
+			}
+		}
+
+		locator, err = db.LatestBlockLocator()
+		if err != nil {
+			t.Errorf("LatestBlockLocator (%s): %v", dbType, err)
+		} else {
+			checkLocator("LatestBlockLocator", locator,
+				int64(len(blocks)-1))
+		}
+		for _, height := range []int{0, 5, len(blocks) / 2} {
+			sha, _ := blocks[height].Sha()
+			locator, err := db.BlockLocatorFromSha(sha)
+			if err != nil {
+				t.Errorf("BlockLocatorFromSha (%s): %v", dbType,
+					err)
+				continue
+			}
+			checkLocator("BlockLocatorFromSha", locator,
+				int64(height))
+		}
+
+		var missing btcwire.ShaHash
+		_, err = db.BlockLocatorFromSha(&missing)
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("BlockLocatorFromSha (%s): missing block got "+
+				"%v, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		teardown()
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// DbLock is an advisory lock on a database which keeps other processes from
+// opening it at the same time.  It is a lock of the operating system on a lock
+// file next to the database, which is released along with the open file when
+// the process holding it exits, however it exits, so a lock is never left
+// behind.  The lock file records the ID of the process holding it to help
+// finding out which process has a database open.
+type DbLock struct {
+	f *os.File
+}
+
+// LockDb takes the lock of the database at the passed path, which drivers of
+// databases stored in files do before opening them.  It returns ErrDbBusy when
+// the lock is held by another open database, in this process or another one.
+// Force opens the database without the lock instead, which recovery tools use
+// to read a database held by a process which no longer responds.  On systems
+// without file locks the lock is not enforced.
+func LockDb(path string, force bool) (*DbLock, error) {
+	name := path + ".lock"
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		held, err := lockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !held {
+			f.Close()
+			if !force {
+				return nil, ErrDbBusy
+			}
+			log.Warnf("Opening database %s without its lock, which "+
+				"is held by another process", path)
+			return &DbLock{}, nil
+		}
+
+		// The holder removes the lock file before releasing it, so a
+		// lock taken on a file which was removed meanwhile is not the
+		// lock of the database and is taken again.
+		same, err := sameFile(f, name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !same {
+			f.Close()
+			continue
+		}
+
+		// The ID of the process is only recorded for people looking
+		// into which process holds the lock, so failing to write it is
+		// harmless.
+		if err := f.Truncate(0); err == nil {
+			f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+		}
+		return &DbLock{f: f}, nil
+	}
+}
+
+// sameFile returns whether the passed open file is still the file with the
+// passed name.
+func sameFile(f *os.File, name string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	nameFi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, nameFi), nil
+}
+
+// Unlock releases the lock and removes the lock file.  It does nothing for a
+// nil lock, so drivers may call it whether or not they took one.  The file is
+// removed while the lock is still held, which LockDb detects, so it never
+// removes a file another process locked.  Systems which do not remove open
+// files have it removed once it is closed, unless another process opened it
+// meanwhile.
+func (l *DbLock) Unlock() {
+	if l == nil || l.f == nil {
+		return
+	}
+	name := l.f.Name()
+	removeErr := os.Remove(name)
+	if err := l.f.Close(); err != nil {
+		log.Warnf("Unable to close lock file %s: %v", name, err)
+	}
+	if removeErr != nil {
+		os.Remove(name)
+	}
+	l.f = nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestDbBusy ensures a database can't be opened while it is open already for
+// every supported database type stored in files, that a lock file left behind
+// by a process which exited does not keep it from being opened, even when it
+// records the ID of the process opening it, and that unlocking removes the lock
+// file.
+func TestDbBusy(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	ownPid := []byte(fmt.Sprintf("%d\n", os.Getpid()))
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		switch dbType {
+		case "memory", "postgres":
+			continue
+		}
+
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "busydb-"+dbType),
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := btcdb.OpenDBWithOptions(dbType, opts); err != btcdb.ErrDbBusy {
+			t.Errorf("OpenDBWithOptions while open (%s): unexpected "+
+				"error - got %v, want %v", dbType, err,
+				btcdb.ErrDbBusy)
+		}
+		db.Close()
+
+		err = ioutil.WriteFile(opts.Path+".lock", ownPid, 0600)
+		if err != nil {
+			t.Errorf("WriteFile (%s): %v", dbType, err)
+			continue
+		}
+		db, err = btcdb.OpenDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("OpenDBWithOptions with stale lock (%s): %v",
+				dbType, err)
+			continue
+		}
+		db.Close()
+	}
+
+	// A lock held by another process keeps the database busy until the
+	// process exits, however it exits, while forcing it opens the
+	// database regardless.
+	path := filepath.Join(testDbRoot, "holddb")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHolder$")
+	cmd.Env = append(os.Environ(), "BTCDB_TEST_LOCK_PATH="+path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Errorf("StdinPipe: %v", err)
+		return
+	}
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Errorf("StdoutPipe: %v", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		t.Errorf("Unable to start lock holder: %v", err)
+		return
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Errorf("Lock holder: got %q (err %v), want locked", line, err)
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	if _, err := btcdb.LockDb(path, false); err != btcdb.ErrDbBusy {
+		t.Errorf("LockDb held by another process: unexpected error - "+
+			"got %v, want %v", err, btcdb.ErrDbBusy)
+	}
+	forced, err := btcdb.LockDb(path, true)
+	if err != nil {
+		t.Errorf("LockDb forced: %v", err)
+	}
+	forced.Unlock()
+	cmd.Process.Kill()
+	cmd.Wait()
+	lock, err := btcdb.LockDb(path, false)
+	if err != nil {
+		t.Errorf("LockDb after the holder was killed: %v", err)
+		return
+	}
+	if _, err := btcdb.LockDb(path, false); err != btcdb.ErrDbBusy {
+		t.Errorf("LockDb while locked: unexpected error - got %v, "+
+			"want %v", err, btcdb.ErrDbBusy)
+	}
+	lock.Unlock()
+	lock, err = btcdb.LockDb(path, false)
+	if err != nil {
+		t.Errorf("LockDb after Unlock: %v", err)
+		return
+	}
+	lock.Unlock()
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Unlock: lock file is left behind (err %v)", err)
+	}
+}
+
+// TestLockHolder is run by TestDbBusy in a process of its own, where it holds
+// the lock of the database named by BTCDB_TEST_LOCK_PATH until the process is
+// killed.  It does nothing otherwise.
+func TestLockHolder(t *testing.T) {
+	path := os.Getenv("BTCDB_TEST_LOCK_PATH")
+	if path == "" {
+		return
+	}
+	if _, err := btcdb.LockDb(path, false); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+}
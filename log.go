@@ -8,29 +8,95 @@ import (
 	"errors"
 	"github.com/conformal/btclog"
 	"io"
+	"sync"
 )
 
-// log is a logger that is initialized with no output filters.  This
-// means the package will not perform any logging by default until the caller
-// requests it.
-var log btclog.Logger
-
-// The default amount of logging is none.
-func init() {
-	DisableLog()
+// Logger is the interface the package and its drivers log through.  It is a
+// subset of btclog.Logger, so a btclog logger is used as is, while other
+// logging packages such as zap are used by wrapping them in a type with these
+// functions.  The error results are ignored.
+type Logger interface {
+	Tracef(format string, params ...interface{})
+	Debugf(format string, params ...interface{})
+	Infof(format string, params ...interface{})
+	Warnf(format string, params ...interface{}) error
+	Errorf(format string, params ...interface{}) error
+	Criticalf(format string, params ...interface{}) error
 }
 
-// DisableLog disables all library log output.  Logging output is disabled
-// by default until either UseLogger or SetLogWriter are called.
+// The loggers set by the caller.  backendLog receives the output of the
+// package and every driver which has not been given a logger of its own in
+// driverLogs, while driverLevels holds the minimum level of the output of
+// each driver which is passed on.
+var (
+	logMtx       sync.RWMutex
+	backendLog   Logger = btclog.Disabled
+	driverLogs          = make(map[string]Logger)
+	driverLevels        = make(map[string]btclog.LogLevel)
+)
+
+// log is the logger of the package itself, which is named "btcdb" for
+// UseDriverLogger and SetDriverLogLevel.  No output is performed by default
+// until the caller requests it.
+var log = DriverLogger("btcdb")
+
+// DisableLog disables all library log output, including the output of drivers
+// given their own logger and level.  Logging output is disabled by default
+// until either UseLogger or SetLogWriter are called.
 func DisableLog() {
-	log = btclog.Disabled
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	backendLog = btclog.Disabled
+	driverLogs = make(map[string]Logger)
+	driverLevels = make(map[string]btclog.LogLevel)
 }
 
-// UseLogger uses a specified Logger to output package logging info.
-// This should be used in preference to SetLogWriter if the caller is also
-// using btclog.
-func UseLogger(logger btclog.Logger) {
-	log = logger
+// UseLogger uses a specified Logger to output package logging info.  The
+// output of every driver which has not been given its own logger with
+// UseDriverLogger goes to it as well, including drivers which are already
+// open.  This should be used in preference to SetLogWriter if the caller is
+// also using btclog.
+func UseLogger(logger Logger) {
+	if logger == nil {
+		logger = btclog.Disabled
+	}
+
+	logMtx.Lock()
+	backendLog = logger
+	logMtx.Unlock()
+}
+
+// UseDriverLogger uses a specified Logger to output the logging info of the
+// named driver in place of the logger given to UseLogger.  The name is that of
+// the driver package, such as "ldb" or "sqldb", or "btcdb" for the package
+// itself.  A nil logger sends the output of the driver back to the logger given
+// to UseLogger.
+func UseDriverLogger(driver string, logger Logger) {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	if logger == nil {
+		delete(driverLogs, driver)
+		return
+	}
+	driverLogs[driver] = logger
+}
+
+// SetDriverLogLevel sets the minimum level of the logging info of the named
+// driver which is output, such as "trace" to see the traces of a single driver
+// while the others only output warnings.  The output is still filtered by the
+// level of the logger it goes to.
+func SetDriverLogLevel(driver, level string) error {
+	lvl, ok := btclog.LogLevelFromString(level)
+	if !ok {
+		return errors.New("invalid log level")
+	}
+
+	logMtx.Lock()
+	driverLevels[driver] = lvl
+	logMtx.Unlock()
+	return nil
 }
 
 // SetLogWriter uses a specified io.Writer to output package logging info.
@@ -57,6 +123,87 @@ func SetLogWriter(w io.Writer, level string) error {
 }
 
 // GetLog returns the currently active logger.
-func GetLog() btclog.Logger {
-	return log
+func GetLog() Logger {
+	logMtx.RLock()
+	defer logMtx.RUnlock()
+
+	return backendLog
+}
+
+// DriverLogger returns the logger of the named driver for drivers to keep in
+// a package variable.  Each message is passed to the logger currently set for
+// the driver with UseDriverLogger, or else UseLogger, when its level is at
+// least the one set with SetDriverLogLevel, so changes to the loggers apply to
+// drivers which are already open.
+func DriverLogger(driver string) Logger {
+	return driverLogger(driver)
+}
+
+// driverLogger is the logger of the driver it is the name of.
+type driverLogger string
+
+// logger returns the logger the message of the passed level is output to, or
+// nil when the message is filtered out.
+func (d driverLogger) logger(lvl btclog.LogLevel) Logger {
+	logMtx.RLock()
+	defer logMtx.RUnlock()
+
+	if min, ok := driverLevels[string(d)]; ok && lvl < min {
+		return nil
+	}
+	if l, ok := driverLogs[string(d)]; ok {
+		return l
+	}
+	return backendLog
+}
+
+// Tracef formats and outputs a message at the trace level.  This is part of
+// the Logger interface implementation.
+func (d driverLogger) Tracef(format string, params ...interface{}) {
+	if l := d.logger(btclog.TraceLvl); l != nil {
+		l.Tracef(format, params...)
+	}
+}
+
+// Debugf formats and outputs a message at the debug level.  This is part of
+// the Logger interface implementation.
+func (d driverLogger) Debugf(format string, params ...interface{}) {
+	if l := d.logger(btclog.DebugLvl); l != nil {
+		l.Debugf(format, params...)
+	}
+}
+
+// Infof formats and outputs a message at the info level.  This is part of the
+// Logger interface implementation.
+func (d driverLogger) Infof(format string, params ...interface{}) {
+	if l := d.logger(btclog.InfoLvl); l != nil {
+		l.Infof(format, params...)
+	}
+}
+
+// Warnf formats and outputs a message at the warn level.  This is part of the
+// Logger interface implementation.
+func (d driverLogger) Warnf(format string, params ...interface{}) error {
+	if l := d.logger(btclog.WarnLvl); l != nil {
+		return l.Warnf(format, params...)
+	}
+	return nil
+}
+
+// Errorf formats and outputs a message at the error level.  This is part of
+// the Logger interface implementation.
+func (d driverLogger) Errorf(format string, params ...interface{}) error {
+	if l := d.logger(btclog.ErrorLvl); l != nil {
+		return l.Errorf(format, params...)
+	}
+	return nil
+}
+
+// Criticalf formats and outputs a message at the critical level.  This is part
+// of the Logger interface implementation.
+func (d driverLogger) Criticalf(format string, params ...interface{}) error {
+	if l := d.logger(btclog.CriticalLvl); l != nil {
+		return l.Criticalf(format, params...)
+	}
+	return nil
 }
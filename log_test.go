@@ -0,0 +1,171 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingLogger is a btcdb.Logger which keeps every message along with its
+// level.
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) add(lvl, format string, params ...interface{}) {
+	l.msgs = append(l.msgs, lvl+" "+fmt.Sprintf(format, params...))
+}
+
+func (l *recordingLogger) Tracef(format string, params ...interface{}) {
+	l.add("trace", format, params...)
+}
+
+func (l *recordingLogger) Debugf(format string, params ...interface{}) {
+	l.add("debug", format, params...)
+}
+
+func (l *recordingLogger) Infof(format string, params ...interface{}) {
+	l.add("info", format, params...)
+}
+
+func (l *recordingLogger) Warnf(format string, params ...interface{}) error {
+	l.add("warn", format, params...)
+	return nil
+}
+
+func (l *recordingLogger) Errorf(format string, params ...interface{}) error {
+	l.add("error", format, params...)
+	return nil
+}
+
+func (l *recordingLogger) Criticalf(format string, params ...interface{}) error {
+	l.add("critical", format, params...)
+	return nil
+}
+
+// TestDriverLogger ensures the output of drivers goes to the logger set for
+// them, or else the package logger, at the levels set for them.
+func TestDriverLogger(t *testing.T) {
+	defer btcdb.DisableLog()
+
+	backend := &recordingLogger{}
+	own := &recordingLogger{}
+	btcdb.UseLogger(backend)
+	log1 := btcdb.DriverLogger("test1")
+	log2 := btcdb.DriverLogger("test2")
+
+	log1.Tracef("one %d", 1)
+	log2.Infof("two %d", 2)
+	btcdb.UseDriverLogger("test2", own)
+	if err := btcdb.SetDriverLogLevel("test1", "warn"); err != nil {
+		t.Errorf("SetDriverLogLevel: %v", err)
+	}
+	log1.Infof("three")
+	log1.Errorf("four")
+	log2.Debugf("five")
+	btcdb.UseDriverLogger("test2", nil)
+	log2.Warnf("six")
+
+	if err := btcdb.SetDriverLogLevel("test1", "bogus"); err == nil {
+		t.Errorf("SetDriverLogLevel: accepted an invalid level")
+	}
+
+	wantBackend := []string{"trace one 1", "info two 2", "error four",
+		"warn six"}
+	if !reflect.DeepEqual(backend.msgs, wantBackend) {
+		t.Errorf("UseLogger: got %q, want %q", backend.msgs, wantBackend)
+	}
+	wantOwn := []string{"debug five"}
+	if !reflect.DeepEqual(own.msgs, wantOwn) {
+		t.Errorf("UseDriverLogger: got %q, want %q", own.msgs, wantOwn)
+	}
+
+	// Nothing is output once logging is disabled.
+	btcdb.DisableLog()
+	log1.Criticalf("seven")
+	if len(backend.msgs) != len(wantBackend) {
+		t.Errorf("DisableLog: got %q, want %q", backend.msgs, wantBackend)
+	}
+}
+
+// TestSlowOpLogging ensures every driver logs the operations which take at
+// least the SlowOpThreshold of its options.
+func TestSlowOpLogging(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+	defer btcdb.DisableLog()
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:3]
+	sha, _ := blocks[1].Sha()
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		for _, threshold := range []time.Duration{time.Nanosecond, time.Hour} {
+			logger := &recordingLogger{}
+			btcdb.UseLogger(logger)
+
+			opts := btcdb.Options{
+				Path: filepath.Join(testDbRoot, fmt.Sprintf(
+					"slowdb-%s-%d", dbType, threshold)),
+				SlowOpThreshold: threshold,
+			}
+			if dbType == "postgres" {
+				opts.Path = postgresDSN
+				if err := dropPostgresTables(); err != nil {
+					t.Errorf("Failed to drop postgres tables: %v",
+						err)
+					continue
+				}
+			}
+			db, err := btcdb.CreateDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+			if _, err := db.InsertBlocks(blocks); err != nil {
+				t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			}
+			if _, err := db.FetchBlockBySha(sha); err != nil {
+				t.Errorf("FetchBlockBySha (%s): %v", dbType, err)
+			}
+			db.Close()
+
+			var insertLogged, fetchLogged bool
+			for _, msg := range logger.msgs {
+				if strings.HasPrefix(msg, "warn Slow insertblocks "+
+					"of 3 blocks from ") {
+					insertLogged = true
+				}
+				if strings.HasPrefix(msg, fmt.Sprintf("warn Slow "+
+					"fetchblock of %v took ", sha)) {
+					fetchLogged = true
+				}
+			}
+			want := threshold == time.Nanosecond
+			if insertLogged != want || fetchLogged != want {
+				t.Errorf("SlowOpThreshold (%s, %v): logged insert "+
+					"%v and fetch %v, want %v: %q", dbType,
+					threshold, insertLogged, fetchLogged, want,
+					logger.msgs)
+			}
+		}
+	}
+}
@@ -8,5 +8,11 @@ storage.
 
 This is primary used for testing purposes as normal operations require a
 persistent block storage mechanism which this is not.
+
+The driver registers as the "memory" database type, which may also be given as
+"memdb", the type it was registered as before, and does not accept any
+arguments:
+
+	db, err := btcdb.CreateDB("memory")
 */
 package memdb
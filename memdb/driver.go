@@ -7,42 +7,51 @@ package memdb
 import (
 	"fmt"
 	"github.com/conformal/btcdb"
-	"github.com/conformal/btclog"
 )
 
-var log = btclog.Disabled
+var log = btcdb.DriverLogger("memdb")
 
 func init() {
-	driver := btcdb.DriverDB{DbType: "memdb", CreateDB: CreateDB, OpenDB: OpenDB}
+	// The driver was registered as "memdb" before it was named "memory",
+	// which is kept as an alias for the callers which still use it.
+	driver := btcdb.DriverDB{DbType: "memory", Aliases: []string{"memdb"},
+		CreateDB: CreateDB, OpenDB: OpenDB}
 	btcdb.AddDBDriver(driver)
 }
 
-// parseArgs parses the arguments from the btcdb Open/Create methods.
-func parseArgs(funcName string, args ...interface{}) error {
+// parseArgs parses the arguments from the btcdb Open/Create methods.  A
+// btcdb.Options is accepted so the database may be opened with
+// btcdb.CreateDBWithOptions, but only its ReadOnly setting applies to memdb.
+func parseArgs(funcName string, args ...interface{}) (*btcdb.Options, error) {
+	if len(args) == 1 {
+		if opts, ok := args[0].(btcdb.Options); ok {
+			return &opts, nil
+		}
+	}
 	if len(args) != 0 {
-		return fmt.Errorf("memdb.%s does not accept any arguments",
+		return nil, fmt.Errorf("memdb.%s does not accept any arguments",
 			funcName)
 	}
 
-	return nil
+	return &btcdb.Options{}, nil
 }
 
 // OpenDB opens an existing database for use.
 func OpenDB(args ...interface{}) (btcdb.Db, error) {
-	if err := parseArgs("OpenDB", args...); err != nil {
+	if _, err := parseArgs("OpenDB", args...); err != nil {
 		return nil, err
 	}
 
 	// A memory database is not persistent, so let CreateDB handle it.
-	return CreateDB()
+	return CreateDB(args...)
 }
 
 // CreateDB creates, initializes, and opens a database for use.
 func CreateDB(args ...interface{}) (btcdb.Db, error) {
-	if err := parseArgs("CreateDB", args...); err != nil {
+	opts, err := parseArgs("CreateDB", args...)
+	if err != nil {
 		return nil, err
 	}
 
-	log = btcdb.GetLog()
-	return newMemDb(), nil
+	return newMemDb(opts), nil
 }
@@ -0,0 +1,122 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package memdb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// fetchMsgTx returns the most recent version of the transaction with the
+// passed hash.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) fetchMsgTx(txHash *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+	txns, exists := db.txns[*txHash]
+	if !exists {
+		return nil, btcdb.TxShaMissing
+	}
+	txD := txns[len(txns)-1]
+	return db.blocks[txD.blockHeight].Transactions[txD.offset], nil
+}
+
+// FetchFilterBySha returns the basic filter of the block with the given hash.
+// This is part of the btcdb.Db interface implementation.
+func (db *MemDb) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	height, exists := db.blocksBySha[*sha]
+	if !exists {
+		return nil, btcdb.ErrBlockNotFound
+	}
+	return db.filters[height], nil
+}
+
+// FetchFilterHeaderBySha returns the basic filter header of the block with the
+// given hash.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	height, exists := db.blocksBySha[*sha]
+	if !exists {
+		return nil, btcdb.ErrBlockNotFound
+	}
+	header := db.filterHeaders[height]
+	return &header, nil
+}
+
+// filterRange returns the clamped heights of the blocks in the passed range.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) filterRange(startHeight, endHeight int64) (int64, int64, error) {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return 0, 0, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return 0, 0, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	// Fetch as many as are available within the specified range.
+	if endHeight > int64(len(db.blocks)) {
+		endHeight = int64(len(db.blocks))
+	}
+	if endHeight < startHeight {
+		endHeight = startHeight
+	}
+	return startHeight, endHeight, nil
+}
+
+// FetchFilterRange returns the basic filters of the blocks from the start
+// height up to but not including the end height.  This is part of the
+// btcdb.Db interface implementation.
+func (db *MemDb) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	startHeight, endHeight, err := db.filterRange(startHeight, endHeight)
+	if err != nil {
+		return nil, err
+	}
+	filters := make([][]byte, 0, endHeight-startHeight)
+	return append(filters, db.filters[startHeight:endHeight]...), nil
+}
+
+// FetchFilterHeaderRange returns the basic filter headers of the blocks from
+// the start height up to but not including the end height.  This is part of
+// the btcdb.Db interface implementation.
+func (db *MemDb) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	startHeight, endHeight, err := db.filterRange(startHeight, endHeight)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]btcwire.ShaHash, 0, endHeight-startHeight)
+	return append(headers, db.filterHeaders[startHeight:endHeight]...), nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// blockIterator walks the blocks of a snapshot of the database in height
+// order.
+type blockIterator struct {
+	snap   *snapshot
+	next   int64
+	height int64
+	sha    *btcwire.ShaHash
+	raw    []byte
+	err    error
+}
+
+// Next moves to the next block.  This is part of the btcdb.BlockIterator
+// interface implementation.
+func (it *blockIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	sha, raw, err := it.snap.fetchRawBlock(it.next)
+	if err != nil {
+		if err != btcdb.ErrBlockNotFound {
+			it.err = err
+		}
+		it.sha, it.raw = nil, nil
+		return false
+	}
+	it.sha, it.raw, it.height = sha, raw, it.next
+	it.next++
+	return true
+}
+
+// Sha returns the hash of the current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Sha() *btcwire.ShaHash {
+	return it.sha
+}
+
+// Height returns the height of the current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Height() int64 {
+	return it.height
+}
+
+// RawBytes returns the serialized current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) RawBytes() []byte {
+	return it.raw
+}
+
+// Err returns the error which stopped the iteration.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Err() error {
+	return it.err
+}
+
+// Release frees the snapshot the iterator reads from.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Release() {
+	it.snap.Release()
+}
+
+// fetchRawBlock returns the hash and serialized bytes of the block at the
+// given height.
+func (db *MemDb) fetchRawBlock(height int64) (*btcwire.ShaHash, []byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, nil, ErrDbClosed
+	}
+	if height < 0 || height >= int64(len(db.blocks)) {
+		return nil, nil, btcdb.ErrBlockNotFound
+	}
+
+	msgBlock := db.blocks[height]
+	sha, err := msgBlock.BlockSha()
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgBlock.Serialize(&buf); err != nil {
+		return nil, nil, err
+	}
+	return &sha, buf.Bytes(), nil
+}
+
+// BlockIterator returns an iterator over the blocks of the chain in height
+// order beginning at the given height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) BlockIterator(startHeight int64) (btcdb.BlockIterator, error) {
+	if startHeight < 0 {
+		return nil, fmt.Errorf("invalid start height %d", startHeight)
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &blockIterator{snap: snap.(*snapshot), next: startHeight}, nil
+}
+
+// TxIterator returns an iterator over every transaction of the chain beginning
+// with the block at the given height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) TxIterator(startHeight int64) (btcdb.TxIterator, error) {
+	blocks, err := db.BlockIterator(startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewTxIterator(blocks), nil
+}
+
+// BlockIteratorCtx returns an iterator over the blocks of the chain beginning
+// at the given height which stops once the passed context is done.  This is
+// part of the btcdb.Db interface implementation.
+func (db *MemDb) BlockIteratorCtx(ctx context.Context, startHeight int64) (btcdb.BlockIterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	it, err := db.BlockIterator(startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.ContextBlockIterator(ctx, it), nil
+}
+
+// TxIteratorCtx returns an iterator over every transaction of the chain
+// beginning with the block at the given height which stops once the passed
+// context is done.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) TxIteratorCtx(ctx context.Context, startHeight int64) (btcdb.TxIterator, error) {
+	blocks, err := db.BlockIteratorCtx(ctx, startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewTxIterator(blocks), nil
+}
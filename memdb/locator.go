@@ -0,0 +1,55 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package memdb
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	blockHeight, exists := db.blocksBySha[*sha]
+	if !exists {
+		return nil, btcdb.ErrBlockNotFound
+	}
+	return db.blockLocator(blockHeight)
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (db *MemDb) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	return db.blockLocator(int64(len(db.blocks) - 1))
+}
+
+// blockLocator returns a block locator for the block at the given height.
+// This function must be called with the db lock held.
+func (db *MemDb) blockLocator(height int64) (btcdb.BlockLocator, error) {
+	heights := btcdb.LocatorHeights(height)
+	locator := make(btcdb.BlockLocator, 0, len(heights))
+	for _, h := range heights {
+		sha, err := db.blocks[h].BlockSha()
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, &sha)
+	}
+	return locator, nil
+}
@@ -5,44 +5,35 @@
 package memdb
 
 import (
-	"errors"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/gcs"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
+	"io"
 	"math"
+	"math/big"
 	"sync"
 )
 
 // Errors that the various database functions may return.
 var (
-	ErrDbClosed = errors.New("Database is closed")
+	// ErrDbClosed is the same error as btcdb.ErrDbClosed.  It is kept so
+	// existing callers which compare against it continue to work.
+	ErrDbClosed = btcdb.ErrDbClosed
 )
 
-var (
-	zeroHash = btcwire.ShaHash{}
-
-	// The following two hashes are ones that must be specially handled.
-	// See the comments where they're used for more details.
-	dupTxHash91842 = newShaHashFromStr("d5d27987d2a3dfc724e359870c6644b40e497bdc0589a033220fe15429d88599")
-	dupTxHash91880 = newShaHashFromStr("e3bf3d07d4b0375638d5f1db5255fe07ba2c4cb067cd81b84ee974b6585fb468")
-)
+var zeroHash = btcwire.ShaHash{}
 
 // tTxInsertData holds information about the location and spent status of
-// a transaction.
+// a transaction along with the transactions which spent its outputs.
 type tTxInsertData struct {
 	blockHeight int64
 	offset      int
 	spentBuf    []bool
-}
-
-// newShaHashFromStr converts the passed big-endian hex string into a
-// btcwire.ShaHash.  It only differs from the one available in btcwire in that
-// it ignores the error since it will only (and must only) be called with
-// hard-coded, and therefore known good, hashes.
-func newShaHashFromStr(hexStr string) *btcwire.ShaHash {
-	sha, _ := btcwire.NewShaHashFromStr(hexStr)
-	return sha
+	spentBy     []*btcdb.SpendingTx
 }
 
 // isCoinbaseInput returns whether or not the passed transaction input is a
@@ -91,9 +82,39 @@ type MemDb struct {
 	// block height and spent status of all their outputs.
 	txns map[btcwire.ShaHash][]*tTxInsertData
 
+	// filters and filterHeaders hold the basic compact filter and filter
+	// header of each block.  They are indexed by height like the blocks
+	// slice.
+	filters       [][]byte
+	filterHeaders []btcwire.ShaHash
+
+	// chainWork holds the cumulative work of the chain through each block.
+	// It is indexed by height like the blocks slice.
+	chainWork []*big.Int
+
+	// meta holds the metadata namespace keyed by the string form of each
+	// key.
+	meta map[string][]byte
+
+	// notifier delivers the blocks connected and disconnected by each
+	// change to subscribers and indexers holds the secondary indexes
+	// updated along with the blocks.
+	notifier btcdb.Notifier
+	indexers btcdb.IndexerSet
+
 	// closed indicates whether or not the database has been closed and is
 	// therefore invalidated.
 	closed bool
+
+	// readOnly indicates whether or not changes to the database are
+	// rejected.
+	readOnly bool
+
+	// metrics receives the measurements of the operations of the database.
+	metrics btcdb.Metrics
+
+	// validation selects the checks performed on each inserted block.
+	validation btcdb.ValidationMode
 }
 
 // removeTx removes the passed transaction including unspending it.
@@ -115,6 +136,7 @@ func (db *MemDb) removeTx(msgTx *btcwire.MsgTx, txHash *btcwire.ShaHash) {
 
 		originTxD := originTxns[len(originTxns)-1]
 		originTxD.spentBuf[prevOut.Index] = false
+		originTxD.spentBy[prevOut.Index] = nil
 	}
 
 	// Remove the info for the most recent version of the transaction.
@@ -144,33 +166,105 @@ func (db *MemDb) Close() {
 	db.blocks = nil
 	db.blocksBySha = nil
 	db.txns = nil
+	db.filters = nil
+	db.filterHeaders = nil
+	db.chainWork = nil
+	db.meta = nil
+	db.notifier.Close()
 	db.closed = true
 }
 
+// Closed returns whether the database has been closed.  This is part of the
+// btcdb.Db interface implementation.
+func (db *MemDb) Closed() bool {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.closed
+}
+
 // DropAfterBlockBySha removes any blocks from the database after the given
 // block.  This is different than a simple truncate since the spend information
 // for each block must also be unwound.  This is part of the btcdb.Db interface
 // implementation.
 func (db *MemDb) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
 	db.Lock()
+	op.Locked()
 	defer db.Unlock()
 
 	if db.closed {
 		return ErrDbClosed
 	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
 
 	// Begin by attempting to find the height associated with the passed
 	// hash.
 	height, exists := db.blocksBySha[*sha]
 	if !exists {
-		return fmt.Errorf("block %v does not exist in the database",
-			sha)
+		return btcdb.ErrBlockNotFound
 	}
 
+	return db.dropAfterHeightWithMeta(height, nil)
+}
+
+// dropAfterHeightWithMeta removes any blocks from the database after the given
+// height, disconnects them from the indexers and then applies the passed
+// changes to the metadata namespace.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) dropAfterHeightWithMeta(height int64, meta *btcdb.MetaBatch) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+
+	// The indexers are given the blocks before any of them are removed
+	// so a failure leaves the database untouched.
+	var dropped []*btcutil.Block
+	var droppedHeights []int64
+	var droppedSpent [][]*btcdb.UtxoEntry
+	if db.indexers.Len() != 0 {
+		for i := int64(len(db.blocks) - 1); i > height; i-- {
+			blk := btcutil.NewBlock(db.blocks[i])
+			spent, err := btcdb.FetchSpentTxOuts(blk, i, db.fetchTxBySha)
+			if err != nil {
+				return err
+			}
+			dropped = append(dropped, blk)
+			droppedHeights = append(droppedHeights, i)
+			droppedSpent = append(droppedSpent, spent)
+		}
+	}
+	idxMeta, err := db.indexers.DisconnectBlocks(dropped, droppedHeights,
+		droppedSpent, db.getMeta)
+	if err != nil {
+		return err
+	}
+
+	disconnected, err := db.dropAfterHeight(height)
+	db.notifier.Notify(disconnected...)
+	if err != nil {
+		return err
+	}
+	db.putMeta(meta)
+	db.putMeta(idxMeta)
+	return nil
+}
+
+// dropAfterHeight removes any blocks from the database after the given height
+// and unwinds their spend information.  It returns the blocks which were
+// removed, even when it fails part of the way.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) dropAfterHeight(height int64) ([]btcdb.ChainEvent, error) {
 	// The spend information has to be undone in reverse order, so loop
 	// backwards from the last block through the block just after the passed
 	// block.  While doing this unspend all transactions in each block and
 	// remove the block.
+	var disconnected []btcdb.ChainEvent
 	endHeight := int64(len(db.blocks) - 1)
 	for i := endHeight; i > height; i-- {
 		// Unspend and remove each transaction in reverse order because
@@ -182,11 +276,23 @@ func (db *MemDb) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
 			db.removeTx(tx, &txHash)
 		}
 
+		blockHash, err := db.blocks[i].BlockSha()
+		if err != nil {
+			return disconnected, err
+		}
+		disconnected = append(disconnected,
+			btcdb.BlockDisconnected{Sha: blockHash, Height: i})
+		delete(db.blocksBySha, blockHash)
 		db.blocks[i] = nil
 		db.blocks = db.blocks[:i]
+		db.filters[i] = nil
+		db.filters = db.filters[:i]
+		db.filterHeaders = db.filterHeaders[:i]
+		db.chainWork[i] = nil
+		db.chainWork = db.chainWork[:i]
 	}
 
-	return nil
+	return disconnected, nil
 }
 
 // ExistsSha returns whether or not the given block hash is present in the
@@ -207,6 +313,25 @@ func (db *MemDb) ExistsSha(sha *btcwire.ShaHash) bool {
 	return false
 }
 
+// ExistsShas returns whether or not each of the given block hashes is present
+// in the database.  All of the hashes are looked up under a single acquisition
+// of the db lock.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) ExistsShas(shas []btcwire.ShaHash) []bool {
+	db.Lock()
+	defer db.Unlock()
+
+	exists := make([]bool, len(shas))
+	if db.closed {
+		log.Warnf("ExistsShas called after db close.")
+		return exists
+	}
+
+	for i := range shas {
+		_, exists[i] = db.blocksBySha[shas[i]]
+	}
+	return exists
+}
+
 // FetchBlockBySha returns a btcutil.Block.  The implementation may cache the
 // underlying data if desired.  This is part of the btcdb.Db interface
 // implementation.
@@ -214,7 +339,18 @@ func (db *MemDb) ExistsSha(sha *btcwire.ShaHash) bool {
 // This implementation does not use any additional cache since the entire
 // database is already in memory.
 func (db *MemDb) FetchBlockBySha(sha *btcwire.ShaHash) (*btcutil.Block, error) {
-	db.Lock()
+	return db.FetchBlockByShaCtx(context.Background(), sha)
+}
+
+// FetchBlockByShaCtx returns a btcutil.Block unless the passed context is done
+// first.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha)
+	defer op.Done()
+	if err := btcdb.LockContext(ctx, &db.Mutex); err != nil {
+		return nil, err
+	}
+	op.Locked()
 	defer db.Unlock()
 
 	if db.closed {
@@ -227,7 +363,16 @@ func (db *MemDb) FetchBlockBySha(sha *btcwire.ShaHash) (*btcutil.Block, error) {
 		return block, nil
 	}
 
-	return nil, fmt.Errorf("block %v is not in database", sha)
+	return nil, btcdb.ErrBlockNotFound
+}
+
+// BlockCacheStats returns the use of the cache of recent blocks.  This is part
+// of the btcdb.Db interface implementation.
+//
+// This implementation does not use a block cache since the entire database is
+// already in memory, so the stats are always zero.
+func (db *MemDb) BlockCacheStats() btcdb.BlockCacheStats {
+	return btcdb.BlockCacheStats{}
 }
 
 // FetchBlockHeightBySha returns the block height for the given hash.  This is
@@ -244,7 +389,60 @@ func (db *MemDb) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
 		return blockHeight, nil
 	}
 
-	return 0, fmt.Errorf("block %v is not in database", sha)
+	return 0, btcdb.ErrBlockNotFound
+}
+
+// FetchBlockRegion returns length bytes of the serialized block with the given
+// hash starting at offset.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	blockHeight, exists := db.blocksBySha[*sha]
+	if !exists {
+		return nil, btcdb.ErrBlockNotFound
+	}
+
+	var buf bytes.Buffer
+	if err := db.blocks[int(blockHeight)].Serialize(&buf); err != nil {
+		return nil, err
+	}
+	raw := buf.Bytes()
+	if offset < 0 || length < 0 || offset+length > len(raw) {
+		return nil, btcdb.ErrInvalidRegion
+	}
+	return raw[offset : offset+length], nil
+}
+
+// FetchBlockBytesBySha appends the serialized block with the given hash to
+// buf[:0] and returns the result.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha)
+	defer op.Done()
+	db.Lock()
+	op.Locked()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	blockHeight, exists := db.blocksBySha[*sha]
+	if !exists {
+		return nil, btcdb.ErrBlockNotFound
+	}
+
+	w := bytes.NewBuffer(buf[:0])
+	if err := db.blocks[int(blockHeight)].Serialize(w); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
 }
 
 // FetchBlockHeaderBySha returns a btcwire.BlockHeader for the given sha.  The
@@ -254,7 +452,10 @@ func (db *MemDb) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
 // This implementation does not use any additional cache since the entire
 // database is already in memory.
 func (db *MemDb) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (*btcwire.BlockHeader, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, sha)
+	defer op.Done()
 	db.Lock()
+	op.Locked()
 	defer db.Unlock()
 
 	if db.closed {
@@ -265,7 +466,25 @@ func (db *MemDb) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (*btcwire.BlockHead
 		return &db.blocks[int(blockHeight)].Header, nil
 	}
 
-	return nil, fmt.Errorf("block header %v is not in database", sha)
+	return nil, btcdb.ErrBlockNotFound
+}
+
+// FetchChainWorkBySha returns the cumulative work of the main chain through the
+// block with the given hash.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	if blockHeight, exists := db.blocksBySha[*sha]; exists {
+		return new(big.Int).Set(db.chainWork[blockHeight]), nil
+	}
+
+	return nil, btcdb.ErrBlockNotFound
 }
 
 // FetchBlockShaByHeight returns a block hash based on its height in the block
@@ -280,9 +499,7 @@ func (db *MemDb) FetchBlockShaByHeight(height int64) (*btcwire.ShaHash, error) {
 
 	numBlocks := int64(len(db.blocks))
 	if height < 0 || height > numBlocks-1 {
-		return nil, fmt.Errorf("unable to fetch block height %d since "+
-			"it is not within the valid range (%d-%d)", height, 0,
-			numBlocks-1)
+		return nil, btcdb.ErrBlockNotFound
 	}
 
 	msgBlock := db.blocks[height]
@@ -299,7 +516,17 @@ func (db *MemDb) FetchBlockShaByHeight(height int64) (*btcwire.ShaHash, error) {
 // To fetch all hashes from the start height until no more are present, use the
 // special id `AllShas'.  This is part of the btcdb.Db interface implementation.
 func (db *MemDb) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
-	db.Lock()
+	return db.FetchHeightRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeightRangeCtx looks up a range of blocks by the start and ending
+// heights unless the passed context is done first.  This is part of the
+// btcdb.Db interface implementation.
+func (db *MemDb) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	if err := btcdb.LockContext(ctx, &db.Mutex); err != nil {
+		return nil, err
+	}
 	defer db.Unlock()
 
 	if db.closed {
@@ -330,6 +557,9 @@ func (db *MemDb) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHa
 		if i > lastBlockIndex {
 			break
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		msgBlock := db.blocks[i]
 		blockHash, err := msgBlock.BlockSha()
@@ -342,6 +572,77 @@ func (db *MemDb) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHa
 	return hashList, nil
 }
 
+// FetchBlockHeaderByHeight returns the block header at the given height in the
+// main chain.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) FetchBlockHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, height)
+	defer op.Done()
+	db.Lock()
+	op.Locked()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	if height < 0 || height > int64(len(db.blocks)-1) {
+		return nil, btcdb.ErrBlockNotFound
+	}
+
+	bh := db.blocks[height].Header
+	return &bh, nil
+}
+
+// FetchHeaderRange returns the block headers from the start height up to but
+// not including the end height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return db.FetchHeaderRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeaderRangeCtx returns the block headers from the start height up to but
+// not including the end height unless the passed context is done first.  This
+// is part of the btcdb.Db interface implementation.
+func (db *MemDb) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	if err := btcdb.LockContext(ctx, &db.Mutex); err != nil {
+		return nil, err
+	}
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	// Fetch as many as are available within the specified range.
+	if endHeight > int64(len(db.blocks)) {
+		endHeight = int64(len(db.blocks))
+	}
+	if endHeight < startHeight {
+		endHeight = startHeight
+	}
+
+	headers := make([]btcwire.BlockHeader, 0, endHeight-startHeight)
+	for i := startHeight; i < endHeight; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		headers = append(headers, db.blocks[i].Header)
+	}
+	return headers, nil
+}
+
 // ExistsTxSha returns whether or not the given transaction hash is present in
 // the database and is not fully spent.  This is part of the btcdb.Db interface
 // implementation.
@@ -361,6 +662,28 @@ func (db *MemDb) ExistsTxSha(sha *btcwire.ShaHash) bool {
 	return false
 }
 
+// ExistsTxShas returns whether or not each of the given transaction hashes is
+// present in the database and is not fully spent.  All of the hashes are looked
+// up under a single acquisition of the db lock.  This is part of the btcdb.Db
+// interface implementation.
+func (db *MemDb) ExistsTxShas(shas []btcwire.ShaHash) []bool {
+	db.Lock()
+	defer db.Unlock()
+
+	exists := make([]bool, len(shas))
+	if db.closed {
+		log.Warnf("ExistsTxShas called after db close.")
+		return exists
+	}
+
+	for i := range shas {
+		if txns, ok := db.txns[shas[i]]; ok {
+			exists[i] = !isFullySpent(txns[len(txns)-1])
+		}
+	}
+	return exists
+}
+
 // FetchTxBySha returns some data for the given transaction hash. The
 // implementation may cache the underlying data if desired.  This is part of the
 // btcdb.Db interface implementation.
@@ -368,13 +691,24 @@ func (db *MemDb) ExistsTxSha(sha *btcwire.ShaHash) bool {
 // This implementation does not use any additional cache since the entire
 // database is already in memory.
 func (db *MemDb) FetchTxBySha(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricFetchTx, txHash)
+	defer op.Done()
 	db.Lock()
+	op.Locked()
 	defer db.Unlock()
 
 	if db.closed {
 		return nil, ErrDbClosed
 	}
 
+	return db.fetchTxBySha(txHash)
+}
+
+// fetchTxBySha returns every instance of the transaction with the passed hash
+// stored in the database.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) fetchTxBySha(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
 	txns, exists := db.txns[*txHash]
 	if !exists {
 		log.Warnf("FetchTxBySha: requested hash of %s does not exist",
@@ -394,12 +728,13 @@ func (db *MemDb) FetchTxBySha(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, er
 		spentBuf := make([]bool, len(txD.spentBuf))
 		copy(spentBuf, txD.spentBuf)
 		reply := btcdb.TxListReply{
-			Sha:     &txHashCopy,
-			Tx:      msgBlock.Transactions[txD.offset],
-			BlkSha:  &blockSha,
-			Height:  txD.blockHeight,
-			TxSpent: spentBuf,
-			Err:     nil,
+			Sha:      &txHashCopy,
+			Tx:       msgBlock.Transactions[txD.offset],
+			BlkSha:   &blockSha,
+			Height:   txD.blockHeight,
+			BlkIndex: txD.offset,
+			TxSpent:  spentBuf,
+			Err:      nil,
 		}
 		replyList[i] = &reply
 	}
@@ -415,7 +750,7 @@ func (db *MemDb) FetchTxBySha(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, er
 // The includeSpent flag indicates whether or not information about transactions
 // which are fully spent should be returned.  When the flag is not set, the
 // corresponding entry in the TxListReply slice for fully spent transactions
-// will indicate the transaction does not exist.
+// will indicate the transaction does not exist and is fully spent.
 //
 // This function must be called with the db lock held.
 func (db *MemDb) fetchTxByShaList(txShaList []*btcwire.ShaHash, includeSpent bool) []*btcdb.TxListReply {
@@ -444,6 +779,8 @@ func (db *MemDb) fetchTxByShaList(txShaList []*btcwire.ShaHash, includeSpent boo
 			// used to get all versions of a transaction.
 			txD := txns[len(txns)-1]
 			if !includeSpent && isFullySpent(txD) {
+				reply.Height = txD.blockHeight
+				reply.FullySpent = true
 				continue
 			}
 
@@ -466,6 +803,7 @@ func (db *MemDb) fetchTxByShaList(txShaList []*btcwire.ShaHash, includeSpent boo
 			reply.Tx = msgBlock.Transactions[txD.offset]
 			reply.BlkSha = &blockSha
 			reply.Height = txD.blockHeight
+			reply.BlkIndex = txD.offset
 			reply.TxSpent = spentBuf
 			reply.Err = nil
 		}
@@ -503,7 +841,8 @@ func (db *MemDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListR
 
 // FetchUnSpentTxByShaList returns a TxListReply given an array of transaction
 // hashes.  Any transactions which are fully spent will indicate they do not
-// exist by setting the Err field to TxShaMissing.  The implementation may cache
+// exist by setting the Err field to TxShaMissing, along with the FullySpent
+// field and the height of their most recent instance.  The implementation may cache
 // the underlying data if desired.  This is part of the btcdb.Db interface
 // implementation.
 //
@@ -520,24 +859,246 @@ func (db *MemDb) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.
 	return db.fetchTxByShaList(txShaList, false)
 }
 
+// FetchUtxoEntry returns the unspent transaction output referenced by the
+// given outpoint.  A nil entry and no error is returned when the output does
+// not exist or has already been spent.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) FetchUtxoEntry(op *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	// Only the most recent version of a transaction can have unspent
+	// outputs.
+	txns, exists := db.txns[op.Hash]
+	if !exists {
+		return nil, nil
+	}
+	txD := txns[len(txns)-1]
+	if int(op.Index) >= len(txD.spentBuf) || txD.spentBuf[op.Index] {
+		return nil, nil
+	}
+
+	msgTx := db.blocks[txD.blockHeight].Transactions[txD.offset]
+	txOut := msgTx.TxOut[op.Index]
+	entry := btcdb.UtxoEntry{
+		Height:   txD.blockHeight,
+		Coinbase: txD.offset == 0,
+		Value:    txOut.Value,
+		PkScript: txOut.PkScript,
+	}
+	return &entry, nil
+}
+
+// FetchSpendingTx returns the transaction which spent the output referenced by
+// the given outpoint.  This is part of the btcdb.Db interface implementation.
+//
+// This implementation always knows the spender since it records it along with
+// the spent status of each output.
+func (db *MemDb) FetchSpendingTx(op *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	txns, exists := db.txns[op.Hash]
+	if !exists {
+		return nil, nil
+	}
+	txD := txns[len(txns)-1]
+	if int(op.Index) >= len(txD.spentBy) || txD.spentBy[op.Index] == nil {
+		return nil, nil
+	}
+	spender := *txD.spentBy[op.Index]
+	return &spender, nil
+}
+
+// IsOutpointSpent returns whether the output referenced by the given outpoint
+// was spent by a transaction of the main chain.  This is part of the btcdb.Db
+// interface implementation.
+func (db *MemDb) IsOutpointSpent(op *btcwire.OutPoint) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return false, ErrDbClosed
+	}
+
+	txns, exists := db.txns[op.Hash]
+	if !exists {
+		return false, btcdb.ErrTxNotFound
+	}
+	txD := txns[len(txns)-1]
+	if int(op.Index) >= len(txD.spentBuf) {
+		return true, nil
+	}
+	return txD.spentBuf[op.Index], nil
+}
+
+// UtxoSetSize returns the total number of unspent transaction outputs in the
+// database.  This is part of the btcdb.Db interface implementation.
+//
+// This implementation counts the unspent outputs on every call since the
+// entire database is already in memory.
+func (db *MemDb) UtxoSetSize() (int64, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return 0, ErrDbClosed
+	}
+
+	var size int64
+	for _, txns := range db.txns {
+		for _, spent := range txns[len(txns)-1].spentBuf {
+			if !spent {
+				size++
+			}
+		}
+	}
+	return size, nil
+}
+
 // InsertBlock inserts raw block and transaction data from a block into the
 // database.  The first block inserted into the database will be treated as the
 // genesis block.  Every subsequent block insert requires the referenced parent
 // block to already exist.  This is part of the btcdb.Db interface
 // implementation.
 func (db *MemDb) InsertBlock(block *btcutil.Block) (int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, block)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, 1)
 	db.Lock()
+	op.Locked()
 	defer db.Unlock()
 
 	if db.closed {
 		return 0, ErrDbClosed
 	}
+	if db.readOnly {
+		return 0, btcdb.ErrReadOnly
+	}
 
+	heights, err := db.insertBlocks([]*btcutil.Block{block}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return heights[0], nil
+}
+
+// InsertBlocks inserts a run of blocks in order and returns the height of each.
+// Every block must connect to the one before it and the first to a block
+// already in the database.  When any of the blocks fails to insert, the ones
+// before it are removed again so none of them are inserted.  This is part of
+// the btcdb.Db interface implementation.
+func (db *MemDb) InsertBlocks(blocks []*btcutil.Block) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+	db.Lock()
+	op.Locked()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+
+	return db.insertBlocks(blocks, nil)
+}
+
+// insertBlocks inserts a run of blocks in order and then applies the passed
+// changes to the metadata namespace.  When any of the blocks fails to insert,
+// the ones before it are removed again and the metadata is left untouched.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) insertBlocks(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+
+	startHeight := int64(len(db.blocks) - 1)
+	heights := make([]int64, 0, len(blocks))
+	connected := make([]btcdb.ChainEvent, 0, len(blocks))
+	for _, block := range blocks {
+		height, err := db.insertBlock(block)
+		if err != nil {
+			_, dropErr := db.dropAfterHeight(startHeight)
+			if dropErr != nil {
+				log.Warnf("Unable to remove partially inserted "+
+					"blocks: %v", dropErr)
+			}
+			return nil, err
+		}
+		heights = append(heights, height)
+		sha, _ := block.Sha()
+		connected = append(connected,
+			btcdb.BlockConnected{Sha: *sha, Height: height})
+	}
+	var spent [][]*btcdb.UtxoEntry
+	if db.indexers.Len() != 0 {
+		for i, block := range blocks {
+			s, err := btcdb.FetchSpentTxOuts(block, heights[i],
+				db.fetchTxBySha)
+			if err != nil {
+				_, dropErr := db.dropAfterHeight(startHeight)
+				if dropErr != nil {
+					log.Warnf("Unable to remove partially "+
+						"inserted blocks: %v", dropErr)
+				}
+				return nil, err
+			}
+			spent = append(spent, s)
+		}
+	}
+	idxMeta, err := db.indexers.ConnectBlocks(blocks, heights, spent,
+		db.getMeta)
+	if err != nil {
+		_, dropErr := db.dropAfterHeight(startHeight)
+		if dropErr != nil {
+			log.Warnf("Unable to remove partially inserted "+
+				"blocks: %v", dropErr)
+		}
+		return nil, err
+	}
+	db.putMeta(meta)
+	db.putMeta(idxMeta)
+	db.notifier.Notify(connected...)
+	return heights, nil
+}
+
+// insertBlock inserts the raw block and transaction data of the passed block.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) insertBlock(block *btcutil.Block) (int64, error) {
 	blockHash, err := block.Sha()
 	if err != nil {
 		return 0, err
 	}
 
+	if db.validation != btcdb.ValidateNone {
+		var tipSha *btcwire.ShaHash
+		if len(db.blocks) > 0 {
+			tip := db.blocks[len(db.blocks)-1]
+			sha, err := tip.Header.BlockSha()
+			if err != nil {
+				return 0, err
+			}
+			tipSha = &sha
+		}
+		err := btcdb.CheckBlock(block, db.validation, tipSha)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Reject the insert if the previously reference block does not exist
 	// except in the case there are no blocks inserted yet where the first
 	// inserted block is assumed to be a genesis block.
@@ -564,19 +1125,17 @@ func (db *MemDb) InsertBlock(block *btcutil.Block) (int64, error) {
 	// deal with rollback on errors.
 	newHeight := int64(len(db.blocks))
 	for i, tx := range transactions {
-		// Two old blocks contain duplicate transactions due to being
-		// mined by faulty miners and accepted by the origin Satoshi
-		// client.  Rules have since been added to the ensure this
-		// problem can no longer happen, but the two duplicate
-		// transactions which were originally accepted are forever in
-		// the block chain history and must be dealth with specially.
-		// http://blockexplorer.com/b/91842
-		// http://blockexplorer.com/b/91880
-		if newHeight == 91842 && tx.Sha().IsEqual(dupTxHash91842) {
-			continue
+		// Prevent duplicate transactions in the same block.
+		if inFlightIndex := txInFlight[*tx.Sha()]; inFlightIndex != i {
+			log.Warnf("Block contains duplicate transaction %s",
+				tx.Sha())
+			return 0, btcdb.DuplicateSha
 		}
 
-		if newHeight == 91880 && tx.Sha().IsEqual(dupTxHash91880) {
+		// The two duplicate coinbase transactions which were accepted
+		// before BIP0030 overwrite the earlier instances of their
+		// hash.  See btcdb.IsBIP30Exception for details.
+		if btcdb.IsBIP30Exception(newHeight, tx.Sha()) {
 			continue
 		}
 
@@ -615,14 +1174,6 @@ func (db *MemDb) InsertBlock(block *btcutil.Block) (int64, error) {
 			}
 		}
 
-		// Prevent duplicate transactions in the same block.
-		if inFlightIndex, exists := txInFlight[*tx.Sha()]; exists &&
-			inFlightIndex < i {
-			log.Warnf("Block contains duplicate transaction %s",
-				tx.Sha())
-			return 0, btcdb.DuplicateSha
-		}
-
 		// Prevent duplicate transactions unless the old one is fully
 		// spent.
 		if txns, exists := db.txns[*tx.Sha()]; exists {
@@ -635,8 +1186,27 @@ func (db *MemDb) InsertBlock(block *btcutil.Block) (int64, error) {
 		}
 	}
 
+	// Build the basic filter of the block now that all of the outputs it
+	// spends are known to exist.
+	filter, err := gcs.BuildBasicFilter(block, db.fetchMsgTx)
+	if err != nil {
+		return 0, err
+	}
+	var prevFilterHeader btcwire.ShaHash
+	if newHeight > 0 {
+		prevFilterHeader = db.filterHeaders[newHeight-1]
+	}
+
 	db.blocks = append(db.blocks, msgBlock)
 	db.blocksBySha[*blockHash] = newHeight
+	db.filters = append(db.filters, filter)
+	db.filterHeaders = append(db.filterHeaders,
+		gcs.FilterHeader(filter, &prevFilterHeader))
+	work := btcdb.CalcWork(msgBlock.Header.Bits)
+	if newHeight > 0 {
+		work.Add(work, db.chainWork[newHeight-1])
+	}
+	db.chainWork = append(db.chainWork, work)
 
 	// Insert information about eacj transaction and spend all of the
 	// outputs referenced by the inputs to the transactions.
@@ -646,11 +1216,12 @@ func (db *MemDb) InsertBlock(block *btcutil.Block) (int64, error) {
 			blockHeight: newHeight,
 			offset:      i,
 			spentBuf:    make([]bool, len(tx.MsgTx().TxOut)),
+			spentBy:     make([]*btcdb.SpendingTx, len(tx.MsgTx().TxOut)),
 		}
 		db.txns[*tx.Sha()] = append(db.txns[*tx.Sha()], &txD)
 
 		// Spend all of the inputs.
-		for _, txIn := range tx.MsgTx().TxIn {
+		for inIdx, txIn := range tx.MsgTx().TxIn {
 			// Coinbase transaction has no inputs.
 			if isCoinbaseInput(txIn) {
 				continue
@@ -661,6 +1232,11 @@ func (db *MemDb) InsertBlock(block *btcutil.Block) (int64, error) {
 			originTxns := db.txns[prevOut.Hash]
 			originTxD := originTxns[len(originTxns)-1]
 			originTxD.spentBuf[prevOut.Index] = true
+			originTxD.spentBy[prevOut.Index] = &btcdb.SpendingTx{
+				Sha:        tx.Sha(),
+				Height:     newHeight,
+				InputIndex: uint32(inIdx),
+			}
 		}
 	}
 
@@ -743,6 +1319,129 @@ func (db *MemDb) RollbackClose() {
 	db.Close()
 }
 
+// AddIndexer initializes the passed indexer, catches it up with the chain and
+// from then on updates it along with the blocks.  This is part of the btcdb.Db
+// interface implementation.
+func (db *MemDb) AddIndexer(idx btcdb.Indexer) error {
+	db.Lock()
+	closed, readOnly := db.closed, db.readOnly
+	db.Unlock()
+
+	if closed {
+		return ErrDbClosed
+	}
+	if readOnly {
+		return btcdb.ErrReadOnly
+	}
+	return db.indexers.Add(db, idx)
+}
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain.  This is part of the btcdb.Db interface implementation.
+func (db *MemDb) Subscribe() (*btcdb.Subscription, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	return db.notifier.Subscribe()
+}
+
+// snapshot is a read-only copy of a memory database.
+type snapshot struct {
+	*MemDb
+}
+
+// Release frees the copied data.  This is part of the btcdb.Snapshot interface
+// implementation.
+func (s *snapshot) Release() {
+	s.Close()
+}
+
+// Snapshot returns a read-only view of the database pinned to the current
+// point in time.  This is part of the btcdb.Db interface implementation.
+//
+// This implementation copies the database since the spent status of
+// transactions is updated in place.
+func (db *MemDb) Snapshot() (btcdb.Snapshot, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	view := &MemDb{
+		blocks:      make([]*btcwire.MsgBlock, len(db.blocks)),
+		blocksBySha: make(map[btcwire.ShaHash]int64, len(db.blocksBySha)),
+		txns:        make(map[btcwire.ShaHash][]*tTxInsertData, len(db.txns)),
+		readOnly:    true,
+		metrics:     db.metrics,
+	}
+	copy(view.blocks, db.blocks)
+	view.filters = make([][]byte, len(db.filters))
+	copy(view.filters, db.filters)
+	view.filterHeaders = make([]btcwire.ShaHash, len(db.filterHeaders))
+	copy(view.filterHeaders, db.filterHeaders)
+	view.chainWork = make([]*big.Int, len(db.chainWork))
+	copy(view.chainWork, db.chainWork)
+	view.meta = make(map[string][]byte, len(db.meta))
+	for key, value := range db.meta {
+		view.meta[key] = value
+	}
+	for sha, height := range db.blocksBySha {
+		view.blocksBySha[sha] = height
+	}
+	for sha, txns := range db.txns {
+		txnsCopy := make([]*tTxInsertData, len(txns))
+		for i, txD := range txns {
+			txDCopy := *txD
+			txDCopy.spentBuf = make([]bool, len(txD.spentBuf))
+			copy(txDCopy.spentBuf, txD.spentBuf)
+			txDCopy.spentBy = make([]*btcdb.SpendingTx,
+				len(txD.spentBy))
+			copy(txDCopy.spentBy, txD.spentBy)
+			txnsCopy[i] = &txDCopy
+		}
+		view.txns[sha] = txnsCopy
+	}
+	return &snapshot{view}, nil
+}
+
+// VerifyIntegrity performs the integrity checks of the given level on every
+// block of the chain using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *MemDb) VerifyIntegrity(level int, progress func(height int64)) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.VerifyChain(snap, level, progress)
+}
+
+// ExportBootstrap writes the blocks of a range of heights in the format of
+// bootstrap.dat using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *MemDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.WriteBootstrap(snap, w, startHeight, endHeight)
+}
+
+// Backup returns btcdb.ErrBackupUnsupported since the memory database has no
+// representation at a path to copy.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) Backup(destPath string, progress func(copied int64)) error {
+	return btcdb.ErrBackupUnsupported
+}
+
 // Sync verifies that the database is coherent on disk and no outstanding
 // transactions are in flight.  This is part of the btcdb.Db interface
 // implementation.
@@ -763,12 +1462,19 @@ func (db *MemDb) Sync() {
 	return
 }
 
-// newMemDb returns a new memory-only database ready for block inserts.
-func newMemDb() *MemDb {
+// newMemDb returns a new memory-only database ready for block inserts unless
+// the ReadOnly setting of the passed options is set.  The operations are
+// measured by the Metrics of the options and inserted blocks are checked as
+// selected by their Validation setting.
+func newMemDb(opts *btcdb.Options) *MemDb {
 	db := MemDb{
 		blocks:      make([]*btcwire.MsgBlock, 0, 200000),
 		blocksBySha: make(map[btcwire.ShaHash]int64),
 		txns:        make(map[btcwire.ShaHash][]*tTxInsertData),
+		meta:        make(map[string][]byte),
+		readOnly:    opts.ReadOnly,
+		metrics:     btcdb.DriverMetrics(opts),
+		validation:  opts.Validation,
 	}
 	return &db
 }
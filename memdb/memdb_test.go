@@ -18,7 +18,7 @@ import (
 // and does not panic or otherwise misbehave for functions which do not return
 // errors.
 func TestClosed(t *testing.T) {
-	db, err := btcdb.CreateDB("memdb")
+	db, err := btcdb.CreateDB("memory")
 	if err != nil {
 		t.Errorf("Failed to open test database %v", err)
 		return
@@ -93,6 +93,15 @@ func TestClosed(t *testing.T) {
 		}
 	}
 
+	genesisOutPoint := btcwire.NewOutPoint(genesisMerkleRoot, 0)
+	if _, err := db.FetchUtxoEntry(genesisOutPoint); err != memdb.ErrDbClosed {
+		t.Errorf("FetchUtxoEntry: unexpected error %v", err)
+	}
+
+	if _, err := db.UtxoSetSize(); err != memdb.ErrDbClosed {
+		t.Errorf("UtxoSetSize: unexpected error %v", err)
+	}
+
 	if _, _, err := db.NewestSha(); err != memdb.ErrDbClosed {
 		t.Errorf("NewestSha: unexpected error %v", err)
 	}
@@ -103,3 +112,33 @@ func TestClosed(t *testing.T) {
 	db.Sync()
 	db.RollbackClose()
 }
+
+// TestAlias ensures the driver is found by its old "memdb" type while it is
+// only listed once by btcdb.SupportedDBs.
+func TestAlias(t *testing.T) {
+	db, err := btcdb.CreateDB("memdb")
+	if err != nil {
+		t.Errorf("CreateDB: %v", err)
+		return
+	}
+	db.Close()
+	db, err = btcdb.OpenDB("memdb")
+	if err != nil {
+		t.Errorf("OpenDB: %v", err)
+		return
+	}
+	db.Close()
+
+	var listed int
+	for _, dbType := range btcdb.SupportedDBs() {
+		switch dbType {
+		case "memdb":
+			t.Errorf("SupportedDBs: alias memdb is listed")
+		case "memory":
+			listed++
+		}
+	}
+	if listed != 1 {
+		t.Errorf("SupportedDBs: memory listed %d times, want 1", listed)
+	}
+}
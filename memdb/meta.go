@@ -0,0 +1,220 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package memdb
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// putMeta applies the passed changes to the metadata namespace.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) putMeta(meta *btcdb.MetaBatch) {
+	for _, op := range meta.Ops() {
+		if op.Delete {
+			delete(db.meta, string(op.Key))
+		} else {
+			db.meta[string(op.Key)] = op.Value
+		}
+	}
+}
+
+// InsertBlocksWithMeta inserts a run of blocks in order and then applies the
+// passed changes to the metadata namespace.  This is part of the btcdb.Db
+// interface implementation.
+func (db *MemDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+	db.Lock()
+	op.Locked()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+
+	return db.insertBlocks(blocks, meta)
+}
+
+// DropAfterBlockByShaWithMeta removes any blocks from the database after the
+// given block and then applies the passed changes to the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *MemDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
+	db.Lock()
+	op.Locked()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	height, exists := db.blocksBySha[*sha]
+	if !exists {
+		return btcdb.ErrBlockNotFound
+	}
+	return db.dropAfterHeightWithMeta(height, meta)
+}
+
+// ReorganizeWithMeta removes any blocks from the database after the given
+// block, inserts the passed run of blocks after it and then applies the passed
+// changes to the metadata namespace.  When any of the blocks fails to insert,
+// the removed blocks are inserted again.  This is part of the btcdb.Db
+// interface implementation.
+func (db *MemDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricReorganize, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricReorganize, len(blocks))
+	db.Lock()
+	op.Locked()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+
+	height, exists := db.blocksBySha[*sha]
+	if !exists {
+		return nil, btcdb.ErrBlockNotFound
+	}
+	removed := make([]*btcutil.Block, 0, int64(len(db.blocks))-height-1)
+	for _, msgBlock := range db.blocks[height+1:] {
+		removed = append(removed, btcutil.NewBlock(msgBlock))
+	}
+	if err := db.dropAfterHeightWithMeta(height, nil); err != nil {
+		return nil, err
+	}
+	heights, err := db.insertBlocks(blocks, meta)
+	if err != nil {
+		if _, rerr := db.insertBlocks(removed, nil); rerr != nil {
+			log.Warnf("Unable to restore the blocks removed by a "+
+				"failed reorganization: %v", rerr)
+		}
+		return nil, err
+	}
+	return heights, nil
+}
+
+// GetMeta returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.  This is part of the
+// btcdb.Db interface implementation.
+func (db *MemDb) GetMeta(key []byte) ([]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	return db.getMeta(key)
+}
+
+// getMeta returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.
+//
+// This function must be called with the db lock held.
+func (db *MemDb) getMeta(key []byte) ([]byte, error) {
+	value, exists := db.meta[string(key)]
+	if !exists {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+// PutMeta stores the value under the given key in the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *MemDb) PutMeta(key, value []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Put(key, value)
+	return db.WriteMeta(&meta)
+}
+
+// DeleteMeta removes the given key from the metadata namespace.  This is part
+// of the btcdb.Db interface implementation.
+func (db *MemDb) DeleteMeta(key []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Delete(key)
+	return db.WriteMeta(&meta)
+}
+
+// WriteMeta applies the passed changes to the metadata namespace.  This is
+// part of the btcdb.Db interface implementation.
+func (db *MemDb) WriteMeta(meta *btcdb.MetaBatch) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+
+	db.putMeta(meta)
+	return nil
+}
+
+// MetaIterator returns an iterator over the keys of the metadata namespace
+// which begin with the given prefix.  This is part of the btcdb.Db interface
+// implementation.
+func (db *MemDb) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewMetaIterator(keys, values), nil
+}
+
+// ReverseMetaIterator returns an iterator over the keys of the metadata
+// namespace which begin with the given prefix in descending order.  This is
+// part of the btcdb.Db interface implementation.
+func (db *MemDb) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewReverseMetaIterator(keys, values), nil
+}
+
+// metaEntries returns copies of the keys of the metadata namespace which begin
+// with the given prefix and their values, in no particular order.
+func (db *MemDb) metaEntries(prefix []byte) ([][]byte, [][]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, nil, ErrDbClosed
+	}
+
+	var keys, values [][]byte
+	for key, value := range db.meta {
+		if !bytes.HasPrefix([]byte(key), prefix) {
+			continue
+		}
+		keys = append(keys, []byte(key))
+		values = append(values, append([]byte{}, value...))
+	}
+	return keys, values, nil
+}
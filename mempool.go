@@ -0,0 +1,348 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+	"time"
+)
+
+// MempoolPrefix is the prefix of the keys of the metadata namespace under which
+// a MempoolStore keeps the unconfirmed transactions.
+var MempoolPrefix = []byte("btcdb/mempool/")
+
+var (
+	// mempoolTipKey is the key of the hash and height of the newest block
+	// the stored transactions were checked against.
+	mempoolTipKey = []byte("btcdb/mempool/tip")
+
+	// mempoolTxPrefix is the prefix of the keys of the transactions, which
+	// are followed by the hash of the transaction.  Each holds the time
+	// the transaction was added as a little endian number of seconds since
+	// the epoch followed by the serialized transaction.
+	mempoolTxPrefix = []byte("btcdb/mempool/tx/")
+)
+
+// mempoolTxKey returns the key of the unconfirmed transaction with the passed
+// hash.
+func mempoolTxKey(sha *btcwire.ShaHash) []byte {
+	key := make([]byte, len(mempoolTxPrefix)+btcwire.HashSize)
+	copy(key, mempoolTxPrefix)
+	copy(key[len(mempoolTxPrefix):], sha.Bytes())
+	return key
+}
+
+// MempoolTx is an unconfirmed transaction kept by a MempoolStore along with the
+// time it was added.
+type MempoolTx struct {
+	Tx    *btcutil.Tx
+	Added time.Time
+}
+
+// serializeMempoolTx returns the stored form of the passed transaction added at
+// the passed time.
+func serializeMempoolTx(tx *btcwire.MsgTx, added time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(added.Unix()))
+	buf.Write(ts[:])
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deserializeMempoolTx returns the transaction stored in the passed value.
+func deserializeMempoolTx(val []byte) (*MempoolTx, error) {
+	if len(val) < 8 {
+		return nil, fmt.Errorf("malformed mempool transaction %x", val)
+	}
+	added := time.Unix(int64(binary.LittleEndian.Uint64(val)), 0)
+	tx, err := btcutil.NewTxFromBytes(val[8:])
+	if err != nil {
+		return nil, err
+	}
+	return &MempoolTx{Tx: tx, Added: added}, nil
+}
+
+// mempoolEntry is what a MempoolStore keeps in memory about a transaction to
+// find the transactions a block confirms or conflicts with.
+type mempoolEntry struct {
+	inputs  []btcwire.OutPoint
+	outputs uint32
+}
+
+// MempoolStore is an optional indexer which persists the unconfirmed
+// transactions of a node in the metadata namespace, so the node reloads its
+// mempool after a restart from the same database as its chain.  Every block
+// inserted removes the transactions it confirms along with the ones spending
+// the same outputs and the ones spending their outputs in turn, and every
+// block dropped returns its transactions but the coinbase to the store, in
+// the same change as the block.  The transactions stored are not validated,
+// so the node checks them as it loads them.
+//
+// The outputs spent by the stored transactions are kept in memory to find the
+// transactions conflicting with each block inserted.
+type MempoolStore struct {
+	mtx     sync.Mutex
+	db      Db
+	entries map[btcwire.ShaHash]*mempoolEntry
+	spends  map[btcwire.OutPoint]btcwire.ShaHash
+}
+
+// Ensure MempoolStore implements the Indexer interface.
+var _ Indexer = (*MempoolStore)(nil)
+
+// NewMempoolStore returns a mempool store which starts keeping transactions
+// once it is added to a database with AddIndexer.
+func NewMempoolStore() *MempoolStore {
+	return new(MempoolStore)
+}
+
+// add records the passed transaction in memory.  It must be called with the
+// lock held.
+func (m *MempoolStore) add(tx *btcutil.Tx) {
+	msgTx := tx.MsgTx()
+	entry := &mempoolEntry{outputs: uint32(len(msgTx.TxOut))}
+	for _, txIn := range msgTx.TxIn {
+		entry.inputs = append(entry.inputs, txIn.PreviousOutpoint)
+		m.spends[txIn.PreviousOutpoint] = *tx.Sha()
+	}
+	m.entries[*tx.Sha()] = entry
+}
+
+// remove removes the transaction with the passed hash from memory and adds
+// removing it from the metadata namespace to the passed batch, along with the
+// transactions spending its outputs when descendants is set.  It must be
+// called with the lock held.
+func (m *MempoolStore) remove(sha btcwire.ShaHash, descendants bool, meta *MetaBatch) {
+	entry, ok := m.entries[sha]
+	if !ok {
+		return
+	}
+	delete(m.entries, sha)
+	for _, op := range entry.inputs {
+		if spender, ok := m.spends[op]; ok && spender == sha {
+			delete(m.spends, op)
+		}
+	}
+	meta.Delete(mempoolTxKey(&sha))
+
+	if !descendants {
+		return
+	}
+	for i := uint32(0); i < entry.outputs; i++ {
+		spender, ok := m.spends[*btcwire.NewOutPoint(&sha, i)]
+		if ok {
+			m.remove(spender, true, meta)
+		}
+	}
+}
+
+// Init loads the outputs spent by the stored transactions from the passed
+// database.  The store starts out empty and checked against the newest block
+// when it was last checked against a block which is no longer in the chain.
+// This is part of the Indexer interface implementation.
+func (m *MempoolStore) Init(db Db) error {
+	tipHeight, err := initIndexerState(db, "Mempool store", MempoolPrefix,
+		mempoolTipKey)
+	if err != nil {
+		return err
+	}
+
+	// An empty store has nothing to remove from the blocks already in the
+	// chain, so it does not catch up with them.
+	if tipHeight == -1 {
+		sha, height, err := db.NewestSha()
+		if err != nil {
+			return err
+		}
+		var meta MetaBatch
+		putTipRecord(&meta, mempoolTipKey, sha, height)
+		if err := db.WriteMeta(&meta); err != nil {
+			return err
+		}
+	}
+
+	var txs []*btcutil.Tx
+	err = ForEachMempoolTx(db, func(tx *MempoolTx) error {
+		txs = append(txs, tx.Tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	m.db = db
+	m.entries = make(map[btcwire.ShaHash]*mempoolEntry)
+	m.spends = make(map[btcwire.OutPoint]btcwire.ShaHash)
+	for _, tx := range txs {
+		m.add(tx)
+	}
+	m.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block the stored transactions were checked against as
+// of the committed state of the metadata namespace.  This is part of the
+// Indexer interface implementation.
+func (m *MempoolStore) Tip() (*btcwire.ShaHash, int64, error) {
+	m.mtx.Lock()
+	db := m.db
+	m.mtx.Unlock()
+
+	return fetchTipRecord(db, mempoolTipKey)
+}
+
+// ConnectBlock removes the transactions confirmed by the passed block, the
+// ones spending the same outputs as its transactions and their descendants.
+// This is part of the Indexer interface implementation.
+func (m *MempoolStore) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, tx := range block.Transactions() {
+		// The transactions spending the outputs of a confirmed
+		// transaction stay, since those outputs now exist.
+		m.remove(*tx.Sha(), false, meta)
+		for _, txIn := range tx.MsgTx().TxIn {
+			spender, ok := m.spends[txIn.PreviousOutpoint]
+			if ok && spender != *tx.Sha() {
+				m.remove(spender, true, meta)
+			}
+		}
+	}
+	putTipRecord(meta, mempoolTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock returns the transactions of the passed block but its
+// coinbase to the store.  This is part of the Indexer interface
+// implementation.
+func (m *MempoolStore) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	now := time.Now()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, tx := range block.Transactions()[1:] {
+		val, err := serializeMempoolTx(tx.MsgTx(), now)
+		if err != nil {
+			return err
+		}
+		meta.Put(mempoolTxKey(tx.Sha()), val)
+		m.add(tx)
+	}
+	putTipRecord(meta, mempoolTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// storeDb returns the database the store was added to.
+func (m *MempoolStore) storeDb() (Db, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.db == nil {
+		return nil, ErrNoMempoolStore
+	}
+	return m.db, nil
+}
+
+// PutMempoolTx stores the passed unconfirmed transaction along with the time it
+// was added to the mempool, replacing the transaction with the same hash.
+func (m *MempoolStore) PutMempoolTx(tx *btcutil.Tx, added time.Time) error {
+	db, err := m.storeDb()
+	if err != nil {
+		return err
+	}
+	val, err := serializeMempoolTx(tx.MsgTx(), added)
+	if err != nil {
+		return err
+	}
+
+	// The lock may not be held while writing, since inserting blocks
+	// takes it with the database locked.  A block confirming the
+	// transaction while it is written may leave it stored, which the node
+	// finds when it checks the transactions it loads.
+	var meta MetaBatch
+	meta.Put(mempoolTxKey(tx.Sha()), val)
+	if err := db.WriteMeta(&meta); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	m.add(tx)
+	m.mtx.Unlock()
+	return nil
+}
+
+// RemoveMempoolTx removes the unconfirmed transaction with the passed hash from
+// the store, such as when it is evicted from the mempool.  The transactions
+// spending its outputs are left alone.
+func (m *MempoolStore) RemoveMempoolTx(sha *btcwire.ShaHash) error {
+	db, err := m.storeDb()
+	if err != nil {
+		return err
+	}
+
+	var meta MetaBatch
+	meta.Delete(mempoolTxKey(sha))
+	if err := db.WriteMeta(&meta); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	m.remove(*sha, false, new(MetaBatch))
+	m.mtx.Unlock()
+	return nil
+}
+
+// FetchMempoolTx returns the unconfirmed transaction with the passed hash kept
+// by the MempoolStore of the passed database.  ErrTxNotFound is returned when
+// the store does not hold the transaction.
+func FetchMempoolTx(db Db, sha *btcwire.ShaHash) (*MempoolTx, error) {
+	val, err := db.GetMeta(mempoolTxKey(sha))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrTxNotFound
+	}
+	return deserializeMempoolTx(val)
+}
+
+// ForEachMempoolTx calls the passed function with every unconfirmed
+// transaction kept by the MempoolStore of the passed database, ordered by
+// hash, and stops with the first error it returns.
+func ForEachMempoolTx(db Db, fn func(tx *MempoolTx) error) error {
+	iter, err := db.MetaIterator(mempoolTxPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		tx, err := deserializeMempoolTx(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
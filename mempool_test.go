@@ -0,0 +1,145 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestMempoolStore ensures the mempool store keeps the unconfirmed transactions
+// put into it, removes the ones each block inserted confirms or conflicts with
+// and returns the transactions of the blocks dropped for all supported database
+// types.
+func TestMempoolStore(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// spend is the transaction of block 170 spending the coinbase of block
+	// 9, conflict spends the same coinbase and child spends conflict, so
+	// both are removed once block 170 is inserted.  change spends the
+	// change of spend, which stays, as does unrelated.
+	spend := blocks[170].Transactions()[1]
+	newTx := func(prevOut *btcwire.OutPoint, value int64) *btcutil.Tx {
+		tx := btcwire.NewMsgTx()
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{0x51}))
+		tx.AddTxOut(btcwire.NewTxOut(value, []byte{0x51}))
+		return btcutil.NewTx(tx)
+	}
+	conflict := newTx(&spend.MsgTx().TxIn[0].PreviousOutpoint, 50e8)
+	child := newTx(btcwire.NewOutPoint(conflict.Sha(), 0), 49e8)
+	change := newTx(btcwire.NewOutPoint(spend.Sha(), 1), 39e8)
+	unrelated := newTx(btcwire.NewOutPoint(&btcwire.ShaHash{0x01}, 0), 1e8)
+	added := time.Unix(1400000000, 0)
+
+	// checkTxs ensures the store holds exactly the passed transactions.
+	checkTxs := func(dbType string, db btcdb.Db, want ...*btcutil.Tx) {
+		wantShas := make(map[btcwire.ShaHash]bool)
+		for _, tx := range want {
+			wantShas[*tx.Sha()] = true
+		}
+		gotShas := make(map[btcwire.ShaHash]bool)
+		err := btcdb.ForEachMempoolTx(db, func(tx *btcdb.MempoolTx) error {
+			gotShas[*tx.Tx.Sha()] = true
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(gotShas, wantShas) {
+			t.Errorf("ForEachMempoolTx (%s): got %v (err %v), want %v",
+				dbType, gotShas, err, wantShas)
+		}
+		for _, tx := range want {
+			got, err := btcdb.FetchMempoolTx(db, tx.Sha())
+			if err != nil {
+				t.Errorf("FetchMempoolTx (%s): %v", dbType, err)
+				continue
+			}
+			if !reflect.DeepEqual(got.Tx.MsgTx(), tx.MsgTx()) {
+				t.Errorf("FetchMempoolTx (%s): wrong transaction "+
+					"for %v", dbType, tx.Sha())
+			}
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "mempool", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:170]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		store := btcdb.NewMempoolStore()
+		if err := store.PutMempoolTx(spend, added); err != btcdb.ErrNoMempoolStore {
+			t.Errorf("PutMempoolTx (%s): got %v before AddIndexer, "+
+				"want %v", dbType, err, btcdb.ErrNoMempoolStore)
+		}
+		if err := db.AddIndexer(store); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		_, tipHeight, err := store.Tip()
+		if err != nil || tipHeight != 169 {
+			t.Errorf("Tip (%s): got height %d (err %v), want 169",
+				dbType, tipHeight, err)
+		}
+		for _, tx := range []*btcutil.Tx{spend, conflict, child, change, unrelated} {
+			if err := store.PutMempoolTx(tx, added); err != nil {
+				t.Errorf("PutMempoolTx (%s): %v", dbType, err)
+			}
+		}
+		checkTxs(dbType, db, spend, conflict, child, change, unrelated)
+		got, err := btcdb.FetchMempoolTx(db, spend.Sha())
+		if err != nil || !got.Added.Equal(added) {
+			t.Errorf("FetchMempoolTx (%s): got added %v (err %v), "+
+				"want %v", dbType, got, err, added)
+		}
+
+		if _, err := db.InsertBlocks(blocks[170:171]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkTxs(dbType, db, change, unrelated)
+		if _, err := btcdb.FetchMempoolTx(db, spend.Sha()); err != btcdb.ErrTxNotFound {
+			t.Errorf("FetchMempoolTx (%s): got %v for a confirmed "+
+				"transaction, want %v", dbType, err,
+				btcdb.ErrTxNotFound)
+		}
+
+		keepSha, _ := blocks[169].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkTxs(dbType, db, spend, change, unrelated)
+
+		if err := store.RemoveMempoolTx(unrelated.Sha()); err != nil {
+			t.Errorf("RemoveMempoolTx (%s): %v", dbType, err)
+		}
+		checkTxs(dbType, db, spend, change)
+
+		// The transaction returned by the dropped block is removed again
+		// once the block is inserted again, and change conflicts with
+		// the transaction of block 181 spending the same output.
+		if _, err := db.InsertBlocks(blocks[170:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkTxs(dbType, db)
+		teardown()
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// MetaOp is a single change to the metadata namespace held by a MetaBatch.
+type MetaOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// MetaView returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.  Drivers pass one to their
+// indexers which reads the namespace as of the changes being committed, since
+// indexers may not call the functions of the database then.
+type MetaView func(key []byte) ([]byte, error)
+
+// MetaBatch collects changes to the metadata namespace so they are committed
+// together, either on their own through WriteMeta or along with blocks through
+// InsertBlocksWithMeta and DropAfterBlockByShaWithMeta.  Changes are applied in
+// the order they were added, so a later change to a key wins.  The zero value
+// is an empty batch ready for use.
+type MetaBatch struct {
+	ops    []MetaOp
+	view   MetaView
+	staged map[string]int
+}
+
+// newMetaBatchView returns an empty batch whose Get reads the keys it does not
+// change through the passed view.
+func newMetaBatchView(view MetaView) *MetaBatch {
+	return &MetaBatch{view: view, staged: make(map[string]int)}
+}
+
+// Put adds setting the given key to the given value to the batch.  The key and
+// value are copied, so the caller is free to reuse them.
+func (b *MetaBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, MetaOp{
+		Key:   append([]byte(nil), key...),
+		Value: append([]byte{}, value...),
+	})
+	if b.staged != nil {
+		b.staged[string(key)] = len(b.ops) - 1
+	}
+}
+
+// Delete adds removing the given key to the batch.  Removing a key which does
+// not exist is not an error.
+func (b *MetaBatch) Delete(key []byte) {
+	b.ops = append(b.ops, MetaOp{
+		Key:    append([]byte(nil), key...),
+		Delete: true,
+	})
+	if b.staged != nil {
+		b.staged[string(key)] = len(b.ops) - 1
+	}
+}
+
+// Get returns the value the given key has once the batch is applied, or nil
+// when it does not exist then.  Keys the batch does not change are read from
+// the metadata namespace, which is only possible for the batches handed to
+// indexers, so ErrMetaNotReadable is returned for any other batch.
+func (b *MetaBatch) Get(key []byte) ([]byte, error) {
+	if i, ok := b.staged[string(key)]; ok {
+		if b.ops[i].Delete {
+			return nil, nil
+		}
+		return append([]byte{}, b.ops[i].Value...), nil
+	}
+	if b.view == nil {
+		return nil, ErrMetaNotReadable
+	}
+	return b.view(key)
+}
+
+// Len returns the number of changes in the batch.
+func (b *MetaBatch) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.ops)
+}
+
+// Reset removes all changes from the batch.
+func (b *MetaBatch) Reset() {
+	b.ops = b.ops[:0]
+	if b.staged != nil {
+		b.staged = make(map[string]int)
+	}
+}
+
+// Ops returns the changes in the batch in the order they were added.  It is
+// intended for use by drivers.
+func (b *MetaBatch) Ops() []MetaOp {
+	if b == nil {
+		return nil
+	}
+	return b.ops
+}
+
+// Validate returns ErrEmptyMetaKey when any change in the batch has an empty
+// key.  It is intended for use by drivers before the batch is applied.
+func (b *MetaBatch) Validate() error {
+	for _, op := range b.Ops() {
+		if len(op.Key) == 0 {
+			return ErrEmptyMetaKey
+		}
+	}
+	return nil
+}
+
+// MetaIterator walks the keys of the metadata namespace which share a prefix
+// in ascending byte order, or descending for those returned by
+// ReverseMetaIterator.  It starts out positioned before its first key, so Next
+// must be called before the first key can be accessed.
+type MetaIterator interface {
+	// Next moves to the next key and returns whether there is one.
+	Next() bool
+
+	// Key returns the current key.
+	Key() []byte
+
+	// Value returns the value of the current key.
+	Value() []byte
+
+	// Err returns the error which stopped the iteration, if any.
+	Err() error
+
+	// Release frees the resources held by the iterator.
+	Release()
+}
+
+// metaIterator implements MetaIterator over entries which were read from the
+// database up front.
+type metaIterator struct {
+	keys    [][]byte
+	values  [][]byte
+	pos     int
+	reverse bool
+}
+
+// NewMetaIterator returns a MetaIterator over the passed keys and their
+// values, which are sorted by key first.  Drivers read all keys matching the
+// prefix in a single consistent read since the metadata namespace is expected
+// to be small.  It is intended for use by drivers.
+func NewMetaIterator(keys, values [][]byte) MetaIterator {
+	it := &metaIterator{keys: keys, values: values, pos: -1}
+	sort.Sort(it)
+	return it
+}
+
+// NewReverseMetaIterator returns a MetaIterator over the passed keys and their
+// values in descending order of the keys, the same as NewMetaIterator
+// otherwise.  It is intended for use by drivers.
+func NewReverseMetaIterator(keys, values [][]byte) MetaIterator {
+	it := &metaIterator{keys: keys, values: values, pos: -1, reverse: true}
+	sort.Sort(it)
+	return it
+}
+
+// Len, Less and Swap implement sort.Interface to order the entries by key.
+func (it *metaIterator) Len() int { return len(it.keys) }
+func (it *metaIterator) Less(i, j int) bool {
+	cmp := bytes.Compare(it.keys[i], it.keys[j])
+	if it.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+func (it *metaIterator) Swap(i, j int) {
+	it.keys[i], it.keys[j] = it.keys[j], it.keys[i]
+	it.values[i], it.values[j] = it.values[j], it.values[i]
+}
+
+// Next moves to the next key.  This is part of the MetaIterator interface
+// implementation.
+func (it *metaIterator) Next() bool {
+	if it.pos >= len(it.keys) {
+		return false
+	}
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+// Key returns the current key.  This is part of the MetaIterator interface
+// implementation.
+func (it *metaIterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.keys[it.pos]
+}
+
+// Value returns the value of the current key.  This is part of the
+// MetaIterator interface implementation.
+func (it *metaIterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+// Err returns nil since all entries are read before iterating.  This is part
+// of the MetaIterator interface implementation.
+func (it *metaIterator) Err() error {
+	return nil
+}
+
+// Release frees the entries.  This is part of the MetaIterator interface
+// implementation.
+func (it *metaIterator) Release() {
+	it.keys, it.values = nil, nil
+	it.pos = 0
+}
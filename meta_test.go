@@ -0,0 +1,168 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"reflect"
+	"testing"
+)
+
+// TestMeta ensures the metadata namespace stores, iterates and removes keys for
+// all supported database types and that changes made along with blocks are
+// only applied when the blocks are.
+func TestMeta(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// checkKeys ensures iterating the passed prefix walks the given keys
+	// in order.
+	checkKeys := func(dbType string, db btcdb.Db, prefix string, want ...string) bool {
+		iter, err := db.MetaIterator([]byte(prefix))
+		if err != nil {
+			t.Errorf("MetaIterator (%s): %v", dbType, err)
+			return false
+		}
+		defer iter.Release()
+
+		var got []string
+		for iter.Next() {
+			got = append(got, string(iter.Key()))
+			if !bytes.Equal(iter.Value(), []byte("v-"+string(iter.Key()))) {
+				t.Errorf("MetaIterator (%s): wrong value for %q: %q",
+					dbType, iter.Key(), iter.Value())
+				return false
+			}
+		}
+		if err := iter.Err(); err != nil {
+			t.Errorf("MetaIterator (%s): %v", dbType, err)
+			return false
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("MetaIterator (%s): prefix %q: got %q, want %q",
+				dbType, prefix, got, want)
+			return false
+		}
+		return true
+	}
+
+	// checkTip ensures the tip recorded in the metadata namespace is the
+	// hash of the passed block.
+	checkTip := func(dbType string, db btcdb.Db, block *btcutil.Block) bool {
+		want, _ := block.Sha()
+		got, err := db.GetMeta([]byte("idx/tip"))
+		if err != nil || !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("GetMeta (%s): tip got %x %v, want %v", dbType,
+				got, err, want)
+			return false
+		}
+		return true
+	}
+
+	half := len(blocks) / 2
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "meta", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		for _, key := range []string{"wallet/b", "idx/x", "wallet/a",
+			"walletz"} {
+			err := db.PutMeta([]byte(key), []byte("v-"+key))
+			if err != nil {
+				t.Errorf("PutMeta (%s): %v", dbType, err)
+			}
+		}
+		if value, err := db.GetMeta([]byte("missing")); value != nil || err != nil {
+			t.Errorf("GetMeta (%s): missing key got %q %v, want nil",
+				dbType, value, err)
+		}
+		if err := db.PutMeta(nil, []byte("v")); err != btcdb.ErrEmptyMetaKey {
+			t.Errorf("PutMeta (%s): empty key got %v, want %v", dbType,
+				err, btcdb.ErrEmptyMetaKey)
+		}
+		if !checkKeys(dbType, db, "wallet/", "wallet/a", "wallet/b") ||
+			!checkKeys(dbType, db, "", "idx/x", "wallet/a",
+				"wallet/b", "walletz") {
+			teardown()
+			continue
+		}
+
+		// A snapshot keeps seeing the keys as they were.
+		snap, err := db.Snapshot()
+		if err != nil {
+			t.Errorf("Snapshot (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if err := db.DeleteMeta([]byte("wallet/a")); err != nil {
+			t.Errorf("DeleteMeta (%s): %v", dbType, err)
+		}
+		value, err := snap.GetMeta([]byte("wallet/a"))
+		if err != nil || string(value) != "v-wallet/a" {
+			t.Errorf("GetMeta (%s): snapshot got %q %v, want %q",
+				dbType, value, err, "v-wallet/a")
+		}
+		snap.Release()
+		if value, err := db.GetMeta([]byte("wallet/a")); value != nil || err != nil {
+			t.Errorf("GetMeta (%s): deleted key got %q %v, want nil",
+				dbType, value, err)
+		}
+		checkKeys(dbType, db, "wallet/", "wallet/b")
+
+		// Changes made along with blocks are applied with them.
+		var meta btcdb.MetaBatch
+		tipSha, _ := blocks[half-1].Sha()
+		meta.Put([]byte("idx/tip"), tipSha.Bytes())
+		meta.Delete([]byte("idx/x"))
+		if _, err := db.InsertBlocksWithMeta(blocks[:half], &meta); err != nil {
+			t.Errorf("InsertBlocksWithMeta (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if !checkTip(dbType, db, blocks[half-1]) {
+			teardown()
+			continue
+		}
+		if value, _ := db.GetMeta([]byte("idx/x")); value != nil {
+			t.Errorf("GetMeta (%s): key deleted with blocks got %q",
+				dbType, value)
+		}
+
+		// Blocks which fail to insert leave the metadata untouched.
+		meta.Reset()
+		meta.Put([]byte("idx/tip"), []byte("bogus"))
+		if _, err := db.InsertBlocksWithMeta(blocks[half+1:], &meta); err == nil {
+			t.Errorf("InsertBlocksWithMeta (%s): unexpected success "+
+				"for unconnected blocks", dbType)
+		}
+		if !checkTip(dbType, db, blocks[half-1]) {
+			teardown()
+			continue
+		}
+
+		keepSha, _ := blocks[half-2].Sha()
+		meta.Reset()
+		meta.Put([]byte("idx/tip"), keepSha.Bytes())
+		if err := db.DropAfterBlockByShaWithMeta(keepSha, &meta); err != nil {
+			t.Errorf("DropAfterBlockByShaWithMeta (%s): %v", dbType,
+				err)
+			teardown()
+			continue
+		}
+		checkTip(dbType, db, blocks[half-2])
+		teardown()
+	}
+}
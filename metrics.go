@@ -0,0 +1,249 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+	"time"
+)
+
+// The operations measured by drivers and passed to Metrics.
+const (
+	// MetricInsertBlocks covers InsertBlock, InsertBlocks and
+	// InsertBlocksWithMeta.  The batch size is the number of blocks.
+	MetricInsertBlocks = "insertblocks"
+
+	// MetricDropBlocks covers DropAfterBlockBySha and
+	// DropAfterBlockByShaWithMeta.
+	MetricDropBlocks = "dropblocks"
+
+	// MetricReorganize covers ReorganizeWithMeta.  The batch size is the
+	// number of blocks connected.
+	MetricReorganize = "reorganize"
+
+	// MetricFetchBlock covers FetchBlockBySha and FetchBlockBytesBySha.
+	MetricFetchBlock = "fetchblock"
+
+	// MetricFetchHeader covers FetchBlockHeaderBySha and
+	// FetchBlockHeaderByHeight.
+	MetricFetchHeader = "fetchheader"
+
+	// MetricFetchTx covers FetchTxBySha.
+	MetricFetchTx = "fetchtx"
+)
+
+// Metrics receives measurements of the operations of a database so they can be
+// exported to a monitoring system.  It is set through the Metrics field of
+// Options.  The functions are called by every goroutine using the database and
+// must be safe for concurrent use and return quickly.
+type Metrics interface {
+	// ObserveLatency records the time taken by an operation, including
+	// the time spent waiting for the database lock.
+	ObserveLatency(op string, d time.Duration)
+
+	// ObserveLockWait records the time an operation waited for the lock
+	// which serializes it with changes to the database.
+	ObserveLockWait(op string, d time.Duration)
+
+	// ObserveBatchSize records the number of items handled by a single
+	// operation.
+	ObserveBatchSize(op string, n int)
+
+	// SetGauge records the current value of a statistic kept by the
+	// driver, such as the amount of compaction leveldb has performed.
+	// The names begin with the name of the storage engine.
+	SetGauge(name string, value int64)
+}
+
+// discardMetrics is a Metrics which drops every measurement.
+type discardMetrics struct{}
+
+func (discardMetrics) ObserveLatency(string, time.Duration)  {}
+func (discardMetrics) ObserveLockWait(string, time.Duration) {}
+func (discardMetrics) ObserveBatchSize(string, int)          {}
+func (discardMetrics) SetGauge(string, int64)                {}
+
+// DiscardMetrics drops every measurement.  Drivers use it when Options does not
+// give a Metrics, so they never need to check for nil.
+var DiscardMetrics Metrics = discardMetrics{}
+
+// slowOpMetrics is a Metrics which passes every measurement on to another and
+// has the operations taking at least the threshold logged by their OpTimer.
+type slowOpMetrics struct {
+	Metrics
+	threshold time.Duration
+}
+
+// DriverMetrics returns the Metrics a driver measures its operations with for
+// the passed options.  It is the Metrics of the options, or DiscardMetrics
+// when it is nil, which logs the operations taking at least the SlowOpThreshold
+// of the options when it is set.
+func DriverMetrics(opts *Options) Metrics {
+	m := opts.Metrics
+	if m == nil {
+		m = DiscardMetrics
+	}
+	if opts.SlowOpThreshold > 0 {
+		m = &slowOpMetrics{Metrics: m, threshold: opts.SlowOpThreshold}
+	}
+	return m
+}
+
+// OpTimer measures a single operation for drivers.  It is created with
+// StartOp before the operation takes the database lock.
+type OpTimer struct {
+	m      Metrics
+	op     string
+	key    interface{}
+	start  time.Time
+	wait   time.Duration
+	locked bool
+}
+
+// StartOp returns a timer of the named operation which starts now.  The key
+// is the hash, height, block or blocks the operation is given, which is logged
+// when the operation is slow.
+func StartOp(m Metrics, op string, key interface{}) *OpTimer {
+	return &OpTimer{m: m, op: op, key: key, start: time.Now()}
+}
+
+// Locked records the time waited for the database lock, which must have just
+// been acquired.
+func (t *OpTimer) Locked() {
+	t.wait = time.Since(t.start)
+	t.locked = true
+	t.m.ObserveLockWait(t.op, t.wait)
+}
+
+// Done records the time taken by the operation.  It is meant to be deferred.
+// Operations taking at least the SlowOpThreshold of the options of the
+// database are logged along with the part of the time spent waiting for the
+// lock.
+func (t *OpTimer) Done() {
+	d := time.Since(t.start)
+	t.m.ObserveLatency(t.op, d)
+
+	slow, ok := t.m.(*slowOpMetrics)
+	if !ok || d < slow.threshold {
+		return
+	}
+	if !t.locked {
+		log.Warnf("Slow %s of %s took %v in the database", t.op,
+			opKeyString(t.key), d)
+		return
+	}
+	log.Warnf("Slow %s of %s took %v: %v waiting for the lock, %v in the "+
+		"database", t.op, opKeyString(t.key), d, t.wait, d-t.wait)
+}
+
+// opKeyString returns the description of the key of an operation used in the
+// logs of slow operations.
+func opKeyString(key interface{}) string {
+	switch k := key.(type) {
+	case *btcutil.Block:
+		sha, _ := k.Sha()
+		return fmt.Sprintf("block %v", sha)
+	case []*btcutil.Block:
+		if len(k) == 0 {
+			return "no blocks"
+		}
+		sha, _ := k[0].Sha()
+		return fmt.Sprintf("%d blocks from %v", len(k), sha)
+	case *btcwire.ShaHash:
+		return k.String()
+	case int64:
+		return fmt.Sprintf("height %d", k)
+	}
+	return fmt.Sprint(key)
+}
+
+// latencyBuckets are the upper bounds of the latency histograms kept by
+// ExpvarMetrics.
+var latencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// batchBuckets are the upper bounds of the batch size histograms kept by
+// ExpvarMetrics.
+var batchBuckets = []int{1, 10, 100, 1000}
+
+// ExpvarMetrics is a Metrics which publishes the measurements through the
+// expvar package as a map of the given name, and so on the /debug/vars page of
+// the default HTTP server.  For every operation the map holds the number of
+// measurements, the total time and a cumulative histogram keyed by the upper
+// bound of each bucket, such as "fetchblock.latency.le.1ms", along with the
+// same for the lock wait time and batch sizes.  Gauges are held under their
+// names.
+type ExpvarMetrics struct {
+	mtx  sync.Mutex
+	vars *expvar.Map
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics published under the given name,
+// which must not be published yet.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{vars: expvar.NewMap(name)}
+}
+
+// observeDuration adds a measurement of the given kind to the histogram of the
+// operation.
+func (m *ExpvarMetrics) observeDuration(op, kind string, d time.Duration) {
+	prefix := op + "." + kind
+	m.vars.Add(prefix+".count", 1)
+	m.vars.Add(prefix+".total_ns", int64(d))
+	for _, bound := range latencyBuckets {
+		if d <= bound {
+			m.vars.Add(fmt.Sprintf("%s.le.%v", prefix, bound), 1)
+		}
+	}
+}
+
+// ObserveLatency records the time taken by an operation.  This is part of the
+// Metrics interface implementation.
+func (m *ExpvarMetrics) ObserveLatency(op string, d time.Duration) {
+	m.observeDuration(op, "latency", d)
+}
+
+// ObserveLockWait records the time an operation waited for the database lock.
+// This is part of the Metrics interface implementation.
+func (m *ExpvarMetrics) ObserveLockWait(op string, d time.Duration) {
+	m.observeDuration(op, "lockwait", d)
+}
+
+// ObserveBatchSize records the number of items handled by an operation.  This
+// is part of the Metrics interface implementation.
+func (m *ExpvarMetrics) ObserveBatchSize(op string, n int) {
+	prefix := op + ".batch"
+	m.vars.Add(prefix+".count", 1)
+	m.vars.Add(prefix+".total", int64(n))
+	for _, bound := range batchBuckets {
+		if n <= bound {
+			m.vars.Add(fmt.Sprintf("%s.le.%d", prefix, bound), 1)
+		}
+	}
+}
+
+// SetGauge records the current value of a statistic kept by the driver.  This
+// is part of the Metrics interface implementation.
+func (m *ExpvarMetrics) SetGauge(name string, value int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	v, ok := m.vars.Get(name).(*expvar.Int)
+	if !ok {
+		v = new(expvar.Int)
+		m.vars.Set(name, v)
+	}
+	v.Set(value)
+}
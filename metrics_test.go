@@ -0,0 +1,163 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"expvar"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics is a btcdb.Metrics which counts the measurements of each
+// kind by operation.
+type recordingMetrics struct {
+	mtx    sync.Mutex
+	counts map[string]int
+	gauges map[string]int64
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{counts: make(map[string]int),
+		gauges: make(map[string]int64)}
+}
+
+func (m *recordingMetrics) add(key string, n int) {
+	m.mtx.Lock()
+	m.counts[key] += n
+	m.mtx.Unlock()
+}
+
+func (m *recordingMetrics) ObserveLatency(op string, d time.Duration) {
+	m.add(op+".latency", 1)
+}
+
+func (m *recordingMetrics) ObserveLockWait(op string, d time.Duration) {
+	m.add(op+".lockwait", 1)
+}
+
+func (m *recordingMetrics) ObserveBatchSize(op string, n int) {
+	m.add(op+".batch", n)
+}
+
+func (m *recordingMetrics) SetGauge(name string, value int64) {
+	m.mtx.Lock()
+	m.gauges[name] = value
+	m.mtx.Unlock()
+}
+
+func (m *recordingMetrics) count(key string) int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.counts[key]
+}
+
+// TestMetrics ensures every driver passes measurements of its operations to
+// the metrics given in the options.
+func TestMetrics(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		m := newRecordingMetrics()
+		opts := btcdb.Options{
+			Path:    filepath.Join(testDbRoot, "metricsdb-"+dbType),
+			Metrics: m,
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+
+		if _, err := db.InsertBlock(blocks[0]); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+		}
+		if _, err := db.InsertBlocks(blocks[1:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		sha, _ := blocks[5].Sha()
+		if _, err := db.FetchBlockBySha(sha); err != nil {
+			t.Errorf("FetchBlockBySha (%s): %v", dbType, err)
+		}
+		if _, err := db.FetchBlockHeaderByHeight(5); err != nil {
+			t.Errorf("FetchBlockHeaderByHeight (%s): %v", dbType, err)
+		}
+		txSha := blocks[5].Transactions()[0].Sha()
+		if _, err := db.FetchTxBySha(txSha); err != nil {
+			t.Errorf("FetchTxBySha (%s): %v", dbType, err)
+		}
+		if err := db.DropAfterBlockBySha(sha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		db.Close()
+
+		want := map[string]int{
+			btcdb.MetricInsertBlocks + ".latency":  2,
+			btcdb.MetricInsertBlocks + ".lockwait": 2,
+			btcdb.MetricInsertBlocks + ".batch":    len(blocks),
+			btcdb.MetricFetchBlock + ".latency":    1,
+			btcdb.MetricFetchHeader + ".latency":   1,
+			btcdb.MetricFetchTx + ".latency":       1,
+			btcdb.MetricDropBlocks + ".latency":    1,
+			btcdb.MetricDropBlocks + ".lockwait":   1,
+		}
+		for key, n := range want {
+			if got := m.count(key); got != n {
+				t.Errorf("Metrics (%s): got %d %s, want %d", dbType,
+					got, key, n)
+			}
+		}
+	}
+
+	// The measurements are published through expvar.
+	em := btcdb.NewExpvarMetrics("btcdbtest")
+	em.ObserveLatency(btcdb.MetricFetchBlock, 5*time.Millisecond)
+	em.ObserveBatchSize(btcdb.MetricInsertBlocks, 50)
+	em.SetGauge("test.gauge", 42)
+	vars := expvar.Get("btcdbtest").(*expvar.Map)
+	wantVars := map[string]string{
+		"fetchblock.latency.count":    "1",
+		"fetchblock.latency.total_ns": "5000000",
+		"fetchblock.latency.le.1ms":   "",
+		"fetchblock.latency.le.10ms":  "1",
+		"insertblocks.batch.total":    "50",
+		"insertblocks.batch.le.10":    "",
+		"insertblocks.batch.le.100":   "1",
+		"test.gauge":                  "42",
+	}
+	for key, want := range wantVars {
+		var got string
+		if v := vars.Get(key); v != nil {
+			got = v.String()
+		}
+		if got != want {
+			t.Errorf("ExpvarMetrics: got %q for %s, want %q", got,
+				key, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package muhash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// chachaBlockSize is the number of bytes of keystream of each ChaCha20 block.
+const chachaBlockSize = 64
+
+// chachaQuarterRound performs a ChaCha quarter round on the passed words.
+func chachaQuarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
+
+// chachaKeystream fills the passed buffer, whose length must be a multiple of
+// chachaBlockSize, with the ChaCha20 keystream of the passed key under the
+// all zero nonce, starting from block zero.
+func chachaKeystream(key *[32]byte, out []byte) {
+	var in [16]uint32
+	in[0], in[1], in[2], in[3] = 0x61707865, 0x3320646e, 0x79622d32,
+		0x6b206574
+	for i := 0; i < 8; i++ {
+		in[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+
+	for ; len(out) >= chachaBlockSize; out = out[chachaBlockSize:] {
+		x := in
+		for round := 0; round < 10; round++ {
+			x[0], x[4], x[8], x[12] = chachaQuarterRound(x[0], x[4], x[8], x[12])
+			x[1], x[5], x[9], x[13] = chachaQuarterRound(x[1], x[5], x[9], x[13])
+			x[2], x[6], x[10], x[14] = chachaQuarterRound(x[2], x[6], x[10], x[14])
+			x[3], x[7], x[11], x[15] = chachaQuarterRound(x[3], x[7], x[11], x[15])
+			x[0], x[5], x[10], x[15] = chachaQuarterRound(x[0], x[5], x[10], x[15])
+			x[1], x[6], x[11], x[12] = chachaQuarterRound(x[1], x[6], x[11], x[12])
+			x[2], x[7], x[8], x[13] = chachaQuarterRound(x[2], x[7], x[8], x[13])
+			x[3], x[4], x[9], x[14] = chachaQuarterRound(x[3], x[4], x[9], x[14])
+		}
+		for i := range x {
+			binary.LittleEndian.PutUint32(out[4*i:], x[i]+in[i])
+		}
+		in[12]++
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package muhash implements MuHash3072, the rolling hash of a set of byte strings
+which Bitcoin Core uses to commit to its unspent transaction output set.
+
+Each item is mapped to a number modulo the prime 2^3072 - 1103717 and the set
+is the product of the numbers of its items, so items are added with Insert and
+taken away with Remove in any order, and the hash depends on nothing but the
+set.  Finalize returns the 32 byte hash of the set:
+
+	h := muhash.New()
+	h.Insert([]byte("a"))
+	h.Insert([]byte("b"))
+	h.Remove([]byte("a"))
+	sum := h.Finalize()
+
+Serialize and Deserialize store the state of a hash so more items are added to
+it later.
+*/
+package muhash
@@ -0,0 +1,14 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package muhash
+
+// ChaChaKeystream returns the first 64 bytes of the ChaCha20 keystream of the
+// passed key under the all zero nonce.
+// This is a testing only interface.
+func ChaChaKeystream(key [32]byte) []byte {
+	out := make([]byte, chachaBlockSize)
+	chachaKeystream(&key, out)
+	return out
+}
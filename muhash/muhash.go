@@ -0,0 +1,143 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package muhash
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// StateSize is the size of the serialized state of a hash.
+const StateSize = 384
+
+// HashSize is the size of the hash returned by Finalize.
+const HashSize = sha256.Size
+
+// ErrInvalidState is returned by Deserialize when the passed buffer is not the
+// state of a hash.
+var ErrInvalidState = errors.New("invalid MuHash3072 state")
+
+// prime is the modulus the numbers of items are multiplied under, which is
+// 2^3072 - 1103717.
+var prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 8*StateSize),
+	big.NewInt(1103717))
+
+// MuHash is the MuHash3072 of a set of byte strings.  Items which are inserted
+// multiply the numerator and items which are removed the denominator, which
+// are only divided when the state is finalized or serialized since division
+// takes far longer than multiplication.  The zero value is not usable, New
+// returns the hash of the empty set.
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+// New returns the hash of the empty set.
+func New() *MuHash {
+	return &MuHash{
+		numerator:   big.NewInt(1),
+		denominator: big.NewInt(1),
+	}
+}
+
+// leToInt returns the number stored little endian in the passed buffer.
+func leToInt(buf []byte) *big.Int {
+	be := make([]byte, len(buf))
+	for i, b := range buf {
+		be[len(buf)-1-i] = b
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// intToLE returns the passed number, which must be less than 2^3072, stored
+// little endian in StateSize bytes.
+func intToLE(n *big.Int) []byte {
+	be := n.Bytes()
+	buf := make([]byte, StateSize)
+	for i, b := range be {
+		buf[len(be)-1-i] = b
+	}
+	return buf
+}
+
+// itemNumber returns the number the passed item is mapped to, which is the
+// ChaCha20 keystream of the SHA256 of the item read as a little endian number.
+func itemNumber(item []byte) *big.Int {
+	key := sha256.Sum256(item)
+	var stream [StateSize]byte
+	chachaKeystream(&key, stream[:])
+	n := leToInt(stream[:])
+	return n.Mod(n, prime)
+}
+
+// Insert adds the passed item to the set.
+func (h *MuHash) Insert(item []byte) {
+	h.numerator.Mul(h.numerator, itemNumber(item))
+	h.numerator.Mod(h.numerator, prime)
+}
+
+// Remove takes the passed item away from the set.  Removing an item which is
+// not in the set gives a hash no set has until it is inserted.
+func (h *MuHash) Remove(item []byte) {
+	h.denominator.Mul(h.denominator, itemNumber(item))
+	h.denominator.Mod(h.denominator, prime)
+}
+
+// Combine adds the items of the passed hash to those of this one, which gives
+// the hash of the union of the sets when they have no items in common.
+func (h *MuHash) Combine(other *MuHash) {
+	h.numerator.Mul(h.numerator, other.numerator)
+	h.numerator.Mod(h.numerator, prime)
+	h.denominator.Mul(h.denominator, other.denominator)
+	h.denominator.Mod(h.denominator, prime)
+}
+
+// Divide takes the items of the passed hash away from those of this one and
+// gives back the items it removed, which undoes combining the hashes.
+func (h *MuHash) Divide(other *MuHash) {
+	h.numerator.Mul(h.numerator, other.denominator)
+	h.numerator.Mod(h.numerator, prime)
+	h.denominator.Mul(h.denominator, other.numerator)
+	h.denominator.Mod(h.denominator, prime)
+}
+
+// normalize divides the numerator by the denominator.
+func (h *MuHash) normalize() {
+	if h.denominator.Cmp(big.NewInt(1)) == 0 {
+		return
+	}
+	inv := new(big.Int).ModInverse(h.denominator, prime)
+	h.numerator.Mul(h.numerator, inv)
+	h.numerator.Mod(h.numerator, prime)
+	h.denominator.SetInt64(1)
+}
+
+// Finalize returns the hash of the set, which is the SHA256 of the product of
+// the numbers of its items stored little endian.  More items may be inserted
+// and removed afterwards.
+func (h *MuHash) Finalize() [HashSize]byte {
+	h.normalize()
+	return sha256.Sum256(intToLE(h.numerator))
+}
+
+// Serialize returns the state of the hash, which Deserialize reads back.
+func (h *MuHash) Serialize() []byte {
+	h.normalize()
+	return intToLE(h.numerator)
+}
+
+// Deserialize returns the hash whose state is stored in the passed buffer made
+// by Serialize.
+func Deserialize(buf []byte) (*MuHash, error) {
+	if len(buf) != StateSize {
+		return nil, ErrInvalidState
+	}
+	n := leToInt(buf)
+	if n.Sign() == 0 || n.Cmp(prime) >= 0 {
+		return nil, ErrInvalidState
+	}
+	return &MuHash{numerator: n, denominator: big.NewInt(1)}, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package muhash_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/conformal/btcdb/muhash"
+	"testing"
+)
+
+// item returns the 32 byte item whose first byte is the passed one and whose
+// other bytes are zero, as used by the reference test vectors.
+func item(b byte) []byte {
+	buf := make([]byte, 32)
+	buf[0] = b
+	return buf
+}
+
+// reversed returns the hex of the passed hash with its bytes reversed, which is
+// how hashes are displayed.
+func reversed(sum [muhash.HashSize]byte) string {
+	for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+		sum[i], sum[j] = sum[j], sum[i]
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// TestChaCha ensures the keystream of the all zero key and nonce matches the
+// ChaCha20 test vector of RFC 7539.
+func TestChaCha(t *testing.T) {
+	want := "76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7" +
+		"da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586"
+	got := hex.EncodeToString(muhash.ChaChaKeystream([32]byte{}))
+	if got != want {
+		t.Errorf("ChaChaKeystream: got %s, want %s", got, want)
+	}
+}
+
+// TestMuHash ensures the hash of a set matches the reference test vector and
+// depends on nothing but the items of the set.
+func TestMuHash(t *testing.T) {
+	h := muhash.New()
+	h.Insert(item(0))
+	h.Insert(item(1))
+	h.Remove(item(2))
+	want := "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863"
+	if got := reversed(h.Finalize()); got != want {
+		t.Errorf("Finalize: got %s, want %s", got, want)
+	}
+
+	// The order items are inserted and removed in does not matter.
+	other := muhash.New()
+	other.Remove(item(2))
+	other.Insert(item(1))
+	other.Insert(item(0))
+	if other.Finalize() != h.Finalize() {
+		t.Errorf("Finalize: hash depends on the order of the items")
+	}
+
+	// Removing every item gives the hash of the empty set.
+	empty := muhash.New().Finalize()
+	h.Insert(item(2))
+	h.Remove(item(0))
+	h.Remove(item(1))
+	if h.Finalize() != empty {
+		t.Errorf("Finalize: got %x after removing every item, want %x",
+			h.Finalize(), empty)
+	}
+
+	// Combining hashes gives the hash of the union of their sets.
+	a, b, ab := muhash.New(), muhash.New(), muhash.New()
+	a.Insert(item(3))
+	b.Insert(item(4))
+	b.Remove(item(5))
+	ab.Insert(item(3))
+	ab.Insert(item(4))
+	ab.Remove(item(5))
+	a.Combine(b)
+	if a.Finalize() != ab.Finalize() {
+		t.Errorf("Combine: got %x, want %x", a.Finalize(),
+			ab.Finalize())
+	}
+
+	// Dividing by a hash undoes combining with it.
+	a.Divide(b)
+	a.Combine(b)
+	a.Divide(b)
+	only := muhash.New()
+	only.Insert(item(3))
+	if a.Finalize() != only.Finalize() {
+		t.Errorf("Divide: got %x, want %x", a.Finalize(),
+			only.Finalize())
+	}
+	a.Combine(b)
+
+	// The state is serialized and read back.
+	state := a.Serialize()
+	restored, err := muhash.Deserialize(state)
+	if err != nil {
+		t.Errorf("Deserialize: %v", err)
+		return
+	}
+	restored.Insert(item(6))
+	ab.Insert(item(6))
+	if restored.Finalize() != ab.Finalize() {
+		t.Errorf("Deserialize: restored state does not match")
+	}
+	if !bytes.Equal(restored.Serialize(), ab.Serialize()) {
+		t.Errorf("Serialize: states of the same set differ")
+	}
+	bad := [][]byte{nil, state[1:], make([]byte, muhash.StateSize),
+		bytes.Repeat([]byte{0xff}, muhash.StateSize)}
+	for _, buf := range bad {
+		if _, err := muhash.Deserialize(buf); err != muhash.ErrInvalidState {
+			t.Errorf("Deserialize: got %v for an invalid state, "+
+				"want %v", err, muhash.ErrInvalidState)
+		}
+	}
+}
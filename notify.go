@@ -0,0 +1,175 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// ChainEvent is a change to the chain stored in a database which is delivered
+// to subscribers.  It is either a BlockConnected or a BlockDisconnected.
+type ChainEvent interface {
+	isChainEvent()
+}
+
+// BlockConnected is delivered once a block has been inserted into the
+// database.
+type BlockConnected struct {
+	Sha    btcwire.ShaHash
+	Height int64
+}
+
+// BlockDisconnected is delivered once a block has been removed from the
+// database by DropAfterBlockBySha.  Blocks are disconnected from the tip down.
+type BlockDisconnected struct {
+	Sha    btcwire.ShaHash
+	Height int64
+}
+
+func (BlockConnected) isChainEvent()    {}
+func (BlockDisconnected) isChainEvent() {}
+
+// Subscription delivers the changes to the chain of a database in the order
+// they were committed.  Events are queued for the subscriber without limit, so
+// a slow subscriber never holds up changes to the database.  The channel is
+// closed once the subscription is cancelled or the database is closed, and any
+// events not received by then are discarded.
+type Subscription struct {
+	n      *Notifier
+	c      chan ChainEvent
+	mtx    sync.Mutex
+	queue  []ChainEvent
+	signal chan struct{}
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// Events returns the channel the events are delivered on.
+func (s *Subscription) Events() <-chan ChainEvent {
+	return s.c
+}
+
+// Unsubscribe cancels the subscription.  Events which have not been received
+// yet are discarded and the channel is closed.
+func (s *Subscription) Unsubscribe() {
+	s.n.remove(s)
+	s.stop()
+}
+
+// stop makes the delivery goroutine exit, which closes the channel.
+func (s *Subscription) stop() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+// push queues the passed events for delivery.
+func (s *Subscription) push(events []ChainEvent) {
+	s.mtx.Lock()
+	s.queue = append(s.queue, events...)
+	s.mtx.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued events to the subscriber until the subscription is
+// stopped.  It must be run as a goroutine.
+func (s *Subscription) deliver() {
+	defer close(s.c)
+	for {
+		s.mtx.Lock()
+		var next ChainEvent
+		if len(s.queue) != 0 {
+			next = s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+		}
+		s.mtx.Unlock()
+
+		if next == nil {
+			select {
+			case <-s.signal:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+		select {
+		case s.c <- next:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Notifier keeps the subscriptions of a database and delivers events to them.
+// The zero value is ready for use.  It is intended for use by drivers, which
+// call Notify once a change is committed and while still holding whatever
+// serializes their changes, so subscribers see the events in commit order.
+type Notifier struct {
+	mtx    sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscribe returns a new subscription to the events passed to Notify.  It
+// returns ErrDbClosed once the notifier has been closed.
+func (n *Notifier) Subscribe() (*Subscription, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.closed {
+		return nil, ErrDbClosed
+	}
+	s := &Subscription{
+		n:      n,
+		c:      make(chan ChainEvent),
+		signal: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	if n.subs == nil {
+		n.subs = make(map[*Subscription]struct{})
+	}
+	n.subs[s] = struct{}{}
+	go s.deliver()
+	return s, nil
+}
+
+// Notify queues the passed events for every subscription without waiting for
+// them to be received.
+func (n *Notifier) Notify(events ...ChainEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for s := range n.subs {
+		s.push(events)
+	}
+}
+
+// Close ends every subscription and makes later calls to Subscribe fail.
+func (n *Notifier) Close() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for s := range n.subs {
+		s.stop()
+	}
+	n.subs = nil
+	n.closed = true
+}
+
+// remove forgets the passed subscription.
+func (n *Notifier) remove(s *Subscription) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	delete(n.subs, s)
+}
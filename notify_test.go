@@ -0,0 +1,137 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSubscribe ensures subscribers are told about the blocks connected and
+// disconnected by committed changes, in order, for all supported database
+// types.
+func TestSubscribe(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// checkEvents ensures the next events of the passed subscription are
+	// the wanted ones.
+	checkEvents := func(dbType string, sub *btcdb.Subscription, want []btcdb.ChainEvent) bool {
+		for i, wantEv := range want {
+			select {
+			case ev, ok := <-sub.Events():
+				if !ok {
+					t.Errorf("Subscribe (%s): channel closed at "+
+						"event %d", dbType, i)
+					return false
+				}
+				if !reflect.DeepEqual(ev, wantEv) {
+					t.Errorf("Subscribe (%s): event %d got %#v, "+
+						"want %#v", dbType, i, ev, wantEv)
+					return false
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("Subscribe (%s): timeout waiting for "+
+					"event %d", dbType, i)
+				return false
+			}
+		}
+		return true
+	}
+
+	// connected and disconnected return the events of the blocks at the
+	// passed heights.
+	connected := func(start, end int) []btcdb.ChainEvent {
+		var events []btcdb.ChainEvent
+		for height := start; height < end; height++ {
+			sha, _ := blocks[height].Sha()
+			events = append(events, btcdb.BlockConnected{Sha: *sha,
+				Height: int64(height)})
+		}
+		return events
+	}
+	disconnected := func(start, end int) []btcdb.ChainEvent {
+		var events []btcdb.ChainEvent
+		for height := end - 1; height >= start; height-- {
+			sha, _ := blocks[height].Sha()
+			events = append(events, btcdb.BlockDisconnected{Sha: *sha,
+				Height: int64(height)})
+		}
+		return events
+	}
+
+	const n = 10
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "subscribe", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		sub, err := db.Subscribe()
+		if err != nil {
+			t.Errorf("Subscribe (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		// Nothing is delivered for blocks which fail to insert.
+		if _, err := db.InsertBlock(blocks[0]); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+		}
+		if _, err := db.InsertBlocks(blocks[2:n]); err == nil {
+			t.Errorf("InsertBlocks (%s): unexpected success for "+
+				"unconnected blocks", dbType)
+		}
+		if _, err := db.InsertBlocks(blocks[1:n]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		if !checkEvents(dbType, sub, connected(0, n)) {
+			sub.Unsubscribe()
+			teardown()
+			continue
+		}
+
+		keepSha, _ := blocks[n/2-1].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		if _, err := db.InsertBlocks(blocks[n/2 : n/2+1]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		want := append(disconnected(n/2, n), connected(n/2, n/2+1)...)
+		checkEvents(dbType, sub, want)
+
+		// Cancelled subscriptions are closed and closing the database
+		// closes the rest.
+		sub.Unsubscribe()
+		if _, ok := <-sub.Events(); ok {
+			t.Errorf("Unsubscribe (%s): channel not closed", dbType)
+		}
+		sub, err = db.Subscribe()
+		if err != nil {
+			t.Errorf("Subscribe (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		db.Close()
+		if _, ok := <-sub.Events(); ok {
+			t.Errorf("Close (%s): channel not closed", dbType)
+		}
+		if _, err := db.Subscribe(); err != btcdb.ErrDbClosed {
+			t.Errorf("Subscribe (%s): closed database got %v, "+
+				"want %v", dbType, err, btcdb.ErrDbClosed)
+		}
+		teardown()
+	}
+}
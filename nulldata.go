@@ -0,0 +1,212 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// nullDataKeyLen is the number of bytes of the payload of an OP_RETURN output
+// which are part of the key of its entry, so payloads are searched by prefixes
+// up to that long without reading the entries of other payloads.
+const nullDataKeyLen = 16
+
+// nullDataEntryLen is the length of the keys of the entries of OP_RETURN
+// outputs after nullDataOutPrefix.
+const nullDataEntryLen = nullDataKeyLen + 1 + 8 + btcwire.HashSize + 4
+
+// NullDataPrefix is the prefix of the keys of the metadata namespace under
+// which a NullDataIndex keeps its state.
+var NullDataPrefix = []byte("btcdb/nulldata/")
+
+var (
+	// nullDataTipKey is the key of the hash and height of the newest block
+	// indexed by the OP_RETURN index.
+	nullDataTipKey = []byte("btcdb/nulldata/tip")
+
+	// nullDataOutPrefix is the prefix of the keys of the entries of the
+	// OP_RETURN outputs.  Each is followed by the first nullDataKeyLen
+	// bytes of the payload padded with zeros, the number of them which
+	// are part of the payload, the height of the block as a big endian
+	// number, the hash of the transaction and the index of the output as
+	// a big endian number.  Its value is the whole payload.
+	nullDataOutPrefix = []byte("btcdb/nulldata/out/")
+)
+
+// nullDataKey returns the key of the entry of the OP_RETURN output with the
+// passed payload and location.
+func nullDataKey(payload []byte, height int64, sha *btcwire.ShaHash, index uint32) []byte {
+	off := len(nullDataOutPrefix)
+	key := make([]byte, off+nullDataEntryLen)
+	copy(key, nullDataOutPrefix)
+	n := copy(key[off:off+nullDataKeyLen], payload)
+	off += nullDataKeyLen
+	key[off] = byte(n)
+	off++
+	binary.BigEndian.PutUint64(key[off:], uint64(height))
+	off += 8
+	copy(key[off:], sha.Bytes())
+	off += btcwire.HashSize
+	binary.BigEndian.PutUint32(key[off:], index)
+	return key
+}
+
+// NullDataOutput is an OP_RETURN output found by FetchNullData.  Payload is the
+// data the output carries as described by NullDataIndex.
+type NullDataOutput struct {
+	TxSha   btcwire.ShaHash
+	Index   uint32
+	Height  int64
+	Payload []byte
+}
+
+// NullDataIndex is an optional indexer which records every OP_RETURN output of
+// the chain by the start of its payload, so protocols embedding data in such
+// outputs find their records with FetchNullData rather than by scanning the
+// chain.  The payload of an output is the data pushed after its OP_RETURN
+// joined together, or every byte after it when the rest of the script is not
+// made of pushes.
+type NullDataIndex struct {
+	mtx sync.Mutex
+	db  Db
+}
+
+// Ensure NullDataIndex implements the Indexer interface.
+var _ Indexer = (*NullDataIndex)(nil)
+
+// NewNullDataIndex returns an OP_RETURN index which starts indexing once it is
+// added to a database with AddIndexer.
+func NewNullDataIndex() *NullDataIndex {
+	return new(NullDataIndex)
+}
+
+// Init prepares the index for the passed database.  The index is rebuilt from
+// the genesis block when its tip is no longer in the chain.  This is part of
+// the Indexer interface implementation.
+func (idx *NullDataIndex) Init(db Db) error {
+	_, err := initIndexerState(db, "OP_RETURN index", NullDataPrefix,
+		nullDataTipKey)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *NullDataIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, nullDataTipKey)
+}
+
+// forEachNullData calls the passed function with the key and payload of the
+// entry of every OP_RETURN output of the passed block at the passed height.
+func forEachNullData(block *btcutil.Block, height int64, fn func(key, payload []byte)) {
+	for _, tx := range block.Transactions() {
+		for i, txOut := range tx.MsgTx().TxOut {
+			payload, ok := nullDataPayload(txOut.PkScript)
+			if !ok {
+				continue
+			}
+			fn(nullDataKey(payload, height, tx.Sha(), uint32(i)), payload)
+		}
+	}
+}
+
+// ConnectBlock adds the entries of the OP_RETURN outputs of the passed block.
+// This is part of the Indexer interface implementation.
+func (idx *NullDataIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	forEachNullData(block, height, func(key, payload []byte) {
+		meta.Put(key, payload)
+	})
+	putTipRecord(meta, nullDataTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the entries of the OP_RETURN outputs of the passed
+// block.  This is part of the Indexer interface implementation.
+func (idx *NullDataIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	forEachNullData(block, height, func(key, payload []byte) {
+		meta.Delete(key)
+	})
+	putTipRecord(meta, nullDataTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// FetchNullData returns up to max OP_RETURN outputs of the chain of the passed
+// database whose payload starts with the passed prefix, ordered by the start
+// of their payload and then by height, using the NullDataIndex of the
+// database.  An empty prefix matches every output and a max which is not
+// positive returns every match.  Prefixes longer than 16 bytes are matched by
+// reading every entry sharing their first 16 bytes.  ErrNoNullDataIndex is
+// returned when the database has no OP_RETURN index.
+func FetchNullData(db Db, prefix []byte, max int) ([]*NullDataOutput, error) {
+	tipSha, _, err := fetchTipRecord(db, nullDataTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoNullDataIndex
+	}
+
+	keyPrefix := prefix
+	if len(keyPrefix) > nullDataKeyLen {
+		keyPrefix = keyPrefix[:nullDataKeyLen]
+	}
+	iter, err := db.MetaIterator(append(append([]byte(nil),
+		nullDataOutPrefix...), keyPrefix...))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var outs []*NullDataOutput
+	for (max <= 0 || len(outs) < max) && iter.Next() {
+		key := iter.Key()
+		if len(key) != len(nullDataOutPrefix)+nullDataEntryLen {
+			return nil, fmt.Errorf("malformed OP_RETURN index key %x",
+				key)
+		}
+
+		// Payloads shorter than the prefix are padded with zeros,
+		// which the prefix may match.
+		off := len(nullDataOutPrefix) + nullDataKeyLen
+		if int(key[off]) < len(keyPrefix) ||
+			!bytes.HasPrefix(iter.Value(), prefix) {
+			continue
+		}
+		off++
+		out := &NullDataOutput{
+			Height:  int64(binary.BigEndian.Uint64(key[off:])),
+			Payload: append([]byte(nil), iter.Value()...),
+		}
+		off += 8
+		copy(out.TxSha[:], key[off:])
+		off += btcwire.HashSize
+		out.Index = binary.BigEndian.Uint32(key[off:])
+		outs = append(outs, out)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return outs, nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestNullData ensures the OP_RETURN index finds outputs by the start of their
+// payload for every supported database type as blocks are inserted and
+// dropped.
+func TestNullData(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	// Each block after the test chain has a coinbase paying to the passed
+	// scripts.
+	long := []byte("abcdefghijklmnopqrstuvwxyz012345")
+	scripts := [][]byte{
+		append([]byte{0x6a, 0x04}, "abcd"...),
+		append(append([]byte{0x6a, 0x4c, 0x05}, "abcde"...), 0x51),
+		{0x76, 0xa9, 0x02, 'a', 'b', 0x88, 0xac},
+		append([]byte{0x6a, 0x02}, "ab"...),
+		append([]byte{0x6a, 0x20}, long...),
+		{0x6a, 0xac},
+	}
+	chain := append([]*btcutil.Block(nil), blocks...)
+	for i, script := range scripts {
+		prev := chain[len(chain)-1]
+		prevSha, _ := prev.Sha()
+		tx := btcwire.NewMsgTx()
+		prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{byte(i), 0x51}))
+		tx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+		tx.AddTxOut(btcwire.NewTxOut(0, script))
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash,
+			prev.MsgBlock().Header.Bits, 0)
+		hdr.Timestamp = prev.MsgBlock().Header.Timestamp.Add(time.Minute)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		msgBlock.AddTransaction(tx)
+		chain = append(chain, btcutil.NewBlock(msgBlock))
+	}
+
+	// checkNullData ensures the outputs found for the passed prefix carry
+	// the passed payloads in order, at the passed heights.
+	checkNullData := func(dbType string, db btcdb.Db, prefix []byte, max int, payloads [][]byte, heights []int64) {
+		outs, err := btcdb.FetchNullData(db, prefix, max)
+		if err != nil || len(outs) != len(payloads) {
+			t.Errorf("FetchNullData (%s): got %d outputs (err %v) for "+
+				"prefix %q, want %d", dbType, len(outs), err,
+				prefix, len(payloads))
+			return
+		}
+		for i, out := range outs {
+			txSha := chain[heights[i]].Transactions()[0].Sha()
+			if !bytes.Equal(out.Payload, payloads[i]) ||
+				out.Height != heights[i] || out.Index != 1 ||
+				!out.TxSha.IsEqual(txSha) {
+				t.Errorf("FetchNullData (%s): got %+v for prefix "+
+					"%q, want payload %q at height %d", dbType,
+					out, prefix, payloads[i], heights[i])
+			}
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "nulldata", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(chain[:12]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.FetchNullData(db, nil, 0); err != btcdb.ErrNoNullDataIndex {
+			t.Errorf("FetchNullData (%s): got %v without an index, "+
+				"want %v", dbType, err, btcdb.ErrNoNullDataIndex)
+		}
+
+		// The index is caught up with the blocks already stored and
+		// kept up to date by those inserted and dropped later.
+		if err := db.AddIndexer(btcdb.NewNullDataIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := db.InsertBlocks(chain[12:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkNullData(dbType, db, []byte("ab"), 0, [][]byte{
+			[]byte("ab"), []byte("abcd"), []byte("abcde\x01"), long,
+		}, []int64{13, 10, 11, 14})
+		checkNullData(dbType, db, []byte("ab"), 2, [][]byte{
+			[]byte("ab"), []byte("abcd"),
+		}, []int64{13, 10})
+		checkNullData(dbType, db, []byte("ab\x00"), 0, nil, nil)
+		checkNullData(dbType, db, long[:20], 0, [][]byte{long},
+			[]int64{14})
+		checkNullData(dbType, db, []byte("abcdefghijklmnopX"), 0, nil,
+			nil)
+		checkNullData(dbType, db, nil, 0, [][]byte{
+			[]byte("ab"), []byte("abcd"), []byte("abcde\x01"), long,
+			{0xac},
+		}, []int64{13, 10, 11, 14, 15})
+
+		keepSha, _ := chain[12].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkNullData(dbType, db, nil, 0, [][]byte{
+			[]byte("abcd"), []byte("abcde\x01"),
+		}, []int64{10, 11})
+		teardown()
+	}
+}
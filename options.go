@@ -0,0 +1,189 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+	"time"
+)
+
+// Compression specifies how a backend compresses the data it stores.
+type Compression int
+
+// Compression methods which may be requested through Options.
+const (
+	// DefaultCompression leaves the choice of compression to the driver.
+	DefaultCompression Compression = iota
+
+	// NoCompression disables compression.
+	NoCompression
+
+	// SnappyCompression compresses data with the snappy algorithm.
+	SnappyCompression
+)
+
+// SyncPolicy specifies when a backend syncs the data it writes to disk.
+type SyncPolicy int
+
+// Sync policies which may be requested through Options.
+const (
+	// SyncDefault leaves the choice of when to sync to the driver.
+	SyncDefault SyncPolicy = iota
+
+	// SyncAlways syncs every write to disk before it is reported as
+	// complete.
+	SyncAlways
+
+	// SyncNever leaves it to the operating system to write data to disk
+	// except when the Sync or Close functions of the database are called.
+	SyncNever
+
+	// SyncPeriodic does not sync writes as they are made but syncs all
+	// data written so far at the SyncInterval of Options, so at most that
+	// much of the most recent writes is lost by a crash.
+	SyncPeriodic
+)
+
+// ValidationMode specifies the checks a backend performs on each block passed
+// to InsertBlock before storing it.
+type ValidationMode int
+
+// Validation modes which may be requested through Options.  Each mode includes
+// the checks of the modes before it.
+const (
+	// ValidateNone stores blocks without checking them beyond what is
+	// needed to link them to the chain.
+	ValidateNone ValidationMode = iota
+
+	// ValidateSanity checks that the block extends the newest block of
+	// the chain, that the hash of its header meets the target difficulty
+	// it claims and that the merkle root of its transactions matches its
+	// header.
+	ValidateSanity
+
+	// ValidateStrict also checks the rules of the block chain which do
+	// not depend on the outputs spent by the block, such as the block
+	// having a single coinbase as its first transaction, its size and
+	// the amounts of the outputs of its transactions.
+	ValidateStrict
+)
+
+// DefaultSyncInterval is the interval at which data is synced under the
+// SyncPeriodic policy when Options does not give one.
+const DefaultSyncInterval = time.Second
+
+// UpgradeStatus describes the progress of an upgrade of the format of a
+// database.
+type UpgradeStatus struct {
+	// Version is the version of the format being upgraded to.  Upgrades
+	// spanning several versions go through each of them in turn.
+	Version uint32
+
+	// Description tells what changes with the version.
+	Description string
+
+	// Done is the number of records upgraded to the version since the
+	// database was opened.
+	Done int64
+
+	// Complete is set once the database is at the version.
+	Complete bool
+}
+
+// Options houses the settings used to create or open a database through
+// CreateDBWithOptions and OpenDBWithOptions.  The zero value of each field
+// selects the default of the driver and drivers ignore the settings which do
+// not apply to them.
+type Options struct {
+	// Path is the location of the database.  It is a file or directory
+	// for backends that store the database locally and a connection
+	// string for those that connect to a server.
+	Path string
+
+	// CacheSize is the size in bytes of the cache of recently read data.
+	CacheSize int
+
+	// BlockCacheSize is the size in bytes of the cache of the serialized
+	// blocks most recently fetched and inserted, which serves them without
+	// reading the backend.  Blocks are not cached when it is zero.
+	BlockCacheSize int
+
+	// WriteBufferSize is the size in bytes of the recent writes held in
+	// memory before they are written out to the database files.
+	WriteBufferSize int
+
+	// Compression is the compression method used for the stored data.
+	Compression Compression
+
+	// Sync is the policy for syncing written data to disk.
+	Sync SyncPolicy
+
+	// SyncInterval is the interval at which data is synced under the
+	// SyncPeriodic policy.
+	SyncInterval time.Duration
+
+	// ReadOnly opens the database without allowing any changes to it.
+	// Functions which would modify the database return ErrReadOnly.
+	ReadOnly bool
+
+	// ForceOpen opens the database without its lock when it is held by
+	// another process, which recovery tools use to read a database held by
+	// a process which no longer responds.  Writing to a database which
+	// another process still has open corrupts it.
+	ForceOpen bool
+
+	// Metrics receives measurements of the operations of the database.
+	// Nothing is measured when it is nil.
+	Metrics Metrics
+
+	// SlowOpThreshold is the duration at which block inserts, drops and
+	// fetches are logged as warnings along with the block involved and how
+	// much of the time was spent waiting for the database lock.  Slow
+	// operations are not logged when it is zero.
+	SlowOpThreshold time.Duration
+
+	// PrefetchDepth is the number of blocks read ahead of the caller on a
+	// goroutine of their own by block iterators, and by drivers with a
+	// block cache once blocks are fetched or listed in height order.
+	// Nothing is read ahead when it is zero.
+	PrefetchDepth int
+
+	// TxIndex turns on the standalone transaction index of drivers which
+	// keep one, which locates every transaction by its hash along with
+	// the block holding it.  It is built from the stored blocks when the
+	// database is opened for writing without it, and kept from then on.
+	TxIndex bool
+
+	// Validation selects the checks performed on each block before it is
+	// inserted.  Blocks which fail them are rejected with a
+	// ValidationError.
+	Validation ValidationMode
+
+	// Net is the network whose chain the database holds.  Drivers which
+	// record it refuse to open a database of another network with an
+	// IdentityError.  It is not checked when zero.
+	Net btcwire.BitcoinNet
+
+	// UpgradeProgress, when not nil, is called as the driver upgrades the
+	// format of a database written by an older version, which it does
+	// when the database is opened for writing.
+	UpgradeProgress func(UpgradeStatus)
+
+	// Backend holds tuning which is specific to a single backend, keyed
+	// by the names documented by its driver.
+	Backend map[string]interface{}
+}
+
+// CreateDBWithOptions intializes and opens a database using the passed
+// options.  The options are handed to the driver as its only argument.
+func CreateDBWithOptions(dbtype string, opts Options) (pbdb Db, err error) {
+	return CreateDB(dbtype, opts)
+}
+
+// OpenDBWithOptions opens an existing database using the passed options.  The
+// options are handed to the driver as its only argument.
+func OpenDBWithOptions(dbtype string, opts Options) (pbdb Db, err error) {
+	return OpenDB(dbtype, opts)
+}
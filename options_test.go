@@ -0,0 +1,84 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/badgerdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCreateOpenWithOptions ensures every supported database type can be
+// created and reopened through the options API.
+func TestCreateOpenWithOptions(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		// Settings for other backends and those which do not apply
+		// are expected to be ignored.
+		opts := btcdb.Options{
+			Path:            filepath.Join(testDbRoot, "optsdb-"+dbType),
+			CacheSize:       1024 * 1024,
+			WriteBufferSize: 1024 * 1024,
+			Compression:     btcdb.SnappyCompression,
+			Sync:            btcdb.SyncAlways,
+			Backend: map[string]interface{}{
+				ldb.BlockFileSizeOption:       1024 * 1024,
+				badgerdb.ValueThresholdOption: 128,
+			},
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		_, err = db.InsertBlock(btcutil.NewBlock(&btcwire.GenesisBlock))
+		if err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+		}
+		db.Sync()
+		db.Close()
+
+		db, err = btcdb.OpenDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+
+		// A memory database does not persist across opens.
+		if dbType != "memory" {
+			sha, height, err := db.NewestSha()
+			if err != nil || height != 0 ||
+				!sha.IsEqual(&btcwire.GenesisHash) {
+
+				t.Errorf("NewestSha (%s): got %v at height %d "+
+					"(err %v), want %v at height 0", dbType,
+					sha, height, err, &btcwire.GenesisHash)
+			}
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sort"
+	"time"
+)
+
+// OrphanPrefix is the prefix of the keys of the metadata namespace under which
+// PutOrphan keeps blocks whose parent is not stored yet.  Each key is the
+// prefix followed by the hash of the parent of a block and the hash of the
+// block itself, so the orphans of a parent are found with a single iterator,
+// and its value is the time the block was stored in nanoseconds since the
+// epoch followed by the serialized block.
+var OrphanPrefix = []byte("btcdb/orphan/")
+
+// orphanKey returns the key of the metadata namespace under which the block
+// with the passed hash and parent is kept while it is an orphan.
+func orphanKey(parent, sha *btcwire.ShaHash) []byte {
+	key := make([]byte, len(OrphanPrefix)+2*btcwire.HashSize)
+	copy(key, OrphanPrefix)
+	copy(key[len(OrphanPrefix):], parent.Bytes())
+	copy(key[len(OrphanPrefix)+btcwire.HashSize:], sha.Bytes())
+	return key
+}
+
+// orphanParentPrefix returns the prefix of the keys of the metadata namespace
+// under which the orphans of the block with the passed hash are kept.
+func orphanParentPrefix(parent *btcwire.ShaHash) []byte {
+	return orphanKey(parent, &btcwire.ShaHash{})[:len(OrphanPrefix)+
+		btcwire.HashSize]
+}
+
+// orphan is a block kept under OrphanPrefix along with its key and the time it
+// was stored.
+type orphan struct {
+	key   []byte
+	added int64
+	size  int
+	block *btcutil.Block
+}
+
+// orphansByAge sorts orphans from the oldest to the newest.
+type orphansByAge []*orphan
+
+func (s orphansByAge) Len() int {
+	return len(s)
+}
+
+func (s orphansByAge) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s orphansByAge) Less(i, j int) bool {
+	return s[i].added < s[j].added
+}
+
+// fetchOrphans returns the orphans kept under the passed prefix of the
+// metadata namespace of the passed database in key order.  The blocks are only
+// deserialized when decode is true.
+func fetchOrphans(db Db, prefix []byte, decode bool) ([]*orphan, error) {
+	iter, err := db.MetaIterator(prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var orphans []*orphan
+	for iter.Next() {
+		key, val := iter.Key(), iter.Value()
+		if len(key) != len(OrphanPrefix)+2*btcwire.HashSize || len(val) < 8 {
+			return nil, fmt.Errorf("malformed orphan record %x", key)
+		}
+		o := &orphan{
+			key:   append([]byte(nil), key...),
+			added: int64(binary.LittleEndian.Uint64(val[:8])),
+			size:  len(val) - 8,
+		}
+		if decode {
+			o.block, err = btcutil.NewBlockFromBytes(val[8:])
+			if err != nil {
+				return nil, err
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// PutOrphan stores the passed block, whose parent is not stored yet, in the
+// orphan pool of the passed database.  Orphans are kept under OrphanPrefix in
+// the metadata namespace, so they survive reopening the database, until
+// PromoteOrphans promotes them once their parent is stored or EvictOrphans
+// evicts them.  When the parent is already in the chain or on a side chain,
+// the block is promoted at once.
+//
+// DuplicateSha is returned when the block is already in the chain, on a side
+// chain or in the orphan pool.
+func PutOrphan(db Db, block *btcutil.Block) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	if db.ExistsSha(sha) {
+		return DuplicateSha
+	}
+	if _, err := FetchSideBlock(db, sha); err != ErrBlockNotFound {
+		if err == nil {
+			err = DuplicateSha
+		}
+		return err
+	}
+	parent := &block.MsgBlock().Header.PrevBlock
+	key := orphanKey(parent, sha)
+	val, err := db.GetMeta(key)
+	if err != nil {
+		return err
+	}
+	if val != nil {
+		return DuplicateSha
+	}
+
+	raw, err := block.Bytes()
+	if err != nil {
+		return err
+	}
+	val = make([]byte, 8+len(raw))
+	binary.LittleEndian.PutUint64(val, uint64(time.Now().UnixNano()))
+	copy(val[8:], raw)
+	if err := db.PutMeta(key, val); err != nil {
+		return err
+	}
+
+	// The parent may have been stored before the orphan was.
+	_, err = PromoteOrphans(db, parent)
+	return err
+}
+
+// FetchOrphansByParent returns the blocks in the orphan pool of the passed
+// database whose parent is the block with the passed hash.
+func FetchOrphansByParent(db Db, parent *btcwire.ShaHash) ([]*btcutil.Block, error) {
+	orphans, err := fetchOrphans(db, orphanParentPrefix(parent), true)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]*btcutil.Block, 0, len(orphans))
+	for _, o := range orphans {
+		blocks = append(blocks, o.block)
+	}
+	return blocks, nil
+}
+
+// PromoteOrphans moves the orphans of the block with the passed hash, which
+// must be in the chain or on a side chain, out of the orphan pool of the
+// passed database, followed by the orphans of each promoted block in turn.
+// An orphan whose parent is the newest block of the chain is inserted into the
+// chain, in the same change as it is removed from the pool, and the others are
+// stored on a side chain with InsertSideBlock.  It returns the number of
+// blocks promoted.  Nothing is done when the block is not stored.
+func PromoteOrphans(db Db, parent *btcwire.ShaHash) (int, error) {
+	if !db.ExistsSha(parent) {
+		if _, err := FetchSideBlock(db, parent); err != nil {
+			if err == ErrBlockNotFound {
+				err = nil
+			}
+			return 0, err
+		}
+	}
+
+	var promoted int
+	queue := []btcwire.ShaHash{*parent}
+	for len(queue) != 0 {
+		parentSha := queue[0]
+		queue = queue[1:]
+		orphans, err := fetchOrphans(db, orphanParentPrefix(&parentSha),
+			true)
+		if err != nil {
+			return promoted, err
+		}
+		for _, o := range orphans {
+			sha, err := o.block.Sha()
+			if err != nil {
+				return promoted, err
+			}
+			newestSha, _, err := db.NewestSha()
+			if err != nil {
+				return promoted, err
+			}
+
+			// Blocks stored by other means since they were put in
+			// the pool are only removed from it.
+			var meta MetaBatch
+			meta.Delete(o.key)
+			stored := true
+			if newestSha.IsEqual(&parentSha) {
+				_, err = db.InsertBlocksWithMeta(
+					[]*btcutil.Block{o.block}, &meta)
+				if err != nil && db.ExistsSha(sha) {
+					stored, err = false, db.WriteMeta(&meta)
+				}
+			} else {
+				_, err = putSideBlock(db, o.block, &meta)
+				if err == DuplicateSha {
+					stored, err = false, nil
+				}
+				if err == nil {
+					err = db.WriteMeta(&meta)
+				}
+			}
+			if err != nil {
+				return promoted, err
+			}
+			if stored {
+				promoted++
+			}
+			queue = append(queue, *sha)
+		}
+	}
+	if promoted != 0 {
+		log.Debugf("Promoted %d orphans after %v", promoted, parent)
+	}
+	return promoted, nil
+}
+
+// EvictOrphans removes the orphans stored longer than maxAge ago from the
+// orphan pool of the passed database, followed by the oldest of the rest until
+// their serialized blocks take no more than maxSize bytes.  A limit which is
+// not positive is not applied.  It returns the number of orphans evicted.
+func EvictOrphans(db Db, maxAge time.Duration, maxSize int64) (int, error) {
+	orphans, err := fetchOrphans(db, OrphanPrefix, false)
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(orphansByAge(orphans))
+
+	var total int64
+	for _, o := range orphans {
+		total += int64(o.size)
+	}
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	var meta MetaBatch
+	for _, o := range orphans {
+		if (maxAge <= 0 || o.added >= cutoff) &&
+			(maxSize <= 0 || total <= maxSize) {
+			break
+		}
+		meta.Delete(o.key)
+		total -= int64(o.size)
+	}
+	if meta.Len() == 0 {
+		return 0, nil
+	}
+	log.Debugf("Evicting %d orphans", meta.Len())
+	if err := db.WriteMeta(&meta); err != nil {
+		return 0, err
+	}
+	return meta.Len(), nil
+}
+
+// OrphanPromoter promotes the orphans of every block connected to the chain of
+// a database as PromoteOrphans does.
+type OrphanPromoter struct {
+	sub  *Subscription
+	done chan struct{}
+}
+
+// StartOrphanPromoter subscribes to the blocks connected to the chain of the
+// passed database and promotes their orphans on a goroutine of its own until
+// Stop is called or the database is closed, so blocks stored with PutOrphan
+// reach the chain once their parent is inserted by any means.  Failures to
+// promote orphans are logged and leave them in the orphan pool.
+func StartOrphanPromoter(db Db) (*OrphanPromoter, error) {
+	sub, err := db.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	p := &OrphanPromoter{sub: sub, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		for event := range sub.Events() {
+			connected, ok := event.(BlockConnected)
+			if !ok {
+				continue
+			}
+			if _, err := PromoteOrphans(db, &connected.Sha); err != nil {
+				log.Warnf("Unable to promote the orphans of %v: %v",
+					&connected.Sha, err)
+			}
+		}
+	}()
+	return p, nil
+}
+
+// Stop ends the promotion of orphans and waits for a promotion which is in
+// progress to finish.
+func (p *OrphanPromoter) Stop() {
+	p.sub.Unsubscribe()
+	<-p.done
+}
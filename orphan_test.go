@@ -0,0 +1,177 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestOrphans ensures orphans are kept until their parent is stored, promoted
+// into the chain or a side chain once it is and evicted by age and size for
+// every supported database type.
+func TestOrphans(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+	shas := make([]*btcwire.ShaHash, len(blocks))
+	for i, blk := range blocks {
+		shas[i], _ = blk.Sha()
+	}
+	side := altChain(blocks[8], 2)
+	sideSha, _ := side[1].Sha()
+	unlinked := altChain(altChain(blocks[3], 1)[0], 3)
+	unlinkedSize := int64(unlinked[0].MsgBlock().SerializeSize())
+
+	// checkOrphans ensures the orphans of the passed parent are the passed
+	// blocks.
+	checkOrphans := func(dbType, desc string, db btcdb.Db, parent *btcwire.ShaHash, want ...*btcutil.Block) {
+		orphans, err := btcdb.FetchOrphansByParent(db, parent)
+		if err != nil {
+			t.Errorf("FetchOrphansByParent (%s) %s: %v", dbType, desc,
+				err)
+			return
+		}
+		if len(orphans) != len(want) {
+			t.Errorf("FetchOrphansByParent (%s) %s: got %d orphans, "+
+				"want %d", dbType, desc, len(orphans), len(want))
+			return
+		}
+		for i := range want {
+			gotSha, _ := orphans[i].Sha()
+			wantSha, _ := want[i].Sha()
+			if !gotSha.IsEqual(wantSha) {
+				t.Errorf("FetchOrphansByParent (%s) %s: got %v, "+
+					"want %v", dbType, desc, gotSha, wantSha)
+			}
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "orphandb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:6]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+
+		for _, blk := range blocks[7:] {
+			if err := btcdb.PutOrphan(db, blk); err != nil {
+				t.Errorf("PutOrphan (%s): %v", dbType, err)
+			}
+		}
+		for _, blk := range []*btcutil.Block{blocks[8], blocks[2]} {
+			if err := btcdb.PutOrphan(db, blk); err != btcdb.DuplicateSha {
+				t.Errorf("PutOrphan (%s): got %v for a stored block, "+
+					"want %v", dbType, err, btcdb.DuplicateSha)
+			}
+		}
+		checkOrphans(dbType, "after putting", db, shas[7], blocks[8])
+
+		// The orphans must survive reopening the database.
+		if dbType != "memory" {
+			db.Close()
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+			checkOrphans(dbType, "after reopening", db, shas[7],
+				blocks[8])
+		}
+
+		// Inserting the missing parent promotes the orphans after it
+		// into the chain.
+		promoter, err := btcdb.StartOrphanPromoter(db)
+		if err != nil {
+			t.Errorf("StartOrphanPromoter (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+		if _, err := db.InsertBlock(blocks[6]); err != nil {
+			t.Errorf("InsertBlock (%s): %v", dbType, err)
+		}
+		var height int64
+		for i := 0; i < 500 && height != 9; i++ {
+			_, height, _ = db.NewestSha()
+			time.Sleep(10 * time.Millisecond)
+		}
+		promoter.Stop()
+		if height != 9 {
+			t.Errorf("StartOrphanPromoter (%s): chain ends at height "+
+				"%d, want 9", dbType, height)
+		}
+		checkOrphans(dbType, "after promoting", db, shas[7])
+
+		// Orphans whose parent is stored but is not the newest block
+		// are promoted to a side chain at once.
+		if err := btcdb.PutOrphan(db, side[1]); err != nil {
+			t.Errorf("PutOrphan (%s): %v", dbType, err)
+		}
+		if err := btcdb.PutOrphan(db, side[0]); err != nil {
+			t.Errorf("PutOrphan (%s): %v", dbType, err)
+		}
+		blk, err := btcdb.FetchSideBlock(db, sideSha)
+		if err != nil || blk.Height() != 10 {
+			t.Errorf("FetchSideBlock (%s): got %v (err %v), want the "+
+				"promoted block at height 10", dbType, blk, err)
+		}
+
+		// Orphans are evicted by size from the oldest and then by age.
+		for _, blk := range unlinked {
+			if err := btcdb.PutOrphan(db, blk); err != nil {
+				t.Errorf("PutOrphan (%s): %v", dbType, err)
+			}
+		}
+		n, err := btcdb.EvictOrphans(db, 0, 2*unlinkedSize)
+		if err != nil || n != 1 {
+			t.Errorf("EvictOrphans (%s): evicted %d (err %v), want 1",
+				dbType, n, err)
+		}
+		first, _ := unlinked[0].Sha()
+		checkOrphans(dbType, "after evicting by size", db,
+			&unlinked[0].MsgBlock().Header.PrevBlock)
+		checkOrphans(dbType, "after evicting by size", db, first,
+			unlinked[1])
+		time.Sleep(10 * time.Millisecond)
+		n, err = btcdb.EvictOrphans(db, time.Millisecond, 0)
+		if err != nil || n != 2 {
+			t.Errorf("EvictOrphans (%s): evicted %d (err %v), want 2",
+				dbType, n, err)
+		}
+		checkOrphans(dbType, "after evicting by age", db, first)
+		db.Close()
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PeerPrefix is the prefix of the keys of the metadata namespace under which
+// the addresses of network peers and their ban scores are kept, so the address
+// manager of a node keeps its state in the same database as its chain.
+var PeerPrefix = []byte("btcdb/peers/")
+
+var (
+	// peerAddrPrefix is the prefix of the keys of the peer addresses,
+	// which are followed by the address.  Each holds the services of the
+	// peer, the times it was last seen, attempted and connected to in
+	// little endian nanoseconds since the epoch, the number of attempts
+	// since the last success and the address it was learned from.
+	peerAddrPrefix = []byte("btcdb/peers/addr/")
+
+	// peerBanPrefix is the prefix of the keys of the ban scores, which are
+	// followed by the host.  Each holds the score followed by the time it
+	// expires in little endian nanoseconds since the epoch.
+	peerBanPrefix = []byte("btcdb/peers/ban/")
+)
+
+// peerAddrLen is the length of a serialized peer address without its source.
+const peerAddrLen = 8 + 3*8 + 4
+
+// PeerAddress is the address of a network peer kept with PutPeerAddress along
+// with what the address manager of a node knows about it.  Addr is the address
+// of the peer as host:port and Source the address of the peer it was learned
+// from.
+type PeerAddress struct {
+	Addr        string
+	Services    uint64
+	Source      string
+	LastSeen    time.Time
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Attempts    uint32
+}
+
+// PeerBan is the ban score of the network peers of a host kept with PutPeerBan
+// until it expires.
+type PeerBan struct {
+	Host    string
+	Score   uint32
+	Expires time.Time
+}
+
+// putPeerTime puts the passed time into the passed buffer as nanoseconds since
+// the epoch, where 0 stands for the zero time.
+func putPeerTime(buf []byte, t time.Time) {
+	var nsec int64
+	if !t.IsZero() {
+		nsec = t.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(buf, uint64(nsec))
+}
+
+// peerTime returns the time put into the passed buffer by putPeerTime.
+func peerTime(buf []byte) time.Time {
+	nsec := int64(binary.LittleEndian.Uint64(buf))
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// peerAddrKey returns the key of the passed peer address.
+func peerAddrKey(addr string) []byte {
+	return append(append([]byte(nil), peerAddrPrefix...), addr...)
+}
+
+// peerBanKey returns the key of the ban score of the passed host.
+func peerBanKey(host string) []byte {
+	return append(append([]byte(nil), peerBanPrefix...), host...)
+}
+
+// serializePeerAddress returns the stored form of the passed peer address.
+func serializePeerAddress(pa *PeerAddress) []byte {
+	val := make([]byte, peerAddrLen+len(pa.Source))
+	binary.LittleEndian.PutUint64(val[0:8], pa.Services)
+	putPeerTime(val[8:16], pa.LastSeen)
+	putPeerTime(val[16:24], pa.LastAttempt)
+	putPeerTime(val[24:32], pa.LastSuccess)
+	binary.LittleEndian.PutUint32(val[32:36], pa.Attempts)
+	copy(val[peerAddrLen:], pa.Source)
+	return val
+}
+
+// deserializePeerAddress returns the peer address stored under the passed key
+// with the passed value.
+func deserializePeerAddress(key, val []byte) (*PeerAddress, error) {
+	if len(val) < peerAddrLen {
+		return nil, fmt.Errorf("malformed peer address record %q", key)
+	}
+	return &PeerAddress{
+		Addr:        string(key[len(peerAddrPrefix):]),
+		Services:    binary.LittleEndian.Uint64(val[0:8]),
+		Source:      string(val[peerAddrLen:]),
+		LastSeen:    peerTime(val[8:16]),
+		LastAttempt: peerTime(val[16:24]),
+		LastSuccess: peerTime(val[24:32]),
+		Attempts:    binary.LittleEndian.Uint32(val[32:36]),
+	}, nil
+}
+
+// deserializePeerBan returns the ban score stored under the passed key with the
+// passed value.
+func deserializePeerBan(key, val []byte) (*PeerBan, error) {
+	if len(val) != 4+8 {
+		return nil, fmt.Errorf("malformed peer ban record %q", key)
+	}
+	return &PeerBan{
+		Host:    string(key[len(peerBanPrefix):]),
+		Score:   binary.LittleEndian.Uint32(val[0:4]),
+		Expires: peerTime(val[4:12]),
+	}, nil
+}
+
+// PutPeerAddress stores the passed peer address in the passed database,
+// replacing what is known about the same address.
+func PutPeerAddress(db Db, pa *PeerAddress) error {
+	if pa.Addr == "" {
+		return fmt.Errorf("peer address is empty")
+	}
+	return db.PutMeta(peerAddrKey(pa.Addr), serializePeerAddress(pa))
+}
+
+// FetchPeerAddress returns the peer address with the passed host:port stored
+// in the passed database.  ErrPeerNotFound is returned when the address is not
+// stored.
+func FetchPeerAddress(db Db, addr string) (*PeerAddress, error) {
+	key := peerAddrKey(addr)
+	val, err := db.GetMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrPeerNotFound
+	}
+	return deserializePeerAddress(key, val)
+}
+
+// ForEachPeerAddress calls the passed function with every peer address stored
+// in the passed database, ordered by address, and stops with the first error
+// it returns.
+func ForEachPeerAddress(db Db, fn func(pa *PeerAddress) error) error {
+	iter, err := db.MetaIterator(peerAddrPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		pa, err := deserializePeerAddress(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(pa); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// RemovePeerAddress removes the peer address with the passed host:port from the
+// passed database.  Nothing is done when the address is not stored.
+func RemovePeerAddress(db Db, addr string) error {
+	return db.DeleteMeta(peerAddrKey(addr))
+}
+
+// PutPeerBan stores the passed ban score in the passed database, replacing the
+// score of the same host.  A ban which has already expired removes the score.
+func PutPeerBan(db Db, ban *PeerBan) error {
+	if !ban.Expires.After(time.Now()) {
+		return db.DeleteMeta(peerBanKey(ban.Host))
+	}
+	val := make([]byte, 4+8)
+	binary.LittleEndian.PutUint32(val[0:4], ban.Score)
+	putPeerTime(val[4:12], ban.Expires)
+	return db.PutMeta(peerBanKey(ban.Host), val)
+}
+
+// FetchPeerBan returns the ban score of the passed host stored in the passed
+// database.  ErrPeerNotFound is returned when the host has no score or its
+// score has expired.
+func FetchPeerBan(db Db, host string) (*PeerBan, error) {
+	key := peerBanKey(host)
+	val, err := db.GetMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrPeerNotFound
+	}
+	ban, err := deserializePeerBan(key, val)
+	if err != nil {
+		return nil, err
+	}
+	if !ban.Expires.After(time.Now()) {
+		return nil, ErrPeerNotFound
+	}
+	return ban, nil
+}
+
+// ForEachPeerBan calls the passed function with every ban score stored in the
+// passed database which has not expired, ordered by host, and stops with the
+// first error it returns.
+func ForEachPeerBan(db Db, fn func(ban *PeerBan) error) error {
+	iter, err := db.MetaIterator(peerBanPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	now := time.Now()
+	for iter.Next() {
+		ban, err := deserializePeerBan(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+		if !ban.Expires.After(now) {
+			continue
+		}
+		if err := fn(ban); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// RemovePeerBan removes the ban score of the passed host from the passed
+// database.  Nothing is done when the host has no score.
+func RemovePeerBan(db Db, host string) error {
+	return db.DeleteMeta(peerBanKey(host))
+}
+
+// peerAddrsBySeen sorts peer addresses from the least to the most recently
+// seen.
+type peerAddrsBySeen []*PeerAddress
+
+func (s peerAddrsBySeen) Len() int {
+	return len(s)
+}
+
+func (s peerAddrsBySeen) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s peerAddrsBySeen) Less(i, j int) bool {
+	return s[i].LastSeen.Before(s[j].LastSeen)
+}
+
+// EvictPeers removes the expired ban scores from the passed database, along
+// with the peer addresses last seen longer than maxAge ago followed by the
+// least recently seen of the rest until no more than maxAddrs are left.  A
+// limit which is not positive is not applied.  It returns the number of
+// addresses and scores removed.
+func EvictPeers(db Db, maxAge time.Duration, maxAddrs int) (int, error) {
+	var meta MetaBatch
+	now := time.Now()
+	banIter, err := db.MetaIterator(peerBanPrefix)
+	if err != nil {
+		return 0, err
+	}
+	for banIter.Next() {
+		ban, err := deserializePeerBan(banIter.Key(), banIter.Value())
+		if err != nil {
+			banIter.Release()
+			return 0, err
+		}
+		if !ban.Expires.After(now) {
+			meta.Delete(banIter.Key())
+		}
+	}
+	err = banIter.Err()
+	banIter.Release()
+	if err != nil {
+		return 0, err
+	}
+
+	var addrs []*PeerAddress
+	err = ForEachPeerAddress(db, func(pa *PeerAddress) error {
+		addrs = append(addrs, pa)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(peerAddrsBySeen(addrs))
+
+	cutoff := now.Add(-maxAge)
+	left := len(addrs)
+	for _, pa := range addrs {
+		if (maxAge <= 0 || !pa.LastSeen.Before(cutoff)) &&
+			(maxAddrs <= 0 || left <= maxAddrs) {
+			break
+		}
+		meta.Delete(peerAddrKey(pa.Addr))
+		left--
+	}
+
+	if meta.Len() == 0 {
+		return 0, nil
+	}
+	log.Debugf("Evicting %d peer addresses and ban scores", meta.Len())
+	if err := db.WriteMeta(&meta); err != nil {
+		return 0, err
+	}
+	return meta.Len(), nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestPeers ensures peer addresses and ban scores are stored, listed, expired
+// and evicted for all supported database types.
+func TestPeers(t *testing.T) {
+	now := time.Unix(0, time.Now().UnixNano())
+	addrs := []*btcdb.PeerAddress{
+		{
+			Addr:        "10.0.0.1:8333",
+			Services:    1,
+			Source:      "10.0.0.9:8333",
+			LastSeen:    now.Add(-time.Hour),
+			LastAttempt: now.Add(-time.Minute),
+			LastSuccess: now.Add(-time.Hour),
+			Attempts:    2,
+		},
+		{
+			Addr:     "10.0.0.2:8333",
+			LastSeen: now.Add(-48 * time.Hour),
+		},
+		{
+			Addr:     "[::1]:18333",
+			Services: 1,
+			LastSeen: now.Add(-2 * time.Hour),
+		},
+	}
+
+	// checkAddrs ensures the stored peer addresses are the passed ones.
+	checkAddrs := func(dbType string, db btcdb.Db, want ...*btcdb.PeerAddress) {
+		var got []*btcdb.PeerAddress
+		err := btcdb.ForEachPeerAddress(db, func(pa *btcdb.PeerAddress) error {
+			got = append(got, pa)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ForEachPeerAddress (%s): got %d addresses (err "+
+				"%v), want %d", dbType, len(got), err, len(want))
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "peers", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+
+		for _, pa := range addrs {
+			if err := btcdb.PutPeerAddress(db, pa); err != nil {
+				t.Errorf("PutPeerAddress (%s): %v", dbType, err)
+			}
+		}
+		checkAddrs(dbType, db, addrs[0], addrs[1], addrs[2])
+		got, err := btcdb.FetchPeerAddress(db, addrs[0].Addr)
+		if err != nil || !reflect.DeepEqual(got, addrs[0]) {
+			t.Errorf("FetchPeerAddress (%s): got %+v (err %v), want "+
+				"%+v", dbType, got, err, addrs[0])
+		}
+		if _, err := btcdb.FetchPeerAddress(db, "10.0.0.3:8333"); err != btcdb.ErrPeerNotFound {
+			t.Errorf("FetchPeerAddress (%s): got %v for an unknown "+
+				"address, want %v", dbType, err,
+				btcdb.ErrPeerNotFound)
+		}
+
+		bans := []*btcdb.PeerBan{
+			{Host: "10.0.0.4", Score: 100, Expires: now.Add(time.Hour)},
+			{Host: "10.0.0.5", Score: 50, Expires: now.Add(time.Hour)},
+		}
+		for _, ban := range bans {
+			if err := btcdb.PutPeerBan(db, ban); err != nil {
+				t.Errorf("PutPeerBan (%s): %v", dbType, err)
+			}
+		}
+		ban, err := btcdb.FetchPeerBan(db, "10.0.0.4")
+		if err != nil || !reflect.DeepEqual(ban, bans[0]) {
+			t.Errorf("FetchPeerBan (%s): got %+v (err %v), want %+v",
+				dbType, ban, err, bans[0])
+		}
+
+		// A ban which expired in the meantime is no longer returned, but
+		// is only removed from the database by EvictPeers.
+		expiredKey := append([]byte("btcdb/peers/ban/"), "10.0.0.6"...)
+		expired := make([]byte, 12)
+		binary.LittleEndian.PutUint32(expired, 100)
+		binary.LittleEndian.PutUint64(expired[4:],
+			uint64(now.Add(-time.Second).UnixNano()))
+		if err := db.PutMeta(expiredKey, expired); err != nil {
+			t.Errorf("PutMeta (%s): %v", dbType, err)
+		}
+		if _, err := btcdb.FetchPeerBan(db, "10.0.0.6"); err != btcdb.ErrPeerNotFound {
+			t.Errorf("FetchPeerBan (%s): got %v for an expired ban, "+
+				"want %v", dbType, err, btcdb.ErrPeerNotFound)
+		}
+		var gotBans []*btcdb.PeerBan
+		err = btcdb.ForEachPeerBan(db, func(ban *btcdb.PeerBan) error {
+			gotBans = append(gotBans, ban)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(gotBans, bans) {
+			t.Errorf("ForEachPeerBan (%s): got %d bans (err %v), "+
+				"want %d", dbType, len(gotBans), err, len(bans))
+		}
+
+		// The expired ban and the address not seen for a day are evicted
+		// first, followed by the least recently seen of the rest.
+		n, err := btcdb.EvictPeers(db, 24*time.Hour, 0)
+		if err != nil || n != 2 {
+			t.Errorf("EvictPeers (%s): evicted %d (err %v), want 2",
+				dbType, n, err)
+		}
+		if val, _ := db.GetMeta(expiredKey); val != nil {
+			t.Errorf("EvictPeers (%s): expired ban is still stored",
+				dbType)
+		}
+		checkAddrs(dbType, db, addrs[0], addrs[2])
+		n, err = btcdb.EvictPeers(db, 0, 1)
+		if err != nil || n != 1 {
+			t.Errorf("EvictPeers (%s): evicted %d (err %v), want 1",
+				dbType, n, err)
+		}
+		checkAddrs(dbType, db, addrs[0])
+
+		if err := btcdb.RemovePeerAddress(db, addrs[0].Addr); err != nil {
+			t.Errorf("RemovePeerAddress (%s): %v", dbType, err)
+		}
+		checkAddrs(dbType, db)
+		if err := btcdb.RemovePeerBan(db, "10.0.0.4"); err != nil {
+			t.Errorf("RemovePeerBan (%s): %v", dbType, err)
+		}
+		if _, err := btcdb.FetchPeerBan(db, "10.0.0.4"); err != btcdb.ErrPeerNotFound {
+			t.Errorf("FetchPeerBan (%s): got %v after RemovePeerBan, "+
+				"want %v", dbType, err, btcdb.ErrPeerNotFound)
+		}
+		teardown()
+	}
+}
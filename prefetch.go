@@ -0,0 +1,276 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// prefetchedBlock is a block read ahead by a prefetchIterator.
+type prefetchedBlock struct {
+	sha    *btcwire.ShaHash
+	height int64
+	raw    []byte
+}
+
+// prefetchIterator implements BlockIterator on top of another BlockIterator
+// which is advanced on a goroutine of its own, so the blocks are read from the
+// backend while the caller processes the ones before them.
+type prefetchIterator struct {
+	it     BlockIterator
+	blocks chan prefetchedBlock
+	quit   chan struct{}
+	cur    prefetchedBlock
+
+	// err is set by the reading goroutine before it closes blocks, so it
+	// is only read once finished is set.
+	err      error
+	finished bool
+	released bool
+}
+
+// PrefetchBlockIterator returns a BlockIterator over the same blocks as the
+// passed one which reads up to the given number of blocks ahead of the caller
+// on a goroutine of its own, so scans are not bound by the latency of reading
+// each block in turn.  The passed iterator is returned as is when the number
+// is not positive.  The blocks returned by RawBytes of the passed iterator must
+// remain valid after it moves on.  It is intended for use by drivers.
+func PrefetchBlockIterator(it BlockIterator, depth int) BlockIterator {
+	if depth <= 0 {
+		return it
+	}
+	p := &prefetchIterator{
+		it:     it,
+		blocks: make(chan prefetchedBlock, depth),
+		quit:   make(chan struct{}),
+	}
+	go p.readAhead()
+	return p
+}
+
+// readAhead reads the blocks of the wrapped iterator until it ends or the
+// iterator is released.  It must be run as a goroutine.
+func (p *prefetchIterator) readAhead() {
+	defer close(p.blocks)
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		if !p.it.Next() {
+			p.err = p.it.Err()
+			return
+		}
+		blk := prefetchedBlock{
+			sha:    p.it.Sha(),
+			height: p.it.Height(),
+			raw:    p.it.RawBytes(),
+		}
+		select {
+		case p.blocks <- blk:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Next moves to the next block.  This is part of the BlockIterator interface
+// implementation.
+func (p *prefetchIterator) Next() bool {
+	if p.released || p.finished {
+		return false
+	}
+	blk, ok := <-p.blocks
+	if !ok {
+		p.finished = true
+		p.cur = prefetchedBlock{}
+		return false
+	}
+	p.cur = blk
+	return true
+}
+
+// Sha returns the hash of the current block.  This is part of the
+// BlockIterator interface implementation.
+func (p *prefetchIterator) Sha() *btcwire.ShaHash {
+	return p.cur.sha
+}
+
+// Height returns the height of the current block.  This is part of the
+// BlockIterator interface implementation.
+func (p *prefetchIterator) Height() int64 {
+	return p.cur.height
+}
+
+// RawBytes returns the serialized current block.  This is part of the
+// BlockIterator interface implementation.
+func (p *prefetchIterator) RawBytes() []byte {
+	return p.cur.raw
+}
+
+// Err returns the error which stopped the iteration.  This is part of the
+// BlockIterator interface implementation.
+func (p *prefetchIterator) Err() error {
+	if !p.finished {
+		return nil
+	}
+	return p.err
+}
+
+// Release stops reading ahead and releases the wrapped iterator.  This is part
+// of the BlockIterator interface implementation.
+func (p *prefetchIterator) Release() {
+	if p.released {
+		return
+	}
+	p.released = true
+
+	// The wrapped iterator is only released once the goroutine reading
+	// from it has stopped, which it signals by closing the channel.
+	close(p.quit)
+	for _ = range p.blocks {
+	}
+	p.it.Release()
+}
+
+// ReadAhead detects blocks being fetched or listed in height order and reads
+// the blocks following them into the block cache of a driver on a goroutine of
+// its own, so callers walking the chain find the blocks they ask for next in
+// the cache rather than waiting for the backend to read each in turn.  It is
+// intended for drivers, which create it with NewReadAhead and report each
+// block fetched with Fetched and each range of hashes listed with Listed.
+//
+// All functions are safe for concurrent use and do nothing on a nil ReadAhead,
+// which is what NewReadAhead returns when reading ahead is disabled.
+type ReadAhead struct {
+	depth int64
+	read  func(height int64) bool
+
+	mtx     sync.Mutex
+	wg      sync.WaitGroup
+	last    int64
+	listEnd int64
+	ahead   int64
+	running bool
+	stopped bool
+}
+
+// NewReadAhead returns a ReadAhead which keeps up to the given number of blocks
+// ahead of the caller read, or nil when the number is not positive.  The passed
+// function reads the block at the given height into the block cache and
+// returns whether reading ahead should go on, which it should not once the
+// block is not found or the database is closed.
+func NewReadAhead(depth int, read func(height int64) bool) *ReadAhead {
+	if depth <= 0 {
+		return nil
+	}
+	return &ReadAhead{depth: int64(depth), read: read, last: -2,
+		listEnd: -1, ahead: -1}
+}
+
+// Fetched notes that the block at the given height was fetched.  Once it
+// directly follows the block fetched before it, the blocks after it are read
+// ahead.
+func (r *ReadAhead) Fetched(height int64) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	sequential := height == r.last+1
+	r.last = height
+	if !sequential {
+		r.ahead = height
+		return
+	}
+
+	// More blocks are only read once half of those read ahead were
+	// fetched, so each goroutine reads a run of blocks.
+	if r.ahead-height >= r.depth/2 {
+		return
+	}
+	r.start(height+1, height+r.depth)
+}
+
+// Listed notes that the hashes of the blocks from the start height up to but
+// not including the end height were listed, such as by FetchHeightRange.
+// Once the range directly follows the range listed before it, the blocks of
+// the range are read ahead since the caller is likely to fetch them next.
+func (r *ReadAhead) Listed(start, end int64) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	sequential := start == r.listEnd
+	r.listEnd = end
+	if !sequential || end <= start {
+		return
+	}
+	last := start + r.depth - 1
+	if last >= end {
+		last = end - 1
+	}
+	r.start(start, last)
+}
+
+// start begins reading the blocks from the first through the last height
+// which were not read ahead already, unless blocks are already being read.
+//
+// This function must be called with the lock held.
+func (r *ReadAhead) start(first, last int64) {
+	if r.running || r.stopped {
+		return
+	}
+	if first <= r.ahead {
+		first = r.ahead + 1
+	}
+	if first > last {
+		return
+	}
+	r.ahead = last
+	r.running = true
+	r.wg.Add(1)
+	go r.readRange(first, last)
+}
+
+// readRange reads the blocks from the first through the last height.  It must
+// be run as a goroutine.
+func (r *ReadAhead) readRange(first, last int64) {
+	defer r.wg.Done()
+
+	for height := first; height <= last; height++ {
+		r.mtx.Lock()
+		stopped := r.stopped
+		r.mtx.Unlock()
+		if stopped || !r.read(height) {
+			break
+		}
+	}
+
+	r.mtx.Lock()
+	r.running = false
+	r.mtx.Unlock()
+}
+
+// Stop stops reading ahead and waits for the blocks being read to finish.
+// Drivers call it before closing the backend.
+func (r *ReadAhead) Stop() {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	r.stopped = true
+	r.mtx.Unlock()
+	r.wg.Wait()
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPrefetch ensures block iterators reading ahead return every block and
+// sequential fetches and listings read the following blocks into the cache.
+func TestPrefetch(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "prefetchdb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+
+		// The blocks are inserted without a cache so the reopened
+		// database only caches the blocks it reads.
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+		opts.BlockCacheSize = 1024 * 1024
+		opts.PrefetchDepth = 4
+		memDb := dbType == "memory"
+		if !memDb {
+			db.Close()
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+		}
+
+		it, err := db.BlockIterator(0)
+		if err != nil {
+			t.Errorf("BlockIterator (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+		var height int64
+		for ; it.Next(); height++ {
+			sha, _ := blocks[height].Sha()
+			raw, _ := blocks[height].Bytes()
+			if it.Height() != height || !it.Sha().IsEqual(sha) ||
+				!bytes.Equal(it.RawBytes(), raw) {
+				t.Errorf("BlockIterator (%s): block %d mismatch",
+					dbType, height)
+			}
+		}
+		if it.Err() != nil || height != int64(len(blocks)) {
+			t.Errorf("BlockIterator (%s): got %d blocks (%v), "+
+				"want %d", dbType, height, it.Err(), len(blocks))
+		}
+		it.Release()
+
+		// Releasing an iterator which is still reading ahead stops it.
+		it, err = db.BlockIterator(0)
+		if err == nil {
+			if !it.Next() {
+				t.Errorf("BlockIterator (%s): no blocks", dbType)
+			}
+			it.Release()
+			if it.Next() {
+				t.Errorf("BlockIterator (%s): got a block after "+
+					"release", dbType)
+			}
+		}
+
+		// A memory database has nothing to cache.
+		if memDb {
+			db.Close()
+			continue
+		}
+
+		// Fetching blocks 0 and 1 reads blocks 2 through 5 ahead.
+		for i := 0; i < 2; i++ {
+			sha, _ := blocks[i].Sha()
+			if _, err := db.FetchBlockBySha(sha); err != nil {
+				t.Errorf("FetchBlockBySha (%s): %v", dbType, err)
+			}
+		}
+		if !waitForCachedBlocks(db, 6) {
+			t.Errorf("FetchBlockBySha (%s): blocks were not read "+
+				"ahead, got %+v", dbType, db.BlockCacheStats())
+		}
+		stats := db.BlockCacheStats()
+		for i := 2; i < 6; i++ {
+			sha, _ := blocks[i].Sha()
+			blk, err := db.FetchBlockBySha(sha)
+			if err != nil || blk.Height() != int64(i) {
+				t.Errorf("FetchBlockBySha (%s): block %d mismatch "+
+					"(%v)", dbType, i, err)
+			}
+		}
+		if got := db.BlockCacheStats(); got.Hits != stats.Hits+4 {
+			t.Errorf("FetchBlockBySha (%s): got %d hits, want %d",
+				dbType, got.Hits, stats.Hits+4)
+		}
+		db.Close()
+
+		// Listing the hashes of consecutive ranges reads the blocks of
+		// the second one ahead.
+		db, err = btcdb.OpenDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		for _, start := range []int64{0, 5} {
+			if _, err := db.FetchHeightRange(start, start+5); err != nil {
+				t.Errorf("FetchHeightRange (%s): %v", dbType, err)
+			}
+		}
+		if !waitForCachedBlocks(db, 4) {
+			t.Errorf("FetchHeightRange (%s): blocks were not read "+
+				"ahead, got %+v", dbType, db.BlockCacheStats())
+		}
+		sha, _ := blocks[5].Sha()
+		db.FetchBlockBySha(sha)
+		if got := db.BlockCacheStats(); got.Hits != 1 {
+			t.Errorf("FetchHeightRange (%s): got %+v after fetching "+
+				"a block read ahead", dbType, got)
+		}
+		db.Close()
+	}
+}
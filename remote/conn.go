@@ -0,0 +1,250 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrConnLost is returned by the functions of a remote database once its
+// connection to the server has failed.
+var ErrConnLost = errors.New("Connection to the remote database was lost")
+
+// callBuffer is the number of frames of a request which are buffered for the
+// caller before the connection stops reading further frames.
+const callBuffer = 16
+
+// call is a request in progress.
+type call struct {
+	id     uint32
+	frames chan *frame
+
+	// quit is closed once the caller no longer waits for the frames of
+	// the request.
+	quit chan struct{}
+}
+
+// conn is the connection of a client to a server.  Requests are sent with
+// their own id, so any number of them may be in progress at once, and the
+// replies are read by a single goroutine which passes them to the waiting
+// callers.
+type conn struct {
+	nc net.Conn
+
+	// wmtx serializes the frames written to the connection.
+	wmtx sync.Mutex
+
+	// mtx protects the fields below.  Once the connection is closed, err
+	// holds the error returned by further requests and done is closed.
+	mtx    sync.Mutex
+	calls  map[uint32]*call
+	nextID uint32
+	err    error
+	done   chan struct{}
+}
+
+// newConn starts a client connection over the passed network connection,
+// greeting the server with an opHello request.
+func newConn(nc net.Conn) (*conn, error) {
+	c := &conn{
+		nc:    nc,
+		calls: make(map[uint32]*call),
+		done:  make(chan struct{}),
+	}
+	go c.readFrames()
+
+	var e encoder
+	e.buf.Write(protocolMagic)
+	e.putUvarint(protocolVersion)
+	d, err := c.roundTrip(context.Background(), opHello, e.bytes(), nil)
+	if err != nil {
+		c.close(ErrConnLost)
+		return nil, err
+	}
+	version := d.uvarint()
+	if err := d.err(); err != nil {
+		c.close(ErrConnLost)
+		return nil, err
+	}
+	if version != protocolVersion {
+		c.close(ErrConnLost)
+		return nil, fmt.Errorf("server speaks protocol version %d, "+
+			"not %d", version, protocolVersion)
+	}
+	return c, nil
+}
+
+// close closes the connection.  Requests in progress and later requests return
+// the passed error.
+func (c *conn) close(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.nc.Close()
+}
+
+// closedErr returns the error requests return once the connection is closed.
+func (c *conn) closedErr() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.err
+}
+
+// readFrames reads the replies of the server and passes each of them to the
+// caller waiting for it until the connection is closed.  It must be run as a
+// goroutine.
+func (c *conn) readFrames() {
+	r := bufio.NewReader(c.nc)
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			if c.closedErr() == nil {
+				log.Warnf("Connection to %v lost: %v",
+					c.nc.RemoteAddr(), err)
+			}
+			c.close(ErrConnLost)
+			return
+		}
+
+		c.mtx.Lock()
+		cl := c.calls[f.id]
+		c.mtx.Unlock()
+		if cl == nil {
+			// The caller has stopped waiting for the request.
+			continue
+		}
+		select {
+		case cl.frames <- f:
+		case <-cl.quit:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// start sends a request and returns the call the replies to it are passed to.
+// The caller must end the call with finish.
+func (c *conn) start(op uint8, payload []byte) (*call, error) {
+	c.mtx.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mtx.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	cl := &call{
+		id:     c.nextID,
+		frames: make(chan *frame, callBuffer),
+		quit:   make(chan struct{}),
+	}
+	c.calls[cl.id] = cl
+	c.mtx.Unlock()
+
+	c.wmtx.Lock()
+	err := writeFrame(c.nc, cl.id, op, payload)
+	c.wmtx.Unlock()
+	if err != nil {
+		c.finish(cl, false)
+		if closedErr := c.closedErr(); closedErr != nil {
+			return nil, closedErr
+		}
+		c.close(ErrConnLost)
+		return nil, ErrConnLost
+	}
+	return cl, nil
+}
+
+// next returns the next frame of a call.  It returns the error of the context
+// once it is done, and the error of the connection once it is closed.
+func (c *conn) next(ctx context.Context, cl *call) (*frame, error) {
+	select {
+	case f := <-cl.frames:
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		// Frames which arrived before the connection was closed are
+		// still passed on.
+		select {
+		case f := <-cl.frames:
+			return f, nil
+		default:
+		}
+		return nil, c.closedErr()
+	}
+}
+
+// finish ends a call.  When cancel is set, the server is told to stop working
+// on the request, which is done for requests abandoned before their reply.
+func (c *conn) finish(cl *call, cancel bool) {
+	c.mtx.Lock()
+	delete(c.calls, cl.id)
+	closed := c.err != nil
+	c.mtx.Unlock()
+	close(cl.quit)
+
+	if cancel && !closed {
+		c.wmtx.Lock()
+		writeFrame(c.nc, cl.id, opCancel, nil)
+		c.wmtx.Unlock()
+	}
+}
+
+// roundTrip sends a request and returns the decoder of the payload of its
+// reply, or the error the server answered with.  The replyData frames which
+// come before the reply are passed to onData, which stops the request when it
+// returns an error.
+func (c *conn) roundTrip(ctx context.Context, op uint8, payload []byte, onData func(d *decoder) error) (*decoder, error) {
+	cl, err := c.start(op, payload)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		f, err := c.next(ctx, cl)
+		if err != nil {
+			c.finish(cl, true)
+			return nil, err
+		}
+
+		switch f.kind {
+		case replyOK:
+			c.finish(cl, false)
+			return newDecoder(f.payload), nil
+
+		case replyErr:
+			c.finish(cl, false)
+			d := newDecoder(f.payload)
+			err := d.error()
+			if derr := d.err(); derr != nil {
+				return nil, derr
+			}
+			return nil, err
+
+		case replyData:
+			if onData == nil {
+				continue
+			}
+			if err := onData(newDecoder(f.payload)); err != nil {
+				c.finish(cl, true)
+				return nil, err
+			}
+
+		default:
+			c.finish(cl, true)
+			return nil, errMalformed
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package remote implements a btcdb driver which proxies a database served by
+another process, so the processes of several machines can share one store.
+
+A database is served by a Server, which takes an open database of any other
+driver and accepts clients on a listener:
+
+	s := remote.NewServer(db)
+	err := s.Serve(listener)
+
+Clients open the database through the "remote" driver with the address of the
+server, given as network://address where the network is tcp, tcp4, tcp6 or
+unix:
+
+	db, err := btcdb.CreateDB("remote", "tcp://node.example.com:8341")
+	if err != nil {
+		// Log and handle the error
+	}
+	defer db.Close()
+
+CreateDB and OpenDB are the same, since the database is created by the process
+serving it.  Of the fields of btcdb.Options, only ReadOnly applies, and changes
+made through a read-only client return btcdb.ErrReadOnly without reaching the
+server.
+
+Protocol
+
+Each client uses a single connection carrying frames of the form
+
+	length  uint32, little endian, of the rest of the frame
+	id      uint32, little endian
+	kind    uint8
+	payload
+
+where the kind of a request is its operation and the kind of a reply is OK,
+error or data.  Requests carry an id chosen by the client, so any number of
+them may be in progress at once, and their replies may arrive in any order.
+Streams, such as subscriptions, progress reports and exported blocks, are sent
+as data frames before the final reply.  A client cancels a request it no longer
+waits for, such as one whose context is done, with a cancel frame of the same
+id.  Integers within payloads are varints, and blocks, headers and
+transactions use their wire encoding.
+
+Errors of the database, such as btcdb.ErrBlockNotFound and btcdb.ErrDbClosed,
+are returned to clients as themselves, and corruption errors keep their type.
+Other errors are returned with their message alone.
+
+Snapshots and iterators are held by the server until they are released, or
+until the connection of their client is closed.
+
+Differences from local databases
+
+Closing a client closes its connection alone, and leaves the database open for
+the other clients of the server.  The path passed to Backup is a path on the
+machine of the server.  Indexers run within the changes of the database, so
+they must be added in the server process, and AddIndexer returns
+ErrUnsupported.  Should the connection fail, the functions of the client
+return ErrConnLost.
+*/
+package remote
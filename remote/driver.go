@@ -0,0 +1,95 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"net"
+	"strings"
+	"time"
+)
+
+var log = btcdb.DriverLogger("remote")
+
+// dialTimeout is how long connecting to a server may take.
+const dialTimeout = 30 * time.Second
+
+func init() {
+	driver := btcdb.DriverDB{DbType: "remote", CreateDB: CreateDB, OpenDB: OpenDB}
+	btcdb.AddDBDriver(driver)
+}
+
+// parseArgs parses the arguments from the btcdb Open/Create methods.  The
+// database is described by either the address of its server or a
+// btcdb.Options whose Path is the address.
+func parseArgs(funcName string, args ...interface{}) (*btcdb.Options, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Invalid arguments to remote.%s -- "+
+			"expected server address string or options", funcName)
+	}
+	switch arg := args[0].(type) {
+	case string:
+		return &btcdb.Options{Path: arg}, nil
+	case btcdb.Options:
+		return &arg, nil
+	}
+	return nil, fmt.Errorf("First argument to remote.%s is invalid -- "+
+		"expected server address string or options", funcName)
+}
+
+// parseAddr splits an address of the form network://address, such as
+// tcp://host:port or unix:///path/to/socket, into its network and address.
+func parseAddr(addr string) (string, string, error) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid server address %q -- "+
+			"expected tcp://host:port or unix://path", addr)
+	}
+	switch parts[0] {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("unsupported network %q in server address "+
+		"%q", parts[0], addr)
+}
+
+// OpenDB connects to the server of a database.
+func OpenDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, err := parseArgs("OpenDB", args...)
+	if err != nil {
+		return nil, err
+	}
+	return openDB(dbOpts)
+}
+
+// CreateDB connects to the server of a database.  Databases are created by the
+// process serving them, so it is the same as OpenDB.
+func CreateDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, err := parseArgs("CreateDB", args...)
+	if err != nil {
+		return nil, err
+	}
+	return openDB(dbOpts)
+}
+
+// openDB connects to the server at the address in the passed options.  Of the
+// options, only ReadOnly applies, which refuses changes before they are sent
+// to the server.
+func openDB(dbOpts *btcdb.Options) (btcdb.Db, error) {
+	network, addr, err := parseAddr(dbOpts.Path)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := net.DialTimeout(network, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newConn(nc)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteDb{view: view{c: c}, readOnly: dbOpts.ReadOnly}, nil
+}
@@ -0,0 +1,522 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// protocolVersion is the version of the protocol spoken by this package.  It
+// is exchanged in the opHello request which starts every connection.
+const protocolVersion = 6
+
+// protocolMagic starts the payload of opHello requests so servers can tell
+// clients of the protocol from other connections.
+var protocolMagic = []byte("btcdbrpc")
+
+// maxFrameSize is the largest frame accepted from the other side of a
+// connection.  It leaves room for the largest block batches and iterator
+// chunks sent by this package.
+const maxFrameSize = 64 * 1024 * 1024
+
+// frameHeaderLen is the length of the header of a frame: the length of the rest
+// of the frame, the id of the request and the operation or reply kind.
+const frameHeaderLen = 9
+
+// Operations of requests.  Requests which read the database start with the
+// handle of the snapshot they read, with zero for the database itself.
+const (
+	opHello uint8 = iota
+	opCancel
+	opExistsShas
+	opFetchBlock
+	opFetchBlockRegion
+	opFetchBlockHeight
+	opFetchHeaderBySha
+	opFetchShaByHeight
+	opFetchHeaderByHeight
+	opFetchHeaderRange
+	opFetchHeightRange
+	opFetchChainWork
+	opBlockLocatorFromSha
+	opLatestBlockLocator
+	opExistsTxShas
+	opFetchTxBySha
+	opFetchTxByShaList
+	opFetchUnSpentTxByShaList
+	opFetchUtxoEntry
+	opFetchSpendingTx
+	opFetchFilter
+	opFetchFilterHeader
+	opFetchFilterRange
+	opFetchFilterHeaderRange
+	opUtxoSetSize
+	opNewestSha
+	opGetMeta
+	opMetaIterator
+	opInsertBlocks
+	opDropAfter
+	opWriteMeta
+	opBlockIterator
+	opIteratorNext
+	opSnapshot
+	opRelease
+	opSubscribe
+	opVerifyIntegrity
+	opBackup
+	opExportBootstrap
+	opBlockCacheStats
+	opSync
+	opReorganize
+	opIsOutpointSpent
+	opReverseMetaIterator
+)
+
+// Kinds of replies.  Every request is answered by a single replyOK or
+// replyErr frame, which may be preceded by replyData frames for requests which
+// stream data, such as the progress of VerifyIntegrity and subscriptions.
+const (
+	replyOK uint8 = iota
+	replyErr
+	replyData
+)
+
+// frame is a request or reply read from a connection.
+type frame struct {
+	id      uint32
+	kind    uint8
+	payload []byte
+}
+
+// writeFrame writes a frame to the passed writer.  Writes of frames from
+// several goroutines must be serialized by the caller.
+func writeFrame(w io.Writer, id uint32, kind uint8, payload []byte) error {
+	buf := make([]byte, frameHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)+5))
+	binary.LittleEndian.PutUint32(buf[4:8], id)
+	buf[8] = kind
+	copy(buf[frameHeaderLen:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a frame from the passed reader.
+func readFrame(r io.Reader) (*frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(hdr[0:4])
+	if length < 5 || length > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame length %d", length)
+	}
+	f := &frame{
+		id:      binary.LittleEndian.Uint32(hdr[4:8]),
+		kind:    hdr[8],
+		payload: make([]byte, length-5),
+	}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// errMalformed is returned when a payload can't be decoded.
+var errMalformed = errors.New("malformed message")
+
+// encoder builds the payload of a frame.  Integers are written as varints and
+// byte slices and strings with their length in front of them.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+// bytes returns the encoded payload.
+func (e *encoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// putUvarint writes an unsigned integer.
+func (e *encoder) putUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+// putVarint writes a signed integer.
+func (e *encoder) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// putBool writes a boolean.
+func (e *encoder) putBool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+// putBytes writes a byte slice.
+func (e *encoder) putBytes(b []byte) {
+	e.putUvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+// putString writes a string.
+func (e *encoder) putString(s string) {
+	e.putUvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// putSha writes a hash.
+func (e *encoder) putSha(sha *btcwire.ShaHash) {
+	e.buf.Write(sha[:])
+}
+
+// putShas writes a list of hashes.
+func (e *encoder) putShas(shas []btcwire.ShaHash) {
+	e.putUvarint(uint64(len(shas)))
+	for i := range shas {
+		e.putSha(&shas[i])
+	}
+}
+
+// putOutPoint writes a transaction output.
+func (e *encoder) putOutPoint(op *btcwire.OutPoint) {
+	e.putSha(&op.Hash)
+	e.putUvarint(uint64(op.Index))
+}
+
+// putMeta writes the changes of a metadata batch, which may be nil.
+func (e *encoder) putMeta(meta *btcdb.MetaBatch) {
+	ops := meta.Ops()
+	e.putUvarint(uint64(len(ops)))
+	for _, op := range ops {
+		e.putBytes(op.Key)
+		e.putBool(op.Delete)
+		if !op.Delete {
+			e.putBytes(op.Value)
+		}
+	}
+}
+
+// putHeader writes a serialized block header.
+func (e *encoder) putHeader(bh *btcwire.BlockHeader) error {
+	var buf bytes.Buffer
+	if err := bh.Serialize(&buf); err != nil {
+		return err
+	}
+	e.putBytes(buf.Bytes())
+	return nil
+}
+
+// putTxReplies writes the records of transactions.
+func (e *encoder) putTxReplies(replies []*btcdb.TxListReply) error {
+	e.putUvarint(uint64(len(replies)))
+	for _, r := range replies {
+		e.putBool(r.Sha != nil)
+		if r.Sha != nil {
+			e.putSha(r.Sha)
+		}
+		var raw []byte
+		if r.Tx != nil {
+			var buf bytes.Buffer
+			if err := r.Tx.Serialize(&buf); err != nil {
+				return err
+			}
+			raw = buf.Bytes()
+		}
+		e.putBytes(raw)
+		e.putBool(r.BlkSha != nil)
+		if r.BlkSha != nil {
+			e.putSha(r.BlkSha)
+		}
+		e.putVarint(r.Height)
+		e.putVarint(int64(r.BlkIndex))
+		e.putUvarint(uint64(len(r.TxSpent)))
+		for _, spent := range r.TxSpent {
+			e.putBool(spent)
+		}
+		e.putBool(r.FullySpent)
+		e.putError(r.Err)
+	}
+	return nil
+}
+
+// sentinelErrors are the errors which are passed to the other side of a
+// connection as themselves.  Their position in the list identifies them, so
+// errors may only be added to the end.
+var sentinelErrors = []error{
+	btcdb.PrevShaMissing,
+	btcdb.TxShaMissing,
+	btcdb.DuplicateSha,
+	btcdb.DbDoesNotExist,
+	btcdb.DbUnknownType,
+	btcdb.ErrBlockNotFound,
+	btcdb.ErrDbClosed,
+	btcdb.ErrReadOnly,
+	btcdb.ErrCorruption,
+	btcdb.ErrInvalidRegion,
+	btcdb.ErrNoSpendIndex,
+	btcdb.ErrNoFilterIndex,
+	btcdb.ErrHeadersOnly,
+	btcdb.ErrPruned,
+	btcdb.ErrEmptyMetaKey,
+	btcdb.ErrBackupUnsupported,
+	btcdb.ErrUpgradeRequired,
+	btcdb.ErrDbBusy,
+	context.Canceled,
+	context.DeadlineExceeded,
+	ErrUnsupported,
+}
+
+// Codes of errors which are not in sentinelErrors.
+const (
+	errCodeNone       = 0
+	errCodeMessage    = 1
+	errCodeCorruption = 2
+	errCodeSentinel   = 3
+)
+
+// putError writes an error, which may be nil.  Errors of other types than
+// those of btcdb are passed as their message.
+func (e *encoder) putError(err error) {
+	if err == nil {
+		e.putUvarint(errCodeNone)
+		return
+	}
+	for i, sentinel := range sentinelErrors {
+		if err == sentinel {
+			e.putUvarint(uint64(errCodeSentinel + i))
+			return
+		}
+	}
+	if cerr, ok := err.(*btcdb.CorruptionError); ok {
+		e.putUvarint(errCodeCorruption)
+		e.putBytes(cerr.Key)
+		return
+	}
+	e.putUvarint(errCodeMessage)
+	e.putString(err.Error())
+}
+
+// decoder reads the payload of a frame.  The first failure is kept and
+// returned by err, and later reads return zero values, so payloads can be read
+// in full before checking for errors.
+type decoder struct {
+	buf []byte
+	bad bool
+}
+
+// newDecoder returns a decoder reading the passed payload.
+func newDecoder(payload []byte) *decoder {
+	return &decoder{buf: payload}
+}
+
+// err returns errMalformed if a read has failed or data is left over.
+func (d *decoder) err() error {
+	if d.bad || len(d.buf) != 0 {
+		return errMalformed
+	}
+	return nil
+}
+
+// fail marks the payload as malformed.
+func (d *decoder) fail() {
+	d.bad = true
+	d.buf = nil
+}
+
+// uvarint reads an unsigned integer.
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// varint reads a signed integer.
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads the length of a list whose entries take at least the passed
+// number of bytes, so malformed lengths can't cause huge allocations.
+func (d *decoder) count(minSize int) int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)/minSize) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+// bool reads a boolean.
+func (d *decoder) bool() bool {
+	if len(d.buf) == 0 {
+		d.fail()
+		return false
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	return v != 0
+}
+
+// bytes reads a byte slice.  The returned slice is a copy.
+func (d *decoder) bytes() []byte {
+	n := d.count(1)
+	b := make([]byte, n)
+	copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return b
+}
+
+// string reads a string.
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// sha reads a hash.
+func (d *decoder) sha() *btcwire.ShaHash {
+	var sha btcwire.ShaHash
+	if len(d.buf) < btcwire.HashSize {
+		d.fail()
+		return &sha
+	}
+	copy(sha[:], d.buf)
+	d.buf = d.buf[btcwire.HashSize:]
+	return &sha
+}
+
+// shas reads a list of hashes.
+func (d *decoder) shas() []btcwire.ShaHash {
+	shas := make([]btcwire.ShaHash, d.count(btcwire.HashSize))
+	for i := range shas {
+		shas[i] = *d.sha()
+	}
+	return shas
+}
+
+// shaPtrs reads a list of hashes as pointers.
+func (d *decoder) shaPtrs() []*btcwire.ShaHash {
+	shas := make([]*btcwire.ShaHash, d.count(btcwire.HashSize))
+	for i := range shas {
+		shas[i] = d.sha()
+	}
+	return shas
+}
+
+// outPoint reads a transaction output.
+func (d *decoder) outPoint() *btcwire.OutPoint {
+	sha := d.sha()
+	return btcwire.NewOutPoint(sha, uint32(d.uvarint()))
+}
+
+// meta reads the changes of a metadata batch.  It returns nil when there are
+// none.
+func (d *decoder) meta() *btcdb.MetaBatch {
+	n := d.count(2)
+	if n == 0 {
+		return nil
+	}
+	meta := new(btcdb.MetaBatch)
+	for i := 0; i < n; i++ {
+		key := d.bytes()
+		if d.bool() {
+			meta.Delete(key)
+		} else {
+			meta.Put(key, d.bytes())
+		}
+	}
+	return meta
+}
+
+// header reads a serialized block header.
+func (d *decoder) header() *btcwire.BlockHeader {
+	var bh btcwire.BlockHeader
+	if err := bh.Deserialize(bytes.NewReader(d.bytes())); err != nil {
+		d.fail()
+	}
+	return &bh
+}
+
+// block reads a serialized block.
+func (d *decoder) block() *btcutil.Block {
+	blk, err := btcutil.NewBlockFromBytes(d.bytes())
+	if err != nil {
+		d.fail()
+		return nil
+	}
+	return blk
+}
+
+// txReplies reads the records of transactions.
+func (d *decoder) txReplies() []*btcdb.TxListReply {
+	replies := make([]*btcdb.TxListReply, d.count(7))
+	for i := range replies {
+		r := new(btcdb.TxListReply)
+		if d.bool() {
+			r.Sha = d.sha()
+		}
+		if raw := d.bytes(); len(raw) != 0 {
+			var tx btcwire.MsgTx
+			if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+				d.fail()
+			}
+			r.Tx = &tx
+		}
+		if d.bool() {
+			r.BlkSha = d.sha()
+		}
+		r.Height = d.varint()
+		r.BlkIndex = int(d.varint())
+		if n := d.count(1); n != 0 {
+			r.TxSpent = make([]bool, n)
+			for j := range r.TxSpent {
+				r.TxSpent[j] = d.bool()
+			}
+		}
+		r.FullySpent = d.bool()
+		r.Err = d.error()
+		replies[i] = r
+	}
+	return replies
+}
+
+// error reads an error, which may be nil.
+func (d *decoder) error() error {
+	code := d.uvarint()
+	switch code {
+	case errCodeNone:
+		return nil
+	case errCodeMessage:
+		return errors.New(d.string())
+	case errCodeCorruption:
+		return &btcdb.CorruptionError{Key: d.bytes()}
+	}
+	i := code - errCodeSentinel
+	if i >= uint64(len(sentinelErrors)) {
+		d.fail()
+		return errMalformed
+	}
+	return sentinelErrors[i]
+}
@@ -0,0 +1,598 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"sync"
+)
+
+// ErrUnsupported is returned by AddIndexer, since indexers are updated in the
+// same change as the blocks they index and so must be added to the database in
+// the server process.
+var ErrUnsupported = errors.New("Function is not supported by remote " +
+	"databases")
+
+// RemoteDb is a database served by another process through a Server.  It
+// proxies every function of btcdb.Db to the server over a single connection,
+// which carries any number of requests at a time.
+type RemoteDb struct {
+	view
+	readOnly bool
+
+	// mtx protects closed and notifier.  The notifier is set while a
+	// subscription on the server feeds it.
+	mtx      sync.Mutex
+	closed   bool
+	notifier *btcdb.Notifier
+}
+
+// Ensure RemoteDb implements the btcdb.Db interface.
+var _ btcdb.Db = (*RemoteDb)(nil)
+
+// Close closes the connection to the server, which leaves the database open
+// for its other clients.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) Close() {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	if db.closed {
+		return
+	}
+	db.closed = true
+	db.c.close(btcdb.ErrDbClosed)
+	if db.notifier != nil {
+		db.notifier.Close()
+		db.notifier = nil
+	}
+}
+
+// Closed returns whether the database has been closed.  This is part of the
+// btcdb.Db interface implementation.
+func (db *RemoteDb) Closed() bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	return db.closed
+}
+
+// RollbackClose is the same as Close, since every change is committed by the
+// server before it is reported as complete.  This is part of the btcdb.Db
+// interface implementation.
+func (db *RemoteDb) RollbackClose() {
+	db.Close()
+}
+
+// Sync has the server sync the database to disk.  This is part of the btcdb.Db
+// interface implementation.
+func (db *RemoteDb) Sync() {
+	if _, err := db.c.roundTrip(context.Background(), opSync, nil, nil); err != nil {
+		log.Warnf("Sync: %v", err)
+	}
+}
+
+// FetchBlockByShaCtx returns a btcutil.Block unless the passed context is done
+// first.  This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	return db.fetchBlockBySha(ctx, sha)
+}
+
+// FetchHeaderRangeCtx returns the block headers from the start height up to but
+// not including the end height unless the passed context is done first.  This
+// is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return db.fetchHeaderRange(ctx, startHeight, endHeight)
+}
+
+// FetchHeightRangeCtx looks up a range of blocks by the start and ending
+// heights unless the passed context is done first.  This is part of the
+// btcdb.Db interface implementation.
+func (db *RemoteDb) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	return db.fetchHeightRange(ctx, startHeight, endHeight)
+}
+
+// insertBlocks sends the passed blocks and metadata changes to be inserted.
+func (db *RemoteDb) insertBlocks(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	return db.sendBlocks(opInsertBlocks, nil, blocks, meta)
+}
+
+// sendBlocks sends the passed blocks and metadata changes with the passed
+// operation, preceded by the given hash unless it is nil, and returns the
+// heights the blocks were inserted at.
+func (db *RemoteDb) sendBlocks(op uint8, sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	if db.readOnly {
+		return nil, btcdb.ErrReadOnly
+	}
+
+	var e encoder
+	if sha != nil {
+		e.putSha(sha)
+	}
+	e.putUvarint(uint64(len(blocks)))
+	for _, block := range blocks {
+		raw, err := block.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		e.putBytes(raw)
+	}
+	e.putMeta(meta)
+	d, err := db.c.roundTrip(context.Background(), op, e.bytes(), nil)
+	if err != nil {
+		return nil, err
+	}
+	heights := make([]int64, d.count(1))
+	for i := range heights {
+		heights[i] = d.varint()
+	}
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// InsertBlock inserts raw block and transaction data from a block into the
+// database.  The first block inserted into the database will be treated as the
+// genesis block.  Every separate insert is a round trip to the server, so
+// InsertBlocks should be preferred for runs of blocks.  This is part of the
+// btcdb.Db interface implementation.
+func (db *RemoteDb) InsertBlock(block *btcutil.Block) (int64, error) {
+	heights, err := db.insertBlocks([]*btcutil.Block{block}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(heights) != 1 {
+		return 0, errMalformed
+	}
+	return heights[0], nil
+}
+
+// InsertBlocks inserts the passed blocks, which must connect to each other in
+// order, in a single atomic change.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) InsertBlocks(blocks []*btcutil.Block) ([]int64, error) {
+	return db.insertBlocks(blocks, nil)
+}
+
+// InsertBlocksWithMeta inserts the passed blocks along with the changes to the
+// metadata namespace in a single atomic change.  This is part of the btcdb.Db
+// interface implementation.
+func (db *RemoteDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	return db.insertBlocks(blocks, meta)
+}
+
+// DropAfterBlockBySha removes all blocks from the database after the given
+// block.  This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	return db.DropAfterBlockByShaWithMeta(sha, nil)
+}
+
+// DropAfterBlockByShaWithMeta removes all blocks after the given block along
+// with applying the changes to the metadata namespace in a single atomic
+// change.  This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	var e encoder
+	e.putSha(sha)
+	e.putMeta(meta)
+	_, err := db.c.roundTrip(context.Background(), opDropAfter, e.bytes(),
+		nil)
+	return err
+}
+
+// ReorganizeWithMeta removes all blocks after the given block, inserts the
+// passed blocks after it and applies the changes to the metadata namespace in
+// a single atomic change.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	return db.sendBlocks(opReorganize, sha, blocks, meta)
+}
+
+// PutMeta stores the value under the given key in the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) PutMeta(key, value []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Put(key, value)
+	return db.WriteMeta(&meta)
+}
+
+// DeleteMeta removes the given key from the metadata namespace.  This is part
+// of the btcdb.Db interface implementation.
+func (db *RemoteDb) DeleteMeta(key []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Delete(key)
+	return db.WriteMeta(&meta)
+}
+
+// WriteMeta applies the changes in the passed batch to the metadata namespace
+// atomically.  This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) WriteMeta(meta *btcdb.MetaBatch) error {
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+
+	var e encoder
+	e.putMeta(meta)
+	_, err := db.c.roundTrip(context.Background(), opWriteMeta, e.bytes(),
+		nil)
+	return err
+}
+
+// BlockIterator returns an iterator over the blocks of the chain in height
+// order beginning at the given height.  The blocks are transferred in batches
+// as the iterator advances.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) BlockIterator(startHeight int64) (btcdb.BlockIterator, error) {
+	it, err := db.blockIterator(context.Background(), startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// BlockIteratorCtx returns an iterator over the blocks of the chain beginning
+// at the given height which stops once the passed context is done.  This is
+// part of the btcdb.Db interface implementation.
+func (db *RemoteDb) BlockIteratorCtx(ctx context.Context, startHeight int64) (btcdb.BlockIterator, error) {
+	it, err := db.blockIterator(ctx, startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.ContextBlockIterator(ctx, it), nil
+}
+
+// blockIterator opens an iterator on the server.
+func (db *RemoteDb) blockIterator(ctx context.Context, startHeight int64) (*blockIterator, error) {
+	var e encoder
+	e.putVarint(startHeight)
+	d, err := db.c.roundTrip(ctx, opBlockIterator, e.bytes(), nil)
+	if err != nil {
+		return nil, err
+	}
+	handle := d.uvarint()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return &blockIterator{c: db.c, ctx: ctx, handle: handle, more: true},
+		nil
+}
+
+// TxIterator returns an iterator over every transaction of the chain beginning
+// with the block at the given height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) TxIterator(startHeight int64) (btcdb.TxIterator, error) {
+	return db.TxIteratorCtx(context.Background(), startHeight)
+}
+
+// TxIteratorCtx returns an iterator over every transaction of the chain
+// beginning with the block at the given height which stops once the passed
+// context is done.  This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) TxIteratorCtx(ctx context.Context, startHeight int64) (btcdb.TxIterator, error) {
+	blocks, err := db.BlockIteratorCtx(ctx, startHeight)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewTxIterator(blocks), nil
+}
+
+// AddIndexer returns ErrUnsupported.  Indexers must be added to the database
+// in the server process.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) AddIndexer(idx btcdb.Indexer) error {
+	return ErrUnsupported
+}
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain by any client of the server.  The subscriptions of a database
+// share a single subscription on the server, which is started by the first of
+// them.  They end should the connection fail.  This is part of the btcdb.Db
+// interface implementation.
+func (db *RemoteDb) Subscribe() (*btcdb.Subscription, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	if db.notifier == nil {
+		cl, err := db.c.start(opSubscribe, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// The server sends an empty frame once it has subscribed, so
+		// no later change is missed.
+		f, err := db.c.next(context.Background(), cl)
+		if err != nil {
+			db.c.finish(cl, true)
+			return nil, err
+		}
+		if f.kind != replyData {
+			db.c.finish(cl, false)
+			if f.kind == replyErr {
+				d := newDecoder(f.payload)
+				return nil, d.error()
+			}
+			return nil, errMalformed
+		}
+		db.notifier = new(btcdb.Notifier)
+		go db.receiveEvents(cl, db.notifier)
+	}
+	return db.notifier.Subscribe()
+}
+
+// receiveEvents passes the events of a subscription on the server to the
+// notifier it feeds until the subscription ends, which ends the subscriptions
+// of the notifier.  It must be run as a goroutine.
+func (db *RemoteDb) receiveEvents(cl *call, n *btcdb.Notifier) {
+	defer func() {
+		db.c.finish(cl, true)
+		db.mtx.Lock()
+		if db.notifier == n {
+			db.notifier = nil
+		}
+		db.mtx.Unlock()
+		n.Close()
+	}()
+
+	for {
+		f, err := db.c.next(context.Background(), cl)
+		if err != nil || f.kind != replyData {
+			return
+		}
+		d := newDecoder(f.payload)
+		connected := d.bool()
+		sha := d.sha()
+		height := d.varint()
+		if err := d.err(); err != nil {
+			log.Warnf("Subscribe: %v", err)
+			return
+		}
+		if connected {
+			n.Notify(btcdb.BlockConnected{Sha: *sha, Height: height})
+		} else {
+			n.Notify(btcdb.BlockDisconnected{Sha: *sha, Height: height})
+		}
+	}
+}
+
+// Snapshot returns a read-only view of the database as of the time of the
+// call, which is held by the server until it is released.  This is part of the
+// btcdb.Db interface implementation.
+func (db *RemoteDb) Snapshot() (btcdb.Snapshot, error) {
+	d, err := db.c.roundTrip(context.Background(), opSnapshot, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	handle := d.uvarint()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return &snapshot{view: view{c: db.c, handle: handle}}, nil
+}
+
+// VerifyIntegrity has the server check the database at the given level.  The
+// progress callback, if any, is called as the server reports its progress.
+// This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) VerifyIntegrity(level int, progress func(height int64)) error {
+	var e encoder
+	e.putVarint(int64(level))
+	e.putBool(progress != nil)
+	_, err := db.c.roundTrip(context.Background(), opVerifyIntegrity,
+		e.bytes(), progressData(progress))
+	return err
+}
+
+// Backup has the server copy the database to the passed path, which is a path
+// on the machine of the server.  This is part of the btcdb.Db interface
+// implementation.
+func (db *RemoteDb) Backup(destPath string, progress func(copied int64)) error {
+	var e encoder
+	e.putString(destPath)
+	e.putBool(progress != nil)
+	_, err := db.c.roundTrip(context.Background(), opBackup, e.bytes(),
+		progressData(progress))
+	return err
+}
+
+// progressData returns the function passing the values of replyData frames to
+// a progress callback, or nil when there is no callback.
+func progressData(progress func(int64)) func(d *decoder) error {
+	if progress == nil {
+		return nil
+	}
+	return func(d *decoder) error {
+		v := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		progress(v)
+		return nil
+	}
+}
+
+// ExportBootstrap writes the blocks from the start height up to but not
+// including the end height to the passed writer in the bootstrap format.  The
+// file is written by the server and streamed to the client.  This is part of
+// the btcdb.Db interface implementation.
+func (db *RemoteDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	var e encoder
+	e.putVarint(startHeight)
+	e.putVarint(endHeight)
+	_, err := db.c.roundTrip(context.Background(), opExportBootstrap,
+		e.bytes(), func(d *decoder) error {
+			_, err := w.Write(d.buf)
+			return err
+		})
+	return err
+}
+
+// BlockCacheStats returns the statistics of the block cache of the database on
+// the server.  This is part of the btcdb.Db interface implementation.
+func (db *RemoteDb) BlockCacheStats() btcdb.BlockCacheStats {
+	var stats btcdb.BlockCacheStats
+	d, err := db.c.roundTrip(context.Background(), opBlockCacheStats, nil,
+		nil)
+	if err != nil {
+		log.Warnf("BlockCacheStats: %v", err)
+		return stats
+	}
+	stats.Size = d.varint()
+	stats.MaxSize = d.varint()
+	stats.Blocks = int(d.varint())
+	stats.Hits = d.uvarint()
+	stats.Misses = d.uvarint()
+	if err := d.err(); err != nil {
+		log.Warnf("BlockCacheStats: %v", err)
+		return btcdb.BlockCacheStats{}
+	}
+	return stats
+}
+
+// snapshot is a snapshot held by the server for the client.
+type snapshot struct {
+	view
+	once sync.Once
+}
+
+// Release frees the snapshot on the server.  This is part of the
+// btcdb.Snapshot interface implementation.
+func (s *snapshot) Release() {
+	s.once.Do(func() {
+		release(s.c, s.handle)
+	})
+}
+
+// release frees the snapshot or iterator with the passed handle on the server.
+func release(c *conn, handle uint64) {
+	var e encoder
+	e.putUvarint(handle)
+	_, err := c.roundTrip(context.Background(), opRelease, e.bytes(), nil)
+	if err != nil && err != btcdb.ErrDbClosed && err != ErrConnLost {
+		log.Warnf("Release: %v", err)
+	}
+}
+
+// iterBlock is a block of a batch read by a blockIterator.
+type iterBlock struct {
+	sha    *btcwire.ShaHash
+	height int64
+	raw    []byte
+}
+
+// blockIterator implements btcdb.BlockIterator on top of an iterator held by
+// the server, whose blocks it reads in batches.
+type blockIterator struct {
+	c      *conn
+	ctx    context.Context
+	handle uint64
+
+	batch    []iterBlock
+	cur      *iterBlock
+	more     bool
+	err      error
+	released bool
+}
+
+// Next moves to the next block.  This is part of the btcdb.BlockIterator
+// interface implementation.
+func (it *blockIterator) Next() bool {
+	it.cur = nil
+	if it.released {
+		return false
+	}
+	if len(it.batch) == 0 && it.more && it.err == nil {
+		it.fetch()
+	}
+	if len(it.batch) == 0 {
+		return false
+	}
+	it.cur = &it.batch[0]
+	it.batch = it.batch[1:]
+	return true
+}
+
+// fetch reads the next batch of blocks from the server.
+func (it *blockIterator) fetch() {
+	var e encoder
+	e.putUvarint(it.handle)
+	d, err := it.c.roundTrip(it.ctx, opIteratorNext, e.bytes(), nil)
+	if err != nil {
+		it.err = err
+		return
+	}
+	batch := make([]iterBlock, d.count(btcwire.HashSize+2))
+	for i := range batch {
+		batch[i].sha = d.sha()
+		batch[i].height = d.varint()
+		batch[i].raw = d.bytes()
+	}
+	more := d.bool()
+	iterErr := d.error()
+	if err := d.err(); err != nil {
+		it.err = err
+		return
+	}
+	it.batch = batch
+	it.more = more
+	it.err = iterErr
+}
+
+// Sha returns the hash of the current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Sha() *btcwire.ShaHash {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.sha
+}
+
+// Height returns the height of the current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Height() int64 {
+	if it.cur == nil {
+		return 0
+	}
+	return it.cur.height
+}
+
+// RawBytes returns the serialized current block.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) RawBytes() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.raw
+}
+
+// Err returns the error which stopped the iteration, if any.  This is part of
+// the btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Err() error {
+	return it.err
+}
+
+// Release frees the iterator on the server.  This is part of the
+// btcdb.BlockIterator interface implementation.
+func (it *blockIterator) Release() {
+	if it.released {
+		return
+	}
+	it.released = true
+	it.batch = nil
+	it.cur = nil
+	release(it.c, it.handle)
+}
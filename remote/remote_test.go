@@ -0,0 +1,447 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/memdb"
+	"github.com/conformal/btcdb/remote"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadBlocks returns the genesis block followed by the blocks of the test
+// data.
+func loadBlocks(t *testing.T) []*btcutil.Block {
+	testdatafile := filepath.Join("..", "testdata", "blocks1-256.bz2")
+	fi, err := os.Open(testdatafile)
+	if err != nil {
+		t.Fatalf("failed to open file %v, err %v", testdatafile, err)
+	}
+	defer fi.Close()
+	dr := bzip2.NewReader(fi)
+
+	blocks := []*btcutil.Block{btcutil.NewBlock(&btcwire.GenesisBlock)}
+	for {
+		var hdr [2]uint32
+		err := binary.Read(dr, binary.LittleEndian, &hdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read block header, err %v", err)
+		}
+		rbytes := make([]byte, hdr[1])
+		if _, err := io.ReadFull(dr, rbytes); err != nil {
+			t.Fatalf("failed to read block, err %v", err)
+		}
+		block, err := btcutil.NewBlockFromBytes(rbytes)
+		if err != nil {
+			t.Fatalf("failed to parse block %v, err %v", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// setup returns a memory database, a server for it and the address of the
+// server in the form taken by the remote driver.  The returned function stops
+// both.
+func setup(t *testing.T) (btcdb.Db, *remote.Server, string, func()) {
+	db, err := btcdb.CreateDB("memory")
+	if err != nil {
+		t.Fatalf("Failed to open test database %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := remote.NewServer(db)
+	go s.Serve(l)
+
+	return db, s, "tcp://" + l.Addr().String(), func() {
+		s.Close()
+		db.Close()
+	}
+}
+
+func TestRemote(t *testing.T) {
+	blocks := loadBlocks(t)
+	db, _, addr, teardown := setup(t)
+	defer teardown()
+
+	client, err := btcdb.CreateDB("remote", addr)
+	if err != nil {
+		t.Fatalf("CreateDB: %v", err)
+	}
+	defer client.Close()
+
+	for height, block := range blocks {
+		newHeight, err := client.InsertBlock(block)
+		if err != nil || newHeight != int64(height) {
+			t.Fatalf("InsertBlock: got height %d (err %v), want %d",
+				newHeight, err, height)
+		}
+	}
+
+	// The blocks are inserted into the database of the server.
+	tipSha, _ := blocks[len(blocks)-1].Sha()
+	sha, height, err := db.NewestSha()
+	if err != nil || !sha.IsEqual(tipSha) || height != int64(len(blocks)-1) {
+		t.Errorf("NewestSha of server: got %v %d (err %v), want %v %d",
+			sha, height, err, tipSha, len(blocks)-1)
+	}
+	sha, height, err = client.NewestSha()
+	if err != nil || !sha.IsEqual(tipSha) || height != int64(len(blocks)-1) {
+		t.Errorf("NewestSha: got %v %d (err %v), want %v %d", sha,
+			height, err, tipSha, len(blocks)-1)
+	}
+
+	for height, block := range blocks {
+		sha, _ := block.Sha()
+		want, _ := block.Bytes()
+		blk, err := client.FetchBlockBySha(sha)
+		if err != nil {
+			t.Errorf("FetchBlockBySha: %v", err)
+			continue
+		}
+		if got, _ := blk.Bytes(); !bytes.Equal(got, want) ||
+			blk.Height() != int64(height) {
+			t.Errorf("FetchBlockBySha: block %d does not match", height)
+		}
+		gotSha, err := client.FetchBlockShaByHeight(int64(height))
+		if err != nil || !gotSha.IsEqual(sha) {
+			t.Errorf("FetchBlockShaByHeight: got %v (err %v), want %v",
+				gotSha, err, sha)
+		}
+		bh, err := client.FetchBlockHeaderBySha(sha)
+		if err != nil {
+			t.Errorf("FetchBlockHeaderBySha: %v", err)
+		} else if bhSha, _ := bh.BlockSha(); !bhSha.IsEqual(sha) {
+			t.Errorf("FetchBlockHeaderBySha: header of block %d "+
+				"does not match", height)
+		}
+
+		for idx, tx := range block.Transactions() {
+			replies, err := client.FetchTxBySha(tx.Sha())
+			if err != nil || len(replies) == 0 {
+				t.Errorf("FetchTxBySha: transaction %v is missing "+
+					"(err %v)", tx.Sha(), err)
+				continue
+			}
+			reply := replies[len(replies)-1]
+			txSha, _ := reply.Tx.TxSha()
+			if !txSha.IsEqual(tx.Sha()) || !reply.BlkSha.IsEqual(sha) ||
+				reply.Height != int64(height) || reply.BlkIndex != idx {
+				t.Errorf("FetchTxBySha: transaction %v does not "+
+					"match", tx.Sha())
+			}
+		}
+	}
+
+	shas, err := client.FetchHeightRange(10, btcdb.AllShas)
+	if err != nil || len(shas) != len(blocks)-10 {
+		t.Errorf("FetchHeightRange: got %d hashes (err %v), want %d",
+			len(shas), err, len(blocks)-10)
+	}
+	headers, err := client.FetchHeaderRange(0, 100)
+	if err != nil || len(headers) != 100 {
+		t.Errorf("FetchHeaderRange: got %d headers (err %v), want 100",
+			len(headers), err)
+	}
+	exists := client.ExistsShas([]btcwire.ShaHash{*tipSha, {}})
+	if len(exists) != 2 || !exists[0] || exists[1] {
+		t.Errorf("ExistsShas: got %v, want [true false]", exists)
+	}
+
+	// Iterators fetch the blocks from the server in batches.
+	it, err := client.BlockIterator(100)
+	if err != nil {
+		t.Fatalf("BlockIterator: %v", err)
+	}
+	height = 100
+	for it.Next() {
+		want, _ := blocks[height].Bytes()
+		if it.Height() != height || !bytes.Equal(it.RawBytes(), want) {
+			t.Errorf("BlockIterator: block %d does not match", height)
+		}
+		height++
+	}
+	if err := it.Err(); err != nil || height != int64(len(blocks)) {
+		t.Errorf("BlockIterator: stopped at %d (err %v), want %d",
+			height, err, len(blocks))
+	}
+	it.Release()
+
+	// The errors of the database are returned as themselves.
+	var missing btcwire.ShaHash
+	if _, err := client.FetchBlockBySha(&missing); err != btcdb.ErrBlockNotFound {
+		t.Errorf("FetchBlockBySha: got %v, want %v", err,
+			btcdb.ErrBlockNotFound)
+	}
+	if client.ExistsSha(&missing) || client.ExistsTxSha(&missing) {
+		t.Errorf("ExistsSha: missing hash exists")
+	}
+	if _, err := client.FetchBlockRegion(tipSha, 0, 1<<20); err != btcdb.ErrInvalidRegion {
+		t.Errorf("FetchBlockRegion: got %v, want %v", err,
+			btcdb.ErrInvalidRegion)
+	}
+
+	// Fully spent transactions are told from ones which do not exist.  The
+	// coinbase of block 9 is spent by block 170.
+	spentSha := blocks[9].Transactions()[0].Sha()
+	replies := client.FetchUnSpentTxByShaList(
+		[]*btcwire.ShaHash{spentSha, &missing})
+	if len(replies) != 2 || replies[0].Err != btcdb.TxShaMissing ||
+		!replies[0].FullySpent || replies[0].Height != 9 ||
+		replies[1].Err != btcdb.TxShaMissing || replies[1].FullySpent {
+
+		t.Errorf("FetchUnSpentTxByShaList: got %+v, want the first "+
+			"fully spent at height 9 and the second missing", replies)
+	}
+	spent, err := client.IsOutpointSpent(btcwire.NewOutPoint(spentSha, 0))
+	if err != nil || !spent {
+		t.Errorf("IsOutpointSpent: got %v (err %v) for a spent output, "+
+			"want true", spent, err)
+	}
+	unspentSha := blocks[10].Transactions()[0].Sha()
+	spent, err = client.IsOutpointSpent(btcwire.NewOutPoint(unspentSha, 0))
+	if err != nil || spent {
+		t.Errorf("IsOutpointSpent: got %v (err %v) for an unspent "+
+			"output, want false", spent, err)
+	}
+	_, err = client.IsOutpointSpent(btcwire.NewOutPoint(&missing, 0))
+	if err != btcdb.ErrTxNotFound {
+		t.Errorf("IsOutpointSpent: got %v for a missing transaction, "+
+			"want %v", err, btcdb.ErrTxNotFound)
+	}
+	if err := client.AddIndexer(nil); err != remote.ErrUnsupported {
+		t.Errorf("AddIndexer: got %v, want %v", err,
+			remote.ErrUnsupported)
+	}
+
+	// Contexts which are done stop requests.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.FetchBlockByShaCtx(ctx, tipSha); err != context.Canceled {
+		t.Errorf("FetchBlockByShaCtx: got %v, want %v", err,
+			context.Canceled)
+	}
+
+	// Snapshots keep their view of the database while it changes.
+	snap, err := client.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	forkSha, _ := blocks[200].Sha()
+	if err := client.DropAfterBlockBySha(forkSha); err != nil {
+		t.Fatalf("DropAfterBlockBySha: %v", err)
+	}
+	if _, height, _ := client.NewestSha(); height != 200 {
+		t.Errorf("NewestSha: got height %d after drop, want 200", height)
+	}
+	if _, err := snap.FetchBlockShaByHeight(int64(len(blocks) - 1)); err != nil {
+		t.Errorf("FetchBlockShaByHeight of snapshot: %v", err)
+	}
+	snap.Release()
+
+	// Closing the client leaves the database of the server open.
+	client.Close()
+	if !client.Closed() {
+		t.Errorf("Closed: got false after close")
+	}
+	if _, _, err := client.NewestSha(); err != btcdb.ErrDbClosed {
+		t.Errorf("NewestSha: got %v after close, want %v", err,
+			btcdb.ErrDbClosed)
+	}
+	if db.Closed() {
+		t.Errorf("Close of client closed the database of the server")
+	}
+}
+
+func TestRemoteMeta(t *testing.T) {
+	_, _, addr, teardown := setup(t)
+	defer teardown()
+
+	client, err := btcdb.OpenDB("remote", addr)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.PutMeta([]byte("a/1"), []byte("one")); err != nil {
+		t.Fatalf("PutMeta: %v", err)
+	}
+	var batch btcdb.MetaBatch
+	batch.Put([]byte("a/2"), []byte("two"))
+	batch.Put([]byte("b/1"), []byte("three"))
+	if err := client.WriteMeta(&batch); err != nil {
+		t.Fatalf("WriteMeta: %v", err)
+	}
+	if err := client.DeleteMeta([]byte("b/1")); err != nil {
+		t.Fatalf("DeleteMeta: %v", err)
+	}
+
+	value, err := client.GetMeta([]byte("a/2"))
+	if err != nil || string(value) != "two" {
+		t.Errorf("GetMeta: got %q (err %v), want %q", value, err, "two")
+	}
+	value, err = client.GetMeta([]byte("b/1"))
+	if err != nil || value != nil {
+		t.Errorf("GetMeta: got %q (err %v) for deleted key", value, err)
+	}
+
+	it, err := client.MetaIterator([]byte("a/"))
+	if err != nil {
+		t.Fatalf("MetaIterator: %v", err)
+	}
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if err := it.Err(); err != nil || len(keys) != 2 ||
+		keys[0] != "a/1" || keys[1] != "a/2" {
+		t.Errorf("MetaIterator: got keys %v (err %v), want [a/1 a/2]",
+			keys, err)
+	}
+	it.Release()
+}
+
+func TestRemoteReadOnly(t *testing.T) {
+	blocks := loadBlocks(t)[:2]
+	db, _, addr, teardown := setup(t)
+	defer teardown()
+
+	client, err := btcdb.OpenDB("remote", btcdb.Options{Path: addr,
+		ReadOnly: true})
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.InsertBlock(blocks[0]); err != btcdb.ErrReadOnly {
+		t.Errorf("InsertBlock: got %v, want %v", err, btcdb.ErrReadOnly)
+	}
+	if err := client.PutMeta([]byte("key"), nil); err != btcdb.ErrReadOnly {
+		t.Errorf("PutMeta: got %v, want %v", err, btcdb.ErrReadOnly)
+	}
+	if _, height, _ := db.NewestSha(); height != -1 {
+		t.Errorf("read-only client changed the database")
+	}
+
+	// Changes made by other clients are seen.
+	if _, err := db.InsertBlock(blocks[0]); err != nil {
+		t.Fatalf("InsertBlock: %v", err)
+	}
+	if _, height, err := client.NewestSha(); err != nil || height != 0 {
+		t.Errorf("NewestSha: got height %d (err %v), want 0", height,
+			err)
+	}
+}
+
+func TestRemoteSubscribe(t *testing.T) {
+	blocks := loadBlocks(t)[:20]
+	db, _, addr, teardown := setup(t)
+	defer teardown()
+
+	client, err := btcdb.OpenDB("remote", addr)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer client.Close()
+
+	sub, err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	var want []btcdb.ChainEvent
+	for height, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Fatalf("InsertBlock: %v", err)
+		}
+		sha, _ := block.Sha()
+		want = append(want, btcdb.BlockConnected{Sha: *sha,
+			Height: int64(height)})
+	}
+	forkSha, _ := blocks[15].Sha()
+	if err := client.DropAfterBlockBySha(forkSha); err != nil {
+		t.Fatalf("DropAfterBlockBySha: %v", err)
+	}
+	for height := len(blocks) - 1; height > 15; height-- {
+		sha, _ := blocks[height].Sha()
+		want = append(want, btcdb.BlockDisconnected{Sha: *sha,
+			Height: int64(height)})
+	}
+
+	for i := range want {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				t.Fatalf("subscription ended after %d events", i)
+			}
+			if event != want[i] {
+				t.Errorf("event %d is %+v, want %+v", i, event,
+					want[i])
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+
+	// Closing the client ends its subscriptions.
+	client.Close()
+	select {
+	case _, ok := <-sub.Events():
+		if ok {
+			t.Errorf("unexpected event after close")
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("subscription did not end on close")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	_, s, addr, teardown := setup(t)
+	defer teardown()
+
+	client, err := btcdb.OpenDB("remote", addr)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer client.Close()
+
+	if _, _, err := client.NewestSha(); err != nil {
+		t.Fatalf("NewestSha: %v", err)
+	}
+	s.Close()
+	if _, _, err := client.NewestSha(); err != remote.ErrConnLost {
+		t.Errorf("NewestSha: got %v after server close, want %v", err,
+			remote.ErrConnLost)
+	}
+	if _, err := btcdb.OpenDB("remote", addr); err == nil {
+		t.Errorf("OpenDB: connected to closed server")
+	}
+}
+
+func TestBadAddress(t *testing.T) {
+	addrs := []string{"", "localhost:8341", "udp://localhost:8341", "tcp://"}
+	for _, addr := range addrs {
+		if _, err := btcdb.OpenDB("remote", addr); err == nil {
+			t.Errorf("OpenDB: no error for address %q", addr)
+		}
+	}
+}
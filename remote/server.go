@@ -0,0 +1,983 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve once the server has been closed.
+var ErrServerClosed = errors.New("Server is closed")
+
+// maxConnRequests is the number of requests of a single connection which are
+// handled at the same time.  Further requests are not read from the connection
+// until one of them completes.
+const maxConnRequests = 64
+
+// Limits of the blocks returned by a single opIteratorNext request.
+const (
+	iterBatchBlocks = 64
+	iterBatchBytes  = 4 * 1024 * 1024
+)
+
+// exportChunkSize is the size of the chunks of a bootstrap file sent in
+// replyData frames.
+const exportChunkSize = 256 * 1024
+
+// Server serves a database to clients of the remote driver.  It only serves
+// the database, which remains owned by the caller, who must close the server
+// before closing the database.
+type Server struct {
+	db btcdb.Db
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a server for the passed database.
+func NewServer(db btcdb.Db) *Server {
+	return &Server{
+		db:        db,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+	}
+}
+
+// Serve accepts connections on the passed listener and serves the database to
+// them until the listener fails or the server is closed, in which case it
+// returns ErrServerClosed.  The listener is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.listeners, l)
+		s.mtx.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &serverConn{
+			s:        s,
+			nc:       nc,
+			ctx:      ctx,
+			cancel:   cancel,
+			requests: make(map[uint32]context.CancelFunc),
+			handles:  make(map[uint64]interface{}),
+		}
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			nc.Close()
+			cancel()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mtx.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Close stops the server from accepting connections, closes the connections
+// of its clients and waits for the requests in progress to finish.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.cancel()
+		c.nc.Close()
+	}
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// iterState is a block iterator of a client.
+type iterState struct {
+	sync.Mutex
+	it btcdb.BlockIterator
+}
+
+// dbView reads the database itself, which is handle zero of requests reading
+// the database.
+type dbView struct {
+	btcdb.Db
+}
+
+// Release does nothing.  This is part of the btcdb.Snapshot interface
+// implementation.
+func (dbView) Release() {
+}
+
+// serverConn is the connection of a client.
+type serverConn struct {
+	s  *Server
+	nc net.Conn
+
+	// ctx is cancelled once the connection is closed, which cancels the
+	// requests of the client.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wmtx serializes the frames written to the connection.
+	wmtx sync.Mutex
+
+	// mtx protects the requests in progress, and the snapshots and
+	// iterators the client holds, which are identified by their handle.
+	mtx        sync.Mutex
+	requests   map[uint32]context.CancelFunc
+	handles    map[uint64]interface{}
+	nextHandle uint64
+}
+
+// send writes a frame to the connection.
+func (c *serverConn) send(id uint32, kind uint8, payload []byte) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+
+	return writeFrame(c.nc, id, kind, payload)
+}
+
+// sendErr answers a request with the passed error.
+func (c *serverConn) sendErr(id uint32, err error) error {
+	var e encoder
+	e.putError(err)
+	return c.send(id, replyErr, e.bytes())
+}
+
+// serve reads the requests of the client and handles each of them in its own
+// goroutine until the connection is closed.  It must be run as a goroutine.
+func (c *serverConn) serve() {
+	var wg sync.WaitGroup
+	defer func() {
+		c.cancel()
+		c.nc.Close()
+		wg.Wait()
+
+		c.mtx.Lock()
+		for handle := range c.handles {
+			c.release(handle)
+		}
+		c.mtx.Unlock()
+
+		c.s.mtx.Lock()
+		delete(c.s.conns, c)
+		c.s.mtx.Unlock()
+		c.s.wg.Done()
+	}()
+
+	r := bufio.NewReader(c.nc)
+	if err := c.hello(r); err != nil {
+		log.Debugf("Refused client %v: %v", c.nc.RemoteAddr(), err)
+		return
+	}
+
+	sem := make(chan struct{}, maxConnRequests)
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				log.Debugf("Client %v disconnected: %v",
+					c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+
+		c.mtx.Lock()
+		if f.kind == opCancel {
+			if cancel, ok := c.requests[f.id]; ok {
+				cancel()
+			}
+			c.mtx.Unlock()
+			continue
+		}
+		if _, ok := c.requests[f.id]; ok {
+			c.mtx.Unlock()
+			log.Debugf("Client %v reused request id %d",
+				c.nc.RemoteAddr(), f.id)
+			return
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.requests[f.id] = cancel
+		c.mtx.Unlock()
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(f *frame) {
+			defer wg.Done()
+			c.handle(ctx, f)
+
+			c.mtx.Lock()
+			delete(c.requests, f.id)
+			c.mtx.Unlock()
+			cancel()
+			<-sem
+		}(f)
+	}
+}
+
+// hello reads the opHello request which starts the connection and answers it.
+func (c *serverConn) hello(r *bufio.Reader) error {
+	f, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if f.kind != opHello || !bytes.HasPrefix(f.payload, protocolMagic) {
+		return errors.New("connection did not start with a hello")
+	}
+	d := newDecoder(f.payload[len(protocolMagic):])
+	version := d.uvarint()
+	if err := d.err(); err != nil {
+		return err
+	}
+	if version != protocolVersion {
+		err := fmt.Errorf("unsupported protocol version %d", version)
+		c.sendErr(f.id, err)
+		return err
+	}
+	var e encoder
+	e.putUvarint(protocolVersion)
+	return c.send(f.id, replyOK, e.bytes())
+}
+
+// handle answers a request.
+func (c *serverConn) handle(ctx context.Context, f *frame) {
+	var e encoder
+	err := c.dispatch(ctx, f.id, f.kind, newDecoder(f.payload), &e)
+	if err != nil {
+		err = c.sendErr(f.id, err)
+	} else {
+		err = c.send(f.id, replyOK, e.bytes())
+	}
+	if err != nil && c.ctx.Err() == nil {
+		log.Debugf("Failed to answer client %v: %v", c.nc.RemoteAddr(),
+			err)
+		c.nc.Close()
+	}
+}
+
+// addHandle stores a snapshot or iterator of the client and returns its
+// handle.
+func (c *serverConn) addHandle(v interface{}) uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.nextHandle++
+	c.handles[c.nextHandle] = v
+	return c.nextHandle
+}
+
+// release frees the snapshot or iterator with the passed handle.  It must be
+// called with the mutex held.
+func (c *serverConn) release(handle uint64) {
+	switch v := c.handles[handle].(type) {
+	case btcdb.Snapshot:
+		v.Release()
+	case *iterState:
+		v.Lock()
+		v.it.Release()
+		v.Unlock()
+	}
+	delete(c.handles, handle)
+}
+
+// reader returns the snapshot with the passed handle, or the database itself
+// for handle zero.
+func (c *serverConn) reader(handle uint64) (btcdb.Snapshot, error) {
+	if handle == 0 {
+		return dbView{c.s.db}, nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	snap, ok := c.handles[handle].(btcdb.Snapshot)
+	if !ok {
+		return nil, btcdb.ErrDbClosed
+	}
+	return snap, nil
+}
+
+// dispatch carries out a request and writes the payload of the reply to the
+// passed encoder.
+func (c *serverConn) dispatch(ctx context.Context, id uint32, op uint8, d *decoder, e *encoder) error {
+	db := c.s.db
+	switch op {
+	case opInsertBlocks, opReorganize:
+		var sha *btcwire.ShaHash
+		if op == opReorganize {
+			sha = d.sha()
+		}
+		blocks := make([]*btcutil.Block, d.count(1))
+		for i := range blocks {
+			blocks[i] = d.block()
+		}
+		meta := d.meta()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var heights []int64
+		var err error
+		if op == opReorganize {
+			heights, err = db.ReorganizeWithMeta(sha, blocks, meta)
+		} else {
+			heights, err = db.InsertBlocksWithMeta(blocks, meta)
+		}
+		if err != nil {
+			return err
+		}
+		e.putUvarint(uint64(len(heights)))
+		for _, height := range heights {
+			e.putVarint(height)
+		}
+		return nil
+
+	case opDropAfter:
+		sha := d.sha()
+		meta := d.meta()
+		if err := d.err(); err != nil {
+			return err
+		}
+		return db.DropAfterBlockByShaWithMeta(sha, meta)
+
+	case opWriteMeta:
+		meta := d.meta()
+		if err := d.err(); err != nil {
+			return err
+		}
+		if meta == nil {
+			meta = new(btcdb.MetaBatch)
+		}
+		return db.WriteMeta(meta)
+
+	case opBlockIterator:
+		start := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		it, err := db.BlockIteratorCtx(c.ctx, start)
+		if err != nil {
+			return err
+		}
+		e.putUvarint(c.addHandle(&iterState{it: it}))
+		return nil
+
+	case opIteratorNext:
+		handle := d.uvarint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		c.mtx.Lock()
+		state, ok := c.handles[handle].(*iterState)
+		c.mtx.Unlock()
+		if !ok {
+			return btcdb.ErrDbClosed
+		}
+		return nextBlocks(ctx, state, e)
+
+	case opSnapshot:
+		if err := d.err(); err != nil {
+			return err
+		}
+		snap, err := db.Snapshot()
+		if err != nil {
+			return err
+		}
+		e.putUvarint(c.addHandle(snap))
+		return nil
+
+	case opRelease:
+		handle := d.uvarint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		c.mtx.Lock()
+		c.release(handle)
+		c.mtx.Unlock()
+		return nil
+
+	case opSubscribe:
+		if err := d.err(); err != nil {
+			return err
+		}
+		return c.subscribe(ctx, id)
+
+	case opVerifyIntegrity:
+		level := int(d.varint())
+		wantProgress := d.bool()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var progress func(height int64)
+		if wantProgress {
+			progress = c.progressFunc(id)
+		}
+		return db.VerifyIntegrity(level, progress)
+
+	case opBackup:
+		path := d.string()
+		wantProgress := d.bool()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var progress func(copied int64)
+		if wantProgress {
+			progress = c.progressFunc(id)
+		}
+		return db.Backup(path, progress)
+
+	case opExportBootstrap:
+		start := d.varint()
+		end := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		w := bufio.NewWriterSize(&dataWriter{c: c, ctx: ctx, id: id},
+			exportChunkSize)
+		if err := db.ExportBootstrap(w, start, end); err != nil {
+			return err
+		}
+		return w.Flush()
+
+	case opBlockCacheStats:
+		if err := d.err(); err != nil {
+			return err
+		}
+		stats := db.BlockCacheStats()
+		e.putVarint(stats.Size)
+		e.putVarint(stats.MaxSize)
+		e.putVarint(int64(stats.Blocks))
+		e.putUvarint(stats.Hits)
+		e.putUvarint(stats.Misses)
+		return nil
+
+	case opSync:
+		if err := d.err(); err != nil {
+			return err
+		}
+		db.Sync()
+		return nil
+	}
+
+	// The remaining operations read the database or one of the snapshots
+	// of the client.
+	r, err := c.reader(d.uvarint())
+	if err != nil {
+		return err
+	}
+	return dispatchRead(ctx, r, op, d, e)
+}
+
+// dispatchRead carries out a request reading the passed database or snapshot
+// and writes the payload of the reply to the passed encoder.  The requests of
+// the database itself honor the context of the request.
+func dispatchRead(ctx context.Context, r btcdb.Snapshot, op uint8, d *decoder, e *encoder) error {
+	var db btcdb.Db
+	if v, ok := r.(dbView); ok {
+		db = v.Db
+	}
+
+	switch op {
+	case opExistsShas:
+		shas := d.shas()
+		if err := d.err(); err != nil {
+			return err
+		}
+		for _, exists := range r.ExistsShas(shas) {
+			e.putBool(exists)
+		}
+
+	case opFetchBlock:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var blk *btcutil.Block
+		var err error
+		if db != nil {
+			blk, err = db.FetchBlockByShaCtx(ctx, sha)
+		} else {
+			blk, err = r.FetchBlockBySha(sha)
+		}
+		if err != nil {
+			return err
+		}
+		raw, err := blk.Bytes()
+		if err != nil {
+			return err
+		}
+		e.putVarint(blk.Height())
+		e.putBytes(raw)
+
+	case opFetchBlockRegion:
+		sha := d.sha()
+		offset := int(d.varint())
+		length := int(d.varint())
+		if err := d.err(); err != nil {
+			return err
+		}
+		region, err := r.FetchBlockRegion(sha, offset, length)
+		if err != nil {
+			return err
+		}
+		e.putBytes(region)
+
+	case opFetchBlockHeight:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		height, err := r.FetchBlockHeightBySha(sha)
+		if err != nil {
+			return err
+		}
+		e.putVarint(height)
+
+	case opFetchHeaderBySha:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		bh, err := r.FetchBlockHeaderBySha(sha)
+		if err != nil {
+			return err
+		}
+		return e.putHeader(bh)
+
+	case opFetchShaByHeight:
+		height := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		sha, err := r.FetchBlockShaByHeight(height)
+		if err != nil {
+			return err
+		}
+		e.putSha(sha)
+
+	case opFetchHeaderByHeight:
+		height := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		bh, err := r.FetchBlockHeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+		return e.putHeader(bh)
+
+	case opFetchHeaderRange:
+		start := d.varint()
+		end := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var headers []btcwire.BlockHeader
+		var err error
+		if db != nil {
+			headers, err = db.FetchHeaderRangeCtx(ctx, start, end)
+		} else {
+			headers, err = r.FetchHeaderRange(start, end)
+		}
+		if err != nil {
+			return err
+		}
+		e.putUvarint(uint64(len(headers)))
+		for i := range headers {
+			if err := e.putHeader(&headers[i]); err != nil {
+				return err
+			}
+		}
+
+	case opFetchHeightRange:
+		start := d.varint()
+		end := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var shas []btcwire.ShaHash
+		var err error
+		if db != nil {
+			shas, err = db.FetchHeightRangeCtx(ctx, start, end)
+		} else {
+			shas, err = r.FetchHeightRange(start, end)
+		}
+		if err != nil {
+			return err
+		}
+		e.putShas(shas)
+
+	case opFetchChainWork:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		work, err := r.FetchChainWorkBySha(sha)
+		if err != nil {
+			return err
+		}
+		e.putBytes(work.Bytes())
+
+	case opBlockLocatorFromSha, opLatestBlockLocator:
+		var locator btcdb.BlockLocator
+		var err error
+		if op == opBlockLocatorFromSha {
+			sha := d.sha()
+			if err := d.err(); err != nil {
+				return err
+			}
+			locator, err = r.BlockLocatorFromSha(sha)
+		} else {
+			if err := d.err(); err != nil {
+				return err
+			}
+			locator, err = r.LatestBlockLocator()
+		}
+		if err != nil {
+			return err
+		}
+		e.putUvarint(uint64(len(locator)))
+		for _, sha := range locator {
+			e.putSha(sha)
+		}
+
+	case opExistsTxShas:
+		shas := d.shas()
+		if err := d.err(); err != nil {
+			return err
+		}
+		for _, exists := range r.ExistsTxShas(shas) {
+			e.putBool(exists)
+		}
+
+	case opFetchTxBySha:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		replies, err := r.FetchTxBySha(sha)
+		if err != nil {
+			return err
+		}
+		return e.putTxReplies(replies)
+
+	case opFetchTxByShaList, opFetchUnSpentTxByShaList:
+		shas := d.shaPtrs()
+		if err := d.err(); err != nil {
+			return err
+		}
+		if op == opFetchTxByShaList {
+			return e.putTxReplies(r.FetchTxByShaList(shas))
+		}
+		return e.putTxReplies(r.FetchUnSpentTxByShaList(shas))
+
+	case opFetchUtxoEntry:
+		outpoint := d.outPoint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		entry, err := r.FetchUtxoEntry(outpoint)
+		if err != nil {
+			return err
+		}
+		e.putBool(entry != nil)
+		if entry == nil {
+			return nil
+		}
+		e.putVarint(entry.Height)
+		e.putBool(entry.Coinbase)
+		e.putVarint(entry.Value)
+		e.putBytes(entry.PkScript)
+
+	case opFetchSpendingTx:
+		outpoint := d.outPoint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		spender, err := r.FetchSpendingTx(outpoint)
+		if err != nil {
+			return err
+		}
+		e.putBool(spender != nil)
+		if spender == nil {
+			return nil
+		}
+		e.putSha(spender.Sha)
+		e.putVarint(spender.Height)
+		e.putUvarint(uint64(spender.InputIndex))
+
+	case opIsOutpointSpent:
+		outpoint := d.outPoint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		spent, err := r.IsOutpointSpent(outpoint)
+		if err != nil {
+			return err
+		}
+		e.putBool(spent)
+
+	case opFetchFilter:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		filter, err := r.FetchFilterBySha(sha)
+		if err != nil {
+			return err
+		}
+		e.putBytes(filter)
+
+	case opFetchFilterHeader:
+		sha := d.sha()
+		if err := d.err(); err != nil {
+			return err
+		}
+		header, err := r.FetchFilterHeaderBySha(sha)
+		if err != nil {
+			return err
+		}
+		e.putSha(header)
+
+	case opFetchFilterRange:
+		start := d.varint()
+		end := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		filters, err := r.FetchFilterRange(start, end)
+		if err != nil {
+			return err
+		}
+		e.putUvarint(uint64(len(filters)))
+		for _, filter := range filters {
+			e.putBytes(filter)
+		}
+
+	case opFetchFilterHeaderRange:
+		start := d.varint()
+		end := d.varint()
+		if err := d.err(); err != nil {
+			return err
+		}
+		headers, err := r.FetchFilterHeaderRange(start, end)
+		if err != nil {
+			return err
+		}
+		e.putShas(headers)
+
+	case opUtxoSetSize:
+		if err := d.err(); err != nil {
+			return err
+		}
+		size, err := r.UtxoSetSize()
+		if err != nil {
+			return err
+		}
+		e.putVarint(size)
+
+	case opNewestSha:
+		if err := d.err(); err != nil {
+			return err
+		}
+		sha, height, err := r.NewestSha()
+		if err != nil {
+			return err
+		}
+		e.putSha(sha)
+		e.putVarint(height)
+
+	case opGetMeta:
+		key := d.bytes()
+		if err := d.err(); err != nil {
+			return err
+		}
+		value, err := r.GetMeta(key)
+		if err != nil {
+			return err
+		}
+		e.putBool(value != nil)
+		e.putBytes(value)
+
+	case opMetaIterator, opReverseMetaIterator:
+		prefix := d.bytes()
+		if err := d.err(); err != nil {
+			return err
+		}
+		var it btcdb.MetaIterator
+		var err error
+		if op == opMetaIterator {
+			it, err = r.MetaIterator(prefix)
+		} else {
+			it, err = r.ReverseMetaIterator(prefix)
+		}
+		if err != nil {
+			return err
+		}
+		defer it.Release()
+		var body encoder
+		var n uint64
+		for it.Next() {
+			body.putBytes(it.Key())
+			body.putBytes(it.Value())
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		e.putUvarint(n)
+		e.buf.Write(body.bytes())
+
+	default:
+		return fmt.Errorf("unknown operation %d", op)
+	}
+	return nil
+}
+
+// nextBlocks writes the next batch of blocks of an iterator, followed by
+// whether the iterator is done and the error which stopped it.
+func nextBlocks(ctx context.Context, state *iterState, e *encoder) error {
+	state.Lock()
+	defer state.Unlock()
+
+	var body encoder
+	var n uint64
+	more := true
+	for n < iterBatchBlocks && body.buf.Len() < iterBatchBytes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !state.it.Next() {
+			more = false
+			break
+		}
+		body.putSha(state.it.Sha())
+		body.putVarint(state.it.Height())
+		body.putBytes(state.it.RawBytes())
+		n++
+	}
+	e.putUvarint(n)
+	e.buf.Write(body.bytes())
+	e.putBool(more)
+	if more {
+		e.putError(nil)
+	} else {
+		e.putError(state.it.Err())
+	}
+	return nil
+}
+
+// subscribe streams the blocks connected to and disconnected from the chain
+// until the request is cancelled or the database is closed.  An empty replyData
+// frame is sent once the subscription is in place, so the client knows no
+// later change is missed.
+func (c *serverConn) subscribe(ctx context.Context, id uint32) error {
+	sub, err := c.s.db.Subscribe()
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	if err := c.send(id, replyData, nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return btcdb.ErrDbClosed
+			}
+			var e encoder
+			switch ev := event.(type) {
+			case btcdb.BlockConnected:
+				e.putBool(true)
+				e.putSha(&ev.Sha)
+				e.putVarint(ev.Height)
+			case btcdb.BlockDisconnected:
+				e.putBool(false)
+				e.putSha(&ev.Sha)
+				e.putVarint(ev.Height)
+			default:
+				continue
+			}
+			if err := c.send(id, replyData, e.bytes()); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// progressFunc returns a progress callback sending each value to the client in
+// a replyData frame.
+func (c *serverConn) progressFunc(id uint32) func(int64) {
+	return func(v int64) {
+		var e encoder
+		e.putVarint(v)
+		c.send(id, replyData, e.bytes())
+	}
+}
+
+// dataWriter is an io.Writer sending the data written to it to the client in
+// replyData frames.
+type dataWriter struct {
+	c   *serverConn
+	ctx context.Context
+	id  uint32
+}
+
+// Write sends the passed data.  This is part of the io.Writer interface
+// implementation.
+func (w *dataWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.c.send(w.id, replyData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,610 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"context"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// view implements the functions reading the database, either the database
+// itself or one of the snapshots the client holds on the server.  They are
+// shared by RemoteDb and the snapshots it returns.
+type view struct {
+	c      *conn
+	handle uint64
+}
+
+// args returns an encoder for the arguments of a request reading the view.
+func (v *view) args() *encoder {
+	e := new(encoder)
+	e.putUvarint(v.handle)
+	return e
+}
+
+// call sends a request reading the view and returns the decoder of its reply.
+func (v *view) call(ctx context.Context, op uint8, e *encoder) (*decoder, error) {
+	return v.c.roundTrip(ctx, op, e.bytes(), nil)
+}
+
+// ExistsSha returns whether or not the given block hash is present in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (v *view) ExistsSha(sha *btcwire.ShaHash) bool {
+	return v.ExistsShas([]btcwire.ShaHash{*sha})[0]
+}
+
+// ExistsShas returns whether or not each of the given block hashes is present
+// in the database.  All of the hashes are looked up in a single request.  This
+// is part of the btcdb.Db interface implementation.
+func (v *view) ExistsShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	e := v.args()
+	e.putShas(shas)
+	d, err := v.call(context.Background(), opExistsShas, e)
+	if err != nil {
+		log.Warnf("ExistsShas: %v", err)
+		return exists
+	}
+	for i := range exists {
+		exists[i] = d.bool()
+	}
+	if err := d.err(); err != nil {
+		log.Warnf("ExistsShas: %v", err)
+		return make([]bool, len(shas))
+	}
+	return exists
+}
+
+// fetchBlock returns the height and serialized form of the block with the
+// passed hash.
+func (v *view) fetchBlock(ctx context.Context, sha *btcwire.ShaHash) (int64, []byte, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(ctx, opFetchBlock, e)
+	if err != nil {
+		return 0, nil, err
+	}
+	height := d.varint()
+	raw := d.bytes()
+	if err := d.err(); err != nil {
+		return 0, nil, err
+	}
+	return height, raw, nil
+}
+
+// FetchBlockBySha returns a btcutil.Block.  This is part of the btcdb.Db
+// interface implementation.
+func (v *view) FetchBlockBySha(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	return v.fetchBlockBySha(context.Background(), sha)
+}
+
+// fetchBlockBySha returns the block with the passed hash unless the context is
+// done first.
+func (v *view) fetchBlockBySha(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	height, raw, err := v.fetchBlock(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := btcutil.NewBlockFromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	blk.SetHeight(height)
+	return blk, nil
+}
+
+// FetchBlockRegion returns length bytes of the serialized block with the given
+// hash starting at offset.  Only the region is transferred.  This is part of
+// the btcdb.Db interface implementation.
+func (v *view) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error) {
+	e := v.args()
+	e.putSha(sha)
+	e.putVarint(int64(offset))
+	e.putVarint(int64(length))
+	d, err := v.call(context.Background(), opFetchBlockRegion, e)
+	if err != nil {
+		return nil, err
+	}
+	region := d.bytes()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return region, nil
+}
+
+// FetchBlockBytesBySha returns the serialized block with the given hash,
+// appended to buf[:0].  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error) {
+	_, raw, err := v.fetchBlock(context.Background(), sha)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf[:0], raw...), nil
+}
+
+// FetchBlockHeightBySha returns the block height for the given hash.  This is
+// part of the btcdb.Db interface implementation.
+func (v *view) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(context.Background(), opFetchBlockHeight, e)
+	if err != nil {
+		return 0, err
+	}
+	height := d.varint()
+	if err := d.err(); err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// FetchBlockHeaderBySha returns a btcwire.BlockHeader for the given sha.  This
+// is part of the btcdb.Db interface implementation.
+func (v *view) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (*btcwire.BlockHeader, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(context.Background(), opFetchHeaderBySha, e)
+	if err != nil {
+		return nil, err
+	}
+	bh := d.header()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return bh, nil
+}
+
+// FetchBlockShaByHeight returns a block hash based on its height in the block
+// chain.  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchBlockShaByHeight(height int64) (*btcwire.ShaHash, error) {
+	e := v.args()
+	e.putVarint(height)
+	d, err := v.call(context.Background(), opFetchShaByHeight, e)
+	if err != nil {
+		return nil, err
+	}
+	sha := d.sha()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return sha, nil
+}
+
+// FetchBlockHeaderByHeight returns the block header at the given height in the
+// main chain.  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchBlockHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	e := v.args()
+	e.putVarint(height)
+	d, err := v.call(context.Background(), opFetchHeaderByHeight, e)
+	if err != nil {
+		return nil, err
+	}
+	bh := d.header()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return bh, nil
+}
+
+// FetchHeaderRange returns the block headers from the start height up to but
+// not including the end height.  This is part of the btcdb.Db interface
+// implementation.
+func (v *view) FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return v.fetchHeaderRange(context.Background(), startHeight, endHeight)
+}
+
+// fetchHeaderRange returns the block headers of a range of heights unless the
+// context is done first.
+func (v *view) fetchHeaderRange(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	e := v.args()
+	e.putVarint(startHeight)
+	e.putVarint(endHeight)
+	d, err := v.call(ctx, opFetchHeaderRange, e)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]btcwire.BlockHeader, d.count(1))
+	for i := range headers {
+		headers[i] = *d.header()
+	}
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// FetchHeightRange looks up a range of blocks by the start and ending heights.
+// Fetch is inclusive of the start height and exclusive of the ending height.
+// To fetch all hashes from the start height until no more are present, use the
+// special id `AllShas'.  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	return v.fetchHeightRange(context.Background(), startHeight, endHeight)
+}
+
+// fetchHeightRange looks up the hashes of a range of heights unless the context
+// is done first.
+func (v *view) fetchHeightRange(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	e := v.args()
+	e.putVarint(startHeight)
+	e.putVarint(endHeight)
+	d, err := v.call(ctx, opFetchHeightRange, e)
+	if err != nil {
+		return nil, err
+	}
+	shas := d.shas()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return shas, nil
+}
+
+// FetchChainWorkBySha returns the total work of the chain up to and including
+// the block with the given hash.  This is part of the btcdb.Db interface
+// implementation.
+func (v *view) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(context.Background(), opFetchChainWork, e)
+	if err != nil {
+		return nil, err
+	}
+	work := new(big.Int).SetBytes(d.bytes())
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return work, nil
+}
+
+// blockLocator reads a block locator from the reply of a request.
+func blockLocator(d *decoder) (btcdb.BlockLocator, error) {
+	locator := btcdb.BlockLocator(d.shaPtrs())
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (v *view) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(context.Background(), opBlockLocatorFromSha, e)
+	if err != nil {
+		return nil, err
+	}
+	return blockLocator(d)
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (v *view) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	d, err := v.call(context.Background(), opLatestBlockLocator, v.args())
+	if err != nil {
+		return nil, err
+	}
+	return blockLocator(d)
+}
+
+// ExistsTxSha returns whether or not the given transaction hash is present in
+// the database and is not fully spent.  This is part of the btcdb.Db interface
+// implementation.
+func (v *view) ExistsTxSha(sha *btcwire.ShaHash) bool {
+	return v.ExistsTxShas([]btcwire.ShaHash{*sha})[0]
+}
+
+// ExistsTxShas returns whether or not each of the given transaction hashes is
+// present in the database and is not fully spent.  All of the hashes are
+// looked up in a single request.  This is part of the btcdb.Db interface
+// implementation.
+func (v *view) ExistsTxShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	e := v.args()
+	e.putShas(shas)
+	d, err := v.call(context.Background(), opExistsTxShas, e)
+	if err != nil {
+		log.Warnf("ExistsTxShas: %v", err)
+		return exists
+	}
+	for i := range exists {
+		exists[i] = d.bool()
+	}
+	if err := d.err(); err != nil {
+		log.Warnf("ExistsTxShas: %v", err)
+		return make([]bool, len(shas))
+	}
+	return exists
+}
+
+// FetchTxBySha returns some data for the given transaction hash.  This is part
+// of the btcdb.Db interface implementation.
+func (v *view) FetchTxBySha(txsha *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	e := v.args()
+	e.putSha(txsha)
+	d, err := v.call(context.Background(), opFetchTxBySha, e)
+	if err != nil {
+		return nil, err
+	}
+	replies := d.txReplies()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// fetchTxList looks up each of the passed transactions with the given
+// operation.  Should the request fail, every reply carries the error.
+func (v *view) fetchTxList(op uint8, txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	e := v.args()
+	e.putUvarint(uint64(len(txShaList)))
+	for _, sha := range txShaList {
+		e.putSha(sha)
+	}
+	d, err := v.call(context.Background(), op, e)
+	var replies []*btcdb.TxListReply
+	if err == nil {
+		replies = d.txReplies()
+		err = d.err()
+	}
+	if err != nil {
+		replies = make([]*btcdb.TxListReply, 0, len(txShaList))
+		for _, sha := range txShaList {
+			replies = append(replies, &btcdb.TxListReply{
+				Sha: sha,
+				Err: err,
+			})
+		}
+	}
+	return replies
+}
+
+// FetchTxByShaList returns the most recent data for each of the given
+// transaction hashes.  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return v.fetchTxList(opFetchTxByShaList, txShaList)
+}
+
+// FetchUnSpentTxByShaList returns the most recent data for each of the given
+// transaction hashes which are not fully spent.  This is part of the btcdb.Db
+// interface implementation.
+func (v *view) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return v.fetchTxList(opFetchUnSpentTxByShaList, txShaList)
+}
+
+// FetchUtxoEntry returns the unspent transaction output at the passed outpoint,
+// or nil when it does not exist or has been spent.  This is part of the
+// btcdb.Db interface implementation.
+func (v *view) FetchUtxoEntry(outpoint *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	e := v.args()
+	e.putOutPoint(outpoint)
+	d, err := v.call(context.Background(), opFetchUtxoEntry, e)
+	if err != nil {
+		return nil, err
+	}
+	var entry *btcdb.UtxoEntry
+	if d.bool() {
+		entry = &btcdb.UtxoEntry{
+			Height:   d.varint(),
+			Coinbase: d.bool(),
+			Value:    d.varint(),
+			PkScript: d.bytes(),
+		}
+	}
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// FetchSpendingTx returns the transaction which spent the output at the passed
+// outpoint.  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchSpendingTx(outpoint *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	e := v.args()
+	e.putOutPoint(outpoint)
+	d, err := v.call(context.Background(), opFetchSpendingTx, e)
+	if err != nil {
+		return nil, err
+	}
+	var spender *btcdb.SpendingTx
+	if d.bool() {
+		spender = &btcdb.SpendingTx{
+			Sha:        d.sha(),
+			Height:     d.varint(),
+			InputIndex: uint32(d.uvarint()),
+		}
+	}
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return spender, nil
+}
+
+// IsOutpointSpent returns whether the output at the passed outpoint was spent by
+// a transaction of the main chain.  This is part of the btcdb.Db interface
+// implementation.
+func (v *view) IsOutpointSpent(outpoint *btcwire.OutPoint) (bool, error) {
+	e := v.args()
+	e.putOutPoint(outpoint)
+	d, err := v.call(context.Background(), opIsOutpointSpent, e)
+	if err != nil {
+		return false, err
+	}
+	spent := d.bool()
+	if err := d.err(); err != nil {
+		return false, err
+	}
+	return spent, nil
+}
+
+// FetchFilterBySha returns the compact filter of the block with the given hash.
+// This is part of the btcdb.Db interface implementation.
+func (v *view) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(context.Background(), opFetchFilter, e)
+	if err != nil {
+		return nil, err
+	}
+	filter := d.bytes()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// FetchFilterHeaderBySha returns the filter header of the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (v *view) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	e := v.args()
+	e.putSha(sha)
+	d, err := v.call(context.Background(), opFetchFilterHeader, e)
+	if err != nil {
+		return nil, err
+	}
+	header := d.sha()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// FetchFilterRange returns the compact filters of the blocks from the start
+// height up to but not including the end height.  This is part of the btcdb.Db
+// interface implementation.
+func (v *view) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	e := v.args()
+	e.putVarint(startHeight)
+	e.putVarint(endHeight)
+	d, err := v.call(context.Background(), opFetchFilterRange, e)
+	if err != nil {
+		return nil, err
+	}
+	filters := make([][]byte, d.count(1))
+	for i := range filters {
+		filters[i] = d.bytes()
+	}
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// FetchFilterHeaderRange returns the filter headers of the blocks from the
+// start height up to but not including the end height.  This is part of the
+// btcdb.Db interface implementation.
+func (v *view) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	e := v.args()
+	e.putVarint(startHeight)
+	e.putVarint(endHeight)
+	d, err := v.call(context.Background(), opFetchFilterHeaderRange, e)
+	if err != nil {
+		return nil, err
+	}
+	headers := d.shas()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// UtxoSetSize returns the number of unspent transaction outputs.  This is part
+// of the btcdb.Db interface implementation.
+func (v *view) UtxoSetSize() (int64, error) {
+	d, err := v.call(context.Background(), opUtxoSetSize, v.args())
+	if err != nil {
+		return 0, err
+	}
+	size := d.varint()
+	if err := d.err(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// NewestSha returns the hash and block height of the most recent (end) block of
+// the block chain.  This is part of the btcdb.Db interface implementation.
+func (v *view) NewestSha() (*btcwire.ShaHash, int64, error) {
+	d, err := v.call(context.Background(), opNewestSha, v.args())
+	if err != nil {
+		return nil, 0, err
+	}
+	sha := d.sha()
+	height := d.varint()
+	if err := d.err(); err != nil {
+		return nil, 0, err
+	}
+	return sha, height, nil
+}
+
+// GetMeta returns the value stored under the given key in the metadata
+// namespace, or nil when there is none.  This is part of the btcdb.Db
+// interface implementation.
+func (v *view) GetMeta(key []byte) ([]byte, error) {
+	e := v.args()
+	e.putBytes(key)
+	d, err := v.call(context.Background(), opGetMeta, e)
+	if err != nil {
+		return nil, err
+	}
+	exists := d.bool()
+	value := d.bytes()
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// MetaIterator returns an iterator over the keys of the metadata namespace
+// which start with the passed prefix.  The keys and values are transferred
+// when the iterator is created.  This is part of the btcdb.Db interface
+// implementation.
+func (v *view) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := v.metaEntries(opMetaIterator, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewMetaIterator(keys, values), nil
+}
+
+// ReverseMetaIterator returns an iterator over the keys of the metadata
+// namespace which start with the passed prefix in descending order.  The keys
+// and values are transferred when the iterator is created.  This is part of
+// the btcdb.Db interface implementation.
+func (v *view) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := v.metaEntries(opReverseMetaIterator, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewReverseMetaIterator(keys, values), nil
+}
+
+// metaEntries returns the keys of the metadata namespace which start with the
+// passed prefix and their values, as walked by the iterator of the server
+// the passed operation creates.
+func (v *view) metaEntries(op uint8, prefix []byte) ([][]byte, [][]byte, error) {
+	e := v.args()
+	e.putBytes(prefix)
+	d, err := v.call(context.Background(), op, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := d.count(2)
+	keys := make([][]byte, n)
+	values := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = d.bytes()
+		values[i] = d.bytes()
+	}
+	if err := d.err(); err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
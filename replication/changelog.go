@@ -0,0 +1,288 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// DefaultChangeLogSize is the number of changes a change log keeps when no
+// size is given, which is about two weeks of blocks.
+const DefaultChangeLogSize = 2016
+
+// errMalformed is returned when an entry of the change log can not be decoded.
+var errMalformed = errors.New("malformed change log entry")
+
+var (
+	// headKey is the metadata key of the head of the change log.
+	headKey = []byte("replication/head")
+
+	// changeKeyPrefix is the prefix of the metadata keys of the changes
+	// in the log, which are followed by their sequence number.
+	changeKeyPrefix = []byte("replication/log/")
+)
+
+// headSize and changeSize are the sizes of the serialized head of the change
+// log and of each change in it.
+const (
+	headSize   = 8 + btcwire.HashSize + 8
+	changeSize = 1 + 8 + 2*btcwire.HashSize
+)
+
+// Head is the most recent change of a change log along with the tip of the
+// chain it left the database at.
+type Head struct {
+	Seq    uint64
+	Sha    btcwire.ShaHash
+	Height int64
+}
+
+// Change is an entry of a change log, which is a single block connected to or
+// disconnected from the chain.
+type Change struct {
+	Seq       uint64
+	Connected bool
+	Height    int64
+	Sha       btcwire.ShaHash
+
+	// PrevSha is the hash of the parent of the block, which is the tip
+	// of the chain before the block is connected or after it is
+	// disconnected.
+	PrevSha btcwire.ShaHash
+}
+
+// MetaReader is implemented by both btcdb.Db and btcdb.Snapshot, and is used
+// to read a change log from either.
+type MetaReader interface {
+	GetMeta(key []byte) ([]byte, error)
+}
+
+// changeKey returns the metadata key of the change with the passed sequence
+// number.  The sequence number is big endian so the keys sort in order.
+func changeKey(seq uint64) []byte {
+	key := make([]byte, len(changeKeyPrefix)+8)
+	copy(key, changeKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(changeKeyPrefix):], seq)
+	return key
+}
+
+// serializeHead returns the head of a change log as it is stored.
+func serializeHead(head *Head) []byte {
+	value := make([]byte, headSize)
+	binary.LittleEndian.PutUint64(value, head.Seq)
+	copy(value[8:], head.Sha.Bytes())
+	binary.LittleEndian.PutUint64(value[8+btcwire.HashSize:],
+		uint64(head.Height))
+	return value
+}
+
+// serializeChange returns a change as it is stored.
+func serializeChange(c *Change) []byte {
+	value := make([]byte, changeSize)
+	if c.Connected {
+		value[0] = 1
+	}
+	binary.LittleEndian.PutUint64(value[1:], uint64(c.Height))
+	copy(value[9:], c.Sha.Bytes())
+	copy(value[9+btcwire.HashSize:], c.PrevSha.Bytes())
+	return value
+}
+
+// ReadHead returns the head of the change log kept in the passed database or
+// snapshot.  It returns nil when the database has no change log.
+func ReadHead(r MetaReader) (*Head, error) {
+	value, err := r.GetMeta(headKey)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if len(value) != headSize {
+		return nil, errMalformed
+	}
+	head := &Head{
+		Seq:    binary.LittleEndian.Uint64(value),
+		Height: int64(binary.LittleEndian.Uint64(value[8+btcwire.HashSize:])),
+	}
+	if err := head.Sha.SetBytes(value[8 : 8+btcwire.HashSize]); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// ReadChange returns the change with the passed sequence number from the
+// change log kept in the passed database or snapshot.  It returns nil when the
+// log does not hold the change, either because it has been dropped from the
+// log or because its change was never committed.
+func ReadChange(r MetaReader, seq uint64) (*Change, error) {
+	value, err := r.GetMeta(changeKey(seq))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if len(value) != changeSize || value[0] > 1 {
+		return nil, errMalformed
+	}
+	c := &Change{
+		Seq:       seq,
+		Connected: value[0] == 1,
+		Height:    int64(binary.LittleEndian.Uint64(value[1:])),
+	}
+	if err := c.Sha.SetBytes(value[9 : 9+btcwire.HashSize]); err != nil {
+		return nil, err
+	}
+	if err := c.PrevSha.SetBytes(value[9+btcwire.HashSize:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ChangeLog is an indexer which records every block connected to and
+// disconnected from the chain of a primary database in an ordered log for its
+// followers to replay.  The log is kept in the metadata namespace of the
+// database and written in the same atomic change as the blocks, so it always
+// matches the chain.  Each change is given the next sequence number, and only
+// the most recent changes are kept.
+//
+// Should a change fail to commit, its sequence numbers are skipped.  Followers
+// which find a change missing from the log catch up by height instead.
+type ChangeLog struct {
+	size uint64
+
+	mtx sync.Mutex
+	db  btcdb.Db
+	seq uint64
+}
+
+// Ensure ChangeLog implements the btcdb.Indexer interface.
+var _ btcdb.Indexer = (*ChangeLog)(nil)
+
+// NewChangeLog returns a change log which keeps the passed number of changes,
+// or DefaultChangeLogSize when it is not positive.  It starts recording once
+// it is added to a database with AddIndexer.
+func NewChangeLog(size int) *ChangeLog {
+	if size <= 0 {
+		size = DefaultChangeLogSize
+	}
+	return &ChangeLog{size: uint64(size)}
+}
+
+// Init loads the head of the change log from the database, starting the log
+// at the tip of the chain when there is none.  Blocks which were dropped while
+// the log was not recording can not be replayed, so the log is then restarted
+// at the tip after skipping a sequence number, which has followers catch up by
+// height.  This is part of the btcdb.Indexer interface implementation.
+func (l *ChangeLog) Init(db btcdb.Db) error {
+	head, err := ReadHead(db)
+	if err != nil {
+		return err
+	}
+
+	restart := head == nil
+	if head != nil && head.Height >= 0 {
+		sha, err := db.FetchBlockShaByHeight(head.Height)
+		if err != nil && err != btcdb.ErrBlockNotFound {
+			return err
+		}
+		if err != nil || !sha.IsEqual(&head.Sha) {
+			log.Warnf("Change log head %v at height %d is not in "+
+				"the main chain -- restarting the log",
+				&head.Sha, head.Height)
+			restart = true
+		}
+	}
+	if restart {
+		sha, height, err := db.NewestSha()
+		if err != nil {
+			return err
+		}
+		newHead := &Head{Sha: *sha, Height: height}
+		if head != nil {
+			newHead.Seq = head.Seq + 1
+		}
+		var meta btcdb.MetaBatch
+		meta.Put(headKey, serializeHead(newHead))
+		if err := db.WriteMeta(&meta); err != nil {
+			return err
+		}
+		head = newHead
+	}
+
+	l.mtx.Lock()
+	l.db = db
+	l.seq = head.Seq
+	l.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the tip of the chain as of the head of the change log.  This is
+// part of the btcdb.Indexer interface implementation.
+func (l *ChangeLog) Tip() (*btcwire.ShaHash, int64, error) {
+	l.mtx.Lock()
+	db := l.db
+	l.mtx.Unlock()
+
+	head, err := ReadHead(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	if head == nil {
+		return &btcwire.ShaHash{}, -1, nil
+	}
+	return &head.Sha, head.Height, nil
+}
+
+// add adds the passed change to the log, along with dropping the change which
+// no longer fits and moving the head, to the passed batch.
+func (l *ChangeLog) add(c *Change, meta *btcdb.MetaBatch) {
+	l.mtx.Lock()
+	l.seq++
+	c.Seq = l.seq
+	l.mtx.Unlock()
+
+	head := &Head{Seq: c.Seq, Sha: c.Sha, Height: c.Height}
+	if !c.Connected {
+		head.Sha = c.PrevSha
+		head.Height = c.Height - 1
+	}
+	meta.Put(changeKey(c.Seq), serializeChange(c))
+	if c.Seq > l.size {
+		meta.Delete(changeKey(c.Seq - l.size))
+	}
+	meta.Put(headKey, serializeHead(head))
+}
+
+// ConnectBlock records the connection of the passed block.  This is part of
+// the btcdb.Indexer interface implementation.
+func (l *ChangeLog) ConnectBlock(block *btcutil.Block, height int64, spent []*btcdb.UtxoEntry, meta *btcdb.MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	l.add(&Change{
+		Connected: true,
+		Height:    height,
+		Sha:       *sha,
+		PrevSha:   block.MsgBlock().Header.PrevBlock,
+	}, meta)
+	return nil
+}
+
+// DisconnectBlock records the disconnection of the passed block.  This is part
+// of the btcdb.Indexer interface implementation.
+func (l *ChangeLog) DisconnectBlock(block *btcutil.Block, height int64, spent []*btcdb.UtxoEntry, meta *btcdb.MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	l.add(&Change{
+		Height:  height,
+		Sha:     *sha,
+		PrevSha: block.MsgBlock().Header.PrevBlock,
+	}, meta)
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package replication keeps follower databases in sync with a primary database.
+
+The primary records every block connected to and disconnected from its chain
+in a change log, which is an indexer kept in the metadata namespace of the
+database and so is written in the same atomic change as the blocks:
+
+	err := db.AddIndexer(replication.NewChangeLog(0))
+
+Each change is given the next sequence number, and the head of the log holds
+the sequence number of the most recent change along with the tip of the chain
+it left.  Only the most recent changes are kept, DefaultChangeLogSize of them
+unless another size is given.
+
+Followers read the log through the functions of btcdb.Db, so the primary may be
+opened in the same process or served by another one through the remote driver:
+
+	primary, err := btcdb.OpenDB("remote", "tcp://primary.example.com:8341")
+	if err != nil {
+		// Log and handle the error
+	}
+	f := replication.NewFollower(primary, local)
+	err = f.Run(ctx)
+
+A follower applies the changes after the last one it applied, which is stored
+in the follower database along with each change, and then checks that its tip
+is the tip of the primary as of the head of the log.  Followers which have not
+synced before, which are further behind than the log reaches, or whose chain
+does not match the changes, catch up by height instead: the blocks above the
+most recent block shared with the primary are dropped and the blocks of the
+primary above it are inserted.  A follower which shares no block with its
+primary, such as one of another network, returns ErrDiverged.
+*/
+package replication
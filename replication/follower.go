@@ -0,0 +1,358 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package replication
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoChangeLog is returned when a follower syncs with a primary
+	// which does not keep a change log.
+	ErrNoChangeLog = errors.New("Primary database has no change log")
+
+	// ErrDiverged is returned when the chain of a follower can not be
+	// brought in line with the chain of its primary, which happens when
+	// they share no block, such as when they are of different networks.
+	ErrDiverged = errors.New("Follower has diverged from the primary")
+)
+
+// appliedKey is the metadata key of the follower database which holds the
+// sequence number of the last change of the primary it applied.
+var appliedKey = []byte("replication/applied")
+
+// catchUpBatch is the number of blocks a follower which catches up by height
+// inserts in a single write.
+const catchUpBatch = 100
+
+// pollInterval is how often a running follower checks the primary for changes
+// in case it is not told of them by its subscription.
+const pollInterval = 10 * time.Second
+
+// Follower keeps a database in sync with a primary database by replaying the
+// change log of the primary.  The sequence number of the last change applied
+// is stored in the metadata namespace of the follower database along with the
+// change, so a follower resumes where it stopped.  Followers which are too far
+// behind for the log, or whose chain does not match the changes in the log,
+// catch up by height from the most recent block they share with the primary
+// instead.
+//
+// The follower database must not be changed other than by its follower.
+type Follower struct {
+	primary btcdb.Db
+	local   btcdb.Db
+
+	// mtx serializes syncs.
+	mtx sync.Mutex
+}
+
+// NewFollower returns a follower which keeps the local database in sync with
+// the primary database.  The primary may be any database, including one served
+// by another process through the remote driver, and must have a ChangeLog
+// added.
+func NewFollower(primary, local btcdb.Db) *Follower {
+	return &Follower{primary: primary, local: local}
+}
+
+// Applied returns the sequence number of the last change of the primary which
+// was applied to the follower database, and false when the follower has not
+// synced yet.
+func (f *Follower) Applied() (uint64, bool, error) {
+	value, err := f.local.GetMeta(appliedKey)
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	if len(value) != 8 {
+		return 0, false, errMalformed
+	}
+	return binary.LittleEndian.Uint64(value), true, nil
+}
+
+// setApplied adds storing the passed sequence number as the last change
+// applied to the passed batch.
+func setApplied(meta *btcdb.MetaBatch, seq uint64) {
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], seq)
+	meta.Put(appliedKey, value[:])
+}
+
+// Sync applies the changes made to the primary since the last sync, and then
+// ensures the tip of the follower is the tip of the primary as of the head of
+// the change log.  The changes are read from a snapshot of the primary, so
+// changes made during the sync are left for the next one.
+func (f *Follower) Sync() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	snap, err := f.primary.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	head, err := ReadHead(snap)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return ErrNoChangeLog
+	}
+	applied, ok, err := f.Applied()
+	if err != nil {
+		return err
+	}
+	if !ok || applied > head.Seq {
+		return f.catchUp(snap, head)
+	}
+
+	for seq := applied + 1; seq <= head.Seq; {
+		n, err := f.apply(snap, seq, head.Seq)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return f.catchUp(snap, head)
+		}
+		seq += n
+	}
+	return f.check(snap, head, true)
+}
+
+// apply applies the changes of the primary starting at the passed sequence
+// number, up to the last one, in a single write.  Consecutive connected blocks
+// are inserted together.  It returns the number of changes applied, which is
+// zero when the next change is missing from the log or does not follow from
+// the tip of the follower.
+func (f *Follower) apply(snap btcdb.Snapshot, seq, last uint64) (uint64, error) {
+	tipSha, tipHeight, err := f.local.NewestSha()
+	if err != nil {
+		return 0, err
+	}
+
+	var blocks []*btcutil.Block
+	var meta btcdb.MetaBatch
+	for ; seq <= last && len(blocks) < catchUpBatch; seq++ {
+		c, err := ReadChange(snap, seq)
+		if err != nil {
+			return 0, err
+		}
+		if c == nil {
+			log.Debugf("Change %d is missing from the change log",
+				seq)
+			break
+		}
+		if !c.Connected {
+			if len(blocks) != 0 {
+				break
+			}
+			if c.Height != tipHeight || !c.Sha.IsEqual(tipSha) {
+				log.Debugf("Disconnected block %v at height %d "+
+					"is not the tip of the follower", &c.Sha,
+					c.Height)
+				return 0, nil
+			}
+			setApplied(&meta, seq)
+			err := f.local.DropAfterBlockByShaWithMeta(&c.PrevSha,
+				&meta)
+			if err != nil {
+				return 0, err
+			}
+			return 1, nil
+		}
+
+		if c.Height != tipHeight+1 || !c.PrevSha.IsEqual(tipSha) {
+			log.Debugf("Connected block %v at height %d does not "+
+				"extend the tip of the follower", &c.Sha, c.Height)
+			break
+		}
+		block, err := snap.FetchBlockBySha(&c.Sha)
+		if err == btcdb.ErrBlockNotFound {
+			// The block was disconnected by a later change.
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		blocks = append(blocks, block)
+		tipSha, tipHeight = &c.Sha, c.Height
+	}
+	if len(blocks) == 0 {
+		return 0, nil
+	}
+
+	n := uint64(len(blocks))
+	setApplied(&meta, seq-1)
+	if _, err := f.local.InsertBlocksWithMeta(blocks, &meta); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// catchUp brings the follower to the tip of the primary as of the head of the
+// change log by height.  Blocks of the follower above the most recent block it
+// shares with the primary are dropped, and the blocks of the primary above it
+// are inserted.
+func (f *Follower) catchUp(snap btcdb.Snapshot, head *Head) error {
+	_, localHeight, err := f.local.NewestSha()
+	if err != nil {
+		return err
+	}
+
+	// Find the most recent block the follower shares with the primary.
+	fork := localHeight
+	if fork > head.Height {
+		fork = head.Height
+	}
+	var forkSha *btcwire.ShaHash
+	for ; fork >= 0; fork-- {
+		localSha, err := f.local.FetchBlockShaByHeight(fork)
+		if err != nil {
+			return err
+		}
+		sha, err := snap.FetchBlockShaByHeight(fork)
+		if err != nil {
+			return err
+		}
+		if localSha.IsEqual(sha) {
+			forkSha = sha
+			break
+		}
+	}
+	if forkSha == nil && localHeight >= 0 {
+		return ErrDiverged
+	}
+	log.Infof("Catching up with the primary from height %d to %d",
+		fork+1, head.Height)
+
+	var meta btcdb.MetaBatch
+	if fork < localHeight {
+		meta.Delete(appliedKey)
+		err := f.local.DropAfterBlockByShaWithMeta(forkSha, &meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	for height := fork + 1; height <= head.Height; height += catchUpBatch {
+		end := height + catchUpBatch
+		if end > head.Height+1 {
+			end = head.Height + 1
+		}
+		shas, err := snap.FetchHeightRange(height, end)
+		if err != nil {
+			return err
+		}
+		blocks := make([]*btcutil.Block, 0, len(shas))
+		for i := range shas {
+			block, err := snap.FetchBlockBySha(&shas[i])
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+
+		meta.Reset()
+		if end == head.Height+1 {
+			setApplied(&meta, head.Seq)
+		}
+		if _, err := f.local.InsertBlocksWithMeta(blocks, &meta); err != nil {
+			return err
+		}
+	}
+	if fork == head.Height {
+		meta.Reset()
+		setApplied(&meta, head.Seq)
+		if err := f.local.WriteMeta(&meta); err != nil {
+			return err
+		}
+	}
+	return f.check(snap, head, false)
+}
+
+// check ensures the tip of the follower is the tip of the primary as of the
+// head of the change log.  When it is not, the follower catches up by height
+// if retry is set, and otherwise ErrDiverged is returned.
+func (f *Follower) check(snap btcdb.Snapshot, head *Head, retry bool) error {
+	sha, height, err := f.local.NewestSha()
+	if err != nil {
+		return err
+	}
+	if height == head.Height && sha.IsEqual(&head.Sha) {
+		return nil
+	}
+	log.Warnf("Follower tip %v at height %d does not match primary tip "+
+		"%v at height %d", sha, height, &head.Sha, head.Height)
+	if !retry {
+		return ErrDiverged
+	}
+	return f.catchUp(snap, head)
+}
+
+// Run syncs the follower whenever the primary changes until the passed context
+// is done, in which case it returns the error of the context.  The follower
+// subscribes to the primary to learn of its changes, and also checks for them
+// periodically.  Failed syncs are logged and retried, except when the
+// follower has diverged from the primary or its database has been closed.
+func (f *Follower) Run(ctx context.Context) error {
+	var events <-chan btcdb.ChainEvent
+	sub, err := f.primary.Subscribe()
+	if err != nil {
+		log.Warnf("Unable to subscribe to the primary, polling "+
+			"instead: %v", err)
+	} else {
+		defer sub.Unsubscribe()
+		events = sub.Events()
+	}
+
+	for {
+		err := f.Sync()
+		if err == ErrDiverged {
+			return err
+		}
+		if f.local.Closed() {
+			return btcdb.ErrDbClosed
+		}
+		if err != nil {
+			log.Warnf("Sync with the primary failed: %v", err)
+		}
+
+		timer := time.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				break
+			}
+
+			// A single sync applies all of the queued changes.
+		drain:
+			for {
+				select {
+				case _, ok := <-events:
+					if !ok {
+						events = nil
+						break drain
+					}
+				default:
+					break drain
+				}
+			}
+
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
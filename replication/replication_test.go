@@ -0,0 +1,354 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package replication_test
+
+import (
+	"compress/bzip2"
+	"context"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/memdb"
+	"github.com/conformal/btcdb/remote"
+	"github.com/conformal/btcdb/replication"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadBlocks returns the genesis block followed by the blocks of the test
+// data.
+func loadBlocks(t *testing.T) []*btcutil.Block {
+	testdatafile := filepath.Join("..", "testdata", "blocks1-256.bz2")
+	fi, err := os.Open(testdatafile)
+	if err != nil {
+		t.Fatalf("failed to open file %v, err %v", testdatafile, err)
+	}
+	defer fi.Close()
+	dr := bzip2.NewReader(fi)
+
+	blocks := []*btcutil.Block{btcutil.NewBlock(&btcwire.GenesisBlock)}
+	for {
+		var hdr [2]uint32
+		err := binary.Read(dr, binary.LittleEndian, &hdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read block header, err %v", err)
+		}
+		rbytes := make([]byte, hdr[1])
+		if _, err := io.ReadFull(dr, rbytes); err != nil {
+			t.Fatalf("failed to read block, err %v", err)
+		}
+		block, err := btcutil.NewBlockFromBytes(rbytes)
+		if err != nil {
+			t.Fatalf("failed to parse block %v, err %v", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// newDB returns a new memory database holding the passed blocks.
+func newDB(t *testing.T, blocks []*btcutil.Block) btcdb.Db {
+	db, err := btcdb.CreateDB("memory")
+	if err != nil {
+		t.Fatalf("Failed to open test database %v", err)
+	}
+	if len(blocks) != 0 {
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Fatalf("InsertBlocks: %v", err)
+		}
+	}
+	return db
+}
+
+// dropAfter drops the blocks above the passed height from the database.
+func dropAfter(t *testing.T, db btcdb.Db, blocks []*btcutil.Block, height int) {
+	sha, _ := blocks[height].Sha()
+	if err := db.DropAfterBlockBySha(sha); err != nil {
+		t.Fatalf("DropAfterBlockBySha: %v", err)
+	}
+}
+
+// checkTip ensures the tip of the follower database is the block at the passed
+// height.
+func checkTip(t *testing.T, local btcdb.Db, blocks []*btcutil.Block, height int) {
+	wantSha, _ := blocks[height].Sha()
+	sha, gotHeight, err := local.NewestSha()
+	if err != nil || gotHeight != int64(height) || !sha.IsEqual(wantSha) {
+		t.Fatalf("NewestSha: got %v at %d (err %v), want %v at %d", sha,
+			gotHeight, err, wantSha, height)
+	}
+}
+
+// checkApplied ensures the follower has applied the changes up to the head of
+// the change log of the primary.
+func checkApplied(t *testing.T, f *replication.Follower, primary btcdb.Db) {
+	head, err := replication.ReadHead(primary)
+	if err != nil || head == nil {
+		t.Fatalf("ReadHead: got %v (err %v)", head, err)
+	}
+	applied, ok, err := f.Applied()
+	if err != nil || !ok || applied != head.Seq {
+		t.Fatalf("Applied: got %d %v (err %v), want %d", applied, ok,
+			err, head.Seq)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	blocks := loadBlocks(t)[:20]
+	db := newDB(t, blocks[:5])
+	defer db.Close()
+
+	// The log starts at the tip of the chain.
+	if err := db.AddIndexer(replication.NewChangeLog(8)); err != nil {
+		t.Fatalf("AddIndexer: %v", err)
+	}
+	head, err := replication.ReadHead(db)
+	tipSha, _ := blocks[4].Sha()
+	if err != nil || head == nil || head.Seq != 0 || head.Height != 4 ||
+		!head.Sha.IsEqual(tipSha) {
+		t.Fatalf("ReadHead: got %+v (err %v), want sequence 0 at %v",
+			head, err, tipSha)
+	}
+
+	if _, err := db.InsertBlocks(blocks[5:15]); err != nil {
+		t.Fatalf("InsertBlocks: %v", err)
+	}
+	dropAfter(t, db, blocks, 12)
+
+	// Blocks 5 to 14 were connected as changes 1 to 10, and blocks 14
+	// and 13 disconnected as changes 11 and 12, of which the log keeps
+	// the last 8.
+	head, err = replication.ReadHead(db)
+	tipSha, _ = blocks[12].Sha()
+	if err != nil || head == nil || head.Seq != 12 || head.Height != 12 ||
+		!head.Sha.IsEqual(tipSha) {
+		t.Fatalf("ReadHead: got %+v (err %v), want sequence 12 at %v",
+			head, err, tipSha)
+	}
+	for seq := uint64(1); seq <= head.Seq; seq++ {
+		c, err := replication.ReadChange(db, seq)
+		if err != nil {
+			t.Fatalf("ReadChange: %v", err)
+		}
+		if seq <= head.Seq-8 {
+			if c != nil {
+				t.Errorf("ReadChange: change %d was kept", seq)
+			}
+			continue
+		}
+
+		height := int(seq) + 4
+		connected := true
+		if seq > 10 {
+			height = 14 - int(seq-11)
+			connected = false
+		}
+		sha, _ := blocks[height].Sha()
+		if c == nil || c.Seq != seq || c.Connected != connected ||
+			c.Height != int64(height) || !c.Sha.IsEqual(sha) ||
+			!c.PrevSha.IsEqual(&blocks[height].MsgBlock().Header.PrevBlock) {
+			t.Errorf("ReadChange: change %d is %+v, want block %v "+
+				"at %d connected %v", seq, c, sha, height,
+				connected)
+		}
+	}
+}
+
+func TestFollower(t *testing.T) {
+	blocks := loadBlocks(t)
+	primary := newDB(t, blocks[:50])
+	defer primary.Close()
+	if err := primary.AddIndexer(replication.NewChangeLog(0)); err != nil {
+		t.Fatalf("AddIndexer: %v", err)
+	}
+
+	// A new follower catches up by height.
+	local := newDB(t, nil)
+	defer local.Close()
+	f := replication.NewFollower(primary, local)
+	if _, ok, _ := f.Applied(); ok {
+		t.Fatalf("Applied: new follower has applied changes")
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 49)
+	checkApplied(t, f, primary)
+
+	// Connected and disconnected blocks are replayed from the log.
+	if _, err := primary.InsertBlocks(blocks[50:120]); err != nil {
+		t.Fatalf("InsertBlocks: %v", err)
+	}
+	dropAfter(t, primary, blocks, 100)
+	if _, err := primary.InsertBlocks(blocks[101:110]); err != nil {
+		t.Fatalf("InsertBlocks: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 109)
+	checkApplied(t, f, primary)
+
+	// Disconnects are replayed down to a tip below the last sync.
+	dropAfter(t, primary, blocks, 80)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 80)
+	checkApplied(t, f, primary)
+
+	// A sync without changes leaves the follower as it is.
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 80)
+}
+
+func TestFollowerCatchUp(t *testing.T) {
+	blocks := loadBlocks(t)
+	primary := newDB(t, blocks[:30])
+	defer primary.Close()
+	if err := primary.AddIndexer(replication.NewChangeLog(5)); err != nil {
+		t.Fatalf("AddIndexer: %v", err)
+	}
+
+	// The follower starts out ahead of the primary.
+	local := newDB(t, blocks[:60])
+	defer local.Close()
+	f := replication.NewFollower(primary, local)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 29)
+	checkApplied(t, f, primary)
+
+	// Changes which are no longer in the log are caught up by height.
+	if _, err := primary.InsertBlocks(blocks[30:90]); err != nil {
+		t.Fatalf("InsertBlocks: %v", err)
+	}
+	if c, _ := replication.ReadChange(primary, 1); c != nil {
+		t.Fatalf("ReadChange: change 1 was kept")
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 89)
+	checkApplied(t, f, primary)
+
+	// The follower is brought back in line with the primary when its
+	// chain was changed.
+	dropAfter(t, local, blocks, 70)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	checkTip(t, local, blocks, 89)
+	checkApplied(t, f, primary)
+}
+
+func TestFollowerErrors(t *testing.T) {
+	blocks := loadBlocks(t)[:10]
+	primary := newDB(t, blocks)
+	defer primary.Close()
+
+	local := newDB(t, nil)
+	defer local.Close()
+	f := replication.NewFollower(primary, local)
+	if err := f.Sync(); err != replication.ErrNoChangeLog {
+		t.Errorf("Sync: got %v without a change log, want %v", err,
+			replication.ErrNoChangeLog)
+	}
+
+	// A follower of another chain shares no block with the primary.
+	if err := primary.AddIndexer(replication.NewChangeLog(0)); err != nil {
+		t.Fatalf("AddIndexer: %v", err)
+	}
+	genesis := btcwire.GenesisBlock
+	genesis.Header.Nonce++
+	other := newDB(t, []*btcutil.Block{btcutil.NewBlock(&genesis)})
+	defer other.Close()
+	f = replication.NewFollower(primary, other)
+	if err := f.Sync(); err != replication.ErrDiverged {
+		t.Errorf("Sync: got %v for another chain, want %v", err,
+			replication.ErrDiverged)
+	}
+}
+
+func TestFollowerRemote(t *testing.T) {
+	blocks := loadBlocks(t)
+	primary := newDB(t, blocks[:100])
+	defer primary.Close()
+	if err := primary.AddIndexer(replication.NewChangeLog(0)); err != nil {
+		t.Fatalf("AddIndexer: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := remote.NewServer(primary)
+	go s.Serve(l)
+	defer s.Close()
+
+	client, err := btcdb.OpenDB("remote", "tcp://"+l.Addr().String())
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer client.Close()
+
+	local := newDB(t, nil)
+	defer local.Close()
+	f := replication.NewFollower(client, local)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Run(ctx)
+	}()
+
+	// waitTip waits for the follower to reach the block at the passed
+	// height.
+	waitTip := func(height int) {
+		wantSha, _ := blocks[height].Sha()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			sha, _, err := local.NewestSha()
+			if err == nil && sha.IsEqual(wantSha) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for the follower to reach height %d",
+			height)
+	}
+	waitTip(99)
+
+	// Changes to the primary are applied as they are made.
+	for _, block := range blocks[100:150] {
+		if _, err := primary.InsertBlock(block); err != nil {
+			t.Fatalf("InsertBlock: %v", err)
+		}
+	}
+	waitTip(149)
+	dropAfter(t, primary, blocks, 140)
+	waitTip(140)
+	checkApplied(t, f, primary)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Run did not return once cancelled")
+	}
+}
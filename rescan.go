@@ -0,0 +1,149 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"runtime"
+	"sync"
+)
+
+// ScriptFilter returns whether the passed output script is of interest to a
+// Rescan, such as when it pays to an address of a wallet.
+type ScriptFilter func(pkScript []byte) bool
+
+// RescanFunc is called by Rescan with each transaction matched along with the
+// hash and height of the block holding it.  Returning an error stops the
+// rescan, which returns the error.
+type RescanFunc func(tx *btcutil.Tx, blockSha *btcwire.ShaHash, height int64) error
+
+// rescanJob is a block on its way through a Rescan.  The block or the error
+// which prevented decoding it is set before ready is closed.
+type rescanJob struct {
+	height int64
+	sha    btcwire.ShaHash
+	raw    []byte
+	blk    *btcutil.Block
+	err    error
+	ready  chan struct{}
+}
+
+// Rescan walks the blocks of the chain of the passed database from the block at
+// the passed height on and calls fn with every transaction which has an output
+// whose script the filter matches or which spends such an output found by the
+// rescan, in the order of the chain.  Progress, when not nil, is called with
+// the height of each block once its transactions have been matched.
+//
+// The blocks are read from a snapshot taken when the rescan starts and are
+// deserialized by one goroutine for every processor while the transactions are
+// matched in order on the calling goroutine, so fn and progress are never
+// called concurrently.  The outputs matched are kept in memory for the length
+// of the rescan to match the transactions spending them.
+func Rescan(db Db, startHeight int64, filter ScriptFilter, fn RescanFunc, progress func(height int64)) error {
+	it, err := db.BlockIterator(startHeight)
+	if err != nil {
+		return err
+	}
+
+	workers := runtime.NumCPU()
+	work := make(chan *rescanJob, workers)
+	pending := make(chan *rescanJob, 2*workers)
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range work {
+				job.blk, job.err = decodeImportBlock(job.raw)
+				job.raw = nil
+				close(job.ready)
+			}
+		}()
+	}
+
+	// The blocks are read in order and queued both for the workers and,
+	// in the same order, for matching.  The error of the iterator is only
+	// read once pending is closed.
+	var iterErr error
+	go func() {
+		defer close(pending)
+		defer close(work)
+		for it.Next() {
+			job := &rescanJob{
+				height: it.Height(),
+				sha:    *it.Sha(),
+				raw:    append([]byte(nil), it.RawBytes()...),
+				ready:  make(chan struct{}),
+			}
+			select {
+			case pending <- job:
+			case <-quit:
+				return
+			}
+			work <- job
+		}
+		iterErr = it.Err()
+	}()
+
+	watched := make(map[btcwire.OutPoint]struct{})
+	for job := range pending {
+		if err != nil {
+			continue
+		}
+		<-job.ready
+		if job.err != nil {
+			err = job.err
+		} else {
+			err = rescanBlock(job, filter, watched, fn)
+		}
+		if err != nil {
+			close(quit)
+			continue
+		}
+		if progress != nil {
+			progress(job.height)
+		}
+	}
+	wg.Wait()
+	it.Release()
+
+	if err != nil {
+		return err
+	}
+	return iterErr
+}
+
+// rescanBlock calls fn with every transaction of the block of the passed job
+// which has an output matched by the filter or which spends a watched output,
+// adding the outputs matched to the watched ones.
+func rescanBlock(job *rescanJob, filter ScriptFilter, watched map[btcwire.OutPoint]struct{}, fn RescanFunc) error {
+	for _, tx := range job.blk.Transactions() {
+		matched := false
+		for _, txIn := range tx.MsgTx().TxIn {
+			op := txIn.PreviousOutpoint
+			if _, ok := watched[op]; ok {
+				delete(watched, op)
+				matched = true
+			}
+		}
+		for i, txOut := range tx.MsgTx().TxOut {
+			if filter(txOut.PkScript) {
+				op := btcwire.NewOutPoint(tx.Sha(), uint32(i))
+				watched[*op] = struct{}{}
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		if err := fn(tx, &job.sha, job.height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// TestRescan ensures rescanning the chain of every supported database type
+// finds the transactions paying to the scripts matched and those spending
+// them, in order, and stops with the error of the callback.
+func TestRescan(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The coinbase of block 9 pays to the script matched and its output
+	// is spent by the second transaction of block 170, which pays change
+	// back to the same script, as do the transactions spending the change
+	// in turn.
+	script := blocks[9].MsgBlock().Transactions[0].TxOut[0].PkScript
+	filter := func(pkScript []byte) bool {
+		return bytes.Equal(pkScript, script)
+	}
+	wantHeights := []int64{9, 170, 181, 182, 183, 248}
+	want := []*btcwire.ShaHash{blocks[9].Transactions()[0].Sha()}
+	for _, height := range wantHeights[1:] {
+		want = append(want, blocks[height].Transactions()[1].Sha())
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "rescan", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		var got []*btcwire.ShaHash
+		var heights []int64
+		lastProgress := int64(-1)
+		err = btcdb.Rescan(db, 0, filter, func(tx *btcutil.Tx, blockSha *btcwire.ShaHash, height int64) error {
+			wantSha, _ := blocks[height].Sha()
+			if !blockSha.IsEqual(wantSha) {
+				t.Errorf("Rescan (%s): got block %v for height %d, "+
+					"want %v", dbType, blockSha, height, wantSha)
+			}
+			got = append(got, tx.Sha())
+			heights = append(heights, height)
+			return nil
+		}, func(height int64) {
+			if height != lastProgress+1 {
+				t.Errorf("Rescan (%s): got progress at height %d "+
+					"after %d", dbType, height, lastProgress)
+			}
+			lastProgress = height
+		})
+		if err != nil {
+			t.Errorf("Rescan (%s): %v", dbType, err)
+		}
+		if !reflect.DeepEqual(got, want) ||
+			!reflect.DeepEqual(heights, wantHeights) {
+			t.Errorf("Rescan (%s): got %v at heights %v, want %v",
+				dbType, got, heights, want)
+		}
+		if lastProgress != int64(len(blocks)-1) {
+			t.Errorf("Rescan (%s): progress ended at height %d, want %d",
+				dbType, lastProgress, len(blocks)-1)
+		}
+
+		// Starting after the coinbase still finds the change paid to
+		// the script.
+		got = nil
+		err = btcdb.Rescan(db, 10, filter, func(tx *btcutil.Tx, blockSha *btcwire.ShaHash, height int64) error {
+			got = append(got, tx.Sha())
+			return nil
+		}, nil)
+		if err != nil || !reflect.DeepEqual(got, want[1:]) {
+			t.Errorf("Rescan (%s): got %v (err %v) from height 10, "+
+				"want %v", dbType, got, err, want[1:])
+		}
+
+		// The error of the callback stops the rescan.
+		errStop := fmt.Errorf("stop")
+		calls := 0
+		err = btcdb.Rescan(db, 0, filter, func(tx *btcutil.Tx, blockSha *btcwire.ShaHash, height int64) error {
+			calls++
+			return errStop
+		}, nil)
+		if err != errStop || calls != 1 {
+			t.Errorf("Rescan (%s): got %v after %d calls, want %v "+
+				"after 1", dbType, err, calls, errStop)
+		}
+		teardown()
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Opcodes of the scripts of transaction outputs which the indexes of the
+// package recognize.
+const (
+	opFalse     = 0x00
+	opPushData1 = 0x4c
+	opPushData2 = 0x4d
+	opPushData4 = 0x4e
+	op1Negate   = 0x4f
+	op1         = 0x51
+	op16        = 0x60
+	opReturn    = 0x6a
+)
+
+// pushedData returns the data pushed by the passed script, which must only
+// consist of push operations, along with whether it does.  The small integers
+// pushed by OP_1NEGATE and OP_1 through OP_16 are returned as a single byte
+// holding their value.
+func pushedData(script []byte) ([][]byte, bool) {
+	var pushes [][]byte
+	for len(script) != 0 {
+		op := script[0]
+		script = script[1:]
+
+		var n int
+		switch {
+		case op == opFalse:
+			pushes = append(pushes, nil)
+			continue
+		case op < opPushData1:
+			n = int(op)
+		case op == opPushData1:
+			if len(script) < 1 {
+				return nil, false
+			}
+			n, script = int(script[0]), script[1:]
+		case op == opPushData2:
+			if len(script) < 2 {
+				return nil, false
+			}
+			n = int(binary.LittleEndian.Uint16(script))
+			script = script[2:]
+		case op == opPushData4:
+			if len(script) < 4 {
+				return nil, false
+			}
+			n64 := uint64(binary.LittleEndian.Uint32(script))
+			if n64 > uint64(len(script)-4) {
+				return nil, false
+			}
+			n = int(n64)
+			script = script[4:]
+		case op == op1Negate:
+			pushes = append(pushes, []byte{0x81})
+			continue
+		case op >= op1 && op <= op16:
+			pushes = append(pushes, []byte{op - op1 + 1})
+			continue
+		default:
+			return nil, false
+		}
+		if n > len(script) {
+			return nil, false
+		}
+		pushes = append(pushes, script[:n])
+		script = script[n:]
+	}
+	return pushes, true
+}
+
+// nullDataPayload returns the payload of the passed output script when it is
+// an OP_RETURN output, along with whether it is one.  The payload is the data
+// pushed after the OP_RETURN joined together, or every byte after it when the
+// rest of the script is not made of pushes.
+func nullDataPayload(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != opReturn {
+		return nil, false
+	}
+	pushes, ok := pushedData(script[1:])
+	if !ok {
+		return append([]byte(nil), script[1:]...), true
+	}
+	var payload []byte
+	for _, push := range pushes {
+		payload = append(payload, push...)
+	}
+	return payload, true
+}
+
+// ScriptClass is the class of the script of a transaction output, as used by
+// ScriptClassIndex.
+type ScriptClass byte
+
+// The classes of output scripts returned by ClassifyScript.
+const (
+	// NonStandardTy is a script which is none of the other classes.
+	NonStandardTy ScriptClass = iota
+
+	// PubKeyTy pays to a public key checked with OP_CHECKSIG.
+	PubKeyTy
+
+	// PubKeyHashTy pays to the hash of a public key.
+	PubKeyHashTy
+
+	// ScriptHashTy pays to the hash of a script as set out by BIP0016.
+	ScriptHashTy
+
+	// MultiSigTy pays to m of n public keys checked with
+	// OP_CHECKMULTISIG.
+	MultiSigTy
+
+	// NullDataTy is an OP_RETURN followed only by pushes, which carries
+	// data and may not be spent.
+	NullDataTy
+
+	// WitnessV0PubKeyHashTy pays to the hash of a public key with a
+	// version 0 witness program as set out by BIP0141.
+	WitnessV0PubKeyHashTy
+
+	// WitnessV0ScriptHashTy pays to the hash of a script with a version 0
+	// witness program as set out by BIP0141.
+	WitnessV0ScriptHashTy
+
+	// WitnessUnknownTy pays to a witness program of a version above 0,
+	// whose meaning is left to later soft forks.
+	WitnessUnknownTy
+
+	// NumScriptClasses is the number of classes of output scripts.
+	NumScriptClasses = int(WitnessUnknownTy) + 1
+)
+
+// More opcodes of the standard output scripts.
+const (
+	opDup           = 0x76
+	opEqual         = 0x87
+	opEqualVerify   = 0x88
+	opHash160       = 0xa9
+	opCheckSig      = 0xac
+	opCheckMultiSig = 0xae
+)
+
+// scriptClassStrings is a map of script classes back to their names for pretty
+// printing.
+var scriptClassStrings = map[ScriptClass]string{
+	NonStandardTy:         "nonstandard",
+	PubKeyTy:              "pubkey",
+	PubKeyHashTy:          "pubkeyhash",
+	ScriptHashTy:          "scripthash",
+	MultiSigTy:            "multisig",
+	NullDataTy:            "nulldata",
+	WitnessV0PubKeyHashTy: "witness_v0_keyhash",
+	WitnessV0ScriptHashTy: "witness_v0_scripthash",
+	WitnessUnknownTy:      "witness_unknown",
+}
+
+// String returns the ScriptClass as a human-readable name.
+func (c ScriptClass) String() string {
+	if str, ok := scriptClassStrings[c]; ok {
+		return str
+	}
+	return fmt.Sprintf("Unknown ScriptClass (%d)", int(c))
+}
+
+// isPubKeyLen returns whether the passed length is the one of a compressed or
+// uncompressed public key.
+func isPubKeyLen(n int) bool {
+	return n == 33 || n == 65
+}
+
+// isMultiSig returns whether the passed script pays to m of n public keys.
+func isMultiSig(script []byte) bool {
+	if len(script) < 3 || script[len(script)-1] != opCheckMultiSig {
+		return false
+	}
+	m, n := script[0], script[len(script)-2]
+	if m < op1 || m > op16 || n < op1 || n > op16 || m > n {
+		return false
+	}
+	pushes, ok := pushedData(script[1 : len(script)-2])
+	if !ok || len(pushes) != int(n-op1+1) {
+		return false
+	}
+	for _, push := range pushes {
+		if !isPubKeyLen(len(push)) {
+			return false
+		}
+	}
+	return true
+}
+
+// witnessProgram returns the version and program of the passed output script
+// when it is a witness program, which is a push of the version followed by a
+// push of 2 to 40 bytes, along with whether it is one.
+func witnessProgram(script []byte) (int, []byte, bool) {
+	if len(script) < 4 || len(script) > 42 {
+		return 0, nil, false
+	}
+	if script[0] != opFalse && (script[0] < op1 || script[0] > op16) {
+		return 0, nil, false
+	}
+	if int(script[1]) != len(script)-2 {
+		return 0, nil, false
+	}
+	version := 0
+	if script[0] != opFalse {
+		version = int(script[0]-op1) + 1
+	}
+	return version, script[2:], true
+}
+
+// ClassifyScript returns the class of the passed output script.  Version 0
+// witness programs which are neither the hash of a public key nor of a script
+// may never be spent and are nonstandard.
+func ClassifyScript(script []byte) ScriptClass {
+	if version, program, ok := witnessProgram(script); ok {
+		switch {
+		case version != 0:
+			return WitnessUnknownTy
+		case len(program) == 20:
+			return WitnessV0PubKeyHashTy
+		case len(program) == 32:
+			return WitnessV0ScriptHashTy
+		}
+		return NonStandardTy
+	}
+
+	switch {
+	case len(script) == 25 && script[0] == opDup &&
+		script[1] == opHash160 && script[2] == 20 &&
+		script[23] == opEqualVerify && script[24] == opCheckSig:
+		return PubKeyHashTy
+
+	case len(script) == 23 && script[0] == opHash160 &&
+		script[1] == 20 && script[22] == opEqual:
+		return ScriptHashTy
+
+	case len(script) > 0 && isPubKeyLen(int(script[0])) &&
+		len(script) == int(script[0])+2 &&
+		script[len(script)-1] == opCheckSig:
+		return PubKeyTy
+
+	case isMultiSig(script):
+		return MultiSigTy
+
+	case len(script) > 0 && script[0] == opReturn:
+		if _, ok := pushedData(script[1:]); ok {
+			return NullDataTy
+		}
+	}
+	return NonStandardTy
+}
+
+// ScriptAddress returns the data the address paid by the passed output script
+// is encoded from, which is the hash of the public key or script for scripts
+// paying to a hash, the witness program for version 0 witness programs and the
+// public key for scripts paying to one.  It returns nil for the other classes,
+// which have no single address.
+func ScriptAddress(script []byte) []byte {
+	switch ClassifyScript(script) {
+	case PubKeyTy:
+		return script[1 : len(script)-1]
+	case PubKeyHashTy:
+		return script[3:23]
+	case ScriptHashTy:
+		return script[2:22]
+	case WitnessV0PubKeyHashTy, WitnessV0ScriptHashTy:
+		return script[2:]
+	}
+	return nil
+}
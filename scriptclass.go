@@ -0,0 +1,496 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// ScriptClassPrefix is the prefix of the keys of the metadata namespace under
+// which a ScriptClassIndex keeps its state.
+var ScriptClassPrefix = []byte("btcdb/scriptclass/")
+
+var (
+	// scriptClassTipKey is the key of the hash and height of the newest
+	// block indexed by the script class index.
+	scriptClassTipKey = []byte("btcdb/scriptclass/tip")
+
+	// scriptClassHeightPrefix is the prefix of the keys of the counts of
+	// each block, which are followed by the height of the block as a big
+	// endian number.
+	scriptClassHeightPrefix = []byte("btcdb/scriptclass/height/")
+
+	// scriptClassOutPrefix is the prefix of the keys of the entries of the
+	// outputs of each class, which are followed by the class, the height
+	// of the block holding the output as a big endian number, the hash of
+	// its transaction and its index as a big endian number.  The value is
+	// the value of the output as an 8-byte little-endian number followed by
+	// its script.
+	scriptClassOutPrefix = []byte("btcdb/scriptclass/out/")
+
+	// scriptClassVersionKey is the key of the version of the records of
+	// the script class index.  It is kept outside of ScriptClassPrefix so
+	// it survives the index being rebuilt.
+	scriptClassVersionKey = []byte("btcdb/version/scriptclass")
+)
+
+// scriptClassVersion is the version of the records of the script class index.
+// It is increased whenever the classes returned by ClassifyScript or the layout
+// of the records change, which has the index rebuilt when it is added to a
+// database.  Version 1 counted the classes from before witness programs were
+// classified, and recorded the number of classes rather than a version.
+// Version 2 only counted the outputs without listing those of each class.
+const scriptClassVersion = 3
+
+// scriptClassRecordLen is the length of the counts of a block: the number of
+// outputs of the block of each class followed by the number of outputs of the
+// chain up to and including it of each class.
+const scriptClassRecordLen = NumScriptClasses * (4 + 8)
+
+// scriptClassHeightKey returns the key of the counts of the block at the passed
+// height.
+func scriptClassHeightKey(height int64) []byte {
+	key := make([]byte, len(scriptClassHeightPrefix)+8)
+	copy(key, scriptClassHeightPrefix)
+	binary.BigEndian.PutUint64(key[len(scriptClassHeightPrefix):],
+		uint64(height))
+	return key
+}
+
+// scriptClassOutKeyLen is the length of the key of the entry of an output
+// after scriptClassOutPrefix.
+const scriptClassOutKeyLen = 1 + 8 + btcwire.HashSize + 4
+
+// scriptClassOutKey returns the key of the entry of the output of the passed
+// class at the passed location.
+func scriptClassOutKey(class ScriptClass, height int64, sha *btcwire.ShaHash, index uint32) []byte {
+	off := len(scriptClassOutPrefix)
+	key := make([]byte, off+scriptClassOutKeyLen)
+	copy(key, scriptClassOutPrefix)
+	key[off] = byte(class)
+	off++
+	binary.BigEndian.PutUint64(key[off:], uint64(height))
+	off += 8
+	copy(key[off:], sha.Bytes())
+	off += btcwire.HashSize
+	binary.BigEndian.PutUint32(key[off:], index)
+	return key
+}
+
+// scriptClassOutHeightPrefix returns the prefix of the keys of the entries of
+// the outputs of the passed class of the block at the passed height.
+func scriptClassOutHeightPrefix(class ScriptClass, height int64) []byte {
+	off := len(scriptClassOutPrefix)
+	prefix := make([]byte, off+1+8)
+	copy(prefix, scriptClassOutPrefix)
+	prefix[off] = byte(class)
+	binary.BigEndian.PutUint64(prefix[off+1:], uint64(height))
+	return prefix
+}
+
+// forEachScriptClassOut calls the passed function with the key of the entry of
+// every output of the passed block at the passed height along with the output.
+func forEachScriptClassOut(block *btcutil.Block, height int64, fn func(key []byte, txOut *btcwire.TxOut)) error {
+	for _, tx := range block.MsgBlock().Transactions {
+		txSha, err := tx.TxSha()
+		if err != nil {
+			return err
+		}
+		for i, txOut := range tx.TxOut {
+			class := ClassifyScript(txOut.PkScript)
+			fn(scriptClassOutKey(class, height, &txSha, uint32(i)), txOut)
+		}
+	}
+	return nil
+}
+
+// ScriptClassOutput is an output of the chain found by FetchScriptClassOutputs.
+type ScriptClassOutput struct {
+	TxSha    btcwire.ShaHash
+	Index    uint32
+	Height   int64
+	Value    int64
+	PkScript []byte
+}
+
+// ScriptClassCounts holds a number of transaction outputs for each class of
+// script, indexed by ScriptClass.
+type ScriptClassCounts [NumScriptClasses]int64
+
+// Total returns the number of outputs of every class.
+func (c *ScriptClassCounts) Total() int64 {
+	var total int64
+	for _, n := range c {
+		total += n
+	}
+	return total
+}
+
+// countScriptClasses returns the number of outputs of each class of the
+// transactions of the passed block.
+func countScriptClasses(block *btcutil.Block) ScriptClassCounts {
+	var counts ScriptClassCounts
+	for _, tx := range block.MsgBlock().Transactions {
+		for _, txOut := range tx.TxOut {
+			counts[ClassifyScript(txOut.PkScript)]++
+		}
+	}
+	return counts
+}
+
+// BlockScriptClasses holds the number of outputs of each class of script of a
+// block, as recorded by a ScriptClassIndex.  Counts holds the outputs of the
+// block and Totals the outputs of the chain up to and including the block.
+type BlockScriptClasses struct {
+	Height int64
+	Counts ScriptClassCounts
+	Totals ScriptClassCounts
+}
+
+// serialize returns the stored form of the counts of the block.  The height is
+// the key of the record rather than part of it.
+func (b *BlockScriptClasses) serialize() []byte {
+	buf := make([]byte, scriptClassRecordLen)
+	for class, n := range b.Counts {
+		binary.LittleEndian.PutUint32(buf[4*class:], uint32(n))
+	}
+	off := 4 * NumScriptClasses
+	for class, n := range b.Totals {
+		binary.LittleEndian.PutUint64(buf[off+8*class:], uint64(n))
+	}
+	return buf
+}
+
+// deserializeBlockScriptClasses returns the counts of the block at the passed
+// height stored in the passed value.
+func deserializeBlockScriptClasses(height int64, val []byte) (*BlockScriptClasses, error) {
+	if len(val) != scriptClassRecordLen {
+		return nil, fmt.Errorf("malformed script class record %x", val)
+	}
+	b := &BlockScriptClasses{Height: height}
+	for class := range b.Counts {
+		b.Counts[class] = int64(binary.LittleEndian.Uint32(val[4*class:]))
+	}
+	off := 4 * NumScriptClasses
+	for class := range b.Totals {
+		b.Totals[class] = int64(binary.LittleEndian.Uint64(
+			val[off+8*class:]))
+	}
+	return b, nil
+}
+
+// ScriptClassIndex is an optional indexer which counts the outputs of every
+// block of the chain by the class of their script, as returned by
+// ClassifyScript, along with the outputs of the chain up to each block, so the
+// breakdown of the outputs of blocks and of the whole chain is answered by
+// FetchScriptClasses without reading the blocks.  It also records every output
+// by its class, so FetchScriptClassOutputs lists the outputs of a class, such
+// as every bare multisig output, by height.  The entry of an
+// output holds its value and script, so the index takes about as much space
+// as the outputs of the chain.
+//
+// The counts of the chain up to each block are kept in memory to count the
+// chain up to each block inserted, which takes 72 bytes per block.  An index
+// recorded by another version, such as one from before ClassifyScript knew of
+// witness programs, is rebuilt from the genesis block when it is added to the
+// database.
+type ScriptClassIndex struct {
+	mtx    sync.Mutex
+	db     Db
+	totals []ScriptClassCounts
+}
+
+// Ensure ScriptClassIndex implements the Indexer interface.
+var _ Indexer = (*ScriptClassIndex)(nil)
+
+// NewScriptClassIndex returns a script class index which starts indexing once
+// it is added to a database with AddIndexer.
+func NewScriptClassIndex() *ScriptClassIndex {
+	return new(ScriptClassIndex)
+}
+
+// Init loads the counts of the chain up to each block indexed before from the
+// passed database.  The index is rebuilt from the genesis block when its tip is
+// no longer in the chain or its records were written by another version of the
+// index.  This is part of the Indexer interface implementation.
+func (idx *ScriptClassIndex) Init(db Db) error {
+	tipHeight, err := initVersionedIndexerState(db, "Script class index",
+		ScriptClassPrefix, scriptClassTipKey, scriptClassVersionKey,
+		scriptClassVersion)
+	if err != nil {
+		return err
+	}
+
+	var totals []ScriptClassCounts
+	iter, err := db.MetaIterator(scriptClassHeightPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for int64(len(totals)) <= tipHeight && iter.Next() {
+		height := int64(len(totals))
+		if !bytes.Equal(iter.Key(), scriptClassHeightKey(height)) {
+			return fmt.Errorf("script classes of block at height %d "+
+				"are missing", height)
+		}
+		b, err := deserializeBlockScriptClasses(height, iter.Value())
+		if err != nil {
+			return err
+		}
+		totals = append(totals, b.Totals)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if int64(len(totals)) != tipHeight+1 {
+		return fmt.Errorf("script classes end at height %d before the "+
+			"tip at height %d", len(totals)-1, tipHeight)
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.totals = totals
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *ScriptClassIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, scriptClassTipKey)
+}
+
+// ConnectBlock adds the counts of the outputs of the passed block and of the
+// chain up to it.  This is part of the Indexer interface implementation.
+func (idx *ScriptClassIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// Counts left by blocks which were disconnected, or whose connection
+	// failed to commit, are replaced.
+	if int64(len(idx.totals)) > height {
+		idx.totals = idx.totals[:height]
+	}
+	if int64(len(idx.totals)) != height {
+		return fmt.Errorf("script class index is missing the blocks from "+
+			"height %d before block %v at height %d",
+			len(idx.totals), sha, height)
+	}
+
+	b := &BlockScriptClasses{
+		Height: height,
+		Counts: countScriptClasses(block),
+	}
+	if height > 0 {
+		b.Totals = idx.totals[height-1]
+	}
+	for class, n := range b.Counts {
+		b.Totals[class] += n
+	}
+	idx.totals = append(idx.totals, b.Totals)
+
+	err = forEachScriptClassOut(block, height, func(key []byte, txOut *btcwire.TxOut) {
+		val := make([]byte, 8+len(txOut.PkScript))
+		binary.LittleEndian.PutUint64(val, uint64(txOut.Value))
+		copy(val[8:], txOut.PkScript)
+		meta.Put(key, val)
+	})
+	if err != nil {
+		return err
+	}
+	meta.Put(scriptClassHeightKey(height), b.serialize())
+	putTipRecord(meta, scriptClassTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the counts and outputs of the passed block.  This is part of the
+// Indexer interface implementation.
+func (idx *ScriptClassIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// The counts of a block whose connection failed to commit may have
+	// replaced the ones of the block stored at its height.
+	if int64(len(idx.totals)) <= height {
+		return fmt.Errorf("script class index is out of step with the "+
+			"block at height %d", height)
+	}
+	var prev ScriptClassCounts
+	if height > 0 {
+		prev = idx.totals[height-1]
+	}
+	counts := countScriptClasses(block)
+	for class, n := range counts {
+		if idx.totals[height][class]-prev[class] != n {
+			return fmt.Errorf("script class index is out of step "+
+				"with the block at height %d", height)
+		}
+	}
+
+	err := forEachScriptClassOut(block, height, func(key []byte, txOut *btcwire.TxOut) {
+		meta.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+	meta.Delete(scriptClassHeightKey(height))
+	putTipRecord(meta, scriptClassTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// FetchScriptClasses returns the counts recorded by the ScriptClassIndex of the
+// passed database for the blocks of a range of heights.  Like
+// FetchHeightRange, the range is inclusive of the start height and exclusive
+// of the ending height and `AllShas' may be used as the ending height to
+// return the counts of every indexed block from the start height on.  The
+// Totals of the last block returned for AllShas hold the breakdown of the
+// whole chain.  ErrNoScriptClassIndex is returned when the database has no
+// script class index.
+func FetchScriptClasses(db Db, startHeight, endHeight int64) ([]*BlockScriptClasses, error) {
+	tipSha, tipHeight, err := fetchTipRecord(db, scriptClassTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoScriptClassIndex
+	}
+	if startHeight < 0 {
+		startHeight = 0
+	}
+	if endHeight > tipHeight+1 {
+		endHeight = tipHeight + 1
+	}
+
+	var classes []*BlockScriptClasses
+	for height := startHeight; height < endHeight; height++ {
+		val, err := db.GetMeta(scriptClassHeightKey(height))
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, fmt.Errorf("script classes for height %d are "+
+				"missing", height)
+		}
+		b, err := deserializeBlockScriptClasses(height, val)
+		if err != nil {
+			return nil, err
+		}
+		classes = append(classes, b)
+	}
+	return classes, nil
+}
+
+// FetchScriptClassTotals returns the number of outputs of each class of script
+// of the chain of the passed database up to and including the block at the
+// passed height, using its ScriptClassIndex.  ErrBlockNotFound is returned
+// when the index does not hold the block and ErrNoScriptClassIndex when the
+// database has no script class index.
+func FetchScriptClassTotals(db Db, height int64) (*ScriptClassCounts, error) {
+	classes, err := FetchScriptClasses(db, height, height+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(classes) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	return &classes[0].Totals, nil
+}
+
+// FetchScriptClassOutputs returns up to max outputs of the passed class of the
+// blocks of a range of heights, ordered by height and then by the hash of their
+// transaction and their index, using the ScriptClassIndex of the passed
+// database.  Like FetchScriptClasses, the range is inclusive of the start
+// height and exclusive of the ending height and `AllShas' may be used as the
+// ending height to search every indexed block from the start height on.  A max
+// which is not positive returns every output.  Blocks without outputs of the
+// class are skipped using their counts, so listing a rare class reads little
+// more than the counts of the range.  ErrNoScriptClassIndex is returned when
+// the database has no script class index.
+func FetchScriptClassOutputs(db Db, class ScriptClass, startHeight, endHeight int64, max int) ([]*ScriptClassOutput, error) {
+	if int(class) >= NumScriptClasses {
+		return nil, fmt.Errorf("unknown script class %d", class)
+	}
+	tipSha, tipHeight, err := fetchTipRecord(db, scriptClassTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoScriptClassIndex
+	}
+	if startHeight < 0 {
+		startHeight = 0
+	}
+	if endHeight > tipHeight+1 {
+		endHeight = tipHeight + 1
+	}
+
+	var outs []*ScriptClassOutput
+	for height := startHeight; height < endHeight; height++ {
+		if max > 0 && len(outs) >= max {
+			break
+		}
+		val, err := db.GetMeta(scriptClassHeightKey(height))
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, fmt.Errorf("script classes for height %d are "+
+				"missing", height)
+		}
+		b, err := deserializeBlockScriptClasses(height, val)
+		if err != nil {
+			return nil, err
+		}
+		if b.Counts[class] == 0 {
+			continue
+		}
+
+		iter, err := db.MetaIterator(scriptClassOutHeightPrefix(class,
+			height))
+		if err != nil {
+			return nil, err
+		}
+		for (max <= 0 || len(outs) < max) && iter.Next() {
+			key, val := iter.Key(), iter.Value()
+			if len(key) != len(scriptClassOutPrefix)+scriptClassOutKeyLen ||
+				len(val) < 8 {
+				iter.Release()
+				return nil, fmt.Errorf("malformed script class "+
+					"entry %x", key)
+			}
+			off := len(scriptClassOutPrefix) + 1 + 8
+			out := &ScriptClassOutput{
+				Height:   height,
+				Value:    int64(binary.LittleEndian.Uint64(val)),
+				PkScript: append([]byte(nil), val[8:]...),
+			}
+			copy(out.TxSha[:], key[off:])
+			off += btcwire.HashSize
+			out.Index = binary.BigEndian.Uint32(key[off:])
+			outs = append(outs, out)
+		}
+		err = iter.Err()
+		iter.Release()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return outs, nil
+}
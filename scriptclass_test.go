@@ -0,0 +1,342 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestScriptClasses ensures output scripts are classified as expected and that
+// the script class index counts the outputs of each class of the blocks of the
+// chain and of the chain up to each of them for all supported database types.
+func TestScriptClasses(t *testing.T) {
+	pubKey := bytes.Repeat([]byte{0x02}, 33)
+	hash := bytes.Repeat([]byte{0x01}, 20)
+	pkScript := append(append([]byte{0x21}, pubKey...), 0xac)
+	pkhScript := append(append([]byte{0x76, 0xa9, 0x14}, hash...), 0x88, 0xac)
+	shScript := append(append([]byte{0xa9, 0x14}, hash...), 0x87)
+	msScript := append(append(append(append([]byte{0x51, 0x21}, pubKey...),
+		0x21), pubKey...), 0x52, 0xae)
+	ndScript := append([]byte{0x6a, 0x04}, "abcd"...)
+	wpkhScript := append([]byte{0x00, 0x14}, hash...)
+	wshScript := append([]byte{0x00, 0x20}, bytes.Repeat([]byte{0x03}, 32)...)
+	w1Script := append([]byte{0x51, 0x20}, bytes.Repeat([]byte{0x04}, 32)...)
+
+	tests := []struct {
+		script []byte
+		class  btcdb.ScriptClass
+	}{
+		{pkScript, btcdb.PubKeyTy},
+		{pkhScript, btcdb.PubKeyHashTy},
+		{shScript, btcdb.ScriptHashTy},
+		{msScript, btcdb.MultiSigTy},
+		{ndScript, btcdb.NullDataTy},
+		{[]byte{0x6a}, btcdb.NullDataTy},
+		{wpkhScript, btcdb.WitnessV0PubKeyHashTy},
+		{wshScript, btcdb.WitnessV0ScriptHashTy},
+		{w1Script, btcdb.WitnessUnknownTy},
+		{[]byte{0x60, 0x02, 0x01, 0x02}, btcdb.WitnessUnknownTy},
+		{append([]byte{0x00, 0x15}, pubKey[:21]...), btcdb.NonStandardTy},
+		{[]byte{0x51, 0x01, 0x01}, btcdb.NonStandardTy},
+		{append([]byte{0x51, 0x29}, bytes.Repeat([]byte{0x05}, 41)...), btcdb.NonStandardTy},
+		{append([]byte{0x00, 0x15}, hash...), btcdb.NonStandardTy},
+		{[]byte{0x6a, 0xac}, btcdb.NonStandardTy},
+		{[]byte{0x51}, btcdb.NonStandardTy},
+		{nil, btcdb.NonStandardTy},
+		{pkhScript[:24], btcdb.NonStandardTy},
+		{append(append([]byte{0x20}, pubKey[:32]...), 0xac), btcdb.NonStandardTy},
+		{append(append([]byte{0x52, 0x21}, pubKey...), 0x51, 0xae), btcdb.NonStandardTy},
+		{append(append([]byte{0x51, 0x21}, pubKey...), 0x52, 0xae), btcdb.NonStandardTy},
+	}
+	for i, test := range tests {
+		if class := btcdb.ClassifyScript(test.script); class != test.class {
+			t.Errorf("ClassifyScript #%d: got %v, want %v", i, class,
+				test.class)
+		}
+	}
+
+	addrTests := []struct {
+		script []byte
+		addr   []byte
+	}{
+		{pkScript, pubKey},
+		{pkhScript, hash},
+		{shScript, hash},
+		{wpkhScript, hash},
+		{wshScript, wshScript[2:]},
+		{msScript, nil},
+		{ndScript, nil},
+		{w1Script, nil},
+		{nil, nil},
+	}
+	for i, test := range addrTests {
+		addr := btcdb.ScriptAddress(test.script)
+		if !bytes.Equal(addr, test.addr) || (addr == nil) != (test.addr == nil) {
+			t.Errorf("ScriptAddress #%d: got %x, want %x", i, addr,
+				test.addr)
+		}
+	}
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	// Each block after the test chain has a coinbase paying to a
+	// nonstandard script and to the passed script.
+	scripts := [][]byte{pkhScript, shScript, msScript, ndScript, pkScript,
+		wpkhScript, wshScript, w1Script}
+	tipHeight := int64(len(blocks) + len(scripts) - 1)
+	chain := append([]*btcutil.Block(nil), blocks...)
+	for i, script := range scripts {
+		prev := chain[len(chain)-1]
+		prevSha, _ := prev.Sha()
+		tx := btcwire.NewMsgTx()
+		prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{byte(i), 0x51}))
+		tx.AddTxOut(btcwire.NewTxOut(50*1e8, []byte{0x51}))
+		tx.AddTxOut(btcwire.NewTxOut(0, script))
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash,
+			prev.MsgBlock().Header.Bits, 0)
+		hdr.Timestamp = prev.MsgBlock().Header.Timestamp.Add(time.Minute)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		msgBlock.AddTransaction(tx)
+		chain = append(chain, btcutil.NewBlock(msgBlock))
+	}
+
+	// wantCounts returns the expected counts of the block at the passed
+	// height.
+	wantCounts := func(height int64) btcdb.ScriptClassCounts {
+		var counts btcdb.ScriptClassCounts
+		if height < 10 {
+			counts[btcdb.PubKeyTy] = 1
+			return counts
+		}
+		counts[btcdb.NonStandardTy] = 1
+		counts[btcdb.ClassifyScript(scripts[height-10])]++
+		return counts
+	}
+
+	// checkClasses ensures the index holds the expected counts of the
+	// blocks up to the passed height.
+	checkClasses := func(dbType string, db btcdb.Db, tipHeight int64) {
+		classes, err := btcdb.FetchScriptClasses(db, 0, btcdb.AllShas)
+		if err != nil || int64(len(classes)) != tipHeight+1 {
+			t.Errorf("FetchScriptClasses (%s): got %d blocks (err %v), "+
+				"want %d", dbType, len(classes), err, tipHeight+1)
+			return
+		}
+		var totals btcdb.ScriptClassCounts
+		for i, b := range classes {
+			counts := wantCounts(int64(i))
+			for class, n := range counts {
+				totals[class] += n
+			}
+			if b.Height != int64(i) || b.Counts != counts ||
+				b.Totals != totals {
+				t.Errorf("FetchScriptClasses (%s): got %+v for "+
+					"height %d, want counts %v and totals %v",
+					dbType, b, i, counts, totals)
+			}
+		}
+		got, err := btcdb.FetchScriptClassTotals(db, tipHeight)
+		if err != nil || *got != totals ||
+			got.Total() != 10+2*(tipHeight-9) {
+			t.Errorf("FetchScriptClassTotals (%s): got %v (err %v), "+
+				"want %v", dbType, got, err, totals)
+		}
+		_, err = btcdb.FetchScriptClassTotals(db, tipHeight+1)
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchScriptClassTotals (%s): got %v past the tip, "+
+				"want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+
+		// The outputs of each class are listed in the order of the
+		// chain, whose blocks have a single transaction.
+		for class := btcdb.ScriptClass(0); int(class) < btcdb.NumScriptClasses; class++ {
+			var want []*btcdb.ScriptClassOutput
+			for height, block := range chain[:tipHeight+1] {
+				tx := block.MsgBlock().Transactions[0]
+				txSha, _ := tx.TxSha()
+				for i, txOut := range tx.TxOut {
+					if btcdb.ClassifyScript(txOut.PkScript) != class {
+						continue
+					}
+					want = append(want, &btcdb.ScriptClassOutput{
+						TxSha:    txSha,
+						Index:    uint32(i),
+						Height:   int64(height),
+						Value:    txOut.Value,
+						PkScript: txOut.PkScript,
+					})
+				}
+			}
+			outs, err := btcdb.FetchScriptClassOutputs(db, class, 0,
+				btcdb.AllShas, 0)
+			if err != nil || !reflect.DeepEqual(outs, want) {
+				t.Errorf("FetchScriptClassOutputs (%s): got %d "+
+					"outputs of %v (err %v), want %d", dbType,
+					len(outs), class, err, len(want))
+			}
+		}
+
+		// Dropped blocks leave no entries behind.
+		iter, err := db.MetaIterator([]byte("btcdb/scriptclass/out/"))
+		if err != nil {
+			t.Errorf("MetaIterator (%s): %v", dbType, err)
+			return
+		}
+		var entries int64
+		for iter.Next() {
+			entries++
+		}
+		iter.Release()
+		if entries != totals.Total() {
+			t.Errorf("MetaIterator (%s): got %d output entries, want %d",
+				dbType, entries, totals.Total())
+		}
+		outs, err := btcdb.FetchScriptClassOutputs(db, btcdb.PubKeyTy, 2,
+			btcdb.AllShas, 3)
+		if err != nil || len(outs) != 3 || outs[0].Height != 2 ||
+			outs[2].Height != 4 {
+			t.Errorf("FetchScriptClassOutputs (%s): got %d outputs "+
+				"from height 2 (err %v), want 3 from heights 2 to 4",
+				dbType, len(outs), err)
+		}
+		outs, err = btcdb.FetchScriptClassOutputs(db,
+			btcdb.NonStandardTy, 10, 12, 0)
+		if err != nil || len(outs) != 2 || outs[0].Height != 10 ||
+			outs[1].Height != 11 {
+			t.Errorf("FetchScriptClassOutputs (%s): got %d outputs "+
+				"of heights 10 and 11 (err %v), want 2", dbType,
+				len(outs), err)
+		}
+		_, err = btcdb.FetchScriptClassOutputs(db,
+			btcdb.ScriptClass(btcdb.NumScriptClasses), 0, btcdb.AllShas, 0)
+		if err == nil {
+			t.Errorf("FetchScriptClassOutputs (%s): got no error for "+
+				"an unknown class", dbType)
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "scriptclass", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(chain[:12]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		_, err = btcdb.FetchScriptClasses(db, 0, btcdb.AllShas)
+		if err != btcdb.ErrNoScriptClassIndex {
+			t.Errorf("FetchScriptClasses (%s): got %v without an "+
+				"index, want %v", dbType, err,
+				btcdb.ErrNoScriptClassIndex)
+		}
+		_, err = btcdb.FetchScriptClassOutputs(db, btcdb.PubKeyTy, 0,
+			btcdb.AllShas, 0)
+		if err != btcdb.ErrNoScriptClassIndex {
+			t.Errorf("FetchScriptClassOutputs (%s): got %v without "+
+				"an index, want %v", dbType, err,
+				btcdb.ErrNoScriptClassIndex)
+		}
+
+		// The index is caught up with the blocks already stored and
+		// kept up to date by those inserted and dropped later.
+		if err := db.AddIndexer(btcdb.NewScriptClassIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkClasses(dbType, db, 11)
+		if _, err := db.InsertBlocks(chain[12:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkClasses(dbType, db, tipHeight)
+
+		keepSha, _ := chain[12].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkClasses(dbType, db, 12)
+		if _, err := db.InsertBlocks(chain[13:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkClasses(dbType, db, tipHeight)
+
+		// An index recorded by the first version, which counted fewer
+		// classes and recorded their number instead of a version, is
+		// rebuilt when it is added.
+		versionKey := []byte("btcdb/version/scriptclass")
+		var meta btcdb.MetaBatch
+		meta.Delete(versionKey)
+		meta.Put([]byte("btcdb/scriptclass/classes"), []byte{6})
+		key := append([]byte("btcdb/scriptclass/height/"),
+			0, 0, 0, 0, 0, 0, 0, 5)
+		meta.Put(key, make([]byte, 6*(4+8)))
+		if err := db.WriteMeta(&meta); err != nil {
+			t.Errorf("WriteMeta (%s): %v", dbType, err)
+		}
+		if err := db.AddIndexer(btcdb.NewScriptClassIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): got %v for an older index",
+				dbType, err)
+		}
+		checkClasses(dbType, db, tipHeight)
+
+		// An index whose tip left the chain is rebuilt once, and the
+		// version written as it starts over keeps it from being
+		// rebuilt again.  A rebuild removes every key under the
+		// prefix, including the marker added after the first one.
+		marker := []byte("btcdb/scriptclass/marker")
+		tip := make([]byte, 8+btcwire.HashSize)
+		binary.LittleEndian.PutUint64(tip, uint64(tipHeight))
+		tip[8] = 0xff
+		meta.Reset()
+		meta.Put([]byte("btcdb/scriptclass/tip"), tip)
+		if err := db.WriteMeta(&meta); err != nil {
+			t.Errorf("WriteMeta (%s): %v", dbType, err)
+		}
+		for i := 0; i < 2; i++ {
+			err := db.AddIndexer(btcdb.NewScriptClassIndex())
+			if err != nil {
+				t.Errorf("AddIndexer (%s): got %v for a tip "+
+					"off the chain", dbType, err)
+			}
+			checkClasses(dbType, db, tipHeight)
+			if i == 0 {
+				if err := db.PutMeta(marker, []byte{1}); err != nil {
+					t.Errorf("PutMeta (%s): %v", dbType, err)
+				}
+			}
+		}
+		if val, err := db.GetMeta(marker); err != nil || val == nil {
+			t.Errorf("GetMeta (%s): the index was rebuilt after "+
+				"its version was written", dbType)
+		}
+		val, err := db.GetMeta(versionKey)
+		if err != nil || !bytes.Equal(val, []byte{3, 0, 0, 0}) {
+			t.Errorf("GetMeta (%s): got version %x, want 03000000",
+				dbType, val)
+		}
+		teardown()
+	}
+}
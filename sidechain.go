@@ -0,0 +1,370 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sort"
+)
+
+// SideBlockPrefix is the prefix of the keys of the metadata namespace under
+// which the blocks of side chains are kept.  Each key is the prefix followed
+// by the hash of a block, and its value is the height of the block followed
+// by the header of the block and the hashes of its transactions, as for
+// InvalidBlockPrefix.  The transactions are stored once under KeptTxPrefix
+// however many side and invalid blocks hold them.
+var SideBlockPrefix = []byte("btcdb/side/")
+
+// sideBlockKey returns the key of the metadata namespace under which the block
+// with the passed hash is kept while it is on a side chain.
+func sideBlockKey(sha *btcwire.ShaHash) []byte {
+	key := make([]byte, len(SideBlockPrefix)+btcwire.HashSize)
+	copy(key, SideBlockPrefix)
+	copy(key[len(SideBlockPrefix):], sha.Bytes())
+	return key
+}
+
+// ChainTipStatus describes the state of the branch ending at a chain tip.
+type ChainTipStatus int
+
+// The states of the branches returned by FetchChainTips.
+const (
+	// ChainTipActive is the newest block of the chain.
+	ChainTipActive ChainTipStatus = iota
+
+	// ChainTipValidFork ends a side chain which links to the chain and
+	// may be made the chain with SetMainChain.
+	ChainTipValidFork
+
+	// ChainTipInvalid ends a branch of blocks marked as invalid by
+	// InvalidateBlock, or a side chain after one of them.
+	ChainTipInvalid
+
+	// ChainTipUnlinked ends a side chain which no longer links to the
+	// chain since the block it forked from was removed.
+	ChainTipUnlinked
+)
+
+// chainTipStatusStrings is a map of chain tip states back to their constant
+// names for pretty printing.
+var chainTipStatusStrings = map[ChainTipStatus]string{
+	ChainTipActive:    "active",
+	ChainTipValidFork: "valid-fork",
+	ChainTipInvalid:   "invalid",
+	ChainTipUnlinked:  "unlinked",
+}
+
+// String returns the ChainTipStatus as a human-readable name.
+func (s ChainTipStatus) String() string {
+	if str, ok := chainTipStatusStrings[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("Unknown ChainTipStatus (%d)", int(s))
+}
+
+// ChainTip describes the newest block of the chain or of a branch off it.
+// BranchLen is the number of blocks of the branch which are not part of the
+// chain, so it is zero for the newest block of the chain.
+type ChainTip struct {
+	Sha       btcwire.ShaHash
+	Height    int64
+	BranchLen int64
+	Status    ChainTipStatus
+}
+
+// chainTipsByHeight sorts chain tips from the highest to the lowest, with the
+// newest block of the chain first among tips of the same height.
+type chainTipsByHeight []ChainTip
+
+func (s chainTipsByHeight) Len() int {
+	return len(s)
+}
+
+func (s chainTipsByHeight) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s chainTipsByHeight) Less(i, j int) bool {
+	if s[i].Height != s[j].Height {
+		return s[i].Height > s[j].Height
+	}
+	if s[i].Status != s[j].Status {
+		return s[i].Status < s[j].Status
+	}
+	return bytes.Compare(s[i].Sha[:], s[j].Sha[:]) < 0
+}
+
+// InsertSideBlock stores the passed block on a side chain of the passed
+// database rather than adding it to the chain.  Its parent must be in the
+// chain or stored on a side chain itself, and the height the block would have
+// in the chain is returned.  Side blocks are kept under SideBlockPrefix in the
+// metadata namespace, so they survive reopening the database and are not seen
+// by NewestSha, the queries by height or the transaction queries until
+// SetMainChain makes a branch containing them the chain.  Orphans stored with
+// PutOrphan after the block are promoted once it is stored.
+//
+// DuplicateSha is returned when the block is already in the chain or on a side
+// chain and PrevShaMissing when its parent is neither.
+func InsertSideBlock(db Db, block *btcutil.Block) (int64, error) {
+	var meta MetaBatch
+	height, err := putSideBlock(db, block, &meta)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.WriteMeta(&meta); err != nil {
+		return 0, err
+	}
+	sha, _ := block.Sha()
+	if _, err := PromoteOrphans(db, sha); err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// putSideBlock adds storing the passed block on a side chain of the passed
+// database, along with its transactions, to the passed batch and returns the
+// height the block would have in the chain.  It returns the errors of
+// InsertSideBlock.  The batch must not change other kept blocks.
+func putSideBlock(db Db, block *btcutil.Block, meta *MetaBatch) (int64, error) {
+	sha, err := block.Sha()
+	if err != nil {
+		return 0, err
+	}
+	if db.ExistsSha(sha) {
+		return 0, DuplicateSha
+	}
+	val, err := db.GetMeta(sideBlockKey(sha))
+	if err != nil {
+		return 0, err
+	}
+	if val != nil {
+		return 0, DuplicateSha
+	}
+
+	prevSha := &block.MsgBlock().Header.PrevBlock
+	height, err := db.FetchBlockHeightBySha(prevSha)
+	if err == ErrBlockNotFound {
+		parent, perr := FetchSideBlock(db, prevSha)
+		if perr == ErrBlockNotFound {
+			return 0, PrevShaMissing
+		}
+		if perr != nil {
+			return 0, perr
+		}
+		height, err = parent.Height(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	height++
+	refs := newKeptTxRefs()
+	val, err = encodeKeptBlock(height, block, refs)
+	if err != nil {
+		return 0, err
+	}
+	meta.Put(sideBlockKey(sha), val)
+	if err := refs.write(db, meta); err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// FetchSideBlock returns the block with the passed hash which is stored on a
+// side chain of the passed database, with its height set to the one it would
+// have in the chain.  ErrBlockNotFound is returned when there is no such side
+// block.
+func FetchSideBlock(db Db, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	val, err := db.GetMeta(sideBlockKey(sha))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrBlockNotFound
+	}
+	return decodeKeptBlock(db, val)
+}
+
+// keptBlocks returns every block kept under the passed prefix of the metadata
+// namespace of the passed database keyed by its hash.  The key of each block
+// must be the prefix followed by its hash.
+func keptBlocks(db Db, prefix []byte) (map[btcwire.ShaHash]*btcutil.Block, error) {
+	iter, err := db.MetaIterator(prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	blocks := make(map[btcwire.ShaHash]*btcutil.Block)
+	for iter.Next() {
+		blk, err := decodeKeptBlock(db, iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		sha, err := blk.Sha()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(iter.Key()[len(prefix):], sha.Bytes()) {
+			return nil, fmt.Errorf("block %v is kept under key %x",
+				sha, iter.Key())
+		}
+		blocks[*sha] = blk
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// FetchChainTips returns the newest block of the chain of the passed database
+// along with the last block of every branch off it which is stored on a side
+// chain or marked as invalid, ordered from the highest to the lowest.
+func FetchChainTips(db Db) ([]ChainTip, error) {
+	var tips []ChainTip
+	newestSha, newest, err := db.NewestSha()
+	if err != nil {
+		return nil, err
+	}
+	if newest >= 0 {
+		tips = append(tips, ChainTip{Sha: *newestSha, Height: newest,
+			Status: ChainTipActive})
+	}
+
+	side, err := keptBlocks(db, SideBlockPrefix)
+	if err != nil {
+		return nil, err
+	}
+	invalid, err := keptBlocks(db, InvalidBlockPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks which are the parent of another branch block are not tips.
+	parents := make(map[btcwire.ShaHash]struct{})
+	for _, branch := range []map[btcwire.ShaHash]*btcutil.Block{side, invalid} {
+		for _, blk := range branch {
+			parents[blk.MsgBlock().Header.PrevBlock] = struct{}{}
+		}
+	}
+
+	for _, branch := range []map[btcwire.ShaHash]*btcutil.Block{side, invalid} {
+		for sha, blk := range branch {
+			sha := sha
+			if _, ok := parents[sha]; ok || db.ExistsSha(&sha) {
+				continue
+			}
+
+			// Follow the branch back to the chain, noting whether
+			// it passes a block marked as invalid.
+			tip := ChainTip{Sha: sha, Height: blk.Height(),
+				Status: ChainTipValidFork}
+			for cur := sha; !db.ExistsSha(&cur); tip.BranchLen++ {
+				if _, ok := invalid[cur]; ok {
+					tip.Status = ChainTipInvalid
+				}
+				prev, ok := side[cur]
+				if !ok {
+					prev, ok = invalid[cur]
+				}
+				if !ok {
+					if tip.Status != ChainTipInvalid {
+						tip.Status = ChainTipUnlinked
+					}
+					break
+				}
+				cur = prev.MsgBlock().Header.PrevBlock
+			}
+			tips = append(tips, tip)
+		}
+	}
+	sort.Sort(chainTipsByHeight(tips))
+	return tips, nil
+}
+
+// SetMainChain makes the branch ending at the block with the passed hash, which
+// must be in the chain or stored on a side chain, the chain of the passed
+// database.  The blocks of the chain after the block the branch forks from are
+// moved to a side chain and the side blocks of the branch are connected in
+// their place with ReorganizeWithMeta, so the heights of the chain are
+// re-pointed from one branch to the other in a single atomic change and
+// subscribers are told of the blocks disconnected and connected.  Making a
+// block of the chain the main chain moves the blocks after it to a side chain.
+//
+// The work of the branches is not compared, so callers choose the branch to
+// follow themselves, such as the one with the most work listed by
+// FetchChainTips.  ErrBlockNotFound is returned when the block is not stored
+// and PrevShaMissing when its branch no longer links to the chain.  Nothing
+// else may change the chain while it is being switched.
+func SetMainChain(db Db, tipSha *btcwire.ShaHash) error {
+	// Collect the side blocks of the branch from the one linking to the
+	// chain up to the tip.
+	var branch []*btcutil.Block
+	var meta MetaBatch
+	refs := newKeptTxRefs()
+	forkSha := *tipSha
+	for !db.ExistsSha(&forkSha) {
+		blk, err := FetchSideBlock(db, &forkSha)
+		if err == ErrBlockNotFound && len(branch) != 0 {
+			return PrevShaMissing
+		}
+		if err != nil {
+			return err
+		}
+		branch = append([]*btcutil.Block{blk}, branch...)
+		err = deleteKeptBlock(db, sideBlockKey(&forkSha), &meta, refs)
+		if err != nil {
+			return err
+		}
+		forkSha = blk.MsgBlock().Header.PrevBlock
+	}
+
+	forkHeight, err := db.FetchBlockHeightBySha(&forkSha)
+	if err != nil {
+		return err
+	}
+	_, newest, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if err := putSideBlocks(db, forkHeight+1, newest, &meta, refs); err != nil {
+		return err
+	}
+	if err := refs.write(db, &meta); err != nil {
+		return err
+	}
+
+	log.Infof("Switching the chain to %v, replacing %d blocks after "+
+		"height %d with %d side blocks", tipSha, newest-forkHeight,
+		forkHeight, len(branch))
+	_, err = db.ReorganizeWithMeta(&forkSha, branch, &meta)
+	return err
+}
+
+// putSideBlocks adds keeping the blocks of the chain of the passed database
+// from the start height through the end height as side blocks to the passed
+// batch and their references to their transactions to the passed set.
+func putSideBlocks(db Db, startHeight, endHeight int64, meta *MetaBatch, refs *keptTxRefs) error {
+	for height := startHeight; height <= endHeight; height++ {
+		sha, err := db.FetchBlockShaByHeight(height)
+		if err != nil {
+			return err
+		}
+		blk, err := db.FetchBlockBySha(sha)
+		if err != nil {
+			return err
+		}
+		val, err := encodeKeptBlock(height, blk, refs)
+		if err != nil {
+			return err
+		}
+		meta.Put(sideBlockKey(sha), val)
+		refs.leaveChain(blk)
+	}
+	return nil
+}
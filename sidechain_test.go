@@ -0,0 +1,160 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestSideChains ensures blocks stored on side chains are listed as chain tips
+// and that SetMainChain switches the chain between branches for every
+// supported database type.
+func TestSideChains(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:15]
+	tipSha, _ := blocks[14].Sha()
+	alt := altChain(blocks[12], 4)
+	altShas := make([]*btcwire.ShaHash, len(alt))
+	for i, blk := range alt {
+		altShas[i], _ = blk.Sha()
+	}
+
+	// checkTips ensures the chain tips of the database are the passed ones.
+	checkTips := func(dbType, desc string, db btcdb.Db, want []btcdb.ChainTip) {
+		tips, err := btcdb.FetchChainTips(db)
+		if err != nil {
+			t.Errorf("FetchChainTips (%s) %s: %v", dbType, desc, err)
+			return
+		}
+		if !reflect.DeepEqual(tips, want) {
+			t.Errorf("FetchChainTips (%s) %s: got %+v, want %+v",
+				dbType, desc, tips, want)
+		}
+	}
+	mainTips := []btcdb.ChainTip{
+		{*altShas[3], 16, 4, btcdb.ChainTipValidFork},
+		{*tipSha, 14, 0, btcdb.ChainTipActive},
+	}
+	altTips := []btcdb.ChainTip{
+		{*altShas[3], 16, 0, btcdb.ChainTipActive},
+		{*tipSha, 14, 2, btcdb.ChainTipValidFork},
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "sidedb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+
+		for i, blk := range alt {
+			height, err := btcdb.InsertSideBlock(db, blk)
+			if err != nil || height != int64(13+i) {
+				t.Errorf("InsertSideBlock (%s): got height %d (err "+
+					"%v), want %d", dbType, height, err, 13+i)
+			}
+		}
+		for _, blk := range []*btcutil.Block{alt[0], blocks[5]} {
+			if _, err := btcdb.InsertSideBlock(db, blk); err != btcdb.DuplicateSha {
+				t.Errorf("InsertSideBlock (%s): got %v for a stored "+
+					"block, want %v", dbType, err, btcdb.DuplicateSha)
+			}
+		}
+		orphan := altChain(altChain(blocks[3], 1)[0], 1)[0]
+		if _, err := btcdb.InsertSideBlock(db, orphan); err != btcdb.PrevShaMissing {
+			t.Errorf("InsertSideBlock (%s): got %v for an orphan, "+
+				"want %v", dbType, err, btcdb.PrevShaMissing)
+		}
+		if db.ExistsSha(altShas[0]) {
+			t.Errorf("ExistsSha (%s): side block is in the chain",
+				dbType)
+		}
+		checkTips(dbType, "after inserting side blocks", db, mainTips)
+
+		// Switching to the side chain moves the replaced blocks to a
+		// side chain of their own.
+		if err := btcdb.SetMainChain(db, altShas[3]); err != nil {
+			t.Errorf("SetMainChain (%s): %v", dbType, err)
+		}
+		sha, err := db.FetchBlockShaByHeight(13)
+		if err != nil || !sha.IsEqual(altShas[0]) {
+			t.Errorf("FetchBlockShaByHeight (%s): got %v (err %v), "+
+				"want %v", dbType, sha, err, altShas[0])
+		}
+		if _, err := btcdb.FetchSideBlock(db, altShas[0]); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchSideBlock (%s): got %v for a block in the "+
+				"chain, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		blk, err := btcdb.FetchSideBlock(db, tipSha)
+		if err != nil || blk.Height() != 14 {
+			t.Errorf("FetchSideBlock (%s): got %v (err %v), want the "+
+				"replaced block at height 14", dbType, blk, err)
+		}
+		checkTips(dbType, "after switching", db, altTips)
+
+		// The side chains must survive reopening the database.
+		if dbType != "memory" {
+			db.Close()
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+			checkTips(dbType, "after reopening", db, altTips)
+		}
+
+		// Switching back restores the transactions of the chain.
+		if err := btcdb.SetMainChain(db, tipSha); err != nil {
+			t.Errorf("SetMainChain (%s): %v", dbType, err)
+		}
+		checkTips(dbType, "after switching back", db, mainTips)
+		if db.ExistsTxSha(alt[0].Transactions()[0].Sha()) {
+			t.Errorf("ExistsTxSha (%s): found a transaction of a side "+
+				"block", dbType)
+		}
+		if !db.ExistsTxSha(blocks[13].Transactions()[0].Sha()) {
+			t.Errorf("ExistsTxSha (%s): transaction of a reconnected "+
+				"block is missing", dbType)
+		}
+		if err := btcdb.SetMainChain(db, &zeroHash); err != btcdb.ErrBlockNotFound {
+			t.Errorf("SetMainChain (%s): got %v for an unknown block, "+
+				"want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+		db.Close()
+	}
+}
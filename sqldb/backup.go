@@ -0,0 +1,62 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"os"
+)
+
+// Backup writes a copy of the database as of the time it is called to a new
+// database file at the passed path, which must not exist yet.  This is part of
+// the btcdb.Db interface implementation.
+//
+// SQLite databases are copied with a single statement which reads from one
+// transaction, so progress is only reported once the copy is complete.
+// PostgreSQL databases live on a server and return btcdb.ErrBackupUnsupported;
+// they are backed up with the tools of the server instead.
+func (db *SqlDb) Backup(destPath string, progress func(copied int64)) (rerr error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.d.backup == "" {
+		return btcdb.ErrBackupUnsupported
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination %v already exists",
+			destPath)
+	}
+
+	defer func() {
+		if rerr != nil {
+			os.Remove(destPath)
+		}
+	}()
+	if _, err := db.sdb.Exec(db.d.backup, destPath); err != nil {
+		return err
+	}
+
+	// The copy is not necessarily synced as it is written.
+	f, err := os.OpenFile(destPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if progress != nil {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		progress(fi.Size())
+	}
+	return nil
+}
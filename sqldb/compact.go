@@ -0,0 +1,29 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"github.com/conformal/btcdb"
+)
+
+// Compact rebuilds the database to reclaim the space of deleted rows.  Writes
+// wait for it to finish.
+func (db *SqlDb) Compact() error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	_, err := db.sdb.Exec("VACUUM")
+	return err
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package sqldb implements an instance of btcdb backed by a SQL database.
+
+Rather than storing opaque serialized blocks, the block chain is kept in
+normalized tables so the database can also be queried directly with ad-hoc SQL:
+
+	blocks:       height, hash, header fields and the raw header
+	transactions: id, hash, block height, index in the block and the raw
+	              transaction
+	inputs:       the transaction id, input index, the previous outpoint, the
+	              signature script and the sequence number of every input
+	outputs:      the transaction id, output index, value and public key
+	              script of every output along with the indexed address it
+	              pays, as returned by btcdb.ScriptAddress, and the id of the
+	              transaction which spent it, which is NULL while the output
+	              is unspent
+	filters:      the height, BIP0158 basic filter and filter header of every
+	              block
+	chain_work:   the height and cumulative chain work through every block as
+	              a big-endian integer
+	meta:         the name and value of every key of the metadata namespace
+
+All hashes are stored as 32-byte blobs in their internal byte order.  Every
+instance of a transaction hash is kept, so looking up the current instance
+of a transaction requires selecting the one with the highest id.
+
+Databases created before the filters table existed are opened without compact
+filters, and fetching a filter from them returns btcdb.ErrNoFilterIndex.
+Those created before the chain_work table existed compute the cumulative work
+of a block from the difficulty of every block up to it when it is requested,
+and those created before the address column of the outputs table existed do not
+record addresses.  The meta table is added to older databases when they are opened for writing.
+
+Every operation which modifies the database, such as InsertBlock and
+DropAfterBlockBySha, is performed in a single SQL transaction which is
+committed before the function returns.
+
+The "sqlite" driver stores the database in a SQLite file and is created and
+opened with the path of the file:
+
+	db, err := btcdb.CreateDB("sqlite", "blocks.sqlite")
+
+SQLite databases use a write-ahead log, kept next to the database file, so
+readers and snapshots are not blocked while blocks are inserted.  Under the
+btcdb.SyncNever and btcdb.SyncPeriodic policies commits are not synced, and Sync
+syncs them by checkpointing the log into the database file.
+
+The "postgres" driver stores the database on a PostgreSQL server so the chain
+can be shared by several processes on different machines.  It is created and
+opened with a connection string and, optionally, the maximum number of pooled
+connections to the server, which defaults to DefaultMaxConns:
+
+	db, err := btcdb.OpenDB("postgres", "host=dbhost dbname=btc sslmode=disable", 20)
+
+When the database is opened with btcdb.OpenDBWithOptions instead, the maximum
+is given by the MaxConnsOption setting.  The sync policy and cache size of the
+options only apply to SQLite, as does Backup since PostgreSQL databases are
+backed up with the tools of the server.
+
+Every query is run as a prepared statement which is cached for the life of the
+database, and the inputs and outputs of each transaction are inserted with
+multi-row insert statements.  Creating a database creates the tables, so it
+fails when they already exist.
+*/
+package sqldb
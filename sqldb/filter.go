@@ -0,0 +1,182 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/gcs"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// fetchMsgTx returns the most recent instance of the transaction with the
+// given hash.
+func (t *sqlTx) fetchMsgTx(sha *btcwire.ShaHash) (*btcwire.MsgTx, error) {
+	row, err := t.fetchLatestTxRow(sha)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, btcdb.TxShaMissing
+	}
+	var msgTx btcwire.MsgTx
+	if err := msgTx.Deserialize(bytes.NewReader(row.raw)); err != nil {
+		return nil, err
+	}
+	return &msgTx, nil
+}
+
+// insertFilter stores the basic filter and filter header of the passed block,
+// which is at the given height.  The transactions of the block must already
+// be stored.
+func (t *sqlTx) insertFilter(height int64, block *btcutil.Block) error {
+	filter, err := gcs.BuildBasicFilter(block, t.fetchMsgTx)
+	if err != nil {
+		return err
+	}
+
+	var prevHeader btcwire.ShaHash
+	if height > 0 {
+		var buf []byte
+		err := t.queryRow("SELECT header FROM filters WHERE height = ?",
+			height-1).Scan(&buf)
+		if err != nil {
+			return err
+		}
+		if err := prevHeader.SetBytes(buf); err != nil {
+			return err
+		}
+	}
+	header := gcs.FilterHeader(filter, &prevHeader)
+
+	_, err = t.exec("INSERT INTO filters (height, filter, header) VALUES "+
+		"(?, ?, ?)", height, filter, header.Bytes())
+	return err
+}
+
+// fetchFilterColumn returns the passed column of the filters table for the
+// block with the given hash.
+func (db *SqlDb) fetchFilterColumn(sha *btcwire.ShaHash, column string) ([]byte, error) {
+	if !db.filterIndex {
+		return nil, btcdb.ErrNoFilterIndex
+	}
+
+	var buf []byte
+	err := db.view(func(tx *sqlTx) error {
+		return tx.queryRow("SELECT f."+column+" FROM filters f JOIN "+
+			"blocks b ON b.height = f.height WHERE b.hash = ?",
+			sha.Bytes()).Scan(&buf)
+	})
+	if err == sql.ErrNoRows {
+		return nil, btcdb.ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// FetchFilterBySha returns the basic filter of the block with the given hash.
+// This is part of the btcdb.Db interface implementation.
+//
+// Databases created before compact filters were stored do not have them and
+// return btcdb.ErrNoFilterIndex.
+func (db *SqlDb) FetchFilterBySha(sha *btcwire.ShaHash) ([]byte, error) {
+	return db.fetchFilterColumn(sha, "filter")
+}
+
+// FetchFilterHeaderBySha returns the basic filter header of the block with the
+// given hash.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchFilterHeaderBySha(sha *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	buf, err := db.fetchFilterColumn(sha, "header")
+	if err != nil {
+		return nil, err
+	}
+	var header btcwire.ShaHash
+	if err := header.SetBytes(buf); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// fetchFilterRange calls the passed function with the passed column of the
+// filters table for each block from the start height up to but not including
+// the end height in height order.
+func (db *SqlDb) fetchFilterRange(startHeight, endHeight int64, column string, fn func([]byte) error) error {
+	if !db.filterIndex {
+		return btcdb.ErrNoFilterIndex
+	}
+
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	return db.view(func(tx *sqlTx) error {
+		rows, err := tx.query("SELECT "+column+" FROM filters WHERE "+
+			"height >= ? AND height < ? ORDER BY height",
+			startHeight, endHeight)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var buf []byte
+			if err := rows.Scan(&buf); err != nil {
+				return err
+			}
+			if err := fn(buf); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// FetchFilterRange returns the basic filters of the blocks from the start
+// height up to but not including the end height.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) FetchFilterRange(startHeight, endHeight int64) ([][]byte, error) {
+	var filters [][]byte
+	err := db.fetchFilterRange(startHeight, endHeight, "filter",
+		func(buf []byte) error {
+			filters = append(filters, buf)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// FetchFilterHeaderRange returns the basic filter headers of the blocks from
+// the start height up to but not including the end height.  This is part of
+// the btcdb.Db interface implementation.
+func (db *SqlDb) FetchFilterHeaderRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	var headers []btcwire.ShaHash
+	err := db.fetchFilterRange(startHeight, endHeight, "header",
+		func(buf []byte) error {
+			var header btcwire.ShaHash
+			if err := header.SetBytes(buf); err != nil {
+				return err
+			}
+			headers = append(headers, header)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"database/sql"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+)
+
+// BlockLocatorFromSha returns a block locator for the block with the given
+// hash.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) BlockLocatorFromSha(sha *btcwire.ShaHash) (btcdb.BlockLocator, error) {
+	var locator btcdb.BlockLocator
+	err := db.view(func(tx *sqlTx) error {
+		height, exists, err := tx.blockHeight(sha)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return btcdb.ErrBlockNotFound
+		}
+		locator, err = tx.blockLocator(height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// LatestBlockLocator returns a block locator for the most recent block.  This
+// is part of the btcdb.Db interface implementation.
+func (db *SqlDb) LatestBlockLocator() (btcdb.BlockLocator, error) {
+	var locator btcdb.BlockLocator
+	err := db.view(func(tx *sqlTx) error {
+		_, height, err := tx.newestBlock()
+		if err != nil {
+			return err
+		}
+		locator, err = tx.blockLocator(height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
+
+// blockLocator returns a block locator for the block at the given height.
+func (t *sqlTx) blockLocator(height int64) (btcdb.BlockLocator, error) {
+	heights := btcdb.LocatorHeights(height)
+	locator := make(btcdb.BlockLocator, 0, len(heights))
+	for _, h := range heights {
+		var hash []byte
+		err := t.queryRow("SELECT hash FROM blocks WHERE height = ?",
+			h).Scan(&hash)
+		if err == sql.ErrNoRows {
+			return nil, btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sha btcwire.ShaHash
+		if err := sha.SetBytes(hash); err != nil {
+			return nil, btcdb.ErrCorruption
+		}
+		locator = append(locator, &sha)
+	}
+	return locator, nil
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// putMeta applies the passed changes to the metadata namespace.  A key is set
+// by removing any existing row for it first, which works the same way in
+// every dialect.
+func (t *sqlTx) putMeta(meta *btcdb.MetaBatch) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	for _, op := range meta.Ops() {
+		_, err := t.exec("DELETE FROM meta WHERE name = ?", op.Key)
+		if err != nil {
+			return err
+		}
+		if op.Delete {
+			continue
+		}
+		_, err = t.exec("INSERT INTO meta (name, value) VALUES (?, ?)",
+			op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertBlocksWithMeta inserts a run of blocks in order along with the passed
+// changes to the metadata namespace within a single transaction.  This is part
+// of the btcdb.Db interface implementation.
+func (db *SqlDb) InsertBlocksWithMeta(blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricInsertBlocks, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricInsertBlocks, len(blocks))
+
+	heights := make([]int64, 0, len(blocks))
+	err := db.updateOp(op, func(tx *sqlTx) error {
+		for _, block := range blocks {
+			height, err := tx.insertBlock(block)
+			if err != nil {
+				return err
+			}
+			heights = append(heights, height)
+		}
+		spent, err := tx.fetchSpentTxOuts(blocks, heights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := tx.db.indexers.ConnectBlocks(blocks, heights, spent,
+			tx.getMeta)
+		if err != nil {
+			return err
+		}
+		if err := tx.putMeta(meta); err != nil {
+			return err
+		}
+		tx.onCommit(func() {
+			tx.db.blockCache.AddBlocks(blocks, heights)
+		})
+		return tx.putMeta(idxMeta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// DropAfterBlockByShaWithMeta removes any blocks from the database after the
+// given block along with applying the passed changes to the metadata namespace
+// within a single transaction.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) DropAfterBlockByShaWithMeta(sha *btcwire.ShaHash, meta *btcdb.MetaBatch) error {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricDropBlocks, sha)
+	defer op.Done()
+
+	return db.updateOp(op, func(tx *sqlTx) error {
+		if err := tx.dropAfterBlockBySha(sha); err != nil {
+			return err
+		}
+		return tx.putMeta(meta)
+	})
+}
+
+// ReorganizeWithMeta removes any blocks from the database after the given
+// block, inserts the passed run of blocks after it and applies the passed
+// changes to the metadata namespace within a single transaction.  This is part
+// of the btcdb.Db interface implementation.
+func (db *SqlDb) ReorganizeWithMeta(sha *btcwire.ShaHash, blocks []*btcutil.Block, meta *btcdb.MetaBatch) ([]int64, error) {
+	op := btcdb.StartOp(db.metrics, btcdb.MetricReorganize, blocks)
+	defer op.Done()
+	db.metrics.ObserveBatchSize(btcdb.MetricReorganize, len(blocks))
+
+	heights := make([]int64, 0, len(blocks))
+	err := db.updateOp(op, func(tx *sqlTx) error {
+		if err := tx.dropAfterBlockBySha(sha); err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			height, err := tx.insertBlock(block)
+			if err != nil {
+				return err
+			}
+			heights = append(heights, height)
+		}
+		spent, err := tx.fetchSpentTxOuts(blocks, heights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := tx.db.indexers.ConnectBlocks(blocks, heights, spent,
+			tx.getMeta)
+		if err != nil {
+			return err
+		}
+		if err := tx.putMeta(meta); err != nil {
+			return err
+		}
+		tx.onCommit(func() {
+			tx.db.blockCache.AddBlocks(blocks, heights)
+		})
+		return tx.putMeta(idxMeta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return heights, nil
+}
+
+// GetMeta returns the value stored under the given key in the metadata
+// namespace, or nil when the key does not exist.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) GetMeta(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.view(func(tx *sqlTx) error {
+		var err error
+		value, err = tx.getMeta(key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// getMeta returns the value stored under the given key in the metadata
+// namespace as of the changes made by the transaction, or nil when the key
+// does not exist.
+func (t *sqlTx) getMeta(key []byte) ([]byte, error) {
+	if !t.db.metaTable || len(key) == 0 {
+		return nil, nil
+	}
+	var value []byte
+	err := t.queryRow("SELECT value FROM meta WHERE name = ?",
+		key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// PutMeta stores the value under the given key in the metadata namespace.
+// This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) PutMeta(key, value []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Put(key, value)
+	return db.WriteMeta(&meta)
+}
+
+// DeleteMeta removes the given key from the metadata namespace.  This is part
+// of the btcdb.Db interface implementation.
+func (db *SqlDb) DeleteMeta(key []byte) error {
+	var meta btcdb.MetaBatch
+	meta.Delete(key)
+	return db.WriteMeta(&meta)
+}
+
+// WriteMeta applies the passed changes to the metadata namespace within a
+// single transaction.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) WriteMeta(meta *btcdb.MetaBatch) error {
+	return db.update(func(tx *sqlTx) error {
+		return tx.putMeta(meta)
+	})
+}
+
+// MetaIterator returns an iterator over the keys of the metadata namespace
+// which begin with the given prefix.  Blobs compare byte by byte in every
+// dialect, so the keys are selected starting at the prefix in key order.  This
+// is part of the btcdb.Db interface implementation.
+func (db *SqlDb) MetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewMetaIterator(keys, values), nil
+}
+
+// ReverseMetaIterator returns an iterator over the keys of the metadata
+// namespace which begin with the given prefix in descending order.  This is
+// part of the btcdb.Db interface implementation.
+func (db *SqlDb) ReverseMetaIterator(prefix []byte) (btcdb.MetaIterator, error) {
+	keys, values, err := db.metaEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return btcdb.NewReverseMetaIterator(keys, values), nil
+}
+
+// metaEntries returns the keys of the metadata namespace which begin with the
+// given prefix and their values, read in a single transaction.
+func (db *SqlDb) metaEntries(prefix []byte) ([][]byte, [][]byte, error) {
+	var keys, values [][]byte
+	err := db.view(func(tx *sqlTx) error {
+		if !tx.db.metaTable {
+			return nil
+		}
+
+		var rows *sql.Rows
+		var err error
+		if len(prefix) == 0 {
+			rows, err = tx.query("SELECT name, value FROM meta " +
+				"ORDER BY name")
+		} else {
+			rows, err = tx.query("SELECT name, value FROM meta "+
+				"WHERE name >= ? ORDER BY name", prefix)
+		}
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key, value []byte
+			if err := rows.Scan(&key, &value); err != nil {
+				return err
+			}
+			if !bytes.HasPrefix(key, prefix) {
+				break
+			}
+			if value == nil {
+				value = []byte{}
+			}
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"github.com/conformal/btcdb"
+)
+
+// Subscribe returns a subscription to the blocks connected to and disconnected
+// from the chain.  The events of a SQL transaction are delivered once it
+// commits.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) Subscribe() (*btcdb.Subscription, error) {
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+	return db.notifier.Subscribe()
+}
+
+// AddIndexer initializes the passed indexer, catches it up with the chain and
+// from then on updates it within the transactions which change the blocks.
+// This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) AddIndexer(idx btcdb.Indexer) error {
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+	return db.indexers.Add(db, idx)
+}
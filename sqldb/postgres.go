@@ -0,0 +1,123 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/conformal/btcdb"
+	_ "github.com/lib/pq"
+)
+
+const (
+	// DefaultMaxConns is the default maximum number of connections a
+	// postgres database keeps open to the server.
+	DefaultMaxConns = 10
+
+	// MaxConnsOption is the key of the btcdb.Options Backend setting which
+	// overrides DefaultMaxConns.
+	MaxConnsOption = "maxconns"
+)
+
+// postgresDialect describes the PostgreSQL flavor of SQL.
+var postgresDialect = dialect{
+	name:           "postgres",
+	blobType:       "BYTEA",
+	intType:        "BIGINT",
+	serialPK:       "BIGSERIAL PRIMARY KEY",
+	numberedParams: true,
+}
+
+func init() {
+	driver := btcdb.DriverDB{DbType: "postgres", CreateDB: CreatePostgresDB,
+		OpenDB: OpenPostgresDB}
+	btcdb.AddDBDriver(driver)
+}
+
+// parsePostgresArgs parses the arguments from the btcdb Open/Create methods.
+// The first argument is the connection string and the optional second one is
+// the maximum number of connections to keep open.  Alternatively, a
+// btcdb.Options may be passed with the connection string as its path and the
+// maximum number of connections in its MaxConnsOption setting.
+func parsePostgresArgs(funcName string, args ...interface{}) (*btcdb.Options, int, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, 0, fmt.Errorf("Invalid arguments to sqldb.%s -- "+
+			"expected connection string and optional max "+
+			"connections", funcName)
+	}
+
+	var dbOpts *btcdb.Options
+	var maxConnsArg interface{}
+	switch arg := args[0].(type) {
+	case string:
+		dbOpts = &btcdb.Options{Path: arg}
+		if len(args) == 2 {
+			maxConnsArg = args[1]
+		}
+	case btcdb.Options:
+		if len(args) == 2 {
+			return nil, 0, fmt.Errorf("Invalid arguments to sqldb.%s "+
+				"-- unexpected argument after options", funcName)
+		}
+		dbOpts = &arg
+		maxConnsArg = arg.Backend[MaxConnsOption]
+	default:
+		return nil, 0, fmt.Errorf("First argument to sqldb.%s is invalid "+
+			"-- expected connection string or options", funcName)
+	}
+
+	maxConns := DefaultMaxConns
+	if maxConnsArg != nil {
+		var ok bool
+		maxConns, ok = maxConnsArg.(int)
+		if !ok || maxConns <= 0 {
+			return nil, 0, fmt.Errorf("Maximum connections argument "+
+				"to sqldb.%s is invalid -- expected positive "+
+				"integer", funcName)
+		}
+	}
+	return dbOpts, maxConns, nil
+}
+
+// openPostgres connects to the PostgreSQL server described by the connection
+// string of the passed options using a pool of up to maxConns connections.
+func openPostgres(dbOpts *btcdb.Options, maxConns int, create bool) (btcdb.Db, error) {
+	sdb, err := sql.Open("postgres", dbOpts.Path)
+	if err != nil {
+		return nil, err
+	}
+	sdb.SetMaxOpenConns(maxConns)
+	sdb.SetMaxIdleConns(maxConns)
+	if err := sdb.Ping(); err != nil {
+		sdb.Close()
+		return nil, err
+	}
+
+	db, err := newSqlDb(sdb, &postgresDialect, create, dbOpts)
+	if err != nil {
+		sdb.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenPostgresDB opens an existing PostgreSQL database for use.
+func OpenPostgresDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, maxConns, err := parsePostgresArgs("OpenPostgresDB", args...)
+	if err != nil {
+		return nil, err
+	}
+	return openPostgres(dbOpts, maxConns, false)
+}
+
+// CreatePostgresDB creates the block chain tables in a PostgreSQL database and
+// opens it for use.  The tables must not already exist.
+func CreatePostgresDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, maxConns, err := parsePostgresArgs("CreatePostgresDB", args...)
+	if err != nil {
+		return nil, err
+	}
+	return openPostgres(dbOpts, maxConns, true)
+}
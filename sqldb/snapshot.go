@@ -0,0 +1,124 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"github.com/conformal/btcdb"
+	"io"
+	"sync"
+)
+
+// snapshotTx is a read transaction held open for the lifetime of a snapshot.
+// A SQL transaction runs on a single connection, so the mutex serializes the
+// queries made through it.
+type snapshotTx struct {
+	sync.Mutex
+	tx *sql.Tx
+}
+
+// view runs the passed function in the held transaction on behalf of the
+// passed snapshot unless the context is done before the transaction is free.
+func (s *snapshotTx) view(ctx context.Context, db *SqlDb, fn func(tx *sqlTx) error) error {
+	if err := btcdb.LockContext(ctx, &s.Mutex); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	if s.tx == nil {
+		return btcdb.ErrDbClosed
+	}
+	return fn(&sqlTx{tx: s.tx, db: db})
+}
+
+// release rolls back the held transaction.
+func (s *snapshotTx) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+}
+
+// snapshot is a read-only view of a SQL database pinned to a transaction.
+type snapshot struct {
+	*SqlDb
+}
+
+// Release rolls back the transaction of the snapshot.  This is part of the
+// btcdb.Snapshot interface implementation.
+func (s *snapshot) Release() {
+	s.Close()
+}
+
+// Snapshot returns a read-only view of the database pinned to the current
+// point in time.  The snapshot holds one connection to the database until it
+// is released.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) Snapshot() (btcdb.Snapshot, error) {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return nil, btcdb.ErrDbClosed
+	}
+
+	// Both SQLite and PostgreSQL take the snapshot of a transaction on its
+	// first query rather than when it begins, so pin it right away.
+	tx, err := db.sdb.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var height int64
+	err = tx.QueryRow("SELECT height FROM blocks LIMIT 1").Scan(&height)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return nil, err
+	}
+
+	view := &SqlDb{
+		sdb:         db.sdb,
+		d:           db.d,
+		stmts:       make(map[string]*sql.Stmt),
+		readOnly:    true,
+		filterIndex: db.filterIndex,
+		chainWork:   db.chainWork,
+		metaTable:   db.metaTable,
+		metrics:     db.metrics,
+		snap:        &snapshotTx{tx: tx},
+	}
+	return &snapshot{view}, nil
+}
+
+// VerifyIntegrity performs the integrity checks of the given level on every
+// block of the chain using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) VerifyIntegrity(level int, progress func(height int64)) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.VerifyChain(snap, level, progress)
+}
+
+// ExportBootstrap writes the blocks of a range of heights in the format of
+// bootstrap.dat using a snapshot of the database.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) ExportBootstrap(w io.Writer, startHeight, endHeight int64) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return btcdb.WriteBootstrap(snap, w, startHeight, endHeight)
+}
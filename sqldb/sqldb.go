@@ -0,0 +1,1876 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"strings"
+	"sync"
+)
+
+var log = btcdb.DriverLogger("sqldb")
+
+var zeroHash = btcwire.ShaHash{}
+
+// isCoinbaseInput returns whether or not the passed transaction input is a
+// coinbase input.
+func isCoinbaseInput(txIn *btcwire.TxIn) bool {
+	prevOut := &txIn.PreviousOutpoint
+	if prevOut.Index == math.MaxUint32 && prevOut.Hash.IsEqual(&zeroHash) {
+		return true
+	}
+
+	return false
+}
+
+// dialect describes the differences between the flavors of SQL understood by
+// the supported databases.
+type dialect struct {
+	name string
+
+	// blobType, intType and serialPK are the column types used for binary
+	// data, 64-bit integers and auto incrementing primary keys.
+	blobType string
+	intType  string
+	serialPK string
+
+	// numberedParams indicates the database expects $1, $2, ... query
+	// parameters rather than ?.
+	numberedParams bool
+
+	// checkpoint is the statement which syncs committed changes to disk,
+	// empty when the database server manages that on its own.
+	checkpoint string
+
+	// backup is the statement which writes a copy of the database to the
+	// path given as its parameter, empty when the database can not be
+	// copied to a path.
+	backup string
+}
+
+// rebind converts a query written with ? parameters to the parameter style of
+// the dialect.
+func (d *dialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var buf bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&buf, "$%d", n)
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// schema returns the statements which create the tables of a new database.
+func (d *dialect) schema() []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE blocks (
+			height %[2]s PRIMARY KEY,
+			hash %[1]s NOT NULL UNIQUE,
+			version %[2]s NOT NULL,
+			prev_hash %[1]s NOT NULL,
+			merkle_root %[1]s NOT NULL,
+			block_time %[2]s NOT NULL,
+			bits %[2]s NOT NULL,
+			nonce %[2]s NOT NULL,
+			header %[1]s NOT NULL)`, d.blobType, d.intType),
+		fmt.Sprintf(`CREATE TABLE transactions (
+			id %[3]s,
+			hash %[1]s NOT NULL,
+			block_height %[2]s NOT NULL,
+			tx_index %[2]s NOT NULL,
+			raw %[1]s NOT NULL)`, d.blobType, d.intType, d.serialPK),
+		`CREATE INDEX transactions_hash ON transactions (hash)`,
+		`CREATE INDEX transactions_block_height ON transactions (block_height)`,
+		fmt.Sprintf(`CREATE TABLE inputs (
+			tx_id %[2]s NOT NULL,
+			input_index %[2]s NOT NULL,
+			prev_hash %[1]s NOT NULL,
+			prev_index %[2]s NOT NULL,
+			sig_script %[1]s NOT NULL,
+			sequence %[2]s NOT NULL,
+			PRIMARY KEY (tx_id, input_index))`, d.blobType, d.intType),
+		fmt.Sprintf(`CREATE TABLE outputs (
+			tx_id %[2]s NOT NULL,
+			output_index %[2]s NOT NULL,
+			value %[2]s NOT NULL,
+			pk_script %[1]s NOT NULL,
+			address %[1]s,
+			spent_by %[2]s,
+			PRIMARY KEY (tx_id, output_index))`, d.blobType, d.intType),
+		`CREATE INDEX outputs_spent_by ON outputs (spent_by)`,
+		`CREATE INDEX outputs_address ON outputs (address)`,
+		fmt.Sprintf(`CREATE TABLE filters (
+			height %[2]s PRIMARY KEY,
+			filter %[1]s NOT NULL,
+			header %[1]s NOT NULL)`, d.blobType, d.intType),
+		fmt.Sprintf(`CREATE TABLE chain_work (
+			height %[2]s PRIMARY KEY,
+			work %[1]s NOT NULL)`, d.blobType, d.intType),
+		d.metaSchema(),
+	}
+}
+
+// metaSchema returns the statement which creates the table of the metadata
+// namespace.
+func (d *dialect) metaSchema() string {
+	return fmt.Sprintf(`CREATE TABLE meta (
+		name %[1]s PRIMARY KEY,
+		value %[1]s NOT NULL)`, d.blobType)
+}
+
+// maxBatchRows is the maximum number of rows inserted by a single statement
+// when the inputs and outputs of a transaction are inserted.
+const maxBatchRows = 100
+
+// SqlDb is a concrete implementation of the btcdb.Db interface which stores
+// the block chain in normalized SQL tables.
+type SqlDb struct {
+	sdb *sql.DB
+	d   *dialect
+
+	// stmts caches the prepared statement of every query by its text so
+	// each query is only parsed once per connection.
+	stmtLock sync.Mutex
+	stmts    map[string]*sql.Stmt
+
+	// writeLock serializes the transactions which modify the database.
+	writeLock sync.Mutex
+
+	// closed is set once the database has been closed and readOnly when it
+	// was opened without allowing changes.  closeLock is held for reading
+	// by every transaction and for writing by Close, so closing waits for
+	// the transactions in progress and those begun later see closed set.
+	closeLock sync.RWMutex
+	closed    bool
+	readOnly  bool
+
+	// filterIndex is set when the database has the filters table.
+	// Databases created before compact filters were stored do not have it
+	// and are used without filters.
+	filterIndex bool
+
+	// chainWork is set when the database has the chain_work table.
+	// Databases created before the cumulative work was stored compute it
+	// as needed instead.
+	chainWork bool
+
+	// addressColumn is set when the outputs table has the address
+	// column.  Databases created before it existed are used without it.
+	addressColumn bool
+
+	// metaTable is set when the database has the meta table.  Databases
+	// created before the metadata namespace existed get it when they are
+	// opened for writing.
+	metaTable bool
+
+	// notifier delivers the blocks connected and disconnected by each
+	// committed transaction to subscribers and indexers holds the
+	// secondary indexes updated within the same transactions.
+	notifier btcdb.Notifier
+	indexers btcdb.IndexerSet
+
+	// syncer performs the periodic syncs of the SyncPeriodic policy.
+	syncer btcdb.PeriodicSyncer
+
+	// metrics receives the measurements of the operations of the database.
+	metrics btcdb.Metrics
+
+	// validation selects the checks performed on each inserted block.
+	validation btcdb.ValidationMode
+
+	// blockCache holds the blocks most recently fetched and inserted.  It
+	// is nil when blocks are not cached and for snapshots, which may not
+	// see every block it holds.
+	blockCache *btcdb.BlockCache
+
+	// prefetch is the number of blocks read ahead by block iterators and
+	// readAhead reads the blocks following those fetched in height order
+	// into the block cache.  readAhead is nil without a block cache and
+	// for snapshots.
+	prefetch  int
+	readAhead *btcdb.ReadAhead
+
+	// lock keeps other processes from opening the database while it is
+	// open, nil for databases on a server.
+	lock *btcdb.DbLock
+
+	// snap is the transaction all reads go through when the instance is a
+	// snapshot of the database rather than the database itself.
+	snap *snapshotTx
+}
+
+// newSqlDb returns a database backed by the passed SQL database.  The tables
+// are created when the create flag is set, otherwise they must already exist.
+func newSqlDb(sdb *sql.DB, d *dialect, create bool, dbOpts *btcdb.Options) (*SqlDb, error) {
+	db := &SqlDb{sdb: sdb, d: d, stmts: make(map[string]*sql.Stmt),
+		filterIndex: true, chainWork: true, addressColumn: true,
+		metaTable:  true,
+		metrics:    btcdb.DriverMetrics(dbOpts),
+		validation: dbOpts.Validation,
+		blockCache: btcdb.NewBlockCache(dbOpts.BlockCacheSize),
+		prefetch:   dbOpts.PrefetchDepth}
+	if db.blockCache != nil {
+		db.readAhead = btcdb.NewReadAhead(dbOpts.PrefetchDepth,
+			db.readAheadBlock)
+	}
+	if create {
+		err := db.update(func(tx *sqlTx) error {
+			for _, stmt := range d.schema() {
+				if _, err := tx.tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		db.readOnly = dbOpts.ReadOnly
+		return db, nil
+	}
+
+	var count int64
+	err := sdb.QueryRow("SELECT COUNT(*) FROM blocks").Scan(&count)
+	if err != nil {
+		log.Tracef("no blocks table in %s database: %v", d.name, err)
+		return nil, btcdb.DbDoesNotExist
+	}
+	err = sdb.QueryRow("SELECT COUNT(*) FROM filters").Scan(&count)
+	if err != nil {
+		log.Infof("no filters table in %s database, compact filters "+
+			"are disabled: %v", d.name, err)
+		db.filterIndex = false
+	}
+	err = sdb.QueryRow("SELECT COUNT(*) FROM chain_work").Scan(&count)
+	if err != nil {
+		log.Infof("no chain_work table in %s database, chain work is "+
+			"computed as needed: %v", d.name, err)
+		db.chainWork = false
+	}
+	_, err = sdb.Exec("SELECT address FROM outputs WHERE 1 = 0")
+	if err != nil {
+		log.Infof("no address column in the outputs table of %s "+
+			"database, addresses are not recorded: %v", d.name, err)
+		db.addressColumn = false
+	}
+	err = sdb.QueryRow("SELECT COUNT(*) FROM meta").Scan(&count)
+	if err != nil && !dbOpts.ReadOnly {
+		err = db.update(func(tx *sqlTx) error {
+			_, err := tx.tx.Exec(d.metaSchema())
+			return err
+		})
+	}
+	if err != nil {
+		log.Infof("no meta table in %s database, the metadata "+
+			"namespace is empty: %v", d.name, err)
+		db.metaTable = false
+	}
+	db.readOnly = dbOpts.ReadOnly
+	return db, nil
+}
+
+// prepare returns the cached prepared statement for the passed query,
+// preparing it first if needed.
+func (db *SqlDb) prepare(query string) (*sql.Stmt, error) {
+	db.stmtLock.Lock()
+	defer db.stmtLock.Unlock()
+
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.sdb.Prepare(db.d.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	db.stmts[query] = stmt
+	return stmt, nil
+}
+
+// sqlTx wraps a SQL transaction so queries are written in a single parameter
+// style regardless of the dialect and run as prepared statements.
+type sqlTx struct {
+	tx *sql.Tx
+	db *SqlDb
+
+	// events holds the blocks connected and disconnected by the
+	// transaction, which are delivered to subscribers once it commits,
+	// and committed the functions run once it commits.
+	events    []btcdb.ChainEvent
+	committed []func()
+}
+
+// onCommit runs the passed function once the transaction commits, while the
+// write lock is still held.  It is not run when the transaction fails.
+func (t *sqlTx) onCommit(fn func()) {
+	t.committed = append(t.committed, fn)
+}
+
+func (t *sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := t.db.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return t.tx.Stmt(stmt).Exec(args...)
+}
+
+func (t *sqlTx) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := t.db.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return t.tx.Stmt(stmt).Query(args...)
+}
+
+func (t *sqlTx) queryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := t.db.prepare(query)
+	if err != nil {
+		// Let the unprepared query report the error through the row.
+		return t.tx.QueryRow(t.db.d.rebind(query), args...)
+	}
+	return t.tx.Stmt(stmt).QueryRow(args...)
+}
+
+// insertRows inserts the passed rows into the given table using multi-row
+// insert statements of up to maxBatchRows rows each.
+func (t *sqlTx) insertRows(table string, columns []string, rows [][]interface{}) error {
+	placeholders := "(" + strings.Repeat("?, ", len(columns)-1) + "?)"
+	for len(rows) != 0 {
+		batch := rows
+		if len(batch) > maxBatchRows {
+			batch = batch[:maxBatchRows]
+		}
+		rows = rows[len(batch):]
+
+		values := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*len(columns))
+		for i, row := range batch {
+			values[i] = placeholders
+			args = append(args, row...)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table,
+			strings.Join(columns, ", "), strings.Join(values, ", "))
+		if _, err := t.exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update runs the passed function in a SQL transaction which is committed when
+// the function succeeds and rolled back otherwise.
+func (db *SqlDb) update(fn func(tx *sqlTx) error) error {
+	return db.updateOp(btcdb.StartOp(btcdb.DiscardMetrics, "", nil), fn)
+}
+
+// updateOp behaves the same as update while recording the time the passed
+// operation waited for the write lock.  The statistics of the connection pool
+// are reported once the transaction is committed.
+func (db *SqlDb) updateOp(op *btcdb.OpTimer, fn func(tx *sqlTx) error) error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.readOnly {
+		return btcdb.ErrReadOnly
+	}
+
+	db.writeLock.Lock()
+	op.Locked()
+	defer db.writeLock.Unlock()
+
+	tx, err := db.sdb.Begin()
+	if err != nil {
+		return err
+	}
+	t := &sqlTx{tx: tx, db: db}
+	if err := fn(t); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, fn := range t.committed {
+		fn()
+	}
+	db.notifier.Notify(t.events...)
+	db.reportStats()
+	return nil
+}
+
+// reportStats passes the statistics of the connection pool to the metrics of
+// the database as gauges.
+func (db *SqlDb) reportStats() {
+	if db.metrics == btcdb.DiscardMetrics {
+		return
+	}
+
+	stats := db.sdb.Stats()
+	prefix := db.d.name + "."
+	m := db.metrics
+	m.SetGauge(prefix+"conns.open", int64(stats.OpenConnections))
+	m.SetGauge(prefix+"conns.inuse", int64(stats.InUse))
+	m.SetGauge(prefix+"conns.wait.count", stats.WaitCount)
+	m.SetGauge(prefix+"conns.wait.time_ns", int64(stats.WaitDuration))
+}
+
+// view runs the passed function in a SQL transaction which is always rolled
+// back so it observes a consistent view of the database.
+func (db *SqlDb) view(fn func(tx *sqlTx) error) error {
+	return db.viewCtx(context.Background(), fn)
+}
+
+// viewCtx behaves the same as view, except the transaction is rolled back and
+// the error of the passed context returned should it be done before the
+// function returns, including while waiting for a connection.
+func (db *SqlDb) viewCtx(ctx context.Context, fn func(tx *sqlTx) error) error {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed {
+		return btcdb.ErrDbClosed
+	}
+	if db.snap != nil {
+		return db.snap.view(ctx, db, fn)
+	}
+
+	tx, err := db.sdb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(&sqlTx{tx: tx, db: db}); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+// txRow holds the columns of a transactions table row along with the hash of
+// the block which contains it.
+type txRow struct {
+	id          int64
+	blockHeight int64
+	txIndex     int64
+	raw         []byte
+	blkSha      btcwire.ShaHash
+}
+
+// newestBlock returns the hash and height of the most recent block or the zero
+// hash and -1 when there are no blocks.
+func (t *sqlTx) newestBlock() (*btcwire.ShaHash, int64, error) {
+	var height int64
+	var hash []byte
+	err := t.queryRow("SELECT height, hash FROM blocks ORDER BY height "+
+		"DESC LIMIT 1").Scan(&height, &hash)
+	if err == sql.ErrNoRows {
+		return &btcwire.ShaHash{}, -1, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var sha btcwire.ShaHash
+	if err := sha.SetBytes(hash); err != nil {
+		return nil, 0, err
+	}
+	return &sha, height, nil
+}
+
+// blockHeight returns the height of the block with the given hash and whether
+// or not it exists.
+func (t *sqlTx) blockHeight(sha *btcwire.ShaHash) (int64, bool, error) {
+	var height int64
+	err := t.queryRow("SELECT height FROM blocks WHERE hash = ?",
+		sha.Bytes()).Scan(&height)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return height, true, nil
+}
+
+// fetchHeader returns the header of the block at the given height.
+func (t *sqlTx) fetchHeader(height int64) (*btcwire.BlockHeader, error) {
+	var header []byte
+	err := t.queryRow("SELECT header FROM blocks WHERE height = ?",
+		height).Scan(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	var bh btcwire.BlockHeader
+	if err := bh.Deserialize(bytes.NewBuffer(header)); err != nil {
+		return nil, err
+	}
+	return &bh, nil
+}
+
+// fetchBlock reassembles the block at the given height from its header and
+// transactions.
+func (t *sqlTx) fetchBlock(height int64) (*btcwire.MsgBlock, error) {
+	bh, err := t.fetchHeader(height)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := t.query("SELECT raw FROM transactions WHERE "+
+		"block_height = ? ORDER BY tx_index", height)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgBlock := btcwire.NewMsgBlock(bh)
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var msgTx btcwire.MsgTx
+		if err := msgTx.Deserialize(bytes.NewBuffer(raw)); err != nil {
+			return nil, err
+		}
+		if err := msgBlock.AddTransaction(&msgTx); err != nil {
+			return nil, err
+		}
+	}
+	return msgBlock, rows.Err()
+}
+
+// fetchRawBlock returns the hash and serialized bytes of the block at the given
+// height, which are appended to buf.  The bytes are assembled from the raw
+// header and transactions, so nothing needs to be deserialized.
+func (t *sqlTx) fetchRawBlock(height int64, buf []byte) (*btcwire.ShaHash, []byte, error) {
+	var hash, header []byte
+	err := t.queryRow("SELECT hash, header FROM blocks WHERE height = ?",
+		height).Scan(&hash, &header)
+	if err == sql.ErrNoRows {
+		return nil, nil, btcdb.ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var sha btcwire.ShaHash
+	if err := sha.SetBytes(hash); err != nil {
+		return nil, nil, btcdb.ErrCorruption
+	}
+
+	rows, err := t.query("SELECT raw FROM transactions WHERE "+
+		"block_height = ? ORDER BY tx_index", height)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var rawTxs [][]byte
+	size := len(header) + 9
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, nil, err
+		}
+		rawTxs = append(rawTxs, raw)
+		size += len(raw)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	w := bytes.NewBuffer(buf)
+	w.Grow(size)
+	w.Write(header)
+	if err := btcwire.WriteVarInt(w, 0, uint64(len(rawTxs))); err != nil {
+		return nil, nil, err
+	}
+	for _, raw := range rawTxs {
+		w.Write(raw)
+	}
+	return &sha, w.Bytes(), nil
+}
+
+// scanTxRows reads all transaction rows selected by a query starting with
+// txRowColumns.
+func scanTxRows(rows *sql.Rows) ([]*txRow, error) {
+	defer rows.Close()
+
+	var txRows []*txRow
+	for rows.Next() {
+		var row txRow
+		var blkHash []byte
+		err := rows.Scan(&row.id, &row.blockHeight, &row.txIndex,
+			&row.raw, &blkHash)
+		if err != nil {
+			return nil, err
+		}
+		if err := row.blkSha.SetBytes(blkHash); err != nil {
+			return nil, err
+		}
+		txRows = append(txRows, &row)
+	}
+	return txRows, rows.Err()
+}
+
+// txRowColumns selects the columns of a txRow from the transactions table
+// aliased as t joined with the blocks table aliased as b.
+const txRowColumns = "SELECT t.id, t.block_height, t.tx_index, t.raw, b.hash " +
+	"FROM transactions t JOIN blocks b ON b.height = t.block_height "
+
+// fetchTxRows returns every instance of the given transaction hash ordered from
+// oldest to newest.
+func (t *sqlTx) fetchTxRows(sha *btcwire.ShaHash) ([]*txRow, error) {
+	rows, err := t.query(txRowColumns+"WHERE t.hash = ? ORDER BY t.id",
+		sha.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return scanTxRows(rows)
+}
+
+// fetchLatestTxRow returns the most recent instance of the given transaction
+// hash or nil when there is none.
+func (t *sqlTx) fetchLatestTxRow(sha *btcwire.ShaHash) (*txRow, error) {
+	rows, err := t.query(txRowColumns+"WHERE t.hash = ? ORDER BY t.id "+
+		"DESC LIMIT 1", sha.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	txRows, err := scanTxRows(rows)
+	if err != nil || len(txRows) == 0 {
+		return nil, err
+	}
+	return txRows[0], nil
+}
+
+// latestTxID returns the id of the most recent instance of the given
+// transaction hash and whether or not one exists.
+func (t *sqlTx) latestTxID(sha *btcwire.ShaHash) (int64, bool, error) {
+	var id int64
+	err := t.queryRow("SELECT id FROM transactions WHERE hash = ? "+
+		"ORDER BY id DESC LIMIT 1", sha.Bytes()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// unspentCount returns the number of unspent outputs of the transaction with
+// the given id.
+func (t *sqlTx) unspentCount(txID int64) (int64, error) {
+	var count int64
+	err := t.queryRow("SELECT COUNT(*) FROM outputs WHERE tx_id = ? AND "+
+		"spent_by IS NULL", txID).Scan(&count)
+	return count, err
+}
+
+// fetchSpent returns the spent status of every output of the transaction with
+// the given id.
+func (t *sqlTx) fetchSpent(txID int64) ([]bool, error) {
+	rows, err := t.query("SELECT spent_by FROM outputs WHERE tx_id = ? "+
+		"ORDER BY output_index", txID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spent []bool
+	for rows.Next() {
+		var spentBy sql.NullInt64
+		if err := rows.Scan(&spentBy); err != nil {
+			return nil, err
+		}
+		spent = append(spent, spentBy.Valid)
+	}
+	return spent, rows.Err()
+}
+
+// txReply populates the passed reply from the given transaction row.
+func (t *sqlTx) txReply(reply *btcdb.TxListReply, row *txRow) error {
+	spent, err := t.fetchSpent(row.id)
+	if err != nil {
+		return err
+	}
+	var msgTx btcwire.MsgTx
+	if err := msgTx.Deserialize(bytes.NewBuffer(row.raw)); err != nil {
+		return err
+	}
+
+	blkSha := row.blkSha
+	reply.Tx = &msgTx
+	reply.BlkSha = &blkSha
+	reply.Height = row.blockHeight
+	reply.BlkIndex = int(row.txIndex)
+	reply.TxSpent = spent
+	reply.Err = nil
+	return nil
+}
+
+// Close cleanly shuts down the database.  This is part of the btcdb.Db
+// interface implementation.
+func (db *SqlDb) Close() {
+	// The periodic syncs and reading ahead begin transactions, so they
+	// are stopped first.
+	db.syncer.Stop()
+	db.readAhead.Stop()
+
+	db.closeLock.Lock()
+	defer db.closeLock.Unlock()
+
+	if db.closed {
+		return
+	}
+	db.closed = true
+
+	db.stmtLock.Lock()
+	for query, stmt := range db.stmts {
+		stmt.Close()
+		delete(db.stmts, query)
+	}
+	db.stmtLock.Unlock()
+
+	// A snapshot only owns the transaction it reads from.
+	if db.snap != nil {
+		db.snap.release()
+		return
+	}
+	db.notifier.Close()
+	if err := db.sdb.Close(); err != nil {
+		log.Warnf("Close: %v", err)
+	}
+	db.lock.Unlock()
+}
+
+// Closed returns whether the database has been closed.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) Closed() bool {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	return db.closed
+}
+
+// DropAfterBlockBySha removes any blocks from the database after the given
+// block.  Outputs spent by the removed transactions are marked unspent again.
+// This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) DropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	return db.DropAfterBlockByShaWithMeta(sha, nil)
+}
+
+// dropAfterBlockBySha removes any blocks after the given block, marks the
+// outputs spent by their transactions unspent again and removes them from the
+// indexers.
+func (t *sqlTx) dropAfterBlockBySha(sha *btcwire.ShaHash) error {
+	height, exists, err := t.blockHeight(sha)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return btcdb.ErrBlockNotFound
+	}
+	t.onCommit(func() {
+		t.db.blockCache.RemoveFrom(height + 1)
+	})
+	first := len(t.events)
+	if err := t.collectDisconnected(height); err != nil {
+		return err
+	}
+
+	// The indexers are given the blocks while they are still stored.
+	if t.db.indexers.Len() != 0 {
+		var dropped []*btcutil.Block
+		var droppedHeights []int64
+		for _, ev := range t.events[first:] {
+			h := ev.(btcdb.BlockDisconnected).Height
+			msgBlock, err := t.fetchBlock(h)
+			if err != nil {
+				return err
+			}
+			dropped = append(dropped, btcutil.NewBlock(msgBlock))
+			droppedHeights = append(droppedHeights, h)
+		}
+		spent, err := t.fetchSpentTxOuts(dropped, droppedHeights)
+		if err != nil {
+			return err
+		}
+		idxMeta, err := t.db.indexers.DisconnectBlocks(dropped,
+			droppedHeights, spent, t.getMeta)
+		if err != nil {
+			return err
+		}
+		if err := t.putMeta(idxMeta); err != nil {
+			return err
+		}
+	}
+
+	const dropped = "SELECT id FROM transactions WHERE block_height > ?"
+	stmts := []string{
+		"UPDATE outputs SET spent_by = NULL WHERE spent_by IN (" +
+			dropped + ")",
+		"DELETE FROM inputs WHERE tx_id IN (" + dropped + ")",
+		"DELETE FROM outputs WHERE tx_id IN (" + dropped + ")",
+		"DELETE FROM transactions WHERE block_height > ?",
+		"DELETE FROM blocks WHERE height > ?",
+	}
+	if t.db.filterIndex {
+		stmts = append(stmts, "DELETE FROM filters WHERE height > ?")
+	}
+	if t.db.chainWork {
+		stmts = append(stmts, "DELETE FROM chain_work WHERE height > ?")
+	}
+	for _, stmt := range stmts {
+		if _, err := t.exec(stmt, height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectDisconnected adds the blocks after the given height to the blocks
+// disconnected by the transaction from the tip down.
+func (t *sqlTx) collectDisconnected(height int64) error {
+	rows, err := t.query("SELECT height, hash FROM blocks WHERE height > ? "+
+		"ORDER BY height DESC", height)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ev btcdb.BlockDisconnected
+		var hash []byte
+		if err := rows.Scan(&ev.Height, &hash); err != nil {
+			return err
+		}
+		if err := ev.Sha.SetBytes(hash); err != nil {
+			return err
+		}
+		t.events = append(t.events, ev)
+	}
+	return rows.Err()
+}
+
+// ExistsSha returns whether or not the given block hash is present in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) ExistsSha(sha *btcwire.ShaHash) bool {
+	var exists bool
+	err := db.view(func(tx *sqlTx) error {
+		var err error
+		_, exists, err = tx.blockHeight(sha)
+		return err
+	})
+	if err != nil {
+		log.Warnf("ExistsSha: %v", err)
+		return false
+	}
+	return exists
+}
+
+// ExistsShas returns whether or not each of the given block hashes is present
+// in the database.  The hashes are looked up with queries of up to
+// maxBatchRows hashes each in a single transaction.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) ExistsShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	err := db.view(func(tx *sqlTx) error {
+		found := make(map[btcwire.ShaHash]bool, len(shas))
+		for start := 0; start < len(shas); start += maxBatchRows {
+			batch := shas[start:]
+			if len(batch) > maxBatchRows {
+				batch = batch[:maxBatchRows]
+			}
+			args := make([]interface{}, len(batch))
+			for i := range batch {
+				args[i] = batch[i].Bytes()
+			}
+			query := "SELECT hash FROM blocks WHERE hash IN (" +
+				strings.Repeat("?, ", len(batch)-1) + "?)"
+			if err := tx.collectHashes(found, query, args...); err != nil {
+				return err
+			}
+		}
+		for i := range shas {
+			exists[i] = found[shas[i]]
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("ExistsShas: %v", err)
+		return make([]bool, len(shas))
+	}
+	return exists
+}
+
+// collectHashes runs the passed query, which must select a single hash column,
+// and marks every returned hash as found.
+func (t *sqlTx) collectHashes(found map[btcwire.ShaHash]bool, query string, args ...interface{}) error {
+	rows, err := t.query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		var sha btcwire.ShaHash
+		if err := sha.SetBytes(hash); err != nil {
+			return btcdb.ErrCorruption
+		}
+		found[sha] = true
+	}
+	return rows.Err()
+}
+
+// FetchBlockBySha returns a btcutil.Block.  This is part of the btcdb.Db
+// interface implementation.
+func (db *SqlDb) FetchBlockBySha(sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	return db.FetchBlockByShaCtx(context.Background(), sha)
+}
+
+// FetchBlockByShaCtx returns a btcutil.Block unless the passed context is done
+// first.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchBlockByShaCtx(ctx context.Context, sha *btcwire.ShaHash) (*btcutil.Block, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha).Done()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if blk := db.blockCache.Lookup(sha); blk != nil {
+		db.readAhead.Fetched(blk.Height())
+		return blk, nil
+	}
+	epoch := db.blockCache.Epoch()
+
+	var blk *btcutil.Block
+	err := db.viewCtx(ctx, func(tx *sqlTx) error {
+		height, exists, err := tx.blockHeight(sha)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return btcdb.ErrBlockNotFound
+		}
+		msgBlock, err := tx.fetchBlock(height)
+		if err != nil {
+			return err
+		}
+		blk = btcutil.NewBlock(msgBlock)
+		blk.SetHeight(height)
+		if db.blockCache != nil {
+			if raw, err := blk.Bytes(); err == nil {
+				db.blockCache.AddRead(epoch, sha, height, raw)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.readAhead.Fetched(blk.Height())
+	return blk, nil
+}
+
+// readAheadBlock reads the block at the given height into the block cache
+// ahead of the caller.  It returns false once there is no such block.
+func (db *SqlDb) readAheadBlock(height int64) bool {
+	epoch := db.blockCache.Epoch()
+	err := db.view(func(tx *sqlTx) error {
+		sha, buf, err := tx.fetchRawBlock(height, nil)
+		if err != nil {
+			return err
+		}
+		db.blockCache.AddRead(epoch, sha, height, buf)
+		return nil
+	})
+	return err == nil
+}
+
+// BlockCacheStats returns the use of the cache of recent blocks.  This is part
+// of the btcdb.Db interface implementation.
+func (db *SqlDb) BlockCacheStats() btcdb.BlockCacheStats {
+	return db.blockCache.Stats()
+}
+
+// FetchBlockHeightBySha returns the block height for the given hash.  This is
+// part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchBlockHeightBySha(sha *btcwire.ShaHash) (int64, error) {
+	var height int64
+	err := db.view(func(tx *sqlTx) error {
+		var exists bool
+		var err error
+		height, exists, err = tx.blockHeight(sha)
+		if err == nil && !exists {
+			err = btcdb.ErrBlockNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// FetchBlockRegion returns length bytes of the serialized block with the given
+// hash starting at offset.  This is part of the btcdb.Db interface
+// implementation.
+//
+// Blocks are stored as separate header and transaction rows, so the block is
+// assembled in full before the region is taken from it.
+func (db *SqlDb) FetchBlockRegion(sha *btcwire.ShaHash, offset, length int) ([]byte, error) {
+	var region []byte
+	err := db.view(func(tx *sqlTx) error {
+		height, exists, err := tx.blockHeight(sha)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return btcdb.ErrBlockNotFound
+		}
+		_, buf, err := tx.fetchRawBlock(height, nil)
+		if err != nil {
+			return err
+		}
+		if offset < 0 || length < 0 || offset+length > len(buf) {
+			return btcdb.ErrInvalidRegion
+		}
+		region = buf[offset : offset+length]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return region, nil
+}
+
+// FetchBlockBytesBySha appends the serialized block with the given hash to
+// buf[:0] and returns the result.  The block is assembled from its header and
+// transactions in the buffer.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) FetchBlockBytesBySha(sha *btcwire.ShaHash, buf []byte) ([]byte, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchBlock, sha).Done()
+
+	err := db.view(func(tx *sqlTx) error {
+		height, exists, err := tx.blockHeight(sha)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return btcdb.ErrBlockNotFound
+		}
+		_, buf, err = tx.fetchRawBlock(height, buf[:0])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// FetchBlockHeaderBySha returns a btcwire.BlockHeader for the given sha.  This
+// is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchBlockHeaderBySha(sha *btcwire.ShaHash) (*btcwire.BlockHeader, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, sha).Done()
+
+	var bh *btcwire.BlockHeader
+	err := db.view(func(tx *sqlTx) error {
+		height, exists, err := tx.blockHeight(sha)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return btcdb.ErrBlockNotFound
+		}
+		bh, err = tx.fetchHeader(height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bh, nil
+}
+
+// FetchBlockShaByHeight returns a block hash based on its height in the block
+// chain.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchBlockShaByHeight(height int64) (*btcwire.ShaHash, error) {
+	var sha *btcwire.ShaHash
+	err := db.view(func(tx *sqlTx) error {
+		var hash []byte
+		err := tx.queryRow("SELECT hash FROM blocks WHERE height = ?",
+			height).Scan(&hash)
+		if err == sql.ErrNoRows {
+			return btcdb.ErrBlockNotFound
+		}
+		if err != nil {
+			return err
+		}
+		sha = new(btcwire.ShaHash)
+		return sha.SetBytes(hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sha, nil
+}
+
+// FetchHeightRange looks up a range of blocks by the start and ending heights.
+// Fetch is inclusive of the start height and exclusive of the ending height.
+// To fetch all hashes from the start height until no more are present, use the
+// special id `AllShas'.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchHeightRange(startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	return db.FetchHeightRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeightRangeCtx looks up a range of blocks by the start and ending
+// heights unless the passed context is done first.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) FetchHeightRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.ShaHash, error) {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	var hashList []btcwire.ShaHash
+	err := db.viewCtx(ctx, func(tx *sqlTx) error {
+		rows, err := tx.query("SELECT hash FROM blocks WHERE height "+
+			">= ? AND height < ? ORDER BY height", startHeight,
+			endHeight)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hash []byte
+			if err := rows.Scan(&hash); err != nil {
+				return err
+			}
+			var sha btcwire.ShaHash
+			if err := sha.SetBytes(hash); err != nil {
+				return err
+			}
+			hashList = append(hashList, sha)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.readAhead.Listed(startHeight, startHeight+int64(len(hashList)))
+	return hashList, nil
+}
+
+// FetchBlockHeaderByHeight returns the block header at the given height in the
+// main chain.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchBlockHeaderByHeight(height int64) (*btcwire.BlockHeader, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchHeader, height).Done()
+
+	var bh *btcwire.BlockHeader
+	err := db.view(func(tx *sqlTx) error {
+		var err error
+		bh, err = tx.fetchHeader(height)
+		if err == sql.ErrNoRows {
+			return btcdb.ErrBlockNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bh, nil
+}
+
+// FetchHeaderRange returns the block headers from the start height up to but
+// not including the end height.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) FetchHeaderRange(startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	return db.FetchHeaderRangeCtx(context.Background(), startHeight,
+		endHeight)
+}
+
+// FetchHeaderRangeCtx returns the block headers from the start height up to but
+// not including the end height unless the passed context is done first.  This
+// is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchHeaderRangeCtx(ctx context.Context, startHeight, endHeight int64) ([]btcwire.BlockHeader, error) {
+	// Ensure requested heights are sane.
+	if startHeight < 0 {
+		return nil, fmt.Errorf("start height of fetch range must not "+
+			"be less than zero - got %d", startHeight)
+	}
+	if endHeight < startHeight {
+		return nil, fmt.Errorf("end height of fetch range must not "+
+			"be less than the start height - got start %d, end %d",
+			startHeight, endHeight)
+	}
+
+	var headers []btcwire.BlockHeader
+	err := db.viewCtx(ctx, func(tx *sqlTx) error {
+		rows, err := tx.query("SELECT header FROM blocks WHERE height "+
+			">= ? AND height < ? ORDER BY height", startHeight,
+			endHeight)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var header []byte
+			if err := rows.Scan(&header); err != nil {
+				return err
+			}
+			var bh btcwire.BlockHeader
+			err := bh.Deserialize(bytes.NewReader(header))
+			if err != nil {
+				return err
+			}
+			headers = append(headers, bh)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// ExistsTxSha returns whether or not the given transaction hash is present in
+// the database and is not fully spent.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) ExistsTxSha(sha *btcwire.ShaHash) bool {
+	var exists bool
+	err := db.view(func(tx *sqlTx) error {
+		id, ok, err := tx.latestTxID(sha)
+		if err != nil || !ok {
+			return err
+		}
+		count, err := tx.unspentCount(id)
+		exists = count != 0
+		return err
+	})
+	if err != nil {
+		log.Warnf("ExistsTxSha: %v", err)
+		return false
+	}
+	return exists
+}
+
+// ExistsTxShas returns whether or not each of the given transaction hashes is
+// present in the database and is not fully spent.  All of the hashes are
+// looked up in a single transaction.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) ExistsTxShas(shas []btcwire.ShaHash) []bool {
+	exists := make([]bool, len(shas))
+	err := db.view(func(tx *sqlTx) error {
+		for i := range shas {
+			id, ok, err := tx.latestTxID(&shas[i])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			count, err := tx.unspentCount(id)
+			if err != nil {
+				return err
+			}
+			exists[i] = count != 0
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("ExistsTxShas: %v", err)
+		return make([]bool, len(shas))
+	}
+	return exists
+}
+
+// FetchTxBySha returns some data for the given transaction hash.  Every
+// instance of the transaction is returned ordered from oldest to newest.  This
+// is part of the btcdb.Db interface implementation.
+func (db *SqlDb) FetchTxBySha(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	defer btcdb.StartOp(db.metrics, btcdb.MetricFetchTx, txHash).Done()
+
+	var replyList []*btcdb.TxListReply
+	err := db.view(func(tx *sqlTx) error {
+		var err error
+		replyList, err = tx.fetchTxInstances(txHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replyList, nil
+}
+
+// fetchTxInstances returns every instance of the transaction with the passed
+// hash stored in the database ordered from oldest to newest.
+func (t *sqlTx) fetchTxInstances(txHash *btcwire.ShaHash) ([]*btcdb.TxListReply, error) {
+	txRows, err := t.fetchTxRows(txHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(txRows) == 0 {
+		log.Warnf("FetchTxBySha: requested hash of %s does not exist",
+			txHash)
+		return nil, btcdb.TxShaMissing
+	}
+
+	txHashCopy := *txHash
+	replyList := make([]*btcdb.TxListReply, 0, len(txRows))
+	for _, row := range txRows {
+		reply := btcdb.TxListReply{Sha: &txHashCopy}
+		if err := t.txReply(&reply, row); err != nil {
+			return nil, err
+		}
+		replyList = append(replyList, &reply)
+	}
+	return replyList, nil
+}
+
+// fetchSpentTxOuts returns the outputs spent by each of the passed blocks
+// stored at the given heights, or nil when there are no indexers to pass them
+// to.
+func (t *sqlTx) fetchSpentTxOuts(blocks []*btcutil.Block, heights []int64) ([][]*btcdb.UtxoEntry, error) {
+	if t.db.indexers.Len() == 0 {
+		return nil, nil
+	}
+	spent := make([][]*btcdb.UtxoEntry, 0, len(blocks))
+	for i, block := range blocks {
+		s, err := btcdb.FetchSpentTxOuts(block, heights[i],
+			t.fetchTxInstances)
+		if err != nil {
+			return nil, err
+		}
+		spent = append(spent, s)
+	}
+	return spent, nil
+}
+
+// fetchTxByShaList fetches transactions and information about them given an
+// array of transaction hashes.  The includeSpent flag indicates whether or not
+// information about transactions which are fully spent should be returned.
+// When the flag is not set, the corresponding entry in the TxListReply slice
+// for fully spent transactions will indicate the transaction does not exist
+// and is fully spent.
+func (db *SqlDb) fetchTxByShaList(txShaList []*btcwire.ShaHash, includeSpent bool) []*btcdb.TxListReply {
+	replyList := make([]*btcdb.TxListReply, 0, len(txShaList))
+	for _, hash := range txShaList {
+		reply := btcdb.TxListReply{Sha: hash, Err: btcdb.TxShaMissing}
+		replyList = append(replyList, &reply)
+	}
+
+	err := db.view(func(tx *sqlTx) error {
+		for _, reply := range replyList {
+			// Only the most recent instance of the transaction is
+			// of interest.  FetchTxBySha can be used to get all of
+			// them.
+			row, err := tx.fetchLatestTxRow(reply.Sha)
+			if err != nil {
+				reply.Err = err
+				continue
+			}
+			if row == nil {
+				continue
+			}
+			if !includeSpent {
+				count, err := tx.unspentCount(row.id)
+				if err != nil {
+					reply.Err = err
+					continue
+				}
+				if count == 0 {
+					reply.Height = row.blockHeight
+					reply.FullySpent = true
+					continue
+				}
+			}
+			if err := tx.txReply(reply, row); err != nil {
+				reply.Err = err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for _, reply := range replyList {
+			reply.Err = err
+		}
+	}
+	return replyList
+}
+
+// FetchTxByShaList returns a TxListReply given an array of transaction hashes.
+// This function differs from FetchUnSpentTxByShaList in that it returns the
+// most recent version of fully spent transactions.  This is part of the
+// btcdb.Db interface implementation.
+func (db *SqlDb) FetchTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return db.fetchTxByShaList(txShaList, true)
+}
+
+// FetchUnSpentTxByShaList returns a TxListReply given an array of transaction
+// hashes.  Any transactions which are fully spent will indicate they do not
+// exist by setting the Err field to TxShaMissing, along with the FullySpent
+// field and the height of their most recent instance.  This is part of the btcdb.Db
+// interface implementation.
+func (db *SqlDb) FetchUnSpentTxByShaList(txShaList []*btcwire.ShaHash) []*btcdb.TxListReply {
+	return db.fetchTxByShaList(txShaList, false)
+}
+
+// FetchUtxoEntry returns the unspent transaction output referenced by the
+// given outpoint.  A nil entry and no error is returned when the output does
+// not exist or has already been spent.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) FetchUtxoEntry(op *btcwire.OutPoint) (*btcdb.UtxoEntry, error) {
+	var entry *btcdb.UtxoEntry
+	err := db.view(func(tx *sqlTx) error {
+		var e btcdb.UtxoEntry
+		var txIndex int64
+		err := tx.queryRow("SELECT t.block_height, t.tx_index, "+
+			"o.value, o.pk_script FROM transactions t JOIN outputs "+
+			"o ON o.tx_id = t.id WHERE t.id = (SELECT MAX(id) FROM "+
+			"transactions WHERE hash = ?) AND o.output_index = ? "+
+			"AND o.spent_by IS NULL", op.Hash.Bytes(),
+			int64(op.Index)).Scan(&e.Height, &txIndex, &e.Value,
+			&e.PkScript)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e.Coinbase = txIndex == 0
+		entry = &e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// FetchSpendingTx returns the transaction which spent the output referenced by
+// the given outpoint.  The spender is recorded with every output, so the spend
+// index is always available for this backend.  This is part of the btcdb.Db
+// interface implementation.
+func (db *SqlDb) FetchSpendingTx(op *btcwire.OutPoint) (*btcdb.SpendingTx, error) {
+	var spender *btcdb.SpendingTx
+	err := db.view(func(tx *sqlTx) error {
+		var hash []byte
+		var height, inIdx int64
+		err := tx.queryRow("SELECT s.hash, s.block_height, i.input_index "+
+			"FROM outputs o JOIN transactions s ON s.id = o.spent_by "+
+			"JOIN inputs i ON i.tx_id = s.id AND i.prev_hash = ? AND "+
+			"i.prev_index = ? WHERE o.tx_id = (SELECT MAX(id) FROM "+
+			"transactions WHERE hash = ?) AND o.output_index = ?",
+			op.Hash.Bytes(), int64(op.Index), op.Hash.Bytes(),
+			int64(op.Index)).Scan(&hash, &height, &inIdx)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var sha btcwire.ShaHash
+		if err := sha.SetBytes(hash); err != nil {
+			return btcdb.ErrCorruption
+		}
+		spender = &btcdb.SpendingTx{Sha: &sha, Height: height,
+			InputIndex: uint32(inIdx)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spender, nil
+}
+
+// IsOutpointSpent returns whether the output referenced by the given outpoint
+// was spent by a transaction of the main chain.  This is part of the btcdb.Db
+// interface implementation.
+func (db *SqlDb) IsOutpointSpent(op *btcwire.OutPoint) (bool, error) {
+	spent := false
+	err := db.view(func(tx *sqlTx) error {
+		var outIdx, spentBy sql.NullInt64
+		err := tx.queryRow("SELECT o.output_index, o.spent_by FROM "+
+			"transactions t LEFT JOIN outputs o ON o.tx_id = t.id "+
+			"AND o.output_index = ? WHERE t.id = (SELECT MAX(id) "+
+			"FROM transactions WHERE hash = ?)", int64(op.Index),
+			op.Hash.Bytes()).Scan(&outIdx, &spentBy)
+		if err == sql.ErrNoRows {
+			return btcdb.ErrTxNotFound
+		}
+		if err != nil {
+			return err
+		}
+		spent = !outIdx.Valid || spentBy.Valid
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return spent, nil
+}
+
+// UtxoSetSize returns the total number of unspent transaction outputs in the
+// database.  This is part of the btcdb.Db interface implementation.
+func (db *SqlDb) UtxoSetSize() (int64, error) {
+	var size int64
+	err := db.view(func(tx *sqlTx) error {
+		return tx.queryRow("SELECT COUNT(*) FROM outputs WHERE " +
+			"spent_by IS NULL").Scan(&size)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// InsertBlock inserts raw block and transaction data from a block into the
+// database.  The first block inserted into the database will be treated as the
+// genesis block.  Every subsequent block insert requires the referenced parent
+// block to already exist.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) InsertBlock(block *btcutil.Block) (int64, error) {
+	heights, err := db.InsertBlocksWithMeta([]*btcutil.Block{block}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return heights[0], nil
+}
+
+// InsertBlocks inserts a run of blocks in order within a single transaction
+// and returns the height of each.  Every block must connect to the one before
+// it and the first to a block already in the database.  When any of the blocks
+// fails to insert, none of them are.  This is part of the btcdb.Db interface
+// implementation.
+func (db *SqlDb) InsertBlocks(blocks []*btcutil.Block) ([]int64, error) {
+	return db.InsertBlocksWithMeta(blocks, nil)
+}
+
+// insertBlock stores the header and transactions of the passed block once it
+// passes the checks selected by the validation mode of the database and returns
+// the height it was inserted at.
+func (t *sqlTx) insertBlock(block *btcutil.Block) (int64, error) {
+	blockHash, err := block.Sha()
+	if err != nil {
+		return 0, err
+	}
+	rawMsg, err := block.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	txLocs, err := block.TxLoc()
+	if err != nil {
+		return 0, err
+	}
+	msgBlock := block.MsgBlock()
+	var header bytes.Buffer
+	if err := msgBlock.Header.Serialize(&header); err != nil {
+		return 0, err
+	}
+
+	_, exists, err := t.blockHeight(blockHash)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, btcdb.DuplicateSha
+	}
+
+	// Reject the insert if the previously reference block does not exist
+	// except in the case there are no blocks inserted yet where the first
+	// inserted block is assumed to be a genesis block.
+	tipSha, lastHeight, err := t.newestBlock()
+	if err != nil {
+		return 0, err
+	}
+	if lastHeight == -1 {
+		tipSha = nil
+	}
+	if err := btcdb.CheckBlock(block, t.db.validation, tipSha); err != nil {
+		return 0, err
+	}
+	_, exists, err = t.blockHeight(&msgBlock.Header.PrevBlock)
+	if err != nil {
+		return 0, err
+	}
+	if !exists && lastHeight != -1 {
+		return 0, btcdb.PrevShaMissing
+	}
+	newHeight := lastHeight + 1
+
+	bh := &msgBlock.Header
+	_, err = t.exec("INSERT INTO blocks (height, hash, version, "+
+		"prev_hash, merkle_root, block_time, bits, nonce, header) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", newHeight,
+		blockHash.Bytes(), int64(bh.Version), bh.PrevBlock.Bytes(),
+		bh.MerkleRoot.Bytes(), bh.Timestamp.Unix(), int64(bh.Bits),
+		int64(bh.Nonce), header.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	// Build a map of in-flight transactions because some of the inputs in
+	// this block could be referencing other transactions earlier in this
+	// block.
+	txInFlight := map[btcwire.ShaHash]int{}
+	transactions := block.Transactions()
+	for i, tx := range transactions {
+		txInFlight[*tx.Sha()] = i
+	}
+
+	for i, tx := range transactions {
+		loc := txLocs[i]
+		rawTx := rawMsg[loc.TxStart : loc.TxStart+loc.TxLen]
+		err := t.insertTx(tx, i, newHeight, rawTx, txInFlight)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if t.db.filterIndex {
+		if err := t.insertFilter(newHeight, block); err != nil {
+			return 0, err
+		}
+	}
+	if t.db.chainWork {
+		err := t.insertChainWork(newHeight, block.MsgBlock().Header.Bits)
+		if err != nil {
+			return 0, err
+		}
+	}
+	t.events = append(t.events,
+		btcdb.BlockConnected{Sha: *blockHash, Height: newHeight})
+	return newHeight, nil
+}
+
+// insertTx stores the passed transaction, which is at index txIdx of the block
+// at the given height, along with its inputs and outputs and spends all of the
+// outputs referenced by its inputs.
+func (t *sqlTx) insertTx(tx *btcutil.Tx, txIdx int, height int64, rawTx []byte,
+	txInFlight map[btcwire.ShaHash]int) error {
+
+	// The two duplicate coinbase transactions which were accepted before
+	// BIP0030 overwrite the earlier instances of their hash.  See
+	// btcdb.IsBIP30Exception for details.
+	allowDup := btcdb.IsBIP30Exception(height, tx.Sha())
+
+	// Prevent duplicate transactions in the same block.
+	if inFlightIndex := txInFlight[*tx.Sha()]; inFlightIndex != txIdx {
+		log.Warnf("Block contains duplicate transaction %s", tx.Sha())
+		return btcdb.DuplicateSha
+	}
+
+	// Prevent duplicate transactions unless the old one is fully spent.
+	prevID, prevExists, err := t.latestTxID(tx.Sha())
+	if err != nil {
+		return err
+	}
+	if prevExists && !allowDup {
+		count, err := t.unspentCount(prevID)
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			log.Warnf("Attempt to insert duplicate transaction %s",
+				tx.Sha())
+			return btcdb.DuplicateSha
+		}
+	}
+
+	var txID int64
+	err = t.queryRow("INSERT INTO transactions (hash, block_height, "+
+		"tx_index, raw) VALUES (?, ?, ?, ?) RETURNING id",
+		tx.Sha().Bytes(), height, int64(txIdx), rawTx).Scan(&txID)
+	if err != nil {
+		return err
+	}
+
+	// Any outputs of an older instance of the transaction which are still
+	// unspent are no longer reachable, so mark them as spent by the new
+	// instance.  Dropping the new instance makes them available again.
+	if prevExists {
+		_, err := t.exec("UPDATE outputs SET spent_by = ? WHERE "+
+			"tx_id = ? AND spent_by IS NULL", txID, prevID)
+		if err != nil {
+			return err
+		}
+	}
+
+	msgTx := tx.MsgTx()
+	columns := []string{"tx_id", "output_index", "value", "pk_script"}
+	if t.db.addressColumn {
+		columns = append(columns, "address")
+	}
+	outputs := make([][]interface{}, len(msgTx.TxOut))
+	for i, txOut := range msgTx.TxOut {
+		outputs[i] = []interface{}{txID, int64(i), txOut.Value,
+			txOut.PkScript}
+		if t.db.addressColumn {
+			// Outputs without an address hold NULL rather than
+			// an empty blob.
+			var addr interface{}
+			if a := btcdb.ScriptAddress(txOut.PkScript); a != nil {
+				addr = a
+			}
+			outputs[i] = append(outputs[i], addr)
+		}
+	}
+	err = t.insertRows("outputs", columns, outputs)
+	if err != nil {
+		return err
+	}
+
+	inputs := make([][]interface{}, len(msgTx.TxIn))
+	for i, txIn := range msgTx.TxIn {
+		prevOut := &txIn.PreviousOutpoint
+		inputs[i] = []interface{}{txID, int64(i), prevOut.Hash.Bytes(),
+			int64(prevOut.Index), txIn.SignatureScript,
+			int64(txIn.Sequence)}
+	}
+	err = t.insertRows("inputs", []string{"tx_id", "input_index",
+		"prev_hash", "prev_index", "sig_script", "sequence"}, inputs)
+	if err != nil {
+		return err
+	}
+
+	for _, txIn := range msgTx.TxIn {
+		prevOut := &txIn.PreviousOutpoint
+		if isCoinbaseInput(txIn) {
+			continue
+		}
+
+		// It is acceptable for a transaction input to reference the
+		// output of another transaction in this block only if the
+		// referenced transaction comes before the current one.
+		if inFlightIndex, ok := txInFlight[prevOut.Hash]; ok &&
+			txIdx <= inFlightIndex {
+
+			log.Warnf("InsertBlock: requested hash of %s does not "+
+				"exist in-flight", tx.Sha())
+			return btcdb.TxShaMissing
+		}
+
+		originID, exists, err := t.latestTxID(&prevOut.Hash)
+		if err != nil {
+			return err
+		}
+		var spentBy sql.NullInt64
+		if exists {
+			err = t.queryRow("SELECT spent_by FROM outputs WHERE "+
+				"tx_id = ? AND output_index = ?", originID,
+				int64(prevOut.Index)).Scan(&spentBy)
+			if err == sql.ErrNoRows {
+				exists = false
+			} else if err != nil {
+				return err
+			}
+		}
+		if !exists {
+			log.Warnf("InsertBlock: requested output %s:%d by %s "+
+				"does not exist", prevOut.Hash, prevOut.Index,
+				tx.Sha())
+			return btcdb.TxShaMissing
+		}
+		if spentBy.Valid {
+			continue
+		}
+		_, err = t.exec("UPDATE outputs SET spent_by = ? WHERE tx_id "+
+			"= ? AND output_index = ?", txID, originID,
+			int64(prevOut.Index))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewestSha returns the hash and block height of the most recent (end) block of
+// the block chain.  It will return the zero hash, -1 for the block height, and
+// no error (nil) if there are not any blocks in the database yet.  This is part
+// of the btcdb.Db interface implementation.
+func (db *SqlDb) NewestSha() (*btcwire.ShaHash, int64, error) {
+	var sha *btcwire.ShaHash
+	var height int64
+	err := db.view(func(tx *sqlTx) error {
+		var err error
+		sha, height, err = tx.newestBlock()
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return sha, height, nil
+}
+
+// RollbackClose discards the recent database changes to the previously saved
+// data at last Sync and closes the database.  This is part of the btcdb.Db
+// interface implementation.
+//
+// Every change is committed before the function making it returns with this
+// implementation, so there is nothing to discard and this function behaves no
+// differently than Close.
+func (db *SqlDb) RollbackClose() {
+	db.Close()
+}
+
+// Sync syncs all data committed so far to disk.  This is part of the btcdb.Db
+// interface implementation.
+//
+// SQLite databases are synced by checkpointing the write-ahead log into the
+// database file, while PostgreSQL servers sync according to their own
+// configuration, so there is nothing to do for them.
+func (db *SqlDb) Sync() {
+	db.closeLock.RLock()
+	defer db.closeLock.RUnlock()
+
+	if db.closed || db.readOnly || db.snap != nil || db.d.checkpoint == "" {
+		return
+	}
+
+	var busy, logFrames, checkpointed int
+	err := db.sdb.QueryRow(db.d.checkpoint).Scan(&busy, &logFrames,
+		&checkpointed)
+	if err != nil {
+		log.Warnf("Sync: %v", err)
+		return
+	}
+	if busy != 0 {
+		log.Warnf("Sync: checkpointed %d of %d log frames while "+
+			"blocked by readers", checkpointed, logFrames)
+	}
+}
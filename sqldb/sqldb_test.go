@@ -0,0 +1,119 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb_test
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/conformal/btcdb"
+	_ "github.com/conformal/btcdb/sqldb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"os"
+	"testing"
+)
+
+// TestSqliteTables ensures the block chain stored by the sqlite driver is
+// available through plain SQL queries against the normalized tables and that
+// the database can be reopened.
+func TestSqliteTables(t *testing.T) {
+	dbname := "tstdbtables.sqlite"
+	_ = os.Remove(dbname)
+	if _, err := btcdb.OpenDB("sqlite", dbname); err != btcdb.DbDoesNotExist {
+		t.Errorf("OpenDB: unexpected error for missing database %v", err)
+	}
+
+	db, err := btcdb.CreateDB("sqlite", dbname)
+	if err != nil {
+		t.Errorf("Failed to create test database %v", err)
+		return
+	}
+	defer os.Remove(dbname)
+
+	genesis := btcutil.NewBlock(&btcwire.GenesisBlock)
+	if _, err := db.InsertBlock(genesis); err != nil {
+		t.Errorf("InsertBlock: %v", err)
+	}
+	db.Close()
+
+	sdb, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Errorf("sql.Open: %v", err)
+		return
+	}
+	defer sdb.Close()
+	var value int64
+	err = sdb.QueryRow("SELECT o.value FROM outputs o JOIN transactions " +
+		"t ON t.id = o.tx_id WHERE t.block_height = 0").Scan(&value)
+	if err != nil {
+		t.Errorf("QueryRow: %v", err)
+		return
+	}
+	if want := btcwire.GenesisBlock.Transactions[0].TxOut[0].Value; value != want {
+		t.Errorf("genesis output value got: %d, want: %d", value, want)
+	}
+
+	// Outputs are found by the address they pay.
+	genesisScript := btcwire.GenesisBlock.Transactions[0].TxOut[0].PkScript
+	var count int64
+	err = sdb.QueryRow("SELECT COUNT(*) FROM outputs WHERE address = ?",
+		btcdb.ScriptAddress(genesisScript)).Scan(&count)
+	if err != nil || count != 1 {
+		t.Errorf("outputs by address: got %d (err %v), want 1", count, err)
+	}
+
+	db, err = btcdb.OpenDB("sqlite", dbname)
+	if err != nil {
+		t.Errorf("Failed to open test database %v", err)
+		return
+	}
+	defer db.Close()
+
+	blk, err := db.FetchBlockBySha(&btcwire.GenesisHash)
+	if err != nil {
+		t.Errorf("FetchBlockBySha: %v", err)
+		return
+	}
+	got, _ := blk.Bytes()
+	want, _ := genesis.Bytes()
+	if string(got) != string(want) {
+		t.Errorf("FetchBlockBySha: reassembled genesis block differs")
+	}
+
+	// The address of an output is removed along with its block.
+	hash := bytes.Repeat([]byte{0x01}, 20)
+	pkhScript := append(append([]byte{0x76, 0xa9, 0x14}, hash...), 0x88, 0xac)
+	coinbase := btcwire.NewMsgTx()
+	prevOut := btcwire.NewOutPoint(&btcwire.ShaHash{}, math.MaxUint32)
+	coinbase.AddTxIn(btcwire.NewTxIn(prevOut, []byte{0x51}))
+	coinbase.AddTxOut(btcwire.NewTxOut(50*1e8, pkhScript))
+	hdr := btcwire.NewBlockHeader(&btcwire.GenesisHash, &btcwire.ShaHash{},
+		btcwire.GenesisBlock.Header.Bits, 0)
+	msgBlock := btcwire.NewMsgBlock(hdr)
+	msgBlock.AddTransaction(coinbase)
+	if _, err := db.InsertBlock(btcutil.NewBlock(msgBlock)); err != nil {
+		t.Errorf("InsertBlock: %v", err)
+		return
+	}
+	countAddr := func() int64 {
+		var count int64
+		err := sdb.QueryRow("SELECT COUNT(*) FROM outputs WHERE "+
+			"address = ?", hash).Scan(&count)
+		if err != nil {
+			t.Errorf("outputs by address: %v", err)
+		}
+		return count
+	}
+	if count := countAddr(); count != 1 {
+		t.Errorf("outputs by address: got %d, want 1", count)
+	}
+	if err := db.DropAfterBlockBySha(&btcwire.GenesisHash); err != nil {
+		t.Errorf("DropAfterBlockBySha: %v", err)
+	}
+	if count := countAddr(); count != 0 {
+		t.Errorf("outputs by address after drop: got %d, want 0", count)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/conformal/btcdb"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+)
+
+// sqliteDialect describes the SQLite flavor of SQL.
+var sqliteDialect = dialect{
+	name:       "sqlite",
+	blobType:   "BLOB",
+	intType:    "INTEGER",
+	serialPK:   "INTEGER PRIMARY KEY",
+	checkpoint: "PRAGMA wal_checkpoint(FULL)",
+	backup:     "VACUUM INTO ?",
+}
+
+func init() {
+	driver := btcdb.DriverDB{DbType: "sqlite", CreateDB: CreateSqliteDB,
+		OpenDB: OpenSqliteDB}
+	btcdb.AddDBDriver(driver)
+}
+
+// parseSqliteArgs parses the arguments from the btcdb Open/Create methods.  The
+// database is described by either its path or a btcdb.Options.
+func parseSqliteArgs(funcName string, args ...interface{}) (*btcdb.Options, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("Invalid arguments to sqldb.%s -- "+
+			"expected database path string or options", funcName)
+	}
+	switch arg := args[0].(type) {
+	case string:
+		return &btcdb.Options{Path: arg}, nil
+	case btcdb.Options:
+		return &arg, nil
+	}
+	return nil, fmt.Errorf("First argument to sqldb.%s is invalid -- "+
+		"expected database path string or options", funcName)
+}
+
+// openSqlite opens the SQLite database at the path of the passed options.
+func openSqlite(dbOpts *btcdb.Options, create bool) (btcdb.Db, error) {
+	// SQLite only allows a single writer at a time, so have connections
+	// wait for each other rather than failing with busy errors.  The write
+	// ahead log lets readers, including snapshots, keep reading while a
+	// block is inserted.
+	// Commits are not synced under the SyncNever and SyncPeriodic policies,
+	// but the write-ahead log still is when it is checkpointed, which Sync
+	// forces.
+	dsn := dbOpts.Path + "?_busy_timeout=10000&_journal_mode=WAL"
+	switch dbOpts.Sync {
+	case btcdb.SyncAlways:
+		dsn += "&_sync=FULL"
+	case btcdb.SyncNever, btcdb.SyncPeriodic:
+		dsn += "&_sync=NORMAL"
+	}
+	if dbOpts.CacheSize > 0 {
+		// A negative cache size is the size in KiB rather than pages.
+		dsn += fmt.Sprintf("&_cache_size=%d", -dbOpts.CacheSize/1024)
+	}
+
+	// Other processes are kept from opening the database at the same
+	// time even though SQLite allows it, since the block cache and the
+	// indexers of each would miss the changes made by the others.
+	lock, err := btcdb.LockDb(dbOpts.Path, dbOpts.ForceOpen)
+	if err != nil {
+		return nil, err
+	}
+	sdb, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	db, err := newSqlDb(sdb, &sqliteDialect, create, dbOpts)
+	if err != nil {
+		sdb.Close()
+		lock.Unlock()
+		return nil, err
+	}
+	db.lock = lock
+	if dbOpts.Sync == btcdb.SyncPeriodic && !dbOpts.ReadOnly {
+		db.syncer.Start(dbOpts.SyncInterval, db.Sync)
+	}
+	return db, nil
+}
+
+// OpenSqliteDB opens an existing SQLite database for use.
+func OpenSqliteDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, err := parseSqliteArgs("OpenSqliteDB", args...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbOpts.Path); err != nil {
+		return nil, btcdb.DbDoesNotExist
+	}
+	return openSqlite(dbOpts, false)
+}
+
+// CreateSqliteDB creates, initializes, and opens a SQLite database for use.
+func CreateSqliteDB(args ...interface{}) (btcdb.Db, error) {
+	dbOpts, err := parseSqliteArgs("CreateSqliteDB", args...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbOpts.Path); err == nil {
+		return nil, fmt.Errorf("database %v already exists",
+			dbOpts.Path)
+	}
+	return openSqlite(dbOpts, true)
+}
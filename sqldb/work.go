@@ -0,0 +1,96 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"database/sql"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// insertChainWork stores the cumulative chain work through the block at the
+// given height, which has the passed compact target difficulty.  The work
+// through the block before it must already be stored.
+func (t *sqlTx) insertChainWork(height int64, bits uint32) error {
+	work := btcdb.CalcWork(bits)
+	if height > 0 {
+		var buf []byte
+		err := t.queryRow("SELECT work FROM chain_work WHERE height = ?",
+			height-1).Scan(&buf)
+		if err != nil {
+			return err
+		}
+		work.Add(work, new(big.Int).SetBytes(buf))
+	}
+
+	_, err := t.exec("INSERT INTO chain_work (height, work) VALUES (?, ?)",
+		height, work.Bytes())
+	return err
+}
+
+// sumChainWork computes the cumulative chain work through the block at the
+// given height from the difficulty of it and every block before it.  It is
+// used for databases created before the chain_work table existed.
+func (t *sqlTx) sumChainWork(height int64) (*big.Int, error) {
+	rows, err := t.query("SELECT bits FROM blocks WHERE height <= ?",
+		height)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	work := new(big.Int)
+	for rows.Next() {
+		var bits int64
+		if err := rows.Scan(&bits); err != nil {
+			return nil, err
+		}
+		work.Add(work, btcdb.CalcWork(uint32(bits)))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return work, nil
+}
+
+// FetchChainWorkBySha returns the cumulative work of the main chain through the
+// block with the given hash.  This is part of the btcdb.Db interface
+// implementation.
+//
+// Databases created before the work was stored compute it from the difficulty
+// of every block up to the requested one.
+func (db *SqlDb) FetchChainWorkBySha(sha *btcwire.ShaHash) (*big.Int, error) {
+	var work *big.Int
+	err := db.view(func(tx *sqlTx) error {
+		height, exists, err := tx.blockHeight(sha)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return btcdb.ErrBlockNotFound
+		}
+
+		if !tx.db.chainWork {
+			work, err = tx.sumChainWork(height)
+			return err
+		}
+		var buf []byte
+		err = tx.queryRow("SELECT work FROM chain_work WHERE height = ?",
+			height).Scan(&buf)
+		if err == sql.ErrNoRows {
+			return btcdb.ErrCorruption
+		}
+		if err != nil {
+			return err
+		}
+		work = new(big.Int).SetBytes(buf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return work, nil
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// StatsIndexPrefix is the prefix of the keys of the metadata namespace under
+// which a StatsIndex keeps its state.
+var StatsIndexPrefix = []byte("btcdb/stats/")
+
+var (
+	// statsIndexTipKey is the key of the hash and height of the newest
+	// block indexed by the stats index.
+	statsIndexTipKey = []byte("btcdb/stats/tip")
+
+	// statsHeightPrefix is the prefix of the keys of the stats records of
+	// each block, which are followed by the height of the block as a big
+	// endian number.
+	statsHeightPrefix = []byte("btcdb/stats/height/")
+
+	// statsVersionKey is the key of the version of the records of the
+	// stats index.  It is kept outside of StatsIndexPrefix so it survives
+	// the index being rebuilt.
+	statsVersionKey = []byte("btcdb/version/stats")
+)
+
+// statsVersion is the version of the records of the stats index.  Records from
+// before the index recorded a version left the fees of blocks spending outputs
+// of earlier blocks unknown, so they are rebuilt.
+const statsVersion = 1
+
+// statsRecordLen is the length of the stats record of a block: its hash, size,
+// number of transactions, total output value and fees followed by whether the
+// fees are known.
+const statsRecordLen = btcwire.HashSize + 4 + 4 + 8 + 8 + 1
+
+// statsHeightKey returns the key of the stats record of the block at the
+// passed height.
+func statsHeightKey(height int64) []byte {
+	key := make([]byte, len(statsHeightPrefix)+8)
+	copy(key, statsHeightPrefix)
+	binary.BigEndian.PutUint64(key[len(statsHeightPrefix):], uint64(height))
+	return key
+}
+
+// BlockStats holds the statistics of a block recorded by a StatsIndex.
+// TotalOut is the value of the outputs of every transaction of the block but
+// its coinbase, so it does not include the subsidy and fees the coinbase
+// claims.  Fees is the value of the outputs spent by those transactions less
+// TotalOut, and is only set when FeesKnown is true, since it needs every
+// spent output to be stored.
+type BlockStats struct {
+	Height    int64
+	Sha       btcwire.ShaHash
+	Size      int
+	TxCount   int
+	TotalOut  int64
+	Fees      int64
+	FeesKnown bool
+}
+
+// serializeBlockStats returns the stored form of the passed stats.  The height
+// is the key of the record rather than part of it.
+func serializeBlockStats(s *BlockStats) []byte {
+	buf := make([]byte, statsRecordLen)
+	off := copy(buf, s.Sha.Bytes())
+	binary.LittleEndian.PutUint32(buf[off:], uint32(s.Size))
+	off += 4
+	binary.LittleEndian.PutUint32(buf[off:], uint32(s.TxCount))
+	off += 4
+	binary.LittleEndian.PutUint64(buf[off:], uint64(s.TotalOut))
+	off += 8
+	binary.LittleEndian.PutUint64(buf[off:], uint64(s.Fees))
+	off += 8
+	if s.FeesKnown {
+		buf[off] = 1
+	}
+	return buf
+}
+
+// deserializeBlockStats returns the stats of the block at the passed height
+// stored in the passed value.
+func deserializeBlockStats(height int64, val []byte) (*BlockStats, error) {
+	if len(val) != statsRecordLen {
+		return nil, fmt.Errorf("malformed stats record %x", val)
+	}
+	s := &BlockStats{Height: height}
+	off := copy(s.Sha[:], val)
+	s.Size = int(binary.LittleEndian.Uint32(val[off:]))
+	off += 4
+	s.TxCount = int(binary.LittleEndian.Uint32(val[off:]))
+	off += 4
+	s.TotalOut = int64(binary.LittleEndian.Uint64(val[off:]))
+	off += 8
+	s.Fees = int64(binary.LittleEndian.Uint64(val[off:]))
+	off += 8
+	s.FeesKnown = val[off] != 0
+	return s, nil
+}
+
+// StatsIndex is an optional indexer which records the size, number of
+// transactions, total output value and fees of every block of the chain, so
+// analytics over ranges of blocks are answered by FetchBlockStats without
+// reading the blocks.  The fees are computed from the outputs the database
+// passes along with each block, and are left unknown when it does not know
+// them.
+type StatsIndex struct {
+	mtx sync.Mutex
+	db  Db
+}
+
+// Ensure StatsIndex implements the Indexer interface.
+var _ Indexer = (*StatsIndex)(nil)
+
+// NewStatsIndex returns a stats index which starts indexing once it is added to
+// a database with AddIndexer.
+func NewStatsIndex() *StatsIndex {
+	return new(StatsIndex)
+}
+
+// Init prepares the index for the passed database.  The index is rebuilt from
+// the genesis block when its tip is no longer in the chain or its records were
+// written by another version of the index.  This is part of the Indexer
+// interface implementation.
+func (idx *StatsIndex) Init(db Db) error {
+	_, err := initVersionedIndexerState(db, "Stats index",
+		StatsIndexPrefix, statsIndexTipKey, statsVersionKey,
+		statsVersion)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *StatsIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, statsIndexTipKey)
+}
+
+// ConnectBlock adds the stats record of the passed block.  This is part of the
+// Indexer interface implementation.
+func (idx *StatsIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	raw, err := block.Bytes()
+	if err != nil {
+		return err
+	}
+
+	s := &BlockStats{
+		Height:   height,
+		Sha:      *sha,
+		Size:     len(raw),
+		TxCount:  len(block.MsgBlock().Transactions),
+		TotalOut: totalOut(block),
+	}
+	if spentKnown(block, spent) {
+		var in int64
+		for _, entry := range spent {
+			in += entry.Value
+		}
+		s.Fees, s.FeesKnown = in-s.TotalOut, true
+	}
+
+	meta.Put(statsHeightKey(height), serializeBlockStats(s))
+	putTipRecord(meta, statsIndexTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the stats record of the passed block.  This is part
+// of the Indexer interface implementation.
+func (idx *StatsIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	meta.Delete(statsHeightKey(height))
+	putTipRecord(meta, statsIndexTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// totalOut returns the value of the outputs of every transaction of the passed
+// block but its coinbase.
+func totalOut(block *btcutil.Block) int64 {
+	var total int64
+	for _, tx := range block.MsgBlock().Transactions[1:] {
+		for _, txOut := range tx.TxOut {
+			total += txOut.Value
+		}
+	}
+	return total
+}
+
+// FetchBlockStats returns the stats recorded by the StatsIndex of the passed
+// database for the blocks of a range of heights.  Like FetchHeightRange, the
+// range is inclusive of the start height and exclusive of the ending height
+// and `AllShas' may be used as the ending height to return the stats of every
+// indexed block from the start height on.  ErrNoStatsIndex is returned when
+// the database has no stats index.
+func FetchBlockStats(db Db, startHeight, endHeight int64) ([]*BlockStats, error) {
+	tipSha, tipHeight, err := fetchTipRecord(db, statsIndexTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoStatsIndex
+	}
+	if startHeight < 0 {
+		startHeight = 0
+	}
+	if endHeight > tipHeight+1 {
+		endHeight = tipHeight + 1
+	}
+
+	var stats []*BlockStats
+	for height := startHeight; height < endHeight; height++ {
+		val, err := db.GetMeta(statsHeightKey(height))
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, fmt.Errorf("stats record for height %d is "+
+				"missing", height)
+		}
+		s, err := deserializeBlockStats(height, val)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
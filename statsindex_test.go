@@ -0,0 +1,127 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// TestBlockStats ensures the stats index records the statistics of every block
+// for every supported database type, including the fees of blocks spending
+// outputs of earlier blocks, as blocks are inserted and dropped.
+func TestBlockStats(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// Work out the stats of each block from the blocks themselves.
+	txs := make(map[btcwire.ShaHash]*btcwire.MsgTx)
+	want := make([]btcdb.BlockStats, len(blocks))
+	var spending int
+	for height, blk := range blocks {
+		for _, tx := range blk.Transactions() {
+			txs[*tx.Sha()] = tx.MsgTx()
+		}
+		sha, _ := blk.Sha()
+		raw, _ := blk.Bytes()
+		s := btcdb.BlockStats{
+			Height:    int64(height),
+			Sha:       *sha,
+			Size:      len(raw),
+			TxCount:   len(blk.MsgBlock().Transactions),
+			FeesKnown: true,
+		}
+		for _, tx := range blk.MsgBlock().Transactions[1:] {
+			spending++
+			for _, txIn := range tx.TxIn {
+				op := txIn.PreviousOutpoint
+				s.Fees += txs[op.Hash].TxOut[op.Index].Value
+			}
+			for _, txOut := range tx.TxOut {
+				s.TotalOut += txOut.Value
+				s.Fees -= txOut.Value
+			}
+		}
+		want[height] = s
+	}
+	if spending == 0 {
+		t.Errorf("test blocks have no transactions spending outputs")
+		return
+	}
+
+	// checkStats ensures the stats of the passed range of heights are
+	// the expected ones.
+	checkStats := func(dbType, desc string, db btcdb.Db, start, end int64, wantLen int) {
+		stats, err := btcdb.FetchBlockStats(db, start, end)
+		if err != nil || len(stats) != wantLen {
+			t.Errorf("FetchBlockStats (%s) %s: got %d stats (err %v), "+
+				"want %d", dbType, desc, len(stats), err, wantLen)
+			return
+		}
+		for i, s := range stats {
+			if !reflect.DeepEqual(*s, want[start+int64(i)]) {
+				t.Errorf("FetchBlockStats (%s) %s: got %+v, want "+
+					"%+v", dbType, desc, *s, want[start+int64(i)])
+				return
+			}
+		}
+	}
+
+	half := int64(len(blocks) / 2)
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "blockstats", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.FetchBlockStats(db, 0, btcdb.AllShas); err != btcdb.ErrNoStatsIndex {
+			t.Errorf("FetchBlockStats (%s): got %v without an index, "+
+				"want %v", dbType, err, btcdb.ErrNoStatsIndex)
+		}
+
+		// The index is caught up with the blocks already stored and
+		// kept up to date by those inserted and dropped later.
+		if err := db.AddIndexer(btcdb.NewStatsIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkStats(dbType, "after catching up", db, 0, btcdb.AllShas,
+			int(half))
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkStats(dbType, "after inserting blocks", db, 0,
+			btcdb.AllShas, len(blocks))
+		checkStats(dbType, "for a range", db, 100, 200, 100)
+
+		keepSha, _ := blocks[half-1].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkStats(dbType, "after dropping blocks", db, half-10,
+			btcdb.AllShas, 10)
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkStats(dbType, "after reinserting blocks", db, half,
+			btcdb.AllShas, len(blocks)-int(half))
+		teardown()
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+const (
+	// baseSubsidy is the subsidy of the first blocks of every network in
+	// satoshi.
+	baseSubsidy = 50 * 1e8
+
+	// subsidyHalvingInterval is the number of blocks after which the
+	// subsidy of the main and test networks halves.
+	subsidyHalvingInterval = 210000
+
+	// regressionHalvingInterval is the number of blocks after which the
+	// subsidy of the regression test network halves.
+	regressionHalvingInterval = 150
+)
+
+// SupplyPrefix is the prefix of the keys of the metadata namespace under which
+// a SupplyIndex keeps the tally of the supply of the chain.
+var SupplyPrefix = []byte("btcdb/supply/")
+
+var (
+	// supplyTipKey is the key of the hash and height of the newest block
+	// tallied by the supply index.
+	supplyTipKey = []byte("btcdb/supply/tip")
+
+	// supplyHeightPrefix is the prefix of the keys of the tally of each
+	// block, which are followed by the height of the block as a big
+	// endian number.
+	supplyHeightPrefix = []byte("btcdb/supply/height/")
+
+	// supplyVersionKey is the key of the version of the records of the
+	// supply index.  It is kept outside of SupplyPrefix so it survives the
+	// index being rebuilt.
+	supplyVersionKey = []byte("btcdb/version/supply")
+)
+
+// supplyVersion is the version of the records of the supply index.  Tallies
+// from before it was an indexer were written by FetchSupplyAtHeight as it was
+// called, and are rebuilt.
+const supplyVersion = 1
+
+// supplyRecordLen is the length of the tally of a block: its hash followed by
+// the cumulative subsidy, fees and value claimed by coinbases.
+const supplyRecordLen = btcwire.HashSize + 8 + 8 + 8
+
+// supplyHeightKey returns the key of the tally of the block at the passed
+// height.
+func supplyHeightKey(height int64) []byte {
+	key := make([]byte, len(supplyHeightPrefix)+8)
+	copy(key, supplyHeightPrefix)
+	binary.BigEndian.PutUint64(key[len(supplyHeightPrefix):], uint64(height))
+	return key
+}
+
+// CalcBlockSubsidy returns the subsidy in satoshi the block at the passed height
+// may claim on a network whose subsidy halves every given number of blocks.
+func CalcBlockSubsidy(height, halvingInterval int64) int64 {
+	halvings := uint(height / halvingInterval)
+	if halvings >= 64 {
+		return 0
+	}
+	return baseSubsidy >> halvings
+}
+
+// Supply is the tally of the coins created by the chain up to and including a
+// block.  Subsidy is the total subsidy the blocks may claim, Fees the total
+// fees paid by their transactions and Claimed the total value of the outputs
+// of their coinbases.  Unclaimed is the subsidy and fees the coinbases did not
+// claim, which no one may spend, and Total the coins in existence, which is
+// Subsidy less Unclaimed.  The coinbase of the genesis block is counted even
+// though it may not be spent.
+type Supply struct {
+	Height    int64
+	Sha       btcwire.ShaHash
+	Subsidy   int64
+	Fees      int64
+	Claimed   int64
+	Unclaimed int64
+	Total     int64
+}
+
+// serializeSupply returns the stored form of the passed tally.
+func serializeSupply(s *Supply) []byte {
+	buf := make([]byte, supplyRecordLen)
+	off := copy(buf, s.Sha.Bytes())
+	binary.LittleEndian.PutUint64(buf[off:], uint64(s.Subsidy))
+	binary.LittleEndian.PutUint64(buf[off+8:], uint64(s.Fees))
+	binary.LittleEndian.PutUint64(buf[off+16:], uint64(s.Claimed))
+	return buf
+}
+
+// deserializeSupply returns the tally of the block at the passed height stored
+// in the passed value.
+func deserializeSupply(height int64, val []byte) (*Supply, error) {
+	if len(val) != supplyRecordLen {
+		return nil, fmt.Errorf("malformed supply record %x", val)
+	}
+	s := &Supply{Height: height}
+	off := copy(s.Sha[:], val)
+	s.Subsidy = int64(binary.LittleEndian.Uint64(val[off:]))
+	s.Fees = int64(binary.LittleEndian.Uint64(val[off+8:]))
+	s.Claimed = int64(binary.LittleEndian.Uint64(val[off+16:]))
+	s.setTotals()
+	return s, nil
+}
+
+// setTotals sets the unclaimed and total coins of the tally from the rest.
+func (s *Supply) setTotals() {
+	s.Unclaimed = s.Subsidy + s.Fees - s.Claimed
+	s.Total = s.Subsidy - s.Unclaimed
+}
+
+// supplySums holds the cumulative subsidy, fees and claimed value of the
+// tally of a block, which is what the supply index keeps in memory for each
+// block.
+type supplySums struct {
+	subsidy int64
+	fees    int64
+	claimed int64
+}
+
+// blockSupply returns what the passed block at the passed height, which spent
+// the passed outputs, adds to the tally on a network whose subsidy halves
+// every given number of blocks.
+func blockSupply(block *btcutil.Block, height, halvingInterval int64, spent []*UtxoEntry) supplySums {
+	var sums supplySums
+	sums.subsidy = CalcBlockSubsidy(height, halvingInterval)
+	for _, entry := range spent {
+		sums.fees += entry.Value
+	}
+	sums.fees -= totalOut(block)
+	for _, txOut := range block.MsgBlock().Transactions[0].TxOut {
+		sums.claimed += txOut.Value
+	}
+	return sums
+}
+
+// SupplyIndex is an optional indexer which tallies the coins created by the
+// chain up to every block, so the supply curve of the chain is audited with
+// FetchSupplyAtHeight without reading the blocks.  The fees of each block are
+// computed from the outputs the database passes along with it, so the index
+// can not be kept for a database which does not know them, such as one which
+// only stores headers.
+//
+// The subsidy schedule of the regression test network is used when the chain
+// starts with its genesis block, and the one of the other networks otherwise.
+// The sums of the tally of every block are kept in memory to tally each block
+// inserted, which takes 24 bytes per block.
+type SupplyIndex struct {
+	mtx             sync.Mutex
+	db              Db
+	halvingInterval int64
+	sums            []supplySums
+}
+
+// Ensure SupplyIndex implements the Indexer interface.
+var _ Indexer = (*SupplyIndex)(nil)
+
+// NewSupplyIndex returns a supply index which starts tallying once it is added
+// to a database with AddIndexer.
+func NewSupplyIndex() *SupplyIndex {
+	return new(SupplyIndex)
+}
+
+// halvingIntervalOf returns the number of blocks after which the subsidy of
+// the chain starting with the block with the passed hash halves.
+func halvingIntervalOf(genesisSha *btcwire.ShaHash) int64 {
+	if net, ok := GenesisNetwork(genesisSha); ok && net == btcwire.TestNet {
+		return regressionHalvingInterval
+	}
+	return subsidyHalvingInterval
+}
+
+// Init loads the tally of the chain up to each block tallied before from the
+// passed database.  The index is rebuilt from the genesis block when its tip is
+// no longer in the chain or its records were written by another version of the
+// index.  This is part of the Indexer interface implementation.
+func (idx *SupplyIndex) Init(db Db) error {
+	tipHeight, err := initVersionedIndexerState(db, "Supply index",
+		SupplyPrefix, supplyTipKey, supplyVersionKey, supplyVersion)
+	if err != nil {
+		return err
+	}
+
+	halvingInterval := int64(subsidyHalvingInterval)
+	genesisSha, err := db.FetchBlockShaByHeight(0)
+	if err != nil && err != ErrBlockNotFound {
+		return err
+	}
+	if err == nil {
+		halvingInterval = halvingIntervalOf(genesisSha)
+	}
+
+	var sums []supplySums
+	iter, err := db.MetaIterator(supplyHeightPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for int64(len(sums)) <= tipHeight && iter.Next() {
+		height := int64(len(sums))
+		if !bytes.Equal(iter.Key(), supplyHeightKey(height)) {
+			return fmt.Errorf("supply of block at height %d is "+
+				"missing", height)
+		}
+		s, err := deserializeSupply(height, iter.Value())
+		if err != nil {
+			return err
+		}
+		sums = append(sums, supplySums{s.Subsidy, s.Fees, s.Claimed})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if int64(len(sums)) != tipHeight+1 {
+		return fmt.Errorf("supply ends at height %d before the tip at "+
+			"height %d", len(sums)-1, tipHeight)
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.halvingInterval = halvingInterval
+	idx.sums = sums
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block tallied as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *SupplyIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, supplyTipKey)
+}
+
+// ConnectBlock adds the tally of the chain up to the passed block.  This is
+// part of the Indexer interface implementation.
+func (idx *SupplyIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	if !spentKnown(block, spent) {
+		return fmt.Errorf("outputs spent by block %v at height %d are "+
+			"not known", sha, height)
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// Tallies left by blocks which were disconnected, or whose connection
+	// failed to commit, are replaced.
+	if int64(len(idx.sums)) > height {
+		idx.sums = idx.sums[:height]
+	}
+	if int64(len(idx.sums)) != height {
+		return fmt.Errorf("supply index is missing the blocks from "+
+			"height %d before block %v at height %d",
+			len(idx.sums), sha, height)
+	}
+	if height == 0 {
+		idx.halvingInterval = halvingIntervalOf(sha)
+	}
+
+	sums := blockSupply(block, height, idx.halvingInterval, spent)
+	if height > 0 {
+		prev := idx.sums[height-1]
+		sums.subsidy += prev.subsidy
+		sums.fees += prev.fees
+		sums.claimed += prev.claimed
+	}
+	idx.sums = append(idx.sums, sums)
+
+	s := &Supply{
+		Height:  height,
+		Sha:     *sha,
+		Subsidy: sums.subsidy,
+		Fees:    sums.fees,
+		Claimed: sums.claimed,
+	}
+	meta.Put(supplyHeightKey(height), serializeSupply(s))
+	putTipRecord(meta, supplyTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the tally of the chain up to the passed block.  This
+// is part of the Indexer interface implementation.
+func (idx *SupplyIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// The tally of a block whose connection failed to commit may have
+	// replaced the one of the block stored at its height.
+	if int64(len(idx.sums)) <= height {
+		return fmt.Errorf("supply index is out of step with the block "+
+			"at height %d", height)
+	}
+	var prev supplySums
+	if height > 0 {
+		prev = idx.sums[height-1]
+	}
+	var claimed int64
+	for _, txOut := range block.MsgBlock().Transactions[0].TxOut {
+		claimed += txOut.Value
+	}
+	if idx.sums[height].claimed-prev.claimed != claimed {
+		return fmt.Errorf("supply index is out of step with the block "+
+			"at height %d", height)
+	}
+
+	meta.Delete(supplyHeightKey(height))
+	putTipRecord(meta, supplyTipKey, &block.MsgBlock().Header.PrevBlock,
+		height-1)
+	return nil
+}
+
+// FetchSupplyAtHeight returns the tally of the coins created by the chain of
+// the passed database up to and including the block at the passed height, as
+// recorded by its SupplyIndex.  ErrBlockNotFound is returned when the index
+// does not hold the block and ErrNoSupplyIndex when the database has no
+// supply index.
+func FetchSupplyAtHeight(db Db, height int64) (*Supply, error) {
+	tipSha, tipHeight, err := fetchTipRecord(db, supplyTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoSupplyIndex
+	}
+	if height < 0 || height > tipHeight {
+		return nil, ErrBlockNotFound
+	}
+
+	val, err := db.GetMeta(supplyHeightKey(height))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, fmt.Errorf("supply for height %d is missing", height)
+	}
+	return deserializeSupply(height, val)
+}
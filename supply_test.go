@@ -0,0 +1,141 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// TestSupply ensures the supply index tallies the supply of the chain from its
+// coinbases and the fees of its transactions for every supported database
+// type, both as it is caught up with the chain and as blocks are inserted, and
+// once blocks which were tallied are replaced.
+func TestSupply(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	subsidyTests := []struct {
+		height, interval, want int64
+	}{
+		{0, 210000, 50 * 1e8},
+		{209999, 210000, 50 * 1e8},
+		{210000, 210000, 25 * 1e8},
+		{450, 150, 50 * 1e8 >> 3},
+		{64 * 210000, 210000, 0},
+	}
+	for _, test := range subsidyTests {
+		got := btcdb.CalcBlockSubsidy(test.height, test.interval)
+		if got != test.want {
+			t.Errorf("CalcBlockSubsidy(%d, %d): got %d, want %d",
+				test.height, test.interval, got, test.want)
+		}
+	}
+
+	// tally returns the expected supply of the passed chain, which starts
+	// with the genesis block.
+	tally := func(chain []*btcutil.Block) btcdb.Supply {
+		txs := make(map[btcwire.ShaHash]*btcwire.MsgTx)
+		var s btcdb.Supply
+		for height, blk := range chain {
+			for _, tx := range blk.Transactions() {
+				txs[*tx.Sha()] = tx.MsgTx()
+			}
+			sha, _ := blk.Sha()
+			s.Height, s.Sha = int64(height), *sha
+			s.Subsidy += 50 * 1e8
+			for i, tx := range blk.MsgBlock().Transactions {
+				for _, txOut := range tx.TxOut {
+					if i == 0 {
+						s.Claimed += txOut.Value
+					} else {
+						s.Fees -= txOut.Value
+					}
+				}
+				if i == 0 {
+					continue
+				}
+				for _, txIn := range tx.TxIn {
+					op := txIn.PreviousOutpoint
+					s.Fees += txs[op.Hash].TxOut[op.Index].Value
+				}
+			}
+		}
+		s.Unclaimed = s.Subsidy + s.Fees - s.Claimed
+		s.Total = s.Subsidy - s.Unclaimed
+		return s
+	}
+
+	// checkSupply ensures the supply at the height of the last of the
+	// passed blocks is the expected one.
+	checkSupply := func(dbType, desc string, db btcdb.Db, chain []*btcutil.Block) {
+		want := tally(chain)
+		s, err := btcdb.FetchSupplyAtHeight(db, want.Height)
+		if err != nil || !reflect.DeepEqual(*s, want) {
+			t.Errorf("FetchSupplyAtHeight (%s) %s: got %+v (err %v), "+
+				"want %+v", dbType, desc, s, err, want)
+		}
+	}
+
+	half := len(blocks) / 2
+	alt := altChain(blocks[half-11], 20)
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "supply", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.FetchSupplyAtHeight(db, 0); err != btcdb.ErrNoSupplyIndex {
+			t.Errorf("FetchSupplyAtHeight (%s): got %v without an "+
+				"index, want %v", dbType, err,
+				btcdb.ErrNoSupplyIndex)
+		}
+
+		// The index is caught up with the blocks already stored.
+		if err := db.AddIndexer(btcdb.NewSupplyIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkSupply(dbType, "of the first blocks", db, blocks[:half])
+		checkSupply(dbType, "below the tally", db, blocks[:10])
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkSupply(dbType, "of every block", db, blocks)
+		if _, err := btcdb.FetchSupplyAtHeight(db, int64(len(blocks))); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchSupplyAtHeight (%s): got %v past the "+
+				"chain, want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+
+		// Tallies of replaced blocks are replaced along with them.
+		keepSha, _ := blocks[half-11].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		if _, err := db.InsertBlocks(alt); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		chain := append(append([]*btcutil.Block(nil),
+			blocks[:half-10]...), alt...)
+		checkSupply(dbType, "after replacing blocks", db, chain)
+		teardown()
+	}
+}
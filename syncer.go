@@ -0,0 +1,66 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"sync"
+	"time"
+)
+
+// PeriodicSyncer calls the sync function of a database at a fixed interval to
+// implement the SyncPeriodic policy.  It is intended for drivers, which start
+// it when a database is opened for writing with that policy and stop it when
+// the database is closed.  The zero value is a stopped syncer.
+type PeriodicSyncer struct {
+	mtx  sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Start calls sync every interval, or every DefaultSyncInterval when the
+// interval is not positive, until Stop is called.
+func (s *PeriodicSyncer) Start(interval time.Duration, sync func()) {
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.quit != nil {
+		return
+	}
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	go func(quit, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sync()
+			case <-quit:
+				return
+			}
+		}
+	}(s.quit, s.done)
+}
+
+// Stop ends the periodic syncs and waits for one which is in progress to
+// finish.  It must not be called while holding a lock the sync function takes.
+// Stopping a syncer which is not running does nothing.
+func (s *PeriodicSyncer) Stop() {
+	s.mtx.Lock()
+	quit, done := s.quit, s.done
+	s.quit, s.done = nil, nil
+	s.mtx.Unlock()
+
+	if quit == nil {
+		return
+	}
+	close(quit)
+	<-done
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"fmt"
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSyncPolicies ensures every supported database type keeps the blocks
+// inserted under each sync policy across a close and reopen, including while
+// the periodic syncs of the SyncPeriodic policy are running.
+func TestSyncPolicies(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:10]
+
+	policies := []btcdb.SyncPolicy{btcdb.SyncDefault, btcdb.SyncAlways,
+		btcdb.SyncNever, btcdb.SyncPeriodic}
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		for _, policy := range policies {
+			opts := btcdb.Options{
+				Path: filepath.Join(testDbRoot, fmt.Sprintf(
+					"syncdb-%s-%d", dbType, policy)),
+				Sync:         policy,
+				SyncInterval: 5 * time.Millisecond,
+			}
+			if dbType == "postgres" {
+				opts.Path = postgresDSN
+				if err := dropPostgresTables(); err != nil {
+					t.Errorf("Failed to drop postgres tables: %v",
+						err)
+					continue
+				}
+			}
+
+			db, err := btcdb.CreateDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("CreateDBWithOptions (%s, policy %d): %v",
+					dbType, policy, err)
+				continue
+			}
+			for _, block := range blocks {
+				if _, err := db.InsertBlock(block); err != nil {
+					t.Errorf("InsertBlock (%s, policy %d): %v",
+						dbType, policy, err)
+					break
+				}
+			}
+
+			// Give the periodic syncs a chance to run alongside
+			// an explicit one.
+			time.Sleep(20 * time.Millisecond)
+			db.Sync()
+			db.Close()
+
+			// A memory database does not persist across opens.
+			if dbType == "memory" {
+				continue
+			}
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s, policy %d): %v",
+					dbType, policy, err)
+				continue
+			}
+			_, height, err := db.NewestSha()
+			if err != nil || height != int64(len(blocks)-1) {
+				t.Errorf("NewestSha (%s, policy %d): got height "+
+					"%d (err %v), want %d", dbType, policy,
+					height, err, len(blocks)-1)
+			}
+			db.Close()
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sort"
+	"sync"
+	"time"
+)
+
+// medianTimeBlocks is the number of blocks, ending with a block itself, whose
+// timestamps the median time past of the block is the median of.
+const medianTimeBlocks = 11
+
+// timeIndexBucket is the number of seconds covered by each entry of the
+// timestamp index.
+const timeIndexBucket = 3600
+
+// TimeIndexPrefix is the prefix of the keys of the metadata namespace under
+// which a TimeIndex keeps its state.
+var TimeIndexPrefix = []byte("btcdb/time/")
+
+var (
+	// timeIndexTipKey is the key of the hash and height of the newest
+	// block indexed by the time index.
+	timeIndexTipKey = []byte("btcdb/time/tip")
+
+	// timeHeightPrefix is the prefix of the keys of the time records of
+	// each block, which are followed by the height of the block as a big
+	// endian number.
+	timeHeightPrefix = []byte("btcdb/time/height/")
+
+	// timeBucketPrefix is the prefix of the keys of the timestamp index,
+	// which are followed by the number of a bucket of timeIndexBucket
+	// seconds as a big endian number.  Each maps to the height of the
+	// first block with a timestamp in the bucket or after it.
+	timeBucketPrefix = []byte("btcdb/time/bucket/")
+)
+
+// timeRecordLen is the length of the time record of a block: its timestamp,
+// median time past and the highest timestamp of the blocks up to it.
+const timeRecordLen = 12
+
+// timeHeightKey returns the key of the time record of the block at the passed
+// height.
+func timeHeightKey(height int64) []byte {
+	key := make([]byte, len(timeHeightPrefix)+8)
+	copy(key, timeHeightPrefix)
+	binary.BigEndian.PutUint64(key[len(timeHeightPrefix):], uint64(height))
+	return key
+}
+
+// timeBucketKey returns the key of the entry of the timestamp index for the
+// passed bucket.
+func timeBucketKey(bucket uint32) []byte {
+	key := make([]byte, len(timeBucketPrefix)+4)
+	copy(key, timeBucketPrefix)
+	binary.BigEndian.PutUint32(key[len(timeBucketPrefix):], bucket)
+	return key
+}
+
+// timeRecord is the time record kept for a block.
+type timeRecord struct {
+	timestamp  uint32
+	medianTime uint32
+	maxTime    uint32
+}
+
+// serialize returns the stored form of the record.
+func (r *timeRecord) serialize() []byte {
+	buf := make([]byte, timeRecordLen)
+	binary.LittleEndian.PutUint32(buf[0:4], r.timestamp)
+	binary.LittleEndian.PutUint32(buf[4:8], r.medianTime)
+	binary.LittleEndian.PutUint32(buf[8:12], r.maxTime)
+	return buf
+}
+
+// deserializeTimeRecord returns the record stored in the passed value.
+func deserializeTimeRecord(val []byte) (*timeRecord, error) {
+	if len(val) != timeRecordLen {
+		return nil, fmt.Errorf("malformed time record %x", val)
+	}
+	return &timeRecord{
+		timestamp:  binary.LittleEndian.Uint32(val[0:4]),
+		medianTime: binary.LittleEndian.Uint32(val[4:8]),
+		maxTime:    binary.LittleEndian.Uint32(val[8:12]),
+	}, nil
+}
+
+// timeSorter sorts timestamps in increasing order.
+type timeSorter []uint32
+
+func (s timeSorter) Len() int {
+	return len(s)
+}
+
+func (s timeSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s timeSorter) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+// TimeIndex is an indexer which keeps the timestamp and median time past of
+// every block of the chain, along with an index from timestamps to heights, so
+// the blocks of a point in time are found without reading headers.  The index
+// is queried with FetchMedianTimeByHeight, FetchBlockByTimestamp and
+// HeightBeforeTime once it is added to a database with AddIndexer.
+//
+// The timestamps of the chain are kept in memory to compute the median time
+// past of each block inserted, which takes 8 bytes per block.
+type TimeIndex struct {
+	mtx      sync.Mutex
+	db       Db
+	times    []uint32
+	maxTimes []uint32
+}
+
+// Ensure TimeIndex implements the Indexer interface.
+var _ Indexer = (*TimeIndex)(nil)
+
+// NewTimeIndex returns a time index which starts indexing once it is added to
+// a database with AddIndexer.
+func NewTimeIndex() *TimeIndex {
+	return new(TimeIndex)
+}
+
+// Init loads the timestamps of the blocks indexed before from the passed
+// database.  The index is rebuilt from the genesis block when its tip is no
+// longer in the chain.  This is part of the Indexer interface implementation.
+func (idx *TimeIndex) Init(db Db) error {
+	tipHeight, err := initIndexerState(db, "Time index", TimeIndexPrefix,
+		timeIndexTipKey)
+	if err != nil {
+		return err
+	}
+
+	var times, maxTimes []uint32
+	iter, err := db.MetaIterator(timeHeightPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for int64(len(times)) <= tipHeight && iter.Next() {
+		rec, err := deserializeTimeRecord(iter.Value())
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(iter.Key(), timeHeightKey(int64(len(times)))) {
+			return fmt.Errorf("time record for height %d is missing",
+				len(times))
+		}
+		times = append(times, rec.timestamp)
+		maxTimes = append(maxTimes, rec.maxTime)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if int64(len(times)) != tipHeight+1 {
+		return fmt.Errorf("time records end at height %d before the tip "+
+			"at height %d", len(times)-1, tipHeight)
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.times = times
+	idx.maxTimes = maxTimes
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *TimeIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, timeIndexTipKey)
+}
+
+// bucketRange returns the first and last buckets of the timestamp index whose
+// entry is the block at the passed height, which are the buckets from the one
+// after the highest timestamp of the blocks before it through the one of its
+// own highest timestamp.  The first bucket is after the last when there are
+// none.
+// Must be called with the mutex held.
+func (idx *TimeIndex) bucketRange(height int64) (uint32, uint32) {
+	last := idx.maxTimes[height] / timeIndexBucket
+	if height == 0 {
+		return last, last
+	}
+	return idx.maxTimes[height-1]/timeIndexBucket + 1, last
+}
+
+// ConnectBlock adds the time record of the passed block and the entries of the
+// timestamp index which start at it.  This is part of the Indexer interface
+// implementation.
+func (idx *TimeIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// Timestamps left by blocks which were disconnected, or whose
+	// connection failed to commit, are replaced.
+	if int64(len(idx.times)) > height {
+		idx.times = idx.times[:height]
+		idx.maxTimes = idx.maxTimes[:height]
+	}
+	if int64(len(idx.times)) != height {
+		return fmt.Errorf("time index is missing the blocks from height "+
+			"%d before block %v at height %d", len(idx.times), sha,
+			height)
+	}
+
+	rec := timeRecord{
+		timestamp: uint32(block.MsgBlock().Header.Timestamp.Unix()),
+	}
+	rec.maxTime = rec.timestamp
+	if height > 0 && idx.maxTimes[height-1] > rec.maxTime {
+		rec.maxTime = idx.maxTimes[height-1]
+	}
+	idx.times = append(idx.times, rec.timestamp)
+	idx.maxTimes = append(idx.maxTimes, rec.maxTime)
+
+	start := len(idx.times) - medianTimeBlocks
+	if start < 0 {
+		start = 0
+	}
+	recent := append(timeSorter(nil), idx.times[start:]...)
+	sort.Sort(recent)
+	rec.medianTime = recent[len(recent)/2]
+
+	meta.Put(timeHeightKey(height), rec.serialize())
+	first, last := idx.bucketRange(height)
+	for bucket := first; bucket <= last && bucket >= first; bucket++ {
+		val := make([]byte, 8)
+		binary.LittleEndian.PutUint64(val, uint64(height))
+		meta.Put(timeBucketKey(bucket), val)
+	}
+	putTipRecord(meta, timeIndexTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the time record of the passed block and the entries
+// of the timestamp index which start at it.  This is part of the Indexer
+// interface implementation.
+func (idx *TimeIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// The timestamps of a block whose connection failed to commit may
+	// have replaced those of the block stored at its height.
+	timestamp := uint32(block.MsgBlock().Header.Timestamp.Unix())
+	if int64(len(idx.times)) <= height || idx.times[height] != timestamp {
+		return fmt.Errorf("time index is out of step with the block "+
+			"at height %d", height)
+	}
+	meta.Delete(timeHeightKey(height))
+	first, last := idx.bucketRange(height)
+	for bucket := first; bucket <= last && bucket >= first; bucket++ {
+		meta.Delete(timeBucketKey(bucket))
+	}
+	putTipRecord(meta, timeIndexTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// fetchTimeRecord returns the time record of the block at the passed height,
+// or ErrBlockNotFound when there is none.
+func fetchTimeRecord(db Db, height int64) (*timeRecord, error) {
+	val, err := db.GetMeta(timeHeightKey(height))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrBlockNotFound
+	}
+	return deserializeTimeRecord(val)
+}
+
+// fetchTimeIndexTip returns the height of the newest block indexed by the time
+// index of the passed database, or ErrNoTimeIndex when it has none.
+func fetchTimeIndexTip(db Db) (int64, error) {
+	sha, height, err := fetchTipRecord(db, timeIndexTipKey)
+	if err != nil {
+		return 0, err
+	}
+	if sha == nil {
+		return 0, ErrNoTimeIndex
+	}
+	return height, nil
+}
+
+// firstHeightAtTime returns the height of the first block of the chain of the
+// passed database whose timestamp is not before the passed time, or -1 when
+// there is no such block, along with the height of the newest block indexed.
+func firstHeightAtTime(db Db, t time.Time) (int64, int64, error) {
+	tipHeight, err := fetchTimeIndexTip(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if tipHeight < 0 {
+		return -1, tipHeight, nil
+	}
+	unix := t.Unix()
+	if unix <= 0 {
+		return 0, tipHeight, nil
+	}
+	if unix > int64(^uint32(0)) {
+		return -1, tipHeight, nil
+	}
+	target := uint32(unix)
+
+	// The entry of the bucket of the time is the first block with a
+	// timestamp in the bucket or after it, and the first block at the
+	// time follows it closely.
+	height := int64(0)
+	val, err := db.GetMeta(timeBucketKey(target / timeIndexBucket))
+	if err != nil {
+		return 0, 0, err
+	}
+	if val != nil {
+		if len(val) != 8 {
+			return 0, 0, fmt.Errorf("malformed time index entry %x",
+				val)
+		}
+		height = int64(binary.LittleEndian.Uint64(val))
+	} else {
+		genesis, err := fetchTimeRecord(db, 0)
+		if err != nil {
+			return 0, 0, err
+		}
+		if target/timeIndexBucket > genesis.maxTime/timeIndexBucket {
+			return -1, tipHeight, nil
+		}
+	}
+	for ; height <= tipHeight; height++ {
+		rec, err := fetchTimeRecord(db, height)
+		if err != nil {
+			return 0, 0, err
+		}
+		if rec.maxTime >= target {
+			return height, tipHeight, nil
+		}
+	}
+	return -1, tipHeight, nil
+}
+
+// FetchMedianTimeByHeight returns the median time past of the block at the
+// passed height, which is the median of the timestamps of the block and the
+// ten blocks before it, as recorded by the TimeIndex of the passed database.
+// ErrNoTimeIndex is returned when the database has no time index.
+func FetchMedianTimeByHeight(db Db, height int64) (time.Time, error) {
+	if _, err := fetchTimeIndexTip(db); err != nil {
+		return time.Time{}, err
+	}
+	rec, err := fetchTimeRecord(db, height)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(rec.medianTime), 0), nil
+}
+
+// FetchBlockByTimestamp returns the first block of the chain of the passed
+// database whose timestamp is not before the passed time, using the TimeIndex
+// of the database.  Since timestamps need not increase, blocks after it may
+// have earlier timestamps, but none before it has a later one.
+// ErrBlockNotFound is returned when no block has such a timestamp and
+// ErrNoTimeIndex when the database has no time index.
+func FetchBlockByTimestamp(db Db, t time.Time) (*btcutil.Block, error) {
+	height, _, err := firstHeightAtTime(db, t)
+	if err != nil {
+		return nil, err
+	}
+	if height < 0 {
+		return nil, ErrBlockNotFound
+	}
+	sha, err := db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return db.FetchBlockBySha(sha)
+}
+
+// HeightBeforeTime returns the height of the newest block of the chain of the
+// passed database such that it and every block before it have a timestamp
+// before the passed time, using the TimeIndex of the database, so rescanning
+// the blocks after it finds everything which happened from the time on.  It
+// returns -1 when the genesis block is not before the time and
+// ErrNoTimeIndex when the database has no time index.
+func HeightBeforeTime(db Db, t time.Time) (int64, error) {
+	height, tipHeight, err := firstHeightAtTime(db, t)
+	if err != nil {
+		return 0, err
+	}
+	if height < 0 {
+		return tipHeight, nil
+	}
+	return height - 1, nil
+}
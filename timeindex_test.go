@@ -0,0 +1,168 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestTimeIndex ensures the time index records the median time past of every
+// block and finds the blocks of a point in time as the chain grows and
+// shrinks, including after reopening the database.
+func TestTimeIndex(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	blocks = blocks[:40]
+	times := make([]time.Time, len(blocks))
+	for i, blk := range blocks {
+		times[i] = blk.MsgBlock().Header.Timestamp
+	}
+
+	// checkTimes ensures the median time past of each block up to the
+	// passed height and the lookups of the times around each of their
+	// timestamps match those found by reading every block.
+	checkTimes := func(dbType, desc string, db btcdb.Db, newest int64) {
+		for h := int64(0); h <= newest; h++ {
+			var recent []int
+			for i := h - 10; i <= h; i++ {
+				if i >= 0 {
+					recent = append(recent, int(times[i].Unix()))
+				}
+			}
+			sort.Ints(recent)
+			want := time.Unix(int64(recent[len(recent)/2]), 0)
+			mtp, err := btcdb.FetchMedianTimeByHeight(db, h)
+			if err != nil || !mtp.Equal(want) {
+				t.Errorf("FetchMedianTimeByHeight (%s) %s: got %v "+
+					"(err %v) at height %d, want %v", dbType,
+					desc, mtp, err, h, want)
+			}
+		}
+
+		queries := []time.Time{time.Unix(0, 0), times[newest].Add(time.Hour)}
+		for _, ts := range times[:newest+1] {
+			queries = append(queries, ts.Add(-time.Second), ts,
+				ts.Add(time.Second))
+		}
+		for _, q := range queries {
+			first := int64(-1)
+			for h := int64(0); h <= newest; h++ {
+				if !times[h].Before(q) {
+					first = h
+					break
+				}
+			}
+
+			blk, err := btcdb.FetchBlockByTimestamp(db, q)
+			if first < 0 {
+				if err != btcdb.ErrBlockNotFound {
+					t.Errorf("FetchBlockByTimestamp (%s) %s: got "+
+						"%v for %v, want %v", dbType, desc,
+						err, q, btcdb.ErrBlockNotFound)
+				}
+			} else if err != nil || blk.Height() != first {
+				t.Errorf("FetchBlockByTimestamp (%s) %s: got %v "+
+					"(err %v) for %v, want height %d", dbType,
+					desc, blk, err, q, first)
+			}
+
+			want := first - 1
+			if first < 0 {
+				want = newest
+			}
+			height, err := btcdb.HeightBeforeTime(db, q)
+			if err != nil || height != want {
+				t.Errorf("HeightBeforeTime (%s) %s: got %d (err %v) "+
+					"for %v, want %d", dbType, desc, height, err,
+					q, want)
+			}
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		opts := btcdb.Options{
+			Path: filepath.Join(testDbRoot, "timedb-"+dbType),
+		}
+		if dbType == "postgres" {
+			opts.Path = postgresDSN
+			if err := dropPostgresTables(); err != nil {
+				t.Errorf("Failed to drop postgres tables: %v", err)
+				continue
+			}
+		}
+		db, err := btcdb.CreateDBWithOptions(dbType, opts)
+		if err != nil {
+			t.Errorf("CreateDBWithOptions (%s): %v", dbType, err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:20]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+		if _, err := btcdb.HeightBeforeTime(db, times[5]); err != btcdb.ErrNoTimeIndex {
+			t.Errorf("HeightBeforeTime (%s): got %v without an "+
+				"index, want %v", dbType, err, btcdb.ErrNoTimeIndex)
+		}
+
+		// The index is caught up with the blocks already stored and
+		// kept up to date by those inserted and dropped later.
+		if err := db.AddIndexer(btcdb.NewTimeIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			db.Close()
+			continue
+		}
+		checkTimes(dbType, "after catching up", db, 19)
+		if _, err := db.InsertBlocks(blocks[20:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkTimes(dbType, "after inserting blocks", db, 39)
+		keepSha, _ := blocks[29].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkTimes(dbType, "after dropping blocks", db, 29)
+		if _, err := db.InsertBlocks(blocks[30:35]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkTimes(dbType, "after reinserting blocks", db, 34)
+
+		// The index must survive reopening the database and carry on
+		// from where it left off.
+		if dbType != "memory" {
+			db.Close()
+			db, err = btcdb.OpenDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("OpenDBWithOptions (%s): %v", dbType, err)
+				continue
+			}
+			checkTimes(dbType, "after reopening", db, 34)
+			if err := db.AddIndexer(btcdb.NewTimeIndex()); err != nil {
+				t.Errorf("AddIndexer (%s): %v", dbType, err)
+			}
+			if _, err := db.InsertBlocks(blocks[35:]); err != nil {
+				t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			}
+			checkTimes(dbType, "after inserting once reopened", db, 39)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// TxIterator walks every transaction of the chain in height order and in the
+// order they appear within each block.  It starts out positioned before its
+// first transaction, so Next must be called before the first transaction can
+// be accessed.
+type TxIterator interface {
+	// Next moves to the next transaction and returns whether there is
+	// one.  It returns false once the end of the chain is reached or an
+	// error occurs, in which case Err returns the error.
+	Next() bool
+
+	// Sha returns the hash of the current transaction.
+	Sha() *btcwire.ShaHash
+
+	// Height returns the height of the block containing the current
+	// transaction.
+	Height() int64
+
+	// RawBytes returns the serialized current transaction.
+	RawBytes() []byte
+
+	// Err returns the error which stopped the iteration, if any.
+	Err() error
+
+	// Release frees the snapshot the iterator reads from.
+	Release()
+}
+
+// blockHeaderLen is the length of a serialized block header.
+const blockHeaderLen = 80
+
+// txIterator implements TxIterator on top of a BlockIterator.  The raw blocks
+// are only scanned for the boundaries of their transactions rather than
+// deserialized.
+type txIterator struct {
+	blocks BlockIterator
+	r      *bytes.Reader
+	raw    []byte
+	txLeft uint64
+	sha    *btcwire.ShaHash
+	tx     []byte
+	err    error
+}
+
+// NewTxIterator returns a TxIterator over the transactions of the blocks the
+// passed block iterator walks.  It is intended for use by drivers.
+func NewTxIterator(blocks BlockIterator) TxIterator {
+	return &txIterator{blocks: blocks}
+}
+
+// Next moves to the next transaction.  This is part of the TxIterator
+// interface implementation.
+func (it *txIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for it.txLeft == 0 {
+		if !it.blocks.Next() {
+			it.sha, it.tx = nil, nil
+			it.err = it.blocks.Err()
+			return false
+		}
+		it.raw = it.blocks.RawBytes()
+		if len(it.raw) < blockHeaderLen {
+			it.err = ErrCorruption
+			return false
+		}
+		it.r = bytes.NewReader(it.raw[blockHeaderLen:])
+		count, err := btcwire.ReadVarInt(it.r, 0)
+		if err != nil {
+			it.err = ErrCorruption
+			return false
+		}
+		it.txLeft = count
+	}
+
+	start := len(it.raw) - it.r.Len()
+	if err := skipTx(it.r); err != nil {
+		it.err = ErrCorruption
+		return false
+	}
+	end := len(it.raw) - it.r.Len()
+	it.tx = it.raw[start:end]
+	it.txLeft--
+
+	var sha btcwire.ShaHash
+	sha.SetBytes(btcwire.DoubleSha256(it.tx))
+	it.sha = &sha
+	return true
+}
+
+// Sha returns the hash of the current transaction.  This is part of the
+// TxIterator interface implementation.
+func (it *txIterator) Sha() *btcwire.ShaHash {
+	return it.sha
+}
+
+// Height returns the height of the block containing the current transaction.
+// This is part of the TxIterator interface implementation.
+func (it *txIterator) Height() int64 {
+	return it.blocks.Height()
+}
+
+// RawBytes returns the serialized current transaction.  This is part of the
+// TxIterator interface implementation.
+func (it *txIterator) RawBytes() []byte {
+	return it.tx
+}
+
+// Err returns the error which stopped the iteration.  This is part of the
+// TxIterator interface implementation.
+func (it *txIterator) Err() error {
+	return it.err
+}
+
+// Release frees the snapshot the iterator reads from.  This is part of the
+// TxIterator interface implementation.
+func (it *txIterator) Release() {
+	it.blocks.Release()
+}
+
+// skip advances the passed reader by n bytes.
+func skip(r *bytes.Reader, n uint64) error {
+	if n > uint64(r.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	_, err := r.Seek(int64(n), io.SeekCurrent)
+	return err
+}
+
+// skipVarBytes advances the passed reader past a variable length byte array.
+func skipVarBytes(r *bytes.Reader) error {
+	n, err := btcwire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	return skip(r, n)
+}
+
+// skipTx advances the passed reader past a serialized transaction.
+func skipTx(r *bytes.Reader) error {
+	// Version.
+	if err := skip(r, 4); err != nil {
+		return err
+	}
+
+	// Each input is made up of the previous outpoint, the signature
+	// script and the sequence number.
+	numIn, err := btcwire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < numIn; i++ {
+		if err := skip(r, btcwire.HashSize+4); err != nil {
+			return err
+		}
+		if err := skipVarBytes(r); err != nil {
+			return err
+		}
+		if err := skip(r, 4); err != nil {
+			return err
+		}
+	}
+
+	// Each output is made up of the value and the public key script.
+	numOut, err := btcwire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < numOut; i++ {
+		if err := skip(r, 8); err != nil {
+			return err
+		}
+		if err := skipVarBytes(r); err != nil {
+			return err
+		}
+	}
+
+	// Lock time.
+	return skip(r, 4)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestBlockIterator ensures the block iterator of every supported database
+// type walks the chain in height order from the requested height.
+func TestBlockIterator(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "blockiter", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		for _, start := range []int{0, len(blocks) / 2, len(blocks)} {
+			iter, err := db.BlockIterator(int64(start))
+			if err != nil {
+				t.Errorf("BlockIterator (%s): %v", dbType, err)
+				continue
+			}
+			height := start
+			for ; iter.Next(); height++ {
+				if height >= len(blocks) {
+					t.Errorf("BlockIterator (%s): iterated "+
+						"past the end of the chain", dbType)
+					break
+				}
+				wantSha, _ := blocks[height].Sha()
+				wantRaw, _ := blocks[height].Bytes()
+				if iter.Height() != int64(height) ||
+					!iter.Sha().IsEqual(wantSha) ||
+					!bytes.Equal(iter.RawBytes(), wantRaw) {
+
+					t.Errorf("BlockIterator (%s): got block "+
+						"%v at height %d, want %v at "+
+						"height %d", dbType, iter.Sha(),
+						iter.Height(), wantSha, height)
+					break
+				}
+			}
+			if err := iter.Err(); err != nil {
+				t.Errorf("BlockIterator (%s): %v", dbType, err)
+			}
+			if height != len(blocks) {
+				t.Errorf("BlockIterator (%s): stopped at height "+
+					"%d, want %d", dbType, height, len(blocks))
+			}
+			iter.Release()
+		}
+		teardown()
+	}
+}
+
+// TestTxIterator ensures the transaction iterator of every supported database
+// type walks every transaction of the chain in order.
+func TestTxIterator(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// Only the transactions from the start height on are expected.
+	startHeight := len(blocks) / 2
+	type txInfo struct {
+		sha    *btcwire.ShaHash
+		height int64
+		raw    []byte
+	}
+	var want []txInfo
+	for height, block := range blocks[startHeight:] {
+		for _, tx := range block.Transactions() {
+			var buf bytes.Buffer
+			if err := tx.MsgTx().Serialize(&buf); err != nil {
+				t.Errorf("Serialize: %v", err)
+				return
+			}
+			want = append(want, txInfo{tx.Sha(),
+				int64(startHeight + height), buf.Bytes()})
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "txiter", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+
+		iter, err := db.TxIterator(int64(startHeight))
+		if err != nil {
+			t.Errorf("TxIterator (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		i := 0
+		for ; iter.Next(); i++ {
+			if i >= len(want) {
+				t.Errorf("TxIterator (%s): too many transactions",
+					dbType)
+				break
+			}
+			if !iter.Sha().IsEqual(want[i].sha) ||
+				iter.Height() != want[i].height ||
+				!bytes.Equal(iter.RawBytes(), want[i].raw) {
+
+				t.Errorf("TxIterator (%s): got tx %v at height "+
+					"%d, want %v at height %d", dbType,
+					iter.Sha(), iter.Height(), want[i].sha,
+					want[i].height)
+				break
+			}
+		}
+		if err := iter.Err(); err != nil {
+			t.Errorf("TxIterator (%s): %v", dbType, err)
+		}
+		if i != len(want) {
+			t.Errorf("TxIterator (%s): got %d transactions, want %d",
+				dbType, i, len(want))
+		}
+		iter.Release()
+		teardown()
+	}
+}
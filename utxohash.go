@@ -0,0 +1,390 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcdb/muhash"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+const (
+	// utxoHashDeltas is the number of the newest blocks whose changes to
+	// the hash of the unspent output set a UtxoHashIndex keeps in memory,
+	// so it can take back blocks whose connection failed to commit.
+	utxoHashDeltas = 288
+
+	// maxUtxoScriptSize is the size of the largest output script which may
+	// be spent.  Outputs with longer scripts are left out of the set.
+	maxUtxoScriptSize = 10000
+)
+
+// UtxoHashPrefix is the prefix of the keys of the metadata namespace under which
+// a UtxoHashIndex keeps the hash of the unspent output set at each block.
+var UtxoHashPrefix = []byte("btcdb/utxohash/")
+
+var (
+	// utxoHashTipKey is the key of the hash and height of the newest block
+	// hashed by the unspent output set hash index.
+	utxoHashTipKey = []byte("btcdb/utxohash/tip")
+
+	// utxoHashHeightPrefix is the prefix of the keys of the hash of the set
+	// at each block, which are followed by the height of the block as a
+	// big endian number.  Each maps to the hash of the block followed by
+	// the hash of the set.
+	utxoHashHeightPrefix = []byte("btcdb/utxohash/height/")
+
+	// utxoHashStateKey is the key of the state of the hash at the newest
+	// block hashed, which maps to the hash of the block followed by the
+	// serialized state.
+	utxoHashStateKey = []byte("btcdb/utxohash/state")
+
+	// utxoHashVersionKey is the key of the version of the records of the
+	// unspent output set hash index.  It is kept outside of UtxoHashPrefix
+	// so it survives the index being rebuilt.
+	utxoHashVersionKey = []byte("btcdb/version/utxohash")
+)
+
+// utxoHashVersion is the version of the records of the unspent output set hash
+// index.  Hashes from before it was an indexer were written by UtxoSetHash as
+// it was called, along with states every hundred blocks, and are rebuilt.
+const utxoHashVersion = 1
+
+const (
+	// utxoHashRecordLen is the length of the hash of the set at a block.
+	utxoHashRecordLen = btcwire.HashSize + muhash.HashSize
+
+	// utxoStateRecordLen is the length of the state of the hash at a
+	// block.
+	utxoStateRecordLen = btcwire.HashSize + muhash.StateSize
+)
+
+// utxoHashKey returns the key under the passed prefix of the block at the
+// passed height.
+func utxoHashKey(prefix []byte, height int64) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], uint64(height))
+	return key
+}
+
+// isUnspendableOutput returns whether the passed output script may never be
+// spent, in which case the output is not part of the unspent output set.
+func isUnspendableOutput(pkScript []byte) bool {
+	return (len(pkScript) > 0 && pkScript[0] == opReturn) ||
+		len(pkScript) > maxUtxoScriptSize
+}
+
+// utxoHashItem returns the serialization of an unspent output hashed into the
+// set, which is the one used by Bitcoin Core: the outpoint, the height of the
+// block of its transaction shifted left by one with the lowest bit set for
+// coinbases, the value and the script of the output.
+func utxoHashItem(op *btcwire.OutPoint, height int64, coinbase bool, txOut *btcwire.TxOut) []byte {
+	var buf bytes.Buffer
+	buf.Grow(btcwire.HashSize + 4 + 4 + 8 + 9 + len(txOut.PkScript))
+	buf.Write(op.Hash[:])
+
+	var scratch [8]byte
+	binary.LittleEndian.PutUint32(scratch[:4], op.Index)
+	buf.Write(scratch[:4])
+	code := uint32(height) << 1
+	if coinbase {
+		code |= 1
+	}
+	binary.LittleEndian.PutUint32(scratch[:4], code)
+	buf.Write(scratch[:4])
+	binary.LittleEndian.PutUint64(scratch[:], uint64(txOut.Value))
+	buf.Write(scratch[:])
+
+	// Writing to a bytes.Buffer never fails.
+	_ = btcwire.WriteVarInt(&buf, 0, uint64(len(txOut.PkScript)))
+	buf.Write(txOut.PkScript)
+	return buf.Bytes()
+}
+
+// utxoHashDelta returns the changes the passed block at the passed height,
+// which spent the passed outputs, makes to the hash of the unspent output set.
+// Outputs of the genesis block may not be spent and are not part of the set.
+func utxoHashDelta(block *btcutil.Block, height int64, spent []*UtxoEntry) (*muhash.MuHash, error) {
+	delta := muhash.New()
+	if height == 0 {
+		return delta, nil
+	}
+
+	var n int
+	for i, tx := range block.MsgBlock().Transactions {
+		if i > 0 {
+			for _, txIn := range tx.TxIn {
+				entry := spent[n]
+				n++
+				if isUnspendableOutput(entry.PkScript) {
+					continue
+				}
+				txOut := btcwire.NewTxOut(entry.Value,
+					entry.PkScript)
+				delta.Remove(utxoHashItem(&txIn.PreviousOutpoint,
+					entry.Height, entry.Coinbase, txOut))
+			}
+		}
+
+		txSha, err := tx.TxSha()
+		if err != nil {
+			return nil, err
+		}
+
+		// The outputs of the transaction overwritten by a duplicate
+		// are no longer available, and were never spent.  Being a
+		// duplicate, the overwritten transaction has the same outputs.
+		if IsBIP30Exception(height, &txSha) {
+			prevHeight := bip30Overwritten[height]
+			for idx, txOut := range tx.TxOut {
+				if isUnspendableOutput(txOut.PkScript) {
+					continue
+				}
+				op := btcwire.NewOutPoint(&txSha, uint32(idx))
+				delta.Remove(utxoHashItem(op, prevHeight,
+					isCoinbaseTx(tx), txOut))
+			}
+		}
+
+		coinbase := i == 0
+		for idx, txOut := range tx.TxOut {
+			if isUnspendableOutput(txOut.PkScript) {
+				continue
+			}
+			op := btcwire.NewOutPoint(&txSha, uint32(idx))
+			delta.Insert(utxoHashItem(op, height, coinbase, txOut))
+		}
+	}
+	return delta, nil
+}
+
+// UtxoHashIndex is an optional indexer which keeps the MuHash3072 of the set of
+// the outputs which are unspent as of every block of the chain, which is the
+// same as the muhash reported by gettxoutsetinfo in Bitcoin Core at that
+// height, so operators can check with UtxoSetHash that their database agrees
+// with other implementations.  Outputs of the genesis block and outputs which
+// may never be spent are not part of the set.
+//
+// The state of the hash at the newest block is updated with the outputs each
+// block creates and spends as it is connected and disconnected, and written
+// along with it.  The spent outputs are those the database passes along with
+// each block, so the index can not be kept for a database which does not know
+// them, such as one which only stores headers.
+type UtxoHashIndex struct {
+	mtx    sync.Mutex
+	db     Db
+	state  *muhash.MuHash
+	height int64
+	deltas map[int64]*muhash.MuHash
+}
+
+// Ensure UtxoHashIndex implements the Indexer interface.
+var _ Indexer = (*UtxoHashIndex)(nil)
+
+// NewUtxoHashIndex returns an unspent output set hash index which starts
+// hashing once it is added to a database with AddIndexer.
+func NewUtxoHashIndex() *UtxoHashIndex {
+	return new(UtxoHashIndex)
+}
+
+// Init loads the state of the hash at the newest block hashed before from the
+// passed database.  The index is rebuilt from the genesis block when its tip is
+// no longer in the chain or its records were written by another version of the
+// index.  This is part of the Indexer interface implementation.
+func (idx *UtxoHashIndex) Init(db Db) error {
+	tipHeight, err := initVersionedIndexerState(db, "Unspent output set "+
+		"hash index", UtxoHashPrefix, utxoHashTipKey, utxoHashVersionKey,
+		utxoHashVersion)
+	if err != nil {
+		return err
+	}
+
+	state := muhash.New()
+	if tipHeight >= 0 {
+		tipSha, _, err := fetchTipRecord(db, utxoHashTipKey)
+		if err != nil {
+			return err
+		}
+		val, err := db.GetMeta(utxoHashStateKey)
+		if err != nil {
+			return err
+		}
+		if len(val) != utxoStateRecordLen ||
+			!bytes.Equal(val[:btcwire.HashSize], tipSha[:]) {
+			return fmt.Errorf("unspent output set state at the tip "+
+				"%v at height %d is missing", tipSha, tipHeight)
+		}
+		state, err = muhash.Deserialize(val[btcwire.HashSize:])
+		if err != nil {
+			return fmt.Errorf("malformed unspent output set state "+
+				"at height %d: %v", tipHeight, err)
+		}
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.state = state
+	idx.height = tipHeight
+	idx.deltas = make(map[int64]*muhash.MuHash)
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block hashed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *UtxoHashIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, utxoHashTipKey)
+}
+
+// seek moves the state of the hash to the passed height with the changes kept
+// for the blocks in between.  The state is ahead of the blocks stored when the
+// connection of blocks failed to commit, and behind them when their
+// disconnection did.
+//
+// This function must be called with the index lock held.
+func (idx *UtxoHashIndex) seek(height int64) error {
+	for idx.height != height {
+		if idx.height > height {
+			delta, ok := idx.deltas[idx.height]
+			if !ok {
+				break
+			}
+			idx.state.Divide(delta)
+			idx.height--
+			continue
+		}
+		delta, ok := idx.deltas[idx.height+1]
+		if !ok {
+			break
+		}
+		idx.state.Combine(delta)
+		idx.height++
+	}
+	if idx.height != height {
+		return fmt.Errorf("unspent output set hash index is out of "+
+			"step with the block at height %d", height)
+	}
+	return nil
+}
+
+// writeState adds the hash of the set at the passed block at the passed height
+// and the state of the hash, which must be at the block, to the passed batch.
+//
+// This function must be called with the index lock held.
+func (idx *UtxoHashIndex) writeState(sha *btcwire.ShaHash, height int64, meta *MetaBatch) {
+	putTipRecord(meta, utxoHashTipKey, sha, height)
+	if height < 0 {
+		meta.Delete(utxoHashStateKey)
+		return
+	}
+	setHash := idx.state.Finalize()
+	meta.Put(utxoHashKey(utxoHashHeightPrefix, height),
+		append(append([]byte{}, sha[:]...), setHash[:]...))
+	meta.Put(utxoHashStateKey, append(append([]byte{}, sha[:]...),
+		idx.state.Serialize()...))
+}
+
+// ConnectBlock adds the outputs created by the passed block to the hash of the
+// set and removes those it spends.  This is part of the Indexer interface
+// implementation.
+func (idx *UtxoHashIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	if !spentKnown(block, spent) {
+		return fmt.Errorf("outputs spent by block %v at height %d are "+
+			"not known", sha, height)
+	}
+	delta, err := utxoHashDelta(block, height, spent)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	if err := idx.seek(height - 1); err != nil {
+		return err
+	}
+	idx.state.Combine(delta)
+	idx.height = height
+	idx.deltas[height] = delta
+	delete(idx.deltas, height-utxoHashDeltas)
+
+	idx.writeState(sha, height, meta)
+	return nil
+}
+
+// DisconnectBlock removes the outputs created by the passed block from the hash
+// of the set and adds back those it spent.  This is part of the Indexer
+// interface implementation.
+func (idx *UtxoHashIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	if !spentKnown(block, spent) {
+		return fmt.Errorf("outputs spent by block %v at height %d are "+
+			"not known", sha, height)
+	}
+	delta, err := utxoHashDelta(block, height, spent)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	if err := idx.seek(height); err != nil {
+		return err
+	}
+	idx.state.Divide(delta)
+	idx.height = height - 1
+	idx.deltas[height] = delta
+
+	meta.Delete(utxoHashKey(utxoHashHeightPrefix, height))
+	idx.writeState(&block.MsgBlock().Header.PrevBlock, height-1, meta)
+	return nil
+}
+
+// UtxoSetHash returns the MuHash3072 of the set of the outputs which are
+// unspent as of the block at the passed height of the chain of the passed
+// database, as recorded by its UtxoHashIndex.  ErrBlockNotFound is returned
+// when the index does not hold the block and ErrNoUtxoHashIndex when the
+// database has no unspent output set hash index.
+func UtxoSetHash(db Db, height int64) (*btcwire.ShaHash, error) {
+	tipSha, tipHeight, err := fetchTipRecord(db, utxoHashTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoUtxoHashIndex
+	}
+	if height < 0 || height > tipHeight {
+		return nil, ErrBlockNotFound
+	}
+
+	val, err := db.GetMeta(utxoHashKey(utxoHashHeightPrefix, height))
+	if err != nil {
+		return nil, err
+	}
+	if len(val) != utxoHashRecordLen {
+		return nil, fmt.Errorf("malformed unspent output set hash %x "+
+			"at height %d", val, height)
+	}
+	var setHash btcwire.ShaHash
+	copy(setHash[:], val[btcwire.HashSize:])
+	return &setHash, nil
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/muhash"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestUtxoSetHash ensures the hash of the unspent output set at a block kept by
+// the unspent output set hash index is the MuHash3072 of the outputs left
+// unspent by the chain up to the block for every supported database type, both
+// as the index is caught up with the chain and as blocks are inserted and
+// replaced, including when the connection or disconnection of blocks fails.
+func TestUtxoSetHash(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// utxoSetHash returns the expected hash of the unspent outputs of the
+	// passed chain, which starts with the genesis block, serialized as by
+	// Bitcoin Core.
+	utxoSetHash := func(chain []*btcutil.Block) btcwire.ShaHash {
+		set := make(map[btcwire.OutPoint][]byte)
+		for height, blk := range chain[1:] {
+			for i, tx := range blk.MsgBlock().Transactions {
+				if i > 0 {
+					for _, txIn := range tx.TxIn {
+						delete(set, txIn.PreviousOutpoint)
+					}
+				}
+				txSha, _ := tx.TxSha()
+				for idx, txOut := range tx.TxOut {
+					var buf bytes.Buffer
+					buf.Write(txSha[:])
+					code := uint32(height+1) << 1
+					if i == 0 {
+						code |= 1
+					}
+					binary.Write(&buf, binary.LittleEndian,
+						uint32(idx))
+					binary.Write(&buf, binary.LittleEndian, code)
+					binary.Write(&buf, binary.LittleEndian,
+						txOut.Value)
+					btcwire.WriteVarInt(&buf, 0,
+						uint64(len(txOut.PkScript)))
+					buf.Write(txOut.PkScript)
+					op := btcwire.NewOutPoint(&txSha, uint32(idx))
+					set[*op] = buf.Bytes()
+				}
+			}
+		}
+		h := muhash.New()
+		for _, item := range set {
+			h.Insert(item)
+		}
+		return btcwire.ShaHash(h.Finalize())
+	}
+
+	// checkHash ensures the hash at the height of the last of the passed
+	// blocks is the expected one.
+	checkHash := func(dbType, desc string, db btcdb.Db, chain []*btcutil.Block) {
+		want := utxoSetHash(chain)
+		hash, err := btcdb.UtxoSetHash(db, int64(len(chain)-1))
+		if err != nil || !hash.IsEqual(&want) {
+			t.Errorf("UtxoSetHash (%s) %s: got %v (err %v), want %v",
+				dbType, desc, hash, err, want)
+		}
+	}
+
+	half := len(blocks) / 2
+	alt := altChain(blocks[half-11], 20)
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "utxohash", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:half]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.UtxoSetHash(db, 0); err != btcdb.ErrNoUtxoHashIndex {
+			t.Errorf("UtxoSetHash (%s): got %v without an index, "+
+				"want %v", dbType, err, btcdb.ErrNoUtxoHashIndex)
+		}
+
+		// The index is caught up with the blocks already stored.  The
+		// indexer added after it makes the changes to the blocks fail
+		// once the hash was updated.
+		if err := db.AddIndexer(btcdb.NewUtxoHashIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		failIdx := new(testIndexer)
+		if err := db.AddIndexer(failIdx); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkHash(dbType, "of the genesis block", db, blocks[:1])
+		checkHash(dbType, "of the first blocks", db, blocks[:half])
+		checkHash(dbType, "below the tip", db, blocks[:10])
+
+		failIdx.fail = true
+		if _, err := db.InsertBlocks(blocks[half:]); err == nil {
+			t.Errorf("InsertBlocks (%s): unexpected success with "+
+				"failing indexer", dbType)
+		}
+		failIdx.fail = false
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkHash(dbType, "of every block", db, blocks)
+		checkHash(dbType, "of a stored block", db, blocks[:half+5])
+		if _, err := btcdb.UtxoSetHash(db, int64(len(blocks))); err != btcdb.ErrBlockNotFound {
+			t.Errorf("UtxoSetHash (%s): got %v past the chain, "+
+				"want %v", dbType, err, btcdb.ErrBlockNotFound)
+		}
+
+		// Hashes of replaced blocks are replaced along with them.
+		keepSha, _ := blocks[half-11].Sha()
+		failIdx.failDisconnect = true
+		if err := db.DropAfterBlockBySha(keepSha); err == nil {
+			t.Errorf("DropAfterBlockBySha (%s): unexpected success "+
+				"with failing indexer", dbType)
+		}
+		failIdx.failDisconnect = false
+		checkHash(dbType, "after failing to drop blocks", db, blocks)
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		if _, err := db.InsertBlocks(alt); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		chain := append(append([]*btcutil.Block(nil),
+			blocks[:half-10]...), alt...)
+		checkHash(dbType, "after replacing blocks", db, chain)
+		checkHash(dbType, "below the replaced blocks", db,
+			blocks[:half-15])
+		teardown()
+	}
+}
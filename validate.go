@@ -0,0 +1,174 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"math/big"
+)
+
+const (
+	// maxSatoshi is the maximum amount of satoshi which may be sent by a
+	// single output and by all of the outputs of a transaction.
+	maxSatoshi = 21e6 * 1e8
+
+	// minCoinbaseScriptLen and maxCoinbaseScriptLen are the bounds of the
+	// length of the signature script of a coinbase transaction.
+	minCoinbaseScriptLen = 2
+	maxCoinbaseScriptLen = 100
+)
+
+// ValidationError describes the first problem found with a block by the checks
+// selected with the Validation field of Options.
+type ValidationError struct {
+	Sha         btcwire.ShaHash
+	Description string
+}
+
+// Error returns the problem with the block as a human-readable string.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("block %v failed validation: %s", &e.Sha,
+		e.Description)
+}
+
+// CheckBlock performs the checks of the passed mode on a block which is about
+// to be inserted on top of the block with the given hash, which is nil when
+// the database holds no blocks yet.  A ValidationError is returned for the
+// first problem found.  It is intended for drivers, which call it for each
+// block they insert with the mode given by the Validation field of Options.
+func CheckBlock(block *btcutil.Block, mode ValidationMode, tipSha *btcwire.ShaHash) error {
+	if mode == ValidateNone {
+		return nil
+	}
+
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+	fail := func(format string, args ...interface{}) error {
+		return &ValidationError{Sha: *sha,
+			Description: fmt.Sprintf(format, args...)}
+	}
+
+	header := &block.MsgBlock().Header
+	if tipSha != nil && !header.PrevBlock.IsEqual(tipSha) {
+		return fail("previous block is %v instead of the newest block "+
+			"%v", &header.PrevBlock, tipSha)
+	}
+
+	target := compactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return fail("target difficulty of %08x is not positive",
+			header.Bits)
+	}
+	if shaToBig(sha).Cmp(target) > 0 {
+		return fail("hash is higher than the target difficulty of %08x",
+			header.Bits)
+	}
+
+	merkleRoot := calcMerkleRoot(block.Transactions())
+	if !merkleRoot.IsEqual(&header.MerkleRoot) {
+		return fail("merkle root of transactions is %v instead of %v",
+			&merkleRoot, &header.MerkleRoot)
+	}
+	if mode < ValidateStrict {
+		return nil
+	}
+
+	msgBlock := block.MsgBlock()
+	if len(msgBlock.Transactions) == 0 {
+		return fail("block has no transactions")
+	}
+	if size := msgBlock.SerializeSize(); size > btcwire.MaxBlockPayload {
+		return fail("serialized size of %d is more than the maximum of "+
+			"%d", size, btcwire.MaxBlockPayload)
+	}
+	for i, tx := range msgBlock.Transactions {
+		coinbase := isCoinbaseTx(tx)
+		if i == 0 && !coinbase {
+			return fail("first transaction is not a coinbase")
+		}
+		if i != 0 && coinbase {
+			return fail("transaction %d is a second coinbase", i)
+		}
+		if desc := checkTransaction(tx, coinbase); desc != "" {
+			return fail("transaction %d %s", i, desc)
+		}
+	}
+	return nil
+}
+
+// checkTransaction performs the checks of a transaction which do not depend on
+// the outputs it spends and returns a description of the first problem found,
+// which is empty when there is none.
+func checkTransaction(tx *btcwire.MsgTx, coinbase bool) string {
+	if len(tx.TxIn) == 0 {
+		return "has no inputs"
+	}
+	if len(tx.TxOut) == 0 {
+		return "has no outputs"
+	}
+
+	var total int64
+	for i, txOut := range tx.TxOut {
+		if txOut.Value < 0 || txOut.Value > maxSatoshi {
+			return fmt.Sprintf("output %d has an amount of %d which "+
+				"is out of range", i, txOut.Value)
+		}
+		total += txOut.Value
+		if total > maxSatoshi {
+			return fmt.Sprintf("outputs have a total amount of more "+
+				"than %d", int64(maxSatoshi))
+		}
+	}
+
+	if coinbase {
+		slen := len(tx.TxIn[0].SignatureScript)
+		if slen < minCoinbaseScriptLen || slen > maxCoinbaseScriptLen {
+			return fmt.Sprintf("has a coinbase script of %d bytes "+
+				"instead of %d to %d", slen, minCoinbaseScriptLen,
+				maxCoinbaseScriptLen)
+		}
+		return ""
+	}
+
+	spent := make(map[btcwire.OutPoint]struct{}, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		if isNullOutPoint(&txIn.PreviousOutpoint) {
+			return fmt.Sprintf("input %d spends a null output", i)
+		}
+		if _, ok := spent[txIn.PreviousOutpoint]; ok {
+			return fmt.Sprintf("input %d spends an output spent by an "+
+				"earlier input", i)
+		}
+		spent[txIn.PreviousOutpoint] = struct{}{}
+	}
+	return ""
+}
+
+// isNullOutPoint returns whether the passed outpoint is the one referenced by
+// the input of a coinbase, which has a zero hash and the maximum index.
+func isNullOutPoint(op *btcwire.OutPoint) bool {
+	return op.Index == math.MaxUint32 && op.Hash.IsEqual(&btcwire.ShaHash{})
+}
+
+// isCoinbaseTx returns whether the passed transaction is a coinbase, which has
+// a single input referencing the null outpoint.
+func isCoinbaseTx(tx *btcwire.MsgTx) bool {
+	return len(tx.TxIn) == 1 && isNullOutPoint(&tx.TxIn[0].PreviousOutpoint)
+}
+
+// shaToBig converts the passed hash, which is stored little endian, to a
+// big.Int so it can be compared with a target difficulty.
+func shaToBig(sha *btcwire.ShaHash) *big.Int {
+	buf := *sha
+	for i := 0; i < btcwire.HashSize/2; i++ {
+		buf[i], buf[btcwire.HashSize-1-i] = buf[btcwire.HashSize-1-i], buf[i]
+	}
+	return new(big.Int).SetBytes(buf[:])
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestValidation ensures every supported database type rejects the blocks
+// failing the checks of the validation mode it was created with and stores
+// blocks without checking them by default.
+func TestValidation(t *testing.T) {
+	if err := os.MkdirAll(testDbRoot, 0700); err != nil {
+		t.Errorf("Unable to create test db root: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDbRoot)
+
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+	stored, next := blocks[:10], blocks[10]
+
+	// mutate returns a copy of the passed block changed by the passed
+	// function.
+	mutate := func(block *btcutil.Block, f func(*btcwire.MsgBlock)) *btcutil.Block {
+		raw, _ := block.Bytes()
+		blkCopy, _ := btcutil.NewBlockFromBytes(raw)
+		f(blkCopy.MsgBlock())
+		return btcutil.NewBlock(blkCopy.MsgBlock())
+	}
+	prevSha, _ := stored[len(stored)-2].Sha()
+	badMerkle := mutate(next, func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Transactions[0].TxOut[0].Value--
+	})
+	badPow := mutate(next, func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Header.Nonce++
+	})
+	fork := mutate(next, func(msgBlock *btcwire.MsgBlock) {
+		msgBlock.Header.PrevBlock = *prevSha
+	})
+
+	// The rules checked in strict mode are exercised with a chain whose
+	// target difficulty is low enough to mine blocks here.
+	coinbase := func(tag byte, value int64) *btcwire.MsgTx {
+		tx := btcwire.NewMsgTx()
+		prevOut := btcwire.NewOutPoint(&zeroHash, math.MaxUint32)
+		tx.AddTxIn(btcwire.NewTxIn(prevOut, []byte{tag, tag}))
+		tx.AddTxOut(btcwire.NewTxOut(value, []byte{0x51}))
+		return tx
+	}
+	mine := func(prevSha *btcwire.ShaHash, txs ...*btcwire.MsgTx) *btcutil.Block {
+		hdr := btcwire.NewBlockHeader(prevSha, &zeroHash, 0x207fffff, 0)
+		hdr.Timestamp = time.Unix(1400000000, 0)
+		msgBlock := btcwire.NewMsgBlock(hdr)
+		for _, tx := range txs {
+			msgBlock.AddTransaction(tx)
+		}
+		block := btcutil.NewBlock(msgBlock)
+		msgBlock.Header.MerkleRoot =
+			btcdb.CalcMerkleRoot(block.Transactions())
+		for {
+			block = btcutil.NewBlock(msgBlock)
+			err := btcdb.CheckBlock(block, btcdb.ValidateSanity, nil)
+			if err == nil {
+				return block
+			}
+			msgBlock.Header.Nonce++
+		}
+	}
+	genesis := mine(&zeroHash, coinbase(0, 50*1e8))
+	genesisSha, _ := genesis.Sha()
+	twoCoinbases := mine(genesisSha, coinbase(1, 50*1e8),
+		coinbase(2, 50*1e8))
+	tooMuch := mine(genesisSha, coinbase(3, 21e6*1e8+1))
+	valid := mine(genesisSha, coinbase(4, 50*1e8))
+
+	tests := []struct {
+		name    string
+		mode    btcdb.ValidationMode
+		chain   []*btcutil.Block
+		block   *btcutil.Block
+		invalid bool
+	}{
+		{"unchecked merkle root", btcdb.ValidateNone, stored, badMerkle, false},
+		{"valid", btcdb.ValidateSanity, stored, next, false},
+		{"merkle root", btcdb.ValidateSanity, stored, badMerkle, true},
+		{"proof of work", btcdb.ValidateSanity, stored, badPow, true},
+		{"fork", btcdb.ValidateSanity, stored, fork, true},
+		{"unchecked output amount", btcdb.ValidateSanity,
+			[]*btcutil.Block{genesis}, tooMuch, false},
+		{"strict valid", btcdb.ValidateStrict,
+			[]*btcutil.Block{genesis}, valid, false},
+		{"coinbases", btcdb.ValidateStrict,
+			[]*btcutil.Block{genesis}, twoCoinbases, true},
+		{"output amount", btcdb.ValidateStrict,
+			[]*btcutil.Block{genesis}, tooMuch, true},
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+		for _, test := range tests {
+			opts := btcdb.Options{
+				Path: filepath.Join(testDbRoot,
+					"validatedb-"+dbType),
+				Validation: test.mode,
+			}
+			if dbType == "postgres" {
+				opts.Path = postgresDSN
+				if err := dropPostgresTables(); err != nil {
+					t.Errorf("Failed to drop postgres "+
+						"tables: %v", err)
+					continue
+				}
+			}
+			os.RemoveAll(opts.Path)
+			db, err := btcdb.CreateDBWithOptions(dbType, opts)
+			if err != nil {
+				t.Errorf("CreateDBWithOptions (%s): %v", dbType,
+					err)
+				continue
+			}
+			if _, err := db.InsertBlocks(test.chain); err != nil {
+				t.Errorf("InsertBlocks (%s) %s: %v", dbType,
+					test.name, err)
+				db.Close()
+				continue
+			}
+
+			_, err = db.InsertBlock(test.block)
+			_, isValidationErr := err.(*btcdb.ValidationError)
+			switch {
+			case test.invalid && !isValidationErr:
+				t.Errorf("InsertBlock (%s) %s: got %v, want a "+
+					"validation error", dbType, test.name, err)
+			case !test.invalid && err != nil:
+				t.Errorf("InsertBlock (%s) %s: %v", dbType,
+					test.name, err)
+			}
+
+			wantHeight := int64(len(test.chain))
+			if test.invalid {
+				wantHeight--
+			}
+			_, height, err := db.NewestSha()
+			if err != nil || height != wantHeight {
+				t.Errorf("NewestSha (%s) %s: got height %d, "+
+					"want %d (err %v)", dbType, test.name,
+					height, wantHeight, err)
+			}
+			db.Close()
+		}
+	}
+}
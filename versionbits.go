@@ -0,0 +1,352 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+const (
+	// VersionBits is the number of bits of the block version which
+	// deployments may signal with.
+	VersionBits = 29
+
+	// versionBitsTopMask is the mask of the bits of the block version
+	// which must equal versionBitsTopBits for the others to signal.
+	versionBitsTopMask = 0xe0000000
+
+	// versionBitsTopBits is the value of the top bits of block versions
+	// which signal for deployments.
+	versionBitsTopBits = 0x20000000
+)
+
+// VersionBitsPrefix is the prefix of the keys of the metadata namespace under
+// which a VersionBitsIndex keeps its state.
+var VersionBitsPrefix = []byte("btcdb/versionbits/")
+
+var (
+	// versionBitsTipKey is the key of the hash and height of the newest
+	// block indexed by the version bits index.
+	versionBitsTipKey = []byte("btcdb/versionbits/tip")
+
+	// versionBitsHeightPrefix is the prefix of the keys of the version of
+	// each block, which are followed by the height of the block as a big
+	// endian number.
+	versionBitsHeightPrefix = []byte("btcdb/versionbits/height/")
+
+	// versionBitsWindowPrefix is the prefix of the keys of the counts of
+	// each retarget window, which are followed by the number of the
+	// window as a big endian number.
+	versionBitsWindowPrefix = []byte("btcdb/versionbits/window/")
+)
+
+// versionBitsWindowLen is the length of the counts of a window: the number of
+// blocks followed by the number of blocks signalling each bit.
+const versionBitsWindowLen = 2 + 2*VersionBits
+
+// versionBitsHeightKey returns the key of the version of the block at the
+// passed height.
+func versionBitsHeightKey(height int64) []byte {
+	key := make([]byte, len(versionBitsHeightPrefix)+8)
+	copy(key, versionBitsHeightPrefix)
+	binary.BigEndian.PutUint64(key[len(versionBitsHeightPrefix):],
+		uint64(height))
+	return key
+}
+
+// versionBitsWindowKey returns the key of the counts of the passed window.
+func versionBitsWindowKey(window int64) []byte {
+	key := make([]byte, len(versionBitsWindowPrefix)+8)
+	copy(key, versionBitsWindowPrefix)
+	binary.BigEndian.PutUint64(key[len(versionBitsWindowPrefix):],
+		uint64(window))
+	return key
+}
+
+// VersionBitsWindow holds the number of blocks of a retarget window of the
+// chain which signal each bit of the block version, as recorded by a
+// VersionBitsIndex.  The window holds the blocks from StartHeight on, which
+// is a multiple of RetargetInterval, and is complete once it holds
+// RetargetInterval blocks.  Blocks only signal when the top three bits of
+// their version are 001, as set out by BIP0009.
+type VersionBitsWindow struct {
+	StartHeight int64
+	Blocks      int
+	Counts      [VersionBits]int
+}
+
+// Complete returns whether the window holds every block up to the next
+// retarget boundary.
+func (w *VersionBitsWindow) Complete() bool {
+	return w.Blocks == RetargetInterval
+}
+
+// serialize returns the stored form of the counts of the window.
+func (w *VersionBitsWindow) serialize() []byte {
+	buf := make([]byte, versionBitsWindowLen)
+	binary.LittleEndian.PutUint16(buf, uint16(w.Blocks))
+	for bit, count := range w.Counts {
+		binary.LittleEndian.PutUint16(buf[2+2*bit:], uint16(count))
+	}
+	return buf
+}
+
+// deserializeVersionBitsWindow returns the counts of the passed window stored
+// in the passed value.
+func deserializeVersionBitsWindow(window int64, val []byte) (*VersionBitsWindow, error) {
+	if len(val) != versionBitsWindowLen {
+		return nil, fmt.Errorf("malformed version bits window %x", val)
+	}
+	w := &VersionBitsWindow{
+		StartHeight: window * RetargetInterval,
+		Blocks:      int(binary.LittleEndian.Uint16(val)),
+	}
+	for bit := range w.Counts {
+		w.Counts[bit] = int(binary.LittleEndian.Uint16(val[2+2*bit:]))
+	}
+	return w, nil
+}
+
+// countVersionBits returns the counts of the window starting at the passed
+// height holding blocks with the passed versions.
+func countVersionBits(startHeight int64, versions []uint32) *VersionBitsWindow {
+	w := &VersionBitsWindow{StartHeight: startHeight, Blocks: len(versions)}
+	for _, version := range versions {
+		if version&versionBitsTopMask != versionBitsTopBits {
+			continue
+		}
+		for bit := range w.Counts {
+			if version&(1<<uint(bit)) != 0 {
+				w.Counts[bit]++
+			}
+		}
+	}
+	return w
+}
+
+// VersionBitsIndex is an indexer which counts the blocks of each retarget
+// window of the chain signalling each bit of the block version, so the
+// progress of soft fork deployments is followed with FetchVersionBitsWindow
+// and FetchThresholdWindow without reading the headers of the window.
+//
+// The versions of the blocks of the chain are kept in memory to count the
+// window of each block inserted, which takes 4 bytes per block.
+type VersionBitsIndex struct {
+	mtx      sync.Mutex
+	db       Db
+	versions []uint32
+}
+
+// Ensure VersionBitsIndex implements the Indexer interface.
+var _ Indexer = (*VersionBitsIndex)(nil)
+
+// NewVersionBitsIndex returns a version bits index which starts indexing once
+// it is added to a database with AddIndexer.
+func NewVersionBitsIndex() *VersionBitsIndex {
+	return new(VersionBitsIndex)
+}
+
+// Init loads the versions of the blocks indexed before from the passed
+// database.  The index is rebuilt from the genesis block when its tip is no
+// longer in the chain.  This is part of the Indexer interface implementation.
+func (idx *VersionBitsIndex) Init(db Db) error {
+	tipHeight, err := initIndexerState(db, "Version bits index",
+		VersionBitsPrefix, versionBitsTipKey)
+	if err != nil {
+		return err
+	}
+
+	var versions []uint32
+	iter, err := db.MetaIterator(versionBitsHeightPrefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for int64(len(versions)) <= tipHeight && iter.Next() {
+		height := int64(len(versions))
+		if !bytes.Equal(iter.Key(), versionBitsHeightKey(height)) ||
+			len(iter.Value()) != 4 {
+			return fmt.Errorf("version of block at height %d is "+
+				"missing", height)
+		}
+		versions = append(versions,
+			binary.LittleEndian.Uint32(iter.Value()))
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if int64(len(versions)) != tipHeight+1 {
+		return fmt.Errorf("block versions end at height %d before the "+
+			"tip at height %d", len(versions)-1, tipHeight)
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.versions = versions
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *VersionBitsIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, versionBitsTipKey)
+}
+
+// ConnectBlock adds the version of the passed block and the counts of its
+// window including it.  This is part of the Indexer interface implementation.
+func (idx *VersionBitsIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// Versions left by blocks which were disconnected, or whose
+	// connection failed to commit, are replaced.
+	if int64(len(idx.versions)) > height {
+		idx.versions = idx.versions[:height]
+	}
+	if int64(len(idx.versions)) != height {
+		return fmt.Errorf("version bits index is missing the blocks from "+
+			"height %d before block %v at height %d",
+			len(idx.versions), sha, height)
+	}
+	version := uint32(block.MsgBlock().Header.Version)
+	idx.versions = append(idx.versions, version)
+
+	val := make([]byte, 4)
+	binary.LittleEndian.PutUint32(val, version)
+	meta.Put(versionBitsHeightKey(height), val)
+	window := height / RetargetInterval
+	start := window * RetargetInterval
+	w := countVersionBits(start, idx.versions[start:])
+	meta.Put(versionBitsWindowKey(window), w.serialize())
+	putTipRecord(meta, versionBitsTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the version of the passed block and the block from
+// the counts of its window.  This is part of the Indexer interface
+// implementation.
+func (idx *VersionBitsIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// The version of a block whose connection failed to commit may have
+	// replaced the one of the block stored at its height.
+	version := uint32(block.MsgBlock().Header.Version)
+	if int64(len(idx.versions)) <= height || idx.versions[height] != version {
+		return fmt.Errorf("version bits index is out of step with the "+
+			"block at height %d", height)
+	}
+
+	meta.Delete(versionBitsHeightKey(height))
+	window := height / RetargetInterval
+	start := window * RetargetInterval
+	if height == start {
+		meta.Delete(versionBitsWindowKey(window))
+	} else {
+		w := countVersionBits(start, idx.versions[start:height])
+		meta.Put(versionBitsWindowKey(window), w.serialize())
+	}
+	putTipRecord(meta, versionBitsTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// FetchVersionBitsWindow returns the counts of the retarget window holding the
+// block at the passed height, as recorded by the VersionBitsIndex of the passed
+// database, including the blocks of the window up to the newest block indexed.
+// ErrBlockNotFound is returned when the index holds no block of the window and
+// ErrNoVersionBitsIndex when the database has no version bits index.
+func FetchVersionBitsWindow(db Db, height int64) (*VersionBitsWindow, error) {
+	tipSha, _, err := fetchTipRecord(db, versionBitsTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoVersionBitsIndex
+	}
+	if height < 0 {
+		return nil, ErrBlockNotFound
+	}
+	window := height / RetargetInterval
+	val, err := db.GetMeta(versionBitsWindowKey(window))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrBlockNotFound
+	}
+	return deserializeVersionBitsWindow(window, val)
+}
+
+// FetchThresholdWindow returns the first complete retarget window of the chain
+// of the passed database, starting at or after the passed height, in which at
+// least threshold blocks signal the passed bit, using the VersionBitsIndex of
+// the database.  Under BIP0009, a deployment using the bit locks in at the end
+// of that window, provided it had started, and is active from the end of the
+// window after it.  The usual thresholds are 1916 blocks on the main network
+// and 1512 on the test network.  Nil is returned when no window reaches the
+// threshold and ErrNoVersionBitsIndex when the database has no version bits
+// index.
+func FetchThresholdWindow(db Db, bit uint, threshold int, startHeight int64) (*VersionBitsWindow, error) {
+	if bit >= VersionBits {
+		return nil, fmt.Errorf("version bit %d is not a deployment bit",
+			bit)
+	}
+	tipSha, _, err := fetchTipRecord(db, versionBitsTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoVersionBitsIndex
+	}
+	if startHeight < 0 {
+		startHeight = 0
+	}
+
+	iter, err := db.MetaIterator(versionBitsWindowPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+	first := (startHeight + RetargetInterval - 1) / RetargetInterval
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) != len(versionBitsWindowPrefix)+8 {
+			return nil, fmt.Errorf("malformed version bits window "+
+				"key %x", key)
+		}
+		window := int64(binary.BigEndian.Uint64(
+			key[len(versionBitsWindowPrefix):]))
+		if window < first {
+			continue
+		}
+		w, err := deserializeVersionBitsWindow(window, iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if w.Complete() && w.Counts[bit] >= threshold {
+			return w, nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// TestVersionBits ensures the version bits index counts the blocks of each
+// retarget window signalling each bit for every supported database type as
+// blocks are inserted and dropped.
+func TestVersionBits(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The second window has blocks signalling bit 1, blocks setting bit
+	// 0 without the top bits of BIP0009, which do not signal, and blocks
+	// signalling bit 0.
+	chain := append([]*btcutil.Block{blocks[0]},
+		mineRun(blocks[0], btcdb.RetargetInterval-1, 0x1d00ffff,
+			btcwire.BlockVersion)...)
+	for _, run := range []struct {
+		n       int
+		version int32
+	}{{100, 0x20000002}, {16, 0x60000001}, {1900, 0x20000001},
+		{4, 0x20000003}} {
+		chain = append(chain, mineRun(chain[len(chain)-1], run.n,
+			0x1d00ffff, run.version)...)
+	}
+
+	// checkWindow ensures the window holding the passed height has the
+	// passed number of blocks and of blocks signalling bits 0 and 1.
+	checkWindow := func(dbType, desc string, db btcdb.Db, height int64, blocks, bit0, bit1 int) {
+		w, err := btcdb.FetchVersionBitsWindow(db, height)
+		if err != nil || w.StartHeight != height/btcdb.RetargetInterval*
+			btcdb.RetargetInterval || w.Blocks != blocks ||
+			w.Counts[0] != bit0 || w.Counts[1] != bit1 {
+			t.Errorf("FetchVersionBitsWindow (%s) %s: got %+v (err "+
+				"%v) at height %d, want %d blocks with %d and %d "+
+				"signalling", dbType, desc, w, err, height, blocks,
+				bit0, bit1)
+		}
+	}
+
+	// checkThreshold ensures the first window in which bit 0 reaches the
+	// passed threshold starts at the passed height, or that there is none
+	// when it is negative.
+	checkThreshold := func(dbType, desc string, db btcdb.Db, threshold int, want int64) {
+		w, err := btcdb.FetchThresholdWindow(db, 0, threshold, 0)
+		got := int64(-1)
+		if w != nil {
+			got = w.StartHeight
+		}
+		if err != nil || got != want {
+			t.Errorf("FetchThresholdWindow (%s) %s: got %d (err %v) "+
+				"for threshold %d, want %d", dbType, desc, got,
+				err, threshold, want)
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "versionbits", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(chain[:3000]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.FetchVersionBitsWindow(db, 0); err != btcdb.ErrNoVersionBitsIndex {
+			t.Errorf("FetchVersionBitsWindow (%s): got %v without an "+
+				"index, want %v", dbType, err,
+				btcdb.ErrNoVersionBitsIndex)
+		}
+
+		// The index is caught up with the blocks already stored and
+		// kept up to date by those inserted and dropped later.
+		if err := db.AddIndexer(btcdb.NewVersionBitsIndex()); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkWindow(dbType, "of the first window", db, 5, 2016, 0, 0)
+		checkWindow(dbType, "after catching up", db, 2999, 984, 868,
+			100)
+		if _, err := db.InsertBlocks(chain[3000:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkWindow(dbType, "after inserting blocks", db, 2016, 2016,
+			1900, 100)
+		checkWindow(dbType, "of the last window", db, 4035, 4, 4, 4)
+		checkThreshold(dbType, "after inserting blocks", db, 1900, 2016)
+		checkThreshold(dbType, "above the signalling blocks", db, 1901,
+			-1)
+
+		keepSha, _ := chain[3015].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkWindow(dbType, "after dropping blocks", db, 3015, 1000, 884,
+			100)
+		if _, err := btcdb.FetchVersionBitsWindow(db, 4032); err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchVersionBitsWindow (%s): got %v for a "+
+				"dropped window, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		checkThreshold(dbType, "after dropping blocks", db, 1900, -1)
+		if _, err := db.InsertBlocks(chain[3016:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkThreshold(dbType, "after reinserting blocks", db, 1900,
+			2016)
+		teardown()
+	}
+}
@@ -0,0 +1,677 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+	"sync"
+)
+
+// WatchIndexPrefix is the prefix of the keys of the metadata namespace under
+// which a WatchIndex keeps the history of the scripts it watches.
+var WatchIndexPrefix = []byte("btcdb/watch/")
+
+// WatchSetPrefix is the prefix of the keys of the metadata namespace under which
+// the scripts and outpoints watched by a WatchIndex are kept.  It is separate
+// from WatchIndexPrefix so the watched set outlives rebuilding the index.
+var WatchSetPrefix = []byte("btcdb/watchset/")
+
+var (
+	// watchTipKey is the key of the hash and height of the newest block
+	// indexed by the watch index.
+	watchTipKey = []byte("btcdb/watch/tip")
+
+	// watchHistoryPrefix is the prefix of the keys of the history of the
+	// watched scripts.  Each is followed by the hash of the script, the
+	// height of the block as a big endian number, the hash of the
+	// transaction, the index of the output or input as a big endian
+	// number and whether the entry spends an output.  The value of an
+	// output is its value, followed by the input spending it once it is
+	// spent, and the one of an input is the outpoint spent.
+	watchHistoryPrefix = []byte("btcdb/watch/history/")
+
+	// watchOutPointPrefix is the prefix of the keys of the outputs paying
+	// to the watched scripts, which are followed by the outpoint and hold
+	// the hash of the script followed by the height of the output as a big
+	// endian number.
+	watchOutPointPrefix = []byte("btcdb/watch/outpoint/")
+
+	// watchSetScriptPrefix is the prefix of the keys of the watched
+	// scripts, which are followed by the hash of the script and hold the
+	// script.
+	watchSetScriptPrefix = []byte("btcdb/watchset/script/")
+
+	// watchSetOutPointPrefix is the prefix of the keys of the outpoints
+	// watched on their own, which are followed by the outpoint and hold
+	// the hash of the script the output pays to.
+	watchSetOutPointPrefix = []byte("btcdb/watchset/outpoint/")
+
+	// watchVersionKey is the key of the version of the records of the watch
+	// index.  It is kept outside of WatchIndexPrefix so it survives the
+	// index being rebuilt.
+	watchVersionKey = []byte("btcdb/version/watch")
+)
+
+// watchVersion is the version of the records of the watch index.  The output
+// entries of the history written before version 1 do not record whether the
+// output is spent, and are rebuilt.
+const watchVersion = 1
+
+// watchSpenderLen is the length of the input spending a watched output stored
+// after the value of the output: the outpoint of the input followed by the
+// height of its block.
+const watchSpenderLen = watchOutPointLen + 8
+
+// watchOutPointLen is the length of a serialized outpoint: the hash of the
+// transaction followed by the index of the output as a big endian number.
+const watchOutPointLen = btcwire.HashSize + 4
+
+// watchHistoryEntryLen is the length of the keys of the history after
+// watchHistoryPrefix.
+const watchHistoryEntryLen = btcwire.HashSize + 8 + btcwire.HashSize + 4 + 1
+
+// WatchScriptHash returns the hash the history of the passed script is kept
+// under, which is its single SHA-256 hash.
+func WatchScriptHash(script []byte) btcwire.ShaHash {
+	return btcwire.ShaHash(sha256.Sum256(script))
+}
+
+// serializeOutPoint returns the serialized form of the passed outpoint.
+func serializeOutPoint(op *btcwire.OutPoint) []byte {
+	buf := make([]byte, watchOutPointLen)
+	copy(buf, op.Hash.Bytes())
+	binary.BigEndian.PutUint32(buf[btcwire.HashSize:], op.Index)
+	return buf
+}
+
+// deserializeOutPoint returns the outpoint serialized in the passed value.
+func deserializeOutPoint(val []byte) (*btcwire.OutPoint, error) {
+	if len(val) != watchOutPointLen {
+		return nil, fmt.Errorf("malformed outpoint %x", val)
+	}
+	op := new(btcwire.OutPoint)
+	copy(op.Hash[:], val)
+	op.Index = binary.BigEndian.Uint32(val[btcwire.HashSize:])
+	return op, nil
+}
+
+// watchOutPointKey returns the key of the passed outpoint under the passed
+// prefix.
+func watchOutPointKey(prefix []byte, op *btcwire.OutPoint) []byte {
+	key := make([]byte, len(prefix)+watchOutPointLen)
+	copy(key, prefix)
+	copy(key[len(prefix):], serializeOutPoint(op))
+	return key
+}
+
+// watchSetScriptKey returns the key of the watched script with the passed
+// hash.
+func watchSetScriptKey(scriptHash *btcwire.ShaHash) []byte {
+	key := make([]byte, len(watchSetScriptPrefix)+btcwire.HashSize)
+	copy(key, watchSetScriptPrefix)
+	copy(key[len(watchSetScriptPrefix):], scriptHash.Bytes())
+	return key
+}
+
+// watchHistoryScriptPrefix returns the prefix of the keys of the history of
+// the watched script with the passed hash.
+func watchHistoryScriptPrefix(scriptHash *btcwire.ShaHash) []byte {
+	key := make([]byte, len(watchHistoryPrefix)+btcwire.HashSize)
+	copy(key, watchHistoryPrefix)
+	copy(key[len(watchHistoryPrefix):], scriptHash.Bytes())
+	return key
+}
+
+// watchHistoryKey returns the key of the history entry of the watched script
+// with the passed hash for the output or input with the passed location.
+func watchHistoryKey(scriptHash *btcwire.ShaHash, height int64, txSha *btcwire.ShaHash, index uint32, spent bool) []byte {
+	off := len(watchHistoryPrefix) + btcwire.HashSize
+	key := make([]byte, len(watchHistoryPrefix)+watchHistoryEntryLen)
+	copy(key, watchHistoryScriptPrefix(scriptHash))
+	binary.BigEndian.PutUint64(key[off:], uint64(height))
+	off += 8
+	copy(key[off:], txSha.Bytes())
+	off += btcwire.HashSize
+	binary.BigEndian.PutUint32(key[off:], index)
+	if spent {
+		key[len(key)-1] = 1
+	}
+	return key
+}
+
+// WatchEvent is an entry of the history of a script watched by a WatchIndex.
+// It is either an output paying to the script, in which case Index is the
+// index of the output, Value its value and SpentBy the input spending it, if
+// any, or an input spending such an output, in which case Spent is set, Index
+// is the index of the input and PrevOut the output spent.
+type WatchEvent struct {
+	Height  int64
+	TxSha   btcwire.ShaHash
+	Index   uint32
+	Spent   bool
+	Value   int64
+	SpentBy *SpendingTx
+	PrevOut btcwire.OutPoint
+}
+
+// serializeWatchedOutput returns the value of the history entry of an output
+// with the passed value spent by the passed input, which is nil while the
+// output is unspent.
+func serializeWatchedOutput(value int64, spentBy *SpendingTx) []byte {
+	if spentBy == nil {
+		val := make([]byte, 8)
+		binary.LittleEndian.PutUint64(val, uint64(value))
+		return val
+	}
+	val := make([]byte, 8+watchSpenderLen)
+	binary.LittleEndian.PutUint64(val, uint64(value))
+	op := btcwire.NewOutPoint(spentBy.Sha, spentBy.InputIndex)
+	off := 8 + copy(val[8:], serializeOutPoint(op))
+	binary.LittleEndian.PutUint64(val[off:], uint64(spentBy.Height))
+	return val
+}
+
+// deserializeWatchedOutput sets the value of the passed output entry and the
+// input spending it from the passed value of the entry.
+func deserializeWatchedOutput(ev *WatchEvent, val []byte) error {
+	if len(val) != 8 && len(val) != 8+watchSpenderLen {
+		return fmt.Errorf("malformed watched output value %x", val)
+	}
+	ev.Value = int64(binary.LittleEndian.Uint64(val))
+	if len(val) == 8 {
+		return nil
+	}
+	op, err := deserializeOutPoint(val[8 : 8+watchOutPointLen])
+	if err != nil {
+		return err
+	}
+	ev.SpentBy = &SpendingTx{
+		Sha:        &op.Hash,
+		Height:     int64(binary.LittleEndian.Uint64(val[8+watchOutPointLen:])),
+		InputIndex: op.Index,
+	}
+	return nil
+}
+
+// WatchIndex is an optional indexer which records the outputs of the chain
+// paying to a persistent set of watched scripts and the inputs spending them,
+// so watch-only wallets read the history of their scripts with
+// FetchWatchHistory rather than from a full address index.  Outputs which
+// paid to scripts that are not watched, such as those of a wallet restored
+// from its keys, are watched on their own with WatchOutPoint, so their spends
+// are recorded.
+//
+// Scripts and outpoints are only matched in the blocks inserted after they are
+// watched, and the watched set is kept in memory.  The history of earlier
+// blocks is found with Rescan.
+type WatchIndex struct {
+	mtx       sync.Mutex
+	db        Db
+	scripts   map[btcwire.ShaHash]struct{}
+	outpoints map[btcwire.OutPoint]btcwire.ShaHash
+}
+
+// Ensure WatchIndex implements the Indexer interface.
+var _ Indexer = (*WatchIndex)(nil)
+
+// NewWatchIndex returns a watch index which starts indexing once it is added to
+// a database with AddIndexer.
+func NewWatchIndex() *WatchIndex {
+	return new(WatchIndex)
+}
+
+// loadWatchedOutPoints adds the outpoints stored under the passed prefix, along
+// with the hash of the script they pay to, to the passed map.  The value of
+// each outpoint starts with the hash.
+func loadWatchedOutPoints(db Db, prefix []byte, outpoints map[btcwire.OutPoint]btcwire.ShaHash) error {
+	iter, err := db.MetaIterator(prefix)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for iter.Next() {
+		op, err := deserializeOutPoint(iter.Key()[len(prefix):])
+		if err != nil {
+			return err
+		}
+		if len(iter.Value()) < btcwire.HashSize {
+			return fmt.Errorf("malformed script hash of watched "+
+				"outpoint %v", op)
+		}
+		var scriptHash btcwire.ShaHash
+		copy(scriptHash[:], iter.Value()[:btcwire.HashSize])
+		outpoints[*op] = scriptHash
+	}
+	return iter.Err()
+}
+
+// Init loads the watched scripts and outpoints from the passed database.  The
+// history is rebuilt from the genesis block when the tip of the index is no
+// longer in the chain or its records were written by another version of the
+// index.  This is part of the Indexer interface implementation.
+func (idx *WatchIndex) Init(db Db) error {
+	_, err := initVersionedIndexerState(db, "Watch index",
+		WatchIndexPrefix, watchTipKey, watchVersionKey, watchVersion)
+	if err != nil {
+		return err
+	}
+
+	scripts := make(map[btcwire.ShaHash]struct{})
+	iter, err := db.MetaIterator(watchSetScriptPrefix)
+	if err != nil {
+		return err
+	}
+	for iter.Next() {
+		scripts[WatchScriptHash(iter.Value())] = struct{}{}
+	}
+	err = iter.Err()
+	iter.Release()
+	if err != nil {
+		return err
+	}
+
+	outpoints := make(map[btcwire.OutPoint]btcwire.ShaHash)
+	err = loadWatchedOutPoints(db, watchSetOutPointPrefix, outpoints)
+	if err != nil {
+		return err
+	}
+	err = loadWatchedOutPoints(db, watchOutPointPrefix, outpoints)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.db = db
+	idx.scripts = scripts
+	idx.outpoints = outpoints
+	idx.mtx.Unlock()
+	return nil
+}
+
+// Tip returns the newest block indexed as of the committed state of the
+// metadata namespace.  This is part of the Indexer interface implementation.
+func (idx *WatchIndex) Tip() (*btcwire.ShaHash, int64, error) {
+	idx.mtx.Lock()
+	db := idx.db
+	idx.mtx.Unlock()
+
+	return fetchTipRecord(db, watchTipKey)
+}
+
+// forEachWatched calls the passed functions with every input of the passed
+// block spending a watched outpoint and every output paying to a watched
+// script until one of them fails.  It must be called with the lock held.
+func (idx *WatchIndex) forEachWatched(block *btcutil.Block, spend func(tx *btcutil.Tx, i int, scriptHash *btcwire.ShaHash) error, pay func(tx *btcutil.Tx, i int, scriptHash *btcwire.ShaHash)) error {
+	for _, tx := range block.Transactions() {
+		for i, txIn := range tx.MsgTx().TxIn {
+			scriptHash, ok := idx.outpoints[txIn.PreviousOutpoint]
+			if !ok {
+				continue
+			}
+			if err := spend(tx, i, &scriptHash); err != nil {
+				return err
+			}
+		}
+		for i, txOut := range tx.MsgTx().TxOut {
+			scriptHash := WatchScriptHash(txOut.PkScript)
+			if _, ok := idx.scripts[scriptHash]; ok {
+				pay(tx, i, &scriptHash)
+			}
+		}
+	}
+	return nil
+}
+
+// setSpentBy adds recording the passed input as the one spending the passed
+// output to its history entry to the passed batch, or recording that the
+// output is unspent when the input is nil.  Outputs watched on their own have
+// no entry and are left alone, as are outputs whose entry is removed by the
+// batch.
+func setSpentBy(meta *MetaBatch, op *btcwire.OutPoint, spentBy *SpendingTx) error {
+	val, err := meta.Get(watchOutPointKey(watchOutPointPrefix, op))
+	if err != nil || val == nil {
+		return err
+	}
+	if len(val) != btcwire.HashSize+8 {
+		return fmt.Errorf("malformed watched outpoint %v", op)
+	}
+	var scriptHash btcwire.ShaHash
+	copy(scriptHash[:], val)
+	height := int64(binary.BigEndian.Uint64(val[btcwire.HashSize:]))
+
+	key := watchHistoryKey(&scriptHash, height, &op.Hash, op.Index, false)
+	entry, err := meta.Get(key)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("history entry of watched output %v is "+
+			"missing", op)
+	}
+	var ev WatchEvent
+	if err := deserializeWatchedOutput(&ev, entry); err != nil {
+		return err
+	}
+	meta.Put(key, serializeWatchedOutput(ev.Value, spentBy))
+	return nil
+}
+
+// ConnectBlock adds the history entries of the passed block, records the
+// inputs of the block as spending the watched outputs they spend and watches
+// the outputs it pays to watched scripts.  This is part of the Indexer
+// interface implementation.
+func (idx *WatchIndex) ConnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	sha, err := block.Sha()
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	err = idx.forEachWatched(block, func(tx *btcutil.Tx, i int, scriptHash *btcwire.ShaHash) error {
+		prevOut := &tx.MsgTx().TxIn[i].PreviousOutpoint
+		meta.Put(watchHistoryKey(scriptHash, height, tx.Sha(), uint32(i),
+			true), serializeOutPoint(prevOut))
+		return setSpentBy(meta, prevOut, &SpendingTx{
+			Sha:        tx.Sha(),
+			Height:     height,
+			InputIndex: uint32(i),
+		})
+	}, func(tx *btcutil.Tx, i int, scriptHash *btcwire.ShaHash) {
+		meta.Put(watchHistoryKey(scriptHash, height, tx.Sha(), uint32(i),
+			false), serializeWatchedOutput(tx.MsgTx().TxOut[i].Value,
+			nil))
+
+		op := btcwire.NewOutPoint(tx.Sha(), uint32(i))
+		val := make([]byte, btcwire.HashSize+8)
+		copy(val, scriptHash.Bytes())
+		binary.BigEndian.PutUint64(val[btcwire.HashSize:], uint64(height))
+		meta.Put(watchOutPointKey(watchOutPointPrefix, op), val)
+		idx.outpoints[*op] = *scriptHash
+	})
+	if err != nil {
+		return err
+	}
+	putTipRecord(meta, watchTipKey, sha, height)
+	return nil
+}
+
+// DisconnectBlock removes the history entries of the passed block and the
+// outputs it paid to watched scripts, and records the outputs it spent as
+// unspent again.  This is part of the Indexer interface implementation.
+func (idx *WatchIndex) DisconnectBlock(block *btcutil.Block, height int64, spent []*UtxoEntry, meta *MetaBatch) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// The outputs stay watched in memory, since the change may fail to
+	// commit, and outputs of blocks no longer in the chain are never
+	// spent by it.
+	err := idx.forEachWatched(block, func(tx *btcutil.Tx, i int, scriptHash *btcwire.ShaHash) error {
+		meta.Delete(watchHistoryKey(scriptHash, height, tx.Sha(),
+			uint32(i), true))
+		prevOut := &tx.MsgTx().TxIn[i].PreviousOutpoint
+		return setSpentBy(meta, prevOut, nil)
+	}, func(tx *btcutil.Tx, i int, scriptHash *btcwire.ShaHash) {
+		meta.Delete(watchHistoryKey(scriptHash, height, tx.Sha(),
+			uint32(i), false))
+		op := btcwire.NewOutPoint(tx.Sha(), uint32(i))
+		meta.Delete(watchOutPointKey(watchOutPointPrefix, op))
+	})
+	if err != nil {
+		return err
+	}
+	putTipRecord(meta, watchTipKey,
+		&block.MsgBlock().Header.PrevBlock, height-1)
+	return nil
+}
+
+// watchedDb returns the database the index was added to.
+func (idx *WatchIndex) watchedDb() (Db, error) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	if idx.db == nil {
+		return nil, ErrNotWatching
+	}
+	return idx.db, nil
+}
+
+// WatchScript adds the passed output script to the watched set, so the
+// outputs of the blocks inserted from then on which pay to it, and the inputs
+// spending those outputs, are recorded in its history.
+func (idx *WatchIndex) WatchScript(script []byte) error {
+	db, err := idx.watchedDb()
+	if err != nil {
+		return err
+	}
+	scriptHash := WatchScriptHash(script)
+	var meta MetaBatch
+	meta.Put(watchSetScriptKey(&scriptHash), script)
+	if err := db.WriteMeta(&meta); err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.scripts[scriptHash] = struct{}{}
+	idx.mtx.Unlock()
+	return nil
+}
+
+// WatchOutPoint adds the passed stored output to the watched set, so the
+// inputs of the blocks inserted from then on which spend it are recorded in
+// the history of the script it pays to.
+func (idx *WatchIndex) WatchOutPoint(op *btcwire.OutPoint) error {
+	db, err := idx.watchedDb()
+	if err != nil {
+		return err
+	}
+	replies, err := db.FetchTxBySha(&op.Hash)
+	if err != nil {
+		return err
+	}
+	if len(replies) == 0 {
+		return ErrTxNotFound
+	}
+	tx := replies[len(replies)-1].Tx
+	if op.Index >= uint32(len(tx.TxOut)) {
+		return fmt.Errorf("transaction %v has no output %d", &op.Hash,
+			op.Index)
+	}
+	scriptHash := WatchScriptHash(tx.TxOut[op.Index].PkScript)
+	var meta MetaBatch
+	meta.Put(watchOutPointKey(watchSetOutPointPrefix, op),
+		scriptHash.Bytes())
+	if err := db.WriteMeta(&meta); err != nil {
+		return err
+	}
+
+	idx.mtx.Lock()
+	idx.outpoints[*op] = scriptHash
+	idx.mtx.Unlock()
+	return nil
+}
+
+// UnwatchScript removes the passed output script from the watched set along
+// with its history and the outputs watched because they pay to it.
+func (idx *WatchIndex) UnwatchScript(script []byte) error {
+	db, err := idx.watchedDb()
+	if err != nil {
+		return err
+	}
+
+	// The script is no longer matched before its history is removed, so
+	// blocks inserted meanwhile do not add to it.
+	scriptHash := WatchScriptHash(script)
+	idx.mtx.Lock()
+	delete(idx.scripts, scriptHash)
+	for op, opScriptHash := range idx.outpoints {
+		if opScriptHash == scriptHash {
+			delete(idx.outpoints, op)
+		}
+	}
+	idx.mtx.Unlock()
+
+	var meta MetaBatch
+	meta.Delete(watchSetScriptKey(&scriptHash))
+	prefixes := [][]byte{
+		watchHistoryScriptPrefix(&scriptHash),
+		watchOutPointPrefix,
+		watchSetOutPointPrefix,
+	}
+	for i, prefix := range prefixes {
+		iter, err := db.MetaIterator(prefix)
+		if err != nil {
+			return err
+		}
+		for iter.Next() {
+			if i == 0 || bytes.HasPrefix(iter.Value(), scriptHash.Bytes()) {
+				meta.Delete(append([]byte(nil), iter.Key()...))
+			}
+		}
+		err = iter.Err()
+		iter.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return db.WriteMeta(&meta)
+}
+
+// FetchWatchedScripts returns the scripts watched by the WatchIndex of the
+// passed database, ordered by their hash.
+func FetchWatchedScripts(db Db) ([][]byte, error) {
+	iter, err := db.MetaIterator(watchSetScriptPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var scripts [][]byte
+	for iter.Next() {
+		scripts = append(scripts, append([]byte(nil), iter.Value()...))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return scripts, nil
+}
+
+// WatchHistoryQuery selects the entries of the history of a watched script
+// returned by FetchWatchHistoryPage.  ReceivedOnly keeps only the outputs
+// paying to the script and UnspentOnly only those outputs which are not spent
+// by an input of the history.  The entries kept are ordered as by
+// FetchWatchHistory, or the other way around when NewestFirst is set, and the
+// first Skip of them are passed over before at most Limit are returned, with a
+// Limit which is not positive returning every one.
+type WatchHistoryQuery struct {
+	Skip         int
+	Limit        int
+	NewestFirst  bool
+	ReceivedOnly bool
+	UnspentOnly  bool
+}
+
+// forEachWatchEvent calls the passed function with every entry of the history
+// stored under the passed prefix, from the newest when reverse is set, until
+// it returns false.
+func forEachWatchEvent(db Db, prefix []byte, reverse bool, fn func(ev *WatchEvent) bool) error {
+	var iter MetaIterator
+	var err error
+	if reverse {
+		iter, err = db.ReverseMetaIterator(prefix)
+	} else {
+		iter, err = db.MetaIterator(prefix)
+	}
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) != len(watchHistoryPrefix)+watchHistoryEntryLen {
+			return fmt.Errorf("malformed watch history key %x", key)
+		}
+		off := len(prefix)
+		ev := &WatchEvent{
+			Height: int64(binary.BigEndian.Uint64(key[off:])),
+		}
+		off += 8
+		copy(ev.TxSha[:], key[off:])
+		off += btcwire.HashSize
+		ev.Index = binary.BigEndian.Uint32(key[off:])
+		off += 4
+		ev.Spent = key[off] != 0
+
+		val := iter.Value()
+		if ev.Spent {
+			prevOut, err := deserializeOutPoint(val)
+			if err != nil {
+				return err
+			}
+			ev.PrevOut = *prevOut
+		} else if err := deserializeWatchedOutput(ev, val); err != nil {
+			return err
+		}
+		if !fn(ev) {
+			break
+		}
+	}
+	return iter.Err()
+}
+
+// FetchWatchHistory returns the history of the passed script recorded by the
+// WatchIndex of the passed database, ordered by height, then by the hash of
+// the transaction and then by the index of the output or input, with an output
+// before the input with the same index.  ErrNoWatchIndex is returned when the
+// database has no watch index.
+func FetchWatchHistory(db Db, script []byte) ([]*WatchEvent, error) {
+	return FetchWatchHistoryPage(db, script, WatchHistoryQuery{})
+}
+
+// FetchWatchHistoryPage returns the entries of the history of the passed script
+// recorded by the WatchIndex of the passed database which are selected by the
+// passed query, so the history of scripts with many transactions is served a
+// page at a time.  The history is read from the end the page starts at and
+// reading stops once the page is complete.  ErrNoWatchIndex is returned when
+// the database has no watch index.
+func FetchWatchHistoryPage(db Db, script []byte, q WatchHistoryQuery) ([]*WatchEvent, error) {
+	tipSha, _, err := fetchTipRecord(db, watchTipKey)
+	if err != nil {
+		return nil, err
+	}
+	if tipSha == nil {
+		return nil, ErrNoWatchIndex
+	}
+
+	scriptHash := WatchScriptHash(script)
+	prefix := watchHistoryScriptPrefix(&scriptHash)
+	var events []*WatchEvent
+	skipped := 0
+	err = forEachWatchEvent(db, prefix, q.NewestFirst, func(ev *WatchEvent) bool {
+		if ev.Spent && (q.ReceivedOnly || q.UnspentOnly) {
+			return true
+		}
+		if q.UnspentOnly && ev.SpentBy != nil {
+			return true
+		}
+		if skipped < q.Skip {
+			skipped++
+			return true
+		}
+		events = append(events, ev)
+		return q.Limit <= 0 || len(events) < q.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
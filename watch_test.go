@@ -0,0 +1,247 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// watchEvents implements sort.Interface to sort watch events in the order of
+// FetchWatchHistory.
+type watchEvents []*btcdb.WatchEvent
+
+func (s watchEvents) Len() int      { return len(s) }
+func (s watchEvents) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s watchEvents) Less(i, j int) bool {
+	if s[i].Height != s[j].Height {
+		return s[i].Height < s[j].Height
+	}
+	if c := bytes.Compare(s[i].TxSha[:], s[j].TxSha[:]); c != 0 {
+		return c < 0
+	}
+	if s[i].Index != s[j].Index {
+		return s[i].Index < s[j].Index
+	}
+	return !s[i].Spent && s[j].Spent
+}
+
+// TestWatchIndex ensures the watch index records the outputs paying to the
+// watched scripts and the inputs spending them, or spending the outpoints
+// watched on their own, as blocks are inserted and dropped for all supported
+// database types.
+func TestWatchIndex(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// The coinbase of block 9 is spent by block 170, which pays change to
+	// the same script, as do the transactions spending the change in turn.
+	script := blocks[9].MsgBlock().Transactions[0].TxOut[0].PkScript
+	coinbase := btcwire.NewOutPoint(blocks[9].Transactions()[0].Sha(), 0)
+
+	// wantHistory returns the history expected once the blocks after the
+	// first 100 up to the passed height are inserted, with the outputs
+	// spent by the inputs of the history recording them.
+	wantHistory := func(tipHeight int64) []*btcdb.WatchEvent {
+		watched := map[btcwire.OutPoint]bool{*coinbase: true}
+		outputs := make(map[btcwire.OutPoint]*btcdb.WatchEvent)
+		var events watchEvents
+		for height := int64(100); height <= tipHeight; height++ {
+			for _, tx := range blocks[height].Transactions() {
+				for i, txIn := range tx.MsgTx().TxIn {
+					if !watched[txIn.PreviousOutpoint] {
+						continue
+					}
+					if out := outputs[txIn.PreviousOutpoint]; out != nil {
+						out.SpentBy = &btcdb.SpendingTx{
+							Sha:        tx.Sha(),
+							Height:     height,
+							InputIndex: uint32(i),
+						}
+					}
+					events = append(events, &btcdb.WatchEvent{
+						Height:  height,
+						TxSha:   *tx.Sha(),
+						Index:   uint32(i),
+						Spent:   true,
+						PrevOut: txIn.PreviousOutpoint,
+					})
+				}
+				for i, txOut := range tx.MsgTx().TxOut {
+					if !bytes.Equal(txOut.PkScript, script) {
+						continue
+					}
+					op := btcwire.NewOutPoint(tx.Sha(), uint32(i))
+					watched[*op] = true
+					outputs[*op] = &btcdb.WatchEvent{
+						Height: height,
+						TxSha:  *tx.Sha(),
+						Index:  uint32(i),
+						Value:  txOut.Value,
+					}
+					events = append(events, outputs[*op])
+				}
+			}
+		}
+		sort.Sort(events)
+		return events
+	}
+
+	// checkHistory ensures the history of the script is the one expected
+	// up to the passed height.
+	checkHistory := func(dbType string, db btcdb.Db, tipHeight int64) {
+		got, err := btcdb.FetchWatchHistory(db, script)
+		want := wantHistory(tipHeight)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("FetchWatchHistory (%s): got %d events (err %v) "+
+				"up to height %d, want %d", dbType, len(got), err,
+				tipHeight, len(want))
+		}
+	}
+
+	// wantPage returns the entries of the passed history selected by the
+	// passed query.
+	wantPage := func(history []*btcdb.WatchEvent, q btcdb.WatchHistoryQuery) []*btcdb.WatchEvent {
+		var events []*btcdb.WatchEvent
+		for i := range history {
+			ev := history[i]
+			if q.NewestFirst {
+				ev = history[len(history)-1-i]
+			}
+			if ev.Spent && (q.ReceivedOnly || q.UnspentOnly) {
+				continue
+			}
+			if q.UnspentOnly && ev.SpentBy != nil {
+				continue
+			}
+			events = append(events, ev)
+		}
+		if q.Skip >= len(events) {
+			return nil
+		}
+		events = events[q.Skip:]
+		if q.Limit > 0 && len(events) > q.Limit {
+			events = events[:q.Limit]
+		}
+		return events
+	}
+
+	// checkPages ensures the pages of the history of the script are the
+	// ones expected up to the passed height.
+	checkPages := func(dbType string, db btcdb.Db, tipHeight int64) {
+		history := wantHistory(tipHeight)
+		queries := []btcdb.WatchHistoryQuery{
+			{Limit: 3},
+			{Skip: 2, Limit: 3},
+			{Skip: 2},
+			{Skip: len(history)},
+			{NewestFirst: true},
+			{Skip: 1, Limit: 2, NewestFirst: true},
+			{Skip: len(history) - 1, Limit: 5, NewestFirst: true},
+			{ReceivedOnly: true},
+			{Limit: 2, ReceivedOnly: true, NewestFirst: true},
+			{UnspentOnly: true},
+			{Skip: 1, UnspentOnly: true, NewestFirst: true},
+		}
+		for _, q := range queries {
+			got, err := btcdb.FetchWatchHistoryPage(db, script, q)
+			want := wantPage(history, q)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("FetchWatchHistoryPage (%s) %+v: got %d "+
+					"events (err %v), want %d", dbType, q,
+					len(got), err, len(want))
+			}
+		}
+		unspent := wantPage(history, btcdb.WatchHistoryQuery{
+			UnspentOnly: true})
+		if len(unspent) == 0 || len(unspent) == len(wantPage(history,
+			btcdb.WatchHistoryQuery{ReceivedOnly: true})) {
+			t.Errorf("FetchWatchHistoryPage (%s): history has %d "+
+				"unspent outputs, want some but not all", dbType,
+				len(unspent))
+		}
+	}
+
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "watch", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks[:100]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if _, err := btcdb.FetchWatchHistory(db, script); err != btcdb.ErrNoWatchIndex {
+			t.Errorf("FetchWatchHistory (%s): got %v without an index, "+
+				"want %v", dbType, err, btcdb.ErrNoWatchIndex)
+		}
+
+		idx := btcdb.NewWatchIndex()
+		if err := idx.WatchScript(script); err != btcdb.ErrNotWatching {
+			t.Errorf("WatchScript (%s): got %v before AddIndexer, "+
+				"want %v", dbType, err, btcdb.ErrNotWatching)
+		}
+		if err := db.AddIndexer(idx); err != nil {
+			t.Errorf("AddIndexer (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if err := idx.WatchScript(script); err != nil {
+			t.Errorf("WatchScript (%s): %v", dbType, err)
+		}
+		if err := idx.WatchOutPoint(coinbase); err != nil {
+			t.Errorf("WatchOutPoint (%s): %v", dbType, err)
+		}
+		scripts, err := btcdb.FetchWatchedScripts(db)
+		if err != nil || !reflect.DeepEqual(scripts, [][]byte{script}) {
+			t.Errorf("FetchWatchedScripts (%s): got %x (err %v), "+
+				"want %x", dbType, scripts, err, script)
+		}
+
+		if _, err := db.InsertBlocks(blocks[100:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkHistory(dbType, db, int64(len(blocks)-1))
+
+		keepSha, _ := blocks[181].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+		}
+		checkHistory(dbType, db, 181)
+		if _, err := db.InsertBlocks(blocks[182:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+		}
+		checkHistory(dbType, db, int64(len(blocks)-1))
+		checkPages(dbType, db, int64(len(blocks)-1))
+
+		if err := idx.UnwatchScript(script); err != nil {
+			t.Errorf("UnwatchScript (%s): %v", dbType, err)
+		}
+		scripts, err = btcdb.FetchWatchedScripts(db)
+		if err != nil || len(scripts) != 0 {
+			t.Errorf("FetchWatchedScripts (%s): got %d scripts (err "+
+				"%v) after UnwatchScript", dbType, len(scripts), err)
+		}
+		events, err := btcdb.FetchWatchHistory(db, script)
+		if err != nil || len(events) != 0 {
+			t.Errorf("FetchWatchHistory (%s): got %d events (err %v) "+
+				"after UnwatchScript", dbType, len(events), err)
+		}
+		teardown()
+	}
+}
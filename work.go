@@ -0,0 +1,54 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb
+
+import (
+	"math/big"
+)
+
+// bigOne is 1 represented as a big.Int.  It is defined here to avoid the
+// overhead of creating it multiple times.
+var bigOne = big.NewInt(1)
+
+// oneLsh256 is 1 shifted left 256 bits.  It is defined here to avoid the
+// overhead of creating it multiple times.
+var oneLsh256 = new(big.Int).Lsh(bigOne, 256)
+
+// compactToBig converts the compact representation of a target difficulty
+// used in the bits field of block headers to a big.Int.  The compact form is
+// a base 256 floating point number with an 8 bit exponent, a sign bit and a
+// 23 bit mantissa.
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+	return bn
+}
+
+// CalcWork returns the expected number of hashes needed to find a block with
+// the given compact target difficulty, which is 2^256 / (target+1).  Summing
+// it over every block of a chain gives the cumulative work of the chain.  A
+// zero or negative target, which no valid block has, contributes no work.
+func CalcWork(bits uint32) *big.Int {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, bigOne)
+	return new(big.Int).Div(oneLsh256, denominator)
+}
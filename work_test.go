@@ -0,0 +1,96 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcdb_test
+
+import (
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcutil"
+	"math/big"
+	"testing"
+)
+
+// TestChainWork ensures the cumulative chain work of every block is the sum of
+// the work of it and every block before it for every supported database type,
+// including after blocks are dropped and inserted again.
+func TestChainWork(t *testing.T) {
+	blocks, err := loadBlocks(t)
+	if err != nil {
+		return
+	}
+
+	// checkWork ensures the work of the passed blocks, which start with
+	// the genesis block, is as expected.
+	checkWork := func(dbType string, db btcdb.Db, blocks []*btcutil.Block) bool {
+		want := new(big.Int)
+		for height, block := range blocks {
+			want.Add(want, btcdb.CalcWork(block.MsgBlock().Header.Bits))
+			sha, _ := block.Sha()
+			got, err := db.FetchChainWorkBySha(sha)
+			if err != nil {
+				t.Errorf("FetchChainWorkBySha (%s): height %d: %v",
+					dbType, height, err)
+				return false
+			}
+			if got.Cmp(want) != 0 {
+				t.Errorf("FetchChainWorkBySha (%s): height %d: "+
+					"got %v, want %v", dbType, height, got, want)
+				return false
+			}
+		}
+		return true
+	}
+
+	// The genesis block has the lowest possible difficulty.
+	genesisWork := btcdb.CalcWork(blocks[0].MsgBlock().Header.Bits)
+	if genesisWork.Cmp(big.NewInt(0x100010001)) != 0 {
+		t.Errorf("CalcWork of genesis block: got %v, want %v",
+			genesisWork, 0x100010001)
+	}
+
+	half := len(blocks) / 2
+	for _, dbType := range btcdb.SupportedDBs() {
+		if _, exists := ignoreDbTypes[dbType]; exists {
+			continue
+		}
+
+		db, teardown, err := createDB(dbType, "chainwork", true)
+		if err != nil {
+			t.Errorf("Failed to create test database (%s) %v", dbType,
+				err)
+			continue
+		}
+		if _, err := db.InsertBlocks(blocks); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		if !checkWork(dbType, db, blocks) {
+			teardown()
+			continue
+		}
+
+		// Dropped blocks must take their work with them.
+		keepSha, _ := blocks[half-1].Sha()
+		if err := db.DropAfterBlockBySha(keepSha); err != nil {
+			t.Errorf("DropAfterBlockBySha (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		droppedSha, _ := blocks[half].Sha()
+		_, err = db.FetchChainWorkBySha(droppedSha)
+		if err != btcdb.ErrBlockNotFound {
+			t.Errorf("FetchChainWorkBySha (%s): unexpected error for "+
+				"dropped block - got %v, want %v", dbType, err,
+				btcdb.ErrBlockNotFound)
+		}
+		if _, err := db.InsertBlocks(blocks[half:]); err != nil {
+			t.Errorf("InsertBlocks (%s): %v", dbType, err)
+			teardown()
+			continue
+		}
+		checkWork(dbType, db, blocks)
+		teardown()
+	}
+}